@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Prediction outcomes and A/B reports
+// ============================================================================
+
+// There is no traffic splitter in the worker: clients run an experiment by
+// sending PREDICT to the models they want to compare, and each model is an
+// arm. Every prediction served by this node is recorded with its latency and
+// output under a request_id returned to the client, which can later report
+// the true label with FEEDBACK (feedback.go). AB_REPORT aggregates those
+// records per model over a time range. Records live in memory on the node
+// that served them.
+
+// predictionLogSize bounds the records kept per model
+const predictionLogSize = 10000
+
+// abMinFeedback is the default number of labelled predictions an arm needs
+// before it can win a report
+const abMinFeedback = 30
+
+var errUnknownRequest = errors.New("unknown request_id")
+
+type predictionRecord struct {
+	requestID string
+	modelID   string
+	at        time.Time
+	latency   time.Duration
+	input     []float64 // nil if the input wasn't numeric
+	output    []float64
+	label     []float64 // set by FEEDBACK
+}
+
+// PredictionLog keeps the recent predictions of each model
+type PredictionLog struct {
+	mu        sync.Mutex
+	byModel   map[string][]*predictionRecord
+	byRequest map[string]*predictionRecord
+}
+
+var predictionLog = &PredictionLog{
+	byModel:   make(map[string][]*predictionRecord),
+	byRequest: make(map[string]*predictionRecord),
+}
+
+// modelIDFromPath returns the model id a model file is stored under, so
+// predictions through an alias count for the model it pointed to
+func modelIDFromPath(modelPath string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(modelPath), "model_"), ".bin")
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Record stores a served prediction and returns its request id. A client
+// supplied id is kept unless it is already in use.
+func (l *PredictionLog) Record(modelID, requestID string, input, output []float64, latency time.Duration) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, taken := l.byRequest[requestID]; requestID == "" || taken {
+		requestID = newRequestID()
+	}
+	rec := &predictionRecord{
+		requestID: requestID,
+		modelID:   modelID,
+		at:        time.Now(),
+		latency:   latency,
+		input:     input,
+		output:    output,
+	}
+
+	records := l.byModel[modelID]
+	if len(records) >= predictionLogSize {
+		delete(l.byRequest, records[0].requestID)
+		records = records[1:]
+	}
+	l.byModel[modelID] = append(records, rec)
+	l.byRequest[requestID] = rec
+	return requestID
+}
+
+// LastUsed returns when this node last served a prediction of modelID
+func (l *PredictionLog) LastUsed(modelID string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if records := l.byModel[modelID]; len(records) > 0 {
+		return records[len(records)-1].at
+	}
+	return time.Time{}
+}
+
+// Feedback attaches the true label to a recorded prediction and returns a
+// copy of the labelled record
+func (l *PredictionLog) Feedback(requestID string, label []float64) (predictionRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, ok := l.byRequest[requestID]
+	if !ok {
+		return predictionRecord{}, errUnknownRequest
+	}
+	if len(label) != len(rec.output) {
+		return predictionRecord{}, fmt.Errorf("label has %d values, prediction had %d", len(label), len(rec.output))
+	}
+	rec.label = label
+	return *rec, nil
+}
+
+// outputClass maps an output vector to a class: the arg-max for several
+// outputs, a 0.5 threshold for a single one
+func outputClass(v []float64) int {
+	if len(v) == 1 {
+		if v[0] >= 0.5 {
+			return 1
+		}
+		return 0
+	}
+	best := 0
+	for i := range v {
+		if v[i] > v[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+// armReport aggregates one model's predictions in [from, to)
+func (l *PredictionLog) armReport(modelID string, from, to time.Time) map[string]interface{} {
+	l.mu.Lock()
+	var records []predictionRecord
+	for _, rec := range l.byModel[modelID] {
+		if !rec.at.Before(from) && rec.at.Before(to) {
+			records = append(records, *rec)
+		}
+	}
+	l.mu.Unlock()
+
+	arm := map[string]interface{}{"model_id": modelID, "predictions": len(records)}
+	if len(records) == 0 {
+		return arm
+	}
+
+	latencies := make([]time.Duration, len(records))
+	var totalLatency time.Duration
+	classes := make(map[string]int)
+	meanOutput := make([]float64, len(records[0].output))
+	labelled, correct := 0, 0
+	var squaredError float64
+	for i, rec := range records {
+		latencies[i] = rec.latency
+		totalLatency += rec.latency
+		classes[strconv.Itoa(outputClass(rec.output))]++
+		if len(rec.output) == len(meanOutput) {
+			for j, v := range rec.output {
+				meanOutput[j] += v / float64(len(records))
+			}
+		}
+		if rec.label != nil {
+			labelled++
+			if outputClass(rec.output) == outputClass(rec.label) {
+				correct++
+			}
+			for j := range rec.label {
+				d := rec.output[j] - rec.label[j]
+				squaredError += d * d / float64(len(rec.label))
+			}
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	arm["latency_ms"] = map[string]float64{
+		"mean": float64((totalLatency / time.Duration(len(records))).Microseconds()) / 1000,
+		"p50":  percentileMs(latencies, 0.50),
+		"p95":  percentileMs(latencies, 0.95),
+		"max":  percentileMs(latencies, 1),
+	}
+	arm["output_classes"] = classes
+	arm["mean_output"] = meanOutput
+	arm["feedback"] = labelled
+	if labelled > 0 {
+		arm["accuracy"] = float64(correct) / float64(labelled)
+		arm["mse"] = squaredError / float64(labelled)
+	}
+	return arm
+}
+
+// Report compares models over [from, to). The winner is the arm with the
+// highest accuracy among those with at least minFeedback labels, ties going
+// to the lower error; without enough feedback no winner is declared.
+func (l *PredictionLog) Report(models []string, from, to time.Time, minFeedback int) map[string]interface{} {
+	arms := make([]map[string]interface{}, 0, len(models))
+	var winner map[string]interface{}
+	for _, id := range models {
+		arm := l.armReport(id, from, to)
+		arms = append(arms, arm)
+
+		labelled, _ := arm["feedback"].(int)
+		if labelled == 0 || labelled < minFeedback {
+			continue
+		}
+		if winner == nil || arm["accuracy"].(float64) > winner["accuracy"].(float64) ||
+			arm["accuracy"].(float64) == winner["accuracy"].(float64) && arm["mse"].(float64) < winner["mse"].(float64) {
+			winner = arm
+		}
+	}
+
+	report := map[string]interface{}{
+		"from":         from.UTC().Format(time.RFC3339),
+		"to":           to.UTC().Format(time.RFC3339),
+		"min_feedback": minFeedback,
+		"arms":         arms,
+		"winner":       nil,
+	}
+	if winner != nil {
+		report["winner"] = winner["model_id"]
+	} else {
+		report["reason"] = fmt.Sprintf("no arm has %d labelled predictions", minFeedback)
+	}
+	return report
+}
+
+// parseReportRange reads an RFC 3339 time range; from defaults to 24h before
+// to, and to to now
+func parseReportRange(fromStr, toStr string) (time.Time, time.Time, error) {
+	to := time.Now()
+	if toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %v", err)
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if fromStr != "" {
+		t, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %v", err)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// canonicalModelID maps a model id or alias to the id its predictions are
+// recorded under. Unknown names are kept, since records outlive models.
+func canonicalModelID(name string) string {
+	if path := findModel(name); path != "" {
+		return modelIDFromPath(path)
+	}
+	return name
+}
+
+func resolveArms(names []string) []string {
+	arms := make([]string, 0, len(names))
+	for _, name := range names {
+		arms = append(arms, canonicalModelID(name))
+	}
+	return arms
+}
+
+// handleABReport serves AB_REPORT {"models": [...], "from", "to", "min_feedback"}
+func handleABReport(conn net.Conn, msg map[string]interface{}) {
+	modelsRaw, _ := msg["models"].([]interface{})
+	var names []string
+	for _, m := range modelsRaw {
+		if s, ok := m.(string); ok && s != "" {
+			names = append(names, s)
+		}
+	}
+	if len(names) == 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing models"})
+		return
+	}
+
+	fromStr, _ := msg["from"].(string)
+	toStr, _ := msg["to"].(string)
+	from, to, err := parseReportRange(fromStr, toStr)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+
+	report := predictionLog.Report(resolveArms(names), from, to, int(numberOr(msg["min_feedback"], abMinFeedback)))
+	report["status"] = "OK"
+	sendResponse(conn, report)
+}
+
+// handleABReportAPI serves GET /api/ab/report?models=a,b[&from=&to=&min_feedback=]
+func handleABReportAPI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var names []string
+	for _, m := range strings.Split(q.Get("models"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			names = append(names, m)
+		}
+	}
+	if len(names) == 0 {
+		http.Error(w, "missing models", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseReportRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minFeedback := abMinFeedback
+	if v := q.Get("min_feedback"); v != "" {
+		if minFeedback, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid min_feedback", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(predictionLog.Report(resolveArms(names), from, to, minFeedback))
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Client API tokens and per-command roles
+// ============================================================================
+
+// Without tokens, anyone who reaches the client port can train or delete
+// models. -api-tokens names a file with one token per line:
+//
+//	# role    token                               name
+//	reader    3f9c...                             dashboards
+//	writer    a71e...                             training-pipeline
+//	admin     c02b...                             ops
+//
+// and every request must then carry one in an "auth" field:
+//
+//	{"type": "PREDICT", "auth": "3f9c...", "model_id": "prod", "input": [...]}
+//
+// Roles are cumulative: a reader can PREDICT, list and inspect models and
+// read jobs, settings and statistics; a writer can also TRAIN, submit and
+// cancel jobs, send FEEDBACK and write the KV store and locks; an admin can
+// also DELETE_MODEL, change settings and membership and compact the log. A
+// missing or unknown token gets E_AUTH, a role too low E_FORBIDDEN. HELLO
+// needs no token, and a message type not listed here needs admin.
+//
+// Nodes send each other SUB_TRAIN, FETCH_MODEL and the like on the client
+// port too. They seal those with the cluster secret (auth.go) and a sealed
+// request is trusted as a node, the only role allowed the internal
+// messages, so a cluster with peers needs -cluster-secret-file as well. A
+// request a follower proxies keeps the client's token and is checked
+// against it by the leader.
+//
+// The monitor takes the same tokens as "Authorization: Bearer <token>" or
+// ?token=<token>: /admin/ needs admin and the rest reader. SIGHUP reads the
+// file again, so tokens can be rotated without a restart.
+
+// Roles, in increasing order of privilege
+const (
+	roleNone = iota
+	roleReader
+	roleWriter
+	roleAdmin
+	roleNode // a peer, by its sealed request
+)
+
+var roleNames = map[int]string{roleReader: "reader", roleWriter: "writer", roleAdmin: "admin", roleNode: "node"}
+
+// requestType describes a client message type: the role it needs and
+// whether it changes replicated state, which maintenance mode refuses
+// (maintenance.go). A type not listed needs admin and counts as mutating,
+// so a new request is refused in maintenance until it is classified here.
+type requestType struct {
+	role     int
+	mutating bool
+}
+
+var requestTypes = map[string]requestType{
+	"HELLO": {role: roleNone},
+
+	"PING":            {role: roleReader},
+	"PREDICT":         {role: roleReader},
+	"PREDICT_BATCH":   {role: roleReader},
+	"LIST_MODELS":     {role: roleReader},
+	"GET_MODEL_INFO":  {role: roleReader},
+	"INSPECT_MODEL":   {role: roleReader},
+	"EXPORT_MODEL":    {role: roleReader},
+	"EVALUATE":        {role: roleReader},
+	"COMPARE_MODELS":  {role: roleReader},
+	"FEEDBACK_STATS":  {role: roleReader},
+	"EXPORT_FEEDBACK": {role: roleReader},
+	"AB_REPORT":       {role: roleReader},
+	"DRIFT_STATUS":    {role: roleReader},
+	"AUDIT_SAMPLES":   {role: roleReader},
+	"GET_SETTINGS":    {role: roleReader},
+	"JOB_STATUS":      {role: roleReader},
+	"JOB_RESULT":      {role: roleReader},
+	"KV_GET":          {role: roleReader},
+	"LOCK_STATUS":     {role: roleReader},
+
+	"TRAIN":            {role: roleWriter, mutating: true},
+	"JOB_SUBMIT":       {role: roleWriter, mutating: true},
+	"CANCEL_TRAIN":     {role: roleWriter, mutating: true},
+	"FEEDBACK":         {role: roleWriter, mutating: true},
+	"AGGREGATE_MODELS": {role: roleWriter, mutating: true},
+	"SET_PREPROCESS":   {role: roleWriter, mutating: true},
+	"KV_PUT":           {role: roleWriter, mutating: true},
+	"KV_DELETE":        {role: roleWriter, mutating: true},
+	"LOCK_ACQUIRE":     {role: roleWriter, mutating: true},
+	"LOCK_RENEW":       {role: roleWriter, mutating: true},
+	"LOCK_RELEASE":     {role: roleWriter, mutating: true},
+	"PUBLISH":          {role: roleWriter, mutating: true},
+	"DISCARD_PENDING":  {role: roleWriter, mutating: true},
+
+	"DELETE_MODEL":       {role: roleAdmin, mutating: true},
+	"QUARANTINE_MODEL":   {role: roleAdmin, mutating: true},
+	"UNQUARANTINE_MODEL": {role: roleAdmin, mutating: true},
+	"SET_SETTINGS":       {role: roleAdmin, mutating: true},
+	"COMPACT_LOG":        {role: roleAdmin, mutating: true},
+	"VERIFY_MODELS":      {role: roleAdmin},
+	"ADD_SERVER":         {role: roleAdmin, mutating: true},
+	"REMOVE_SERVER":      {role: roleAdmin, mutating: true},
+
+	"SUB_TRAIN":     {role: roleNode, mutating: true},
+	"DATASET_PUT":   {role: roleNode, mutating: true},
+	"JOB_EVENT":     {role: roleNode, mutating: true},
+	"FETCH_STATE":   {role: roleNode},
+	"FETCH_MODEL":   {role: roleNode},
+	"GEO_REPLICATE": {role: roleNode, mutating: true},
+}
+
+// requestInfo returns how a client message type is treated
+func requestInfo(msgType string) requestType {
+	if t, ok := requestTypes[msgType]; ok {
+		return t
+	}
+	return requestType{role: roleAdmin, mutating: true}
+}
+
+// apiToken is one line of the tokens file
+type apiToken struct {
+	role int
+	name string
+}
+
+// apiTokens holds the tokens by SHA-256, so a lookup doesn't leak a token
+// through timing; nil while -api-tokens is off
+var apiTokens struct {
+	sync.RWMutex
+	path   string
+	byHash map[[sha256.Size]byte]apiToken
+}
+
+// apiTokensEnabled reports whether requests need a token
+func apiTokensEnabled() bool {
+	apiTokens.RLock()
+	defer apiTokens.RUnlock()
+	return apiTokens.byHash != nil
+}
+
+// loadAPITokens reads the tokens file and installs its tokens
+func loadAPITokens(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	byHash := make(map[[sha256.Size]byte]apiToken)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(stripYAMLComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("%s:%d: expected \"role token [name]\"", path, n)
+		}
+		role := roleNone
+		for r, name := range roleNames {
+			if name == fields[0] && r != roleNode {
+				role = r
+			}
+		}
+		if role == roleNone {
+			return 0, fmt.Errorf("%s:%d: unknown role %q (use reader, writer or admin)", path, n, fields[0])
+		}
+		if len(fields[1]) < 16 {
+			return 0, fmt.Errorf("%s:%d: token shorter than 16 characters", path, n)
+		}
+		hash := sha256.Sum256([]byte(fields[1]))
+		if _, dup := byHash[hash]; dup {
+			return 0, fmt.Errorf("%s:%d: token given twice", path, n)
+		}
+		name := fmt.Sprintf("%s:%d", path, n)
+		if len(fields) > 2 {
+			name = strings.Join(fields[2:], " ")
+		}
+		byHash[hash] = apiToken{role: role, name: name}
+	}
+	if len(byHash) == 0 {
+		return 0, fmt.Errorf("%s: no tokens", path)
+	}
+
+	apiTokens.Lock()
+	apiTokens.path = path
+	apiTokens.byHash = byHash
+	apiTokens.Unlock()
+	return len(byHash), nil
+}
+
+// reloadAPITokens reads the tokens file again, keeping the old tokens if it
+// is broken
+func reloadAPITokens() {
+	apiTokens.RLock()
+	path := apiTokens.path
+	apiTokens.RUnlock()
+	if path == "" {
+		return
+	}
+	n, err := loadAPITokens(path)
+	if err != nil {
+		workerLog.Errorf("api tokens: %v (keeping the previous tokens)", err)
+		return
+	}
+	workerLog.Infof("api tokens: %d loaded from %s", n, path)
+}
+
+// lookupToken returns the token's entry, if it is one
+func lookupToken(token string) (apiToken, bool) {
+	apiTokens.RLock()
+	defer apiTokens.RUnlock()
+	t, ok := apiTokens.byHash[sha256.Sum256([]byte(token))]
+	return t, ok
+}
+
+// authorizeRequest checks a client message's token against the role its
+// type needs, answering E_AUTH or E_FORBIDDEN when it falls short. sealed
+// is true for a request sealed by a peer.
+func authorizeRequest(conn net.Conn, msgType string, msg map[string]interface{}, sealed bool) bool {
+	if !apiTokensEnabled() || sealed {
+		return true
+	}
+	need := requestInfo(msgType).role
+	if need == roleNone {
+		return true
+	}
+
+	token, _ := msg["auth"].(string)
+	entry, ok := lookupToken(token)
+	if !ok {
+		metrics.Inc("auth.rejected", 1)
+		tcpLog.Warnf("Rejected %s from %s: missing or unknown token", msgType, conn.RemoteAddr())
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_AUTH", "message": "Missing or invalid auth token"})
+		return false
+	}
+	if entry.role < need {
+		metrics.Inc("auth.forbidden", 1)
+		tcpLog.Warnf("Refused %s to %s (%s) from %s", msgType, entry.name, roleNames[entry.role], conn.RemoteAddr())
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_FORBIDDEN", "message": fmt.Sprintf("%s needs role %s, the token has %s", msgType, roleNames[need], roleNames[entry.role])})
+		return false
+	}
+	return true
+}
+
+// requireMonitorToken wraps the monitor's handlers with the token check
+func requireMonitorToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiTokensEnabled() || probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		need := roleReader
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			need = roleAdmin
+		}
+		token := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = strings.TrimSpace(bearer)
+		}
+		entry, ok := lookupToken(token)
+		if !ok {
+			metrics.Inc("auth.rejected", 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="worker"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		if entry.role < need {
+			metrics.Inc("auth.forbidden", 1)
+			http.Error(w, fmt.Sprintf("%s needs role %s", r.URL.Path, roleNames[need]), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
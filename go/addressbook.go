@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Address book
+// ============================================================================
+
+// Every node has a client (worker) port and a RAFT port. -peers names both:
+//
+//	-peers 10.0.0.2:9000:10000,10.0.0.3:9000:10000,[fd00::4]:9000:10000
+//
+// The older host:port form is still accepted for clusters whose nodes all
+// keep the same distance between the two ports: the RAFT port is then this
+// node's -raft-port plus the peer's offset from -port, and a warning says
+// so. Members learned from committed MEMBERSHIP configurations, which carry
+// both ports, are added as they are applied, so ADD_SERVER and
+// REMOVE_SERVER may name a known node by its client address alone.
+//
+// RAFT replicates to the book's entries, redirects and /cluster/status
+// turn RAFT addresses into client addresses with it, and ADD_SERVER only
+// falls back to the offset for nodes it has never heard of.
+//
+// A node's file service port (-file-port) may follow as a fourth port,
+// host:client_port:raft_port:file_port. Nodes also report it in their RAFT
+// replies, so it only needs listing for nodes not yet heard from.
+
+// AddressBook maps each node's RAFT address to its client address
+type AddressBook struct {
+	mu     sync.RWMutex
+	self   Peer
+	byRaft map[string]Peer // keyed by RaftAddress()
+	files  map[string]int  // file service ports, keyed by RaftAddress()
+}
+
+var addressBook = &AddressBook{byRaft: make(map[string]Peer), files: make(map[string]int)}
+
+// RaftAddress is the host:port peers send RAFT RPCs to, in the form RAFT
+// keys its per-peer state by
+func (p Peer) RaftAddress() string {
+	return fmt.Sprintf("%s:%d", p.Host, p.Port)
+}
+
+// ClientAddress is the host:port the node serves clients on
+func (p Peer) ClientAddress() string {
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.WorkerPort))
+}
+
+// SetSelf records this node's own addresses, against which legacy peer
+// entries are resolved
+func (b *AddressBook) SetSelf(p Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.self = p
+	b.byRaft[p.RaftAddress()] = p
+}
+
+// Add records a node, replacing what was known for its RAFT address
+func (b *AddressBook) Add(p Peer) {
+	if p.Host == "" || p.Port <= 0 || p.WorkerPort <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.byRaft[p.RaftAddress()] = p
+}
+
+// Lookup returns the node with the given RAFT address
+func (b *AddressBook) Lookup(raftAddr string) (Peer, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	p, ok := b.byRaft[raftAddr]
+	return p, ok
+}
+
+// LookupClient returns the node serving clients on host:port
+func (b *AddressBook) LookupClient(host string, port int) (Peer, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, p := range b.byRaft {
+		if p.Host == host && p.WorkerPort == port {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// ClientAddress returns the client address of the node at raftAddr
+func (b *AddressBook) ClientAddress(raftAddr string) (string, bool) {
+	p, ok := b.Lookup(raftAddr)
+	if !ok {
+		return "", false
+	}
+	return p.ClientAddress(), true
+}
+
+// SetFilePort records the port the node at p's RAFT address serves files on
+func (b *AddressBook) SetFilePort(p Peer, port int) {
+	if port <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[p.RaftAddress()] = port
+}
+
+// FileAddress returns the address p serves files on, if it is known
+func (b *AddressBook) FileAddress(p Peer) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	port, ok := b.files[p.RaftAddress()]
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(p.Host, strconv.Itoa(port)), true
+}
+
+// Entries lists every known node, this one included, by RAFT address
+func (b *AddressBook) Entries() []Peer {
+	b.mu.RLock()
+	entries := make([]Peer, 0, len(b.byRaft))
+	for _, p := range b.byRaft {
+		entries = append(entries, p)
+	}
+	b.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RaftAddress() < entries[j].RaftAddress() })
+	return entries
+}
+
+// derivedRaftPort is the RAFT port of a node known only by its client
+// port, assuming it keeps the same offset as this node
+func (b *AddressBook) derivedRaftPort(clientPort int) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.self.Port + (clientPort - b.self.WorkerPort)
+}
+
+// Resolve fills in the RAFT port of host:clientPort from the book, or from
+// this node's offset when the node is unknown; derived reports the latter
+func (b *AddressBook) Resolve(host string, clientPort int) (p Peer, derived bool) {
+	if p, ok := b.LookupClient(host, clientPort); ok {
+		return p, false
+	}
+	return Peer{Host: host, Port: b.derivedRaftPort(clientPort), WorkerPort: clientPort}, true
+}
+
+// parsePeerSpec parses one -peers entry, host:clientPort:raftPort with an
+// optional :filePort, or the legacy host:clientPort. IPv6 hosts go in
+// brackets.
+func (b *AddressBook) parsePeerSpec(spec string) (p Peer, filePort int, legacy bool, err error) {
+	host, rest := spec, ""
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 || end+1 < len(spec) && spec[end+1] != ':' {
+			return Peer{}, 0, false, fmt.Errorf("peer %q: bad IPv6 address", spec)
+		}
+		host, rest = spec[1:end], strings.TrimPrefix(spec[end+1:], ":")
+	} else if i := strings.Index(spec, ":"); i >= 0 {
+		host, rest = spec[:i], spec[i+1:]
+	}
+	if host == "" || rest == "" {
+		return Peer{}, 0, false, fmt.Errorf("peer %q: use host:client_port:raft_port", spec)
+	}
+
+	ports := strings.Split(rest, ":")
+	if len(ports) > 3 {
+		return Peer{}, 0, false, fmt.Errorf("peer %q: use host:client_port:raft_port", spec)
+	}
+	nums := make([]int, len(ports))
+	for i, s := range ports {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > 65535 {
+			return Peer{}, 0, false, fmt.Errorf("peer %q: invalid port %q", spec, s)
+		}
+		nums[i] = n
+	}
+	if len(nums) == 1 {
+		p, _ = b.Resolve(host, nums[0])
+		return p, 0, true, nil
+	}
+	if len(nums) == 3 {
+		filePort = nums[2]
+	}
+	return Peer{Host: host, Port: nums[1], WorkerPort: nums[0]}, filePort, false, nil
+}
+
+// ParsePeers parses the -peers list, adds its nodes to the book and
+// returns them. Legacy entries are returned in legacy.
+func (b *AddressBook) ParsePeers(list string) (peers []Peer, legacy []string, err error) {
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		p, filePort, old, err := b.parsePeerSpec(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if old {
+			legacy = append(legacy, spec)
+		}
+		b.Add(p)
+		b.SetFilePort(p, filePort)
+		peers = append(peers, p)
+	}
+	return peers, legacy, nil
+}
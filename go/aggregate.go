@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================================
+// Model aggregation
+// ============================================================================
+
+// AGGREGATE_MODELS merges N committed models into a new one on the leader:
+//
+//	{"type": "AGGREGATE_MODELS", "model_ids": ["a", "b"], "weights": [3, 1],
+//	 "method": "average"}
+//	-> {"status": "OK", "model_id": "...", "method": "average", "session": "..."}
+//
+// "average" is federated averaging: every weight and bias is the weighted
+// mean of the models', so the models must have the same shape and should
+// descend from the same starting point (fine-tuned copies of one model).
+// "ensemble" keeps every model's hidden units side by side and averages the
+// output logits; it accepts any models with the same input and output
+// sizes, and is what distributed training uses for chunks trained from
+// independent random starts. Weights default to equal and are normalized.
+
+// Aggregation methods
+const (
+	AggregateAverage  = "average"
+	AggregateEnsemble = "ensemble"
+)
+
+// aggregateNetworks merges nets with the given method; weights must sum to 1
+func aggregateNetworks(nets []*goNetwork, weights []float64, method string) (*goNetwork, error) {
+	switch method {
+	case AggregateAverage:
+		return averageNetworks(nets, weights)
+	case AggregateEnsemble:
+		return ensembleNetworks(nets, weights)
+	}
+	return nil, fmt.Errorf("unknown aggregation method %q (want %s or %s)", method, AggregateAverage, AggregateEnsemble)
+}
+
+// normalizeWeights scales weights to sum to 1; nil means equal weights
+func normalizeWeights(weights []float64, n int) ([]float64, error) {
+	if weights == nil {
+		weights = make([]float64, n)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != n {
+		return nil, fmt.Errorf("%d weights for %d models", len(weights), n)
+	}
+	var sum float64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, errors.New("weights must not be negative")
+		}
+		sum += w
+	}
+	if sum == 0 {
+		return nil, errors.New("weights must not all be zero")
+	}
+	normalized := make([]float64, n)
+	for i, w := range weights {
+		normalized[i] = w / sum
+	}
+	return normalized, nil
+}
+
+// averageNetworks returns the weighted mean of networks of identical shape
+func averageNetworks(nets []*goNetwork, weights []float64) (*goNetwork, error) {
+	if len(nets) == 0 {
+		return nil, errors.New("no networks to merge")
+	}
+	shape := fmt.Sprint(nets[0].sizes())
+	for i, n := range nets {
+		if fmt.Sprint(n.sizes()) != shape {
+			return nil, fmt.Errorf("network %d has shape %v, network 0 has %s; use %s for different shapes", i, n.sizes(), shape, AggregateEnsemble)
+		}
+	}
+
+	merged := &goNetwork{modelID: newUUID(), learningRate: nets[0].learningRate}
+	for l, first := range nets[0].layers {
+		layer := mlpLayer{Weights: make([][]float64, len(first.Weights)), Bias: make([]float64, len(first.Bias))}
+		for i := range layer.Weights {
+			layer.Weights[i] = make([]float64, len(first.Bias))
+		}
+		for k, n := range nets {
+			src := n.layers[l]
+			for i, row := range src.Weights {
+				for j, v := range row {
+					layer.Weights[i][j] += v * weights[k]
+				}
+			}
+			for j, b := range src.Bias {
+				layer.Bias[j] += b * weights[k]
+			}
+		}
+		merged.layers = append(merged.layers, layer)
+	}
+	return merged, nil
+}
+
+// ensembleNetworks builds one network whose output is the sigmoid of the
+// weighted sum of the networks' output logits. The hidden layers of the
+// networks sit side by side: the first hidden layer concatenates their
+// units, deeper hidden layers are block-diagonal, and the output layer
+// scales each network's weights and biases by its weight.
+func ensembleNetworks(nets []*goNetwork, weights []float64) (*goNetwork, error) {
+	if len(nets) == 0 {
+		return nil, errors.New("no networks to merge")
+	}
+	depth := len(nets[0].layers)
+	for i, n := range nets {
+		if len(n.layers) != depth || n.sizes()[0] != nets[0].sizes()[0] || n.sizes()[depth] != nets[0].sizes()[depth] {
+			return nil, fmt.Errorf("network %d has shape %v, network 0 has %v", i, n.sizes(), nets[0].sizes())
+		}
+	}
+
+	merged := &goNetwork{modelID: newUUID(), learningRate: nets[0].learningRate}
+	for l := 0; l < depth; l++ {
+		var layer mlpLayer
+		switch {
+		case l == 0:
+			// same inputs, hidden units side by side
+			layer.Weights = make([][]float64, len(nets[0].layers[0].Weights))
+			for _, n := range nets {
+				for i, row := range n.layers[0].Weights {
+					layer.Weights[i] = append(layer.Weights[i], row...)
+				}
+				layer.Bias = append(layer.Bias, n.layers[0].Bias...)
+			}
+		case l < depth-1:
+			// each network only sees its own units of the previous layer
+			cols := 0
+			for _, n := range nets {
+				cols += len(n.layers[l].Bias)
+			}
+			col := 0
+			for _, n := range nets {
+				for _, row := range n.layers[l].Weights {
+					wide := make([]float64, cols)
+					copy(wide[col:], row)
+					layer.Weights = append(layer.Weights, wide)
+				}
+				layer.Bias = append(layer.Bias, n.layers[l].Bias...)
+				col += len(n.layers[l].Bias)
+			}
+		}
+		if l == depth-1 {
+			// weighted sum of the networks' logits
+			layer.Bias = make([]float64, len(nets[0].layers[l].Bias))
+			for k, n := range nets {
+				out := n.layers[l]
+				for _, row := range out.Weights {
+					scaled := make([]float64, len(row))
+					for j, v := range row {
+						scaled[j] = v * weights[k]
+					}
+					layer.Weights = append(layer.Weights, scaled)
+				}
+				for j, b := range out.Bias {
+					layer.Bias[j] += b * weights[k]
+				}
+			}
+		}
+		merged.layers = append(merged.layers, layer)
+	}
+	if err := merged.validate(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// handleAggregateModels merges committed models on the leader and commits
+// the result as a new MODEL_TRAINED, like a finished training
+func handleAggregateModels(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	idsRaw, _ := msg["model_ids"].([]interface{})
+	method, _ := msg["method"].(string)
+	if method == "" {
+		method = AggregateAverage
+	}
+	if len(idsRaw) < 2 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "model_ids needs at least two models"})
+		return
+	}
+
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	var weights []float64
+	if raw, ok := msg["weights"].([]interface{}); ok {
+		for _, w := range raw {
+			f, ok := w.(float64)
+			if !ok {
+				sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "weights must be numbers"})
+				return
+			}
+			weights = append(weights, f)
+		}
+	}
+	weights, err := normalizeWeights(weights, len(idsRaw))
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+
+	tcpLog.Infof("AGGREGATE_MODELS request: %d models, method=%s", len(idsRaw), method)
+
+	nets := make([]*goNetwork, len(idsRaw))
+	sources := make([]string, len(idsRaw))
+	for i, raw := range idsRaw {
+		id, _ := raw.(string)
+		path := findModel(id)
+		if id == "" || path == "" {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("Model not found: %v", raw)})
+			return
+		}
+		if nets[i], err = loadGoNetwork(path); err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("Cannot read model %s: %v", id, err)})
+			return
+		}
+		sources[i] = modelStateMachine.ResolveAlias(id)
+		if _, ok := modelStateMachine.ModelPath(sources[i]); !ok {
+			sources[i] = modelIDFromPath(path)
+		}
+	}
+
+	merged, err := aggregateNetworks(nets, weights, method)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	modelPath := filepath.Join(modelsDir, fmt.Sprintf("model_agg%d.bin", time.Now().UnixNano()%100000000))
+	if err := merged.Save(modelPath); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Cannot save model: " + err.Error()})
+		return
+	}
+	if err := reserveName(merged.modelID, modelOwner(modelPath)); err != nil {
+		os.Remove(modelPath)
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Cannot register model: " + err.Error()})
+		return
+	}
+
+	sizes := merged.sizes()
+	meta := &ModelMetadata{
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		Creator:    raftNode.id,
+		Backend:    modelBackend,
+		InputSize:  sizes[0],
+		OutputSize: sizes[len(sizes)-1],
+	}
+	if sum, err := fileSHA256(modelPath); err == nil {
+		meta.SHA256 = sum
+	}
+	if err := replicateModelFile(modelPath); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_NOT_COMMITTED", "message": "Cannot replicate model file: " + err.Error()})
+		return
+	}
+	index, err := replicateCommand(&ModelTrainedCommand{ModelID: merged.modelID, ModelPath: modelPath, Metadata: meta})
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	metrics.Inc("models.aggregated", 1)
+	sendResponse(conn, map[string]interface{}{
+		"status":   "OK",
+		"model_id": merged.modelID,
+		"method":   method,
+		"sources":  sources,
+		"session":  sessionToken(index),
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Prediction audit sampling
+// ============================================================================
+
+// FEEDBACK only sees the predictions a client labels. To watch the quality
+// of a model in production, each node can also keep a random sample of the
+// PREDICTs it serves: with -audit-sample-rate 0.01 about one prediction in a
+// hundred is appended, input and output, to <storage>/audit/<model>.jsonl.
+// A writer goroutine does the appending through a bounded queue, so the
+// sample never delays the answer; when the queue is full the sample is
+// dropped (metric audit.dropped). Each file keeps the newest
+// -audit-max-samples, trimmed by a quarter when full.
+//
+// With -audit-anonymize the samples carry no request_id, their time is
+// truncated to the hour and inputs and outputs are rounded to
+// auditAnonymizeDigits significant digits.
+//
+//	{"type": "AUDIT_SAMPLES", "model_id": "prod", "limit": 500}
+//
+// answers the newest samples as a data set (inputs, outputs) ready to be
+// labelled for a retraining, with the PSI of every feature against the
+// model's training statistics (drift.go). GET /api/audit/{model} on the
+// monitor serves the same. Like FEEDBACK, the samples are local to the node
+// that served the predictions.
+
+const (
+	auditQueueSize       = 1024
+	auditAnonymizeDigits = 3
+	auditDefaultLimit    = 1000
+)
+
+// AuditSample is one sampled prediction
+type AuditSample struct {
+	At        string    `json:"at"`
+	RequestID string    `json:"request_id,omitempty"`
+	Input     []float64 `json:"input"`
+	Output    []float64 `json:"output"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+type auditRecord struct {
+	modelID string
+	sample  AuditSample
+}
+
+// PredictionAudit samples served predictions into per-model files under dir
+type PredictionAudit struct {
+	dir        string
+	rate       float64
+	anonymize  bool
+	maxSamples int
+	queue      chan auditRecord
+
+	mu     sync.Mutex
+	counts map[string]int // samples in each model's file, once known
+}
+
+// predictionAudit is nil when sampling is off
+var predictionAudit *PredictionAudit
+
+// NewPredictionAudit samples a fraction rate of the predictions, keeping at
+// most maxSamples per model
+func NewPredictionAudit(dir string, rate float64, anonymize bool, maxSamples int) *PredictionAudit {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		storageLog.Errorf("audit: cannot create %s: %v", dir, err)
+	}
+	if maxSamples <= 0 {
+		maxSamples = 10000
+	}
+	return &PredictionAudit{
+		dir:        dir,
+		rate:       rate,
+		anonymize:  anonymize,
+		maxSamples: maxSamples,
+		queue:      make(chan auditRecord, auditQueueSize),
+		counts:     make(map[string]int),
+	}
+}
+
+func (a *PredictionAudit) path(modelID string) string {
+	return filepath.Join(a.dir, modelID+".jsonl")
+}
+
+// Sample queues a served prediction with probability rate. Predictions
+// whose input wasn't numeric are skipped.
+func (a *PredictionAudit) Sample(modelID, requestID string, input, output []float64, latency time.Duration) {
+	if a == nil || len(input) == 0 || !safeBaseName(modelID) {
+		return
+	}
+	if rand.Float64() >= a.rate {
+		return
+	}
+
+	now := time.Now().UTC()
+	s := AuditSample{
+		At:        now.Format(time.RFC3339Nano),
+		RequestID: requestID,
+		Input:     input,
+		Output:    output,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if a.anonymize {
+		s.At = now.Truncate(time.Hour).Format(time.RFC3339)
+		s.RequestID = ""
+		s.Input = roundSignificant(input, auditAnonymizeDigits)
+		s.Output = roundSignificant(output, auditAnonymizeDigits)
+	}
+	select {
+	case a.queue <- auditRecord{modelID: modelID, sample: s}:
+	default:
+		metrics.Inc("audit.dropped", 1)
+	}
+}
+
+// run appends queued samples until stopCh closes
+func (a *PredictionAudit) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case rec := <-a.queue:
+			if err := a.append(rec.modelID, rec.sample); err != nil {
+				storageLog.Warnf("audit: cannot store sample of %s: %v", rec.modelID, err)
+				continue
+			}
+			metrics.Inc("audit.samples", 1)
+		}
+	}
+}
+
+func (a *PredictionAudit) append(modelID string, s AuditSample) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	count, known := a.counts[modelID]
+	if !known {
+		samples, _ := a.readLocked(modelID)
+		count = len(samples)
+	}
+	if count >= a.maxSamples {
+		if count, err = a.trimLocked(modelID, a.maxSamples-a.maxSamples/4); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(a.path(modelID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.counts[modelID] = count + 1
+	return nil
+}
+
+// trimLocked keeps the newest keep samples of a model's file
+func (a *PredictionAudit) trimLocked(modelID string, keep int) (int, error) {
+	samples, err := a.readLocked(modelID)
+	if err != nil {
+		return 0, err
+	}
+	if len(samples) > keep {
+		samples = samples[len(samples)-keep:]
+	}
+	tmp := a.path(modelID) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, s := range samples {
+		enc.Encode(s)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	f.Close()
+	if err := replaceFile(tmp, a.path(modelID)); err != nil {
+		return 0, err
+	}
+	return len(samples), nil
+}
+
+func (a *PredictionAudit) readLocked(modelID string) ([]AuditSample, error) {
+	f, err := os.Open(a.path(modelID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var samples []AuditSample
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var s AuditSample
+		if json.Unmarshal(scanner.Bytes(), &s) == nil && len(s.Input) > 0 {
+			samples = append(samples, s)
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// Samples returns the newest limit samples of a model, oldest first
+func (a *PredictionAudit) Samples(modelID string, limit int) ([]AuditSample, bool) {
+	if a == nil || !safeBaseName(modelID) {
+		return nil, false
+	}
+	a.mu.Lock()
+	samples, err := a.readLocked(modelID)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, false
+	}
+	if limit > 0 && len(samples) > limit {
+		samples = samples[len(samples)-limit:]
+	}
+	return samples, true
+}
+
+// roundSignificant rounds every value to digits significant digits
+func roundSignificant(values []float64, digits int) []float64 {
+	out := make([]float64, len(values))
+	for i, v := range values {
+		if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			out[i] = v
+			continue
+		}
+		scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(math.Abs(v))))
+		out[i] = math.Round(v*scale) / scale
+	}
+	return out
+}
+
+// auditDrift compares sampled inputs with the model's training statistics,
+// or returns nil when the model has none
+func auditDrift(modelID string, samples []AuditSample) map[string]interface{} {
+	baseline, ok := modelStateMachine.InputStats(modelID)
+	if !ok {
+		return nil
+	}
+	hist := make([][]float64, len(baseline.Features))
+	for j := range hist {
+		hist[j] = make([]float64, driftBins+2)
+	}
+	var count float64
+	for _, s := range samples {
+		if len(s.Input) != len(baseline.Features) {
+			continue
+		}
+		count++
+		for j, x := range s.Input {
+			hist[j][baseline.Features[j].bin(x)]++
+		}
+	}
+
+	drift := map[string]interface{}{"samples": int(count), "threshold": inputDriftThreshold, "drifting": false}
+	if count == 0 {
+		return drift
+	}
+	psis := make([]float64, len(hist))
+	var worst float64
+	for j := range hist {
+		psis[j] = psi(baseline.Features[j].Hist, hist[j], count)
+		worst = math.Max(worst, psis[j])
+	}
+	drift["psi"] = psis
+	drift["drifting"] = worst > inputDriftThreshold
+	return drift
+}
+
+// auditReport is the answer to AUDIT_SAMPLES and GET /api/audit/{model}
+func auditReport(name string, limit int) (map[string]interface{}, error) {
+	if predictionAudit == nil {
+		return nil, errAuditOff
+	}
+	modelID := canonicalModelID(name)
+	samples, ok := predictionAudit.Samples(modelID, limit)
+	if !ok {
+		return nil, errNoAuditSamples
+	}
+	inputs := make([][]float64, len(samples))
+	outputs := make([][]float64, len(samples))
+	for i, s := range samples {
+		inputs[i], outputs[i] = s.Input, s.Output
+	}
+	report := map[string]interface{}{
+		"model_id":    modelID,
+		"node":        raftNode.id,
+		"sample_rate": predictionAudit.rate,
+		"anonymized":  predictionAudit.anonymize,
+		"count":       len(samples),
+		"samples":     samples,
+		"inputs":      inputs,
+		"outputs":     outputs,
+	}
+	if drift := auditDrift(modelID, samples); drift != nil {
+		report["drift"] = drift
+	}
+	return report, nil
+}
+
+var (
+	errAuditOff       = errors.New("prediction auditing is off (start with -audit-sample-rate)")
+	errNoAuditSamples = errors.New("no audit samples for model")
+)
+
+// handleAuditSamples serves AUDIT_SAMPLES {"model_id", "limit"}
+func handleAuditSamples(conn net.Conn, msg map[string]interface{}) {
+	name, _ := msg["model_id"].(string)
+	if name == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+	report, err := auditReport(name, int(numberOr(msg["limit"], auditDefaultLimit)))
+	if err != nil {
+		resp := map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		if errors.Is(err, errNoAuditSamples) {
+			resp["code"] = "E_NO_SAMPLES"
+		}
+		sendResponse(conn, resp)
+		return
+	}
+	report["status"] = "OK"
+	sendResponse(conn, report)
+}
+
+// handleAuditAPI serves GET /api/audit/{model}?limit=N
+func handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/audit/")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = auditDefaultLimit
+	}
+	report, err := auditReport(name, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
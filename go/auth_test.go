@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// withClusterSecret sets the cluster secret for the rest of the test
+func withClusterSecret(t *testing.T, secret string) {
+	t.Helper()
+	old := clusterSecret
+	clusterSecret = []byte(secret)
+	t.Cleanup(func() { clusterSecret = old })
+}
+
+func TestSealedRequestRoundTrip(t *testing.T) {
+	withClusterSecret(t, "s3cret")
+	body := []byte(`{"type":"REQUEST_VOTE","term":3}`)
+
+	line, nonce := sealRequest(body)
+	got, gotNonce, err := openRequest(line)
+	if err != nil || !bytes.Equal(got, body) || gotNonce != nonce {
+		t.Fatalf("openRequest = %s, %q, %v; want the body and nonce %q", got, gotNonce, err, nonce)
+	}
+	if _, _, err := openRequest(line); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("replayed request: err = %v, want errUnauthenticated", err)
+	}
+
+	reply := []byte(`{"vote_granted":true}`)
+	got, err = openResponse(sealResponse(reply, nonce), nonce)
+	if err != nil || !bytes.Equal(got, reply) {
+		t.Errorf("openResponse = %s, %v; want the reply", got, err)
+	}
+	if _, err := openResponse(sealResponse(reply, "other"), nonce); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("reply to another request: err = %v, want errUnauthenticated", err)
+	}
+	if _, err := openResponse(reply, nonce); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("plain reply: err = %v, want errUnauthenticated", err)
+	}
+}
+
+func TestOpenRequestRejects(t *testing.T) {
+	withClusterSecret(t, "s3cret")
+	body := []byte(`{"type":"APPEND_ENTRIES"}`)
+	envelope := func(ts int64, nonce, mac string, msg []byte) []byte {
+		out, _ := json.Marshal(authEnvelope{Auth: &authTag{TS: ts, Nonce: nonce, MAC: mac}, Msg: msg})
+		return out
+	}
+	now := time.Now().UnixMilli()
+	stale := time.Now().Add(-2 * authWindow).UnixMilli()
+
+	tests := []struct {
+		name string
+		line []byte
+	}{
+		{name: "plain line", line: body},
+		{name: "tampered message", line: envelope(now, "n1", authMAC("req", now, "n1", body), []byte(`{"type":"REQUEST_VOTE"}`))},
+		{name: "signed as a response", line: envelope(now, "n2", authMAC("resp", now, "n2", body), body)},
+		{name: "stale timestamp", line: envelope(stale, "n3", authMAC("req", stale, "n3", body), body)},
+		{name: "no mac", line: envelope(now, "n4", "", body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := openRequest(tt.line); !errors.Is(err, errUnauthenticated) {
+				t.Errorf("err = %v, want errUnauthenticated", err)
+			}
+		})
+	}
+
+	t.Run("other secret", func(t *testing.T) {
+		withClusterSecret(t, "other")
+		line, _ := sealRequest(body)
+		clusterSecret = []byte("s3cret")
+		if _, _, err := openRequest(line); !errors.Is(err, errUnauthenticated) {
+			t.Errorf("err = %v, want errUnauthenticated", err)
+		}
+	})
+}
+
+func TestOpenRequestWithoutSecret(t *testing.T) {
+	withClusterSecret(t, "")
+	body := []byte(`{"type":"PING"}`)
+	if line, nonce := sealRequest(body); !bytes.Equal(line, body) || nonce != "" {
+		t.Errorf("sealRequest = %s, %q; want the body unchanged", line, nonce)
+	}
+	if got, _, err := openRequest(body); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("plain line: %s, %v", got, err)
+	}
+
+	sealed := seal("req", "n", body)
+	if got, _, err := openRequest(sealed); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("envelope: %s, %v; want it unwrapped", got, err)
+	}
+}
+
+func TestOpenClientRequest(t *testing.T) {
+	withClusterSecret(t, "s3cret")
+	plain := []byte(`{"type":"PREDICT","auth":"token"}`)
+	if got, authenticated, err := openClientRequest(plain); err != nil || authenticated || !bytes.Equal(got, plain) {
+		t.Errorf("token request: %s, %v, %v; want it passed through unauthenticated", got, authenticated, err)
+	}
+
+	body := []byte(`{"type":"GEO_REPLICATE"}`)
+	line, _ := sealRequest(body)
+	if got, authenticated, err := openClientRequest(line); err != nil || !authenticated || !bytes.Equal(got, body) {
+		t.Errorf("sealed request: %s, %v, %v; want it authenticated", got, authenticated, err)
+	}
+}
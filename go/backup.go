@@ -0,0 +1,496 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Backup and Restore
+// ============================================================================
+
+const backupManifestName = "backup_manifest.json"
+
+// BackupManifest describes the contents of a backup archive
+type BackupManifest struct {
+	CreatedAt   string            `json:"created_at"`
+	NodeStorage string            `json:"node_storage"`
+	CurrentTerm int               `json:"current_term"`
+	LogLength   int               `json:"log_length"`
+	Files       map[string]string `json:"files"` // archive path -> sha256
+}
+
+// runBackup implements `worker backup`
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	storage := fs.String("storage-dir", "node0_storage", "Storage directory to back up")
+	raftFlag := fs.String("raft-dir", "", "RAFT state directory (default <storage-dir>)")
+	modelsFlag := fs.String("models-dir", "", "Models directory (default <storage-dir>/models)")
+	out := fs.String("out", "", "Output archive (.tar.gz)")
+	fs.Parse(args)
+
+	raftPath := resolveDir(*raftFlag, *storage, "")
+	modelsPath := resolveDir(*modelsFlag, *storage, "models")
+
+	if *out == "" {
+		return fmt.Errorf("missing -out")
+	}
+
+	// Read the RAFT state first: the checkpoint is replaced atomically and
+	// the write-ahead log only grows, so replaying it gives a consistent
+	// point-in-time copy even while the node is running, archived as a
+	// single checkpoint. Model files are immutable once written, so anything
+	// referenced by the log at this point is already on disk.
+	var stateData []byte
+	state, found, err := readPersistedState(raftPath)
+	if err != nil {
+		return fmt.Errorf("read raft state: %v", err)
+	}
+	if found {
+		state.WALSeq = 0
+		body, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if stateData, err = encodeStateFile(body); err != nil {
+			return err
+		}
+	}
+	// The snapshot is read after the state: if a compaction lands in between,
+	// the restored node sees a snapshot newer than its log and reconciles.
+	snapData, err := os.ReadFile(filepath.Join(raftPath, "raft_snapshot.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read raft snapshot: %v", err)
+	}
+
+	manifest := BackupManifest{
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		NodeStorage: *storage,
+		Files:       make(map[string]string),
+	}
+	if stateData != nil {
+		term, logLen, err := parseRaftStateSummary(stateData)
+		if err != nil {
+			return fmt.Errorf("raft state is corrupt: %v", err)
+		}
+		manifest.CurrentTerm = term
+		manifest.LogLength = logLen
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	if stateData != nil {
+		if err := addTarFile(tw, "raft_state.json", stateData); err != nil {
+			return err
+		}
+		manifest.Files["raft_state.json"] = sha256Hex(stateData)
+	}
+	if snapData != nil {
+		if err := addTarFile(tw, "raft_snapshot.json", snapData); err != nil {
+			return err
+		}
+		manifest.Files["raft_snapshot.json"] = sha256Hex(snapData)
+	}
+
+	// The whole models directory goes in, models.json and the registry files
+	// included; pending models are node-local and partial pulls incomplete
+	models := 0
+	err = filepath.WalkDir(modelsPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == modelsPath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(modelsPath, path)
+		if d.IsDir() {
+			if rel == "pending" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(rel, ".part") || strings.HasSuffix(rel, ".tmp") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %v", path, err)
+		}
+		name := "models/" + filepath.ToSlash(rel)
+		if err := addTarFile(tw, name, data); err != nil {
+			return err
+		}
+		manifest.Files[name] = sha256Hex(data)
+		if strings.HasSuffix(rel, ".bin") {
+			models++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestData, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := addTarFile(tw, backupManifestName, manifestData); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup written to %s (term=%d, log_len=%d, %d models)\n",
+		*out, manifest.CurrentTerm, manifest.LogLength, models)
+	return nil
+}
+
+// runRestore implements `worker restore`
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	storage := fs.String("storage-dir", "node0_storage", "Storage directory to restore into")
+	raftFlag := fs.String("raft-dir", "", "RAFT state directory (default <storage-dir>)")
+	modelsFlag := fs.String("models-dir", "", "Models directory (default <storage-dir>/models)")
+	in := fs.String("in", "", "Backup archive (.tar.gz)")
+	peersStr := fs.String("peers", "", "Comma-separated RAFT addresses (host:raft_port) of the other cluster members; the leader or a majority must agree with the backup (required unless -force)")
+	force := fs.Bool("force", false, "Overwrite existing state and skip cluster conflict checks")
+	secretFile := fs.String("cluster-secret-file", "", "Cluster secret for -peers checks (default: $CLUSTER_SECRET)")
+	fs.Parse(args)
+
+	var err error
+	if clusterSecret, err = loadClusterSecret(*secretFile); err != nil {
+		return fmt.Errorf("read cluster secret: %v", err)
+	}
+
+	if *in == "" {
+		return fmt.Errorf("missing -in")
+	}
+
+	raftPath := resolveDir(*raftFlag, *storage, "")
+	modelsPath := resolveDir(*modelsFlag, *storage, "models")
+
+	if !*force {
+		if _, err := os.Stat(filepath.Join(raftPath, "raft_state.json")); err == nil {
+			return fmt.Errorf("%s already contains RAFT state; use -force to overwrite", raftPath)
+		}
+	}
+
+	files, manifest, err := readBackup(*in)
+	if err != nil {
+		return err
+	}
+
+	for name, sum := range manifest.Files {
+		data, ok := files[name]
+		if !ok {
+			return fmt.Errorf("archive is missing %s", name)
+		}
+		if sha256Hex(data) != sum {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	stateData := files["raft_state.json"]
+	if stateData != nil && !*force {
+		if *peersStr == "" {
+			return fmt.Errorf("missing -peers: the backup must be checked against the live cluster; use -force to restore without cluster checks")
+		}
+		if err := checkRestoreAgainstCluster(stateData, strings.Split(*peersStr, ",")); err != nil {
+			return err
+		}
+	}
+
+	// Every file is staged next to its target and synced first, so a restore
+	// that fails halfway leaves the old state in place
+	targets := make(map[string][]byte)
+	for name, data := range files {
+		switch {
+		case name == "raft_state.json":
+			if data, err = restoredState(data, raftPath); err != nil {
+				return err
+			}
+			targets[filepath.Join(raftPath, name)] = data
+		case name == "raft_snapshot.json":
+			targets[filepath.Join(raftPath, name)] = data
+		case strings.HasPrefix(name, "models/"):
+			targets[filepath.Join(modelsPath, filepath.FromSlash(strings.TrimPrefix(name, "models/")))] = data
+		}
+	}
+	var staged []string
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path + ".restore")
+		}
+	}()
+	for path, data := range targets {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		staged = append(staged, path)
+		if err := writeFileSync(path+".restore", data); err != nil {
+			return fmt.Errorf("stage %s: %v", path, err)
+		}
+	}
+
+	// raft_state.json goes last: once it is in place the node starts from
+	// the backup, and a crash before that leaves the old state whole
+	statePath := filepath.Join(raftPath, stateFileName)
+	sort.Slice(staged, func(i, j int) bool { return staged[j] == statePath && staged[i] != statePath })
+	for _, path := range staged {
+		if err := replaceFile(path+".restore", path); err != nil {
+			return fmt.Errorf("install %s: %v", path, err)
+		}
+	}
+	staged = nil
+
+	// The archive holds a single checkpoint; older generations, write-ahead
+	// log records and a snapshot the backup doesn't have must not be read
+	// with it. The restored checkpoint already skips the old records, so
+	// the node starts correctly even if these survive a crash.
+	leftovers := []string{prevStateFileName, walFileName, prevWALFileName}
+	if _, ok := files["raft_snapshot.json"]; !ok && stateData != nil {
+		leftovers = append(leftovers, "raft_snapshot.json")
+	}
+	for _, name := range leftovers {
+		if err := os.Remove(filepath.Join(raftPath, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	fmt.Printf("Restored %s into %s (models: %s, term=%d, log_len=%d)\n",
+		*in, raftPath, modelsPath, manifest.CurrentTerm, manifest.LogLength)
+	return nil
+}
+
+// restoredState prepares the archived checkpoint for dir. Its vote is
+// replaced with recoveredVote: the node may have voted for someone else in
+// the backup's term since, and must not vote again in it. Its write-ahead
+// log sequence is moved past the records already in dir, so records left
+// over from the old state are never replayed on top of it.
+func restoredState(data []byte, dir string) ([]byte, error) {
+	body, err := decodeStateFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("raft state is corrupt: %v", err)
+	}
+	state := persistedState{SnapshotIndex: -1}
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("raft state is corrupt: %v", err)
+	}
+	state.VotedFor = recoveredVote
+	state.WALSeq = max(state.WALSeq, lastWALSeq(dir))
+	if body, err = json.Marshal(state); err != nil {
+		return nil, err
+	}
+	return encodeStateFile(body)
+}
+
+// checkRestoreAgainstCluster refuses a restore whose log would diverge from the
+// live cluster: the backup may not be ahead of the cluster, and its last entry
+// must carry the same term the cluster has at that index. An index the
+// cluster has already compacted can't be checked and is accepted. The
+// leader's answer decides when it is among the peers; otherwise a majority
+// of the cluster, this node included, must be reachable and agree, since a
+// single follower may lag or sit in a minority partition.
+func checkRestoreAgainstCluster(stateData []byte, peers []string) error {
+	var state struct {
+		CurrentTerm   int        `json:"current_term"`
+		Log           []LogEntry `json:"log"`
+		SnapshotIndex *int       `json:"snapshot_index"`
+		SnapshotTerm  int        `json:"snapshot_term"`
+	}
+	stateData, err := decodeStateFile(stateData)
+	if err != nil {
+		return fmt.Errorf("raft state is corrupt: %v", err)
+	}
+	if err := json.Unmarshal(stateData, &state); err != nil {
+		return fmt.Errorf("raft state is corrupt: %v", err)
+	}
+
+	snapIndex := -1
+	if state.SnapshotIndex != nil {
+		snapIndex = *state.SnapshotIndex
+	}
+	lastIndex := snapIndex + len(state.Log)
+	lastTerm := state.SnapshotTerm
+	if len(state.Log) > 0 {
+		lastTerm = state.Log[len(state.Log)-1].Term
+	}
+
+	// compare reports why the backup doesn't fit a peer's log, if it doesn't
+	compare := func(p string, resp map[string]interface{}) error {
+		liveTerm := int(numberOr(resp["current_term"], 0))
+		liveLen := int(numberOr(resp["log_length"], 0))
+		if state.CurrentTerm > liveTerm {
+			return fmt.Errorf("backup term %d is ahead of live cluster term %d (peer %s)", state.CurrentTerm, liveTerm, p)
+		}
+		if lastIndex+1 > liveLen {
+			return fmt.Errorf("backup log (%d entries) is ahead of live cluster (%d entries, peer %s)", lastIndex+1, liveLen, p)
+		}
+		liveSnapIndex := int(numberOr(resp["snapshot_index"], -1))
+		if lastIndex > liveSnapIndex {
+			liveEntryTerm := int(numberOr(resp["entry_term"], -1))
+			if liveEntryTerm != lastTerm {
+				return fmt.Errorf("backup log conflicts with peer %s at index %d (term %d vs %d)",
+					p, lastIndex, lastTerm, liveEntryTerm)
+			}
+		}
+		return nil
+	}
+
+	quorum := (len(peers)+1)/2 + 1
+	agreed := 1 // this node, whose state the backup becomes
+	var firstErr error
+	for _, p := range peers {
+		host, portStr, ok := strings.Cut(strings.TrimSpace(p), ":")
+		if !ok {
+			continue
+		}
+		port, _ := strconv.Atoi(portStr)
+
+		resp := sendRaftRPC(host, port, map[string]interface{}{
+			"type":  STATE_QUERY,
+			"index": lastIndex,
+		})
+		if resp == nil {
+			fmt.Printf("Peer %s unreachable, skipping\n", p)
+			continue
+		}
+
+		err := compare(p, resp)
+		if resp["state"] == "leader" {
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Leader %s: term=%v log_len=%v, compatible\n", p, resp["current_term"], resp["log_length"])
+			return nil
+		}
+		if err != nil {
+			fmt.Printf("Peer %s: %v\n", p, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		fmt.Printf("Peer %s: term=%v log_len=%v, compatible\n", p, resp["current_term"], resp["log_length"])
+		agreed++
+	}
+	if agreed >= quorum {
+		return nil
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return fmt.Errorf("only %d of the %d nodes needed agree with the backup and no leader answered; use -force to restore without cluster checks", agreed, quorum)
+}
+
+func readBackup(path string) (map[string][]byte, BackupManifest, error) {
+	var manifest BackupManifest
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, manifest, err
+	}
+	tr := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, manifest, err
+		}
+		name := filepath.ToSlash(filepath.Clean(hdr.Name))
+		if strings.HasPrefix(name, "..") || filepath.IsAbs(name) {
+			return nil, manifest, fmt.Errorf("unsafe path in archive: %s", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, manifest, err
+		}
+		files[name] = data
+	}
+
+	manifestData, ok := files[backupManifestName]
+	if !ok {
+		return nil, manifest, fmt.Errorf("archive has no %s", backupManifestName)
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, manifest, fmt.Errorf("invalid manifest: %v", err)
+	}
+	return files, manifest, nil
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func parseRaftStateSummary(data []byte) (int, int, error) {
+	var state struct {
+		CurrentTerm   int               `json:"current_term"`
+		Log           []json.RawMessage `json:"log"`
+		SnapshotIndex *int              `json:"snapshot_index"`
+	}
+	data, err := decodeStateFile(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, 0, err
+	}
+	logLen := len(state.Log)
+	if state.SnapshotIndex != nil {
+		logLen += *state.SnapshotIndex + 1
+	}
+	return state.CurrentTerm, logLen, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func numberOr(v interface{}, def float64) float64 {
+	if f, ok := v.(float64); ok {
+		return f
+	}
+	return def
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Prediction micro-batching
+// ============================================================================
+
+// PredictBatcher groups PREDICT requests for the same model that arrive
+// within a short window into a single backend call, then hands each caller
+// its own row of the result. It trades up to one window of latency for far
+// fewer JVM launches under concurrent load.
+type PredictBatcher struct {
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending map[string]*predictBatch // model path -> open batch
+}
+
+type predictBatch struct {
+	inputs  []string
+	waiters []chan []float64
+	err     error // set before the waiters are answered
+}
+
+// NewPredictBatcher creates a batcher with the given window and batch cap
+func NewPredictBatcher(window time.Duration, maxBatch int) *PredictBatcher {
+	if maxBatch <= 0 {
+		maxBatch = 64
+	}
+	return &PredictBatcher{
+		window:   window,
+		maxBatch: maxBatch,
+		pending:  make(map[string]*predictBatch),
+	}
+}
+
+var predictBatcher *PredictBatcher
+
+// Predict queues one input and blocks until its batch has run or ctx is done.
+// It returns nil if the backend call failed, and an error if the batch never
+// ran or ctx ended first.
+func (b *PredictBatcher) Predict(ctx context.Context, modelPath, inputStr string) ([]float64, error) {
+	ch := make(chan []float64, 1)
+
+	b.mu.Lock()
+	batch, ok := b.pending[modelPath]
+	if !ok {
+		batch = &predictBatch{}
+		b.pending[modelPath] = batch
+		time.AfterFunc(b.window, func() { b.flush(modelPath, batch) })
+	}
+	batch.inputs = append(batch.inputs, inputStr)
+	batch.waiters = append(batch.waiters, ch)
+	full := len(batch.inputs) >= b.maxBatch
+	b.mu.Unlock()
+
+	if full {
+		b.flush(modelPath, batch)
+	}
+	select {
+	case output := <-ch:
+		return output, batch.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush closes a batch (once) and runs it
+func (b *PredictBatcher) flush(modelPath string, batch *predictBatch) {
+	b.mu.Lock()
+	if b.pending[modelPath] != batch {
+		b.mu.Unlock()
+		return // already flushed
+	}
+	delete(b.pending, modelPath)
+	b.mu.Unlock()
+
+	metrics.Inc("predict.batches", 1)
+	metrics.Inc("predict.batched_inputs", int64(len(batch.inputs)))
+
+	ctx, cancel := sharedContext()
+	defer cancel()
+	results, err := limitedPrediction(modelPath, func() [][]float64 {
+		if len(batch.inputs) == 1 {
+			return [][]float64{runJavaPrediction(ctx, modelPath, batch.inputs[0])}
+		}
+		return runJavaPredictionBatch(ctx, modelPath, batch.inputs)
+	})
+	batch.err = err
+
+	for i, ch := range batch.waiters {
+		if i < len(results) {
+			ch <- results[i]
+		} else {
+			ch <- nil
+		}
+	}
+}
+
+// runJavaPredictionBatch runs the backend predict_batch mode for several
+// inputs against one model load
+func runJavaPredictionBatch(ctx context.Context, modelPath string, inputs []string) [][]float64 {
+	javaLog.Debugf("Running: predict_batch %s (%d inputs)", modelPath, len(inputs))
+
+	defer metrics.Since("java.predict_batch", time.Now())
+	output, err := runJava(ctx, nil, "predict_batch", modelPath, strings.Join(inputs, ";"))
+	if err != nil {
+		javaLog.Errorf("Java batch prediction error: %v", err)
+		metrics.Inc("java.predict_errors", 1)
+		return nil
+	}
+
+	results := make([][]float64, len(inputs))
+	for _, line := range splitLines(string(output)) {
+		if !strings.HasPrefix(line, "PREDICTION[") {
+			continue
+		}
+		end := strings.Index(line, "]:")
+		if end < 0 {
+			continue
+		}
+		idx, err := strconv.Atoi(line[len("PREDICTION["):end])
+		if err != nil || idx < 0 || idx >= len(results) {
+			continue
+		}
+		results[idx] = parsePrediction(line[end+2:])
+	}
+	return results
+}
+
+// parsePrediction parses a comma-separated list of output values
+func parsePrediction(predStr string) []float64 {
+	var result []float64
+	for _, v := range strings.Split(predStr, ",") {
+		var f float64
+		fmt.Sscanf(strings.TrimSpace(v), "%f", &f)
+		result = append(result, f)
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ============================================================================
+// Training cancellation
+// ============================================================================
+
+// CANCEL_TRAIN stops a training on the leader, whether a plain TRAIN or a
+// JOB_SUBMIT job:
+//
+//	{"type": "CANCEL_TRAIN", "job_id": "12345678"}
+//	-> {"status": "OK", "job_id": "12345678", "state": "cancelled"}
+//
+// A running training has its context cancelled: a one-off JVM is killed with
+// its whole process group, the Java bridge is asked to interrupt the command
+// and the Go backend stops at the next epoch. Its temporary files and model
+// are removed as for a client that went away, and distributed chunks stop
+// when their SUB_TRAIN connections close. The TRAIN client gets E_CANCELLED;
+// a job is recorded as cancelled in the job store. A job still queued is
+// recorded as cancelled and never starts.
+
+// errTrainCancelled is the cause of a training stopped by CANCEL_TRAIN
+var errTrainCancelled = errors.New("training cancelled")
+
+// trainingRegistry tracks the trainings running on this node by job id
+type trainingRegistry struct {
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+}
+
+var runningTrainings = &trainingRegistry{running: make(map[string]context.CancelCauseFunc)}
+
+// Start registers job and returns its cancellable context; call done when
+// the training returns
+func (r *trainingRegistry) Start(ctx context.Context, jobID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	r.mu.Lock()
+	r.running[jobID] = cancel
+	r.mu.Unlock()
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.running, jobID)
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Cancel stops a running training and reports whether there was one
+func (r *trainingRegistry) Cancel(jobID string) bool {
+	r.mu.Lock()
+	cancel, ok := r.running[jobID]
+	r.mu.Unlock()
+	if ok {
+		cancel(errTrainCancelled)
+	}
+	return ok
+}
+
+// cancelledResponse is the answer of a training stopped by CANCEL_TRAIN
+func cancelledResponse(jobID string) map[string]interface{} {
+	return map[string]interface{}{"status": "ERROR", "code": "E_CANCELLED", "job_id": jobID, "message": "Training cancelled"}
+}
+
+func handleCancelTrain(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	jobID, _ := msg["job_id"].(string)
+	if !safeBaseName(jobID) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid job_id"})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	tcpLog.Infof("CANCEL_TRAIN request: %s", jobID)
+
+	if runningTrainings.Cancel(jobID) {
+		metrics.Inc("train.cancelled", 1)
+		jobEvents.Record(jobID, JobCancelled, nil)
+		sendResponse(conn, map[string]interface{}{"status": "OK", "job_id": jobID, "state": JobStateCancelled})
+		return
+	}
+	if jobManager != nil && jobManager.holds(jobID) {
+		if job, ok := modelStateMachine.Job(jobID); ok && job.State == JobStateQueued {
+			if _, err := recordJob(&JobCommand{JobID: jobID, Event: jobEntryCancelled, Node: raftNode.id, Result: cancelledResponse(jobID)}); err != nil {
+				sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+				return
+			}
+			metrics.Inc("jobs.cancelled", 1)
+			jobEvents.Record(jobID, JobCancelled, nil)
+			sendResponse(conn, map[string]interface{}{"status": "OK", "job_id": jobID, "state": JobStateCancelled})
+			return
+		}
+	}
+
+	if job, ok := modelStateMachine.Job(jobID); ok && job.finished() {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_JOB_FINISHED", "job_id": jobID, "state": job.State, "message": "Job already finished"})
+		return
+	}
+	sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_JOB_NOT_FOUND", "message": "No such training running on the leader"})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Chunk model garbage collection
+// ============================================================================
+
+// ChunkArtifact is a partial model produced by SUB_TRAIN
+type ChunkArtifact struct {
+	JobID     string    `json:"job_id,omitempty"`
+	ChunkID   int       `json:"chunk_id"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	MergedAt  time.Time `json:"merged_at,omitempty"`
+}
+
+// ChunkRegistry tracks chunk lineage so partial models can be deleted once
+// the merged model is committed. Chunks whose job is never merged (or that
+// arrived without a job id) are collected after orphanTTL.
+type ChunkRegistry struct {
+	path      string
+	grace     time.Duration
+	orphanTTL time.Duration
+
+	mu     sync.Mutex
+	chunks []ChunkArtifact
+}
+
+var chunkRegistry *ChunkRegistry
+
+// NewChunkRegistry loads the lineage file from dir
+func NewChunkRegistry(dir string, grace, orphanTTL time.Duration) *ChunkRegistry {
+	r := &ChunkRegistry{
+		path:      filepath.Join(dir, "chunk_lineage.json"),
+		grace:     grace,
+		orphanTTL: orphanTTL,
+	}
+	if data, err := os.ReadFile(r.path); err == nil {
+		if err := json.Unmarshal(data, &r.chunks); err != nil {
+			storageLog.Warnf("chunk gc: ignoring unreadable %s: %v", r.path, err)
+		}
+	}
+	return r
+}
+
+// Register records a chunk model written by SUB_TRAIN
+func (r *ChunkRegistry) Register(jobID string, chunkID int, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, ChunkArtifact{
+		JobID:     jobID,
+		ChunkID:   chunkID,
+		Path:      path,
+		CreatedAt: time.Now(),
+	})
+	r.save()
+}
+
+// MarkMerged starts the grace period for every chunk of a committed job
+func (r *ChunkRegistry) MarkMerged(jobID string) {
+	if jobID == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for i := range r.chunks {
+		if r.chunks[i].JobID == jobID && r.chunks[i].MergedAt.IsZero() {
+			r.chunks[i].MergedAt = time.Now()
+			changed = true
+		}
+	}
+	if changed {
+		r.save()
+	}
+}
+
+// save persists the registry; callers hold r.mu
+func (r *ChunkRegistry) save() {
+	data, err := json.Marshal(r.chunks)
+	if err != nil {
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		storageLog.Errorf("chunk gc: error writing lineage: %v", err)
+		return
+	}
+	replaceFile(tmp, r.path)
+}
+
+// Collect deletes expired chunk artifacts and returns how many were removed
+func (r *ChunkRegistry) Collect() int {
+	now := time.Now()
+
+	r.mu.Lock()
+	var keep []ChunkArtifact
+	var expired []string
+	known := make(map[string]bool)
+	for _, c := range r.chunks {
+		merged := !c.MergedAt.IsZero() && now.Sub(c.MergedAt) >= r.grace
+		orphaned := c.MergedAt.IsZero() && now.Sub(c.CreatedAt) >= r.orphanTTL
+		if merged || orphaned {
+			expired = append(expired, c.Path)
+		} else {
+			keep = append(keep, c)
+			known[filepath.Base(c.Path)] = true
+		}
+	}
+	r.chunks = keep
+	if len(expired) > 0 {
+		r.save()
+	}
+	r.mu.Unlock()
+
+	// Chunk files left behind before lineage tracking existed
+	files, _ := filepath.Glob(filepath.Join(modelsDir, "model_*_chunk*.bin"))
+	for _, f := range files {
+		if known[filepath.Base(f)] {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil && now.Sub(info.ModTime()) >= r.orphanTTL {
+			expired = append(expired, f)
+		}
+	}
+
+	removed := 0
+	for _, p := range expired {
+		if err := os.Remove(p); err == nil {
+			removed++
+			storageLog.Infof("chunk gc: removed %s", p)
+		} else if !os.IsNotExist(err) {
+			storageLog.Errorf("chunk gc: cannot remove %s: %v", p, err)
+		}
+	}
+	if removed > 0 {
+		metrics.Inc("chunk_gc.removed", int64(removed))
+	}
+	return removed
+}
+
+// Run collects periodically until stopCh is closed
+func (r *ChunkRegistry) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			r.Collect()
+		}
+	}
+}
+
+// trackChunkMerges is a state machine hook: a committed MODEL_TRAINED with a
+// job id means that job's chunks are no longer needed
+func trackChunkMerges(index int, cmd Command) {
+	if mt, ok := cmd.(*ModelTrainedCommand); ok && chunkRegistry != nil {
+		chunkRegistry.MarkMerged(mt.JobID)
+	}
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// TrainOptions tunes a Train call
+type TrainOptions struct {
+	// Progress, when set, receives the worker's epochs and, for a
+	// distributed training, chunk completions while the model trains
+	Progress func(Progress)
+	// Constraints, when set, restrict the training to nodes whose labels
+	// have these values (worker -labels)
+	Constraints map[string]string
+	// Pending, when set, keeps the trained model out of the cluster until
+	// Publish; meanwhile the leader that trained it can evaluate it
+	Pending bool
+}
+
+// Progress is one PROGRESS message of a training: an epoch, or with Event
+// "chunk_done" a chunk of a distributed training that finished
+type Progress struct {
+	JobID string `json:"job_id"`
+	// Event is "epoch" or "chunk_done"; workers that only stream epochs
+	// leave it empty
+	Event  string  `json:"event"`
+	Epoch  int     `json:"epoch"`
+	Epochs int     `json:"epochs"`
+	Loss   float64 `json:"loss"`
+	// Chunk completions: the chunk, the node that trained it and how many
+	// of the job's chunks are done
+	ChunkID    int    `json:"chunk_id"`
+	Worker     string `json:"worker"`
+	ChunksDone int    `json:"chunks_done"`
+	Chunks     int    `json:"chunks"`
+}
+
+// TrainResult is the answer to a completed training
+type TrainResult struct {
+	ModelID string `json:"model_id"`
+	JobID   string `json:"job_id"`
+	// Partial is set when some chunks of a distributed training failed and
+	// the model was built from the rest
+	Partial bool `json:"-"`
+	// Pending is set when the model waits for Publish
+	Pending bool `json:"pending,omitempty"`
+	// Raw is the whole answer, for fields not listed here
+	Raw map[string]interface{} `json:"-"`
+}
+
+// ModelInfo is a model's entry in the cluster's registry
+type ModelInfo struct {
+	ModelID      string   `json:"model_id"`
+	File         string   `json:"file,omitempty"`
+	CreatedAt    string   `json:"created_at,omitempty"`
+	Creator      string   `json:"creator,omitempty"`
+	Backend      string   `json:"backend,omitempty"`
+	Samples      int      `json:"samples,omitempty"`
+	InputSize    int      `json:"input_size,omitempty"`
+	OutputSize   int      `json:"output_size,omitempty"`
+	Epochs       int      `json:"epochs,omitempty"`
+	TrainingLoss *float64 `json:"training_loss,omitempty"`
+	SHA256       string   `json:"sha256,omitempty"`
+}
+
+// Train trains a model on the leader and returns its id once it is
+// committed. A training is never sent twice: after a lost answer Train
+// returns the error instead of retrying.
+func (c *Client) Train(ctx context.Context, inputs, outputs [][]float64, opts *TrainOptions) (*TrainResult, error) {
+	if len(inputs) == 0 || len(inputs) != len(outputs) {
+		return nil, fmt.Errorf("client: need as many outputs as inputs, at least one")
+	}
+	req := map[string]interface{}{"type": "TRAIN", "inputs": inputs, "outputs": outputs}
+	if opts != nil && len(opts.Constraints) > 0 {
+		req["constraints"] = opts.Constraints
+	}
+	if opts != nil && opts.Pending {
+		req["publish"] = false
+	}
+	var onProgress func(map[string]interface{})
+	if opts != nil && opts.Progress != nil {
+		req["stream_progress"] = true
+		onProgress = func(msg map[string]interface{}) {
+			var p Progress
+			if decode(msg, &p) == nil {
+				opts.Progress(p)
+			}
+		}
+	}
+
+	resp, err := c.do(ctx, req, c.opts.TrainTimeout, false, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	res := &TrainResult{Raw: resp}
+	if err := decode(resp, res); err != nil {
+		return nil, err
+	}
+	res.Partial = resp["status"] == "PARTIAL"
+	return res, nil
+}
+
+// Publish commits a model trained with TrainOptions.Pending, making it
+// available to Predict, and returns what Train would have. Like Train it is
+// never sent twice.
+func (c *Client) Publish(ctx context.Context, modelID string) (*TrainResult, error) {
+	resp, err := c.do(ctx, map[string]interface{}{"type": "PUBLISH", "model_id": modelID}, c.opts.Timeout, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &TrainResult{Raw: resp}
+	if err := decode(resp, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Discard deletes a model trained with TrainOptions.Pending
+func (c *Client) Discard(ctx context.Context, modelID string) error {
+	_, err := c.do(ctx, map[string]interface{}{"type": "DISCARD_PENDING", "model_id": modelID}, c.opts.Timeout, false, nil)
+	return err
+}
+
+// Predict runs a model on one input, on any node that holds it
+func (c *Client) Predict(ctx context.Context, modelID string, input []float64) ([]float64, error) {
+	resp, err := c.do(ctx, map[string]interface{}{"type": "PREDICT", "model_id": modelID, "input": input}, c.opts.Timeout, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Output []float64 `json:"output"`
+	}
+	if err := decode(resp, &out); err != nil {
+		return nil, err
+	}
+	return out.Output, nil
+}
+
+// listPageSize is the models ListModels asks for per request
+const listPageSize = 500
+
+// ListModels returns the models in the cluster's registry, oldest first. It
+// reads them in pages, so a large registry never comes in one answer.
+func (c *Client) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var models []ModelInfo
+	token := ""
+	for {
+		req := map[string]interface{}{"type": "LIST_MODELS", "limit": listPageSize}
+		if token != "" {
+			req["page_token"] = token
+		}
+		resp, err := c.do(ctx, req, c.opts.Timeout, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Details       []ModelInfo `json:"details"`
+			NextPageToken string      `json:"next_page_token"`
+		}
+		if err := decode(resp, &out); err != nil {
+			return nil, err
+		}
+		models = append(models, out.Details...)
+		if token = out.NextPageToken; token == "" {
+			break
+		}
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		if models[i].CreatedAt != models[j].CreatedAt {
+			return models[i].CreatedAt < models[j].CreatedAt
+		}
+		return models[i].ModelID < models[j].ModelID
+	})
+	return models, nil
+}
+
+// decode converts a generic answer into a typed one
+func decode(resp map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("client: unexpected answer: %v", err)
+	}
+	return nil
+}
+
+// NodeStatus is one node's RAFT state, as it reports it to PING
+type NodeStatus struct {
+	Node        string            `json:"node"` // worker address (host:port)
+	ID          string            `json:"id,omitempty"`
+	State       string            `json:"state,omitempty"` // leader, follower or candidate
+	Term        int               `json:"term,omitempty"`
+	Leader      string            `json:"leader,omitempty"` // worker address of the leader it knows
+	CommitIndex int               `json:"commit_index,omitempty"`
+	LastApplied int               `json:"last_applied,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"` // scheduling labels
+	Error       string            `json:"error,omitempty"`  // set when the node didn't answer
+}
+
+// Status pings every known node, plus the peers they report, and returns
+// their states in that order. A node that can't be reached is listed with
+// Error set; Status fails only if none answers.
+func (c *Client) Status(ctx context.Context) ([]NodeStatus, error) {
+	c.mu.Lock()
+	pending := append([]string(nil), c.nodes...)
+	c.mu.Unlock()
+
+	var nodes []NodeStatus
+	seen := make(map[string]bool)
+	answered := 0
+	for len(pending) > 0 {
+		addr := pending[0]
+		pending = pending[1:]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		st, peers, err := c.ping(ctx, addr)
+		if err != nil {
+			nodes = append(nodes, NodeStatus{Node: addr, Error: err.Error()})
+			continue
+		}
+		answered++
+		nodes = append(nodes, *st)
+		if st.State == "leader" {
+			c.mu.Lock()
+			c.leader = addr
+			c.mu.Unlock()
+		}
+		for _, p := range peers {
+			c.mu.Lock()
+			c.addNodeLocked(p)
+			c.mu.Unlock()
+			pending = append(pending, p)
+		}
+	}
+	if answered == 0 {
+		return nodes, fmt.Errorf("client: no node answered")
+	}
+	return nodes, nil
+}
+
+// ping asks one node for its RAFT state and the worker addresses of its peers
+func (c *Client) ping(ctx context.Context, addr string) (*NodeStatus, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	resp, err := c.send(ctx, addr, map[string]interface{}{"type": "PING"}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out struct {
+		Raft struct {
+			ID          string            `json:"id"`
+			State       string            `json:"state"`
+			Term        int               `json:"term"`
+			CommitIndex int               `json:"commit_index"`
+			LastApplied int               `json:"last_applied"`
+			Labels      map[string]string `json:"labels"`
+			Leader      *struct {
+				Host       string
+				WorkerPort int
+			} `json:"leader"`
+			Peers []struct {
+				Address    string `json:"address"`
+				WorkerPort int    `json:"worker_port"`
+			} `json:"peers"`
+		} `json:"raft"`
+	}
+	if err := decode(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	r := out.Raft
+	st := &NodeStatus{Node: addr, ID: r.ID, State: r.State, Term: r.Term, CommitIndex: r.CommitIndex, LastApplied: r.LastApplied, Labels: r.Labels}
+	if r.Leader != nil && r.Leader.WorkerPort > 0 {
+		st.Leader = net.JoinHostPort(r.Leader.Host, strconv.Itoa(r.Leader.WorkerPort))
+	}
+	var peers []string
+	for _, p := range r.Peers {
+		host, _, err := net.SplitHostPort(p.Address)
+		if err == nil && p.WorkerPort > 0 {
+			peers = append(peers, net.JoinHostPort(host, strconv.Itoa(p.WorkerPort)))
+		}
+	}
+	return st, peers, nil
+}
@@ -0,0 +1,413 @@
+// Package client is a Go client for the worker cluster. It speaks the
+// newline-delimited JSON protocol of the client port, so callers work with
+// typed requests and results:
+//
+//	c, err := client.New([]string{"10.0.0.1:9000", "10.0.0.2:9000"}, client.Options{})
+//	res, err := c.Train(ctx, inputs, outputs, nil)
+//	out, err := c.Predict(ctx, res.ModelID, []float64{1, 0})
+//
+// The client follows REDIRECT answers to the leader and remembers it, learns
+// the other nodes from them, and retries on another node when one can't be
+// reached. It echoes the session token of its last write, so a read on any
+// node observes it (read-your-writes). Requests that aren't wrapped yet go
+// through Do.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options tunes a Client. Zero values take the defaults.
+type Options struct {
+	// Timeout bounds a request that has no deadline of its own (default
+	// 30s). Train uses TrainTimeout (default 10m).
+	Timeout      time.Duration
+	TrainTimeout time.Duration
+	// DialTimeout bounds connecting to a node (default 5s)
+	DialTimeout time.Duration
+	// Retries is how many other attempts a failed request gets (default 3,
+	// negative for none)
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled on each one
+	// (default 200ms)
+	RetryBackoff time.Duration
+	// MaxConnsPerNode bounds the connections open to one node at a time
+	// (default 8)
+	MaxConnsPerNode int
+	// TLS, when set, is used for every connection (workers started with
+	// -tls-cert)
+	TLS *tls.Config
+	// Token is sent as "auth" on every request (workers started with
+	// -api-tokens)
+	Token string
+}
+
+func (o *Options) setDefaults() {
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.TrainTimeout <= 0 {
+		o.TrainTimeout = 10 * time.Minute
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	} else if o.Retries == 0 {
+		o.Retries = 3
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 200 * time.Millisecond
+	}
+	if o.MaxConnsPerNode <= 0 {
+		o.MaxConnsPerNode = 8
+	}
+}
+
+// maxRedirects bounds the REDIRECT answers followed for one attempt
+const maxRedirects = 5
+
+// Error is an ERROR answer from a worker
+type Error struct {
+	Code    string // e.g. E_STALE, E_MODEL_CORRUPT; empty for older errors
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return e.Code + ": " + e.Message
+}
+
+// errNotSent marks failures before the request left the client, which are
+// safe to retry for any request
+var errNotSent = errors.New("request not sent")
+
+// Client sends requests to a cluster. It is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu      sync.Mutex
+	nodes   []string // every known node, seeds first
+	leader  string   // last leader reported by a REDIRECT, "" if unknown
+	session string   // token of the last write, sent with reads
+	slots   map[string]chan struct{}
+}
+
+// New creates a client for the cluster reachable at any of nodes
+// (host:port of worker client ports)
+func New(nodes []string, opts Options) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("client: no nodes")
+	}
+	opts.setDefaults()
+	return &Client{opts: opts, nodes: append([]string(nil), nodes...), slots: make(map[string]chan struct{})}, nil
+}
+
+// Leader returns the last known leader, or "" if none was reported yet
+func (c *Client) Leader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+// Session returns the token of the client's last write
+func (c *Client) Session() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// Do sends a raw request, e.g. {"type": "GET_MODEL_INFO", "model_id": "x"},
+// and returns the final answer. ERROR answers come back as *Error along with
+// the answer. A request other than TRAIN is also retried when its answer is
+// lost, so it may run twice; set Retries negative for ones that must not.
+func (c *Client) Do(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
+	kind, _ := req["type"].(string)
+	timeout := c.opts.Timeout
+	if kind == "TRAIN" {
+		timeout = c.opts.TrainTimeout
+	}
+	return c.do(ctx, req, timeout, kind != "TRAIN", nil)
+}
+
+// do runs req against the cluster. Writes start at the known leader, reads
+// anywhere. idempotent allows retrying after the request may have run.
+func (c *Client) do(ctx context.Context, req map[string]interface{}, timeout time.Duration, idempotent bool, onProgress func(map[string]interface{})) (map[string]interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if session := c.Session(); session != "" {
+		if _, set := req["session"]; !set {
+			req["session"] = session
+		}
+	}
+
+	backoff := c.opts.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		addr := c.pick(attempt)
+		var retryAfter time.Duration
+	redirect:
+		for redirects := 0; ; redirects++ {
+			resp, err := c.send(ctx, addr, req, onProgress)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			switch status, _ := resp["status"].(string); status {
+			case "REDIRECT":
+				leader, ok := c.learn(resp)
+				if !ok || redirects == maxRedirects {
+					return nil, &Error{Code: "E_NO_LEADER", Message: "no leader available"}
+				}
+				addr = leader
+				continue
+			case "SECONDARY":
+				// a busy leader points predictions at followers
+				if secondary, ok := firstAddr(resp["secondaries"]); ok && redirects < maxRedirects {
+					addr = secondary
+					continue
+				}
+				return nil, &Error{Code: "E_BUSY", Message: fmt.Sprint(resp["message"])}
+			case "ERROR":
+				e := &Error{Message: fmt.Sprint(resp["message"])}
+				e.Code, _ = resp["code"].(string)
+				if e.Code == "E_STALE" {
+					// this node is behind our session; the leader isn't
+					if leader, ok := parseAddr(resp["leader"]); ok && redirects < maxRedirects {
+						addr = leader
+						continue
+					}
+				}
+				if ms, ok := resp["retry_after_ms"].(float64); ok && e.Code == "E_QUEUE_FULL" && attempt < c.opts.Retries {
+					// refused by a limit before running: wait as told
+					lastErr, retryAfter = e, time.Duration(ms)*time.Millisecond
+					break redirect
+				}
+				return resp, e
+			}
+			if token, _ := resp["session"].(string); token != "" && !isRead(req) {
+				c.mu.Lock()
+				if sessionIndex(token) > sessionIndex(c.session) {
+					c.session = token
+				}
+				c.mu.Unlock()
+			}
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if retryAfter > 0 {
+			backoff = max(backoff, retryAfter)
+			continue
+		}
+		if !idempotent && !errors.Is(lastErr, errNotSent) {
+			return nil, lastErr
+		}
+		if errors.Is(lastErr, errNotSent) {
+			c.forgetLeader(addr)
+		}
+	}
+	return nil, fmt.Errorf("client: giving up after %d attempts: %w", c.opts.Retries+1, lastErr)
+}
+
+// isRead reports whether a request leaves the session alone; a read's
+// session in the answer is just the one it sent
+func isRead(req map[string]interface{}) bool {
+	switch req["type"] {
+	case "PREDICT", "PREDICT_BATCH", "LIST_MODELS", "GET_MODEL_INFO", "EVALUATE":
+		return true
+	}
+	return false
+}
+
+// sessionIndex returns the log index in a session token ("s1.<index>"), or
+// -1 for none
+func sessionIndex(token string) int {
+	rest, ok := strings.CutPrefix(token, "s1.")
+	if !ok {
+		return -1
+	}
+	index, err := strconv.Atoi(rest)
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// pick chooses the node for an attempt: the leader when known, then the
+// known nodes in turn
+func (c *Client) pick(attempt int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader != "" && attempt == 0 {
+		return c.leader
+	}
+	return c.nodes[attempt%len(c.nodes)]
+}
+
+// learn records the leader and nodes listed in a REDIRECT answer
+func (c *Client) learn(resp map[string]interface{}) (string, bool) {
+	leader, ok := parseAddr(resp["leader"])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.leader = leader
+		c.addNodeLocked(leader)
+	}
+	peers, _ := resp["peers"].([]interface{})
+	for _, p := range peers {
+		peer, _ := p.(map[string]interface{})
+		host, _ := peer["host"].(string)
+		port, _ := peer["worker_port"].(float64)
+		if host != "" && port > 0 {
+			c.addNodeLocked(net.JoinHostPort(host, strconv.Itoa(int(port))))
+		}
+	}
+	return leader, ok
+}
+
+func (c *Client) addNodeLocked(addr string) {
+	for _, n := range c.nodes {
+		if n == addr {
+			return
+		}
+	}
+	c.nodes = append(c.nodes, addr)
+}
+
+func (c *Client) forgetLeader(addr string) {
+	c.mu.Lock()
+	if c.leader == addr {
+		c.leader = ""
+	}
+	c.mu.Unlock()
+}
+
+// parseAddr reads a [host, port] pair
+func parseAddr(v interface{}) (string, bool) {
+	pair, _ := v.([]interface{})
+	if len(pair) != 2 {
+		return "", false
+	}
+	host, _ := pair[0].(string)
+	port, _ := pair[1].(float64)
+	if host == "" || port <= 0 {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), true
+}
+
+// firstAddr reads the first [host, port] pair of a list
+func firstAddr(v interface{}) (string, bool) {
+	list, _ := v.([]interface{})
+	if len(list) == 0 {
+		return "", false
+	}
+	return parseAddr(list[0])
+}
+
+// acquire takes one of addr's connection slots. A worker answers a single
+// request per connection, so the pool bounds concurrent connections to each
+// node rather than keeping idle ones open.
+func (c *Client) acquire(ctx context.Context, addr string) (func(), error) {
+	c.mu.Lock()
+	slots, ok := c.slots[addr]
+	if !ok {
+		slots = make(chan struct{}, c.opts.MaxConnsPerNode)
+		c.slots[addr] = slots
+	}
+	c.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %v", errNotSent, ctx.Err())
+	}
+}
+
+// send makes one request to addr and reads its final answer, passing any
+// PROGRESS messages before it to onProgress
+func (c *Client) send(ctx context.Context, addr string, req map[string]interface{}, onProgress func(map[string]interface{})) (map[string]interface{}, error) {
+	release, err := c.acquire(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	dialer := &net.Dialer{Timeout: c.opts.DialTimeout}
+	var conn net.Conn
+	if c.opts.TLS != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.opts.TLS}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if c.opts.Token != "" {
+		if _, set := req["auth"]; !set {
+			req["auth"] = c.opts.Token
+		}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%s: %v", addr, err)
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, fmt.Errorf("%s: bad answer: %v", addr, err)
+		}
+		if status, _ := resp["status"].(string); status == "PROGRESS" {
+			if onProgress != nil {
+				onProgress(resp)
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWorker serves the client protocol on a local port: each connection
+// carries one request, answered with the messages handle returns. No
+// messages closes the connection without an answer.
+type fakeWorker struct {
+	addr string
+
+	mu       sync.Mutex
+	requests []map[string]interface{}
+}
+
+func newFakeWorker(t *testing.T, handle func(req map[string]interface{}) []map[string]interface{}) *fakeWorker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	w := &fakeWorker{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				var req map[string]interface{}
+				json.Unmarshal(line, &req)
+				w.mu.Lock()
+				w.requests = append(w.requests, req)
+				w.mu.Unlock()
+				for _, msg := range handle(req) {
+					data, _ := json.Marshal(msg)
+					conn.Write(append(data, '\n'))
+				}
+			}()
+		}
+	}()
+	return w
+}
+
+func (w *fakeWorker) received() []map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]map[string]interface{}(nil), w.requests...)
+}
+
+// hostPort returns addr as the [host, port] pair workers send
+func hostPort(t *testing.T, addr string) []interface{} {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return []interface{}{host, p}
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newTestClient(t *testing.T, nodes ...string) *Client {
+	t.Helper()
+	c, err := New(nodes, Options{Timeout: 5 * time.Second, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func ok(fields map[string]interface{}) []map[string]interface{} {
+	resp := map[string]interface{}{"status": "OK"}
+	for k, v := range fields {
+		resp[k] = v
+	}
+	return []map[string]interface{}{resp}
+}
+
+func TestTrainFollowsRedirectToLeader(t *testing.T) {
+	leader := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return ok(map[string]interface{}{"model_id": "m1", "job_id": "j1"})
+	})
+	follower := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return []map[string]interface{}{{"status": "REDIRECT", "leader": hostPort(t, leader.addr)}}
+	})
+	c := newTestClient(t, follower.addr)
+
+	res, err := c.Train(context.Background(), [][]float64{{0}}, [][]float64{{1}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ModelID != "m1" || res.JobID != "j1" {
+		t.Errorf("result = %+v, want model m1, job j1", res)
+	}
+	if c.Leader() != leader.addr {
+		t.Errorf("Leader() = %q, want %q", c.Leader(), leader.addr)
+	}
+
+	// the next write goes straight to the known leader
+	if _, err := c.Train(context.Background(), [][]float64{{0}}, [][]float64{{1}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(follower.received()); n != 1 {
+		t.Errorf("follower got %d requests, want 1", n)
+	}
+}
+
+func TestTrainStreamsProgress(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return []map[string]interface{}{
+			{"status": "PROGRESS", "job_id": "j1", "epoch": 1, "epochs": 2, "loss": 0.5},
+			{"status": "PROGRESS", "job_id": "j1", "epoch": 2, "epochs": 2, "loss": 0.25},
+			{"status": "PARTIAL", "model_id": "m1", "job_id": "j1"},
+		}
+	})
+	c := newTestClient(t, w.addr)
+
+	var epochs []int
+	res, err := c.Train(context.Background(), [][]float64{{0}}, [][]float64{{1}}, &TrainOptions{
+		Progress: func(p Progress) { epochs = append(epochs, p.Epoch) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(epochs) != 2 || epochs[0] != 1 || epochs[1] != 2 {
+		t.Errorf("progress epochs = %v, want [1 2]", epochs)
+	}
+	if !res.Partial || res.ModelID != "m1" {
+		t.Errorf("result = %+v, want a partial m1", res)
+	}
+	if got := w.received()[0]["stream_progress"]; got != true {
+		t.Errorf("stream_progress = %v, want true", got)
+	}
+}
+
+func TestErrorAnswer(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return []map[string]interface{}{{"status": "ERROR", "code": "E_MODEL_NOT_FOUND", "message": "no such model"}}
+	})
+	c := newTestClient(t, w.addr)
+
+	_, err := c.Predict(context.Background(), "x", []float64{1})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "E_MODEL_NOT_FOUND" || e.Message != "no such model" {
+		t.Errorf("err = %v, want *Error E_MODEL_NOT_FOUND", err)
+	}
+	if n := len(w.received()); n != 1 {
+		t.Errorf("worker got %d requests, want 1: an ERROR answer is final", n)
+	}
+}
+
+func TestReadRetriesOnAnotherNode(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return ok(map[string]interface{}{"output": []float64{0.75}})
+	})
+	c := newTestClient(t, closedAddr(t), w.addr)
+
+	out, err := c.Predict(context.Background(), "m1", []float64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0] != 0.75 {
+		t.Errorf("output = %v, want [0.75]", out)
+	}
+}
+
+func TestTrainNotResentAfterLostAnswer(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		return nil // the connection drops before the answer
+	})
+	c := newTestClient(t, w.addr)
+
+	if _, err := c.Train(context.Background(), [][]float64{{0}}, [][]float64{{1}}, nil); err == nil {
+		t.Fatal("Train succeeded without an answer")
+	}
+	if n := len(w.received()); n != 1 {
+		t.Errorf("worker got %d trainings, want 1", n)
+	}
+}
+
+func TestReadsCarryTheLastWriteSession(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		switch req["type"] {
+		case "TRAIN":
+			return ok(map[string]interface{}{"model_id": "m1", "session": "s1.7"})
+		case "PREDICT":
+			return ok(map[string]interface{}{"output": []float64{1}, "session": "s1.7"})
+		}
+		return ok(map[string]interface{}{"details": []interface{}{}, "session": "s1.3"})
+	})
+	c := newTestClient(t, w.addr)
+
+	if _, err := c.Train(context.Background(), [][]float64{{0}}, [][]float64{{1}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Predict(context.Background(), "m1", []float64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.received()[1]["session"]; got != "s1.7" {
+		t.Errorf("PREDICT session = %v, want s1.7", got)
+	}
+	if _, err := c.Do(context.Background(), map[string]interface{}{"type": "KV_PUT"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Session() != "s1.7" {
+		t.Errorf("Session() = %q, want s1.7: an older token must not replace it", c.Session())
+	}
+}
+
+func TestListModelsReadsEveryPage(t *testing.T) {
+	w := newFakeWorker(t, func(req map[string]interface{}) []map[string]interface{} {
+		if req["page_token"] == nil {
+			return ok(map[string]interface{}{
+				"details":         []map[string]interface{}{{"model_id": "b", "created_at": "2026-01-02"}},
+				"next_page_token": "p2",
+			})
+		}
+		return ok(map[string]interface{}{
+			"details": []map[string]interface{}{{"model_id": "a", "created_at": "2026-01-01"}},
+		})
+	})
+	c := newTestClient(t, w.addr)
+
+	models, err := c.ListModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 2 || models[0].ModelID != "a" || models[1].ModelID != "b" {
+		t.Errorf("models = %+v, want a then b", models)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Cluster view
+// ============================================================================
+
+// /cluster/status on any node's monitor asks every peer for its RAFT state
+// (a PING on its worker port, so peers' monitors needn't be reachable) and
+// answers with one entry per node:
+//
+//	{"leader": "10.0.0.1:9000", "term": 7, "reachable": 3, "nodes": [
+//	  {"address": "10.0.0.1:9000", "self": true, "reachable": true, "state": "leader",
+//	   "term": 7, "log_length": 120, "commit_index": 119, "last_applied": 119, ...},
+//	  {"address": "10.0.0.2:9000", "reachable": true, "state": "follower", ...,
+//	   "match_index": 119, "lag": 0, "rtt_ms": 0.4, "apply_lag": 0},
+//	  {"address": "10.0.0.3:9000", "reachable": false, "error": "dial tcp ...: connection refused"}]}
+//
+// match_index, lag and rtt_ms are the leader's view of a follower's
+// replication and apply_lag how far the node's applied index trails the
+// leader's commit index. "leaders" lists every node claiming leadership
+// when more than one does. /cluster renders the same as a page.
+
+// clusterPingTimeout bounds each peer's answer
+const clusterPingTimeout = 2 * time.Second
+
+// clusterNode is one node of the cluster view
+type clusterNode struct {
+	Address     string      `json:"address"` // worker host:port
+	RaftAddress string      `json:"raft_address,omitempty"`
+	Self        bool        `json:"self,omitempty"`
+	Reachable   bool        `json:"reachable"`
+	Error       string      `json:"error,omitempty"`
+	ID          string      `json:"id,omitempty"`
+	UUID        string      `json:"node_uuid,omitempty"`
+	State       string      `json:"state,omitempty"`
+	Term        int         `json:"term,omitempty"`
+	Leader      *LeaderInfo `json:"leader,omitempty"`
+	LogLength   int         `json:"log_length,omitempty"`
+	Snapshot    int         `json:"snapshot_index,omitempty"`
+	CommitIndex int         `json:"commit_index,omitempty"`
+	LastApplied int         `json:"last_applied,omitempty"`
+	MatchIndex  *int        `json:"match_index,omitempty"`
+	Lag         *int        `json:"lag,omitempty"`
+	RTT         *float64    `json:"rtt_ms,omitempty"`
+	ApplyLag    *int        `json:"apply_lag,omitempty"`
+
+	peers []PeerHealth // as this node reports them
+}
+
+// clusterNodeFromStatus fills a node from its RAFT status
+func clusterNodeFromStatus(n *clusterNode, st RaftStatus) {
+	n.Reachable = true
+	n.ID, n.UUID, n.State, n.Term, n.Leader = st.ID, st.UUID, st.Role, st.Term, st.Leader
+	n.LogLength, n.Snapshot, n.CommitIndex, n.LastApplied = st.LogLength, st.SnapshotIdx, st.CommitIndex, st.LastApplied
+	n.peers = st.Peers
+}
+
+// clusterStatus queries every peer and builds the cluster view
+func clusterStatus(ctx context.Context) map[string]interface{} {
+	st := raftNode.Status()
+	nodes := make([]*clusterNode, 0, len(st.Peers)+1)
+	me := Peer{Host: raftNode.host, Port: raftNode.port, WorkerPort: raftNode.workerPort}
+	self := &clusterNode{Address: me.ClientAddress(), RaftAddress: me.RaftAddress(), Self: true}
+	clusterNodeFromStatus(self, st)
+	nodes = append(nodes, self)
+
+	var wg sync.WaitGroup
+	for _, p := range st.Peers {
+		addr, ok := addressBook.ClientAddress(p.Address)
+		if !ok {
+			continue
+		}
+		n := &clusterNode{Address: addr, RaftAddress: p.Address, UUID: p.UUID}
+		nodes = append(nodes, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := sendClientMessageContext(ctx, n.Address, map[string]interface{}{"type": "PING"}, clusterPingTimeout)
+			if err != nil {
+				n.Error = err.Error()
+				return
+			}
+			var ping struct {
+				Raft *RaftStatus `json:"raft"`
+			}
+			data, _ := json.Marshal(resp)
+			if json.Unmarshal(data, &ping) != nil || ping.Raft == nil {
+				n.Error, _ = resp["message"].(string)
+				if n.Error == "" {
+					n.Error = "unexpected answer to PING"
+				}
+				return
+			}
+			clusterNodeFromStatus(n, *ping.Raft)
+		}()
+	}
+	wg.Wait()
+
+	// The leader of the highest term has the replication view
+	var leader *clusterNode
+	var leaders []string
+	term := 0
+	reachable := 0
+	for _, n := range nodes {
+		if !n.Reachable {
+			continue
+		}
+		reachable++
+		term = max(term, n.Term)
+		if n.State == "leader" {
+			leaders = append(leaders, n.Address)
+			if leader == nil || n.Term > leader.Term {
+				leader = n
+			}
+		}
+	}
+	if leader != nil {
+		for _, n := range nodes {
+			if n.Reachable && n != leader {
+				applyLag := max(leader.CommitIndex-n.LastApplied, 0)
+				n.ApplyLag = &applyLag
+			}
+			for _, h := range leader.peers {
+				if n != leader && (n.UUID != "" && h.UUID == n.UUID || h.Address == n.RaftAddress) {
+					n.MatchIndex, n.Lag, n.RTT = h.MatchIndex, h.Lag, h.RTT
+					if !n.Reachable && n.Error != "" && h.Reachable {
+						n.Error += " (reachable from the leader)"
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(nodes[1:], func(i, j int) bool { return nodes[1+i].Address < nodes[1+j].Address })
+
+	view := map[string]interface{}{
+		"term":      term,
+		"reachable": reachable,
+		"nodes":     nodes,
+	}
+	if leader != nil {
+		view["leader"] = leader.Address
+	}
+	if len(leaders) > 1 {
+		view["leaders"] = leaders
+	}
+	return view
+}
+
+func handleClusterStatusAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clusterStatus(r.Context()))
+}
+
+func handleClusterPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(clusterPage))
+}
+
+const clusterPage = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Cluster Monitor (Go)</title>
+    <style>
+        body { font-family: monospace; background: #1a1a2e; color: #eee; padding: 20px; }
+        h1 { color: #00ff88; }
+        a { color: #00ADD8; }
+        .card { background: #16213e; padding: 15px; margin: 10px 0; border-radius: 8px; }
+        .label { color: #888; }
+        .leader { color: #00ff88; }
+        .follower { color: #ffaa00; }
+        .candidate { color: #ff6b6b; }
+        .down { color: #ff6b6b; }
+        table { border-collapse: collapse; width: 100%; }
+        th, td { text-align: left; padding: 4px 10px; border-bottom: 1px solid #0f0f23; }
+        th { color: #888; font-weight: normal; }
+    </style>
+</head>
+<body>
+    <h1>🌐 Cluster Monitor</h1>
+    <div class="card">
+        <div class="label">Summary</div>
+        <div id="summary">Loading...</div>
+    </div>
+    <div class="card">
+        <div class="label">Nodes</div>
+        <table>
+            <thead><tr><th></th><th>Node</th><th>Role</th><th>Term</th><th>Log</th><th>Commit</th><th>Applied</th><th>Match</th><th>Lag</th><th>RTT</th><th>Apply lag</th></tr></thead>
+            <tbody id="nodes"></tbody>
+        </table>
+    </div>
+    <div><a id="local" href="/">Local node</a></div>
+    <script>
+        document.getElementById('local').href = '/' + location.search;
+        const esc = s => String(s).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+        const val = v => v === undefined || v === null ? '–' : esc(v);
+        async function refresh() {
+            try {
+                const c = await fetch('/cluster/status' + location.search).then(r => r.json());
+                document.getElementById('summary').innerHTML =
+                    'Leader: ' + (c.leader ? '<span class="leader">' + esc(c.leader) + '</span>' : '<span class="down">none</span>') +
+                    ' | Term: ' + c.term + ' | Reachable: ' + c.reachable + '/' + c.nodes.length +
+                    (c.leaders ? ' | <span class="down">several leaders: ' + c.leaders.map(esc).join(', ') + '</span>' : '');
+                document.getElementById('nodes').innerHTML = c.nodes.map(n => n.reachable
+                    ? '<tr><td>🟢</td><td>' + esc(n.address) + (n.self ? ' (this node)' : '') + '</td>' +
+                      '<td class="' + esc(n.state) + '">' + esc(n.state) + '</td><td>' + n.term + '</td>' +
+                      '<td>' + n.log_length + '</td><td>' + n.commit_index + '</td><td>' + n.last_applied + '</td>' +
+                      '<td>' + val(n.match_index) + '</td><td>' + val(n.lag) + '</td>' +
+                      '<td>' + (n.rtt_ms === undefined ? '–' : n.rtt_ms.toFixed(1) + ' ms') + '</td><td>' + val(n.apply_lag) + '</td></tr>'
+                    : '<tr><td>🔴</td><td>' + esc(n.address) + '</td><td class="down" colspan="9">' + esc(n.error || 'unreachable') + '</td></tr>'
+                ).join('');
+            } catch(e) { document.getElementById('summary').textContent = 'Error'; }
+        }
+        refresh();
+        setInterval(refresh, 3000);
+    </script>
+</body>
+</html>`
@@ -0,0 +1,349 @@
+// workerctl talks to a worker cluster from the command line:
+//
+//	workerctl -nodes 10.0.0.1:9000,10.0.0.2:9000 train -inputs data.csv -outputs labels.csv
+//	workerctl predict <model> 1,2,3
+//	workerctl publish <model>
+//	workerctl models
+//	workerctl status
+//
+// Any node of the cluster will do as a seed: requests follow REDIRECT
+// answers to the leader (see package client). -json prints the answers as
+// JSON instead of tables. The nodes default to $WORKER_NODES, then
+// 127.0.0.1:9000, and -token, for workers started with -api-tokens, to
+// $WORKER_TOKEN.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/proyecto-final/worker-go/client"
+)
+
+const usage = `Usage: workerctl [flags] <command> [args]
+
+Commands:
+  train -inputs FILE -outputs FILE [-progress] [-constraints K=V,...] [-pending]
+                                                 train a model on CSV files
+  publish MODEL                                  commit a model trained with -pending
+  discard MODEL                                  delete a model trained with -pending
+  predict MODEL V1,V2,...                        run a model on one input
+  models                                         list the registered models
+  status                                         show every node's RAFT state
+
+Flags:
+`
+
+func main() {
+	nodesFlag := flag.String("nodes", defaultNodes(), "Comma-separated worker addresses (host:port); any node of the cluster")
+	jsonOut := flag.Bool("json", false, "Print answers as JSON")
+	timeout := flag.Duration("timeout", 30*time.Second, "Timeout of a request other than train")
+	trainTimeout := flag.Duration("train-timeout", 10*time.Minute, "Timeout of a training")
+	useTLS := flag.Bool("tls", false, "Connect with TLS (workers started with -tls-cert)")
+	insecure := flag.Bool("tls-insecure", false, "Don't verify the workers' certificates")
+	token := flag.String("token", os.Getenv("WORKER_TOKEN"), "API token sent with every request (workers started with -api-tokens)")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := client.Options{Timeout: *timeout, TrainTimeout: *trainTimeout, Token: *token}
+	if *useTLS {
+		opts.TLS = &tls.Config{InsecureSkipVerify: *insecure}
+	}
+	c, err := client.New(strings.Split(*nodesFlag, ","), opts)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	out := &printer{json: *jsonOut}
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "train":
+		err = runTrain(ctx, c, out, args)
+	case "publish", "discard":
+		err = runPublish(ctx, c, out, flag.Arg(0), args)
+	case "predict":
+		err = runPredict(ctx, c, out, args)
+	case "models":
+		err = runModels(ctx, c, out)
+	case "status":
+		err = runStatus(ctx, c, out)
+	default:
+		fmt.Fprintf(os.Stderr, "workerctl: unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func defaultNodes() string {
+	if nodes := os.Getenv("WORKER_NODES"); nodes != "" {
+		return nodes
+	}
+	return "127.0.0.1:9000"
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "workerctl:", err)
+	os.Exit(1)
+}
+
+func runTrain(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("train", flag.ExitOnError)
+	inputsFile := fs.String("inputs", "", "CSV file with one input per line")
+	outputsFile := fs.String("outputs", "", "CSV file with the expected output of each input")
+	progress := fs.Bool("progress", false, "Print the loss of each epoch and each finished chunk while training")
+	constraintsFlag := fs.String("constraints", "", "Train only on nodes with these labels, key=value,... (e.g. gpu=true)")
+	pending := fs.Bool("pending", false, "Keep the model pending until publish, so it can be evaluated first")
+	fs.Parse(args)
+	if *inputsFile == "" || *outputsFile == "" {
+		return errors.New("train needs -inputs and -outputs")
+	}
+	inputs, err := readCSV(*inputsFile)
+	if err != nil {
+		return err
+	}
+	outputs, err := readCSV(*outputsFile)
+	if err != nil {
+		return err
+	}
+	if len(inputs) != len(outputs) {
+		return fmt.Errorf("%d inputs but %d outputs", len(inputs), len(outputs))
+	}
+
+	opts := &client.TrainOptions{Pending: *pending}
+	if *progress {
+		opts.Progress = func(p client.Progress) {
+			if p.Event == "chunk_done" {
+				fmt.Fprintf(os.Stderr, "chunk %d done on %s  (%d/%d)\n", p.ChunkID, p.Worker, p.ChunksDone, p.Chunks)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "epoch %d/%d  loss %.6f\n", p.Epoch, p.Epochs, p.Loss)
+		}
+	}
+	if opts.Constraints, err = parseLabels(*constraintsFlag); err != nil {
+		return err
+	}
+	start := time.Now()
+	res, err := c.Train(ctx, inputs, outputs, opts)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.print(res.Raw)
+	}
+	fmt.Printf("model %s trained on %d samples in %s\n", res.ModelID, len(inputs), time.Since(start).Round(time.Millisecond))
+	if res.Partial {
+		fmt.Println("warning: some chunks failed, the model was built from the rest")
+	}
+	if res.Pending {
+		fmt.Printf("pending: workerctl publish %s\n", res.ModelID)
+	}
+	return nil
+}
+
+func runPublish(ctx context.Context, c *client.Client, out *printer, command string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s MODEL", command)
+	}
+	if command == "discard" {
+		if err := c.Discard(ctx, args[0]); err != nil {
+			return err
+		}
+		if out.json {
+			return out.print(map[string]interface{}{"model_id": args[0], "discarded": true})
+		}
+		fmt.Printf("model %s discarded\n", args[0])
+		return nil
+	}
+	res, err := c.Publish(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.print(res.Raw)
+	}
+	fmt.Printf("model %s published\n", res.ModelID)
+	return nil
+}
+
+func runPredict(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: predict MODEL V1,V2,...")
+	}
+	input, err := parseRow(args[1])
+	if err != nil {
+		return err
+	}
+	output, err := c.Predict(ctx, args[0], input)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.print(map[string]interface{}{"model_id": args[0], "input": input, "output": output})
+	}
+	fmt.Println(formatRow(output))
+	return nil
+}
+
+func runModels(ctx context.Context, c *client.Client, out *printer) error {
+	models, err := c.ListModels(ctx)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.print(models)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tCREATED\tBACKEND\tSAMPLES\tSHAPE\tLOSS")
+	for _, m := range models {
+		loss := "-"
+		if m.TrainingLoss != nil {
+			loss = strconv.FormatFloat(*m.TrainingLoss, 'f', 6, 64)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d→%d\t%s\n", m.ModelID, m.CreatedAt, m.Backend, m.Samples, m.InputSize, m.OutputSize, loss)
+	}
+	return w.Flush()
+}
+
+func runStatus(ctx context.Context, c *client.Client, out *printer) error {
+	nodes, err := c.Status(ctx)
+	if out.json && nodes != nil {
+		if perr := out.print(nodes); perr != nil {
+			return perr
+		}
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATE\tTERM\tLEADER\tCOMMIT\tAPPLIED\tLABELS")
+	for _, n := range nodes {
+		if n.Error != "" {
+			fmt.Fprintf(w, "%s\tunreachable\t-\t-\t-\t-\t-\t(%s)\n", n.Node, n.Error)
+			continue
+		}
+		leader := n.Leader
+		if leader == "" {
+			leader = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%d\t%s\n", n.Node, n.State, n.Term, leader, n.CommitIndex, n.LastApplied, formatLabels(n.Labels))
+	}
+	if ferr := w.Flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// printer writes answers as tables or, with -json, as indented JSON
+type printer struct {
+	json bool
+}
+
+func (p *printer) print(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readCSV loads one row of numbers per non-empty line, like train_client.py
+func readCSV(path string) ([][]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows [][]float64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row, err := parseRow(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no rows", path)
+	}
+	return rows, nil
+}
+
+// parseRow reads comma-separated numbers
+func parseRow(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	row := make([]float64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", field)
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+// parseLabels reads key=value,key=value
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func formatRow(row []float64) string {
+	fields := make([]string, len(row))
+	for i, v := range row {
+		fields[i] = strconv.FormatFloat(v, 'g', 6, 64)
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{in: "1,2,3", want: []float64{1, 2, 3}},
+		{in: " 0.5 , -1e3", want: []float64{0.5, -1000}},
+		{in: "7", want: []float64{7}},
+		{in: "1,,2", wantErr: true},
+		{in: "1,x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRow(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseRow(%q) = %v, %v; want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "gpu=true", want: map[string]string{"gpu": "true"}},
+		{in: " zone = eu , gpu=true,", want: map[string]string{"zone": "eu", "gpu": "true"}},
+		{in: "empty=", want: map[string]string{"empty": ""}},
+		{in: "gpu", wantErr: true},
+		{in: "=true", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLabels(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseLabels(%q) = %v, %v; want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	if got := formatLabels(map[string]string{"zone": "eu", "gpu": "true"}); got != "gpu=true,zone=eu" {
+		t.Errorf("formatLabels = %q, want labels sorted", got)
+	}
+	if got := formatLabels(nil); got != "-" {
+		t.Errorf("formatLabels(nil) = %q, want -", got)
+	}
+	if got := formatRow([]float64{0.25, 1, 1.0 / 3}); got != "0.25,1,0.333333" {
+		t.Errorf("formatRow = %q", got)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	rows, err := readCSV(write("ok.csv", "1,2\n\n 3,4 \n"))
+	if err != nil || !reflect.DeepEqual(rows, [][]float64{{1, 2}, {3, 4}}) {
+		t.Errorf("readCSV = %v, %v; want [[1 2] [3 4]], blank lines skipped", rows, err)
+	}
+	if _, err := readCSV(write("bad.csv", "1,2\n3,x\n")); err == nil || !strings.Contains(err.Error(), "bad.csv:2") {
+		t.Errorf("bad row: err = %v, want it located at bad.csv:2", err)
+	}
+	if _, err := readCSV(write("empty.csv", "\n\n")); err == nil {
+		t.Error("empty file: want an error")
+	}
+}
+
+func TestTrainChecksItsFiles(t *testing.T) {
+	dir := t.TempDir()
+	inputs := filepath.Join(dir, "in.csv")
+	outputs := filepath.Join(dir, "out.csv")
+	os.WriteFile(inputs, []byte("0,0\n0,1\n1,0\n"), 0644)
+	os.WriteFile(outputs, []byte("0\n1\n"), 0644)
+
+	// both fail before a request is sent, so no client is needed
+	if err := runTrain(context.Background(), nil, &printer{}, nil); err == nil || !strings.Contains(err.Error(), "-inputs") {
+		t.Errorf("no files: err = %v, want a usage error", err)
+	}
+	err := runTrain(context.Background(), nil, &printer{}, []string{"-inputs", inputs, "-outputs", outputs})
+	if err == nil || !strings.Contains(err.Error(), "3 inputs but 2 outputs") {
+		t.Errorf("mismatched files: err = %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// Operator log compaction (COMPACT_LOG)
+// ============================================================================
+
+// Automatic snapshots wait for -snapshot-threshold applied entries. When a
+// large log is filling the disk sooner than that, an operator can compact a
+// node's log at once:
+//
+//	{"type": "COMPACT_LOG"}
+//	{"type": "COMPACT_LOG", "force": true}
+//
+// The node snapshots its state machine at the last index it applied, then
+// asks every peer for its applied index with PING, waiting up to
+// compactPeerWait for slow ones to catch up. Only when all of them have
+// applied the snapshot index is the log discarded up to it, so no peer will
+// ever need those entries and no INSTALL_SNAPSHOT follows. A peer that
+// doesn't answer or stays behind makes it refuse (E_PEER_UNREACHABLE,
+// E_PEER_LAGGING) unless force is set; a lagging peer then catches up from
+// the snapshot, as after any automatic one.
+//
+// The compaction is local to the node that receives the request: run it on
+// every node whose disk is short. POST /admin/compact-log?force=true on the
+// monitor does the same.
+
+// compactPeerWait bounds the wait for peers to apply the snapshot index
+const compactPeerWait = 10 * time.Second
+
+// CompactResult describes a COMPACT_LOG run
+type CompactResult struct {
+	Index       int            `json:"index"`        // last entry covered by the snapshot
+	Discarded   int            `json:"discarded"`    // log entries removed
+	Remaining   int            `json:"remaining"`    // log entries kept
+	PeerApplied map[string]int `json:"peer_applied"` // worker address -> applied index
+	Unreachable []string       `json:"unreachable,omitempty"`
+	Lagging     []string       `json:"lagging,omitempty"`
+	Forced      bool           `json:"forced,omitempty"`
+	Purged      int            `json:"tombstones_purged,omitempty"` // tombstones dropped (tombstones.go)
+}
+
+var (
+	errPeerUnreachable = errors.New("peer unreachable")
+	errPeerLagging     = errors.New("peer has not applied the snapshot index")
+)
+
+// snapshotApplied captures the state machine after the last entry it
+// applied. Holding applyExec keeps the applier from running meanwhile.
+func (rn *RaftNode) snapshotApplied() (int, []byte, error) {
+	rn.applyExec.Lock()
+	defer rn.applyExec.Unlock()
+
+	rn.applyMu.Lock()
+	index := rn.lastApplied
+	if len(rn.applyQueue) > 0 {
+		index = rn.applyQueue[0].index - 1
+	}
+	rn.applyMu.Unlock()
+
+	rn.mu.RLock()
+	sm := rn.stateMachine
+	rn.mu.RUnlock()
+	s, ok := sm.(Snapshotter)
+	if !ok {
+		return 0, nil, errors.New("state machine does not support snapshots")
+	}
+	state, err := s.Snapshot()
+	return index, state, err
+}
+
+// compactTo installs state as the snapshot at index and discards the log up
+// to it. It returns the entries discarded and kept; a state older than the
+// current snapshot discards nothing.
+func (rn *RaftNode) compactTo(index int, state []byte) (int, int, error) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if index <= rn.snapshotIndex {
+		return 0, len(rn.log), nil
+	}
+	if index > rn.lastLogIndex() {
+		return 0, len(rn.log), fmt.Errorf("index %d is past the log (%d)", index, rn.lastLogIndex())
+	}
+	before := len(rn.log)
+	config, _ := rn.configAtLocked(index)
+	if err := rn.compactLocked(index, rn.termAt(index), state, rn.membersLocked(), config); err != nil {
+		return 0, len(rn.log), err
+	}
+	return before - len(rn.log), len(rn.log), nil
+}
+
+// peerApplied asks every peer for its applied index until all of them reach
+// index or compactPeerWait passes
+func peerApplied(index int) (applied map[string]int, unreachable, lagging []string) {
+	applied = make(map[string]int)
+	caughtUp := make(map[string]bool)
+	var addrs []string
+	for _, p := range raftNode.peersSnapshot() {
+		addrs = append(addrs, net.JoinHostPort(p.Host, strconv.Itoa(p.WorkerPort)))
+	}
+
+	deadline := time.Now().Add(compactPeerWait)
+	for {
+		unreachable, lagging = nil, nil
+		for _, addr := range addrs {
+			if caughtUp[addr] {
+				continue
+			}
+			resp, err := sendClientMessage(addr, map[string]interface{}{"type": "PING"}, 2*time.Second)
+			raft, _ := resp["raft"].(map[string]interface{})
+			last, ok := raft["last_applied"].(float64)
+			if err != nil || !ok {
+				unreachable = append(unreachable, addr)
+				continue
+			}
+			applied[addr] = int(last)
+			if caughtUp[addr] = int(last) >= index; !caughtUp[addr] {
+				lagging = append(lagging, addr)
+			}
+		}
+		if len(unreachable)+len(lagging) == 0 || time.Now().After(deadline) {
+			sort.Strings(unreachable)
+			sort.Strings(lagging)
+			return applied, unreachable, lagging
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// compactLog runs COMPACT_LOG on this node
+func compactLog(force bool) (*CompactResult, error) {
+	index, state, err := raftNode.snapshotApplied()
+	if err != nil {
+		return nil, err
+	}
+	res := &CompactResult{Index: index, Forced: force}
+	if index <= raftNode.Status().SnapshotIdx {
+		_, res.Remaining, err = raftNode.compactTo(index, state)
+		return res, err
+	}
+	res.PeerApplied, res.Unreachable, res.Lagging = peerApplied(index)
+	if !force {
+		if len(res.Unreachable) > 0 {
+			return res, fmt.Errorf("%w: %v", errPeerUnreachable, res.Unreachable)
+		}
+		if len(res.Lagging) > 0 {
+			return res, fmt.Errorf("%w (%d): %v", errPeerLagging, index, res.Lagging)
+		}
+	}
+
+	if res.Discarded, res.Remaining, err = raftNode.compactTo(index, state); err != nil {
+		return res, err
+	}
+	metrics.Inc("raft.forced_compactions", 1)
+	raftLog.Infof("COMPACT_LOG: snapshot at index %d, discarded %d log entries (force=%v)", index, res.Discarded, force)
+	if res.Purged, err = purgeTombstones(res); err != nil {
+		raftLog.Warnf("COMPACT_LOG: tombstones kept: %v", err)
+	}
+	return res, nil
+}
+
+func handleCompactLog(conn net.Conn, msg map[string]interface{}) {
+	force, _ := msg["force"].(bool)
+	res, err := compactLog(force)
+	if err != nil {
+		resp := map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		switch {
+		case errors.Is(err, errPeerUnreachable):
+			resp["code"] = "E_PEER_UNREACHABLE"
+		case errors.Is(err, errPeerLagging):
+			resp["code"] = "E_PEER_LAGGING"
+		}
+		if res != nil {
+			resp["index"] = res.Index
+			resp["peer_applied"] = res.PeerApplied
+			resp["unreachable"] = res.Unreachable
+			resp["lagging"] = res.Lagging
+		}
+		sendResponse(conn, resp)
+		return
+	}
+	sendResponse(conn, map[string]interface{}{
+		"status":            "OK",
+		"index":             res.Index,
+		"discarded":         res.Discarded,
+		"remaining":         res.Remaining,
+		"peer_applied":      res.PeerApplied,
+		"unreachable":       res.Unreachable,
+		"lagging":           res.Lagging,
+		"tombstones_purged": res.Purged,
+	})
+}
+
+func handleCompactLogAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	res, err := compactLog(force)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "result": res})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
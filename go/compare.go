@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// ============================================================================
+// COMPARE_MODELS
+// ============================================================================
+
+// COMPARE_MODELS scores two models on the same labelled data set, so a
+// promotion workflow can check a candidate against the model it would
+// replace before pointing an alias at it:
+//
+//	{"type": "COMPARE_MODELS", "model_a": "prod", "model_b": "candidate",
+//	 "inputs": [[...], ...], "outputs": [[...], ...],
+//	 "max_accuracy_drop": 0.01, "max_loss_increase": 0}
+//
+// The data set can also be a dataset descriptor ("dataset": {"dataset_id":
+// ..., "start_row": 0, "end_row": 500}) naming a copy this node holds. Each
+// model gets its own preprocessing of the raw rows. Loss and accuracy are
+// computed like EVALUATE's, from per-sample predictions, and the answer puts
+// them side by side with their difference (b minus a), counts the samples
+// the models classify differently and which of them each got right, and
+// sets "promote" when b loses at most max_accuracy_drop accuracy and gains
+// at most max_loss_increase loss (both default 0: b must be no worse).
+
+// maxCompareSamples bounds the rows of one comparison
+const maxCompareSamples = 10000
+
+// compareListedDisagreements bounds the sample indexes listed in an answer
+const compareListedDisagreements = 100
+
+// comparedModel is one side of a comparison
+type comparedModel struct {
+	ModelID  string  `json:"model_id"`
+	Loss     float64 `json:"loss"`
+	Accuracy float64 `json:"accuracy"`
+	Samples  int     `json:"samples"`
+
+	outputs [][]float64
+}
+
+// sampleAgreement counts how two models' classifications relate
+type sampleAgreement struct {
+	Disagreements    int     `json:"disagreements"`
+	DisagreementRate float64 `json:"disagreement_rate"`
+	BothCorrect      int     `json:"both_correct"`
+	OnlyACorrect     int     `json:"only_a_correct"`
+	OnlyBCorrect     int     `json:"only_b_correct"`
+	BothWrong        int     `json:"both_wrong"`
+	MeanAbsDiff      float64 `json:"mean_abs_diff"` // mean |a-b| over output values
+	Samples          []int   `json:"samples"`       // first disagreeing sample indexes
+}
+
+func handleCompareModels(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	idA, _ := msg["model_a"].(string)
+	idB, _ := msg["model_b"].(string)
+	if idA == "" || idB == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_a or model_b"})
+		return
+	}
+	inputsRaw, _ := msg["inputs"].([]interface{})
+	outputsRaw, _ := msg["outputs"].([]interface{})
+	if desc, ok := msg["dataset"].(map[string]interface{}); ok {
+		var err error
+		if inputsRaw, outputsRaw, err = readDatasetChunk(desc); err != nil {
+			resp := map[string]interface{}{"status": "ERROR", "message": "Cannot read dataset: " + err.Error()}
+			if errors.Is(err, errDatasetUnavailable) {
+				resp["code"] = "E_DATASET_UNAVAILABLE"
+			}
+			sendResponse(conn, resp)
+			return
+		}
+	}
+	if len(inputsRaw) == 0 || len(inputsRaw) != len(outputsRaw) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Need inputs and as many outputs"})
+		return
+	}
+	if len(inputsRaw) > maxCompareSamples {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("At most %d samples per comparison", maxCompareSamples)})
+		return
+	}
+	labels := make([][]float64, len(outputsRaw))
+	for i, r := range outputsRaw {
+		row, _ := r.([]interface{})
+		label, ok := parseNumericInput(row)
+		if !ok || len(label) == 0 {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_BAD_INPUT", "message": fmt.Sprintf("Output %d is not a list of numbers", i)})
+			return
+		}
+		labels[i] = label
+	}
+	maxAccuracyDrop, _ := msg["max_accuracy_drop"].(float64)
+	maxLossIncrease, _ := msg["max_loss_increase"].(float64)
+
+	tcpLog.Infof("COMPARE_MODELS request: %s vs %s, %d samples", idA, idB, len(inputsRaw))
+
+	var sides [2]*comparedModel
+	for i, id := range []string{idA, idB} {
+		modelPath, ok := findServableModel(ctx, conn, msg, id)
+		if !ok {
+			return
+		}
+		if modelPath == "" {
+			modelPath, _ = pendingModels.Path(id)
+		}
+		if modelPath == "" {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found: " + id, "session": currentSession(msg)})
+			return
+		}
+		if !checkModelIntegrity(conn, msg, modelPath) {
+			return
+		}
+		rows := make([][]interface{}, len(inputsRaw))
+		for j, r := range inputsRaw {
+			row, _ := r.([]interface{})
+			rows[j] = append([]interface{}(nil), row...)
+		}
+		if err := preprocessRows(modelPath, rows); err != nil {
+			sendPreprocessError(conn, msg, err)
+			return
+		}
+		outputs := fastPredictBatch(modelPath, rows)
+		var err error
+		if outputs == nil {
+			outputs, err = backendPredictBatch(ctx, modelPath, rows)
+		}
+		if requestTimedOut(conn, ctx, "COMPARE_MODELS") {
+			return
+		}
+		if errors.Is(err, errPredictQueueFull) || errors.Is(err, errPredictQueueTimeout) {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": err.Error()})
+			return
+		}
+		if err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("Prediction with %s failed", id)})
+			return
+		}
+		sides[i] = scoreOutputs(modelStateMachine.ResolveAlias(id), outputs, labels)
+	}
+
+	a, b := sides[0], sides[1]
+	agreement := compareOutputs(a.outputs, b.outputs, labels)
+	diff := map[string]interface{}{"loss": b.Loss - a.Loss, "accuracy": b.Accuracy - a.Accuracy}
+	promote := b.Accuracy >= a.Accuracy-maxAccuracyDrop && b.Loss <= a.Loss+maxLossIncrease
+	metrics.Inc("models.comparisons", 1)
+	sendResponse(conn, map[string]interface{}{
+		"status":    "OK",
+		"model_a":   a,
+		"model_b":   b,
+		"diff":      diff,
+		"agreement": agreement,
+		"promote":   promote,
+		"session":   currentSession(msg),
+	})
+}
+
+// scoreOutputs computes loss (mean squared error per output value) and
+// accuracy the way the backends' evaluate mode does
+func scoreOutputs(modelID string, outputs, labels [][]float64) *comparedModel {
+	var sqError float64
+	values, correct := 0, 0
+	for i, predicted := range outputs {
+		expected := labels[i]
+		for j := 0; j < len(expected) && j < len(predicted); j++ {
+			d := predicted[j] - expected[j]
+			sqError += d * d
+			values++
+		}
+		if len(predicted) > 0 && outputClass(predicted) == outputClass(expected) {
+			correct++
+		}
+	}
+	m := &comparedModel{ModelID: modelID, Samples: len(outputs), outputs: outputs}
+	if values > 0 {
+		m.Loss = sqError / float64(values)
+	}
+	if len(outputs) > 0 {
+		m.Accuracy = float64(correct) / float64(len(outputs))
+	}
+	return m
+}
+
+// compareOutputs relates two models' per-sample predictions
+func compareOutputs(a, b, labels [][]float64) sampleAgreement {
+	agreement := sampleAgreement{Samples: []int{}}
+	var absDiff float64
+	values := 0
+	for i := range labels {
+		classA, classB, want := outputClass(a[i]), outputClass(b[i]), outputClass(labels[i])
+		if classA != classB {
+			agreement.Disagreements++
+			if len(agreement.Samples) < compareListedDisagreements {
+				agreement.Samples = append(agreement.Samples, i)
+			}
+		}
+		switch {
+		case classA == want && classB == want:
+			agreement.BothCorrect++
+		case classA == want:
+			agreement.OnlyACorrect++
+		case classB == want:
+			agreement.OnlyBCorrect++
+		default:
+			agreement.BothWrong++
+		}
+		for j := 0; j < len(a[i]) && j < len(b[i]); j++ {
+			absDiff += math.Abs(a[i][j] - b[i][j])
+			values++
+		}
+	}
+	if len(labels) > 0 {
+		agreement.DisagreementRate = float64(agreement.Disagreements) / float64(len(labels))
+	}
+	if values > 0 {
+		agreement.MeanAbsDiff = absDiff / float64(values)
+	}
+	return agreement
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ============================================================================
+// RAFT RPC compression
+// ============================================================================
+
+// compressionVersion is the protocol version that understands compressed
+// RPC bodies
+const compressionVersion = 3
+
+// maxDecompressedRPC bounds a decompressed RPC body
+const maxDecompressedRPC = 256 << 20
+
+// raftCompressMin is the encoded size from which RPCs are compressed
+// (0 = never)
+var raftCompressMin = 32 * 1024
+
+// compressForPeer wraps an encoded RPC in a gzip envelope when it is large
+// enough and addr is known to speak compressionVersion. Peers whose version
+// hasn't been learned yet get the plain body, so a legacy node never sees an
+// envelope. The envelope keeps "type" for logs; the original message,
+// including its "proto", is inside "body".
+func compressForPeer(addr string, data []byte) []byte {
+	if raftCompressMin <= 0 || len(data) < raftCompressMin || knownPeerProtocol(addr) < compressionVersion {
+		return data
+	}
+
+	var msg struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &msg)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return data
+	}
+
+	wrapped, err := json.Marshal(map[string]interface{}{
+		"type":     msg.Type,
+		"proto":    compressionVersion,
+		"encoding": "gzip",
+		"body":     buf.Bytes(),
+	})
+	if err != nil || len(wrapped) >= len(data) {
+		// base64 costs a third; not worth it for poorly compressible bodies
+		return data
+	}
+	metrics.Inc("raft.compress.raw_bytes", int64(len(data)))
+	metrics.Inc("raft.compress.sent_bytes", int64(len(wrapped)))
+	return wrapped
+}
+
+// decodeEnvelope returns the message carried by a compressed envelope, or msg
+// unchanged if it isn't one
+func decodeEnvelope(msg map[string]interface{}) (map[string]interface{}, error) {
+	encoding, _ := msg["encoding"].(string)
+	if encoding == "" {
+		return msg, nil
+	}
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	encoded, _ := msg["body"].(string)
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecompressedRPC+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDecompressedRPC {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxDecompressedRPC)
+	}
+
+	var inner map[string]interface{}
+	if err := json.Unmarshal(data, &inner); err != nil {
+		return nil, err
+	}
+	return inner, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Configuration file and environment overrides
+// ============================================================================
+
+// Every flag can also come from a file given with -config (or
+// WORKER_CONFIG) and from the environment, so each node of a cluster keeps
+// its settings in one place:
+//
+//	# worker.yaml
+//	host: 10.0.0.1
+//	port: 9000
+//	peers: [10.0.0.2:9000:10000, 10.0.0.3:9000:10000]
+//	storage-dir: /var/lib/worker
+//	backend: go
+//	tls:
+//	  cert: /etc/worker/node.pem
+//	  key: /etc/worker/node-key.pem
+//
+// Keys are flag names; "_" may stand for "-", and a nested block joins its
+// key to the keys under it with "-" (tls: cert: is -tls-cert). Lists become
+// the comma-separated value the flag takes. A file ending in .json holds
+// the same keys as a JSON object. The YAML read here is the subset a flat
+// configuration needs: scalars, quoted strings, comments, [inline] and
+// "- item" lists and one level of nesting.
+//
+// WORKER_<FLAG> variables (WORKER_PORT, WORKER_STORAGE_DIR, ...) override the
+// file, and flags on the command line override both. A key that names no
+// flag or a value the flag rejects stops the worker with an error naming
+// the file, line and key.
+
+// configEnvPrefix starts the environment variable of every flag
+const configEnvPrefix = "WORKER_"
+
+// configPath is the configuration file in use, read again on reload
+// (reload.go); configPinned maps the flags set on the command line or in
+// the environment, which the file can't change, to where they came from
+var (
+	configPath   string
+	configPinned = make(map[string]string)
+)
+
+// configValue is one setting read from a configuration file
+type configValue struct {
+	value string
+	line  int // 0 for JSON
+}
+
+// configEnvName returns the environment variable of a flag
+func configEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configKey normalizes a configuration key to a flag name
+func configKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(key)), "_", "-")
+}
+
+// applyConfig sets the flags not given on the command line from the
+// configuration file and the environment. It runs right after flag.Parse
+// and returns where settings came from, for the startup log.
+func applyConfig(path string) (string, error) {
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+		configPinned[f.Name] = "command line"
+	})
+	if !onCommandLine["config"] {
+		if env := os.Getenv(configEnvName("config")); env != "" {
+			path = env
+		}
+	}
+	configPath = path
+
+	fromFile := 0
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return "", err
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := values[key]
+			where := path
+			if v.line > 0 {
+				where = fmt.Sprintf("%s:%d", path, v.line)
+			}
+			f := flag.Lookup(key)
+			if f == nil || key == "config" {
+				return "", fmt.Errorf("%s: unknown key %q", where, key)
+			}
+			if onCommandLine[key] {
+				continue
+			}
+			if err := f.Value.Set(v.value); err != nil {
+				return "", fmt.Errorf("%s: key %q: invalid value %q: %v", where, key, v.value, err)
+			}
+			fromFile++
+		}
+	}
+
+	fromEnv := 0
+	var envErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := configEnvName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || onCommandLine[f.Name] || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			envErr = fmt.Errorf("%s: invalid value %q for -%s: %v", name, value, f.Name, err)
+			return
+		}
+		configPinned[f.Name] = name
+		fromEnv++
+	})
+	if envErr != nil {
+		return "", envErr
+	}
+
+	var sources []string
+	if path != "" {
+		sources = append(sources, fmt.Sprintf("%d from %s", fromFile, path))
+	}
+	if fromEnv > 0 {
+		sources = append(sources, fmt.Sprintf("%d from %s* variables", fromEnv, configEnvPrefix))
+	}
+	return strings.Join(sources, ", "), nil
+}
+
+// readConfigFile reads a YAML or, by extension, JSON configuration file
+func readConfigFile(path string) (map[string]configValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return parseJSONConfig(path, data)
+	}
+	return parseYAMLConfig(path, data)
+}
+
+func parseJSONConfig(path string, data []byte) (map[string]configValue, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]configValue)
+	var walk func(prefix string, obj map[string]interface{}) error
+	walk = func(prefix string, obj map[string]interface{}) error {
+		for k, v := range obj {
+			key := prefix + configKey(k)
+			if nested, ok := v.(map[string]interface{}); ok {
+				if prefix != "" {
+					return fmt.Errorf("%s: key %q: nested too deep", path, key)
+				}
+				if err := walk(key+"-", nested); err != nil {
+					return err
+				}
+				continue
+			}
+			value, err := jsonConfigValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: key %q: %v", path, key, err)
+			}
+			if _, dup := values[key]; dup {
+				return fmt.Errorf("%s: key %q given twice", path, key)
+			}
+			values[key] = configValue{value: value}
+		}
+		return nil
+	}
+	if err := walk("", doc); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// jsonConfigValue renders a JSON value the way the flag takes it
+func jsonConfigValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := jsonConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported value")
+	}
+}
+
+// yamlBlock is a key with no value on its line: a nested block or a list
+// follows
+type yamlBlock struct {
+	key    string
+	line   int
+	items  []string
+	isList bool
+	isMap  bool
+}
+
+func parseYAMLConfig(path string, data []byte) (map[string]configValue, error) {
+	values := make(map[string]configValue)
+	set := func(key, value string, line int) error {
+		if _, dup := values[key]; dup {
+			return fmt.Errorf("%s:%d: key %q given twice", path, line, key)
+		}
+		values[key] = configValue{value: value, line: line}
+		return nil
+	}
+	// flush records a finished list, or an empty value if nothing followed
+	flush := func(b *yamlBlock) error {
+		if b == nil || b.isMap {
+			return nil
+		}
+		return set(b.key, strings.Join(b.items, ","), b.line)
+	}
+
+	var top, nested *yamlBlock
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		raw := stripYAMLComment(scanner.Text())
+		text := strings.TrimSpace(raw)
+		if text == "" || text == "---" {
+			continue
+		}
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			b := nested
+			if b == nil {
+				b = top
+			}
+			if b == nil || b.isMap {
+				return nil, fmt.Errorf("%s:%d: list item outside a list", path, n)
+			}
+			b.isList = true
+			b.items = append(b.items, yamlScalar(strings.TrimSpace(text[1:])))
+			continue
+		}
+
+		colon := strings.Index(text, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"key: value\"", path, n)
+		}
+		key := configKey(text[:colon])
+		value := strings.TrimSpace(text[colon+1:])
+
+		if err := flush(nested); err != nil {
+			return nil, err
+		}
+		nested = nil
+		if raw[0] != ' ' && raw[0] != '\t' {
+			if err := flush(top); err != nil {
+				return nil, err
+			}
+			top = nil
+			if value == "" {
+				top = &yamlBlock{key: key, line: n}
+				continue
+			}
+		} else {
+			if top == nil || top.isList {
+				return nil, fmt.Errorf("%s:%d: key %q: unexpected indentation", path, n, key)
+			}
+			top.isMap = true
+			key = top.key + "-" + key
+			if value == "" {
+				nested = &yamlBlock{key: key, line: n}
+				continue
+			}
+		}
+
+		if strings.HasPrefix(value, "[") {
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("%s:%d: key %q: unterminated list", path, n, key)
+			}
+			var items []string
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, yamlScalar(item))
+				}
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = yamlScalar(value)
+		}
+		if err := set(key, value, n); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := flush(nested); err != nil {
+		return nil, err
+	}
+	if err := flush(top); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripYAMLComment drops a "#" comment that is not inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar unquotes a scalar
+func yamlScalar(s string) string {
+	if len(s) >= 2 {
+		switch {
+		case s[0] == '"' && s[len(s)-1] == '"':
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		case s[0] == '\'' && s[len(s)-1] == '\'':
+			return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+		}
+	}
+	return s
+}
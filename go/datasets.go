@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Dataset storage for distributed training
+// ============================================================================
+
+// A DatasetStore decides how the chunks of a distributed job reach the
+// workers. The inline store ships every chunk's rows inside SUB_TRAIN. The
+// other two write the data set once, as CSV files named by a dataset id,
+// and each SUB_TRAIN only carries the id and a row range that the worker
+// slices from its copy:
+//
+//	{"type": "SUB_TRAIN", "job_id": "...", "chunk_id": 1,
+//	 "dataset": {"dataset_id": "9f86d0...", "start_row": 500, "end_row": 1000}}
+//
+//   - shared (-shared-dataset-dir): every node mounts the same network
+//     volume and reads the files the leader wrote there.
+//   - replicated (-dataset-store replicated): the leader sends a worker the
+//     files once with DATASET_PUT, the first time a descriptor names a data
+//     set the worker lacks; workers cache them under <storage>/datasets.
+//
+// Rows are written chunk after chunk, so a chunk keeps its interleaved
+// samples and still is one contiguous range. The dataset id is the SHA-256
+// of the files, so retraining on the same data (with the same number of
+// chunks) reuses the copies workers already hold. A worker that can't find
+// a data set answers E_DATASET_UNAVAILABLE; the leader then pushes it
+// (replicated) or sends the rows inline (shared).
+
+// Dataset store kinds for -dataset-store
+const (
+	DatasetsInline     = "inline"
+	DatasetsShared     = "shared"
+	DatasetsReplicated = "replicated"
+)
+
+// DatasetStore publishes a distributed job's chunks for the workers
+type DatasetStore interface {
+	// Name identifies the store in logs and /status
+	Name() string
+	// Publish makes chunks available and returns the SUB_TRAIN fields that
+	// describe each one
+	Publish(jobID string, chunks []datasetChunk) ([]map[string]interface{}, error)
+	// Release drops whatever Publish stored for the job
+	Release(jobID string)
+}
+
+// datasetChunk is one chunk's rows
+type datasetChunk struct {
+	inputs, outputs []interface{}
+}
+
+// datasetStore is the store distributed training uses
+var datasetStore DatasetStore = inlineDatasets{}
+
+// localDatasets caches data sets received with DATASET_PUT, and the
+// leader's own in replicated mode
+var localDatasets *datasetFiles
+
+// inlineDatasets ships every chunk's rows in its SUB_TRAIN
+type inlineDatasets struct{}
+
+func (inlineDatasets) Name() string { return DatasetsInline }
+
+func (inlineDatasets) Publish(jobID string, chunks []datasetChunk) ([]map[string]interface{}, error) {
+	fields := make([]map[string]interface{}, len(chunks))
+	for i, c := range chunks {
+		fields[i] = inlineChunkFields(c)
+	}
+	return fields, nil
+}
+
+func (inlineDatasets) Release(string) {}
+
+func inlineChunkFields(c datasetChunk) map[string]interface{} {
+	return map[string]interface{}{"inputs": c.inputs, "outputs": c.outputs}
+}
+
+// datasetFiles is a directory of data sets, one subdirectory per dataset
+// id holding inputs.csv and outputs.csv. Data sets published by running
+// jobs are pinned; the others are removed once unused for ttl (0 = as soon
+// as the last job releases them).
+type datasetFiles struct {
+	dir string
+	ttl time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]string // job id -> dataset id
+	pins map[string]int    // dataset id -> jobs using it
+}
+
+func newDatasetFiles(dir string, ttl time.Duration) (*datasetFiles, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &datasetFiles{dir: dir, ttl: ttl, jobs: make(map[string]string), pins: make(map[string]int)}, nil
+}
+
+// encodeDataset renders chunks as the two CSV files, chunk after chunk
+func encodeDataset(chunks []datasetChunk) (inputs, outputs []byte) {
+	var in, out bytes.Buffer
+	for _, c := range chunks {
+		writeCSVRows(&in, c.inputs)
+		writeCSVRows(&out, c.outputs)
+	}
+	return in.Bytes(), out.Bytes()
+}
+
+// datasetID names a data set by its contents
+func datasetID(inputs, outputs []byte) string {
+	h := sha256.New()
+	h.Write(inputs)
+	h.Write([]byte{0})
+	h.Write(outputs)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validDatasetID accepts the hex SHA-256 datasetID returns
+func validDatasetID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// path returns a data set file; name is inputs or outputs
+func (f *datasetFiles) path(id, name string) string {
+	return filepath.Join(f.dir, id, name+".csv")
+}
+
+// Has reports whether the data set is stored, refreshing its age
+func (f *datasetFiles) Has(id string) bool {
+	now := time.Now()
+	for _, name := range []string{"inputs", "outputs"} {
+		if err := os.Chtimes(f.path(id, name), now, now); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Put stores a data set unless it is already there. The files are written
+// under a temporary name and renamed, so a reader never sees half of one.
+func (f *datasetFiles) Put(id string, inputs, outputs []byte) error {
+	if !validDatasetID(id) || datasetID(inputs, outputs) != id {
+		return errors.New("dataset contents don't match its id")
+	}
+	f.evict()
+	if f.Has(id) {
+		return nil
+	}
+	tmp, err := os.MkdirTemp(f.dir, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.WriteFile(filepath.Join(tmp, "inputs.csv"), inputs, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "outputs.csv"), outputs, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, id)); err != nil && !f.Has(id) {
+		return err
+	}
+	return nil
+}
+
+// Publish stores the job's data set and pins it until Release
+func (f *datasetFiles) Publish(jobID string, chunks []datasetChunk) ([]map[string]interface{}, error) {
+	inputs, outputs := encodeDataset(chunks)
+	id := datasetID(inputs, outputs)
+	// pinned first, so a concurrent eviction can't remove it
+	f.mu.Lock()
+	f.jobs[jobID] = id
+	f.pins[id]++
+	f.mu.Unlock()
+	if err := f.Put(id, inputs, outputs); err != nil {
+		f.Release(jobID)
+		return nil, err
+	}
+
+	fields := make([]map[string]interface{}, len(chunks))
+	start := 0
+	for i, c := range chunks {
+		fields[i] = map[string]interface{}{"dataset": map[string]interface{}{
+			"dataset_id": id,
+			"start_row":  start,
+			"end_row":    start + len(c.inputs),
+		}}
+		start += len(c.inputs)
+	}
+	return fields, nil
+}
+
+func (f *datasetFiles) Release(jobID string) {
+	f.mu.Lock()
+	id, ok := f.jobs[jobID]
+	delete(f.jobs, jobID)
+	if ok {
+		f.pins[id]--
+		if f.pins[id] <= 0 {
+			delete(f.pins, id)
+		}
+	}
+	f.mu.Unlock()
+	f.evict()
+}
+
+// evict removes data sets that no job pins and nobody used for ttl
+func (f *datasetFiles) evict() {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range entries {
+		id := e.Name()
+		if !validDatasetID(id) || f.pins[id] > 0 {
+			continue
+		}
+		info, err := os.Stat(f.path(id, "inputs"))
+		if err == nil && time.Since(info.ModTime()) < f.ttl {
+			continue
+		}
+		os.RemoveAll(filepath.Join(f.dir, id))
+	}
+}
+
+// sharedDatasets writes data sets to a directory every node mounts
+type sharedDatasets struct {
+	*datasetFiles
+}
+
+// NewSharedDatasets stores data sets under dir, which must be the same
+// network volume on every node. They are removed when their job ends.
+func NewSharedDatasets(dir string) (*sharedDatasets, error) {
+	files, err := newDatasetFiles(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedDatasets{files}, nil
+}
+
+func (s *sharedDatasets) Name() string { return DatasetsShared + ":" + s.dir }
+
+// replicatedDatasets keeps data sets in the leader's dataset cache and
+// pushes them to workers that lack them
+type replicatedDatasets struct {
+	*datasetFiles
+}
+
+func (r *replicatedDatasets) Name() string { return DatasetsReplicated }
+
+// push sends a worker the data set with DATASET_PUT
+func (r *replicatedDatasets) push(ctx context.Context, worker, id string, timeout time.Duration) error {
+	inputs, err := os.ReadFile(r.path(id, "inputs"))
+	if err != nil {
+		return err
+	}
+	outputs, err := os.ReadFile(r.path(id, "outputs"))
+	if err != nil {
+		return err
+	}
+	resp, err := sendClientMessageContext(ctx, worker, map[string]interface{}{
+		"type":        "DATASET_PUT",
+		"dataset_id":  id,
+		"inputs_b64":  base64.StdEncoding.EncodeToString(inputs),
+		"outputs_b64": base64.StdEncoding.EncodeToString(outputs),
+	}, timeout)
+	if err != nil {
+		return err
+	}
+	if status, _ := resp["status"].(string); status != "OK" {
+		return fmt.Errorf("%v", resp["message"])
+	}
+	metrics.Inc("datasets.pushed", 1)
+	metrics.Inc("datasets.pushed_bytes", int64(len(inputs)+len(outputs)))
+	return nil
+}
+
+// errDatasetUnavailable means a worker doesn't hold a data set
+var errDatasetUnavailable = errors.New("dataset not available on this node")
+
+// readDatasetChunk loads the rows a SUB_TRAIN dataset descriptor points to
+// from this node's copy of the data set
+func readDatasetChunk(desc map[string]interface{}) (inputs, outputs []interface{}, err error) {
+	id, _ := desc["dataset_id"].(string)
+	start, _ := desc["start_row"].(float64)
+	end, _ := desc["end_row"].(float64)
+	if !validDatasetID(id) {
+		return nil, nil, fmt.Errorf("invalid dataset_id %q", id)
+	}
+	if start < 0 || end <= start {
+		return nil, nil, fmt.Errorf("invalid row range %v-%v", desc["start_row"], desc["end_row"])
+	}
+	var files *datasetFiles
+	switch store := datasetStore.(type) {
+	case *sharedDatasets:
+		files = store.datasetFiles
+	default:
+		files = localDatasets
+	}
+	if files == nil || !files.Has(id) {
+		return nil, nil, errDatasetUnavailable
+	}
+	if inputs, err = readCSVRows(files.path(id, "inputs"), int(start), int(end)); err != nil {
+		return nil, nil, err
+	}
+	if outputs, err = readCSVRows(files.path(id, "outputs"), int(start), int(end)); err != nil {
+		return nil, nil, err
+	}
+	return inputs, outputs, nil
+}
+
+// readCSVRows parses rows [start, end) of a CSV file
+func readCSVRows(path string, start, end int) ([]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows := make([]interface{}, 0, end-start)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 0; line < end && scanner.Scan(); line++ {
+		if line < start {
+			continue
+		}
+		values, err := parseCSVRow(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s row %d: %v", filepath.Base(path), line, err)
+		}
+		row := make([]interface{}, len(values))
+		for i, v := range values {
+			row[i] = v
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rows) != end-start {
+		return nil, fmt.Errorf("%s has fewer than %d rows", filepath.Base(path), end)
+	}
+	return rows, nil
+}
+
+// subTrainDataset returns the rows of a SUB_TRAIN, inline or sliced from a
+// data set, answering the leader itself when they can't be read
+func subTrainDataset(conn net.Conn, msg map[string]interface{}) (inputs, outputs []interface{}, ok bool) {
+	desc, described := msg["dataset"].(map[string]interface{})
+	if !described {
+		inputs, _ = msg["inputs"].([]interface{})
+		outputs, _ = msg["outputs"].([]interface{})
+		return inputs, outputs, true
+	}
+	inputs, outputs, err := readDatasetChunk(desc)
+	if err != nil {
+		resp := map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		if errors.Is(err, errDatasetUnavailable) {
+			resp["code"] = "E_DATASET_UNAVAILABLE"
+		}
+		sendResponse(conn, resp)
+		return nil, nil, false
+	}
+	return inputs, outputs, true
+}
+
+// handleDatasetPut stores a data set the leader pushed for SUB_TRAIN
+func handleDatasetPut(conn net.Conn, msg map[string]interface{}) {
+	id, _ := msg["dataset_id"].(string)
+	inputsB64, _ := msg["inputs_b64"].(string)
+	outputsB64, _ := msg["outputs_b64"].(string)
+	inputs, err1 := base64.StdEncoding.DecodeString(inputsB64)
+	outputs, err2 := base64.StdEncoding.DecodeString(outputsB64)
+	if err1 != nil || err2 != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid dataset encoding"})
+		return
+	}
+	if localDatasets == nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "No dataset cache on this node"})
+		return
+	}
+	if err := checkTrainingSpace(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_DISK_FULL", "message": err.Error()})
+		return
+	}
+	if err := localDatasets.Put(id, inputs, outputs); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	tcpLog.Infof("DATASET_PUT: stored dataset %.12s (%d bytes)", id, len(inputs)+len(outputs))
+	sendResponse(conn, map[string]interface{}{"status": "OK", "dataset_id": id})
+}
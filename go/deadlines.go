@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Request deadlines
+// ============================================================================
+
+// Every client request runs under a context that ends at its deadline,
+// when the node shuts down and, for TRAIN and SUB_TRAIN, when the client
+// disconnects. The deadline is -request-timeout after the request arrived,
+// -train-timeout for TRAIN, SUB_TRAIN and JOB_SUBMIT trainings, or sooner
+// when the request carries "timeout_ms", the longest the caller is willing
+// to wait. The context reaches the backend: the executor pool stops
+// waiting, a JVM of its own is killed and the bridge JVM is asked to
+// interrupt the command. A request proxied to the leader takes what is left
+// of its deadline along as timeout_ms. A request whose deadline passes gets
+//
+//	{"status": "ERROR", "code": "E_TIMEOUT", "message": "PREDICT did not finish within its deadline"}
+//
+// A micro-batched prediction stops waiting for its batch, which still runs
+// for the other callers, and in-process (fast path) predictions are not
+// timed. Between nodes, a RAFT RPC (dial and round trip) is bounded by
+// -raft-rpc-timeout and a replicated command waits at most
+// -replicate-timeout for its round.
+
+// Set from the command line at startup; 0 means no deadline
+var (
+	requestTimeout   = 2 * time.Minute
+	trainTimeout     = time.Hour
+	raftRPCTimeout   = 2 * time.Second
+	replicateTimeout = 5 * time.Second
+)
+
+// requestContext returns the context a client request of msgType runs
+// under, counted from start
+func requestContext(msgType string, msg map[string]interface{}, start time.Time) (context.Context, context.CancelFunc, error) {
+	timeout := requestTimeout
+	if msgType == "TRAIN" || msgType == "SUB_TRAIN" {
+		timeout = trainTimeout
+	}
+	if raw, ok := msg["timeout_ms"]; ok && raw != nil {
+		ms, ok := raw.(float64)
+		if !ok || ms <= 0 {
+			return nil, nil, fmt.Errorf("timeout_ms must be a positive number of milliseconds")
+		}
+		if d := time.Duration(ms * float64(time.Millisecond)); timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(shutdownCtx)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithDeadline(shutdownCtx, start.Add(timeout))
+	return ctx, cancel, nil
+}
+
+// trainingContext bounds a training started outside a client request (a
+// JOB_SUBMIT job) by -train-timeout
+func trainingContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if trainTimeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, trainTimeout)
+}
+
+// sharedContext bounds backend work done for several requests at once (a
+// micro-batch, loading a model into the fast path) by -request-timeout
+func sharedContext() (context.Context, context.CancelFunc) {
+	if requestTimeout == 0 {
+		return context.WithCancel(shutdownCtx)
+	}
+	return context.WithTimeout(shutdownCtx, requestTimeout)
+}
+
+// deadlineExpired reports whether ctx ended because its deadline passed
+func deadlineExpired(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// timeoutResponse is the E_TIMEOUT answer to a request of msgType
+func timeoutResponse(msgType string) map[string]interface{} {
+	metrics.Inc("timeouts."+strings.ToLower(msgType), 1)
+	return map[string]interface{}{
+		"status":  "ERROR",
+		"code":    "E_TIMEOUT",
+		"message": msgType + " did not finish within its deadline",
+	}
+}
+
+// requestTimedOut answers E_TIMEOUT if ctx's deadline passed
+func requestTimedOut(conn net.Conn, ctx context.Context, msgType string) bool {
+	if !deadlineExpired(ctx) {
+		return false
+	}
+	sendResponse(conn, timeoutResponse(msgType))
+	return true
+}
+
+// remainingTimeoutMs is what is left of ctx's deadline, for a request
+// passed on to another node, or 0 if ctx has none
+func remainingTimeoutMs(ctx context.Context) float64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	return max(float64(time.Until(deadline).Milliseconds()), 1)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Client disconnect detection
+// ============================================================================
+
+// cancelOnDisconnect enables aborting long requests whose client went away
+var cancelOnDisconnect = true
+
+// watchDisconnect returns a context cancelled when the client closes the
+// connection while a long request (TRAIN) is running. The protocol is one
+// request per connection, so any read result after the request line (EOF,
+// reset, or unexpected bytes) means the client is gone or misbehaving. Call
+// stop when the handler finishes; it unblocks the watcher via a read
+// deadline so the response can still be written.
+//
+// Clients that half-close their side right after sending would look
+// disconnected, so watching only starts when the request line ended with a
+// newline (a half-close before the newline is served normally).
+func watchDisconnect(parent context.Context, conn net.Conn, reader *bufio.Reader) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if !cancelOnDisconnect {
+		return ctx, cancel
+	}
+
+	var finished int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		_, err := reader.Read(buf)
+		if atomic.LoadInt32(&finished) == 1 {
+			return
+		}
+		if err != nil {
+			tcpLog.Warnf("Client %s disconnected, cancelling request", conn.RemoteAddr())
+			metrics.Inc("requests.cancelled_disconnect", 1)
+		}
+		cancel()
+	}()
+
+	stop = func() {
+		atomic.StoreInt32(&finished, 1)
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+	return ctx, stop
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Peer discovery
+// ============================================================================
+
+// -discover finds peers instead of (or besides) listing them in -peers.
+// Sources are comma-separated:
+//
+//	dns:NAME              SRV records _worker._tcp.NAME (client ports) and
+//	                      _raft._tcp.NAME (RAFT ports) when NAME has them,
+//	                      otherwise every A/AAAA address of NAME on this
+//	                      node's -port and -raft-port (a Kubernetes headless
+//	                      Service)
+//	multicast[:GROUP:PORT]
+//	                      nodes announce themselves on a LAN multicast group
+//	                      (default 239.255.77.77:7788) every
+//	                      -discover-interval and whenever they hear a node
+//	                      they didn't know
+//
+// Announcements are sealed with the cluster secret when there is one, so a
+// host without it can't get itself added. With no -peers, the nodes found
+// within a few seconds of startup are the initial peers. Afterwards every
+// -discover-interval the sources are polled again, what they return goes
+// into the address book, and the leader adds every reachable node that
+// isn't a member with ADD_SERVER's joint consensus (membership.go). Nodes
+// are never removed automatically: a node that disappears from DNS may only
+// be restarting. A node joining a running cluster should still start with
+// -join. Metrics: discovery.found, discovery.added, discovery.errors.
+
+// discoverBootstrapWait bounds the startup search for the initial peers
+const discoverBootstrapWait = 3 * time.Second
+
+// defaultDiscoveryGroup is the multicast group of "multicast"
+const defaultDiscoveryGroup = "239.255.77.77:7788"
+
+// discoverySource finds the nodes of the cluster, this one possibly included
+type discoverySource interface {
+	String() string
+	Discover(ctx context.Context) ([]Peer, error)
+}
+
+// Discovery polls its sources and feeds what they find to the address book
+// and, on the leader, to the cluster configuration
+type Discovery struct {
+	sources  []discoverySource
+	interval time.Duration
+	self     Peer
+	found    atomic.Int64 // nodes found by the last poll
+}
+
+var discovery *Discovery
+
+// NewDiscovery parses -discover for the node self
+func NewDiscovery(spec string, interval time.Duration, self Peer) (*Discovery, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("-discover-interval must be positive")
+	}
+	d := &Discovery{interval: interval, self: self}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		kind, arg, _ := strings.Cut(s, ":")
+		switch {
+		case s == "":
+			continue
+		case kind == "dns" && arg != "":
+			d.sources = append(d.sources, &dnsDiscovery{name: arg, port: self.WorkerPort, raftPort: self.Port})
+		case kind == "multicast":
+			if arg == "" {
+				arg = defaultDiscoveryGroup
+			}
+			m, err := newMulticastDiscovery(arg, self, interval)
+			if err != nil {
+				return nil, err
+			}
+			d.sources = append(d.sources, m)
+		default:
+			return nil, fmt.Errorf("unknown discovery source %q (use dns:NAME or multicast[:GROUP:PORT])", s)
+		}
+	}
+	if len(d.sources) == 0 {
+		return nil, fmt.Errorf("no discovery source in %q", spec)
+	}
+	metrics.Gauge("discovery.found", func() float64 { return float64(d.found.Load()) })
+	return d, nil
+}
+
+// String lists the sources for the log
+func (d *Discovery) String() string {
+	names := make([]string, len(d.sources))
+	for i, s := range d.sources {
+		names[i] = s.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// discover asks every source and returns the other nodes found, recording
+// them in the address book
+func (d *Discovery) discover(ctx context.Context) []Peer {
+	seen := make(map[string]bool)
+	var peers []Peer
+	for _, src := range d.sources {
+		found, err := src.Discover(ctx)
+		if err != nil {
+			metrics.Inc("discovery.errors", 1)
+			workerLog.Warnf("discovery %s: %v", src, err)
+		}
+		for _, p := range found {
+			key := p.RaftAddress()
+			if seen[key] || isOwnAddress(p, d.self) {
+				continue
+			}
+			seen[key] = true
+			addressBook.Add(p)
+			peers = append(peers, p)
+		}
+	}
+	d.found.Store(int64(len(peers)))
+	return peers
+}
+
+// Bootstrap returns the peers found at startup, searching for up to
+// discoverBootstrapWait until some turn up
+func (d *Discovery) Bootstrap() []Peer {
+	deadline := time.Now().Add(discoverBootstrapWait)
+	for {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		peers := d.discover(ctx)
+		cancel()
+		if len(peers) > 0 || time.Now().After(deadline) {
+			return peers
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Run polls the sources until stopCh closes; the leader adds new nodes
+func (d *Discovery) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(shutdownCtx, d.interval)
+		peers := d.discover(ctx)
+		if raftNode.IsLeader() {
+			d.addMembers(ctx, peers)
+		}
+		cancel()
+	}
+}
+
+// addMembers adds the discovered nodes that answer a PING and aren't
+// members yet, one configuration change at a time
+func (d *Discovery) addMembers(ctx context.Context, peers []Peer) {
+	members := make(map[string]bool)
+	for _, m := range raftNode.Members() {
+		members[m.RaftAddress()] = true
+	}
+	for _, p := range peers {
+		if members[p.RaftAddress()] || ctx.Err() != nil {
+			continue
+		}
+		if _, err := sendClientMessageContext(ctx, p.ClientAddress(), map[string]interface{}{"type": "PING"}, clusterPingTimeout); err != nil {
+			workerLog.Debugf("discovery: %s found but not answering: %v", p.ClientAddress(), err)
+			continue
+		}
+		workerLog.Infof("discovery: adding %s (raft %d) to the cluster", p.ClientAddress(), p.Port)
+		if err := raftNode.ChangeMembership(p, true); err != nil {
+			metrics.Inc("discovery.errors", 1)
+			workerLog.Warnf("discovery: cannot add %s: %v", p.ClientAddress(), err)
+			continue
+		}
+		metrics.Inc("discovery.added", 1)
+	}
+}
+
+// isOwnAddress reports whether p is self, also under another of this
+// host's addresses
+func isOwnAddress(p, self Peer) bool {
+	if p.Port != self.Port || p.WorkerPort != self.WorkerPort {
+		return false
+	}
+	if p.Host == self.Host {
+		return true
+	}
+	ip := net.ParseIP(p.Host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsDiscovery finds nodes by SRV records, or by the addresses of a name
+type dnsDiscovery struct {
+	name           string
+	port, raftPort int // this node's, for names without SRV records
+}
+
+func (d *dnsDiscovery) String() string {
+	return "dns:" + d.name
+}
+
+func (d *dnsDiscovery) Discover(ctx context.Context) ([]Peer, error) {
+	r := net.DefaultResolver
+	_, workers, err := r.LookupSRV(ctx, "worker", "tcp", d.name)
+	if err != nil || len(workers) == 0 {
+		addrs, err := r.LookupHost(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		peers := make([]Peer, 0, len(addrs))
+		for _, a := range addrs {
+			peers = append(peers, Peer{Host: a, Port: d.raftPort, WorkerPort: d.port})
+		}
+		return peers, nil
+	}
+
+	raftPorts := make(map[string]int)
+	if _, rafts, err := r.LookupSRV(ctx, "raft", "tcp", d.name); err == nil {
+		for _, s := range rafts {
+			raftPorts[s.Target] = int(s.Port)
+		}
+	}
+	var peers []Peer
+	for _, s := range workers {
+		raftPort, ok := raftPorts[s.Target]
+		if !ok {
+			return nil, fmt.Errorf("_worker._tcp.%s lists %s, which has no _raft._tcp record", d.name, s.Target)
+		}
+		// RAFT keys peers by address, so targets are resolved
+		addrs, err := r.LookupHost(ctx, strings.TrimSuffix(s.Target, "."))
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		peers = append(peers, Peer{Host: addrs[0], Port: raftPort, WorkerPort: int(s.Port)})
+	}
+	return peers, nil
+}
+
+// multicastDiscovery announces this node on a multicast group and lists
+// the nodes heard there within the last three intervals
+type multicastDiscovery struct {
+	group    *net.UDPAddr
+	self     Peer
+	interval time.Duration
+
+	mu        sync.Mutex
+	heard     map[string]multicastPeer // RAFT address -> announcement
+	announced time.Time
+}
+
+type multicastPeer struct {
+	peer Peer
+	at   time.Time
+}
+
+// multicastAnnouncement is the datagram nodes send
+type multicastAnnouncement struct {
+	Type     string `json:"type"` // "ANNOUNCE"
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	RaftPort int    `json:"raft_port"`
+}
+
+func newMulticastDiscovery(group string, self Peer, interval time.Duration) (*multicastDiscovery, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil || !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("multicast group %q: not an IPv4 multicast host:port", group)
+	}
+	if ip := net.ParseIP(self.Host); ip != nil && ip.IsUnspecified() {
+		return nil, fmt.Errorf("multicast discovery needs a routable -host, not %s", self.Host)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("multicast group %s: %v", group, err)
+	}
+	m := &multicastDiscovery{group: addr, self: self, interval: interval, heard: make(map[string]multicastPeer)}
+	go m.listen(conn)
+	go m.announceEvery(interval)
+	return m, nil
+}
+
+func (m *multicastDiscovery) String() string {
+	return "multicast:" + m.group.String()
+}
+
+func (m *multicastDiscovery) Discover(ctx context.Context) ([]Peer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var peers []Peer
+	for key, h := range m.heard {
+		if time.Since(h.at) > 3*m.interval {
+			delete(m.heard, key)
+			continue
+		}
+		peers = append(peers, h.peer)
+	}
+	return peers, nil
+}
+
+// announce sends this node's announcement, at most once a second
+func (m *multicastDiscovery) announce() {
+	m.mu.Lock()
+	if time.Since(m.announced) < time.Second {
+		m.mu.Unlock()
+		return
+	}
+	m.announced = time.Now()
+	m.mu.Unlock()
+
+	body, _ := json.Marshal(multicastAnnouncement{Type: "ANNOUNCE", Host: m.self.Host, Port: m.self.WorkerPort, RaftPort: m.self.Port})
+	sealed, _ := sealRequest(body)
+	conn, err := net.DialUDP("udp4", nil, m.group)
+	if err != nil {
+		workerLog.Debugf("discovery: cannot announce on %s: %v", m.group, err)
+		return
+	}
+	defer conn.Close()
+	conn.Write(sealed)
+}
+
+func (m *multicastDiscovery) announceEvery(interval time.Duration) {
+	for {
+		m.announce()
+		time.Sleep(interval)
+	}
+}
+
+func (m *multicastDiscovery) listen(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			workerLog.Warnf("discovery: multicast listener stopped: %v", err)
+			return
+		}
+		body, _, err := openRequest(buf[:n])
+		if err != nil {
+			workerLog.Debugf("discovery: announcement from %s rejected: %v", from, err)
+			continue
+		}
+		var a multicastAnnouncement
+		if json.Unmarshal(body, &a) != nil || a.Type != "ANNOUNCE" || a.Host == "" || a.Port <= 0 || a.RaftPort <= 0 {
+			continue
+		}
+		p := Peer{Host: a.Host, Port: a.RaftPort, WorkerPort: a.Port}
+		if isOwnAddress(p, m.self) {
+			continue
+		}
+		m.mu.Lock()
+		_, known := m.heard[p.RaftAddress()]
+		m.heard[p.RaftAddress()] = multicastPeer{peer: p, at: time.Now()}
+		m.mu.Unlock()
+		if !known {
+			workerLog.Infof("discovery: %s announced itself (raft %d)", p.ClientAddress(), p.Port)
+			m.announce()
+		}
+	}
+}
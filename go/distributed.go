@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Distributed training
+// ============================================================================
+
+// The leader splits a large TRAIN into one chunk per healthy worker (itself
+// included) that matches the job's constraints, sends each peer its chunk as SUB_TRAIN and trains its own
+// locally, all in parallel. Chunk i gets samples i, i+n, i+2n... so every
+// chunk sees the whole range of the data. The chunk models are fetched back
+// to the leader and merged (aggregate.go) weighted by chunk size, by
+// default into an ensemble that averages their output logits: chunks start
+// from different random weights, so averaging the weights themselves
+// (-distributed-merge average) only suits backends with a fixed seed. The
+// merge commits as a normal MODEL_TRAINED whose job id releases the chunk
+// models to the chunk GC.
+// A chunk whose peer fails or is in maintenance is retrained on the leader,
+// unless the job's constraints rule the leader out (labels.go).
+// If that fails too, the chunks that did train are merged on their own and
+// the client gets a PARTIAL answer listing every chunk's outcome, unless
+// -distributed-partial-merge is off, in which case the job fails with the
+// same report.
+
+// DistributedTrainer runs data-parallel training from the leader
+type DistributedTrainer struct {
+	minSamples   int
+	chunkTimeout time.Duration
+	merge        string // aggregation method
+	partialMerge bool   // merge the chunks that trained when others failed
+}
+
+// distributedTrainer is nil when distributed training is off
+var distributedTrainer *DistributedTrainer
+
+// NewDistributedTrainer distributes jobs of at least minSamples samples and
+// merges their chunks with the given aggregation method
+func NewDistributedTrainer(minSamples int, chunkTimeout time.Duration, merge string, partialMerge bool) *DistributedTrainer {
+	return &DistributedTrainer{minSamples: minSamples, chunkTimeout: chunkTimeout, merge: merge, partialMerge: partialMerge}
+}
+
+// Wants reports whether a job of this many samples should be distributed
+// over the peers of p
+func (d *DistributedTrainer) Wants(samples int, p placement) bool {
+	return d != nil && samples >= d.minSamples && len(p.peers) > 0
+}
+
+// chunkReport is the outcome of one chunk, as reported to the client
+type chunkReport struct {
+	ChunkID        int    `json:"chunk_id"`
+	Worker         string `json:"worker"` // where it last ran: a peer or "local"
+	Samples        int    `json:"samples"`
+	Status         string `json:"status"` // "ok" or "failed"
+	ModelID        string `json:"model_id,omitempty"`
+	RetriedLocally bool   `json:"retried_locally,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	net *goNetwork
+}
+
+// DistributedReport describes how a distributed job went chunk by chunk
+type DistributedReport struct {
+	Chunks      []chunkReport
+	Merged      bool // a model was produced
+	SamplesUsed int  // samples of the chunks in the merged model
+}
+
+// Failed returns the ids of the chunks that could not be trained
+func (r *DistributedReport) Failed() []int {
+	failed := []int{}
+	for _, c := range r.Chunks {
+		if c.Status != "ok" {
+			failed = append(failed, c.ChunkID)
+		}
+	}
+	return failed
+}
+
+// annotate adds the report to a TRAIN response. A model merged from only
+// some of the chunks turns OK into PARTIAL.
+func (r *DistributedReport) annotate(resp map[string]interface{}) {
+	failed := r.Failed()
+	resp["chunks"] = r.Chunks
+	resp["failed_chunks"] = failed
+	resp["merged"] = r.Merged
+	resp["samples_used"] = r.SamplesUsed
+	if status, _ := resp["status"].(string); status == "OK" && len(failed) > 0 {
+		resp["status"] = "PARTIAL"
+	}
+}
+
+// Train trains jobID across the cluster and saves the merged model to
+// modelPath. It returns the model id and the merged model's loss on the
+// whole data set, or "" if no model was produced, along with the outcome
+// of every chunk. Chunks go to the peers of p, and one stays on the leader
+// if p allows it.
+func (d *DistributedTrainer) Train(ctx context.Context, jobID string, inputsRaw, outputsRaw []interface{}, modelPath string, p placement) (string, float64, *DistributedReport) {
+	start := time.Now()
+	workers := p.peers
+	if p.local {
+		workers = append([]string{""}, workers...)
+	}
+	n := len(workers)
+	if n > len(inputsRaw) {
+		n = len(inputsRaw)
+	}
+	jobsLog.Infof("job %s: distributing %d samples over %d chunks", jobID, len(inputsRaw), n)
+
+	chunks := make([]datasetChunk, n)
+	for i := range chunks {
+		for j := i; j < len(inputsRaw); j += n {
+			chunks[i].inputs = append(chunks[i].inputs, inputsRaw[j])
+			chunks[i].outputs = append(chunks[i].outputs, outputsRaw[j])
+		}
+	}
+	fields, err := datasetStore.Publish(jobID, chunks)
+	if err != nil {
+		jobsLog.Warnf("job %s: cannot publish dataset to %s, sending chunks inline: %v", jobID, datasetStore.Name(), err)
+		fields, _ = inlineDatasets{}.Publish(jobID, chunks)
+	}
+	defer datasetStore.Release(jobID)
+
+	report := &DistributedReport{Chunks: make([]chunkReport, n)}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// "" is the leader, which takes chunk 0 when it may
+		worker := workers[i]
+
+		wg.Add(1)
+		go func(i int, worker string) {
+			defer wg.Done()
+			c := &report.Chunks[i]
+			c.ChunkID, c.Samples = i, len(chunks[i].inputs)
+			if err := d.trainChunk(ctx, jobID, c, n, worker, p.local, chunks[i], fields[i]); err != nil {
+				c.Status, c.Error = "failed", err.Error()
+				return
+			}
+			c.Status, c.ModelID = "ok", c.net.modelID
+		}(i, worker)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return "", 0, report
+	}
+	var nets []*goNetwork
+	var weights []float64
+	for _, c := range report.Chunks {
+		if c.Status != "ok" {
+			jobsLog.Errorf("job %s: chunk %d failed: %s", jobID, c.ChunkID, c.Error)
+			metrics.Inc("train.chunks_failed", 1)
+			continue
+		}
+		nets = append(nets, c.net)
+		weights = append(weights, float64(c.Samples))
+		report.SamplesUsed += c.Samples
+	}
+	failed := report.Failed()
+	if len(nets) == 0 || len(failed) > 0 && !d.partialMerge {
+		jobEvents.Record(jobID, JobFailed, map[string]interface{}{"failed_chunks": failed, "error": "chunks failed"})
+		return "", 0, report
+	}
+	if len(failed) > 0 {
+		jobsLog.Warnf("job %s: merging %d of %d chunks (%d of %d samples)", jobID, len(nets), n, report.SamplesUsed, len(inputsRaw))
+	}
+
+	weights, err = normalizeWeights(weights, len(nets))
+	if err != nil {
+		jobEvents.Record(jobID, JobFailed, map[string]interface{}{"error": "merge failed: " + err.Error()})
+		return "", 0, report
+	}
+	merged, err := aggregateNetworks(nets, weights, d.merge)
+	if err == nil {
+		err = merged.Save(modelPath)
+	}
+	if err != nil {
+		jobsLog.Errorf("job %s: merge failed: %v", jobID, err)
+		jobEvents.Record(jobID, JobFailed, map[string]interface{}{"error": "merge failed: " + err.Error()})
+		return "", 0, report
+	}
+	report.Merged = true
+	loss := merged.loss(inputsRaw, outputsRaw)
+	jobEvents.Record(jobID, JobMerged, map[string]interface{}{"chunks": len(nets), "failed_chunks": failed, "model_id": merged.modelID})
+	metrics.Since("train.distributed", start)
+	jobsLog.Infof("job %s: merged %d chunks into %s (loss %.6f)", jobID, len(nets), merged.modelID, loss)
+	return merged.modelID, loss, report
+}
+
+// trainChunk trains one chunk of the job's total on worker, or locally when
+// worker is "" or the worker fails and local allows it, and loads the
+// resulting model into c. fields describe the chunk's data in SUB_TRAIN.
+func (d *DistributedTrainer) trainChunk(ctx context.Context, jobID string, c *chunkReport, total int, worker string, local bool, chunk datasetChunk, fields map[string]interface{}) error {
+	chunkID := c.ChunkID
+	inputs, outputs := chunk.inputs, chunk.outputs
+	if worker != "" {
+		c.Worker = worker
+		jobEvents.Record(jobID, JobChunkDispatched, map[string]interface{}{"chunk_id": chunkID, "chunks": total, "worker": worker, "samples": len(inputs)})
+		path, err := d.remoteChunk(ctx, jobID, chunkID, worker, chunk, fields)
+		if err == nil {
+			jobEvents.Record(jobID, JobChunkDone, map[string]interface{}{"chunk_id": chunkID, "worker": worker})
+			c.net, err = loadGoNetwork(path)
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !local {
+			return fmt.Errorf("%s: %v (the leader doesn't match the job's constraints)", worker, err)
+		}
+		metrics.Inc("train.chunks_retried_locally", 1)
+		jobsLog.Warnf("job %s: chunk %d failed on %s (%v), training it on the leader", jobID, chunkID, worker, err)
+		c.RetriedLocally = true
+	}
+
+	c.Worker = "local"
+	jobEvents.Record(jobID, JobChunkDispatched, map[string]interface{}{"chunk_id": chunkID, "chunks": total, "worker": "local", "samples": len(inputs)})
+	resp := subTrain(ctx, jobID, chunkID, inputs, outputs)
+	if resp == nil {
+		return ctx.Err()
+	}
+	if status, _ := resp["status"].(string); status != "OK" {
+		return fmt.Errorf("%v", resp["message"])
+	}
+	path, _ := resp["model_path"].(string)
+	var err error
+	c.net, err = loadGoNetwork(path)
+	return err
+}
+
+// remoteChunk sends a chunk to worker as SUB_TRAIN and copies the chunk
+// model back to the leader's models dir. A worker lacking the chunk's data
+// set is pushed a copy (replicated store) or gets the rows inline.
+func (d *DistributedTrainer) remoteChunk(ctx context.Context, jobID string, chunkID int, worker string, chunk datasetChunk, fields map[string]interface{}) (string, error) {
+	msg := map[string]interface{}{"type": "SUB_TRAIN", "job_id": jobID, "chunk_id": chunkID}
+	for k, v := range fields {
+		msg[k] = v
+	}
+	resp, err := sendClientMessageContext(ctx, worker, msg, d.chunkTimeout)
+	if err != nil {
+		return "", err
+	}
+	if code, _ := resp["code"].(string); code == "E_DATASET_UNAVAILABLE" {
+		desc, _ := msg["dataset"].(map[string]interface{})
+		id, _ := desc["dataset_id"].(string)
+		if store, ok := datasetStore.(*replicatedDatasets); ok && store.push(ctx, worker, id, d.chunkTimeout) == nil {
+			jobsLog.Infof("job %s: pushed dataset %.12s to %s", jobID, id, worker)
+		} else {
+			metrics.Inc("train.dataset_fallbacks", 1)
+			jobsLog.Warnf("job %s: %s can't read dataset %.12s, sending chunk %d inline", jobID, worker, id, chunkID)
+			delete(msg, "dataset")
+			for k, v := range inlineChunkFields(chunk) {
+				msg[k] = v
+			}
+		}
+		if resp, err = sendClientMessageContext(ctx, worker, msg, d.chunkTimeout); err != nil {
+			return "", err
+		}
+	}
+	if status, _ := resp["status"].(string); status != "OK" {
+		return "", fmt.Errorf("%v", resp["message"])
+	}
+	remotePath, _ := resp["model_path"].(string)
+	if remotePath == "" {
+		return "", errors.New("no model_path in SUB_TRAIN response")
+	}
+
+	name := filepath.Base(remotePath)
+	if err := fetchModelFromPeer(worker, name, modelsDir); err != nil {
+		return "", fmt.Errorf("fetch %s: %v", name, err)
+	}
+	path := filepath.Join(modelsDir, name)
+	chunkRegistry.Register(jobID, chunkID, path)
+	return path, nil
+}
+
+// loss is the network's mean squared error over a data set, as reported
+// by training; samples that don't parse are skipped
+func (n *goNetwork) loss(inputsRaw, outputsRaw []interface{}) float64 {
+	var total float64
+	count := 0
+	for i := range inputsRaw {
+		inRow, _ := inputsRaw[i].([]interface{})
+		outRow, _ := outputsRaw[i].([]interface{})
+		input, ok1 := parseNumericInput(inRow)
+		target, ok2 := parseNumericInput(outRow)
+		if !ok1 || !ok2 {
+			continue
+		}
+		output, err := n.Predict(input)
+		if err != nil || len(output) != len(target) {
+			continue
+		}
+		var e float64
+		for k := range output {
+			e += math.Pow(target[k]-output[k], 2)
+		}
+		total += e / float64(len(output))
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Input drift detection
+// ============================================================================
+
+// TRAIN stores per-feature statistics of its inputs in MODEL_TRAINED, so
+// every node knows the training distribution of every model. Each node
+// tracks the inputs of the predictions it serves and compares them against
+// that baseline with the population stability index (PSI) over the training
+// histogram bins. A model whose worst feature exceeds the threshold is
+// reported as drifting through a metric, the log and an optional webhook.
+
+// driftBins is the number of equal-width histogram bins between the
+// training minimum and maximum; one more bin on each side counts inputs
+// outside that range
+const driftBins = 10
+
+// maxDriftFeatures skips statistics for very wide inputs, which would bloat
+// every MODEL_TRAINED entry
+const maxDriftFeatures = 256
+
+const (
+	driftMinSamples = 100  // predictions needed before judging drift
+	driftCheckEvery = 50   // predictions between checks
+	driftMaxSamples = 5000 // counts are halved past this, favouring recent inputs
+)
+
+var (
+	inputDriftThreshold = 0.2 // PSI above which a feature has drifted
+	inputDriftWebhook   string
+)
+
+// FeatureStats describes one input feature. Hist holds the fraction of
+// samples per bin: below Min, driftBins bins over [Min, Max], above Max.
+type FeatureStats struct {
+	Mean float64   `json:"mean"`
+	Std  float64   `json:"std"`
+	Min  float64   `json:"min"`
+	Max  float64   `json:"max"`
+	Hist []float64 `json:"hist"`
+}
+
+// InputStats is the training-time input distribution of a model
+type InputStats struct {
+	Samples  int            `json:"samples"`
+	Features []FeatureStats `json:"features"`
+}
+
+// bin returns the histogram bin of x
+func (f *FeatureStats) bin(x float64) int {
+	switch {
+	case x < f.Min:
+		return 0
+	case x > f.Max:
+		return driftBins + 1
+	case f.Max == f.Min:
+		return 1
+	}
+	i := 1 + int((x-f.Min)/(f.Max-f.Min)*driftBins)
+	if i > driftBins {
+		i = driftBins
+	}
+	return i
+}
+
+// computeInputStats summarizes training inputs. It returns nil for empty,
+// ragged, non-numeric or very wide inputs.
+func computeInputStats(inputsRaw []interface{}) *InputStats {
+	rows := make([][]float64, 0, len(inputsRaw))
+	for _, r := range inputsRaw {
+		raw, _ := r.([]interface{})
+		row, ok := parseNumericInput(raw)
+		if !ok || len(row) == 0 || len(rows) > 0 && len(row) != len(rows[0]) {
+			return nil
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 || len(rows[0]) > maxDriftFeatures {
+		return nil
+	}
+
+	stats := &InputStats{Samples: len(rows), Features: make([]FeatureStats, len(rows[0]))}
+	n := float64(len(rows))
+	for j := range stats.Features {
+		f := &stats.Features[j]
+		f.Min, f.Max = rows[0][j], rows[0][j]
+		var sum, sumSq float64
+		for _, row := range rows {
+			sum += row[j]
+			sumSq += row[j] * row[j]
+			f.Min = math.Min(f.Min, row[j])
+			f.Max = math.Max(f.Max, row[j])
+		}
+		f.Mean = sum / n
+		f.Std = math.Sqrt(math.Max(0, sumSq/n-f.Mean*f.Mean))
+
+		f.Hist = make([]float64, driftBins+2)
+		for _, row := range rows {
+			f.Hist[f.bin(row[j])] += 1 / n
+		}
+	}
+	return stats
+}
+
+// psi is the population stability index of observed bin counts against the
+// expected fractions. Empty bins are smoothed so the index stays finite.
+func psi(expected []float64, observed []float64, total float64) float64 {
+	const eps = 1e-4
+	var sum float64
+	for i := range expected {
+		p := math.Max(expected[i], eps)
+		q := math.Max(observed[i]/total, eps)
+		sum += (q - p) * math.Log(q/p)
+	}
+	return sum
+}
+
+// modelDrift is the prediction input distribution observed for one model
+type modelDrift struct {
+	count    float64
+	sum      []float64
+	sumSq    []float64
+	hist     [][]float64
+	psi      []float64
+	checked  time.Time
+	drifting bool
+}
+
+// InputDriftMonitor tracks prediction inputs per model on this node
+type InputDriftMonitor struct {
+	mu     sync.Mutex
+	models map[string]*modelDrift
+}
+
+var inputDrift = &InputDriftMonitor{models: make(map[string]*modelDrift)}
+
+// Observe records the input of a served prediction
+func (m *InputDriftMonitor) Observe(modelID string, input []float64) {
+	baseline, ok := modelStateMachine.InputStats(modelID)
+	if !ok || len(input) != len(baseline.Features) {
+		return
+	}
+
+	m.mu.Lock()
+	d := m.models[modelID]
+	if d == nil || len(d.sum) != len(input) {
+		d = &modelDrift{
+			sum:   make([]float64, len(input)),
+			sumSq: make([]float64, len(input)),
+			hist:  make([][]float64, len(input)),
+		}
+		for j := range d.hist {
+			d.hist[j] = make([]float64, driftBins+2)
+		}
+		m.models[modelID] = d
+	}
+
+	if d.count >= driftMaxSamples {
+		d.count /= 2
+		for j := range d.sum {
+			d.sum[j] /= 2
+			d.sumSq[j] /= 2
+			for b := range d.hist[j] {
+				d.hist[j][b] /= 2
+			}
+		}
+	}
+	d.count++
+	for j, x := range input {
+		d.sum[j] += x
+		d.sumSq[j] += x * x
+		d.hist[j][baseline.Features[j].bin(x)]++
+	}
+
+	var changed bool
+	var worst float64
+	worstFeature := -1
+	if d.count >= driftMinSamples && int(d.count)%driftCheckEvery == 0 {
+		d.psi = make([]float64, len(input))
+		for j := range input {
+			d.psi[j] = psi(baseline.Features[j].Hist, d.hist[j], d.count)
+			if d.psi[j] > worst {
+				worst, worstFeature = d.psi[j], j
+			}
+		}
+		d.checked = time.Now()
+		drifting := worst > inputDriftThreshold
+		changed = drifting != d.drifting
+		d.drifting = drifting
+	}
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	event := "input_drift_resolved"
+	if worst > inputDriftThreshold {
+		event = "input_drift"
+		metrics.Inc("drift.warnings", 1)
+		predictLog.Warnf("inputs of model %s diverge from training (feature %d, PSI %.3f > %.2f)", modelID, worstFeature, worst, inputDriftThreshold)
+	} else {
+		predictLog.Infof("inputs of model %s back within threshold (PSI %.3f)", modelID, worst)
+	}
+	notifyDrift(map[string]interface{}{
+		"event":     event,
+		"model_id":  modelID,
+		"node":      raftNode.id,
+		"feature":   worstFeature,
+		"psi":       worst,
+		"threshold": inputDriftThreshold,
+		"at":        time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// Drifting returns the number of models currently flagged
+func (m *InputDriftMonitor) Drifting() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, d := range m.models {
+		if d.drifting {
+			n++
+		}
+	}
+	return n
+}
+
+// Status compares a model's observed inputs with its training baseline
+func (m *InputDriftMonitor) Status(modelID string) (map[string]interface{}, bool) {
+	baseline, ok := modelStateMachine.InputStats(modelID)
+	if !ok {
+		return nil, false
+	}
+
+	status := map[string]interface{}{
+		"model_id":         modelID,
+		"training_samples": baseline.Samples,
+		"threshold":        inputDriftThreshold,
+		"drifting":         false,
+		"samples":          0,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.models[modelID]
+	features := make([]map[string]interface{}, len(baseline.Features))
+	for j, f := range baseline.Features {
+		feature := map[string]interface{}{"train_mean": f.Mean, "train_std": f.Std}
+		if d != nil && d.count > 0 {
+			mean := d.sum[j] / d.count
+			feature["mean"] = mean
+			feature["std"] = math.Sqrt(math.Max(0, d.sumSq[j]/d.count-mean*mean))
+			if j < len(d.psi) {
+				feature["psi"] = d.psi[j]
+			}
+		}
+		features[j] = feature
+	}
+	status["features"] = features
+	if d != nil {
+		status["samples"] = int(d.count)
+		status["drifting"] = d.drifting
+		if !d.checked.IsZero() {
+			status["checked_at"] = d.checked.UTC().Format(time.RFC3339)
+		}
+	}
+	return status, true
+}
+
+// notifyDrift posts a drift event to the configured webhook in the background
+func notifyDrift(event map[string]interface{}) {
+	postWebhook(inputDriftWebhook, event)
+}
+
+// postWebhook posts an event as JSON to url, if set, in the background
+func postWebhook(url string, event map[string]interface{}) {
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(event)
+	go func() {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			predictLog.Warnf("webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			predictLog.Warnf("webhook answered %s", resp.Status)
+		}
+	}()
+}
+
+// handleDriftStatus serves DRIFT_STATUS {"model_id"}
+func handleDriftStatus(conn net.Conn, msg map[string]interface{}) {
+	name, _ := msg["model_id"].(string)
+	if name == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+	status, ok := inputDrift.Status(canonicalModelID(name))
+	if !ok {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_NO_BASELINE", "message": "No training statistics for model"})
+		return
+	}
+	status["status"] = "OK"
+	sendResponse(conn, status)
+}
+
+// handleDriftAPI serves GET /api/drift/{model}
+func handleDriftAPI(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/drift/")
+	status, ok := inputDrift.Status(canonicalModelID(name))
+	if !ok {
+		http.Error(w, "no training statistics for model", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Model evaluation and round-by-round tracking
+// ============================================================================
+
+// EvalResult is the backend's score for a model on a labelled dataset
+type EvalResult struct {
+	Loss     float64 `json:"loss"`
+	Accuracy float64 `json:"accuracy"`
+	Samples  int     `json:"samples"`
+}
+
+// evaluateOnData writes a labelled dataset to scratch space and scores the
+// model against it
+func evaluateOnData(ctx context.Context, modelPath string, inputs, outputs []interface{}) (*EvalResult, error) {
+	evalID := fmt.Sprintf("eval_%d", time.Now().UnixNano()%100000000)
+	inputsFile := filepath.Join(scratchDir, "inputs_"+evalID+".csv")
+	outputsFile := filepath.Join(scratchDir, "outputs_"+evalID+".csv")
+	defer os.Remove(inputsFile)
+	defer os.Remove(outputsFile)
+
+	if err := writeCSV(inputsFile, inputs); err != nil {
+		return nil, err
+	}
+	if err := writeCSV(outputsFile, outputs); err != nil {
+		return nil, err
+	}
+
+	result := runJavaEvaluation(ctx, modelPath, inputsFile, outputsFile)
+	if result == nil {
+		return nil, fmt.Errorf("evaluation failed")
+	}
+	return result, nil
+}
+
+// runJavaEvaluation runs the backend "evaluate" mode
+func runJavaEvaluation(ctx context.Context, modelPath, inputsFile, outputsFile string) *EvalResult {
+	args := []string{"evaluate", modelPath, inputsFile, outputsFile}
+	javaLog.Debugf("Running: TrainingModule %s", strings.Join(args, " "))
+
+	defer metrics.Since("java.evaluate", time.Now())
+	output, err := runJava(ctx, nil, args...)
+	if err != nil {
+		javaLog.Errorf("Java evaluation error: %v", err)
+		return nil
+	}
+
+	for _, line := range splitLines(string(output)) {
+		if !strings.HasPrefix(line, "EVAL:") {
+			continue
+		}
+		result := &EvalResult{}
+		for _, kv := range strings.Split(strings.TrimPrefix(line, "EVAL:"), ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "loss":
+				result.Loss, _ = strconv.ParseFloat(v, 64)
+			case "accuracy":
+				result.Accuracy, _ = strconv.ParseFloat(v, 64)
+			case "samples":
+				result.Samples, _ = strconv.Atoi(v)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// handleEvaluate scores a stored model on a labelled dataset
+func handleEvaluate(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	inputsRaw, _ := msg["inputs"].([]interface{})
+	outputsRaw, _ := msg["outputs"].([]interface{})
+
+	if token, _ := msg["page_token"].(string); token != "" && modelID == "" {
+		sendNextPage(conn, msg)
+		return
+	}
+	if modelID == "" || len(inputsRaw) == 0 || len(outputsRaw) == 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id, inputs or outputs"})
+		return
+	}
+
+	tcpLog.Infof("EVALUATE request: model=%s, %d samples", modelID, len(inputsRaw))
+
+	modelPath := findEvaluableModel(modelID)
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+	if !checkModelIntegrity(conn, msg, modelPath) {
+		return
+	}
+	if spec := preprocessFor(modelPath); spec != nil {
+		for i, r := range inputsRaw {
+			row, _ := r.([]interface{})
+			features, err := spec.Apply(row)
+			if err != nil {
+				sendPreprocessError(conn, msg, fmt.Errorf("input %d: %v", i, err))
+				return
+			}
+			inputsRaw[i] = features
+		}
+	}
+
+	if perSample, _ := msg["per_sample"].(bool); perSample {
+		evaluatePerSample(ctx, conn, msg, modelID, modelPath, inputsRaw, outputsRaw)
+		return
+	}
+
+	result, err := evaluateOnData(ctx, modelPath, inputsRaw, outputsRaw)
+	if requestTimedOut(conn, ctx, "EVALUATE") {
+		return
+	}
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	sendResponse(conn, map[string]interface{}{
+		"status":   "OK",
+		"model_id": modelID,
+		"loss":     result.Loss,
+		"accuracy": result.Accuracy,
+		"samples":  result.Samples,
+	})
+}
+
+// maxPerSampleEvaluation bounds the rows of an EVALUATE with per_sample
+const maxPerSampleEvaluation = 100000
+
+// evaluatePerSample scores a model from its predictions for each sample,
+// like COMPARE_MODELS, and answers the per-sample results in pages
+// (paging.go)
+func evaluatePerSample(ctx context.Context, conn net.Conn, msg map[string]interface{}, modelID, modelPath string, inputsRaw, outputsRaw []interface{}) {
+	if len(inputsRaw) != len(outputsRaw) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Need as many outputs as inputs"})
+		return
+	}
+	if len(inputsRaw) > maxPerSampleEvaluation {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("At most %d samples per evaluation with per_sample", maxPerSampleEvaluation)})
+		return
+	}
+	rows := make([][]interface{}, len(inputsRaw))
+	labels := make([][]float64, len(outputsRaw))
+	for i := range inputsRaw {
+		rows[i], _ = inputsRaw[i].([]interface{})
+		label, _ := outputsRaw[i].([]interface{})
+		var ok bool
+		if labels[i], ok = parseNumericInput(label); !ok || len(labels[i]) == 0 || len(rows[i]) == 0 {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_BAD_INPUT", "message": fmt.Sprintf("Sample %d is not a list of numbers", i)})
+			return
+		}
+	}
+
+	outputs := fastPredictBatch(modelPath, rows)
+	var err error
+	if outputs == nil {
+		outputs, err = backendPredictBatch(ctx, modelPath, rows)
+	}
+	if requestTimedOut(conn, ctx, "EVALUATE") {
+		return
+	}
+	if errors.Is(err, errPredictQueueFull) || errors.Is(err, errPredictQueueTimeout) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": err.Error()})
+		return
+	}
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Prediction failed"})
+		return
+	}
+
+	score := scoreOutputs(modelID, outputs, labels)
+	results := make([]interface{}, len(outputs))
+	for i, predicted := range outputs {
+		var sqError float64
+		for j := 0; j < len(labels[i]) && j < len(predicted); j++ {
+			d := predicted[j] - labels[i][j]
+			sqError += d * d
+		}
+		results[i] = map[string]interface{}{
+			"index":         i,
+			"output":        predicted,
+			"expected":      labels[i],
+			"squared_error": sqError,
+			"correct":       outputClass(predicted) == outputClass(labels[i]),
+		}
+	}
+	header := map[string]interface{}{
+		"status":   "OK",
+		"model_id": modelID,
+		"loss":     score.Loss,
+		"accuracy": score.Accuracy,
+		"samples":  score.Samples,
+	}
+	sendResponse(conn, firstPage(header, results, pageLimit(msg)))
+}
+
+// RoundMetrics is the validation score of the aggregated model after one
+// distributed training round
+type RoundMetrics struct {
+	Round     int        `json:"round"`
+	ModelPath string     `json:"model_path"`
+	Eval      EvalResult `json:"eval"`
+	At        string     `json:"at"`
+}
+
+// RoundTracker records per-round validation metrics for a distributed job
+// and decides when to stop early: training stops once validation loss has
+// not improved by at least MinDelta for Patience consecutive rounds.
+type RoundTracker struct {
+	Patience int
+	MinDelta float64
+
+	mu        sync.Mutex
+	rounds    []RoundMetrics
+	bestLoss  float64
+	bestRound int
+	stale     int
+	stopped   bool
+}
+
+// NewRoundTracker creates a tracker; patience <= 0 disables early stopping
+func NewRoundTracker(patience int, minDelta float64) *RoundTracker {
+	return &RoundTracker{Patience: patience, MinDelta: minDelta, bestRound: -1}
+}
+
+// Record stores a round's metrics and reports whether the job should stop
+func (t *RoundTracker) Record(round int, modelPath string, eval EvalResult) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rounds = append(t.rounds, RoundMetrics{
+		Round:     round,
+		ModelPath: modelPath,
+		Eval:      eval,
+		At:        time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if t.bestRound < 0 || eval.Loss < t.bestLoss-t.MinDelta {
+		t.bestLoss = eval.Loss
+		t.bestRound = round
+		t.stale = 0
+	} else {
+		t.stale++
+	}
+
+	if t.Patience > 0 && t.stale >= t.Patience {
+		t.stopped = true
+	}
+	return t.stopped
+}
+
+// Status returns the rounds so far for the job status API
+func (t *RoundTracker) Status() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rounds := make([]RoundMetrics, len(t.rounds))
+	copy(rounds, t.rounds)
+	return map[string]interface{}{
+		"rounds":        rounds,
+		"best_round":    t.bestRound,
+		"best_loss":     t.bestLoss,
+		"early_stopped": t.stopped,
+	}
+}
+
+// roundTrackers holds the trackers of distributed jobs by job id
+var roundTrackers = struct {
+	sync.RWMutex
+	m map[string]*RoundTracker
+}{m: make(map[string]*RoundTracker)}
+
+// trackRounds registers a tracker for a distributed job
+func trackRounds(jobID string, t *RoundTracker) {
+	roundTrackers.Lock()
+	roundTrackers.m[jobID] = t
+	roundTrackers.Unlock()
+}
+
+// handleRoundsAPI serves GET /api/training/rounds?job=<id>
+func handleRoundsAPI(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("job")
+
+	roundTrackers.RLock()
+	t, ok := roundTrackers.m[jobID]
+	roundTrackers.RUnlock()
+	if !ok {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Status())
+}
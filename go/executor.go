@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Java executor pool
+// ============================================================================
+
+// Every TrainingModule command (through the bridge or in a JVM of its own)
+// runs under an ExecutorPool slot, so a burst of requests doesn't run more
+// commands at once than the machine has cores. -java-workers sets the slots
+// (default: one per CPU); commands over it wait in a queue of at most
+// -java-queue and fail once it is full. Waiters are served by priority,
+// oldest first within one:
+//
+//	predict   predict, predict_batch
+//	normal    evaluate, describe, export
+//	train     train
+//
+// and trainings never take the last slot, so a PREDICT waits at most for the
+// shorter commands ahead of it. A waiter whose context ends leaves the
+// queue. /status shows the pool under "java_pool" with the queue depth by
+// priority and the wait and run time of the latest commands; the metrics are
+// java.queue_wait, java.queue_rejected and the gauge java.queued.
+// -backend=go runs commands in-process and has no pool.
+
+// Command priorities, in increasing order of precedence
+const (
+	javaPriorityTrain = iota
+	javaPriorityNormal
+	javaPriorityPredict
+)
+
+var javaPriorityNames = [...]string{"train", "normal", "predict"}
+
+// javaRecentJobs is how many finished commands /status lists
+const javaRecentJobs = 16
+
+var errJavaQueueFull = errors.New("too many TrainingModule commands waiting")
+
+// ExecutorPool bounds the TrainingModule commands running at once
+type ExecutorPool struct {
+	workers  int
+	maxQueue int // 0 = unbounded
+
+	mu        sync.Mutex
+	running   int
+	trainings int                          // running commands of javaPriorityTrain
+	waiting   [3][]*javaWaiter             // by priority, oldest first
+	recent    [javaRecentJobs]javaJobStats // ring of finished commands
+	finished  int
+	rejected  int
+}
+
+type javaWaiter struct {
+	granted chan struct{} // closed when handed a slot
+}
+
+// javaJobStats is the timing of one finished command
+type javaJobStats struct {
+	Command  string    `json:"command"`
+	Priority string    `json:"priority"`
+	Queued   time.Time `json:"queued_at"`
+	WaitMs   int64     `json:"wait_ms"`
+	RunMs    int64     `json:"run_ms"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// javaPool is nil with -backend=go
+var javaPool *ExecutorPool
+
+// NewExecutorPool creates a pool running workers commands at once
+func NewExecutorPool(workers, maxQueue int) *ExecutorPool {
+	return &ExecutorPool{workers: max(workers, 1), maxQueue: maxQueue}
+}
+
+// javaCommandPriority is the priority of a TrainingModule command
+func javaCommandPriority(command string) int {
+	switch command {
+	case "predict", "predict_batch":
+		return javaPriorityPredict
+	case "train":
+		return javaPriorityTrain
+	default:
+		return javaPriorityNormal
+	}
+}
+
+// Run runs fn under a slot for command, waiting for one until ctx ends
+func (p *ExecutorPool) Run(ctx context.Context, command string, fn func() ([]byte, error)) ([]byte, error) {
+	priority := javaCommandPriority(command)
+	queued := time.Now()
+	if err := p.acquire(ctx, priority); err != nil {
+		return nil, err
+	}
+	wait := time.Since(queued)
+	metrics.Time("java.queue_wait", wait)
+
+	started := time.Now()
+	output, err := fn()
+	job := javaJobStats{
+		Command:  command,
+		Priority: javaPriorityNames[priority],
+		Queued:   queued,
+		WaitMs:   wait.Milliseconds(),
+		RunMs:    time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		job.Error = err.Error()
+	}
+	p.release(priority, job)
+	return output, err
+}
+
+// admitLocked reports whether a command of priority can take a free slot
+func (p *ExecutorPool) admitLocked(priority int) bool {
+	if p.running >= p.workers {
+		return false
+	}
+	return priority != javaPriorityTrain || p.workers == 1 || p.trainings < p.workers-1
+}
+
+func (p *ExecutorPool) takeLocked(priority int) {
+	p.running++
+	if priority == javaPriorityTrain {
+		p.trainings++
+	}
+}
+
+// acquire takes a slot, queueing behind the waiters of the same or higher
+// priority
+func (p *ExecutorPool) acquire(ctx context.Context, priority int) error {
+	p.mu.Lock()
+	ahead := 0
+	for pr := priority; pr < len(p.waiting); pr++ {
+		ahead += len(p.waiting[pr])
+	}
+	if ahead == 0 && p.admitLocked(priority) {
+		p.takeLocked(priority)
+		p.mu.Unlock()
+		return nil
+	}
+	if p.maxQueue > 0 && p.queuedLocked() >= p.maxQueue {
+		p.rejected++
+		p.mu.Unlock()
+		metrics.Inc("java.queue_rejected", 1)
+		return errJavaQueueFull
+	}
+	w := &javaWaiter{granted: make(chan struct{})}
+	p.waiting[priority] = append(p.waiting[priority], w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-w.granted:
+		// Granted while giving up: hand the slot on
+		p.running--
+		if priority == javaPriorityTrain {
+			p.trainings--
+		}
+		p.grantLocked()
+	default:
+		queue := p.waiting[priority]
+		for i, q := range queue {
+			if q == w {
+				p.waiting[priority] = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// release frees a slot and hands free slots to the waiters that may take
+// them
+func (p *ExecutorPool) release(priority int, job javaJobStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	if priority == javaPriorityTrain {
+		p.trainings--
+	}
+	p.recent[p.finished%javaRecentJobs] = job
+	p.finished++
+	p.grantLocked()
+}
+
+func (p *ExecutorPool) grantLocked() {
+	for pr := javaPriorityPredict; pr >= javaPriorityTrain; pr-- {
+		for len(p.waiting[pr]) > 0 && p.admitLocked(pr) {
+			w := p.waiting[pr][0]
+			p.waiting[pr] = p.waiting[pr][1:]
+			p.takeLocked(pr)
+			close(w.granted)
+		}
+	}
+}
+
+func (p *ExecutorPool) queuedLocked() int {
+	n := 0
+	for _, queue := range p.waiting {
+		n += len(queue)
+	}
+	return n
+}
+
+// Queued returns the number of commands waiting for a slot
+func (p *ExecutorPool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queuedLocked()
+}
+
+// Status reports the pool for /status, latest commands first
+func (p *ExecutorPool) Status() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued := make(map[string]int, len(p.waiting))
+	for pr, queue := range p.waiting {
+		queued[javaPriorityNames[pr]] = len(queue)
+	}
+	recent := make([]javaJobStats, 0, javaRecentJobs)
+	for i := 1; i <= min(p.finished, javaRecentJobs); i++ {
+		recent = append(recent, p.recent[(p.finished-i)%javaRecentJobs])
+	}
+	return map[string]interface{}{
+		"workers":           p.workers,
+		"max_queue":         p.maxQueue,
+		"running":           p.running,
+		"running_trainings": p.trainings,
+		"queued":            queued,
+		"queue_depth":       p.queuedLocked(),
+		"finished":          p.finished,
+		"rejected":          p.rejected,
+		"recent":            recent,
+	}
+}
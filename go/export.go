@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Model export
+// ============================================================================
+
+// handleExportModel returns a model's architecture, weights and biases in the
+// portable JSON format described in docs/MODEL_EXPORT_FORMAT.md
+func handleExportModel(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+
+	tcpLog.Infof("EXPORT_MODEL request: model=%s", modelID)
+
+	modelPath := findModel(modelID)
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+
+	model, err := runJavaExport(ctx, modelPath)
+	if requestTimedOut(conn, ctx, "EXPORT_MODEL") {
+		return
+	}
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Export failed: " + err.Error()})
+		return
+	}
+	sendResponse(conn, map[string]interface{}{"status": "OK", "model": model})
+}
+
+// handleExportAPI serves GET /api/models/export?model=<id> as a downloadable
+// JSON document
+func handleExportAPI(w http.ResponseWriter, r *http.Request) {
+	modelID := r.URL.Query().Get("model")
+	modelPath := ""
+	if modelID != "" {
+		modelPath = findModel(modelID)
+	}
+	if modelPath == "" {
+		http.Error(w, "unknown model", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := sharedContext()
+	defer cancel()
+	model, err := runJavaExport(ctx, modelPath)
+	if err != nil {
+		http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", modelID+".json"))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(model)
+}
+
+// runJavaExport runs the backend "export" mode, which prints a single
+// EXPORT:<json> line, and checks the document shape before returning it
+func runJavaExport(ctx context.Context, modelPath string) (map[string]interface{}, error) {
+	javaLog.Debugf("Running: TrainingModule export %s", modelPath)
+
+	defer metrics.Since("java.export", time.Now())
+	output, err := runJava(ctx, nil, "export", modelPath)
+	if err != nil {
+		javaLog.Errorf("Java export error: %v", err)
+		return nil, err
+	}
+
+	for _, line := range splitLines(string(output)) {
+		if !strings.HasPrefix(line, "EXPORT:") {
+			continue
+		}
+		var model map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "EXPORT:")), &model); err != nil {
+			return nil, fmt.Errorf("invalid export document: %v", err)
+		}
+		if v, _ := model["format_version"].(float64); v != 1 {
+			return nil, fmt.Errorf("unsupported export format version %v", model["format_version"])
+		}
+		if layers, _ := model["layers"].([]interface{}); len(layers) == 0 {
+			return nil, fmt.Errorf("export document has no layers")
+		}
+		return model, nil
+	}
+	return nil, fmt.Errorf("no EXPORT line in backend output")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Go-native prediction fast path
+// ============================================================================
+
+// mlpModel is a model decoded from the JSON export format
+// (docs/MODEL_EXPORT_FORMAT.md)
+type mlpModel struct {
+	inputSize int
+	params    int
+	layers    []mlpLayer
+}
+
+type mlpLayer struct {
+	Weights [][]float64 `json:"weights"` // [input][neuron]
+	Bias    []float64   `json:"bias"`
+}
+
+// decodeMLP validates an exported model and converts it for Forward
+func decodeMLP(doc map[string]interface{}) (*mlpModel, error) {
+	if format, _ := doc["format"].(string); format != "mlp-sigmoid" {
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	data, err := json.Marshal(doc["layers"])
+	if err != nil {
+		return nil, err
+	}
+	var layers []mlpLayer
+	if err := json.Unmarshal(data, &layers); err != nil {
+		return nil, fmt.Errorf("decode layers: %v", err)
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layers")
+	}
+
+	m := &mlpModel{inputSize: len(layers[0].Weights), layers: layers}
+	width := m.inputSize
+	for i, l := range layers {
+		if len(l.Weights) != width {
+			return nil, fmt.Errorf("layer %d expects %d inputs, has %d weight rows", i, width, len(l.Weights))
+		}
+		for _, row := range l.Weights {
+			if len(row) != len(l.Bias) {
+				return nil, fmt.Errorf("layer %d weight row has %d columns, bias has %d", i, len(row), len(l.Bias))
+			}
+		}
+		// null (non-finite) weights decode as 0, which would silently change
+		// the model; leave those to the backend
+		if len(l.Bias) == 0 || hasNull(doc, i) {
+			return nil, fmt.Errorf("layer %d has empty or non-finite parameters", i)
+		}
+		m.params += width*len(l.Bias) + len(l.Bias)
+		width = len(l.Bias)
+	}
+	return m, nil
+}
+
+// hasNull reports whether layer i of the raw export contains a null value
+func hasNull(doc map[string]interface{}, i int) bool {
+	layers, _ := doc["layers"].([]interface{})
+	if i >= len(layers) {
+		return true
+	}
+	layer, _ := layers[i].(map[string]interface{})
+	rows, _ := layer["weights"].([]interface{})
+	vectors := append([]interface{}{layer["bias"]}, rows...)
+	for _, v := range vectors {
+		values, _ := v.([]interface{})
+		for _, x := range values {
+			if x == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Forward runs the sigmoid MLP, matching TrainingModule predict
+func (m *mlpModel) Forward(input []float64) ([]float64, error) {
+	if len(input) != m.inputSize {
+		return nil, fmt.Errorf("input size mismatch: expected %d, got %d", m.inputSize, len(input))
+	}
+	x := input
+	for _, l := range m.layers {
+		out := make([]float64, len(l.Bias))
+		for j := range out {
+			sum := l.Bias[j]
+			for i, v := range x {
+				sum += v * l.Weights[i][j]
+			}
+			out[j] = 1 / (1 + math.Exp(-sum))
+		}
+		x = out
+	}
+	return x, nil
+}
+
+// FastPredictor serves PREDICT in-process for models small enough that a JVM
+// launch dominates the cost. Each model is exported through the backend once
+// and cached; larger models, unsupported formats and models that failed a
+// cross-check keep using the subprocess.
+type FastPredictor struct {
+	maxParams int
+	check     bool // also run the backend and compare every prediction
+
+	mu     sync.Mutex
+	models map[string]*fastEntry // model path -> cached export
+}
+
+type fastEntry struct {
+	model   *mlpModel // nil when the model must use the backend
+	modTime time.Time
+	size    int64
+	reason  string
+}
+
+var fastPredictor *FastPredictor
+
+// fastPathTolerance absorbs the backend's fixed-precision output
+const fastPathTolerance = 1e-5
+
+// NewFastPredictor creates a fast path for models up to maxParams parameters
+func NewFastPredictor(maxParams int, check bool) *FastPredictor {
+	return &FastPredictor{
+		maxParams: maxParams,
+		check:     check,
+		models:    make(map[string]*fastEntry),
+	}
+}
+
+// Predict returns the output and true when the fast path handled the
+// request; false means the caller should use the backend.
+func (f *FastPredictor) Predict(modelPath string, input []float64) ([]float64, bool) {
+	m := f.model(modelPath)
+	if m == nil {
+		return nil, false
+	}
+	output, err := m.Forward(input)
+	if err != nil {
+		return nil, false
+	}
+
+	if f.check {
+		inputParts := make([]string, len(input))
+		for i, v := range input {
+			inputParts[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		ctx, cancel := sharedContext()
+		expected := runJavaPrediction(ctx, modelPath, strings.Join(inputParts, ","))
+		cancel()
+		if expected == nil {
+			return output, true
+		}
+		if !outputsMatch(output, expected) {
+			metrics.Inc("predict.fast_mismatch", 1)
+			predictLog.Warnf("%s disagrees with backend (%v vs %v), disabling for this model", modelPath, output, expected)
+			f.disable(modelPath, "cross-check mismatch")
+			return expected, true
+		}
+	}
+
+	metrics.Inc("predict.fast", 1)
+	return output, true
+}
+
+// model returns the cached fast-path model for a path, exporting it on first
+// use or when the file has changed
+func (f *FastPredictor) model(modelPath string) *mlpModel {
+	info, err := os.Stat(modelPath)
+	if err != nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	e, ok := f.models[modelPath]
+	f.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.model
+	}
+
+	e = &fastEntry{modTime: info.ModTime(), size: info.Size()}
+	ctx, cancel := sharedContext()
+	doc, err := runJavaExport(ctx, modelPath)
+	cancel()
+	if err != nil {
+		e.reason = err.Error()
+	} else if m, err := decodeMLP(doc); err != nil {
+		e.reason = err.Error()
+	} else if m.params > f.maxParams {
+		e.reason = fmt.Sprintf("%d parameters exceeds limit of %d", m.params, f.maxParams)
+	} else {
+		e.model = m
+	}
+	if e.model == nil {
+		predictLog.Infof("%s uses the backend: %s", modelPath, e.reason)
+	}
+
+	f.mu.Lock()
+	f.models[modelPath] = e
+	f.mu.Unlock()
+	return e.model
+}
+
+func (f *FastPredictor) disable(modelPath, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.models[modelPath]; ok {
+		e.model = nil
+		e.reason = reason
+	}
+}
+
+func outputsMatch(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > fastPathTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumericInput converts a PREDICT input array, reporting false if any
+// value is not a number
+func parseNumericInput(raw []interface{}) ([]float64, bool) {
+	input := make([]float64, len(raw))
+	for i, v := range raw {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, false
+		}
+		input[i] = f
+	}
+	return input, true
+}
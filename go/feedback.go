@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Prediction feedback
+// ============================================================================
+
+// FEEDBACK reports the true outcome of an earlier PREDICT by its request_id.
+// Besides labelling the in-memory record used by A/B reports, each label is
+// appended to a per-model file together with the prediction's input, so the
+// collected feedback survives restarts, drives the drift statistics and can
+// be exported as a TRAIN dataset. A request_id is only known to the node that
+// served the prediction.
+
+// driftWindow is the number of labels compared between the oldest and the
+// newest feedback of a model
+const driftWindow = 100
+
+// driftThreshold is the accuracy drop between windows reported as drift
+const driftThreshold = 0.1
+
+// FeedbackEntry is one labelled prediction
+type FeedbackEntry struct {
+	RequestID string    `json:"request_id"`
+	At        string    `json:"at"`
+	Input     []float64 `json:"input,omitempty"`
+	Output    []float64 `json:"output"`
+	Label     []float64 `json:"label"`
+}
+
+// FeedbackStore keeps an append-only file of labels per model under dir
+type FeedbackStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+var feedbackStore *FeedbackStore
+
+// NewFeedbackStore creates the store rooted at dir
+func NewFeedbackStore(dir string) *FeedbackStore {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		storageLog.Errorf("feedback: cannot create %s: %v", dir, err)
+	}
+	return &FeedbackStore{dir: dir}
+}
+
+func (s *FeedbackStore) path(modelID string) string {
+	return filepath.Join(s.dir, modelID+".jsonl")
+}
+
+// Append stores a label for modelID
+func (s *FeedbackStore) Append(modelID string, entry FeedbackEntry) error {
+	if !safeBaseName(modelID) {
+		return errors.New("invalid model id")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path(modelID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Entries returns a model's labels in arrival order. A request labelled
+// more than once keeps its latest label, at its latest position.
+func (s *FeedbackStore) Entries(modelID string) ([]FeedbackEntry, bool) {
+	if !safeBaseName(modelID) {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path(modelID))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var entries []FeedbackEntry
+	latest := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e FeedbackEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || len(e.Label) != len(e.Output) {
+			continue
+		}
+		latest[e.RequestID] = len(entries)
+		entries = append(entries, e)
+	}
+
+	deduped := entries[:0]
+	for i, e := range entries {
+		if latest[e.RequestID] == i {
+			deduped = append(deduped, e)
+		}
+	}
+	return deduped, true
+}
+
+// feedbackAccuracy returns the share of entries whose predicted class matches
+// the label, and their mean squared error
+func feedbackAccuracy(entries []FeedbackEntry) (float64, float64) {
+	if len(entries) == 0 {
+		return 0, 0
+	}
+	correct := 0
+	var squaredError float64
+	for _, e := range entries {
+		if outputClass(e.Output) == outputClass(e.Label) {
+			correct++
+		}
+		for j := range e.Label {
+			d := e.Output[j] - e.Label[j]
+			squaredError += d * d / float64(len(e.Label))
+		}
+	}
+	n := float64(len(entries))
+	return float64(correct) / n, squaredError / n
+}
+
+// feedbackDrift compares the first and the last driftWindow labels of a
+// model. Drift is only judged once both windows are full and disjoint.
+func feedbackDrift(modelID string, entries []FeedbackEntry) map[string]interface{} {
+	accuracy, mse := feedbackAccuracy(entries)
+	stats := map[string]interface{}{
+		"model_id": modelID,
+		"feedback": len(entries),
+		"accuracy": accuracy,
+		"mse":      mse,
+		"window":   driftWindow,
+		"drifting": false,
+	}
+	if len(entries) == 0 {
+		return stats
+	}
+	stats["first_at"] = entries[0].At
+	stats["last_at"] = entries[len(entries)-1].At
+	if len(entries) < 2*driftWindow {
+		return stats
+	}
+
+	baseAccuracy, baseMSE := feedbackAccuracy(entries[:driftWindow])
+	recentAccuracy, recentMSE := feedbackAccuracy(entries[len(entries)-driftWindow:])
+	stats["baseline"] = map[string]float64{"accuracy": baseAccuracy, "mse": baseMSE}
+	stats["recent"] = map[string]float64{"accuracy": recentAccuracy, "mse": recentMSE}
+	stats["accuracy_drop"] = baseAccuracy - recentAccuracy
+	stats["drifting"] = baseAccuracy-recentAccuracy > driftThreshold
+	return stats
+}
+
+// feedbackDataset turns labels into TRAIN inputs and outputs, skipping
+// predictions whose input wasn't numeric
+func feedbackDataset(entries []FeedbackEntry) ([][]float64, [][]float64) {
+	inputs := [][]float64{}
+	outputs := [][]float64{}
+	for _, e := range entries {
+		if len(e.Input) == 0 {
+			continue
+		}
+		inputs = append(inputs, e.Input)
+		outputs = append(outputs, e.Label)
+	}
+	return inputs, outputs
+}
+
+// handleFeedback records the true label for an earlier PREDICT
+func handleFeedback(conn net.Conn, msg map[string]interface{}) {
+	requestID, _ := msg["request_id"].(string)
+	labelRaw, _ := msg["label"].([]interface{})
+	label, ok := parseNumericInput(labelRaw)
+	if requestID == "" || !ok || len(label) == 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing request_id or label"})
+		return
+	}
+
+	rec, err := predictionLog.Feedback(requestID, label)
+	if err != nil {
+		resp := map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		if errors.Is(err, errUnknownRequest) {
+			resp["code"] = "E_UNKNOWN_REQUEST"
+		}
+		sendResponse(conn, resp)
+		return
+	}
+
+	err = feedbackStore.Append(rec.modelID, FeedbackEntry{
+		RequestID: requestID,
+		At:        time.Now().UTC().Format(time.RFC3339Nano),
+		Input:     rec.input,
+		Output:    rec.output,
+		Label:     label,
+	})
+	if err != nil {
+		storageLog.Errorf("feedback: cannot store label for %s: %v", rec.modelID, err)
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Cannot store feedback: " + err.Error()})
+		return
+	}
+	metrics.Inc("feedback.received", 1)
+	sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": rec.modelID})
+}
+
+// handleFeedbackQuery serves FEEDBACK_STATS (accuracy and drift) and
+// EXPORT_FEEDBACK (the labels as a TRAIN dataset) for a model
+func handleFeedbackQuery(conn net.Conn, msg map[string]interface{}) {
+	msgType, _ := msg["type"].(string)
+	name, _ := msg["model_id"].(string)
+	if name == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+
+	modelID := canonicalModelID(name)
+	entries, ok := feedbackStore.Entries(modelID)
+	if !ok {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_NO_FEEDBACK", "message": "No feedback for model"})
+		return
+	}
+
+	if msgType == "FEEDBACK_STATS" {
+		stats := feedbackDrift(modelID, entries)
+		stats["status"] = "OK"
+		sendResponse(conn, stats)
+		return
+	}
+	inputs, outputs := feedbackDataset(entries)
+	sendResponse(conn, map[string]interface{}{
+		"status":   "OK",
+		"model_id": modelID,
+		"samples":  len(inputs),
+		"inputs":   inputs,
+		"outputs":  outputs,
+	})
+}
+
+// handleFeedbackAPI serves GET /api/feedback/{model}/stats and
+// GET /api/feedback/{model}/dataset
+func handleFeedbackAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/feedback/")
+	name, suffix, ok := strings.Cut(rest, "/")
+	if !ok || (suffix != "stats" && suffix != "dataset") {
+		http.NotFound(w, r)
+		return
+	}
+
+	modelID := canonicalModelID(name)
+	entries, found := feedbackStore.Entries(modelID)
+	if !found {
+		http.Error(w, "no feedback for model", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if suffix == "stats" {
+		json.NewEncoder(w).Encode(feedbackDrift(modelID, entries))
+		return
+	}
+	inputs, outputs := feedbackDataset(entries)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"model_id": modelID,
+		"inputs":   inputs,
+		"outputs":  outputs,
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// Chunked file replication
+// ============================================================================
+
+// A STORE_FILE entry carries the whole file as one base64 blob, which for a
+// real model overflows RPC buffers and makes every AppendEntries holding it
+// huge. Files larger than storeFileChunkBytes are committed as a transfer
+// of several entries instead:
+//
+//	{"action": "STORE_FILE_BEGIN", "transfer_id": "...", "filename": "model_x.bin", "size": 5242880, "chunks": 5, "sha256": "..."}
+//	{"action": "STORE_FILE_CHUNK", "transfer_id": "...", "seq": 0, "offset": 0, "data_b64": "...", "sha256": "..."}
+//	...
+//	{"action": "STORE_FILE_END", "transfer_id": "...", "filename": "model_x.bin", "sha256": "..."}
+//
+// BEGIN creates <filename>.<transfer_id>.part in the models directory, each
+// CHUNK checks its own checksum and writes at its offset, and END checks the
+// size and checksum of the whole file before renaming it into place, so a
+// reader never sees a partial model. Re-applying the entries after a
+// restart rewrites the same bytes; a transfer whose file is already in place
+// with the right checksum is skipped. A node that installs a snapshot taken
+// in the middle of a transfer misses its first chunks and logs the failed
+// END; the file reaches it with the next snapshot.
+
+// storeFileChunkBytes is the largest file replicated as a single STORE_FILE
+var storeFileChunkBytes = 1 << 20
+
+// fileTransfer is a chunked STORE_FILE being applied
+type fileTransfer struct {
+	Filename string
+	Size     int64
+	Chunks   int
+	SHA256   string
+	next     int  // next chunk expected
+	skip     bool // the file is already in place
+}
+
+func (t *fileTransfer) partPath(sm *ModelStateMachine, id string) string {
+	return filepath.Join(sm.modelsDir, t.Filename+"."+id+".part")
+}
+
+// replicateFile commits a file through RAFT as a STORE_FILE, or as a chunked
+// transfer when it is larger than storeFileChunkBytes, and returns the index
+// of the entry that makes it visible. With the file service up on every node
+// only a reference is committed (filetransfer.go).
+func replicateFile(filename string, data []byte) (int, error) {
+	if outOfBandReady() {
+		return replicateFileRef(filename, data)
+	}
+	if len(data) <= storeFileChunkBytes {
+		return replicateCommand(&StoreFileCommand{Filename: filename, DataB64: base64.StdEncoding.EncodeToString(data), SHA256: sha256Hex(data)})
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	sum := sha256Hex(data)
+	chunks := (len(data) + storeFileChunkBytes - 1) / storeFileChunkBytes
+	begin := &StoreFileBeginCommand{TransferID: id, Filename: filename, Size: int64(len(data)), Chunks: chunks, SHA256: sum}
+	if _, err := replicateCommand(begin); err != nil {
+		return -1, err
+	}
+	for seq := 0; seq < chunks; seq++ {
+		start := seq * storeFileChunkBytes
+		part := data[start:min(start+storeFileChunkBytes, len(data))]
+		chunk := &StoreFileChunkCommand{
+			TransferID: id,
+			Seq:        seq,
+			Offset:     int64(start),
+			DataB64:    base64.StdEncoding.EncodeToString(part),
+			SHA256:     sha256Hex(part),
+		}
+		if _, err := replicateCommand(chunk); err != nil {
+			return -1, fmt.Errorf("chunk %d/%d of %s: %v", seq+1, chunks, filename, err)
+		}
+	}
+	metrics.Inc("raft.chunked_files", 1)
+	return replicateCommand(&StoreFileEndCommand{TransferID: id, Filename: filename, SHA256: sum})
+}
+
+// replicateModelFile ships a model the leader created to every node, ahead
+// of the MODEL_TRAINED that makes it servable
+func replicateModelFile(modelPath string) error {
+	data, err := os.ReadFile(modelPath)
+	if err != nil {
+		return err
+	}
+	_, err = replicateFile(filepath.Base(modelPath), data)
+	return err
+}
+
+// StoreFileBeginCommand opens a chunked transfer
+type StoreFileBeginCommand struct {
+	TransferID string `json:"transfer_id"`
+	Filename   string `json:"filename"`
+	Size       int64  `json:"size"`
+	Chunks     int    `json:"chunks"`
+	SHA256     string `json:"sha256"`
+}
+
+func (c *StoreFileBeginCommand) Action() string { return "STORE_FILE_BEGIN" }
+
+func (c *StoreFileBeginCommand) Validate() error {
+	if c.TransferID == "" || !safeBaseName(c.TransferID) {
+		return fmt.Errorf("invalid transfer_id %q", c.TransferID)
+	}
+	if !safeBaseName(c.Filename) {
+		return fmt.Errorf("unsafe filename %q", c.Filename)
+	}
+	if c.Size <= 0 || c.Chunks <= 0 || c.SHA256 == "" {
+		return fmt.Errorf("missing size, chunks or sha256")
+	}
+	return nil
+}
+
+func (c *StoreFileBeginCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.RLock()
+	deletedID, deleted := sm.deletedFileLocked(c.Filename)
+	sm.mu.RUnlock()
+	if deleted {
+		return fmt.Errorf("%s belongs to deleted model %s", c.Filename, deletedID)
+	}
+
+	t := &fileTransfer{Filename: c.Filename, Size: c.Size, Chunks: c.Chunks, SHA256: c.SHA256}
+	if sum, err := fileSHA256(filepath.Join(sm.modelsDir, c.Filename)); err == nil && sum == c.SHA256 {
+		t.skip = true
+	} else {
+		f, err := os.Create(t.partPath(sm, c.TransferID))
+		if err != nil {
+			return fmt.Errorf("create part file: %v", err)
+		}
+		f.Close()
+	}
+
+	sm.mu.Lock()
+	sm.transfers[c.TransferID] = t
+	sm.mu.Unlock()
+	return nil
+}
+
+// StoreFileChunkCommand writes one piece of a chunked transfer
+type StoreFileChunkCommand struct {
+	TransferID string `json:"transfer_id"`
+	Seq        int    `json:"seq"`
+	Offset     int64  `json:"offset"`
+	DataB64    string `json:"data_b64"`
+	SHA256     string `json:"sha256"`
+}
+
+func (c *StoreFileChunkCommand) Action() string { return "STORE_FILE_CHUNK" }
+
+func (c *StoreFileChunkCommand) Validate() error {
+	if c.TransferID == "" || c.DataB64 == "" || c.SHA256 == "" {
+		return fmt.Errorf("missing transfer_id, data or sha256")
+	}
+	if c.Seq < 0 || c.Offset < 0 {
+		return fmt.Errorf("negative seq or offset")
+	}
+	return nil
+}
+
+func (c *StoreFileChunkCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	t, ok := sm.transfers[c.TransferID]
+	if ok && !t.skip {
+		if c.Seq != t.next {
+			sm.mu.Unlock()
+			return fmt.Errorf("transfer %s: chunk %d out of order, expected %d", c.TransferID, c.Seq, t.next)
+		}
+		t.next++
+	}
+	sm.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown transfer %s", c.TransferID)
+	}
+	if t.skip {
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(c.DataB64)
+	if err != nil {
+		return fmt.Errorf("base64 decode error: %v", err)
+	}
+	if sha256Hex(data) != c.SHA256 {
+		return fmt.Errorf("transfer %s: chunk %d fails its checksum", c.TransferID, c.Seq)
+	}
+	if c.Offset+int64(len(data)) > t.Size {
+		return fmt.Errorf("transfer %s: chunk %d ends past the file size", c.TransferID, c.Seq)
+	}
+	f, err := os.OpenFile(t.partPath(sm, c.TransferID), os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open part file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, c.Offset); err != nil {
+		return fmt.Errorf("write error: %v", err)
+	}
+	return nil
+}
+
+// StoreFileEndCommand checks a chunked transfer and moves the file into place
+type StoreFileEndCommand struct {
+	TransferID string `json:"transfer_id"`
+	Filename   string `json:"filename"`
+	SHA256     string `json:"sha256"`
+}
+
+func (c *StoreFileEndCommand) Action() string { return "STORE_FILE_END" }
+
+func (c *StoreFileEndCommand) Validate() error {
+	if c.TransferID == "" || c.SHA256 == "" {
+		return fmt.Errorf("missing transfer_id or sha256")
+	}
+	if !safeBaseName(c.Filename) {
+		return fmt.Errorf("unsafe filename %q", c.Filename)
+	}
+	return nil
+}
+
+func (c *StoreFileEndCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	t, ok := sm.transfers[c.TransferID]
+	delete(sm.transfers, c.TransferID)
+	deletedID, deleted := sm.deletedFileLocked(c.Filename)
+	sm.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown transfer %s", c.TransferID)
+	}
+	part := t.partPath(sm, c.TransferID)
+	if deleted {
+		os.Remove(part)
+		return fmt.Errorf("%s belongs to deleted model %s", c.Filename, deletedID)
+	}
+	if t.skip {
+		return nil
+	}
+
+	if t.next != t.Chunks {
+		os.Remove(part)
+		return fmt.Errorf("transfer %s: got %d of %d chunks", c.TransferID, t.next, t.Chunks)
+	}
+	info, err := os.Stat(part)
+	if err != nil {
+		return fmt.Errorf("stat part file: %v", err)
+	}
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return fmt.Errorf("read part file: %v", err)
+	}
+	if info.Size() != t.Size || sum != c.SHA256 || sum != t.SHA256 {
+		os.Remove(part)
+		return fmt.Errorf("transfer %s: %s fails its checksum", c.TransferID, c.Filename)
+	}
+	path := filepath.Join(sm.modelsDir, c.Filename)
+	if err := replaceFile(part, path); err != nil {
+		return fmt.Errorf("rename error: %v", err)
+	}
+	raftLog.Infof("applied STORE_FILE_END: wrote %s (%d bytes in %d chunks)", path, t.Size, t.Chunks)
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Out-of-band file transfer
+// ============================================================================
+
+// With -file-port set on every node, model files no longer travel through
+// the RAFT log at all. The leader keeps the file in <models-dir>/.outgoing
+// under its SHA-256 and commits only a reference to it:
+//
+//	{"action": "STORE_FILE_REF", "filename": "model_x.bin", "size": 5242880, "sha256": "...", "source": "host:port"}
+//
+// Applying the entry on the leader moves the staged file into place. A
+// follower only queues the file and moves on, so the applier never waits on
+// the network: a background queue (fileRepairs) pulls it over the file port
+// of the node named by source, falling back to the other peers, and retries
+// with backoff until it arrives. The file counts as present (FileIndex, the
+// files a snapshot ships) only once its bytes have the committed size and
+// checksum; meanwhile predictions for it go to the leader. Pending pulls are
+// kept in snapshots so a restart resumes them. Every node serves the files it holds
+// on its file port and says so in its RPC replies ("file_service": true,
+// "file_port": 9100):
+//
+//	-> {"type": "FILE_GET", "filename": "model_x.bin", "sha256": "..."}\n
+//	<- {"status": "OK", "size": 5242880}\n<5242880 raw bytes>
+//
+// The port carries the same TLS and cluster secret sealing as RAFT RPCs.
+// A peer's file port comes from the address book, which learns it from
+// those replies or from a host:client:raft:file entry in -peers. Until
+// every peer speaks fileTransferVersion and serves files on a known port
+// the leader keeps replicating them inline (filechunks.go).
+
+// fileTransferVersion is the first protocol version whose nodes apply
+// STORE_FILE_REF
+const fileTransferVersion = 6
+
+// fileServicePort is -file-port; 0 disables the service
+var fileServicePort int
+
+// outgoingDirName holds files staged by the leader, named by checksum
+const outgoingDirName = ".outgoing"
+
+// fileRepairMaxBackoff caps the wait between rounds of failed pulls
+const fileRepairMaxBackoff = time.Minute
+
+// fileServiceTimeout bounds a whole transfer between two nodes
+var fileServiceTimeout = 10 * time.Minute
+
+// peerFileServices remembers which RAFT addresses last answered with their
+// file service up ("file_service" in RPC replies)
+var peerFileServices = struct {
+	sync.RWMutex
+	up map[string]bool
+}{up: make(map[string]bool)}
+
+// notePeerFileService records whether the reply from addr advertised a file
+// service, and on which port
+func notePeerFileService(addr string, resp map[string]interface{}) {
+	up, _ := resp["file_service"].(bool)
+	if port, ok := resp["file_port"].(float64); ok {
+		host, raftPort, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(raftPort)
+		addressBook.SetFilePort(Peer{Host: host, Port: n}, int(port))
+	}
+	peerFileServices.Lock()
+	peerFileServices.up[addr] = up
+	peerFileServices.Unlock()
+}
+
+// outOfBandReady reports whether the file service is enabled here and every
+// peer is known to apply STORE_FILE_REF and serve files itself
+func outOfBandReady() bool {
+	if fileServicePort == 0 {
+		return false
+	}
+	peerFileServices.RLock()
+	defer peerFileServices.RUnlock()
+	for _, p := range raftNode.peersSnapshot() {
+		addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+		if knownPeerProtocol(addr) < fileTransferVersion || !peerFileServices.up[addr] {
+			return false
+		}
+		if _, ok := addressBook.FileAddress(p); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// replicateFileRef stages data and commits a STORE_FILE_REF for it
+func replicateFileRef(filename string, data []byte) (int, error) {
+	sum := sha256Hex(data)
+	staged := filepath.Join(modelStateMachine.modelsDir, outgoingDirName, sum)
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return -1, err
+	}
+	if err := writeFileSync(staged, data); err != nil {
+		return -1, fmt.Errorf("stage %s: %v", filename, err)
+	}
+	index, err := replicateCommand(&StoreFileRefCommand{Filename: filename, Size: int64(len(data)), SHA256: sum, Source: raftNode.id, SourceFilePort: fileServicePort})
+	if err != nil {
+		os.Remove(staged)
+		return index, err
+	}
+	metrics.Inc("raft.file_refs", 1)
+	return index, nil
+}
+
+// StoreFileRefCommand makes a file stored outside the log visible
+type StoreFileRefCommand struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Source   string `json:"source"` // id (host:port) of the node holding the file
+	// SourceFilePort is the port source serves files on, for followers
+	// that never got an RPC reply from it
+	SourceFilePort int `json:"source_file_port,omitempty"`
+
+	pending bool // not in place when applied; recordFile queues the pull
+}
+
+func (c *StoreFileRefCommand) Action() string { return "STORE_FILE_REF" }
+
+func (c *StoreFileRefCommand) Validate() error {
+	if !safeBaseName(c.Filename) {
+		return fmt.Errorf("unsafe filename %q", c.Filename)
+	}
+	if c.Size <= 0 {
+		return fmt.Errorf("missing size")
+	}
+	if _, err := hex.DecodeString(c.SHA256); err != nil || len(c.SHA256) != 2*sha256.Size {
+		return fmt.Errorf("invalid sha256 %q", c.SHA256)
+	}
+	return nil
+}
+
+func (c *StoreFileRefCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.RLock()
+	deletedID, deleted := sm.deletedFileLocked(c.Filename)
+	sm.mu.RUnlock()
+	staged := filepath.Join(sm.modelsDir, outgoingDirName, c.SHA256)
+	if deleted {
+		os.Remove(staged)
+		return fmt.Errorf("%s belongs to deleted model %s", c.Filename, deletedID)
+	}
+
+	path := filepath.Join(sm.modelsDir, c.Filename)
+	if sum, err := fileSHA256(path); err == nil && sum == c.SHA256 {
+		os.Remove(staged)
+		return nil
+	}
+	if _, err := os.Stat(staged); err == nil {
+		if err := replaceFile(staged, path); err != nil {
+			return fmt.Errorf("rename error: %v", err)
+		}
+		raftLog.Infof("applied STORE_FILE_REF: moved staged %s into place (%d bytes)", path, c.Size)
+		return nil
+	}
+
+	c.pending = true
+	raftLog.Infof("applied STORE_FILE_REF: %s queued for pulling (%d bytes)", path, c.Size)
+	return nil
+}
+
+// pendingFile is an out-of-band file committed at Index that hasn't arrived
+type pendingFile struct {
+	Index int                 `json:"index"`
+	Ref   StoreFileRefCommand `json:"ref"`
+}
+
+// fileRepairQueue pulls committed out-of-band files in the background until
+// they arrive
+type fileRepairQueue struct {
+	mu      sync.Mutex
+	pending map[string]pendingFile // by filename
+	wake    chan struct{}
+	start   sync.Once
+}
+
+var fileRepairs = &fileRepairQueue{pending: make(map[string]pendingFile), wake: make(chan struct{}, 1)}
+
+// Add queues the file of a STORE_FILE_REF applied at index, replacing any
+// older pull of the same file
+func (q *fileRepairQueue) Add(index int, c *StoreFileRefCommand) {
+	q.mu.Lock()
+	q.pending[c.Filename] = pendingFile{Index: index, Ref: *c}
+	q.mu.Unlock()
+	q.kick()
+}
+
+// Drop forgets a file a later entry replaced or deleted
+func (q *fileRepairQueue) Drop(name string) {
+	q.mu.Lock()
+	delete(q.pending, name)
+	q.mu.Unlock()
+}
+
+// Reset replaces the queue with the pulls recorded in a snapshot
+func (q *fileRepairQueue) Reset(files []pendingFile) {
+	q.mu.Lock()
+	q.pending = make(map[string]pendingFile, len(files))
+	for _, f := range files {
+		q.pending[f.Ref.Filename] = f
+	}
+	q.mu.Unlock()
+	if len(files) > 0 {
+		q.kick()
+	}
+}
+
+// List returns the pending files in log order
+func (q *fileRepairQueue) List() []pendingFile {
+	q.mu.Lock()
+	files := make([]pendingFile, 0, len(q.pending))
+	for _, f := range q.pending {
+		files = append(files, f)
+	}
+	q.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Index < files[j].Index })
+	return files
+}
+
+// done removes f unless a newer entry queued the file again
+func (q *fileRepairQueue) done(f pendingFile) {
+	q.mu.Lock()
+	if cur, ok := q.pending[f.Ref.Filename]; ok && cur.Index == f.Index {
+		delete(q.pending, f.Ref.Filename)
+	}
+	q.mu.Unlock()
+}
+
+// kick starts the puller on first use and wakes it
+func (q *fileRepairQueue) kick() {
+	q.start.Do(func() {
+		metrics.Gauge("raft.files_pending", func() float64 {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return float64(len(q.pending))
+		})
+		go q.run()
+	})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run makes a round over the pending files whenever one is queued, and
+// after a failed round again with growing backoff
+func (q *fileRepairQueue) run() {
+	backoff := time.Second
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-q.wake:
+		case <-retry:
+		}
+		failed := false
+		for _, f := range q.List() {
+			if err := pullFile(f); err != nil {
+				raftLog.Warnf("pull %s: %v; retrying in %v", f.Ref.Filename, err, backoff)
+				failed = true
+			}
+		}
+		retry = nil
+		if failed {
+			retry = time.After(backoff)
+			backoff = min(2*backoff, fileRepairMaxBackoff)
+		} else {
+			backoff = time.Second
+		}
+	}
+}
+
+// pullFile fetches a pending file from the first source that has it and
+// installs it
+func pullFile(f pendingFile) error {
+	c := &f.Ref
+	part := filepath.Join(modelStateMachine.modelsDir, c.Filename) + "." + c.SHA256[:12] + ".part"
+	lastErr := fmt.Errorf("no peer to pull from")
+	for _, addr := range fileSources(c.Source, c.SourceFilePort) {
+		err := fetchFile(addr, c, part)
+		if err == nil {
+			return installPulledFile(f, part, addr)
+		}
+		metrics.Inc("raft.file_pull_errors", 1)
+		raftLog.Warnf("pull %s from %s: %v", c.Filename, addr, err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+// installPulledFile moves a verified file into place and records it as
+// present, unless a later entry replaced or deleted it meanwhile. The
+// applier is held so no such entry can be applied halfway.
+func installPulledFile(f pendingFile, part, addr string) error {
+	raftNode.applyExec.Lock()
+	defer raftNode.applyExec.Unlock()
+	sm := modelStateMachine
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	defer fileRepairs.done(f)
+
+	if sm.checksums[f.Ref.Filename] != f.Ref.SHA256 {
+		os.Remove(part)
+		return nil
+	}
+	path := filepath.Join(sm.modelsDir, f.Ref.Filename)
+	if err := replaceFile(part, path); err != nil {
+		os.Remove(part)
+		return err
+	}
+	sm.files[f.Ref.Filename] = f.Index
+	metrics.Inc("raft.file_pulls", 1)
+	raftLog.Infof("pulled %s from %s (%d bytes, committed at %d)", path, addr, f.Ref.Size, f.Index)
+	return nil
+}
+
+// fileSources returns the file service addresses to pull from: the node
+// named source first, then every other peer, which may have applied the
+// entry already. Other peers whose file port isn't known are left out.
+func fileSources(source string, sourceFilePort int) []string {
+	host, port, _ := net.SplitHostPort(source)
+	var first, rest []string
+	for _, p := range raftNode.peersSnapshot() {
+		addr, ok := addressBook.FileAddress(p)
+		// a node bound to a wildcard address names itself by it
+		if strconv.Itoa(p.WorkerPort) == port && (p.Host == host || net.ParseIP(host).IsUnspecified()) {
+			if !ok && sourceFilePort > 0 {
+				addr, ok = net.JoinHostPort(p.Host, strconv.Itoa(sourceFilePort)), true
+			}
+			if ok {
+				first = append(first, addr)
+			}
+		} else if ok {
+			rest = append(rest, addr)
+		}
+	}
+	return append(first, rest...)
+}
+
+// fetchFile pulls the file described by c from the file service at addr
+// into part, which it removes unless size and checksum match
+func fetchFile(addr string, c *StoreFileRefCommand, part string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fileServiceTimeout)
+	defer cancel()
+	conn, err := dialPeer(ctx, addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fileServiceTimeout))
+
+	req, _ := json.Marshal(map[string]interface{}{"type": "FILE_GET", "filename": c.Filename, "sha256": c.SHA256, "proto": ProtocolVersion})
+	sealed, nonce := sealRequest(req)
+	if _, err := conn.Write(append(sealed, '\n')); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read header: %v", err)
+	}
+	body, err := openResponse(line, nonce)
+	if err != nil {
+		return err
+	}
+	var header struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Size    int64  `json:"size"`
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return fmt.Errorf("bad header: %v", err)
+	}
+	if header.Status != "OK" {
+		return fmt.Errorf("%s", header.Message)
+	}
+	if header.Size != c.Size {
+		return fmt.Errorf("size %d, committed %d", header.Size, c.Size)
+	}
+
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(f, h), reader, c.Size)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != c.SHA256 {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
+
+// startFileServer serves the files this node holds to its peers
+func startFileServer(host string, port int) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+	listener, err := listen(addr, raftTLS)
+	if err != nil {
+		raftLog.Errorf("file service listen error: %v", err)
+		return
+	}
+	defer listener.Close()
+	raftLog.Infof("file service listening on %s", addr)
+
+	for {
+		select {
+		case <-raftNode.stopCh:
+			return
+		default:
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go serveFile(conn)
+	}
+}
+
+func serveFile(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fileServiceTimeout))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	body, nonce, err := openRequest(line[:len(line)-1])
+	if err != nil {
+		metrics.Inc("raft.auth_failures", 1)
+		raftLog.Warnf("rejected file request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	reply := func(resp map[string]interface{}) error {
+		data, _ := json.Marshal(resp)
+		_, err := conn.Write(append(sealResponse(data, nonce), '\n'))
+		return err
+	}
+
+	var req struct {
+		Type     string `json:"type"`
+		Filename string `json:"filename"`
+		SHA256   string `json:"sha256"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Type != "FILE_GET" || !safeBaseName(req.Filename) || !safeBaseName(req.SHA256) {
+		reply(map[string]interface{}{"status": "ERROR", "message": "bad request"})
+		return
+	}
+
+	path := filepath.Join(modelStateMachine.modelsDir, outgoingDirName, req.SHA256)
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(modelStateMachine.modelsDir, req.Filename)
+		if sum, err := fileSHA256(path); err != nil || sum != req.SHA256 {
+			reply(map[string]interface{}{"status": "ERROR", "message": "no such file"})
+			return
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		reply(map[string]interface{}{"status": "ERROR", "message": "no such file"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		reply(map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	if err := reply(map[string]interface{}{"status": "OK", "size": info.Size()}); err != nil {
+		return
+	}
+	if _, err := io.Copy(conn, f); err != nil {
+		raftLog.Warnf("send %s to %s: %v", req.Filename, conn.RemoteAddr(), err)
+	}
+}
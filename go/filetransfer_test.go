@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreFileRefPullsOffTheApplier(t *testing.T) {
+	dir := t.TempDir()
+	sm := NewModelStateMachine(dir)
+	savedSM, savedNode := modelStateMachine, raftNode
+	modelStateMachine, raftNode = sm, newTestNode(t, 1)
+	t.Cleanup(func() { modelStateMachine, raftNode = savedSM, savedNode })
+	fileRepairs.start.Do(func() {}) // no background puller: the test installs by hand
+
+	data := []byte("model bytes")
+	ref := map[string]interface{}{
+		"action":   "STORE_FILE_REF",
+		"filename": "model_x.bin",
+		"size":     float64(len(data)),
+		"sha256":   sha256Hex(data),
+		"source":   "127.0.0.1:1",
+	}
+	if err := sm.Apply(5, ref); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, ok := sm.FileIndex("model_x.bin"); ok {
+		t.Fatal("file recorded as present before it arrived")
+	}
+	pending := fileRepairs.List()
+	if len(pending) != 1 || pending[0].Index != 5 || pending[0].Ref.Filename != "model_x.bin" {
+		t.Fatalf("pending pulls = %+v", pending)
+	}
+
+	part := filepath.Join(dir, "model_x.bin.part")
+	if err := os.WriteFile(part, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installPulledFile(pending[0], part, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if index, ok := sm.FileIndex("model_x.bin"); !ok || index != 5 {
+		t.Errorf("FileIndex = %d, %v; want 5, true", index, ok)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "model_x.bin")); err != nil || string(got) != string(data) {
+		t.Errorf("installed file = %q, %v", got, err)
+	}
+	if n := len(fileRepairs.List()); n != 0 {
+		t.Errorf("%d pulls still pending", n)
+	}
+}
+
+func TestPulledFileSupersededWhilePending(t *testing.T) {
+	dir := t.TempDir()
+	sm := NewModelStateMachine(dir)
+	savedSM, savedNode := modelStateMachine, raftNode
+	modelStateMachine, raftNode = sm, newTestNode(t, 1)
+	t.Cleanup(func() { modelStateMachine, raftNode = savedSM, savedNode })
+	fileRepairs.start.Do(func() {})
+
+	old := []byte("old version")
+	if err := sm.Apply(5, map[string]interface{}{
+		"action": "STORE_FILE_REF", "filename": "model_y.bin",
+		"size": float64(len(old)), "sha256": sha256Hex(old), "source": "127.0.0.1:1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pulled := fileRepairs.List()[0]
+	if err := sm.Apply(6, map[string]interface{}{"action": "DELETE_FILE", "filename": "model_y.bin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	part := filepath.Join(dir, "model_y.bin.part")
+	os.WriteFile(part, old, 0644)
+	if err := installPulledFile(pulled, part, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "model_y.bin")); !os.IsNotExist(err) {
+		t.Error("a deleted file was installed")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Error("the stale download was left behind")
+	}
+	if n := len(fileRepairs.List()); n != 0 {
+		t.Errorf("%d pulls still pending", n)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ============================================================================
+// Per-peer replication flow control
+// ============================================================================
+
+// Flow control limits. A follower with this much unacknowledged data in
+// flight is skipped for new entries until it catches up, instead of piling
+// more timed-out RPCs onto a slow link.
+var (
+	maxInflightEntries       = 64
+	maxInflightBytes   int64 = 32 << 20
+	maxPeerBackoff           = 30 * time.Second
+)
+
+// peerFlow is the leader's view of one follower's replication pipeline
+type peerFlow struct {
+	inflightEntries int
+	inflightBytes   int64
+	failures        int
+	pausedUntil     time.Time
+	skipped         int64
+}
+
+// flowFor returns the flow state for a peer, creating it on first use
+func (rn *RaftNode) flowFor(key string) *peerFlow {
+	rn.flowMu.Lock()
+	defer rn.flowMu.Unlock()
+	f, ok := rn.flows[key]
+	if !ok {
+		f = &peerFlow{}
+		rn.flows[key] = f
+	}
+	return f
+}
+
+// acquireFlow reserves pipeline capacity for entries bound to a peer. It
+// returns false (and counts a skip) when the peer is paused or saturated.
+func (rn *RaftNode) acquireFlow(key string, entries int, bytes int64) bool {
+	f := rn.flowFor(key)
+	rn.flowMu.Lock()
+	defer rn.flowMu.Unlock()
+
+	if time.Now().Before(f.pausedUntil) ||
+		(f.inflightEntries > 0 && (f.inflightEntries+entries > maxInflightEntries || f.inflightBytes+bytes > maxInflightBytes)) {
+		f.skipped++
+		metrics.Inc("raft.flow.skipped", 1)
+		return false
+	}
+	f.inflightEntries += entries
+	f.inflightBytes += bytes
+	return true
+}
+
+// releaseFlow returns capacity and updates the peer's backoff: each failure
+// doubles the pause (capped), any success clears it
+func (rn *RaftNode) releaseFlow(key string, entries int, bytes int64, ok bool) {
+	f := rn.flowFor(key)
+	rn.flowMu.Lock()
+	defer rn.flowMu.Unlock()
+
+	f.inflightEntries -= entries
+	f.inflightBytes -= bytes
+	rn.recordFlowResult(f, key, ok)
+}
+
+// noteHeartbeat lets heartbeat results clear or extend a peer's backoff
+func (rn *RaftNode) noteHeartbeat(key string, ok bool) {
+	f := rn.flowFor(key)
+	rn.flowMu.Lock()
+	defer rn.flowMu.Unlock()
+	rn.recordFlowResult(f, key, ok)
+}
+
+// recordFlowResult updates backoff; callers hold rn.flowMu
+func (rn *RaftNode) recordFlowResult(f *peerFlow, key string, ok bool) {
+	if ok {
+		if f.failures > 0 {
+			raftLog.Debugf("flow: peer %s recovered after %d failures", key, f.failures)
+		}
+		f.failures = 0
+		f.pausedUntil = time.Time{}
+		return
+	}
+	f.failures++
+	backoff := time.Duration(1<<uint(min(f.failures, 6))) * rn.heartbeatInterval()
+	if backoff > maxPeerBackoff {
+		backoff = maxPeerBackoff
+	}
+	f.pausedUntil = time.Now().Add(backoff)
+}
+
+// flowSnapshot copies a peer's flow state for status reporting
+func (rn *RaftNode) flowSnapshot(key string) peerFlow {
+	rn.flowMu.Lock()
+	defer rn.flowMu.Unlock()
+	if f, ok := rn.flows[key]; ok {
+		return *f
+	}
+	return peerFlow{}
+}
+
+// entriesSize estimates the wire size of entries
+func entriesSize(entries []LogEntry) int64 {
+	data, _ := json.Marshal(entries)
+	return int64(len(data))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ============================================================================
+// Length-prefixed message framing
+// ============================================================================
+
+// A framed message is a 4-byte big-endian body length followed by the JSON
+// body. Newline-delimited JSON is still accepted on every port: a JSON line
+// starts with '{' or whitespace, while a frame header starts with a byte no
+// greater than maxFrameSize>>24, so the first byte tells the two apart.
+// Servers answer in the framing of the request; senders frame only for peers
+// known to speak framingVersion.
+
+// framingVersion is the protocol version that understands framed messages
+const framingVersion = 4
+
+// maxFrameSize bounds a frame body. It keeps the header's first byte below
+// '\t', the first whitespace a JSON line may start with; larger messages are
+// sent newline-delimited.
+const maxFrameSize = 128 << 20
+
+// isFrameHeader reports whether b can only start a frame header
+func isFrameHeader(b byte) bool {
+	return b <= maxFrameSize>>24
+}
+
+// readMessage reads one message in either framing and reports which one was
+// used. In line mode the trailing newline is stripped and, like
+// ReadString, a final unterminated line is returned together with io.EOF.
+func readMessage(r *bufio.Reader) ([]byte, bool, error) {
+	first, err := r.Peek(1)
+	if err != nil || !isFrameHeader(first[0]) {
+		line, err := r.ReadString('\n')
+		return []byte(trimLine(line)), false, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, true, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, true, fmt.Errorf("frame of %d bytes exceeds %d", size, maxFrameSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, true, err
+	}
+	return body, true, nil
+}
+
+// writeMessage writes body as a frame, or as a JSON line when framed is
+// false or the body is too large for a frame
+func writeMessage(w io.Writer, body []byte, framed bool) error {
+	if !framed || len(body) > maxFrameSize {
+		_, err := w.Write(append(body, '\n'))
+		return err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// peerFramed reports whether messages to addr should be framed
+func peerFramed(addr string) bool {
+	return knownPeerProtocol(addr) >= framingVersion
+}
+
+// framedConn answers a framed client request: handlers write one JSON line
+// per response through sendResponse, which is re-encoded as a frame
+type framedConn struct {
+	net.Conn
+}
+
+func (c *framedConn) Write(p []byte) (int, error) {
+	body := p
+	if n := len(body); n > 0 && body[n-1] == '\n' {
+		body = body[:n-1]
+	}
+	if err := writeMessage(c.Conn, body, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestMessageFramingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		framed bool
+	}{
+		{name: "line", body: `{"type":"PING"}`},
+		{name: "frame", body: `{"type":"PING"}`, framed: true},
+		{name: "frame with newlines in body", body: "{\"type\":\n\"PING\"}", framed: true},
+		{name: "line with leading whitespace", body: ` {"type":"PING"}`},
+		{name: "empty frame", framed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeMessage(&buf, []byte(tt.body), tt.framed); err != nil {
+				t.Fatal(err)
+			}
+			body, framed, err := readMessage(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("readMessage: %v", err)
+			}
+			if framed != tt.framed || string(body) != tt.body {
+				t.Errorf("read %q framed=%v, want %q framed=%v", body, framed, tt.body, tt.framed)
+			}
+		})
+	}
+}
+
+func TestReadMessageMixedStream(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessage(&buf, []byte(`{"n":1}`), true)
+	writeMessage(&buf, []byte(`{"n":2}`), false)
+	writeMessage(&buf, []byte(`{"n":3}`), true)
+	buf.WriteString(`{"n":4}`) // unterminated final line
+
+	r := bufio.NewReader(&buf)
+	for i, want := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		body, _, err := readMessage(r)
+		if err != nil || string(body) != want {
+			t.Fatalf("message %d = %q, %v; want %q", i+1, body, err, want)
+		}
+	}
+	body, framed, err := readMessage(r)
+	if err != io.EOF || framed || string(body) != `{"n":4}` {
+		t.Errorf("final line = %q framed=%v, %v; want %q with io.EOF", body, framed, err, `{"n":4}`)
+	}
+}
+
+func TestReadMessageRejectsBadFrames(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+	if _, framed, err := readMessage(bufio.NewReader(bytes.NewReader(header[:]))); err == nil || !framed {
+		t.Errorf("oversized frame: framed=%v err=%v, want a framed error", framed, err)
+	}
+
+	binary.BigEndian.PutUint32(header[:], 10)
+	truncated := append(header[:], `{"a"`...)
+	if _, _, err := readMessage(bufio.NewReader(bytes.NewReader(truncated))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: err=%v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestFramedConnReframesResponses(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		conn := &framedConn{Conn: server}
+		conn.Write([]byte("{\"status\":\"OK\"}\n"))
+		server.Close()
+	}()
+
+	body, framed, err := readMessage(bufio.NewReader(client))
+	if err != nil || !framed || string(body) != `{"status":"OK"}` {
+		t.Errorf("got %q framed=%v, %v; want the response as a frame without its newline", body, framed, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Geo-replication bridge
+// ============================================================================
+
+// GeoReplicator ships committed entries (and the model files they reference)
+// to the leader of a standby cluster. It is best-effort and asynchronous: the
+// standby is never part of the RAFT quorum, so a slow or unreachable region
+// only increases lag instead of blocking commits.
+type GeoReplicator struct {
+	target   string // host:port of any worker in the standby cluster
+	maxQueue int
+
+	mu        sync.Mutex
+	queue     []geoItem
+	notify    chan struct{}
+	shipped   int
+	dropped   int
+	failures  int
+	lastShip  time.Time
+	lastError string
+}
+
+type geoItem struct {
+	command    map[string]interface{}
+	enqueuedAt time.Time
+}
+
+// NewGeoReplicator creates a replicator for the given standby address
+func NewGeoReplicator(target string, maxQueue int) *GeoReplicator {
+	if maxQueue <= 0 {
+		maxQueue = 1000
+	}
+	return &GeoReplicator{
+		target:   target,
+		maxQueue: maxQueue,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue records a committed command for shipping. When the queue is full the
+// oldest entry is dropped so a long outage cannot exhaust memory.
+func (g *GeoReplicator) Enqueue(cmd map[string]interface{}) {
+	action, _ := cmd["action"].(string)
+	if action != "STORE_FILE" && action != "MODEL_TRAINED" {
+		return
+	}
+
+	g.mu.Lock()
+	if len(g.queue) >= g.maxQueue {
+		g.queue = g.queue[1:]
+		g.dropped++
+	}
+	g.queue = append(g.queue, geoItem{command: cmd, enqueuedAt: time.Now()})
+	g.mu.Unlock()
+
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run drains the queue until stopCh is closed. Only the local RAFT leader
+// ships entries; followers discard theirs since the leader holds the same log.
+func (g *GeoReplicator) Run(stopCh <-chan struct{}) {
+	geoLog.Infof("replicating committed entries to standby cluster at %s", g.target)
+
+	retry := time.NewTicker(5 * time.Second)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-g.notify:
+		case <-retry.C:
+		}
+
+		for {
+			g.mu.Lock()
+			if len(g.queue) == 0 {
+				g.mu.Unlock()
+				break
+			}
+			item := g.queue[0]
+			g.mu.Unlock()
+
+			if !raftNode.IsLeader() {
+				g.mu.Lock()
+				g.queue = g.queue[:0]
+				g.mu.Unlock()
+				break
+			}
+
+			if err := g.ship(item.command); err != nil {
+				g.mu.Lock()
+				g.failures++
+				g.lastError = err.Error()
+				g.mu.Unlock()
+				geoLog.Warnf("ship failed, will retry: %v", err)
+				break
+			}
+
+			g.mu.Lock()
+			if len(g.queue) > 0 {
+				g.queue = g.queue[1:]
+			}
+			g.shipped++
+			g.lastShip = time.Now()
+			g.lastError = ""
+			g.mu.Unlock()
+		}
+	}
+}
+
+// ship converts a committed command into a STORE_FILE payload and sends it to
+// the standby cluster, following one REDIRECT to its leader if necessary.
+func (g *GeoReplicator) ship(cmd map[string]interface{}) error {
+	payload, err := geoPayload(cmd)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+
+	msg := map[string]interface{}{
+		"type":    "GEO_REPLICATE",
+		"command": payload,
+	}
+
+	addr := g.target
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := sendClientMessage(addr, msg, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		status, _ := resp["status"].(string)
+		switch status {
+		case "OK":
+			return nil
+		case "REDIRECT":
+			leader, _ := resp["leader"].([]interface{})
+			if len(leader) != 2 {
+				return fmt.Errorf("standby redirect without leader")
+			}
+			host, _ := leader[0].(string)
+			port, _ := leader[1].(float64)
+			addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		default:
+			message, _ := resp["message"].(string)
+			return fmt.Errorf("standby rejected entry: %s", message)
+		}
+	}
+	return fmt.Errorf("standby redirect loop")
+}
+
+// geoPayload builds the STORE_FILE command the standby applies. MODEL_TRAINED
+// entries only carry a local path, so the model file is read and inlined.
+func geoPayload(cmd map[string]interface{}) (map[string]interface{}, error) {
+	action, _ := cmd["action"].(string)
+	switch action {
+	case "STORE_FILE":
+		return cmd, nil
+	case "MODEL_TRAINED":
+		modelPath, _ := cmd["model_path"].(string)
+		if modelPath == "" {
+			return nil, nil
+		}
+		data, err := os.ReadFile(modelPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				geoLog.Warnf("skipping %s, model file no longer exists", modelPath)
+				return nil, nil
+			}
+			return nil, err
+		}
+		return map[string]interface{}{
+			"action":   "STORE_FILE",
+			"filename": filepath.Base(modelPath),
+			"data_b64": base64.StdEncoding.EncodeToString(data),
+		}, nil
+	}
+	return nil, nil
+}
+
+// Status returns lag metrics for the monitor
+func (g *GeoReplicator) Status() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	lagSeconds := 0.0
+	if len(g.queue) > 0 {
+		lagSeconds = time.Since(g.queue[0].enqueuedAt).Seconds()
+	}
+	var lastShip interface{}
+	if !g.lastShip.IsZero() {
+		lastShip = g.lastShip.UTC().Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"target":      g.target,
+		"pending":     len(g.queue),
+		"lag_seconds": lagSeconds,
+		"shipped":     g.shipped,
+		"dropped":     g.dropped,
+		"failures":    g.failures,
+		"last_ship":   lastShip,
+		"last_error":  g.lastError,
+	}
+}
+
+// sendClientMessage sends one JSON request to a worker's client port and
+// reads the single response.
+func sendClientMessage(addr string, msg map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	return sendClientMessageContext(context.Background(), addr, msg, timeout)
+}
+
+// errNotSent wraps failures that happened before the request left this
+// node, so the remote worker certainly never ran it
+var errNotSent = errors.New("request not sent")
+
+// sendClientMessageContext is sendClientMessage with cancellation: closing
+// the connection when ctx ends lets the remote worker notice and abort too.
+func sendClientMessageContext(ctx context.Context, addr string, msg map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	return sendClientMessageStream(ctx, addr, msg, timeout, nil)
+}
+
+// sendClientMessageStream is sendClientMessageContext for requests answered
+// with PROGRESS messages before the final response; each one is passed to
+// onProgress
+func sendClientMessageStream(ctx context.Context, addr string, msg map[string]interface{}, timeout time.Duration, onProgress func(map[string]interface{})) (map[string]interface{}, error) {
+	conn, err := dialPeer(ctx, addr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	data, err := json.Marshal(encodeForPeer(addr, msg))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+	// with API tokens on, the node's own requests are sealed to pass as a
+	// node; a proxied one keeps its client's token (acl.go)
+	msgType, _ := msg["type"].(string)
+	proxied, _ := msg["proxied"].(bool)
+	if authenticatedRequests[msgType] || apiTokensEnabled() && !proxied {
+		data, _ = sealRequest(data)
+	}
+	if err := writeMessage(conn, data, peerFramed(addr)); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, _, err := readMessage(reader)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		var resp map[string]interface{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, err
+		}
+		if status, _ := resp["status"].(string); status == "PROGRESS" && onProgress != nil {
+			onProgress(resp)
+			continue
+		}
+		if v, ok := resp["proto"].(float64); ok {
+			notePeerProtocol(addr, int(v))
+		}
+		return resp, nil
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/proyecto-final/worker-go
 
-go 1.21
+go 1.24
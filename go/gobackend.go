@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Native Go backend
+// ============================================================================
+
+// With -backend=go the worker runs the TrainingModule commands itself, so a
+// node needs no JVM. The network is the same sigmoid MLP trained with
+// per-sample backpropagation, and each command prints what TrainingModule
+// prints, so callers parse one format for both backends. Networks with one
+// hidden layer are saved as a Java-serialized NeuralNetwork that the JVM
+// loads as-is; deeper ones (-hidden-layers) use a Go-only format.
+
+// Model backends selectable with -backend
+const (
+	BackendJava = "java"
+	BackendGo   = "go"
+)
+
+var (
+	modelBackend = BackendJava
+	hiddenLayers []int // -hidden-layers; nil uses TrainingModule's heuristic
+)
+
+// goModelMagic starts model files only the Go backend can read
+const goModelMagic = "GOMLP1\n"
+
+// goLearningRate matches NeuralNetwork.learningRate
+const goLearningRate = 0.5
+
+// goNetwork is a sigmoid MLP; layers[i].Weights is [input][neuron]
+type goNetwork struct {
+	modelID      string
+	learningRate float64
+	layers       []mlpLayer
+}
+
+// newGoNetwork creates a network with Xavier-initialized weights and zero
+// biases, as NeuralNetwork does
+func newGoNetwork(sizes []int) *goNetwork {
+	n := &goNetwork{modelID: newUUID(), learningRate: goLearningRate}
+	for l := 1; l < len(sizes); l++ {
+		in, out := sizes[l-1], sizes[l]
+		limit := math.Sqrt(6.0 / float64(in+out))
+		layer := mlpLayer{Weights: make([][]float64, in), Bias: make([]float64, out)}
+		for i := range layer.Weights {
+			layer.Weights[i] = make([]float64, out)
+			for j := range layer.Weights[i] {
+				layer.Weights[i][j] = (mrand.Float64()*2 - 1) * limit
+			}
+		}
+		n.layers = append(n.layers, layer)
+	}
+	return n
+}
+
+// newUUID returns a random (version 4) UUID, the form of Java model ids
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validate checks that consecutive layers fit together
+func (n *goNetwork) validate() error {
+	if len(n.layers) < 2 {
+		return errors.New("network needs a hidden and an output layer")
+	}
+	width := len(n.layers[0].Weights)
+	for i, l := range n.layers {
+		if len(l.Weights) != width || len(l.Bias) == 0 {
+			return fmt.Errorf("layer %d has %d weight rows, expected %d", i, len(l.Weights), width)
+		}
+		for _, row := range l.Weights {
+			if len(row) != len(l.Bias) {
+				return fmt.Errorf("layer %d weight row has %d columns, bias has %d", i, len(row), len(l.Bias))
+			}
+		}
+		width = len(l.Bias)
+	}
+	return nil
+}
+
+func (n *goNetwork) sizes() []int {
+	sizes := []int{len(n.layers[0].Weights)}
+	for _, l := range n.layers {
+		sizes = append(sizes, len(l.Bias))
+	}
+	return sizes
+}
+
+func (n *goNetwork) parameterCount() int {
+	count := 0
+	for _, l := range n.layers {
+		count += len(l.Weights)*len(l.Bias) + len(l.Bias)
+	}
+	return count
+}
+
+// activations returns the input followed by the output of every layer
+func (n *goNetwork) activations(input []float64) [][]float64 {
+	acts := [][]float64{input}
+	x := input
+	for _, l := range n.layers {
+		out := make([]float64, len(l.Bias))
+		for j := range out {
+			sum := l.Bias[j]
+			for i, v := range x {
+				sum += v * l.Weights[i][j]
+			}
+			out[j] = 1 / (1 + math.Exp(-sum))
+		}
+		acts = append(acts, out)
+		x = out
+	}
+	return acts
+}
+
+// Predict runs a forward pass
+func (n *goNetwork) Predict(input []float64) ([]float64, error) {
+	if len(input) != len(n.layers[0].Weights) {
+		return nil, fmt.Errorf("Input size mismatch: expected %d, got %d", len(n.layers[0].Weights), len(input))
+	}
+	acts := n.activations(input)
+	return acts[len(acts)-1], nil
+}
+
+// trainSample does one backpropagation step and returns the sample's mean
+// squared error, like NeuralNetwork.trainSingle
+func (n *goNetwork) trainSample(input, target []float64) float64 {
+	acts := n.activations(input)
+	output := acts[len(acts)-1]
+
+	deltas := make([]float64, len(output))
+	var totalError float64
+	for k, o := range output {
+		e := target[k] - o
+		deltas[k] = e * o * (1 - o)
+		totalError += e * e
+	}
+
+	for l := len(n.layers) - 1; l >= 0; l-- {
+		layer := n.layers[l]
+		in := acts[l]
+		var prev []float64
+		if l > 0 {
+			prev = make([]float64, len(in))
+			for i := range in {
+				var e float64
+				for j, d := range deltas {
+					e += d * layer.Weights[i][j]
+				}
+				prev[i] = e * in[i] * (1 - in[i])
+			}
+		}
+		for i, v := range in {
+			for j, d := range deltas {
+				layer.Weights[i][j] += n.learningRate * d * v
+			}
+		}
+		for j, d := range deltas {
+			layer.Bias[j] += n.learningRate * d
+		}
+		deltas = prev
+	}
+	return totalError / float64(len(output))
+}
+
+// Train runs epochs of per-sample backpropagation, printing progress in
+// TrainingModule's format. It stops early when ctx is cancelled.
+func (n *goNetwork) Train(ctx context.Context, inputs, outputs [][]float64, epochs int, out io.Writer) error {
+	fmt.Fprintln(out, "Training with Go backend")
+	fmt.Fprintln(out, "Model ID: "+n.modelID)
+	fmt.Fprintf(out, "Samples: %d, Epochs: %d\n", len(inputs), epochs)
+	for epoch := 0; epoch < epochs; epoch++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var totalError float64
+		for i := range inputs {
+			totalError += n.trainSample(inputs[i], outputs[i])
+		}
+		if epoch%100 == 0 || epoch == epochs-1 {
+			fmt.Fprintf(out, "Epoch %d/%d - Error: %.6f\n", epoch+1, epochs, totalError/float64(len(inputs)))
+		}
+	}
+	fmt.Fprintln(out, "Training complete!")
+	return nil
+}
+
+// goModelFile is the Go-only format for networks deeper than NeuralNetwork
+type goModelFile struct {
+	ModelID      string     `json:"model_id"`
+	LearningRate float64    `json:"learning_rate"`
+	Layers       []mlpLayer `json:"layers"`
+}
+
+// Save writes the network in the Java format when it has one hidden layer
+func (n *goNetwork) Save(path string) error {
+	var data []byte
+	if len(n.layers) == 2 {
+		var err error
+		if data, err = encodeJavaNetwork(n); err != nil {
+			return err
+		}
+	} else {
+		body, err := json.Marshal(goModelFile{ModelID: n.modelID, LearningRate: n.learningRate, Layers: n.layers})
+		if err != nil {
+			return err
+		}
+		data = append([]byte(goModelMagic), body...)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadGoNetwork reads a model saved by either backend
+func loadGoNetwork(path string) (*goNetwork, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(goModelMagic)) {
+		return decodeJavaNetwork(bytes.NewReader(data))
+	}
+
+	var file goModelFile
+	if err := json.Unmarshal(data[len(goModelMagic):], &file); err != nil {
+		return nil, fmt.Errorf("corrupt model file: %v", err)
+	}
+	n := &goNetwork{modelID: file.ModelID, learningRate: file.LearningRate, layers: file.Layers}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseHiddenLayers parses -hidden-layers, e.g. "16,8"
+func parseHiddenLayers(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid layer size %q", part)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// runGoBackend runs a TrainingModule command in-process and returns what
+// the JVM would print
+func runGoBackend(ctx context.Context, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	if len(args) == 0 {
+		return nil, errors.New("missing command")
+	}
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "train":
+		if observe := outputObserver(ctx); observe != nil {
+			lines := &lineWriter{observe: observe}
+			err = goTrain(ctx, lines, args)
+			out.Write(lines.buf.Bytes())
+			break
+		}
+		err = goTrain(ctx, &out, args)
+	case "predict":
+		err = goPredict(&out, args)
+	case "predict_batch":
+		err = goPredictBatch(&out, args)
+	case "describe":
+		err = goDescribe(&out, args)
+	case "export":
+		err = goExport(&out, args)
+	case "evaluate":
+		err = goEvaluate(&out, args)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(&out, "Error: "+err.Error())
+	}
+	return out.Bytes(), err
+}
+
+func goTrain(ctx context.Context, out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return errors.New("Usage: train <inputs.csv> <outputs.csv> [epochs] [model_output_path]")
+	}
+	epochs := 1000
+	if len(args) > 3 {
+		var err error
+		if epochs, err = strconv.Atoi(args[3]); err != nil {
+			return fmt.Errorf("invalid epochs %q", args[3])
+		}
+	}
+	inputs, err := loadCSVMatrix(args[1])
+	if err != nil {
+		return err
+	}
+	outputs, err := loadCSVMatrix(args[2])
+	if err != nil {
+		return err
+	}
+	if len(inputs) != len(outputs) {
+		return errors.New("Inputs and outputs must have same number of samples")
+	}
+	if len(inputs) == 0 {
+		return errors.New("no samples")
+	}
+	for i := range inputs {
+		if len(inputs[i]) != len(inputs[0]) || len(outputs[i]) != len(outputs[0]) {
+			return fmt.Errorf("sample %d has a different width", i)
+		}
+	}
+	fmt.Fprintf(out, "Loaded %d samples\n", len(inputs))
+	fmt.Fprintf(out, "Input size: %d\n", len(inputs[0]))
+	fmt.Fprintf(out, "Output size: %d\n", len(outputs[0]))
+
+	sizes := []int{len(inputs[0])}
+	if hiddenLayers != nil {
+		sizes = append(sizes, hiddenLayers...)
+	} else {
+		sizes = append(sizes, max(4, (len(inputs[0])+len(outputs[0]))/2))
+	}
+	sizes = append(sizes, len(outputs[0]))
+
+	n := newGoNetwork(sizes)
+	if err := n.Train(ctx, inputs, outputs, epochs, out); err != nil {
+		return err
+	}
+
+	modelPath := "model_" + n.modelID + ".bin"
+	if len(args) > 4 {
+		modelPath = args[4]
+	}
+	if err := n.Save(modelPath); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Model saved to: "+modelPath)
+	fmt.Fprintln(out, "MODEL_ID:"+n.modelID)
+	fmt.Fprintln(out, "MODEL_PATH:"+modelPath)
+	return nil
+}
+
+// parseCSVRow parses comma-separated numbers like Double.parseDouble
+func parseCSVRow(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	row := make([]float64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p)
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+func loadCSVMatrix(path string) ([][]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows [][]float64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		row, err := parseCSVRow(line)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func formatPrediction(output []float64) string {
+	parts := make([]string, len(output))
+	for i, v := range output {
+		parts[i] = fmt.Sprintf("%.6f", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func goPredict(out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return errors.New("Usage: predict <model.bin> <value1,value2,...>")
+	}
+	n, err := loadGoNetwork(args[1])
+	if err != nil {
+		return err
+	}
+	input, err := parseCSVRow(args[2])
+	if err != nil {
+		return err
+	}
+	output, err := n.Predict(input)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "PREDICTION:"+formatPrediction(output))
+	return nil
+}
+
+func goPredictBatch(out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return errors.New("Usage: predict_batch <model.bin> <v1,v2;v3,v4;...>")
+	}
+	n, err := loadGoNetwork(args[1])
+	if err != nil {
+		return err
+	}
+	for s, sample := range strings.Split(args[2], ";") {
+		input, err := parseCSVRow(sample)
+		if err != nil {
+			return err
+		}
+		output, err := n.Predict(input)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "PREDICTION[%d]:%s\n", s, formatPrediction(output))
+	}
+	return nil
+}
+
+// layerNames names tensors like NeuralNetwork does for its single hidden
+// layer, numbering the hidden layers of deeper networks
+func (n *goNetwork) layerNames() []string {
+	names := make([]string, len(n.layers))
+	for i := range n.layers {
+		switch {
+		case i == len(n.layers)-1:
+			names[i] = "output"
+		case len(n.layers) == 2:
+			names[i] = "hidden"
+		default:
+			names[i] = fmt.Sprintf("hidden%d", i+1)
+		}
+	}
+	return names
+}
+
+func goDescribe(out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: describe <model.bin>")
+	}
+	n, err := loadGoNetwork(args[1])
+	if err != nil {
+		return err
+	}
+	sizes := make([]string, 0, len(n.layers)+1)
+	for _, s := range n.sizes() {
+		sizes = append(sizes, strconv.Itoa(s))
+	}
+	fmt.Fprintln(out, "MODEL_ID:"+n.modelID)
+	fmt.Fprintln(out, "LAYERS:"+strings.Join(sizes, ","))
+	fmt.Fprintf(out, "PARAMS:%d\n", n.parameterCount())
+
+	names := n.layerNames()
+	for i, l := range n.layers {
+		from := "input"
+		if i > 0 {
+			from = names[i-1]
+		}
+		fmt.Fprintln(out, "WEIGHTS:"+describeTensor("weights_"+from+"_"+names[i], l.Weights))
+		fmt.Fprintln(out, "WEIGHTS:"+describeTensor("bias_"+names[i], [][]float64{l.Bias}))
+	}
+	return nil
+}
+
+// describeTensor matches NeuralNetwork.describeTensor
+func describeTensor(name string, t [][]float64) string {
+	rows, cols := len(t), 0
+	if rows > 0 {
+		cols = len(t[0])
+	}
+	minV, maxV := math.Inf(1), math.Inf(-1)
+	var sum float64
+	count := 0
+	for _, row := range t {
+		for _, v := range row {
+			minV = math.Min(minV, v)
+			maxV = math.Max(maxV, v)
+			sum += v
+			count++
+		}
+	}
+	var mean, std float64
+	if count > 0 {
+		mean = sum / float64(count)
+		var variance float64
+		for _, row := range t {
+			for _, v := range row {
+				variance += (v - mean) * (v - mean)
+			}
+		}
+		std = math.Sqrt(variance / float64(count))
+	} else {
+		minV, maxV = 0, 0
+	}
+	return fmt.Sprintf("%s,%d,%d,%d,%.6f,%.6f,%.6f,%.6f", name, rows, cols, count, minV, maxV, mean, std)
+}
+
+// exportJSON builds the document of docs/MODEL_EXPORT_FORMAT.md. Non-finite
+// values export as null, as in NeuralNetwork.toJson.
+func (n *goNetwork) exportJSON() string {
+	var sb strings.Builder
+	vector := func(v []float64) {
+		sb.WriteByte('[')
+		for i, x := range v {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				sb.WriteString("null")
+			} else {
+				sb.WriteString(strconv.FormatFloat(x, 'g', -1, 64))
+			}
+		}
+		sb.WriteByte(']')
+	}
+
+	sizes := n.sizes()
+	fmt.Fprintf(&sb, `{"format":"mlp-sigmoid","format_version":1,"model_id":%q`, n.modelID)
+	fmt.Fprintf(&sb, `,"architecture":{"input_size":%d,"hidden_size":%d,"output_size":%d`, sizes[0], sizes[1], sizes[len(sizes)-1])
+	if len(n.layers) > 2 {
+		hidden, _ := json.Marshal(sizes[1 : len(sizes)-1])
+		fmt.Fprintf(&sb, `,"hidden_sizes":%s`, hidden)
+	}
+	sb.WriteString(`,"activation":"sigmoid"},"layers":[`)
+	for i, l := range n.layers {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `{"name":%q,"weights":[`, n.layerNames()[i])
+		for r, row := range l.Weights {
+			if r > 0 {
+				sb.WriteByte(',')
+			}
+			vector(row)
+		}
+		sb.WriteString(`],"bias":`)
+		vector(l.Bias)
+		sb.WriteByte('}')
+	}
+	sb.WriteString("]}")
+	return sb.String()
+}
+
+func goExport(out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: export <model.bin>")
+	}
+	n, err := loadGoNetwork(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "EXPORT:"+n.exportJSON())
+	return nil
+}
+
+func goEvaluate(out io.Writer, args []string) error {
+	if len(args) < 4 {
+		return errors.New("Usage: evaluate <model.bin> <inputs.csv> <outputs.csv>")
+	}
+	n, err := loadGoNetwork(args[1])
+	if err != nil {
+		return err
+	}
+	inputs, err := loadCSVMatrix(args[2])
+	if err != nil {
+		return err
+	}
+	outputs, err := loadCSVMatrix(args[3])
+	if err != nil {
+		return err
+	}
+	if len(inputs) != len(outputs) {
+		return errors.New("Inputs and outputs must have same number of samples")
+	}
+
+	var sqError float64
+	values, correct := 0, 0
+	for s := range inputs {
+		predicted, err := n.Predict(inputs[s])
+		if err != nil {
+			return err
+		}
+		expected := outputs[s]
+		for i := 0; i < len(expected) && i < len(predicted); i++ {
+			d := predicted[i] - expected[i]
+			sqError += d * d
+			values++
+		}
+		if len(expected) == 1 {
+			if (predicted[0] >= 0.5) == (expected[0] >= 0.5) {
+				correct++
+			}
+		} else if outputClass(predicted) == outputClass(expected) {
+			correct++
+		}
+	}
+
+	var loss, accuracy float64
+	if values > 0 {
+		loss = sqError / float64(values)
+	}
+	if len(inputs) > 0 {
+		accuracy = float64(correct) / float64(len(inputs))
+	}
+	fmt.Fprintf(out, "EVAL:loss=%.6f,accuracy=%.6f,samples=%d\n", loss, accuracy, len(inputs))
+	return nil
+}
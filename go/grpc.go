@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// gRPC API
+// ============================================================================
+
+// With -grpc-port the worker also serves the Worker service of
+// proto/worker.proto (Train, Predict, ListModels, JobStatus) over HTTP/2,
+// with TLS when the client port has it and in cleartext (h2c) otherwise.
+// Each call becomes the JSON request of the line protocol and runs through
+// handleConnection, so tokens, ACL, rate limits and deadlines apply as on
+// the client port:
+//
+//	grpcurl -plaintext -import-path proto -proto worker.proto \
+//	  -d '{"model_id": "...", "input": [0, 1]}' localhost:9500 worker.v1.Worker/Predict
+//
+// The call's deadline (grpc-timeout) becomes timeout_ms and an API token
+// goes in the "authorization" metadata as "Bearer <token>". A follower runs
+// a Train on the leader itself rather than redirecting. Errors end the call
+// with the gRPC status matching their code (E_TIMEOUT is DEADLINE_EXCEEDED,
+// E_QUEUE_FULL is RESOURCE_EXHAUSTED, ...) and the message as grpc-message.
+// Compressed messages are not supported.
+
+// grpcService is the path prefix of the Worker service's methods
+const grpcService = "/worker.v1.Worker/"
+
+// grpcMaxMessage bounds a request message, like a framed line (framing.go)
+const grpcMaxMessage = 128 << 20
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcCancelled          = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcUnavailable        = 14
+	grpcDataLoss           = 15
+	grpcUnauthenticated    = 16
+)
+
+// grpcCodes maps the error codes of the JSON protocol to gRPC status codes;
+// the rest are UNKNOWN
+var grpcCodes = map[string]int{
+	"E_TIMEOUT":             grpcDeadlineExceeded,
+	"E_CANCELLED":           grpcCancelled,
+	"E_AUTH":                grpcUnauthenticated,
+	"E_FORBIDDEN":           grpcPermissionDenied,
+	"E_BAD_INPUT":           grpcInvalidArgument,
+	"E_PROTOCOL":            grpcInvalidArgument,
+	"E_QUEUE_FULL":          grpcResourceExhausted,
+	"E_QUOTA":               grpcResourceExhausted,
+	"E_DISK_FULL":           grpcResourceExhausted,
+	"E_JOB_NOT_FOUND":       grpcNotFound,
+	"E_NOT_PENDING":         grpcNotFound,
+	"E_NAME_CONFLICT":       grpcAlreadyExists,
+	"E_PAGE_EXPIRED":        grpcFailedPrecondition,
+	"E_NO_MATCHING_NODE":    grpcFailedPrecondition,
+	"E_SESSION":             grpcUnavailable,
+	"E_MAINTENANCE":         grpcUnavailable,
+	"E_PROXY":               grpcUnavailable,
+	"E_DATASET_UNAVAILABLE": grpcUnavailable,
+	"E_MODEL_CORRUPT":       grpcDataLoss,
+}
+
+// grpcMethod adapts one rpc of the Worker service to a JSON request
+type grpcMethod struct {
+	request  func(body []byte) (map[string]interface{}, error)
+	response func(resp map[string]interface{}) []byte
+	// progress encodes a PROGRESS message of a streaming call
+	progress func(msg map[string]interface{}) []byte
+}
+
+var grpcMethods = map[string]grpcMethod{
+	"Train":      {request: grpcTrainRequest, response: grpcTrainResult, progress: grpcTrainProgress},
+	"Predict":    {request: grpcPredictRequest, response: grpcPredictResponse},
+	"ListModels": {request: grpcListModelsRequest, response: grpcListModelsResponse},
+	"JobStatus":  {request: grpcJobStatusRequest, response: grpcJobStatusResponse},
+}
+
+// grpcError ends a call with a status other than OK
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// startGRPCServer serves the gRPC API on port
+func startGRPCServer(host string, port int) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+	tcpLog.Infof("Starting gRPC server on %s", addr)
+
+	server := &http.Server{Addr: addr, Handler: http.HandlerFunc(handleGRPC), Protocols: new(http.Protocols)}
+	if clientTLS != nil {
+		server.Protocols.SetHTTP2(true)
+		server.TLSConfig = clientTLS
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			tcpLog.Errorf("gRPC server error: %v", err)
+		}
+		return
+	}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	if err := server.ListenAndServe(); err != nil {
+		tcpLog.Errorf("gRPC server error: %v", err)
+	}
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, grpcService)
+	metrics.Inc("grpc.calls", 1)
+	w.Header().Set("Content-Type", "application/grpc")
+
+	method, ok := grpcMethods[name]
+	if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+		grpcFinish(w, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path})
+		return
+	}
+	if isShuttingDown() {
+		grpcFinish(w, &grpcError{grpcUnavailable, "worker is shutting down"})
+		return
+	}
+	body, err := readGRPCMessage(r)
+	if err != nil {
+		grpcFinish(w, err)
+		return
+	}
+	msg, err := method.request(body)
+	if err != nil {
+		grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+		return
+	}
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseGRPCTimeout(timeout)
+		if err != nil {
+			grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+			return
+		}
+		msg["timeout_ms"] = max(float64(d.Milliseconds()), 1)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		msg["auth"] = token
+	}
+
+	var onProgress func(map[string]interface{})
+	if method.progress != nil {
+		flusher, _ := w.(http.Flusher)
+		onProgress = func(progress map[string]interface{}) {
+			writeGRPCMessage(w, method.progress(progress))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	resp, err := dispatchGRPC(r.Context(), r.RemoteAddr, msg, onProgress)
+	if err == nil && name == "JobStatus" {
+		resp, err = grpcJobModel(r.Context(), r.RemoteAddr, msg, resp)
+	}
+	if err != nil {
+		grpcFinish(w, err)
+		return
+	}
+	writeGRPCMessage(w, method.response(resp))
+	grpcFinish(w, nil)
+}
+
+// dispatchGRPC runs msg as a client-port request and returns its answer,
+// following a REDIRECT to the leader
+func dispatchGRPC(ctx context.Context, remote string, msg map[string]interface{}, onProgress func(map[string]interface{})) (map[string]interface{}, error) {
+	resp, err := dispatchLocal(ctx, remote, msg, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	if resp["status"] == "REDIRECT" {
+		leader, _ := resp["leader"].([]interface{})
+		if len(leader) != 2 {
+			return nil, &grpcError{grpcUnavailable, "no leader available"}
+		}
+		host, _ := leader[0].(string)
+		port, _ := leader[1].(float64)
+		forward := make(map[string]interface{}, len(msg)+1)
+		for k, v := range msg {
+			forward[k] = v
+		}
+		forward["proxied"] = true
+		if deadline, ok := ctx.Deadline(); ok {
+			forward["timeout_ms"] = max(float64(time.Until(deadline).Milliseconds()), 1)
+		}
+		msgType, _ := msg["type"].(string)
+		tcpLog.Infof("gRPC %s: running on leader %s:%d", msgType, host, int(port))
+		resp, err = sendClientMessageStream(ctx, net.JoinHostPort(host, strconv.Itoa(int(port))), forward, proxyTimeout, onProgress)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, &grpcError{grpcCancelled, ctx.Err().Error()}
+			}
+			return nil, &grpcError{grpcUnavailable, "leader unreachable: " + err.Error()}
+		}
+	}
+	if status, _ := resp["status"].(string); status != "OK" && status != "PARTIAL" {
+		code, _ := resp["code"].(string)
+		message, _ := resp["message"].(string)
+		if message == "" {
+			message = status
+		}
+		grpcCode, ok := grpcCodes[code]
+		if !ok {
+			grpcCode = grpcUnknown
+		}
+		return nil, &grpcError{grpcCode, message}
+	}
+	return resp, nil
+}
+
+// dispatchLocal runs msg through handleConnection over an in-memory
+// connection, passing PROGRESS messages to onProgress. Ending ctx closes the
+// connection, which aborts a TRAIN like a client disconnecting.
+func dispatchLocal(ctx context.Context, remote string, msg map[string]interface{}, onProgress func(map[string]interface{})) (map[string]interface{}, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	atomic.AddInt64(&openConns, 1)
+	go handleConnection(&grpcConn{Conn: server, remote: remote})
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	data, _ := json.Marshal(msg)
+	if _, err := client.Write(append(data, '\n')); err != nil {
+		return nil, &grpcError{grpcCancelled, "call cancelled"}
+	}
+	reader := bufio.NewReader(client)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, &grpcError{grpcCancelled, "call cancelled"}
+			}
+			return nil, &grpcError{grpcUnknown, "no answer"}
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, &grpcError{grpcUnknown, err.Error()}
+		}
+		if resp["status"] == "PROGRESS" {
+			if onProgress != nil {
+				onProgress(resp)
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// grpcConn is the server end of dispatchLocal's connection, addressed as the
+// gRPC client so per-client limits apply to it
+type grpcConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *grpcConn) RemoteAddr() net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", c.remote); err == nil {
+		return addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readGRPCMessage reads the one message of a unary request
+func readGRPCMessage(r *http.Request) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if header[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("message of %d bytes exceeds %d", size, grpcMaxMessage)}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, body); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	return body, nil
+}
+
+func writeGRPCMessage(w io.Writer, body []byte) {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	w.Write(header[:])
+	w.Write(body)
+}
+
+// grpcFinish sends the call's status as trailers
+func grpcFinish(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	if err != nil {
+		code, message = grpcUnknown, err.Error()
+		if e, ok := err.(*grpcError); ok {
+			code = e.code
+		}
+		metrics.Inc("grpc.errors", 1)
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+// grpcEncodeMessage percent-encodes a grpc-message as the protocol requires
+func grpcEncodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c <= 0x7E && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses a grpc-timeout header (e.g. "500m", "30S")
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if !ok || err != nil || n <= 0 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// ---------------------------------------------------------------------------
+// Messages
+// ---------------------------------------------------------------------------
+
+// grpcRows decodes a Row message into the JSON form of one sample
+func grpcRows(rows []interface{}, data []byte) ([]interface{}, error) {
+	var values []float64
+	err := readProto(data, func(f protoField) (err error) {
+		if f.num == 1 {
+			values, err = f.doubles(values)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return append(rows, row), nil
+}
+
+func grpcTrainRequest(body []byte) (map[string]interface{}, error) {
+	msg := map[string]interface{}{"type": "TRAIN"}
+	var inputs, outputs []interface{}
+	constraints := make(map[string]interface{})
+	err := readProto(body, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			inputs, err = grpcRows(inputs, f.data)
+		case 2:
+			outputs, err = grpcRows(outputs, f.data)
+		case 3:
+			var key, value string
+			err = readProto(f.data, func(e protoField) error {
+				if e.num == 1 {
+					key = e.string()
+				} else if e.num == 2 {
+					value = e.string()
+				}
+				return nil
+			})
+			constraints[key] = value
+		case 4:
+			msg["stream_progress"] = f.bool()
+		case 5:
+			if f.bool() {
+				msg["publish"] = false
+			}
+		}
+		return err
+	})
+	msg["inputs"], msg["outputs"] = inputs, outputs
+	if len(constraints) > 0 {
+		msg["constraints"] = constraints
+	}
+	return msg, err
+}
+
+func grpcTrainProgress(progress map[string]interface{}) []byte {
+	var p, event protoWriter
+	p.string(1, stringField(progress, "job_id"))
+	p.int(2, int64(floatField(progress, "epoch")))
+	p.int(3, int64(floatField(progress, "epochs")))
+	p.double(4, floatField(progress, "loss"))
+	p.string(5, stringField(progress, "event"))
+	p.int(6, int64(floatField(progress, "chunk_id")))
+	p.string(7, stringField(progress, "worker"))
+	p.int(8, int64(floatField(progress, "chunks_done")))
+	p.int(9, int64(floatField(progress, "chunks")))
+	event.message(1, &p)
+	return event.buf
+}
+
+func grpcTrainResult(resp map[string]interface{}) []byte {
+	var res, event protoWriter
+	res.string(1, stringField(resp, "model_id"))
+	res.string(2, stringField(resp, "job_id"))
+	res.bool(3, resp["status"] == "PARTIAL")
+	pending, _ := resp["pending"].(bool)
+	res.bool(4, pending)
+	event.message(2, &res)
+	return event.buf
+}
+
+func grpcPredictRequest(body []byte) (map[string]interface{}, error) {
+	msg := map[string]interface{}{"type": "PREDICT"}
+	var input []float64
+	err := readProto(body, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			msg["model_id"] = f.string()
+		case 2:
+			input, err = f.doubles(input)
+		}
+		return err
+	})
+	values := make([]interface{}, len(input))
+	for i, v := range input {
+		values[i] = v
+	}
+	msg["input"] = values
+	return msg, err
+}
+
+func grpcPredictResponse(resp map[string]interface{}) []byte {
+	var w protoWriter
+	w.doubles(1, floatList(resp["output"]))
+	w.string(2, stringField(resp, "request_id"))
+	return w.buf
+}
+
+func grpcListModelsRequest(body []byte) (map[string]interface{}, error) {
+	msg := map[string]interface{}{"type": "LIST_MODELS"}
+	err := readProto(body, func(f protoField) error {
+		switch f.num {
+		case 1:
+			if limit := f.int(); limit > 0 {
+				msg["limit"] = float64(limit)
+			}
+		case 2:
+			if token := f.string(); token != "" {
+				msg["page_token"] = token
+			}
+		}
+		return nil
+	})
+	return msg, err
+}
+
+func grpcListModelsResponse(resp map[string]interface{}) []byte {
+	var w protoWriter
+	details, _ := resp["details"].([]interface{})
+	for _, d := range details {
+		m, _ := d.(map[string]interface{})
+		var info protoWriter
+		info.string(1, stringField(m, "model_id"))
+		info.string(2, stringField(m, "file"))
+		info.string(3, stringField(m, "created_at"))
+		info.string(4, stringField(m, "creator"))
+		info.string(5, stringField(m, "backend"))
+		info.int(6, int64(floatField(m, "samples")))
+		info.int(7, int64(floatField(m, "input_size")))
+		info.int(8, int64(floatField(m, "output_size")))
+		info.int(9, int64(floatField(m, "epochs")))
+		if loss, ok := m["training_loss"].(float64); ok {
+			info.optionalDouble(10, loss)
+		}
+		info.string(11, stringField(m, "sha256"))
+		w.message(1, &info)
+	}
+	w.string(2, stringField(resp, "next_page_token"))
+	return w.buf
+}
+
+func grpcJobStatusRequest(body []byte) (map[string]interface{}, error) {
+	msg := map[string]interface{}{"type": "JOB_STATUS"}
+	err := readProto(body, func(f protoField) error {
+		if f.num == 1 {
+			msg["job_id"] = f.string()
+		}
+		return nil
+	})
+	return msg, err
+}
+
+// grpcJobModel adds the model of a finished job to its JOB_STATUS, asking
+// JOB_RESULT for it when the status doesn't carry it
+func grpcJobModel(ctx context.Context, remote string, msg, status map[string]interface{}) (map[string]interface{}, error) {
+	if status["state"] != JobStateDone || stringField(status, "model_id") != "" {
+		return status, nil
+	}
+	query := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		query[k] = v
+	}
+	query["type"] = "JOB_RESULT"
+	result, err := dispatchGRPC(ctx, remote, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	status["model_id"] = result["model_id"]
+	return status, nil
+}
+
+func grpcJobStatusResponse(resp map[string]interface{}) []byte {
+	var w protoWriter
+	w.string(1, stringField(resp, "job_id"))
+	w.string(2, stringField(resp, "state"))
+	w.int(3, int64(floatField(resp, "samples")))
+	w.string(4, stringField(resp, "node"))
+	w.int(5, int64(floatField(resp, "queue_position")))
+	w.string(6, stringField(resp, "submitted_at"))
+	w.string(7, stringField(resp, "started_at"))
+	w.string(8, stringField(resp, "finished_at"))
+	w.string(9, stringField(resp, "model_id"))
+	return w.buf
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func floatField(m map[string]interface{}, key string) float64 {
+	f, _ := m[key].(float64)
+	return f
+}
+
+func floatList(v interface{}) []float64 {
+	list, _ := v.([]interface{})
+	values := make([]float64, 0, len(list))
+	for _, x := range list {
+		f, _ := x.(float64)
+		values = append(values, f)
+	}
+	return values
+}
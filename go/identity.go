@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// Node identity
+// ============================================================================
+
+// host:port says where a node is, not which node it is: a storage dir
+// copied to a second machine starts a node with the same RAFT state and log
+// under a new address, and the cluster silently counts it twice. Each node
+// keeps a random UUID next to its RAFT state, created on first start, and
+// stamps it on every RAFT RPC and reply. A node that meets its own UUID at
+// another address has a twin: the one that started later refuses to join
+// and exits, and the other ignores its twin's messages. ADD_SERVER refuses
+// a server whose UUID is already in the cluster. Peers that predate UUIDs
+// send none and are never flagged.
+
+const nodeUUIDFile = "node_uuid"
+
+// nodeUUIDPath is where this node's UUID is stored, for error messages
+var nodeUUIDPath string
+
+// loadNodeUUID reads the node's UUID from dir, creating it on first start
+func loadNodeUUID(dir string) (string, error) {
+	path := filepath.Join(dir, nodeUUIDFile)
+	nodeUUIDPath = path
+	if data, err := os.ReadFile(path); err == nil {
+		if uuid := strings.TrimSpace(string(data)); uuid != "" {
+			return uuid, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	uuid := newUUID()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(uuid+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if err := replaceFile(tmp, path); err != nil {
+		return "", err
+	}
+	workerLog.Infof("generated node uuid %s", uuid)
+	return uuid, nil
+}
+
+// SetUUID sets the node's persistent identity; call before Start
+func (rn *RaftNode) SetUUID(uuid string) {
+	rn.uuid = uuid
+}
+
+// stampIdentity adds this node's identity to an outgoing RPC or reply,
+// along with its scheduling labels
+func (rn *RaftNode) stampIdentity(m map[string]interface{}) {
+	if len(rn.labels) > 0 {
+		m["node_labels"] = rn.labels
+	}
+	if rn.uuid == "" {
+		return
+	}
+	m["node_uuid"] = rn.uuid
+	m["node_id"] = rn.id
+	m["node_started"] = rn.started.UnixMilli()
+}
+
+// isTwin reports whether m comes from another node with this node's UUID.
+// When this node started after its twin it refuses to stay and exits.
+func (rn *RaftNode) isTwin(m map[string]interface{}) bool {
+	uuid, _ := m["node_uuid"].(string)
+	otherID, _ := m["node_id"].(string)
+	if uuid == "" || uuid != rn.uuid || otherID == rn.id {
+		return false
+	}
+	metrics.Inc("raft.duplicate_node", 1)
+
+	started, otherStarted := rn.started.UnixMilli(), int64(numberOr(m["node_started"], 0))
+	if started > otherStarted || (started == otherStarted && rn.id > otherID) {
+		workerLog.Errorf("node uuid %s is already used by %s, which started first; refusing to join "+
+			"(if this storage dir was copied, delete %s and restart)", uuid, otherID, nodeUUIDPath)
+		closeLog()
+		os.Exit(1)
+	}
+
+	rn.mu.Lock()
+	first := !rn.twins[otherID]
+	rn.twins[otherID] = true
+	rn.mu.Unlock()
+	if first {
+		raftLog.Errorf("%s started with this node's uuid %s, ignoring it until it stops", otherID, uuid)
+	}
+	return true
+}
+
+// checkNewMember refuses to add a server that shares its UUID with this
+// node or with a current member. Servers that don't answer, or predate
+// UUIDs, are let through.
+func (rn *RaftNode) checkNewMember(p Peer) error {
+	resp := sendRaftRPC(p.Host, p.Port, map[string]interface{}{"type": STATE_QUERY})
+	uuid, _ := resp["node_uuid"].(string)
+	if uuid == "" {
+		return nil
+	}
+
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	if uuid == rn.uuid {
+		return fmt.Errorf("%s:%d has the same node uuid as the leader (%s)", p.Host, p.Port, uuid)
+	}
+	for _, m := range rn.membersLocked() {
+		key := fmt.Sprintf("%s:%d", m.Host, m.Port)
+		if rn.peerUUIDs[key] == uuid && !(m.Host == p.Host && m.Port == p.Port) {
+			return fmt.Errorf("%s:%d has the same node uuid as member %s (%s)", p.Host, p.Port, key, uuid)
+		}
+	}
+	return nil
+}
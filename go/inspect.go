@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Model inspection
+// ============================================================================
+
+// handleInspectModel returns layer sizes, parameter count and per-tensor
+// weight statistics for a stored model
+func handleInspectModel(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+
+	tcpLog.Infof("INSPECT_MODEL request: model=%s", modelID)
+
+	modelPath := findEvaluableModel(modelID)
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+
+	info := runJavaDescribe(ctx, modelPath)
+	if requestTimedOut(conn, ctx, "INSPECT_MODEL") {
+		return
+	}
+	if info == nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Inspection failed"})
+		return
+	}
+	info["status"] = "OK"
+	sendResponse(conn, info)
+}
+
+// runJavaDescribe runs the backend "describe" mode and parses its output:
+//
+//	MODEL_ID:<id>
+//	LAYERS:<in>,<hidden>,<out>
+//	PARAMS:<n>
+//	WEIGHTS:<name>,<rows>,<cols>,<params>,<min>,<max>,<mean>,<std>
+func runJavaDescribe(ctx context.Context, modelPath string) map[string]interface{} {
+	javaLog.Debugf("Running: TrainingModule describe %s", modelPath)
+
+	defer metrics.Since("java.describe", time.Now())
+	output, err := runJava(ctx, nil, "describe", modelPath)
+	if err != nil {
+		javaLog.Errorf("Java describe error: %v", err)
+		return nil
+	}
+
+	info := map[string]interface{}{}
+	var tensors []interface{}
+	for _, line := range splitLines(string(output)) {
+		switch {
+		case strings.HasPrefix(line, "MODEL_ID:"):
+			info["model_id"] = strings.TrimPrefix(line, "MODEL_ID:")
+		case strings.HasPrefix(line, "LAYERS:"):
+			var layers []int
+			for _, v := range strings.Split(strings.TrimPrefix(line, "LAYERS:"), ",") {
+				n, _ := strconv.Atoi(strings.TrimSpace(v))
+				layers = append(layers, n)
+			}
+			info["layers"] = layers
+		case strings.HasPrefix(line, "PARAMS:"):
+			n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "PARAMS:")))
+			info["parameters"] = n
+		case strings.HasPrefix(line, "WEIGHTS:"):
+			parts := strings.Split(strings.TrimPrefix(line, "WEIGHTS:"), ",")
+			if len(parts) != 8 {
+				continue
+			}
+			num := func(i int) float64 {
+				f, _ := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+				return f
+			}
+			tensors = append(tensors, map[string]interface{}{
+				"name":   parts[0],
+				"shape":  []int{int(num(1)), int(num(2))},
+				"params": int(num(3)),
+				"min":    num(4),
+				"max":    num(5),
+				"mean":   num(6),
+				"std":    num(7),
+			})
+		}
+	}
+
+	if _, ok := info["layers"]; !ok {
+		javaLog.Infof("Java describe: unexpected output for %s", modelPath)
+		return nil
+	}
+	info["weights"] = tensors
+	return info
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Model file integrity
+// ============================================================================
+
+// Every entry that creates a model file also fixes its SHA-256: TRAIN and
+// AGGREGATE_MODELS put it in the MODEL_TRAINED metadata, STORE_FILE carries
+// it next to the data, and chunked and out-of-band transfers already commit
+// it. The state machine keeps the checksum of each file, in snapshots too,
+// and checks the bytes against it
+//
+//   - when a STORE_FILE is applied, when a follower installs the files of a
+//     snapshot and when a recovering node fetches a model from a peer;
+//   - before a model is used for PREDICT, PREDICT_BATCH or EVALUATE. The
+//     file is hashed once and again only after its size or modification
+//     time change, and a mismatch answers E_MODEL_CORRUPT.
+//
+// VERIFY_MODELS (or GET /admin/verify-models on the monitor) hashes every
+// file in the models directory and reports the corrupt and missing ones,
+// plus model files with no recorded checksum, written before checksums or
+// by a worker that doesn't send them. The last report shows in /status.
+
+// errModelCorrupt marks a model file whose contents don't match its checksum
+var errModelCorrupt = errors.New("model file fails its checksum")
+
+// verifiedFile is a model file that matched its checksum when last hashed
+type verifiedFile struct {
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+var verifiedModels = struct {
+	sync.Mutex
+	files map[string]verifiedFile
+}{files: make(map[string]verifiedFile)}
+
+// Checksum returns the SHA-256 recorded for a file in the models directory
+func (sm *ModelStateMachine) Checksum(name string) (string, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	sum, ok := sm.checksums[name]
+	return sum, ok
+}
+
+// Checksums returns a copy of every recorded checksum
+func (sm *ModelStateMachine) Checksums() map[string]string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	sums := make(map[string]string, len(sm.checksums))
+	for name, sum := range sm.checksums {
+		sums[name] = sum
+	}
+	return sums
+}
+
+// verifyModelFile checks a model file against its recorded checksum. Files
+// without one pass.
+func verifyModelFile(path string) error {
+	want, ok := modelStateMachine.Checksum(filepath.Base(path))
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	verifiedModels.Lock()
+	v, cached := verifiedModels.files[path]
+	verifiedModels.Unlock()
+	if cached && v.size == info.Size() && v.modTime.Equal(info.ModTime()) && v.sha256 == want {
+		return nil
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		metrics.Inc("models.corrupt", 1)
+		storageLog.Errorf("%s: sha256 %s, recorded %s", path, sum, want)
+		return fmt.Errorf("%w: %s", errModelCorrupt, filepath.Base(path))
+	}
+	verifiedModels.Lock()
+	verifiedModels.files[path] = verifiedFile{size: info.Size(), modTime: info.ModTime(), sha256: sum}
+	verifiedModels.Unlock()
+	return nil
+}
+
+// checkModelIntegrity verifies a model before it is used and answers the
+// request itself when it can't be
+func checkModelIntegrity(conn net.Conn, msg map[string]interface{}, modelPath string) bool {
+	err := verifyModelFile(modelPath)
+	if err == nil {
+		return true
+	}
+	resp := map[string]interface{}{"status": "ERROR", "message": err.Error(), "session": currentSession(msg)}
+	if errors.Is(err, errModelCorrupt) {
+		resp["code"] = "E_MODEL_CORRUPT"
+	}
+	sendResponse(conn, resp)
+	return false
+}
+
+// IntegrityReport is the result of a models directory scan
+type IntegrityReport struct {
+	CheckedAt  string            `json:"checked_at"`
+	Verified   int               `json:"verified"`
+	Corrupt    map[string]string `json:"corrupt"` // file -> sha256 found
+	Missing    []string          `json:"missing"`
+	Unverified []string          `json:"unverified"` // no recorded checksum
+	Healthy    bool              `json:"healthy"`
+}
+
+var lastIntegrityReport struct {
+	sync.Mutex
+	report *IntegrityReport
+}
+
+// verifyModels hashes every recorded and present model file. A file counts
+// as missing only if this node should hold it: it was replicated through the
+// log, or it is a model trained here. Other nodes fetch trained models on
+// demand.
+func verifyModels() *IntegrityReport {
+	report := &IntegrityReport{
+		CheckedAt:  time.Now().UTC().Format(time.RFC3339),
+		Corrupt:    make(map[string]string),
+		Missing:    []string{},
+		Unverified: []string{},
+	}
+	ownModels := make(map[string]bool)
+	for _, meta := range modelStateMachine.Registry().All() {
+		if meta.Creator == raftNode.id {
+			ownModels[meta.File] = true
+		}
+	}
+	sums := modelStateMachine.Checksums()
+	for name, want := range sums {
+		path := filepath.Join(modelsDir, name)
+		sum, err := fileSHA256(path)
+		switch {
+		case os.IsNotExist(err):
+			if _, replicated := modelStateMachine.FileIndex(name); replicated || ownModels[name] {
+				report.Missing = append(report.Missing, name)
+			}
+		case err != nil:
+			report.Corrupt[name] = err.Error()
+		case sum != want:
+			report.Corrupt[name] = sum
+		default:
+			report.Verified++
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(modelsDir, "*.bin"))
+	for _, f := range files {
+		if _, ok := sums[filepath.Base(f)]; !ok {
+			report.Unverified = append(report.Unverified, filepath.Base(f))
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Unverified)
+	report.Healthy = len(report.Corrupt) == 0 && len(report.Missing) == 0
+	if len(report.Corrupt) > 0 {
+		metrics.Inc("models.corrupt", int64(len(report.Corrupt)))
+	}
+	storageLog.Infof("VERIFY_MODELS: %d verified, %d corrupt, %d missing, %d without checksum",
+		report.Verified, len(report.Corrupt), len(report.Missing), len(report.Unverified))
+
+	lastIntegrityReport.Lock()
+	lastIntegrityReport.report = report
+	lastIntegrityReport.Unlock()
+	return report
+}
+
+// integrityStatus returns the last scan for /status, or nil before any
+func integrityStatus() *IntegrityReport {
+	lastIntegrityReport.Lock()
+	defer lastIntegrityReport.Unlock()
+	return lastIntegrityReport.report
+}
+
+// handleVerifyModels answers VERIFY_MODELS with a fresh scan
+func handleVerifyModels(conn net.Conn) {
+	report := verifyModels()
+	sendResponse(conn, map[string]interface{}{
+		"status":     "OK",
+		"checked_at": report.CheckedAt,
+		"verified":   report.Verified,
+		"corrupt":    report.Corrupt,
+		"missing":    report.Missing,
+		"unverified": report.Unverified,
+		"healthy":    report.Healthy,
+	})
+}
+
+func handleVerifyModelsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifyModels())
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Persistent JVM bridge
+// ============================================================================
+
+// JavaBridge keeps one TrainingModule process running in "serve" mode and
+// multiplexes backend commands over its stdin/stdout, saving a JVM start per
+// request. Requests are tab-separated lines tagged with an id; the JVM
+// answers OUT/END lines carrying the same id (see TrainingModule.serve). A
+// crashed JVM fails its in-flight calls and is restarted with backoff; while
+// it is down, runJava falls back to one process per command.
+type JavaBridge struct {
+	mu        sync.Mutex
+	stdin     io.WriteCloser
+	pid       int
+	running   bool
+	stopped   bool
+	reloading bool // Restart closed the JVM's stdin
+	nextID    uint64
+	pending   map[string]*bridgeCall
+	restarts  int
+	started   time.Time
+}
+
+type bridgeCall struct {
+	output  bytes.Buffer
+	observe func(string) // sees each OUT line, may be nil
+	done    chan int     // receives the exit status
+}
+
+// javaBridgeReadyTimeout bounds the JVM start until it prints READY
+const javaBridgeReadyTimeout = 30 * time.Second
+
+// maxJavaBridgeBackoff caps the delay between restarts of a crashing JVM
+const maxJavaBridgeBackoff = 30 * time.Second
+
+var (
+	errBridgeDown        = errors.New("java bridge not running")
+	errBridgeUnsupported = errors.New("TrainingModule has no serve mode")
+)
+
+var javaBridge *JavaBridge
+
+// NewJavaBridge creates a bridge; Run starts the JVM
+func NewJavaBridge() *JavaBridge {
+	return &JavaBridge{pending: make(map[string]*bridgeCall)}
+}
+
+// Run keeps the JVM alive until stopCh is closed. If the backend doesn't
+// support serve mode the bridge stays down and every command is exec'd.
+func (b *JavaBridge) Run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		b.mu.Lock()
+		b.stopped = true
+		stdin := b.stdin
+		b.mu.Unlock()
+		if stdin != nil {
+			stdin.Close()
+		}
+	}()
+
+	backoff := time.Second
+	for {
+		err := b.runOnce()
+		b.mu.Lock()
+		stopped := b.stopped
+		b.mu.Unlock()
+		if stopped {
+			return
+		}
+		b.mu.Lock()
+		reloading := b.reloading
+		b.reloading = false
+		b.mu.Unlock()
+		if reloading {
+			javaLog.Infof("bridge: restarting the JVM (java-dir %s)", currentJavaDir())
+			backoff = time.Second
+			continue
+		}
+		if errors.Is(err, errBridgeUnsupported) {
+			javaLog.Infof("bridge: %v, running one JVM per command", err)
+			return
+		}
+
+		b.mu.Lock()
+		b.restarts++
+		if time.Since(b.started) > time.Minute {
+			backoff = time.Second
+		}
+		b.mu.Unlock()
+		javaLog.Warnf("bridge: JVM exited (%v), restarting in %v", err, backoff)
+		metrics.Inc("java.bridge_restarts", 1)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxJavaBridgeBackoff)
+	}
+}
+
+// Restart replaces the JVM, e.g. after the Java directory changed. The
+// running one finishes its in-flight commands first; new commands meanwhile
+// run in a JVM of their own.
+func (b *JavaBridge) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.running || b.stopped {
+		return
+	}
+	b.reloading = true
+	b.stdin.Close()
+}
+
+// Close stops the bridge and waits for the JVM to exit, killing it after
+// timeout
+func (b *JavaBridge) Close(timeout time.Duration) {
+	b.mu.Lock()
+	b.stopped = true
+	if b.stdin != nil {
+		b.stdin.Close()
+	}
+	b.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mu.Lock()
+		running, pid := b.running, b.pid
+		b.mu.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			javaLog.Warnf("bridge: JVM (pid %d) still running, killing it", pid)
+			if p, err := os.FindProcess(pid); err == nil {
+				p.Kill()
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runOnce starts the JVM and serves its output until it exits
+func (b *JavaBridge) runOnce() error {
+	cmd := exec.Command(javaExecutable(), javaCommandArgs("serve")...)
+	sandboxCommand(cmd)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(stdout)
+	ready := make(chan error, 1)
+	go func() {
+		line, err := reader.ReadString('\n')
+		switch {
+		case err != nil:
+			ready <- errBridgeUnsupported
+		case trimLine(line) != "READY":
+			ready <- errBridgeUnsupported
+		default:
+			ready <- nil
+		}
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(javaBridgeReadyTimeout):
+		err = fmt.Errorf("no READY within %v", javaBridgeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	b.mu.Lock()
+	b.stdin = stdin
+	b.pid = cmd.Process.Pid
+	b.running = true
+	b.started = time.Now()
+	if b.stopped {
+		stdin.Close()
+	}
+	b.mu.Unlock()
+	javaLog.Infof("bridge: JVM started (pid %d)", cmd.Process.Pid)
+
+	readErr := b.readLoop(reader)
+
+	b.mu.Lock()
+	b.running = false
+	b.stdin = nil
+	pending := b.pending
+	b.pending = make(map[string]*bridgeCall)
+	b.mu.Unlock()
+	for _, call := range pending {
+		call.done <- -1
+	}
+
+	stdin.Close()
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return waitErr
+	}
+	return readErr
+}
+
+// readLoop routes OUT and END lines to their calls until the JVM's stdout
+// closes
+func (b *JavaBridge) readLoop(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, rest, _ := strings.Cut(trimLine(line), "\t")
+		id, payload, _ := strings.Cut(rest, "\t")
+
+		b.mu.Lock()
+		call := b.pending[id]
+		if kind == "END" {
+			delete(b.pending, id)
+		}
+		b.mu.Unlock()
+		if call == nil {
+			continue
+		}
+
+		switch kind {
+		case "OUT":
+			call.output.WriteString(payload)
+			call.output.WriteByte('\n')
+			if call.observe != nil {
+				call.observe(payload)
+			}
+		case "END":
+			status, _ := strconv.Atoi(payload)
+			call.done <- status
+		}
+	}
+}
+
+// Call runs one TrainingModule command in the JVM. If ctx is cancelled the
+// JVM is asked to interrupt the command, which training honours between
+// epochs; cleanup (if non-nil) runs when it finishes.
+func (b *JavaBridge) Call(ctx context.Context, cleanup func(), args ...string) ([]byte, error) {
+	call := &bridgeCall{observe: outputObserver(ctx), done: make(chan int, 1)}
+	b.mu.Lock()
+	if !b.running {
+		b.mu.Unlock()
+		return nil, errBridgeDown
+	}
+	b.nextID++
+	id := strconv.FormatUint(b.nextID, 10)
+	b.pending[id] = call
+	_, err := io.WriteString(b.stdin, id+"\t"+strings.Join(args, "\t")+"\n")
+	if err != nil {
+		delete(b.pending, id)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return nil, errBridgeDown
+	}
+
+	select {
+	case status := <-call.done:
+		if status < 0 {
+			return call.output.Bytes(), errors.New("JVM exited during the command")
+		}
+		if status != 0 {
+			return call.output.Bytes(), fmt.Errorf("command failed with status %d", status)
+		}
+		return call.output.Bytes(), nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		if b.running {
+			io.WriteString(b.stdin, "CANCEL\t"+id+"\n")
+		}
+		b.mu.Unlock()
+		if cleanup != nil {
+			go func() {
+				<-call.done
+				cleanup()
+			}()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Status reports the bridge for /status
+func (b *JavaBridge) Status() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := map[string]interface{}{
+		"running":  b.running,
+		"restarts": b.restarts,
+		"inflight": len(b.pending),
+	}
+	if b.running {
+		status["pid"] = b.pid
+		status["uptime"] = time.Since(b.started).Round(time.Second).String()
+	}
+	return status
+}
+
+// runJava runs a TrainingModule command and returns its combined output,
+// through the bridge when it is up and in a fresh JVM otherwise, once the
+// executor pool has a slot for it; with -backend=go the command runs
+// in-process instead. cleanup is for commands that leave files behind: it
+// runs once a command abandoned through ctx has finished in the bridge JVM,
+// which can't be interrupted.
+func runJava(ctx context.Context, cleanup func(), args ...string) ([]byte, error) {
+	if modelBackend == BackendGo {
+		return runGoBackend(ctx, args...)
+	}
+	if javaPool != nil && len(args) > 0 {
+		return javaPool.Run(ctx, args[0], func() ([]byte, error) {
+			return execJava(ctx, cleanup, args...)
+		})
+	}
+	return execJava(ctx, cleanup, args...)
+}
+
+// execJava runs a TrainingModule command right away
+func execJava(ctx context.Context, cleanup func(), args ...string) ([]byte, error) {
+	if javaBridge != nil && !strings.ContainsAny(strings.Join(args, ""), "\t\r\n") {
+		output, err := javaBridge.Call(ctx, cleanup, args...)
+		if !errors.Is(err, errBridgeDown) {
+			return output, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, javaExecutable(), javaCommandArgs(args...)...)
+	killProcessGroup(cmd)
+	sandboxCommand(cmd)
+	// Don't wait on orphaned grandchildren holding the output pipe after a kill
+	cmd.WaitDelay = time.Second
+	if observe := outputObserver(ctx); observe != nil {
+		out := &lineWriter{observe: observe}
+		cmd.Stdout, cmd.Stderr = out, out
+		err := cmd.Run()
+		return out.buf.Bytes(), err
+	}
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// JVM command line
+// ============================================================================
+
+// TrainingModule runs as
+//
+//	<java-bin> <java-opts> -cp <java-dir>:<java-classpath> TrainingModule <command>
+//
+// -java-bin is the launcher, a path or a name looked up in PATH (default
+// java), for hosts with several JVMs installed or images without one on
+// PATH. -java-opts are JVM options separated by spaces (e.g. "-Xmx2g
+// -XX:+UseSerialGC") and -java-classpath extra classpath entries,
+// comma-separated, placed after -java-dir and joined with the platform's
+// separator. In a configuration file:
+//
+//	java:
+//	  bin: /opt/jdk-21/bin/java
+//	  opts: -Xmx2g -Dfile.encoding=UTF-8
+//	  classpath: [/opt/lib/extra.jar]
+//
+// They are checked at startup (a launcher that doesn't exist stops the
+// worker) and apply on restart; -java-dir can still change live.
+
+// Set by configureJava at startup
+var (
+	javaBin       string   // resolved launcher, "" = javaExecutable's default
+	javaOpts      []string // before the class name
+	javaClasspath []string // after java-dir
+)
+
+// configureJava validates and sets the JVM command line flags
+func configureJava(bin, opts, classpath string) error {
+	if bin != "" {
+		path, err := exec.LookPath(bin)
+		if err != nil {
+			return fmt.Errorf("-java-bin %q: %v", bin, err)
+		}
+		javaBin = path
+	}
+	javaOpts = strings.Fields(opts)
+	for _, opt := range javaOpts {
+		if !strings.HasPrefix(opt, "-") {
+			return fmt.Errorf("-java-opts %q: %q is not a JVM option", opts, opt)
+		}
+	}
+	javaClasspath = nil
+	for _, entry := range strings.Split(classpath, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			javaClasspath = append(javaClasspath, entry)
+		}
+	}
+	return nil
+}
+
+// javaClassPath returns the -cp value: the java directory, then the extra
+// entries
+func javaClassPath() string {
+	entries := append([]string{currentJavaDir()}, javaClasspath...)
+	if sandbox.Dir != "" {
+		// Relative to the worker's directory, not the JVM's
+		for i, entry := range entries {
+			if abs, err := filepath.Abs(entry); err == nil {
+				entries[i] = abs
+			}
+		}
+	}
+	return strings.Join(entries, string(os.PathListSeparator))
+}
+
+// javaCommandArgs returns the launcher arguments that run TrainingModule
+// with args
+func javaCommandArgs(args ...string) []string {
+	cmdArgs := make([]string, 0, len(javaOpts)+3+len(args))
+	cmdArgs = append(cmdArgs, javaOpts...)
+	cmdArgs = append(cmdArgs, "-cp", javaClassPath(), "TrainingModule")
+	return append(cmdArgs, args...)
+}
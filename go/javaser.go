@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ============================================================================
+// Java serialization of NeuralNetwork
+// ============================================================================
+
+// The Java backend stores models with ObjectOutputStream. This is just
+// enough of the Java Object Serialization Stream Protocol to read and write
+// a NeuralNetwork, so the Go backend shares .bin files with the JVM.
+
+const (
+	javaStreamMagic   = 0xACED
+	javaStreamVersion = 5
+	javaBaseHandle    = 0x7E0000
+
+	tcNull          = 0x70
+	tcReference     = 0x71
+	tcClassDesc     = 0x72
+	tcObject        = 0x73
+	tcString        = 0x74
+	tcArray         = 0x75
+	tcBlockData     = 0x77
+	tcEndBlockData  = 0x78
+	tcReset         = 0x79
+	tcBlockDataLong = 0x7A
+	tcLongString    = 0x7C
+
+	scWriteMethod  = 0x01
+	scSerializable = 0x02
+)
+
+// serialVersionUIDs of the classes in a NeuralNetwork stream
+const (
+	neuralNetworkUID = 1
+	doubleArrayUID   = 0x3EA68C14AB635A1E  // double[]
+	doubleArray2DUID = -0x3852F4009B9800BB // double[][]
+)
+
+const javaNeuralNetwork = "NeuralNetwork"
+
+type javaClassDesc struct {
+	name   string
+	flags  byte
+	fields []javaField
+	super  *javaClassDesc
+}
+
+type javaField struct {
+	typeCode byte
+	name     string
+}
+
+type javaObject struct {
+	class  *javaClassDesc
+	fields map[string]interface{}
+}
+
+type javaReader struct {
+	r       *bufio.Reader
+	handles []interface{}
+}
+
+// decodeJavaNetwork reads a NeuralNetwork written by the Java backend
+func decodeJavaNetwork(r io.Reader) (*goNetwork, error) {
+	jr := &javaReader{r: bufio.NewReader(r)}
+	var header struct{ Magic, Version uint16 }
+	if err := binary.Read(jr.r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != javaStreamMagic || header.Version != javaStreamVersion {
+		return nil, errors.New("not a Java serialization stream")
+	}
+
+	content, err := jr.readContent()
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := content.(*javaObject)
+	if !ok || obj.class.name != javaNeuralNetwork {
+		return nil, errors.New("stream does not hold a NeuralNetwork")
+	}
+
+	f := obj.fields
+	modelID, _ := f["modelId"].(string)
+	wih, ok1 := f["weightsInputHidden"].([][]float64)
+	who, ok2 := f["weightsHiddenOutput"].([][]float64)
+	bh, ok3 := f["biasHidden"].([]float64)
+	bo, ok4 := f["biasOutput"].([]float64)
+	lr, ok5 := f["learningRate"].(float64)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, errors.New("NeuralNetwork is missing fields")
+	}
+	n := &goNetwork{
+		modelID:      modelID,
+		learningRate: lr,
+		layers:       []mlpLayer{{Weights: wih, Bias: bh}, {Weights: who, Bias: bo}},
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (jr *javaReader) assign(v interface{}) int {
+	jr.handles = append(jr.handles, v)
+	return len(jr.handles) - 1
+}
+
+func (jr *javaReader) readUTF() (string, error) {
+	var n uint16
+	if err := binary.Read(jr.r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(jr.r, buf)
+	return string(buf), err
+}
+
+func (jr *javaReader) readContent() (interface{}, error) {
+	tc, err := jr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tc {
+	case tcNull:
+		return nil, nil
+	case tcReference:
+		var h int32
+		if err := binary.Read(jr.r, binary.BigEndian, &h); err != nil {
+			return nil, err
+		}
+		i := int(h) - javaBaseHandle
+		if i < 0 || i >= len(jr.handles) {
+			return nil, fmt.Errorf("invalid handle %#x", h)
+		}
+		return jr.handles[i], nil
+	case tcClassDesc:
+		return jr.readClassDesc()
+	case tcString, tcLongString:
+		var s string
+		if tc == tcString {
+			s, err = jr.readUTF()
+		} else {
+			var n int64
+			if err = binary.Read(jr.r, binary.BigEndian, &n); err == nil {
+				buf := make([]byte, n)
+				_, err = io.ReadFull(jr.r, buf)
+				s = string(buf)
+			}
+		}
+		jr.assign(s)
+		return s, err
+	case tcArray:
+		return jr.readArray()
+	case tcObject:
+		return jr.readObject()
+	case tcReset:
+		jr.handles = nil
+		return jr.readContent()
+	}
+	return nil, fmt.Errorf("unsupported stream element %#x", tc)
+}
+
+func (jr *javaReader) readClassDescRef() (*javaClassDesc, error) {
+	v, err := jr.readContent()
+	if err != nil || v == nil {
+		return nil, err
+	}
+	desc, ok := v.(*javaClassDesc)
+	if !ok {
+		return nil, errors.New("expected a class descriptor")
+	}
+	return desc, nil
+}
+
+func (jr *javaReader) readClassDesc() (*javaClassDesc, error) {
+	desc := &javaClassDesc{}
+	name, err := jr.readUTF()
+	if err != nil {
+		return nil, err
+	}
+	desc.name = name
+	jr.assign(desc)
+
+	var hdr struct {
+		UID    int64
+		Flags  byte
+		Fields int16
+	}
+	if err := binary.Read(jr.r, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	desc.flags = hdr.Flags
+	if desc.flags&scSerializable == 0 {
+		return nil, fmt.Errorf("class %s is not plain Serializable", name)
+	}
+	for i := 0; i < int(hdr.Fields); i++ {
+		code, err := jr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		fieldName, err := jr.readUTF()
+		if err != nil {
+			return nil, err
+		}
+		if code == '[' || code == 'L' {
+			if _, err := jr.readContent(); err != nil { // field class name
+				return nil, err
+			}
+		}
+		desc.fields = append(desc.fields, javaField{typeCode: code, name: fieldName})
+	}
+	if err := jr.skipAnnotation(); err != nil {
+		return nil, err
+	}
+	desc.super, err = jr.readClassDescRef()
+	return desc, err
+}
+
+// skipAnnotation skips block data and objects up to TC_ENDBLOCKDATA
+func (jr *javaReader) skipAnnotation() error {
+	for {
+		tc, err := jr.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch tc {
+		case tcEndBlockData:
+			return nil
+		case tcBlockData:
+			n, err := jr.r.ReadByte()
+			if err == nil {
+				_, err = jr.r.Discard(int(n))
+			}
+			if err != nil {
+				return err
+			}
+		case tcBlockDataLong:
+			var n int32
+			if err := binary.Read(jr.r, binary.BigEndian, &n); err != nil {
+				return err
+			}
+			if _, err := jr.r.Discard(int(n)); err != nil {
+				return err
+			}
+		default:
+			jr.r.UnreadByte()
+			if _, err := jr.readContent(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (jr *javaReader) readArray() (interface{}, error) {
+	desc, err := jr.readClassDescRef()
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil || len(desc.name) < 2 {
+		return nil, errors.New("invalid array class")
+	}
+	h := jr.assign(nil)
+	var n int32
+	if err := binary.Read(jr.r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("negative array length")
+	}
+
+	switch {
+	case desc.name == "[D":
+		values := make([]float64, n)
+		err = binary.Read(jr.r, binary.BigEndian, values)
+		jr.handles[h] = values
+		return values, err
+	case desc.name == "[[D":
+		rows := make([][]float64, n)
+		jr.handles[h] = rows
+		for i := range rows {
+			v, err := jr.readContent()
+			if err != nil {
+				return nil, err
+			}
+			rows[i], _ = v.([]float64)
+		}
+		return rows, nil
+	case desc.name[1] == '[' || desc.name[1] == 'L':
+		values := make([]interface{}, n)
+		jr.handles[h] = values
+		for i := range values {
+			if values[i], err = jr.readContent(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported array type %s", desc.name)
+}
+
+func (jr *javaReader) readObject() (interface{}, error) {
+	desc, err := jr.readClassDescRef()
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		return nil, errors.New("object without class")
+	}
+	obj := &javaObject{class: desc, fields: make(map[string]interface{})}
+	jr.assign(obj)
+
+	// Field values go from the topmost superclass down
+	var chain []*javaClassDesc
+	for c := desc; c != nil; c = c.super {
+		chain = append([]*javaClassDesc{c}, chain...)
+	}
+	for _, c := range chain {
+		for _, f := range c.fields {
+			v, err := jr.readField(f.typeCode)
+			if err != nil {
+				return nil, err
+			}
+			obj.fields[f.name] = v
+		}
+		if c.flags&scWriteMethod != 0 {
+			if err := jr.skipAnnotation(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return obj, nil
+}
+
+func (jr *javaReader) readField(code byte) (interface{}, error) {
+	var err error
+	switch code {
+	case 'B', 'Z':
+		var v int8
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'C', 'S':
+		var v int16
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'I':
+		var v int32
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'J':
+		var v int64
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return v, err
+	case 'F':
+		var v float32
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return float64(v), err
+	case 'D':
+		var v float64
+		err = binary.Read(jr.r, binary.BigEndian, &v)
+		return v, err
+	case '[', 'L':
+		return jr.readContent()
+	}
+	return nil, fmt.Errorf("unknown field type %q", code)
+}
+
+// javaWriter emits the stream ObjectOutputStream writes for a NeuralNetwork
+type javaWriter struct {
+	buf     bytes.Buffer
+	handles int32
+	strings map[string]int32
+	classes map[string]int32
+}
+
+func (w *javaWriter) assign() int32 {
+	h := javaBaseHandle + w.handles
+	w.handles++
+	return h
+}
+
+func (w *javaWriter) put(v interface{}) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *javaWriter) utf(s string) {
+	w.put(uint16(len(s)))
+	w.buf.WriteString(s)
+}
+
+// typeString writes a field's class name, shared by handle after first use
+func (w *javaWriter) typeString(s string) {
+	if h, ok := w.strings[s]; ok {
+		w.put(byte(tcReference))
+		w.put(h)
+		return
+	}
+	w.put(byte(tcString))
+	w.strings[s] = w.assign()
+	w.utf(s)
+}
+
+// arrayClass writes the descriptor of a field-less array class
+func (w *javaWriter) arrayClass(name string, uid int64) {
+	if h, ok := w.classes[name]; ok {
+		w.put(byte(tcReference))
+		w.put(h)
+		return
+	}
+	w.put(byte(tcClassDesc))
+	w.utf(name)
+	w.classes[name] = w.assign()
+	w.put(uid)
+	w.put(byte(scSerializable))
+	w.put(int16(0))
+	w.put(byte(tcEndBlockData))
+	w.put(byte(tcNull))
+}
+
+func (w *javaWriter) doubles(v []float64) {
+	w.put(byte(tcArray))
+	w.arrayClass("[D", doubleArrayUID)
+	w.assign()
+	w.put(int32(len(v)))
+	w.put(v)
+}
+
+func (w *javaWriter) matrix(m [][]float64) {
+	w.put(byte(tcArray))
+	w.arrayClass("[[D", doubleArray2DUID)
+	w.assign()
+	w.put(int32(len(m)))
+	for _, row := range m {
+		w.doubles(row)
+	}
+}
+
+// encodeJavaNetwork serializes a one-hidden-layer network exactly as the
+// JVM's NeuralNetwork.save does. Fields are listed primitives first, each
+// group sorted by name, as ObjectStreamClass orders them.
+func encodeJavaNetwork(n *goNetwork) ([]byte, error) {
+	if len(n.layers) != 2 {
+		return nil, fmt.Errorf("the Java format holds one hidden layer, network has %d", len(n.layers)-1)
+	}
+	hidden, output := n.layers[0], n.layers[1]
+	w := &javaWriter{strings: make(map[string]int32), classes: make(map[string]int32)}
+
+	w.put(uint16(javaStreamMagic))
+	w.put(uint16(javaStreamVersion))
+	w.put(byte(tcObject))
+	w.put(byte(tcClassDesc))
+	w.utf(javaNeuralNetwork)
+	w.classes[javaNeuralNetwork] = w.assign()
+	w.put(int64(neuralNetworkUID))
+	w.put(byte(scSerializable))
+	w.put(int16(9))
+	for _, f := range []struct {
+		code byte
+		name string
+	}{{'I', "hiddenSize"}, {'I', "inputSize"}, {'D', "learningRate"}, {'I', "outputSize"}} {
+		w.put(f.code)
+		w.utf(f.name)
+	}
+	for _, f := range []struct {
+		code      byte
+		name, cls string
+	}{
+		{'[', "biasHidden", "[D"},
+		{'[', "biasOutput", "[D"},
+		{'L', "modelId", "Ljava/lang/String;"},
+		{'[', "weightsHiddenOutput", "[[D"},
+		{'[', "weightsInputHidden", "[[D"},
+	} {
+		w.put(f.code)
+		w.utf(f.name)
+		w.typeString(f.cls)
+	}
+	w.put(byte(tcEndBlockData))
+	w.put(byte(tcNull))
+	w.assign() // the object itself
+
+	w.put(int32(len(hidden.Bias)))
+	w.put(int32(len(hidden.Weights)))
+	w.put(n.learningRate)
+	w.put(int32(len(output.Bias)))
+	w.doubles(hidden.Bias)
+	w.doubles(output.Bias)
+	w.put(byte(tcString))
+	w.assign()
+	w.utf(n.modelID)
+	w.matrix(output.Weights)
+	w.matrix(hidden.Weights)
+	return w.buf.Bytes(), nil
+}
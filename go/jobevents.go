@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Job event log
+// ============================================================================
+
+// Job event types, in the order a distributed job normally emits them
+const (
+	JobCreated         = "created"
+	JobQueued          = "queued"
+	JobChunkDispatched = "chunk_dispatched"
+	JobChunkDone       = "chunk_done"
+	JobMerged          = "merged"
+	JobCommitted       = "committed"
+	JobFailed          = "failed"
+	JobAbandoned       = "abandoned"
+	JobCancelled       = "cancelled"
+)
+
+// JobEvent is one entry of a job's timeline
+type JobEvent struct {
+	Seq    int                    `json:"seq"`
+	Type   string                 `json:"type"`
+	At     string                 `json:"at"`
+	Node   string                 `json:"node"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+// jobWatcher is a Watch callback, a pointer so that stop can find it
+type jobWatcher struct {
+	fn func(JobEvent)
+}
+
+// JobEventLog keeps an append-only file per job under dir. Events are never
+// rewritten, so a crash loses at most the line being written and the timeline
+// survives restarts for post-mortems.
+type JobEventLog struct {
+	dir  string
+	node string
+
+	mu       sync.Mutex
+	seqs     map[string]int           // job id -> last sequence number written
+	watchers map[string][]*jobWatcher // job id -> Watch callbacks
+}
+
+var jobEvents *JobEventLog
+
+// NewJobEventLog creates the event log rooted at dir
+func NewJobEventLog(dir, node string) *JobEventLog {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		jobsLog.Errorf("job events: cannot create %s: %v", dir, err)
+	}
+	return &JobEventLog{dir: dir, node: node, seqs: make(map[string]int), watchers: make(map[string][]*jobWatcher)}
+}
+
+func (l *JobEventLog) path(jobID string) string {
+	return filepath.Join(l.dir, jobID+".jsonl")
+}
+
+// Record appends an event to a job's stream. It is a no-op for an empty or
+// unsafe job id, so callers can pass through whatever the client sent.
+func (l *JobEventLog) Record(jobID, eventType string, detail map[string]interface{}) {
+	if l == nil || !safeBaseName(jobID) {
+		return
+	}
+
+	event, watchers, ok := l.append(jobID, eventType, detail)
+	if !ok {
+		return
+	}
+	liveUpdates.Publish("job", map[string]interface{}{"job_id": jobID, "event": eventType, "detail": detail})
+	for _, w := range watchers {
+		w.fn(event)
+	}
+}
+
+// append writes an event and returns it with the job's watchers
+func (l *JobEventLog) append(jobID, eventType string, detail map[string]interface{}) (JobEvent, []*jobWatcher, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seq, ok := l.seqs[jobID]
+	if !ok {
+		seq = len(l.read(jobID))
+	}
+	seq++
+
+	event := JobEvent{
+		Seq:    seq,
+		Type:   eventType,
+		At:     time.Now().UTC().Format(time.RFC3339Nano),
+		Node:   l.node,
+		Detail: detail,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return event, nil, false
+	}
+
+	f, err := os.OpenFile(l.path(jobID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		jobsLog.Errorf("job events: cannot open log for %s: %v", jobID, err)
+		return event, nil, false
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		jobsLog.Errorf("job events: write error for %s: %v", jobID, err)
+		return event, nil, false
+	}
+	l.seqs[jobID] = seq
+	return event, append([]*jobWatcher(nil), l.watchers[jobID]...), true
+}
+
+// Watch calls fn with every event later recorded for jobID until the
+// returned stop is called. fn runs on the goroutine recording the event.
+func (l *JobEventLog) Watch(jobID string, fn func(JobEvent)) (stop func()) {
+	if l == nil {
+		return func() {}
+	}
+	w := &jobWatcher{fn}
+	l.mu.Lock()
+	l.watchers[jobID] = append(l.watchers[jobID], w)
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		ws := l.watchers[jobID]
+		for i, x := range ws {
+			if x == w {
+				ws = append(ws[:i:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(l.watchers, jobID)
+		} else {
+			l.watchers[jobID] = ws
+		}
+	}
+}
+
+// Events returns the events of a job with a sequence number above since
+func (l *JobEventLog) Events(jobID string, since int) ([]JobEvent, bool) {
+	if !safeBaseName(jobID) {
+		return nil, false
+	}
+	if _, err := os.Stat(l.path(jobID)); err != nil {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	all := l.read(jobID)
+	l.mu.Unlock()
+
+	events := []JobEvent{}
+	for _, e := range all {
+		if e.Seq > since {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// read parses a job's stream, skipping a torn last line; callers hold l.mu
+func (l *JobEventLog) read(jobID string) []JobEvent {
+	f, err := os.Open(l.path(jobID))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var events []JobEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e JobEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// trackJobCommits is a state machine hook that closes a job's timeline once
+// its model is committed
+func trackJobCommits(index int, cmd Command) {
+	if mt, ok := cmd.(*ModelTrainedCommand); ok && mt.JobID != "" {
+		jobEvents.Record(mt.JobID, JobCommitted, map[string]interface{}{
+			"index":    index,
+			"model_id": mt.ModelID,
+		})
+	}
+}
+
+// handleJobEvent lets an external coordinator append the events only it
+// observes (queueing, chunk dispatch and merge) to the job's stream on this
+// node
+func handleJobEvent(conn net.Conn, msg map[string]interface{}) {
+	jobID, _ := msg["job_id"].(string)
+	eventType, _ := msg["event"].(string)
+	detail, _ := msg["detail"].(map[string]interface{})
+
+	if !safeBaseName(jobID) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid job_id"})
+		return
+	}
+	switch eventType {
+	case JobQueued, JobChunkDispatched, JobMerged, JobFailed:
+	default:
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Unsupported event type"})
+		return
+	}
+
+	jobEvents.Record(jobID, eventType, detail)
+	sendResponse(conn, map[string]interface{}{"status": "OK"})
+}
+
+// handleJobEventsAPI serves GET /api/jobs/{id}/events[?since=<seq>]
+func handleJobEventsAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	jobID, suffix, ok := strings.Cut(rest, "/")
+	if !ok || suffix != "events" {
+		http.NotFound(w, r)
+		return
+	}
+
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	events, found := jobEvents.Events(jobID, since)
+	if !found {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id": jobID,
+		"events": events,
+	})
+}
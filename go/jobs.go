@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Asynchronous training jobs
+// ============================================================================
+
+// Job states reported by JOB_STATUS
+const (
+	JobStateQueued    = "queued"
+	JobStateRunning   = "running"
+	JobStateDone      = "done"
+	JobStateFailed    = "failed"
+	JobStateLost      = "lost" // its leader went away before it finished
+	JobStateCancelled = "cancelled"
+)
+
+// orphanScanInterval is how often the leader looks for jobs it can't finish
+const orphanScanInterval = 2 * time.Second
+
+// orphanScanLock makes the scan exclusive: a deposed leader that hasn't
+// noticed yet can't mark jobs lost while the new one runs them
+const orphanScanLock = internalLockPrefix + "jobs.orphan-scan"
+
+var errJobQueueFull = errors.New("job queue is full")
+
+// trainJob is a TRAIN submitted with JOB_SUBMIT, held by the leader until it
+// finishes. Its state lives in the replicated job store (jobstore.go).
+type trainJob struct {
+	id          string
+	samples     int
+	constraints Labels
+	publish     bool
+
+	inputs  []interface{}
+	outputs []interface{}
+}
+
+// JobManager runs submitted trainings on the leader from a bounded queue, so
+// the client can disconnect and poll for the outcome
+type JobManager struct {
+	queue chan *trainJob
+
+	mu   sync.Mutex
+	jobs map[string]*trainJob // queued or running on this node
+}
+
+var jobManager *JobManager
+
+// NewJobManager creates a manager holding up to queueSize pending jobs
+func NewJobManager(queueSize int) *JobManager {
+	if queueSize <= 0 {
+		queueSize = 64
+	}
+	return &JobManager{
+		queue: make(chan *trainJob, queueSize),
+		jobs:  make(map[string]*trainJob),
+	}
+}
+
+// Submit records a training job through RAFT, queues it and returns its id
+// and the index of its JOB entry
+func (m *JobManager) Submit(inputs, outputs []interface{}, constraints Labels, publish bool) (string, int, error) {
+	job := &trainJob{
+		id:          newTrainID(),
+		samples:     len(inputs),
+		constraints: constraints,
+		publish:     publish,
+		inputs:      inputs,
+		outputs:     outputs,
+	}
+
+	m.mu.Lock()
+	if len(m.queue) >= cap(m.queue) {
+		m.mu.Unlock()
+		return "", -1, errJobQueueFull
+	}
+	for {
+		if _, known := modelStateMachine.Job(job.id); !known && m.jobs[job.id] == nil {
+			break
+		}
+		job.id = newTrainID()
+	}
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	index, err := recordJob(&JobCommand{JobID: job.id, Event: jobEntryCreated, Node: raftNode.id, Samples: job.samples})
+	if err != nil {
+		m.forget(job.id)
+		return "", index, err
+	}
+	select {
+	case m.queue <- job:
+	default:
+		m.forget(job.id)
+		recordJob(&JobCommand{JobID: job.id, Event: jobEntryFailed, Result: map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": errJobQueueFull.Error()}})
+		return "", index, errJobQueueFull
+	}
+
+	jobEvents.Record(job.id, JobCreated, map[string]interface{}{"samples": job.samples})
+	jobEvents.Record(job.id, JobQueued, nil)
+	metrics.Inc("jobs.submitted", 1)
+	return job.id, index, nil
+}
+
+func (m *JobManager) forget(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, id)
+}
+
+// Pending returns the number of jobs queued or running on this node
+func (m *JobManager) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.jobs)
+}
+
+// holds reports whether this node has a job's data in memory
+func (m *JobManager) holds(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id] != nil
+}
+
+// recoverOrphans runs on every node; the one holding the orphan scan lock,
+// always the leader, records as lost the pending jobs it doesn't hold, whose
+// data went away with an earlier leader or a restart
+func (m *JobManager) recoverOrphans(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(orphanScanInterval)
+	defer ticker.Stop()
+	lease := &leaseKeeper{name: orphanScanLock, ttl: 15 * orphanScanInterval}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if !raftNode.IsLeader() || !lease.Hold() {
+			continue
+		}
+		for _, id := range modelStateMachine.PendingJobs() {
+			if m.holds(id) {
+				continue
+			}
+			result := map[string]interface{}{"status": "ERROR", "code": "E_JOB_FAILED", "message": "The node running the job went away; submit it again"}
+			if _, err := recordJob(&JobCommand{JobID: id, Event: jobEntryLost, Node: raftNode.id, Result: result}); err != nil {
+				break
+			}
+			jobEvents.Record(id, JobAbandoned, map[string]interface{}{"reason": "leader changed"})
+			metrics.Inc("jobs.lost", 1)
+			jobsLog.Warnf("JOB %s: lost, its data is not on this leader", id)
+		}
+	}
+}
+
+// Run starts workers goroutines that execute queued jobs until stopCh is
+// closed; a job still running then is abandoned like a TRAIN whose client
+// went away
+func (m *JobManager) Run(workers int, stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(shutdownCtx)
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	go m.recoverOrphans(stopCh)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-stopCh:
+					return
+				case job := <-m.queue:
+					m.run(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+func (m *JobManager) run(ctx context.Context, job *trainJob) {
+	defer m.forget(job.id)
+	started := time.Now()
+
+	if rec, ok := modelStateMachine.Job(job.id); ok && rec.finished() {
+		// cancelled while queued
+		return
+	}
+	ctx, cancel := trainingContext(ctx)
+	defer cancel()
+	ctx, done := runningTrainings.Start(ctx, job.id)
+	defer done()
+
+	if _, err := recordJob(&JobCommand{JobID: job.id, Event: jobEntryAssigned, Node: raftNode.id}); err != nil {
+		// Lost leadership while queued; the new leader records the job as lost
+		jobEvents.Record(job.id, JobFailed, map[string]interface{}{"error": "leadership lost"})
+		jobsLog.Warnf("JOB %s: not started: %v", job.id, err)
+		return
+	}
+
+	jobsLog.Infof("JOB %s: training %d samples", job.id, job.samples)
+
+	var result map[string]interface{}
+	if err := checkTrainingSpace(); err != nil {
+		jobEvents.Record(job.id, JobFailed, map[string]interface{}{"error": err.Error()})
+		result = map[string]interface{}{"status": "ERROR", "code": "E_DISK_FULL", "message": err.Error()}
+	} else {
+		if release, err := waitTrainSlot(ctx); err == nil {
+			beginTraining()
+			result = trainModel(ctx, job.id, job.inputs, job.outputs, job.constraints, job.publish)
+			endTraining()
+			release()
+		}
+		if result == nil && errors.Is(context.Cause(ctx), errTrainCancelled) {
+			result = cancelledResponse(job.id)
+		} else if result == nil && deadlineExpired(ctx) {
+			result = timeoutResponse("JOB_SUBMIT")
+		} else if result == nil {
+			result = map[string]interface{}{"status": "ERROR", "message": "Job abandoned at shutdown"}
+		}
+	}
+
+	event, state := jobEntryFailed, JobStateFailed
+	switch status, _ := result["status"].(string); {
+	case status == "OK" || status == "PARTIAL":
+		event, state = jobEntryCompleted, JobStateDone
+	case result["code"] == "E_CANCELLED":
+		event, state = jobEntryCancelled, JobStateCancelled
+	}
+	if _, err := recordJob(&JobCommand{JobID: job.id, Event: event, Node: raftNode.id, Result: result}); err != nil {
+		// The next leader records the job as lost
+		jobsLog.Errorf("JOB %s: cannot record outcome: %v", job.id, err)
+	}
+
+	metrics.Inc("jobs."+state, 1)
+	jobsLog.Infof("JOB %s: %s in %v", job.id, state, time.Since(started).Round(time.Millisecond))
+}
+
+// jobStatusFromEvents rebuilds the status of a job missing from the job
+// store, such as a plain TRAIN or one pruned from it, from this node's event
+// log
+func jobStatusFromEvents(id string) (map[string]interface{}, bool) {
+	events, ok := jobEvents.Events(id, 0)
+	if !ok || len(events) == 0 {
+		return nil, false
+	}
+	status := map[string]interface{}{"job_id": id, "state": JobStateLost}
+	last := events[len(events)-1]
+	switch last.Type {
+	case JobCommitted:
+		status["state"] = JobStateDone
+		status["model_id"] = last.Detail["model_id"]
+	case JobFailed, JobAbandoned:
+		status["state"] = JobStateFailed
+	case JobCancelled:
+		status["state"] = JobStateCancelled
+	}
+	status["finished_at"] = last.At
+	return status, true
+}
+
+// handleJobSubmit queues a TRAIN and answers with its job id right away
+func handleJobSubmit(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	inputsRaw, _ := msg["inputs"].([]interface{})
+	outputsRaw, _ := msg["outputs"].([]interface{})
+
+	if len(inputsRaw) == 0 || len(outputsRaw) == 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing inputs or outputs"})
+		return
+	}
+	constraints, err := parseConstraints(msg["constraints"])
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid constraints: " + err.Error()})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+	if checkTrainQuota(conn, len(inputsRaw)) || checkPlacement(conn, constraints) {
+		return
+	}
+	if err := checkTrainingSpace(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_DISK_FULL", "message": err.Error()})
+		return
+	}
+
+	jobID, index, err := jobManager.Submit(inputsRaw, outputsRaw, constraints, publishOnTrain(msg))
+	if errors.Is(err, errJobQueueFull) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": err.Error()})
+		return
+	}
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	tcpLog.Infof("JOB_SUBMIT: queued job %s (%d samples)", jobID, len(inputsRaw))
+	sendResponse(conn, map[string]interface{}{"status": "OK", "job_id": jobID, "state": JobStateQueued, "session": sessionToken(index)})
+}
+
+// handleJobQuery serves JOB_STATUS and JOB_RESULT from the replicated job
+// store. With the session from JOB_SUBMIT any node answers at least as fresh
+// as the submission; a follower that doesn't know the job yet forwards the
+// query to the leader.
+func handleJobQuery(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	msgType, _ := msg["type"].(string)
+	jobID, _ := msg["job_id"].(string)
+	if !safeBaseName(jobID) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid job_id"})
+		return
+	}
+	if !awaitSession(conn, msg) {
+		return
+	}
+
+	status, result, ok := jobStatus(jobID)
+	if !ok && !raftNode.IsLeader() {
+		if proxied, _ := msg["proxied"].(bool); !proxied {
+			forwardToLeader(ctx, conn, msg)
+			return
+		}
+	}
+	if !ok {
+		status, ok = jobStatusFromEvents(jobID)
+	}
+	if !ok {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_JOB_NOT_FOUND", "message": "Unknown job"})
+		return
+	}
+
+	if msgType == "JOB_STATUS" {
+		status["status"] = "OK"
+		sendResponse(conn, status)
+		return
+	}
+
+	state, _ := status["state"].(string)
+	switch {
+	case result != nil:
+		resp := make(map[string]interface{}, len(result)+2)
+		for k, v := range result {
+			resp[k] = v
+		}
+		resp["job_id"] = jobID
+		resp["state"] = state
+		sendResponse(conn, resp)
+	case state == JobStateDone:
+		sendResponse(conn, map[string]interface{}{"status": "OK", "job_id": jobID, "state": state, "model_id": status["model_id"]})
+	case state == JobStateQueued || state == JobStateRunning:
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_JOB_PENDING", "job_id": jobID, "state": state, "message": "Job has not finished"})
+	default:
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_JOB_FAILED", "job_id": jobID, "state": state, "message": "Job did not complete"})
+	}
+}
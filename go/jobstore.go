@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ============================================================================
+// Replicated job store
+// ============================================================================
+
+// The lifecycle of every JOB_SUBMIT goes through the RAFT log as JOB entries,
+// so all nodes hold the same job table and answer JOB_STATUS alike, and it
+// survives restarts and failovers. Only the training data stays in the
+// leader's memory: a job still queued or running when its leader goes away
+// can't be resumed, and the next leader records it as lost.
+
+// JOB entry events
+const (
+	jobEntryCreated   = "created"
+	jobEntryAssigned  = "assigned"
+	jobEntryCompleted = "completed"
+	jobEntryFailed    = "failed"
+	jobEntryLost      = "lost"
+	jobEntryCancelled = "cancelled"
+)
+
+// jobHistoryRetention is how long finished jobs stay in the table unless the
+// cluster sets job_retention. They are pruned when a later job is created,
+// by entry time, so every node prunes the same jobs.
+var jobHistoryRetention = time.Hour
+
+// JobRecord is the replicated state of a job
+type JobRecord struct {
+	ID          string                 `json:"job_id"`
+	State       string                 `json:"state"`
+	Samples     int                    `json:"samples"`
+	Node        string                 `json:"node,omitempty"` // node that queued or ran it
+	SubmittedAt string                 `json:"submitted_at"`
+	StartedAt   string                 `json:"started_at,omitempty"`
+	FinishedAt  string                 `json:"finished_at,omitempty"`
+	Result      map[string]interface{} `json:"result,omitempty"` // the response TRAIN would have sent
+}
+
+func (r *JobRecord) finished() bool {
+	switch r.State {
+	case JobStateDone, JobStateFailed, JobStateLost, JobStateCancelled:
+		return true
+	}
+	return false
+}
+
+// JobCommand moves a job through its lifecycle. Entries are applied in log
+// order and the first outcome wins, so a late completion can't revive a job
+// already recorded as lost, nor the reverse.
+type JobCommand struct {
+	JobID   string                 `json:"job_id"`
+	Event   string                 `json:"event"`
+	At      string                 `json:"at"`
+	Node    string                 `json:"node,omitempty"`
+	Samples int                    `json:"samples,omitempty"`
+	Result  map[string]interface{} `json:"result,omitempty"`
+}
+
+func (c *JobCommand) Action() string { return "JOB" }
+
+func (c *JobCommand) Validate() error {
+	if !safeBaseName(c.JobID) {
+		return fmt.Errorf("invalid job_id %q", c.JobID)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, c.At); err != nil {
+		return fmt.Errorf("invalid time %q", c.At)
+	}
+	switch c.Event {
+	case jobEntryCreated, jobEntryAssigned, jobEntryCompleted, jobEntryFailed, jobEntryLost, jobEntryCancelled:
+		return nil
+	}
+	return fmt.Errorf("unknown job event %q", c.Event)
+}
+
+func (c *JobCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	job, ok := sm.jobs[c.JobID]
+	if c.Event == jobEntryCreated {
+		if !ok {
+			sm.pruneJobsLocked(c.At)
+			sm.jobs[c.JobID] = &JobRecord{ID: c.JobID, State: JobStateQueued, Samples: c.Samples, Node: c.Node, SubmittedAt: c.At}
+		}
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("unknown job %s", c.JobID)
+	}
+	if job.finished() {
+		return nil
+	}
+
+	switch c.Event {
+	case jobEntryAssigned:
+		job.State = JobStateRunning
+		job.Node = c.Node
+		job.StartedAt = c.At
+	case jobEntryCompleted:
+		job.State = JobStateDone
+	case jobEntryFailed:
+		job.State = JobStateFailed
+	case jobEntryLost:
+		job.State = JobStateLost
+	case jobEntryCancelled:
+		job.State = JobStateCancelled
+	}
+	if job.finished() {
+		job.FinishedAt = c.At
+		job.Result = c.Result
+	}
+	return nil
+}
+
+// pruneJobsLocked drops jobs finished more than job_retention (settings.go)
+// before at. Callers hold sm.mu.
+func (sm *ModelStateMachine) pruneJobsLocked(at string) {
+	now, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return
+	}
+	for id, job := range sm.jobs {
+		if !job.finished() {
+			continue
+		}
+		if finished, err := time.Parse(time.RFC3339Nano, job.FinishedAt); err == nil && now.Sub(finished) > sm.settings.Duration("job_retention") {
+			delete(sm.jobs, id)
+		}
+	}
+}
+
+// Job returns a copy of a job's replicated state
+func (sm *ModelStateMachine) Job(id string) (JobRecord, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	job, ok := sm.jobs[id]
+	if !ok {
+		return JobRecord{}, false
+	}
+	return *job, true
+}
+
+// PendingJobs returns the ids of jobs queued or running, oldest first
+func (sm *ModelStateMachine) PendingJobs() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var pending []*JobRecord
+	for _, job := range sm.jobs {
+		if !job.finished() {
+			pending = append(pending, job)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return submittedBefore(pending[i], pending[j]) })
+	ids := make([]string, len(pending))
+	for i, job := range pending {
+		ids[i] = job.ID
+	}
+	return ids
+}
+
+// Jobs returns copies of every job in the table, oldest first
+func (sm *ModelStateMachine) Jobs() []JobRecord {
+	sm.mu.RLock()
+	jobs := make([]JobRecord, 0, len(sm.jobs))
+	for _, job := range sm.jobs {
+		jobs = append(jobs, *job)
+	}
+	sm.mu.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool { return submittedBefore(&jobs[i], &jobs[j]) })
+	return jobs
+}
+
+func submittedBefore(a, b *JobRecord) bool {
+	ta, _ := time.Parse(time.RFC3339Nano, a.SubmittedAt)
+	tb, _ := time.Parse(time.RFC3339Nano, b.SubmittedAt)
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return a.ID < b.ID
+}
+
+// jobStatus describes a job from the replicated table; result is set once it
+// finished
+func jobStatus(id string) (status map[string]interface{}, result map[string]interface{}, ok bool) {
+	job, ok := modelStateMachine.Job(id)
+	if !ok {
+		return nil, nil, false
+	}
+	status = map[string]interface{}{
+		"job_id":       job.ID,
+		"state":        job.State,
+		"samples":      job.Samples,
+		"submitted_at": job.SubmittedAt,
+	}
+	if job.Node != "" {
+		status["node"] = job.Node
+	}
+	if job.State == JobStateQueued {
+		position := 0
+		for _, pending := range modelStateMachine.PendingJobs() {
+			if other, ok := modelStateMachine.Job(pending); ok && other.State == JobStateQueued {
+				position++
+			}
+			if pending == id {
+				break
+			}
+		}
+		status["queue_position"] = position
+	}
+	if job.StartedAt != "" {
+		status["started_at"] = job.StartedAt
+	}
+	if job.FinishedAt != "" {
+		status["finished_at"] = job.FinishedAt
+		result = job.Result
+	}
+	return status, result, true
+}
+
+// recordJob commits a JOB entry and waits until it is applied locally
+func recordJob(cmd *JobCommand) (int, error) {
+	cmd.At = time.Now().UTC().Format(time.RFC3339Nano)
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		return index, err
+	}
+	modelStateMachine.WaitApplied(index, reserveWaitTimeout)
+	return index, nil
+}
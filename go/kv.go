@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Key-value metadata store
+// ============================================================================
+
+// Clients keep small pipeline metadata (last training time, feature lists,
+// ...) in the replicated state machine through KV_PUT, KV_GET and KV_DELETE.
+// Writes are KV entries in the RAFT log, so keys have the same guarantees as
+// models: committed on a majority, the same on every node, kept in snapshots.
+// Values are any JSON value.
+
+// KV entry operations
+const (
+	kvPut    = "put"
+	kvDelete = "delete"
+)
+
+const (
+	maxKVKeyLen    = 256
+	maxKVValueSize = 64 * 1024
+	maxKVKeys      = 10000
+)
+
+// KVEntry is a stored key
+type KVEntry struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Version    int64       `json:"version"` // store-wide revision of the last write
+	ModifiedAt string      `json:"modified_at"`
+}
+
+// KVCommand writes one key, or deletes a key or every key under a prefix
+type KVCommand struct {
+	Op     string      `json:"op"`
+	Key    string      `json:"key,omitempty"`
+	Prefix string      `json:"prefix,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+	At     string      `json:"at"`
+}
+
+func (c *KVCommand) Action() string { return "KV" }
+
+func (c *KVCommand) Validate() error {
+	switch c.Op {
+	case kvPut:
+		if err := validKVKey(c.Key); err != nil {
+			return err
+		}
+		data, err := json.Marshal(c.Value)
+		if err != nil {
+			return err
+		}
+		if len(data) > maxKVValueSize {
+			return fmt.Errorf("value larger than %d bytes", maxKVValueSize)
+		}
+	case kvDelete:
+		if (c.Key == "") == (c.Prefix == "") {
+			return fmt.Errorf("delete needs a key or a prefix")
+		}
+	default:
+		return fmt.Errorf("unknown kv op %q", c.Op)
+	}
+	return nil
+}
+
+func validKVKey(key string) error {
+	if key == "" || len(key) > maxKVKeyLen {
+		return fmt.Errorf("key must have 1 to %d bytes", maxKVKeyLen)
+	}
+	return nil
+}
+
+func (c *KVCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	switch c.Op {
+	case kvPut:
+		if limit := sm.settings.Int("kv_max_keys"); int64(len(sm.kv)) >= limit {
+			if _, exists := sm.kv[c.Key]; !exists {
+				return fmt.Errorf("store full (%d keys)", limit)
+			}
+		}
+		sm.kvRevision++
+		sm.kv[c.Key] = &KVEntry{Key: c.Key, Value: c.Value, Version: sm.kvRevision, ModifiedAt: c.At}
+	case kvDelete:
+		if c.Key != "" {
+			delete(sm.kv, c.Key)
+			break
+		}
+		for key := range sm.kv {
+			if strings.HasPrefix(key, c.Prefix) {
+				delete(sm.kv, key)
+			}
+		}
+	}
+	return nil
+}
+
+// KV returns a stored key
+func (sm *ModelStateMachine) KV(key string) (KVEntry, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	entry, ok := sm.kv[key]
+	if !ok {
+		return KVEntry{}, false
+	}
+	return *entry, true
+}
+
+// KVPrefix returns the keys starting with prefix, sorted
+func (sm *ModelStateMachine) KVPrefix(prefix string) []KVEntry {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	entries := []KVEntry{}
+	for key, entry := range sm.kv {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// handleKV serves KV_PUT, KV_GET and KV_DELETE. Writes go to the leader;
+// KV_GET is answered by any node, at least as fresh as the session passed.
+func handleKV(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	msgType, _ := msg["type"].(string)
+	key, _ := msg["key"].(string)
+	prefix, hasPrefix := msg["prefix"].(string)
+
+	if msgType == "KV_GET" {
+		if !awaitSession(conn, msg) {
+			return
+		}
+		if hasPrefix {
+			sendResponse(conn, map[string]interface{}{"status": "OK", "prefix": prefix, "entries": modelStateMachine.KVPrefix(prefix), "session": currentSession(msg)})
+			return
+		}
+		if key == "" {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing key or prefix"})
+			return
+		}
+		entry, ok := modelStateMachine.KV(key)
+		if !ok {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_KEY_NOT_FOUND", "message": "Unknown key", "key": key, "session": currentSession(msg)})
+			return
+		}
+		sendResponse(conn, map[string]interface{}{"status": "OK", "key": entry.Key, "value": entry.Value, "version": entry.Version, "modified_at": entry.ModifiedAt, "session": currentSession(msg)})
+		return
+	}
+
+	cmd := &KVCommand{Op: kvDelete, Key: key, At: time.Now().UTC().Format(time.RFC3339Nano)}
+	if msgType == "KV_PUT" {
+		value, ok := msg["value"]
+		if !ok {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing value"})
+			return
+		}
+		cmd.Op, cmd.Value = kvPut, value
+	} else if hasPrefix {
+		if key != "" || prefix == "" {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "KV_DELETE takes a key or a non-empty prefix"})
+			return
+		}
+		cmd.Prefix = prefix
+	}
+	if err := cmd.Validate(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	modelStateMachine.WaitApplied(index, reserveWaitTimeout)
+	resp := map[string]interface{}{"status": "OK", "session": sessionToken(index)}
+	if cmd.Op == kvPut {
+		entry, ok := modelStateMachine.KV(key)
+		if !ok {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_KV_FULL", "message": fmt.Sprintf("Store full (%d keys)", modelStateMachine.Settings().Int("kv_max_keys"))})
+			return
+		}
+		resp["key"] = key
+		resp["version"] = entry.Version
+	}
+	sendResponse(conn, resp)
+}
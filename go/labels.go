@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Node labels and scheduling constraints
+// ============================================================================
+
+// In a cluster of mixed hardware not every node should take every job. An
+// operator labels each node at start:
+//
+//	-labels gpu=true,region=us-east
+//
+// and a TRAIN or JOB_SUBMIT can require labels of the nodes that run it:
+//
+//	{"type": "TRAIN", "inputs": [...], "outputs": [...], "constraints": {"gpu": "true"}}
+//
+// A node matches when it has every constrained label with that exact value.
+// Nodes stamp their labels on RAFT RPCs and replies, as they do their UUID,
+// so the leader knows its peers' labels from the heartbeats; PING and
+// /status show them. The leader trains a constrained job itself only if its
+// own labels match, and a distributed job only sends chunks to matching
+// peers. A job the leader can't run and that isn't distributed goes whole
+// to one matching peer as a single SUB_TRAIN, and a chunk that fails on its
+// peer is not retried on a leader that doesn't match. When no reachable
+// node matches, the request fails with E_NO_MATCHING_NODE.
+
+// Labels are a node's key=value scheduling labels, or the ones a job
+// requires
+type Labels map[string]string
+
+var errNoMatchingNode = errors.New("no reachable node matches the constraints")
+
+// placementTimeout is -distributed-chunk-timeout, how long the leader waits
+// for the peer it hands a job to
+var placementTimeout = 10 * time.Minute
+
+// placementNext spreads single-peer placements over the matching peers
+var placementNext atomic.Uint64
+
+// parseLabels reads "key=value,key=value"
+func parseLabels(s string) (Labels, error) {
+	labels := make(Labels)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		if _, dup := labels[key]; dup {
+			return nil, fmt.Errorf("label %q given twice", key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// parseConstraints reads the constraints of a request: an object whose
+// values are strings, numbers or booleans
+func parseConstraints(v interface{}) (Labels, error) {
+	if v == nil {
+		return nil, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("constraints must be an object")
+	}
+	constraints := make(Labels, len(obj))
+	for key, value := range obj {
+		switch value := value.(type) {
+		case string:
+			constraints[key] = value
+		case bool:
+			constraints[key] = strconv.FormatBool(value)
+		case float64:
+			constraints[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("constraint %q must be a string, number or boolean", key)
+		}
+	}
+	return constraints, nil
+}
+
+// labelsFromValue reads the labels a peer stamped on an RPC
+func labelsFromValue(v interface{}) Labels {
+	obj, _ := v.(map[string]interface{})
+	if len(obj) == 0 {
+		return nil
+	}
+	labels := make(Labels, len(obj))
+	for key, value := range obj {
+		if s, ok := value.(string); ok {
+			labels[key] = s
+		}
+	}
+	return labels
+}
+
+// matches reports whether the labels satisfy every constraint
+func (l Labels) matches(constraints Labels) bool {
+	for key, want := range constraints {
+		if have, ok := l[key]; !ok || have != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// SetLabels sets the node's scheduling labels; call before Start
+func (rn *RaftNode) SetLabels(labels Labels) {
+	rn.labels = labels
+}
+
+// placement is where the leader may run a job's work
+type placement struct {
+	local bool     // the leader's labels match
+	peers []string // client addresses of the healthy peers that match
+}
+
+// placeJob finds the nodes that can run a job with these constraints
+func placeJob(constraints Labels) (placement, error) {
+	st := raftNode.Status()
+	p := placement{local: st.Labels.matches(constraints)}
+	for _, h := range st.Peers {
+		if !h.Reachable || h.Paused || h.WorkerPort == 0 || !h.Labels.matches(constraints) {
+			continue
+		}
+		host, _, err := net.SplitHostPort(h.Address)
+		if err != nil {
+			continue
+		}
+		p.peers = append(p.peers, net.JoinHostPort(host, strconv.Itoa(h.WorkerPort)))
+	}
+	if !p.local && len(p.peers) == 0 {
+		return p, fmt.Errorf("%w (%s)", errNoMatchingNode, constraints)
+	}
+	return p, nil
+}
+
+// single narrows a placement to one matching peer, for a job the leader
+// can't run itself
+func (p placement) single() placement {
+	i := placementNext.Add(1) - 1
+	return placement{peers: []string{p.peers[i%uint64(len(p.peers))]}}
+}
+
+// placedTrainer runs a job that goes whole to one peer: a distributed job
+// of a single chunk
+func placedTrainer() *DistributedTrainer {
+	return NewDistributedTrainer(1, placementTimeout, AggregateAverage, false)
+}
+
+// checkPlacement answers E_NO_MATCHING_NODE for a job no node can run and
+// reports whether it did
+func checkPlacement(conn net.Conn, constraints Labels) bool {
+	if _, err := placeJob(constraints); err != nil {
+		metrics.Inc("train.unplaceable", 1)
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_NO_MATCHING_NODE", "message": err.Error()})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+// ============================================================================
+// Leader lease
+// ============================================================================
+
+// A leader cut off from the cluster used to go on accepting TRAIN requests
+// and appending entries that could never commit, while the other side
+// elected a new leader. The leader now holds a lease: it stays leader only
+// while a majority of the voters answered one of its RPCs within the last
+// election timeout, the same window after which they would start voting
+// for someone else. The leader loop checks the lease after every round of
+// heartbeats and ReplicateIndex before every append; on expiry the node
+// steps down to follower, so writes are refused with "No leader available"
+// until it hears from a leader again.
+
+// leaseValidLocked reports whether a majority answered within an election
+// timeout. Callers hold rn.mu.
+func (rn *RaftNode) leaseValidLocked() bool {
+	window := rn.ElectionTimeout()
+	return rn.quorumLocked(func(key string) bool {
+		t, ok := rn.peerLastContact[key]
+		return ok && time.Since(t) < window
+	})
+}
+
+// checkLeaseLocked steps down when the lease has expired and reports
+// whether the node is still leader. Callers hold rn.mu.
+func (rn *RaftNode) checkLeaseLocked() bool {
+	if rn.state != "leader" {
+		return false
+	}
+	if rn.leaseValidLocked() {
+		return true
+	}
+	raftLog.Warnf("no answer from a majority within %v, stepping down in term %d", rn.ElectionTimeout(), rn.currentTerm)
+	metrics.Inc("raft.quorum_lost", 1)
+	rn.state = "follower"
+	rn.leader = nil
+	rn.resetElectionTimeout()
+	return false
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Live updates (WebSocket)
+// ============================================================================
+
+// /ws on the monitor is a WebSocket that pushes what happens on this node
+// as JSON text messages, so the dashboard needn't poll:
+//
+//	{"type": "raft", "at": "...", "state": "leader", "term": 7, "leader": {...}}
+//	{"type": "log", "at": "...", "line": "2024-05-01T10:00:00Z INFO  [tcp] TRAIN request: 20 samples"}
+//	{"type": "job", "at": "...", "job_id": "...", "event": "committed", "detail": {...}}
+//	{"type": "progress", "at": "...", "job_id": "...", "epoch": 101, "epochs": 1000, "loss": 0.0123}
+//	{"type": "model", "at": "...", "model_id": "...", "file": "model_123.bin"}
+//	{"type": "model_deleted", "at": "...", "model_id": "..."}
+//	{"type": "model_quarantined", "at": "...", "model_id": "...", "reason": "..."}
+//
+// raft is sent on connecting and whenever the role, term or leader
+// changes; log carries every line written to worker.log, job every job
+// event (jobevents.go), progress the epochs of trainings this node runs and
+// model the models this node applies. A client that falls 256 messages
+// behind is disconnected rather than slowing the node down. The monitor
+// token applies as for the other endpoints, and a browser must come from
+// the monitor's own origin. Metrics: ws.clients, ws.dropped.
+
+// liveBuffer is how many messages a client may fall behind
+const liveBuffer = 256
+
+// wsGUID is the key suffix of the WebSocket handshake (RFC 6455)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// LiveUpdates fans events out to the /ws clients
+type LiveUpdates struct {
+	clients atomic.Int64 // fast path for Publish with no one listening
+
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+var liveUpdates = &LiveUpdates{subs: make(map[chan []byte]struct{})}
+
+// Publish sends an event to every client. It never blocks: a client whose
+// buffer is full is dropped.
+func (h *LiveUpdates) Publish(eventType string, fields map[string]interface{}) {
+	if h.clients.Load() == 0 {
+		return
+	}
+	event := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["type"] = eventType
+	event["at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- data:
+		default:
+			h.removeLocked(ch)
+			metrics.Inc("ws.dropped", 1)
+		}
+	}
+}
+
+func (h *LiveUpdates) subscribe() chan []byte {
+	ch := make(chan []byte, liveBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.clients.Add(1)
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *LiveUpdates) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(ch)
+}
+
+// removeLocked closes ch, which tells its client to disconnect
+func (h *LiveUpdates) removeLocked(ch chan []byte) {
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+		h.clients.Add(-1)
+	}
+}
+
+// raftEvent is the raft message for the node's current state
+func raftEvent() map[string]interface{} {
+	st := raftNode.Status()
+	return map[string]interface{}{"state": st.Role, "term": st.Term, "leader": st.Leader}
+}
+
+// watchRaft publishes a raft event whenever the role, term or leader
+// changes, checking every interval while clients are connected
+func (h *LiveUpdates) watchRaft(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	key, _ := json.Marshal(raftEvent())
+	last := string(key)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if h.clients.Load() == 0 {
+			continue
+		}
+		event := raftEvent()
+		key, _ := json.Marshal(event)
+		if string(key) != last {
+			last = string(key)
+			h.Publish("raft", event)
+		}
+	}
+}
+
+// publishTrainingProgress returns a context that also publishes a progress
+// event for each epoch line of job's training
+func publishTrainingProgress(ctx context.Context, jobID string) context.Context {
+	next := outputObserver(ctx)
+	return withOutputObserver(ctx, func(line string) {
+		if next != nil {
+			next(line)
+		}
+		if epoch, epochs, loss, ok := parseEpochLine(line); ok {
+			liveUpdates.Publish("progress", map[string]interface{}{"job_id": jobID, "epoch": epoch, "epochs": epochs, "loss": loss})
+		}
+	})
+}
+
+func handleLiveUpdates(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "WebSocket only", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin WebSocket refused", http.StatusForbidden)
+			return
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	ch := liveUpdates.subscribe()
+	defer liveUpdates.unsubscribe(ch)
+	metrics.Inc("ws.clients", 1)
+	monitorLog.Debugf("ws: %s connected", conn.RemoteAddr())
+
+	// The reader answers pings and ends the session when the client
+	// closes; control frames are written under mu
+	var mu sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		return writeWSFrame(conn, opcode, payload)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			opcode, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsPing:
+				write(wsPong, payload)
+			case wsClose:
+				write(wsClose, nil)
+				return
+			}
+		}
+	}()
+
+	initial, _ := json.Marshal(withType("raft", raftEvent()))
+	if write(wsText, initial) != nil {
+		return
+	}
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				write(wsClose, nil)
+				return
+			}
+			if write(wsText, data) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if write(wsPing, nil) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func withType(eventType string, fields map[string]interface{}) map[string]interface{} {
+	fields["type"] = eventType
+	fields["at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	return fields
+}
+
+// writeWSFrame writes one unmasked, unfragmented frame
+func writeWSFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readWSFrame reads one frame from a client, which must mask it. Clients
+// only send control frames and the odd message here, so anything over 64
+// KiB ends the session.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("ws: unmasked client frame")
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > 64<<10 {
+		return 0, nil, errors.New("ws: client frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0F, payload, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ============================================================================
+// Leadership-aware prediction load shedding
+// ============================================================================
+
+// activeTrainings counts TRAIN requests currently running on this node
+var activeTrainings int64
+
+// shedThreshold is the number of concurrent trainings at which a busy leader
+// starts pointing PREDICT traffic at followers (0 disables shedding), unless
+// the cluster sets shed_threshold
+var shedThreshold int64
+
+func beginTraining() { atomic.AddInt64(&activeTrainings, 1) }
+func endTraining()   { atomic.AddInt64(&activeTrainings, -1) }
+
+// shedPredict answers a PREDICT with a SECONDARY hint when this node is a
+// saturated leader and at least one follower holds the model. It reports
+// whether the request was shed.
+func shedPredict(conn net.Conn, modelPath string) bool {
+	threshold := modelStateMachine.Settings().Int("shed_threshold")
+	if threshold <= 0 || atomic.LoadInt64(&activeTrainings) < threshold || !raftNode.IsLeader() {
+		return false
+	}
+
+	index, ok := modelStateMachine.FileIndex(filepath.Base(modelPath))
+	if !ok {
+		return false
+	}
+
+	var secondaries []interface{}
+	for _, p := range raftNode.PeersAtIndex(index) {
+		if p.WorkerPort > 0 {
+			secondaries = append(secondaries, []interface{}{p.Host, p.WorkerPort})
+		}
+	}
+	if len(secondaries) == 0 {
+		return false
+	}
+
+	predictLog.Infof("PREDICT shed: leader busy with %d trainings, hinting %d secondaries",
+		atomic.LoadInt64(&activeTrainings), len(secondaries))
+	sendResponse(conn, map[string]interface{}{
+		"status":      "SECONDARY",
+		"message":     "Leader busy with training, retry on a secondary",
+		"secondaries": secondaries,
+	})
+	return true
+}
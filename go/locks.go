@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Lease-based distributed locks
+// ============================================================================
+
+// A lock is a lease replicated through RAFT as LOCK entries. The leader stamps
+// each entry with its clock and every node judges expiry against that stamp,
+// so all nodes agree on who held a lock at each point of the log. Every grant
+// gets a new fencing token, increasing across all locks; a holder that may
+// have lost its lease passes the token along so stale writes can be refused.
+// Locks are advisory: nothing stops a node from acting without one.
+
+// LOCK entry operations
+const (
+	lockAcquire = "acquire"
+	lockRenew   = "renew"
+	lockRelease = "release"
+)
+
+const (
+	minLockTTL     = 100 * time.Millisecond
+	maxLockTTL     = 24 * time.Hour
+	defaultLockTTL = 30 * time.Second
+)
+
+var errLockHeld = errors.New("lock is held by another owner")
+
+// clientLocks exposes LOCK_* to clients (-client-locks)
+var clientLocks bool
+
+// internalLockPrefix marks the locks of the node's own tasks, which clients
+// can read but not take
+const internalLockPrefix = "internal/"
+
+// Lease is the replicated state of a held lock
+type Lease struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Token   int64  `json:"token"`
+	Expires string `json:"expires_at"`
+}
+
+func (l *Lease) expiredAt(at time.Time) bool {
+	expires, err := time.Parse(time.RFC3339Nano, l.Expires)
+	return err != nil || !at.Before(expires)
+}
+
+// LockCommand acquires, renews or releases a lease
+type LockCommand struct {
+	Op    string `json:"op"`
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	TTLMs int64  `json:"ttl_ms,omitempty"`
+	At    string `json:"at"`
+}
+
+func (c *LockCommand) Action() string { return "LOCK" }
+
+func (c *LockCommand) Validate() error {
+	if c.Name == "" || c.Owner == "" {
+		return fmt.Errorf("missing name or owner")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, c.At); err != nil {
+		return fmt.Errorf("invalid time %q", c.At)
+	}
+	switch c.Op {
+	case lockAcquire, lockRenew:
+		ttl := time.Duration(c.TTLMs) * time.Millisecond
+		if ttl < minLockTTL || ttl > maxLockTTL {
+			return fmt.Errorf("ttl must be between %v and %v", minLockTTL, maxLockTTL)
+		}
+	case lockRelease:
+	default:
+		return fmt.Errorf("unknown lock op %q", c.Op)
+	}
+	return nil
+}
+
+// Apply grants or refuses the operation. A refusal is not an error: the
+// caller reads the outcome back with Lock.
+func (c *LockCommand) Apply(sm *ModelStateMachine) error {
+	at, _ := time.Parse(time.RFC3339Nano, c.At)
+	expires := at.Add(time.Duration(c.TTLMs) * time.Millisecond).Format(time.RFC3339Nano)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	lease, held := sm.locks[c.Name]
+	if held && lease.expiredAt(at) {
+		delete(sm.locks, c.Name)
+		held = false
+	}
+	mine := held && lease.Owner == c.Owner
+
+	switch c.Op {
+	case lockAcquire:
+		if mine {
+			lease.Expires = expires
+		} else if !held {
+			sm.lockToken++
+			sm.locks[c.Name] = &Lease{Name: c.Name, Owner: c.Owner, Token: sm.lockToken, Expires: expires}
+		}
+	case lockRenew:
+		if mine {
+			lease.Expires = expires
+		}
+	case lockRelease:
+		if mine {
+			delete(sm.locks, c.Name)
+		}
+	}
+	return nil
+}
+
+// Lock returns the lease on a lock that hasn't expired by the local clock
+func (sm *ModelStateMachine) Lock(name string) (Lease, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	lease, ok := sm.locks[name]
+	if !ok || lease.expiredAt(time.Now()) {
+		return Lease{}, false
+	}
+	return *lease, true
+}
+
+// changeLock commits a LOCK entry and returns the lease it left, waiting
+// until it is applied locally
+func changeLock(op, name, owner string, ttl time.Duration) (Lease, int, error) {
+	cmd := &LockCommand{Op: op, Name: name, Owner: owner, TTLMs: ttl.Milliseconds(), At: time.Now().UTC().Format(time.RFC3339Nano)}
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		return Lease{}, index, err
+	}
+	if !modelStateMachine.WaitApplied(index, reserveWaitTimeout) {
+		return Lease{}, index, fmt.Errorf("lock change committed but not yet applied")
+	}
+	lease, held := modelStateMachine.Lock(name)
+	switch {
+	case op == lockRelease && !held:
+		return Lease{}, index, nil
+	case op == lockRelease && lease.Owner == owner:
+		return lease, index, fmt.Errorf("lock not released")
+	case !held:
+		return Lease{}, index, fmt.Errorf("lock not held")
+	case lease.Owner != owner:
+		return lease, index, errLockHeld
+	}
+	return lease, index, nil
+}
+
+// leaseKeeper holds a lock on behalf of a periodic task of this node,
+// extending it once half the lease is gone. Only the leader can commit LOCK
+// entries, so on followers Hold always fails.
+type leaseKeeper struct {
+	name    string
+	ttl     time.Duration
+	expires time.Time
+}
+
+// Hold reports whether this node holds the lock, acquiring it (which
+// extends a lease it already holds) when needed
+func (k *leaseKeeper) Hold() bool {
+	if time.Until(k.expires) > k.ttl/2 {
+		if lease, ok := modelStateMachine.Lock(k.name); ok && lease.Owner == raftNode.id {
+			return true
+		}
+	}
+	start := time.Now()
+	if _, _, err := changeLock(lockAcquire, k.name, raftNode.id, k.ttl); err != nil {
+		k.expires = time.Time{}
+		return false
+	}
+	k.expires = start.Add(k.ttl)
+	return true
+}
+
+// handleLock serves LOCK_ACQUIRE, LOCK_RENEW, LOCK_RELEASE and LOCK_STATUS.
+// Changes go to the leader; LOCK_STATUS is answered by any node.
+func handleLock(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	if !clientLocks {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Client locks are disabled (-client-locks)"})
+		return
+	}
+	msgType, _ := msg["type"].(string)
+	name, _ := msg["name"].(string)
+	owner, _ := msg["owner"].(string)
+	if name == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing name"})
+		return
+	}
+
+	if msgType == "LOCK_STATUS" {
+		if !awaitSession(conn, msg) {
+			return
+		}
+		resp := map[string]interface{}{"status": "OK", "name": name, "held": false, "session": currentSession(msg)}
+		if lease, ok := modelStateMachine.Lock(name); ok {
+			resp["held"] = true
+			resp["owner"] = lease.Owner
+			resp["token"] = lease.Token
+			resp["expires_at"] = lease.Expires
+		}
+		sendResponse(conn, resp)
+		return
+	}
+
+	if owner == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing owner"})
+		return
+	}
+	if strings.HasPrefix(name, internalLockPrefix) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Locks under " + internalLockPrefix + " are reserved"})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	ttl := defaultLockTTL
+	if ms := numberOr(msg["ttl_ms"], 0); ms > 0 {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	op := map[string]string{"LOCK_ACQUIRE": lockAcquire, "LOCK_RENEW": lockRenew, "LOCK_RELEASE": lockRelease}[msgType]
+
+	lease, index, err := changeLock(op, name, owner, ttl)
+	switch {
+	case errors.Is(err, errLockHeld):
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_LOCK_HELD", "message": err.Error(), "name": name, "owner": lease.Owner, "expires_at": lease.Expires})
+	case err != nil:
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_LOCK", "message": err.Error(), "name": name})
+	case op == lockRelease:
+		sendResponse(conn, map[string]interface{}{"status": "OK", "name": name, "session": sessionToken(index)})
+	default:
+		sendResponse(conn, map[string]interface{}{"status": "OK", "name": name, "owner": lease.Owner, "token": lease.Token, "expires_at": lease.Expires, "session": sessionToken(index)})
+	}
+}
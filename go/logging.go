@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Structured logging
+// ============================================================================
+
+// Every component logs through its own Logger, which tags lines with the
+// component and drops those below the component's level. Lines go to stdout
+// and worker.log, as text ("<time> <LEVEL> [<component>] <message>") or,
+// with -log-format json, one JSON object per line for ELK/Loki. The level
+// is set with -log-level and changed at runtime, for all components or one,
+// through /admin/log-level on the HTTP monitor.
+
+// LogLevel orders log messages by severity
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{LevelDebug: "DEBUG", LevelInfo: "INFO", LevelWarn: "WARN", LevelError: "ERROR"}
+
+func (l LogLevel) String() string { return levelNames[l] }
+
+// parseLogLevel accepts a level name in any case
+func parseLogLevel(name string) (LogLevel, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (use debug, info, warn or error)", name)
+}
+
+// Log output formats (-log-format)
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var (
+	logConfigMu     sync.RWMutex
+	logLevel        = LevelInfo
+	componentLevels = map[string]LogLevel{} // overrides of logLevel
+	logFormat       = LogFormatText
+	logNode         string // node id added to JSON lines
+)
+
+// Logger writes the messages of one component
+type Logger struct {
+	component string
+}
+
+// Component loggers
+var (
+	workerLog      = &Logger{"worker"}
+	tcpLog         = &Logger{"tcp"}
+	raftLog        = &Logger{"raft"}
+	javaLog        = &Logger{"java"}
+	monitorLog     = &Logger{"monitor"}
+	jobsLog        = &Logger{"jobs"}
+	storageLog     = &Logger{"storage"}
+	predictLog     = &Logger{"predict"}
+	geoLog         = &Logger{"geo"}
+	metricsLog     = &Logger{"metrics"}
+	shutdownLog    = &Logger{"shutdown"}
+	recoveryLog    = &Logger{"recovery"}
+	maintenanceLog = &Logger{"maintenance"}
+
+	loggers = []*Logger{workerLog, tcpLog, raftLog, javaLog, monitorLog, jobsLog, storageLog, predictLog,
+		geoLog, metricsLog, shutdownLog, recoveryLog, maintenanceLog}
+)
+
+// Enabled reports whether messages at level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	logConfigMu.RLock()
+	defer logConfigMu.RUnlock()
+	threshold, ok := componentLevels[l.component]
+	if !ok {
+		threshold = logLevel
+	}
+	return level >= threshold
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now().UTC()
+
+	logConfigMu.RLock()
+	asJSON, node := logFormat == LogFormatJSON, logNode
+	logConfigMu.RUnlock()
+
+	var line string
+	if asJSON {
+		var buf strings.Builder
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Component string `json:"component"`
+			Node      string `json:"node,omitempty"`
+			Msg       string `json:"msg"`
+		}{now.Format(time.RFC3339Nano), strings.ToLower(level.String()), l.component, node, msg})
+		line = buf.String()
+	} else {
+		line = fmt.Sprintf("%s %-5s [%s] %s\n", now.Format(time.RFC3339), level, l.component, msg)
+	}
+
+	logMutex.Lock()
+	fmt.Print(line)
+	if logFile != nil {
+		logFile.WriteString(line)
+	}
+	logMutex.Unlock()
+	liveUpdates.Publish("log", map[string]interface{}{"line": strings.TrimSuffix(line, "\n")})
+}
+
+// setupLogging applies -log-level and -log-format
+func setupLogging(level, format, node string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("invalid -log-format %q (use %s or %s)", format, LogFormatText, LogFormatJSON)
+	}
+	logConfigMu.Lock()
+	defer logConfigMu.Unlock()
+	logLevel, logFormat, logNode = lvl, format, node
+	return nil
+}
+
+// setLogLevel changes the level of one component, or of all of them (and
+// clears the overrides) when component is empty
+func setLogLevel(component string, level LogLevel) {
+	logConfigMu.Lock()
+	defer logConfigMu.Unlock()
+	if component == "" {
+		logLevel = level
+		componentLevels = map[string]LogLevel{}
+		return
+	}
+	componentLevels[component] = level
+}
+
+func logLevelStatus() map[string]interface{} {
+	logConfigMu.RLock()
+	defer logConfigMu.RUnlock()
+	components := make(map[string]string, len(componentLevels))
+	for _, c := range sortedKeys(componentLevels) {
+		components[c] = strings.ToLower(componentLevels[c].String())
+	}
+	return map[string]interface{}{
+		"level":      strings.ToLower(logLevel.String()),
+		"format":     logFormat,
+		"components": components,
+		"known":      knownComponents(),
+	}
+}
+
+func knownComponents() []string {
+	names := []string{}
+	for _, l := range loggers {
+		names = append(names, l.component)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func knownComponent(name string) bool {
+	for _, l := range loggers {
+		if l.component == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleLogLevelAPI shows or changes log levels:
+// GET shows them, POST ?level=debug[&component=raft] changes one
+func handleLogLevelAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level, err := parseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		component := r.URL.Query().Get("component")
+		if component != "" && !knownComponent(component) {
+			http.Error(w, "unknown component "+component, http.StatusBadRequest)
+			return
+		}
+		setLogLevel(component, level)
+		if component == "" {
+			component = "all components"
+		}
+		monitorLog.Infof("log level of %s set to %s", component, level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelStatus())
+}
@@ -5,7 +5,7 @@ This is a complete Worker implementation compatible with the Python workers.
 Uses only standard library (no external dependencies).
 
 Features:
-- TCP Server for client requests (TRAIN, PREDICT, LIST_MODELS)
+- TCP Server for client requests (TRAIN, PREDICT, PREDICT_BATCH, LIST_MODELS)
 - RAFT consensus for replication
 - HTTP Monitor for status visualization
 - Calls Java TrainingModule for neural network operations
@@ -14,8 +14,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -23,10 +25,12 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,38 +40,225 @@ var (
 	raftNode   *RaftNode
 	storageDir string
 	modelsDir  string
-	javaDir    string
+	raftDir    string
+	scratchDir string
+	logDir     string
 	logFile    *os.File
 	logMutex   sync.Mutex
+
+	modelStateMachine *ModelStateMachine
+	geoReplicator     *GeoReplicator
 )
 
+// subcommands maps `worker <name>` to an operator tool that runs instead of
+// the server
+var subcommands = map[string]func([]string) error{
+	"backup":         runBackup,
+	"restore":        runRestore,
+	"support-bundle": runSupportBundle,
+}
+
 func main() {
+	// Operator subcommands run standalone and exit
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse command line arguments
 	host := flag.String("host", "0.0.0.0", "Host to bind")
 	port := flag.Int("port", 9000, "TCP port for client connections")
 	monitorPort := flag.Int("monitor-port", 8000, "HTTP port for monitor")
 	raftPort := flag.Int("raft-port", 10000, "Port for RAFT RPCs")
-	peersStr := flag.String("peers", "", "Comma-separated list of peers (host:port)")
+	grpcPort := flag.Int("grpc-port", 0, "Port serving the gRPC API of proto/worker.proto (0 = off)")
+	filePort := flag.Int("file-port", 0, "Port serving model files to peers, which then replicate through RAFT as checksums only; set on every node, peers learn it from RAFT replies or a fourth port in -peers (0 = off)")
+	peersStr := flag.String("peers", "", "Comma-separated list of peers (host:client_port:raft_port[:file_port])")
+	discoverFlag := flag.String("discover", "", "Find peers through DNS and/or LAN multicast: comma-separated dns:NAME, multicast or multicast:GROUP:PORT; the leader adds the nodes found")
+	discoverInterval := flag.Duration("discover-interval", 15*time.Second, "How often -discover looks for peers and multicast nodes announce themselves")
 	storageDirFlag := flag.String("storage-dir", "", "Storage directory")
+	modelsDirFlag := flag.String("models-dir", "", "Directory for model files (default <storage-dir>/models)")
+	raftDirFlag := flag.String("raft-dir", "", "Directory for RAFT state (default <storage-dir>)")
+	scratchDirFlag := flag.String("scratch-dir", "", "Directory for temporary training data (default <storage-dir>/scratch)")
+	logDirFlag := flag.String("log-dir", "", "Directory for worker.log (default <storage-dir>)")
+	minFreeMB := flag.Int("min-free-mb", 100, "Minimum free space per storage volume in MB")
 	javaDirFlag := flag.String("java-dir", "java", "Java classes directory")
+	javaBinFlag := flag.String("java-bin", "", "Java launcher, a path or a name looked up in PATH (default java)")
+	javaOptsFlag := flag.String("java-opts", "", "JVM options for TrainingModule, separated by spaces (e.g. \"-Xmx2g -XX:+UseSerialGC\")")
+	javaClasspathFlag := flag.String("java-classpath", "", "Comma-separated classpath entries added after -java-dir")
+	javaUserFlag := flag.String("java-user", "", "Run TrainingModule as this user, name or uid (Linux, worker running as root)")
+	javaWorkdirFlag := flag.String("java-workdir", "", "Run TrainingModule in this directory instead of the worker's")
+	javaNoNetwork := flag.Bool("java-no-network", false, "Run TrainingModule in a network namespace without network access (Linux)")
+	backendFlag := flag.String("backend", BackendJava, "Model backend: java (TrainingModule on a JVM) or go (in-process, no JVM needed)")
+	hiddenLayersFlag := flag.String("hidden-layers", "", "Hidden layer sizes for -backend=go, e.g. 16,8 (default: one layer sized like the Java backend)")
+	javaBridgeFlag := flag.Bool("java-bridge", true, "Keep one TrainingModule JVM running and send it every backend command (false = one JVM per command)")
+	javaWorkers := flag.Int("java-workers", runtime.NumCPU(), "TrainingModule commands running at once; more wait by priority (predict first, train last)")
+	javaQueue := flag.Int("java-queue", 1024, "TrainingModule commands waiting for a slot before they fail (0 = unbounded)")
+	geoTarget := flag.String("geo-target", "", "Worker address (host:port) of a standby cluster for async geo-replication")
+	geoQueue := flag.Int("geo-queue", 1000, "Max committed entries buffered for geo-replication")
+	cancelOnDisconnectFlag := flag.Bool("cancel-on-disconnect", true, "Abort TRAIN when the client disconnects before the response")
+	maintenanceFlag := flag.Bool("maintenance", false, "Start in read-only maintenance mode")
+	shedAt := flag.Int("shed-threshold", 0, "Concurrent trainings at which the leader redirects PREDICT to followers (0 = off)")
+	statsdAddr := flag.String("statsd", "", "statsd agent address (host:port) to push metrics to")
+	statsdPrefix := flag.String("statsd-prefix", "worker", "Prefix for statsd metric names")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "statsd flush interval")
+	batchWindow := flag.Duration("predict-batch-window", 0, "Batch PREDICT requests for the same model arriving within this window (0 = off)")
+	batchMax := flag.Int("predict-batch-max", 64, "Maximum PREDICT requests per batch")
+	predictMaxConcurrent := flag.Int("predict-max-concurrent", 0, "Backend predictions (or batches) running at once per model; more wait in FIFO order (0 = unlimited)")
+	predictQueue := flag.Int("predict-queue", 256, "Predictions waiting for a slot per model before E_QUEUE_FULL (0 = unbounded)")
+	predictQueueTimeout := flag.Duration("predict-queue-timeout", 30*time.Second, "Longest wait for a prediction slot (0 = no limit)")
+	fastMaxParams := flag.Int("fast-predict-max-params", 10000, "Serve PREDICT in-process for models with at most this many parameters (0 = off)")
+	fastCheck := flag.Bool("fast-predict-check", false, "Cross-check every in-process prediction against the Java backend")
+	nonLeader := flag.String("non-leader", NonLeaderRedirect, "How followers answer TRAIN: redirect (REDIRECT to the leader) or proxy (forward and relay)")
+	proxyTimeoutFlag := flag.Duration("proxy-timeout", 10*time.Minute, "Maximum time to wait for the leader when proxying")
+	pendingTTL := flag.Duration("pending-ttl", 24*time.Hour, "Discard models trained with \"publish\": false that are not published within this long")
+	requestTimeoutFlag := flag.Duration("request-timeout", requestTimeout, "Deadline of a client request other than a training; past it the backend command is cancelled and the client gets E_TIMEOUT (0 = none)")
+	trainTimeoutFlag := flag.Duration("train-timeout", trainTimeout, "Deadline of TRAIN, SUB_TRAIN and JOB_SUBMIT trainings (0 = none)")
+	raftRPCTimeoutFlag := flag.Duration("raft-rpc-timeout", raftRPCTimeout, "Deadline of one RAFT RPC to a peer, dial included")
+	replicateTimeoutFlag := flag.Duration("replicate-timeout", replicateTimeout, "Longest a replicated command waits for its round to reach the followers")
+	maxConns := flag.Int("max-connections", 0, "Client connections served at once; more get E_QUEUE_FULL (0 = unlimited)")
+	maxTrainings := flag.Int("max-trainings", 0, "Trainings (TRAIN, jobs and SUB_TRAIN chunks) running at once on this node; a TRAIN over it gets E_QUEUE_FULL (0 = unlimited)")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second allowed from one client address; more get E_QUEUE_FULL (0 = unlimited)")
+	rateBurst := flag.Int("rate-burst", 0, "Requests one client address may send in a burst under -rate-limit (0 = one second's worth)")
+	jobQueue := flag.Int("job-queue", 64, "Maximum JOB_SUBMIT trainings waiting to run")
+	jobWorkers := flag.Int("job-workers", 1, "JOB_SUBMIT trainings run concurrently")
+	jobRetention := flag.Duration("job-retention", time.Hour, "Keep finished jobs for JOB_STATUS/JOB_RESULT this long")
+	maxTrainSamplesFlag := flag.Int64("max-train-samples", 0, "Samples a TRAIN or JOB_SUBMIT may carry unless the cluster sets max_train_samples (0 = unlimited)")
+	clientLocksFlag := flag.Bool("client-locks", false, "Let clients take replicated locks with LOCK_ACQUIRE/LOCK_RENEW/LOCK_RELEASE")
+	driftThresholdFlag := flag.Float64("drift-threshold", 0.2, "PSI between prediction and training inputs above which a model is reported as drifting")
+	driftWebhookFlag := flag.String("drift-webhook", "", "URL to POST input drift warnings to")
+	quarantineAfterFlag := flag.Int("quarantine-after", 5, "Quarantine a model after this many consecutive failed predictions on a node (0 = never)")
+	quarantineWebhookFlag := flag.String("quarantine-webhook", "", "URL to POST model quarantine alerts to")
+	auditRate := flag.Float64("audit-sample-rate", 0, "Fraction of PREDICT requests whose input and output are kept in a per-model audit data set (0 = off)")
+	auditAnonymize := flag.Bool("audit-anonymize", false, "Drop request ids from audit samples, round their values and truncate their time to the hour")
+	auditMax := flag.Int("audit-max-samples", 10000, "Audit samples kept per model; the oldest are dropped")
+	compressMin := flag.Int("raft-compress-min", 32*1024, "Compress RAFT RPCs of at least this many bytes to peers that support it (0 = off)")
+	storeFileChunk := flag.Int("store-file-chunk", 1<<20, "Replicate files larger than this many bytes as chunked STORE_FILE transfers")
+	walCheckpoint := flag.Int64("raft-wal-checkpoint", 16<<20, "Checkpoint raft_state.json once the RAFT write-ahead log reaches this many bytes")
+	piggybackMax := flag.Int64("raft-piggyback-max", 4096, "Replicate commands of at most this many bytes on the next heartbeat instead of their own round (0 = off)")
+	snapshotThreshold := flag.Int("snapshot-threshold", 1000, "Snapshot and compact the RAFT log every this many applied entries (0 = off)")
+	chunkGrace := flag.Duration("chunk-gc-grace", 10*time.Minute, "Keep chunk models this long after their merged model commits")
+	chunkOrphanTTL := flag.Duration("chunk-orphan-ttl", 24*time.Hour, "Delete chunk models never linked to a committed merge after this long")
+	distributedMin := flag.Int("distributed-min-samples", 0, "Split TRAIN jobs of at least this many samples across healthy workers (0 = off)")
+	distributedChunkTimeout := flag.Duration("distributed-chunk-timeout", 10*time.Minute, "How long the leader waits for a worker to train its chunk")
+	distributedPartial := flag.Bool("distributed-partial-merge", true, "When some chunks of a distributed TRAIN fail, merge the others and answer PARTIAL instead of failing")
+	sharedDatasetDir := flag.String("shared-dataset-dir", "", "Directory on a volume every node mounts: distributed TRAIN writes the data set there once and SUB_TRAIN carries row ranges instead of rows")
+	datasetStoreFlag := flag.String("dataset-store", "", "How distributed TRAIN ships chunks: inline, shared or replicated (default: shared with -shared-dataset-dir, else inline)")
+	datasetCacheTTL := flag.Duration("dataset-cache-ttl", time.Hour, "Keep data sets pushed with DATASET_PUT this long after their last use")
+	distributedMerge := flag.String("distributed-merge", AggregateEnsemble, "How distributed training merges chunk models: ensemble or average")
+	labelsFlag := flag.String("labels", "", "Scheduling labels of this node, key=value,... (e.g. gpu=true,region=us-east); TRAIN constraints select nodes by them")
+	apiTokensFile := flag.String("api-tokens", "", "File of \"role token [name]\" lines (roles reader, writer, admin); requests must then carry a token in \"auth\"")
+	secretFile := flag.String("cluster-secret-file", "", "File holding the shared secret that authenticates RAFT peers (default: $CLUSTER_SECRET; unset = no authentication)")
+	skipSelfTest := flag.Bool("skip-self-test", false, "Skip the startup environment self-test")
+	maxClockSkew := flag.Duration("max-clock-skew", 2*time.Second, "Maximum tolerated clock skew against peers")
+	join := flag.Bool("join", false, "Start as a new server of a running cluster: don't stand for election until added with ADD_SERVER")
+	recoverFrom := flag.String("recover-from", "", "Rebuild lost storage from a live peer (host:port) before joining")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate: serve TLS on the client port and monitor, mutual TLS between RAFT peers")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "PEM CA bundle that peer and client certificates must chain to (default: system roots)")
+	tlsClientAuth := flag.String("tls-client-auth", TLSClientAuthNone, "Client certificates on the client port and monitor: none, request or require")
+	electionMin := flag.Duration("election-timeout-min", electionTimeoutMin, "Lower bound of the adaptive RAFT election timeout")
+	electionMax := flag.Duration("election-timeout-max", electionTimeoutMax, "Upper bound of the adaptive RAFT election timeout")
+	heartbeatFlag := flag.Duration("heartbeat-interval", 0, "Interval between the leader's AppendEntries (0 = a quarter of the election timeout, at most 1s)")
+	logLevelFlag := flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error (changeable at runtime via /admin/log-level)")
+	logFormatFlag := flag.String("log-format", LogFormatText, "Log line format: text or json")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "On SIGINT/SIGTERM, wait this long for in-flight requests and jobs before cancelling them")
+	configFlag := flag.String("config", "", "YAML or JSON file of flag values; WORKER_<FLAG> variables override it, command-line flags override both")
 	flag.Parse()
 
+	configSources, configErr := applyConfig(*configFlag)
+	if configErr != nil {
+		fmt.Fprintln(os.Stderr, configErr)
+		os.Exit(2)
+	}
+	if err := setupLogging(*logLevelFlag, *logFormatFlag, fmt.Sprintf("%s:%d", *host, *port)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if configSources != "" {
+		workerLog.Infof("configuration: %s", configSources)
+	}
+
 	// Configure directories
 	if *storageDirFlag != "" {
 		storageDir = *storageDirFlag
 	} else {
 		storageDir = fmt.Sprintf("node%d_storage", *port-9000)
 	}
-	modelsDir = filepath.Join(storageDir, "models")
-	javaDir = *javaDirFlag
+	modelsDir = resolveDir(*modelsDirFlag, storageDir, "models")
+	raftDir = resolveDir(*raftDirFlag, storageDir, "")
+	scratchDir = resolveDir(*scratchDirFlag, storageDir, "scratch")
+	logDir = resolveDir(*logDirFlag, storageDir, "")
+	minFreeBytes = uint64(*minFreeMB) << 20
+	setJavaDir(*javaDirFlag)
+	if *backendFlag != BackendJava && *backendFlag != BackendGo {
+		fmt.Fprintf(os.Stderr, "invalid -backend %q (use %s or %s)\n", *backendFlag, BackendJava, BackendGo)
+		os.Exit(2)
+	}
+	modelBackend = *backendFlag
+	if modelBackend == BackendJava {
+		if err := configureJava(*javaBinFlag, *javaOptsFlag, *javaClasspathFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid JVM configuration: %v\n", err)
+			os.Exit(2)
+		}
+		if err := configureSandbox(*javaUserFlag, *javaWorkdirFlag, *javaNoNetwork); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid JVM sandbox: %v\n", err)
+			os.Exit(2)
+		}
+		if sandbox.Dir != "" {
+			// The JVM no longer runs in the worker's directory
+			modelsDir, _ = filepath.Abs(modelsDir)
+			scratchDir, _ = filepath.Abs(scratchDir)
+		}
+	}
+	if *distributedMerge != AggregateEnsemble && *distributedMerge != AggregateAverage {
+		fmt.Fprintf(os.Stderr, "invalid -distributed-merge %q (use %s or %s)\n", *distributedMerge, AggregateEnsemble, AggregateAverage)
+		os.Exit(2)
+	}
+	nodeLabels, err := parseLabels(*labelsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -labels: %v\n", err)
+		os.Exit(2)
+	}
+	layers, err := parseHiddenLayers(*hiddenLayersFlag)
+	if err != nil || layers != nil && modelBackend != BackendGo {
+		fmt.Fprintf(os.Stderr, "invalid -hidden-layers %q: needs -backend=%s and positive sizes\n", *hiddenLayersFlag, BackendGo)
+		os.Exit(2)
+	}
+	hiddenLayers = layers
+	inputDriftThreshold = *driftThresholdFlag
+	if *auditRate < 0 || *auditRate > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -audit-sample-rate %v (use a fraction between 0 and 1)\n", *auditRate)
+		os.Exit(2)
+	}
+	inputDriftWebhook = *driftWebhookFlag
+	if *quarantineAfterFlag < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -quarantine-after %d (use 0 to disable)\n", *quarantineAfterFlag)
+		os.Exit(2)
+	}
+	quarantineAfter = *quarantineAfterFlag
+	quarantineWebhook = *quarantineWebhookFlag
+
+	if err := setupTLS(*tlsCert, *tlsKey, *tlsCA, *tlsClientAuth); err != nil {
+		fmt.Fprintf(os.Stderr, "TLS: %v\n", err)
+		os.Exit(2)
+	}
+
+	if clusterSecret, err = loadClusterSecret(*secretFile); err != nil {
+		log.Fatal("Failed to read cluster secret: ", err)
+	}
 
 	// Create directories
-	os.MkdirAll(storageDir, 0755)
-	os.MkdirAll(modelsDir, 0755)
+	if err := ensureStorageDirs(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Setup logging
-	logPath := filepath.Join(storageDir, "worker.log")
-	var err error
+	logPath := filepath.Join(logDir, "worker.log")
 	logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatal("Failed to open log file:", err)
@@ -75,86 +266,249 @@ func main() {
 	defer logFile.Close()
 
 	// Parse peers
-	var peers []Peer
-	if *peersStr != "" {
-		for _, p := range strings.Split(*peersStr, ",") {
-			parts := strings.Split(strings.TrimSpace(p), ":")
-			if len(parts) == 2 {
-				var peerPort int
-				fmt.Sscanf(parts[1], "%d", &peerPort)
-				// Calculate RAFT port for peer
-				raftPeerPort := *raftPort + (peerPort - *port)
-				peers = append(peers, Peer{Host: parts[0], Port: raftPeerPort})
-			}
+	addressBook.SetSelf(Peer{Host: *host, Port: *raftPort, WorkerPort: *port})
+	peers, legacyPeers, err := addressBook.ParsePeers(*peersStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -peers: %v\n", err)
+		os.Exit(2)
+	}
+	if len(legacyPeers) > 0 {
+		workerLog.Warnf("-peers %s: no RAFT port given, assuming the same offset from -port as this node's; use host:client_port:raft_port",
+			strings.Join(legacyPeers, ","))
+	}
+	if *discoverFlag != "" {
+		if discovery, err = NewDiscovery(*discoverFlag, *discoverInterval, Peer{Host: *host, Port: *raftPort, WorkerPort: *port}); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -discover: %v\n", err)
+			os.Exit(2)
+		}
+		workerLog.Infof("discovery: %s", discovery)
+		if len(peers) == 0 {
+			peers = discovery.Bootstrap()
+		}
+	}
+
+	if *apiTokensFile != "" {
+		if len(clusterSecret) == 0 && (len(peers) > 0 || *join) {
+			fmt.Fprintln(os.Stderr, "-api-tokens needs -cluster-secret-file (or CLUSTER_SECRET) so nodes can authenticate their requests to each other")
+			os.Exit(2)
+		}
+		n, err := loadAPITokens(*apiTokensFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -api-tokens: %v\n", err)
+			os.Exit(2)
+		}
+		workerLog.Infof("api tokens: %d loaded from %s", n, *apiTokensFile)
+	}
+
+	if !*skipSelfTest {
+		ports := map[string]int{"client": *port, "monitor": *monitorPort, "raft": *raftPort}
+		if *filePort > 0 {
+			ports["file"] = *filePort
+		}
+		report := runSelfTest(SelfTestConfig{
+			Host:         *host,
+			Ports:        ports,
+			Peers:        peers,
+			MaxClockSkew: *maxClockSkew,
+		})
+		if !report.Ready {
+			workerLog.Warnf("Self-test failed, refusing to start (use -skip-self-test to override)")
+			os.Exit(1)
 		}
 	}
 
 	// Initialize RAFT node
+	if *electionMin <= 0 || *electionMax < *electionMin {
+		fmt.Fprintf(os.Stderr, "invalid election timeout bounds %v..%v\n", *electionMin, *electionMax)
+		os.Exit(2)
+	}
+	if *heartbeatFlag < 0 || *heartbeatFlag >= *electionMin {
+		fmt.Fprintf(os.Stderr, "invalid -heartbeat-interval %v (must be below -election-timeout-min)\n", *heartbeatFlag)
+		os.Exit(2)
+	}
+	setElectionTimeoutBounds(*electionMin, *electionMax)
+	heartbeatOverride.Store(int64(*heartbeatFlag))
 	nodeID := fmt.Sprintf("%s:%d", *host, *port)
 	raftNode = NewRaftNode(nodeID, *host, *raftPort, peers, *port)
+	uuid, err := loadNodeUUID(raftDir)
+	if err != nil {
+		workerLog.Errorf("cannot load node uuid: %v", err)
+		os.Exit(1)
+	}
+	raftNode.SetUUID(uuid)
+	raftNode.SetLabels(nodeLabels)
+	if len(nodeLabels) > 0 {
+		workerLog.Infof("node labels: %s", nodeLabels)
+	}
 
-	// Set callback to apply committed entries (for .bin file replication)
-	raftNode.SetApplyCallback(func(cmd map[string]interface{}) {
-		action, _ := cmd["action"].(string)
-		
-		// Handle STORE_FILE entries
-		if action == "STORE_FILE" {
-			filename, _ := cmd["filename"].(string)
-			dataB64, _ := cmd["data_b64"].(string)
-			
-			if filename == "" || dataB64 == "" {
-				logMsg("RAFT STORE_FILE: missing filename or data")
-				return
-			}
-			
-			data, err := base64.StdEncoding.DecodeString(dataB64)
-			if err != nil {
-				logMsg("RAFT STORE_FILE: base64 decode error: %v", err)
-				return
-			}
-			
-			path := filepath.Join(modelsDir, filename)
-			if err := os.WriteFile(path, data, 0644); err != nil {
-				logMsg("RAFT STORE_FILE: write error: %v", err)
-				return
-			}
-			
-		logMsg("RAFT applied STORE_FILE: wrote %s (%d bytes)", path, len(data))
-		} else {
-			logMsg("RAFT applied command: %v", cmd)
+	// Apply committed entries to the model state machine
+	modelStateMachine = NewModelStateMachine(modelsDir)
+	shedThreshold = int64(*shedAt)
+	if localDatasets, err = newDatasetFiles(filepath.Join(storageDir, "datasets"), *datasetCacheTTL); err != nil {
+		workerLog.Errorf("Cannot create dataset cache: %v", err)
+		os.Exit(1)
+	}
+	if *datasetStoreFlag == "" && *sharedDatasetDir != "" {
+		*datasetStoreFlag = DatasetsShared
+	}
+	switch *datasetStoreFlag {
+	case "", DatasetsInline:
+	case DatasetsReplicated:
+		datasetStore = &replicatedDatasets{localDatasets}
+	case DatasetsShared:
+		shared, err := NewSharedDatasets(*sharedDatasetDir)
+		if *sharedDatasetDir == "" || err != nil {
+			workerLog.Errorf("Cannot use -dataset-store shared: needs a usable -shared-dataset-dir (%v)", err)
+			os.Exit(1)
+		}
+		datasetStore = shared
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -dataset-store %q (use %s, %s or %s)\n", *datasetStoreFlag, DatasetsInline, DatasetsShared, DatasetsReplicated)
+		os.Exit(2)
+	}
+	chunkRegistry = NewChunkRegistry(storageDir, *chunkGrace, *chunkOrphanTTL)
+	placementTimeout = *distributedChunkTimeout
+	if *distributedMin > 0 {
+		distributedTrainer = NewDistributedTrainer(*distributedMin, *distributedChunkTimeout, *distributedMerge, *distributedPartial)
+	}
+	modelStateMachine.OnApply(trackChunkMerges)
+	jobEvents = NewJobEventLog(filepath.Join(storageDir, "jobs"), nodeID)
+	modelStateMachine.OnApply(trackJobCommits)
+	feedbackStore = NewFeedbackStore(filepath.Join(storageDir, "feedback"))
+	if *auditRate > 0 {
+		predictionAudit = NewPredictionAudit(filepath.Join(storageDir, "audit"), *auditRate, *auditAnonymize, *auditMax)
+	}
+	modelStateMachine.OnApply(func(index int, cmd Command) {
+		if geoReplicator != nil && raftNode.IsLeader() {
+			geoReplicator.Enqueue(encodeCommand(cmd))
 		}
 	})
+	raftNode.SetStateMachine(modelStateMachine)
+	raftNode.SetSnapshotThreshold(*snapshotThreshold)
+	raftNode.SetJoining(*join)
+	raftCompressMin = *compressMin
+	piggybackMaxBytes = *piggybackMax
+	walCheckpointBytes = *walCheckpoint
+	if *storeFileChunk > 0 {
+		storeFileChunkBytes = *storeFileChunk
+	}
+	if *filePort > 0 {
+		fileServicePort = *filePort
+	}
 
-	// Set persistence path for RAFT state
-	raftNode.SetPersistencePath(storageDir)
-
-	go raftNode.Start()
+	cancelOnDisconnect = *cancelOnDisconnectFlag
+	if *nonLeader != NonLeaderRedirect && *nonLeader != NonLeaderProxy {
+		fmt.Fprintf(os.Stderr, "invalid -non-leader %q (use %s or %s)\n", *nonLeader, NonLeaderRedirect, NonLeaderProxy)
+		os.Exit(2)
+	}
+	nonLeaderMode = *nonLeader
+	proxyTimeout = *proxyTimeoutFlag
+	if *requestTimeoutFlag < 0 || *trainTimeoutFlag < 0 || *raftRPCTimeoutFlag <= 0 || *replicateTimeoutFlag <= 0 {
+		fmt.Fprintln(os.Stderr, "-request-timeout and -train-timeout can't be negative, -raft-rpc-timeout and -replicate-timeout must be positive")
+		os.Exit(2)
+	}
+	requestTimeout, trainTimeout = *requestTimeoutFlag, *trainTimeoutFlag
+	raftRPCTimeout, replicateTimeout = *raftRPCTimeoutFlag, *replicateTimeoutFlag
 
+	if *maintenanceFlag {
+		setMaintenance(true, "started with -maintenance")
+	}
 
-	logMsg("Worker started: host=%s, port=%d, raft_port=%d", *host, *port, *raftPort)
-	logMsg("Storage: %s, Models: %s", storageDir, modelsDir)
-	logMsg("Peers: %v", peers)
+	// Set persistence path for RAFT state
+	raftNode.SetPersistencePath(raftDir)
 
 	// Start HTTP monitor
 	go startHTTPMonitor(*host, *monitorPort)
 
-	// Start TCP server (blocking)
-	startTCPServer(*host, *port)
+	if *recoverFrom != "" {
+		if err := recoverFromPeer(*recoverFrom); err != nil {
+			os.Exit(1)
+		}
+	}
 
-}
+	if err := raftNode.Start(); err != nil {
+		raftLog.Errorf("%v; refusing to start (restore a backup or use -recover-from)", err)
+		os.Exit(1)
+	}
+
+	if *batchWindow > 0 {
+		predictBatcher = NewPredictBatcher(*batchWindow, *batchMax)
+	}
+	maxConnections = int64(*maxConns)
+	initTrainSlots(*maxTrainings)
+	if *rateLimit > 0 {
+		rateLimiter = NewRateLimiter(*rateLimit, *rateBurst)
+	}
+	if *predictMaxConcurrent > 0 {
+		predictLimiter = NewPredictLimiter(*predictMaxConcurrent, *predictQueue, *predictQueueTimeout)
+	}
+	if *fastMaxParams > 0 {
+		fastPredictor = NewFastPredictor(*fastMaxParams, *fastCheck)
+	}
+
+	if *filePort > 0 {
+		go startFileServer(*host, *filePort)
+	}
+
+	go chunkRegistry.Run(time.Minute, raftNode.stopCh)
+	if predictionAudit != nil {
+		go predictionAudit.run(raftNode.stopCh)
+	}
 
-func logMsg(format string, args ...interface{}) {
-	logMutex.Lock()
-	defer logMutex.Unlock()
+	if modelBackend == BackendJava {
+		javaPool = NewExecutorPool(*javaWorkers, *javaQueue)
+		javaLog.Infof("TrainingModule runs as: %s %s", javaExecutable(), strings.Join(javaCommandArgs(), " "))
+		if sandbox.enabled() {
+			javaLog.Infof("TrainingModule sandbox: %s", sandbox)
+		}
+	}
+	if *javaBridgeFlag && modelBackend == BackendJava {
+		javaBridge = NewJavaBridge()
+		go javaBridge.Run(raftNode.stopCh)
+	}
 
-	msg := fmt.Sprintf(format, args...)
-	timestamp := time.Now().UTC().Format(time.RFC3339)
-	line := fmt.Sprintf("%s %s\n", timestamp, msg)
+	jobHistoryRetention = *jobRetention
+	atomic.StoreInt64(&maxTrainSamples, *maxTrainSamplesFlag)
+	clientLocks = *clientLocksFlag
+	if pendingModels, err = NewPendingModels(filepath.Join(modelsDir, "pending"), *pendingTTL); err != nil {
+		storageLog.Errorf("pending models: %v", err)
+		os.Exit(1)
+	}
+	go pendingModels.Run(time.Minute, raftNode.stopCh)
+	jobManager = NewJobManager(*jobQueue)
+	jobManager.Run(*jobWorkers, raftNode.stopCh)
 
-	fmt.Print(line)
-	if logFile != nil {
-		logFile.WriteString(line)
+	registerRaftGauges()
+	if *statsdAddr != "" {
+		go NewStatsdExporter(*statsdAddr, *statsdPrefix, *statsdInterval).Run(raftNode.stopCh)
 	}
+
+	if *geoTarget != "" {
+		geoReplicator = NewGeoReplicator(*geoTarget, *geoQueue)
+		go geoReplicator.Run(raftNode.stopCh)
+	}
+
+	workerLog.Infof("Worker started: host=%s, port=%d, raft_port=%d", *host, *port, *raftPort)
+	workerLog.Infof("Storage: %s, Models: %s, RAFT: %s, Scratch: %s, Logs: %s", storageDir, modelsDir, raftDir, scratchDir, logDir)
+	workerLog.Infof("Peers: %v", peers)
+
+	if discovery != nil {
+		go discovery.Run(raftNode.stopCh)
+	}
+
+	go handleSignals(*shutdownTimeout)
+	go watchReloadSignal()
+
+	// The gRPC API dispatches through handleConnection, so it opens with the
+	// TCP server, once everything a request can reach is set up
+	if *grpcPort > 0 {
+		go startGRPCServer(*host, *grpcPort)
+	}
+
+	// Start TCP server (blocking until shutdown)
+	startTCPServer(*host, *port)
+	<-shutdownDone
+
 }
 
 // ============================================================================
@@ -163,58 +517,193 @@ func logMsg(format string, args ...interface{}) {
 
 func startTCPServer(host string, port int) {
 	addr := fmt.Sprintf("%s:%d", host, port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := listen(addr, clientTLS)
 	if err != nil {
 		log.Fatal("TCP listen error:", err)
 	}
 	defer listener.Close()
+	setClientListener(listener)
 
-	logMsg("Starting TCP server on %s", addr)
+	tcpLog.Infof("Starting TCP server on %s", addr)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			logMsg("Accept error: %v", err)
+			if isShuttingDown() {
+				return
+			}
+			tcpLog.Warnf("Accept error: %v", err)
 			continue
 		}
+		if !admitConnection(conn) {
+			continue
+		}
+		atomic.AddInt64(&openConns, 1)
 		go handleConnection(conn)
 	}
 }
 
 func handleConnection(conn net.Conn) {
+	defer atomic.AddInt64(&openConns, -1)
 	defer conn.Close()
 
 	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
-	if err != nil && err != io.EOF {
-		logMsg("Read error: %v", err)
+	line, framed, err := readMessage(reader)
+	if err != nil && (framed || err != io.EOF) {
+		tcpLog.Warnf("Read error: %v", err)
+		return
+	}
+	fullLine := err == nil
+	if framed {
+		conn = &framedConn{Conn: conn}
+	}
+
+	body, authenticated, err := openClientRequest(line)
+	if err != nil {
+		metrics.Inc("auth_failures", 1)
+		tcpLog.Warnf("Rejected request from %s: %v", conn.RemoteAddr(), err)
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_AUTH", "message": "Authentication failed"})
 		return
 	}
 
 	var msg map[string]interface{}
-	if err := json.Unmarshal([]byte(line), &msg); err != nil {
-		logMsg("JSON parse error: %v", err)
+	if err := json.Unmarshal(body, &msg); err != nil {
+		tcpLog.Warnf("JSON parse error: %v", err)
 		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid JSON"})
 		return
 	}
 
+	if !checkProtocol(msg) {
+		tcpLog.Warnf("Rejected request from %s: protocol version %v", conn.RemoteAddr(), msg["proto"])
+		sendResponse(conn, protocolError(msg))
+		return
+	}
+	if v := clientProtocol(msg); v > 0 {
+		conn = &versionedConn{Conn: conn, proto: v}
+	}
+
 	msgType, _ := msg["type"].(string)
+	metricType := strings.ToLower(msgType)
+	start := time.Now()
+	defer func() {
+		metrics.Inc("requests."+metricType, 1)
+		metrics.Since("latency."+metricType, start)
+	}()
+
+	if rejectIfMaintenance(conn, msgType) {
+		return
+	}
+	if checkRateLimit(conn, msgType, msg, authenticated) {
+		return
+	}
+	if len(clusterSecret) > 0 && authenticatedRequests[msgType] && !authenticated {
+		tcpLog.Warnf("Rejected unauthenticated %s from %s", msgType, conn.RemoteAddr())
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_AUTH", "message": msgType + " requires cluster authentication"})
+		return
+	}
+	if !authorizeRequest(conn, msgType, msg, authenticated) {
+		return
+	}
+	ctx, cancel, err := requestContext(msgType, msg, start)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	defer cancel()
+
 	switch msgType {
-	case "TRAIN":
-		handleTrain(conn, msg)
-	case "SUB_TRAIN":
-		handleSubTrain(conn, msg)
+	case "HELLO":
+		handleHello(conn, msg)
+	case "PING":
+		handlePing(conn)
+	case "TRAIN", "SUB_TRAIN":
+		stop := func() {}
+		if fullLine {
+			ctx, stop = watchDisconnect(ctx, conn, reader)
+		}
+		if msgType == "TRAIN" {
+			handleTrain(ctx, conn, msg)
+		} else {
+			handleSubTrain(ctx, conn, msg)
+		}
+		stop()
 	case "PREDICT":
-		handlePredict(conn, msg)
+		handlePredict(ctx, conn, msg)
+	case "PREDICT_BATCH":
+		handlePredictBatch(ctx, conn, msg)
 	case "LIST_MODELS":
-		handleListModels(conn)
+		handleListModels(conn, msg)
+	case "GET_MODEL_INFO":
+		handleGetModelInfo(conn, msg)
+	case "INSPECT_MODEL":
+		handleInspectModel(ctx, conn, msg)
+	case "EXPORT_MODEL":
+		handleExportModel(ctx, conn, msg)
+	case "EVALUATE":
+		handleEvaluate(ctx, conn, msg)
+	case "COMPARE_MODELS":
+		handleCompareModels(ctx, conn, msg)
+	case "FEEDBACK":
+		handleFeedback(conn, msg)
+	case "FEEDBACK_STATS", "EXPORT_FEEDBACK":
+		handleFeedbackQuery(conn, msg)
+	case "AB_REPORT":
+		handleABReport(conn, msg)
+	case "DRIFT_STATUS":
+		handleDriftStatus(conn, msg)
+	case "AUDIT_SAMPLES":
+		handleAuditSamples(conn, msg)
+	case "GEO_REPLICATE":
+		handleGeoReplicate(conn, msg)
+	case "DELETE_MODEL":
+		handleDeleteModel(conn, msg)
+	case "PUBLISH", "DISCARD_PENDING":
+		handlePublish(ctx, conn, msgType, msg)
+	case "SET_PREPROCESS":
+		handleSetPreprocess(ctx, conn, msg)
+	case "QUARANTINE_MODEL":
+		handleQuarantineModel(ctx, conn, msg, true)
+	case "UNQUARANTINE_MODEL":
+		handleQuarantineModel(ctx, conn, msg, false)
+	case "VERIFY_MODELS":
+		handleVerifyModels(conn)
+	case "COMPACT_LOG":
+		handleCompactLog(conn, msg)
+	case "SET_SETTINGS", "GET_SETTINGS":
+		handleSettings(ctx, conn, msg)
+	case "DATASET_PUT":
+		handleDatasetPut(conn, msg)
+	case "CANCEL_TRAIN":
+		handleCancelTrain(ctx, conn, msg)
+	case "AGGREGATE_MODELS":
+		handleAggregateModels(ctx, conn, msg)
+	case "LOCK_ACQUIRE", "LOCK_RENEW", "LOCK_RELEASE", "LOCK_STATUS":
+		handleLock(ctx, conn, msg)
+	case "KV_PUT", "KV_GET", "KV_DELETE":
+		handleKV(ctx, conn, msg)
+	case "JOB_EVENT":
+		handleJobEvent(conn, msg)
+	case "JOB_SUBMIT":
+		handleJobSubmit(ctx, conn, msg)
+	case "JOB_STATUS", "JOB_RESULT":
+		handleJobQuery(ctx, conn, msg)
+	case "ADD_SERVER", "REMOVE_SERVER":
+		handleMembershipChange(ctx, conn, msg)
+	case "FETCH_STATE":
+		handleFetchState(conn)
+	case "FETCH_MODEL":
+		handleFetchModel(conn, msg)
 	default:
+		metricType = "unknown"
 		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Unknown type"})
 	}
 }
 
 
 func sendResponse(conn net.Conn, resp map[string]interface{}) {
+	if vc, ok := conn.(*versionedConn); ok {
+		resp["proto"] = vc.proto
+	}
 	data, _ := json.Marshal(resp)
 	conn.Write(append(data, '\n'))
 }
@@ -223,7 +712,7 @@ func sendResponse(conn net.Conn, resp map[string]interface{}) {
 // Message Handlers
 // ============================================================================
 
-func handleTrain(conn net.Conn, msg map[string]interface{}) {
+func handleTrain(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
 	inputsRaw, _ := msg["inputs"].([]interface{})
 	outputsRaw, _ := msg["outputs"].([]interface{})
 
@@ -231,113 +720,276 @@ func handleTrain(conn net.Conn, msg map[string]interface{}) {
 		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing inputs or outputs"})
 		return
 	}
+	constraints, err := parseConstraints(msg["constraints"])
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid constraints: " + err.Error()})
+		return
+	}
+
+	tcpLog.Infof("TRAIN request: %d samples", len(inputsRaw))
 
-	logMsg("TRAIN request: %d samples", len(inputsRaw))
+	beginTraining()
+	defer endTraining()
 
 	// Check if we are leader
 	if !raftNode.IsLeader() {
-		leader := raftNode.GetLeader()
-		if leader != nil {
-			sendResponse(conn, map[string]interface{}{
-				"status": "REDIRECT",
-				"leader": []interface{}{leader.Host, leader.WorkerPort},
-			})
-			return
-		}
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "No leader available"})
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	if checkTrainQuota(conn, len(inputsRaw)) || checkPlacement(conn, constraints) {
 		return
 	}
+	if err := checkTrainingSpace(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_DISK_FULL", "message": err.Error()})
+		return
+	}
+	release, ok := tryTrainSlot()
+	if !ok {
+		sendResponse(conn, queueFullResponse("too many trainings running", trainRetryAfter))
+		return
+	}
+	defer release()
 
 	// Generate training ID
-	trainID := fmt.Sprintf("%d", time.Now().UnixNano()%100000000)
+	trainID := newTrainID()
+	jobEvents.Record(trainID, JobCreated, map[string]interface{}{"samples": len(inputsRaw)})
+	stopStream := func() {}
+	if stream, _ := msg["stream_progress"].(bool); stream {
+		ctx, stopStream = streamTrainingProgress(ctx, conn, trainID)
+	}
+	ctx, done := runningTrainings.Start(ctx, trainID)
+	defer done()
+
+	resp := trainModel(ctx, trainID, inputsRaw, outputsRaw, constraints, publishOnTrain(msg))
+	stopStream()
+	if resp == nil && errors.Is(context.Cause(ctx), errTrainCancelled) {
+		resp = cancelledResponse(trainID)
+	} else if resp == nil && deadlineExpired(ctx) {
+		resp = timeoutResponse("TRAIN")
+	}
+	if resp != nil {
+		sendResponse(conn, resp)
+	}
+}
+
+func newTrainID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano()%100000000)
+}
+
+// trainModel runs a training job on the nodes matching constraints and
+// returns the response for the client, or nil if ctx was cancelled and the
+// job abandoned. Without publish the model is kept pending (pending.go).
+func trainModel(ctx context.Context, trainID string, inputsRaw, outputsRaw []interface{}, constraints Labels, publish bool) (result map[string]interface{}) {
+	metrics.Inc("train.started", 1)
+	ctx = publishTrainingProgress(ctx, trainID)
+	defer func() {
+		switch status, _ := result["status"].(string); {
+		case result == nil:
+			metrics.Inc("train.abandoned", 1)
+		case status == "OK":
+			metrics.Inc("train.completed", 1)
+		case status == "PARTIAL":
+			metrics.Inc("train.partial", 1)
+		default:
+			metrics.Inc("train.failed", 1)
+		}
+	}()
 
-	// Write CSV files
-	inputsFile := filepath.Join(modelsDir, fmt.Sprintf("inputs_%s.csv", trainID))
-	outputsFile := filepath.Join(modelsDir, fmt.Sprintf("outputs_%s.csv", trainID))
 	modelPath := filepath.Join(modelsDir, fmt.Sprintf("model_%s.bin", trainID))
+	place, err := placeJob(constraints)
+	if err != nil {
+		jobEvents.Record(trainID, JobFailed, map[string]interface{}{"error": err.Error()})
+		return map[string]interface{}{"status": "ERROR", "code": "E_NO_MATCHING_NODE", "message": err.Error()}
+	}
+
+	// Large jobs are split across the cluster (distributed.go); a job the
+	// leader's labels rule out goes whole to a matching peer (labels.go)
+	trainer := distributedTrainer
+	if !place.local && !trainer.Wants(len(inputsRaw), place) {
+		trainer, place = placedTrainer(), place.single()
+	}
+	if trainer.Wants(len(inputsRaw), place) {
+		modelID, loss, report := trainer.Train(ctx, trainID, inputsRaw, outputsRaw, modelPath, place)
+		resp := finishTraining(ctx, trainID, modelID, loss, modelPath, inputsRaw, outputsRaw, publish)
+		if resp != nil {
+			report.annotate(resp)
+		}
+		return resp
+	}
+
+	// Write CSV files
+	inputsFile := filepath.Join(scratchDir, fmt.Sprintf("inputs_%s.csv", trainID))
+	outputsFile := filepath.Join(scratchDir, fmt.Sprintf("outputs_%s.csv", trainID))
 
 	if err := writeCSV(inputsFile, inputsRaw); err != nil {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
-		return
+		return map[string]interface{}{"status": "ERROR", "message": err.Error()}
 	}
 	if err := writeCSV(outputsFile, outputsRaw); err != nil {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
-		return
+		return map[string]interface{}{"status": "ERROR", "message": err.Error()}
 	}
 
-	logMsg("Training data saved: %s, %s", inputsFile, outputsFile)
+	javaLog.Debugf("Training data saved: %s, %s", inputsFile, outputsFile)
 
 	// Run Java training
-	modelID := runJavaTraining(inputsFile, outputsFile, modelPath)
+	modelID, loss := runJavaTraining(ctx, inputsFile, outputsFile, modelPath)
 
 	// Cleanup temp files
 	os.Remove(inputsFile)
 	os.Remove(outputsFile)
 
+	return finishTraining(ctx, trainID, modelID, loss, modelPath, inputsRaw, outputsRaw, publish)
+}
+
+// finishTraining registers and replicates a model trained on the leader, or
+// keeps it pending without publish, and returns the client response, or nil
+// if ctx was cancelled
+func finishTraining(ctx context.Context, trainID, modelID string, loss float64, modelPath string, inputsRaw, outputsRaw []interface{}, publish bool) map[string]interface{} {
+	if ctx.Err() != nil {
+		os.Remove(modelPath)
+		jobEvents.Record(trainID, JobAbandoned, nil)
+		tcpLog.Warnf("Training %s abandoned (%v), cleaned up", trainID, context.Cause(ctx))
+		return nil
+	}
+
 	if modelID != "" {
-		// Replicate via RAFT
-		entry := map[string]interface{}{
-			"action":     "MODEL_TRAINED",
-			"model_id":   modelID,
-			"model_path": modelPath,
+		meta := &ModelMetadata{
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Creator:   raftNode.id,
+			Backend:   modelBackend,
+			Samples:   len(inputsRaw),
+			Epochs:    trainEpochs,
+		}
+		if row, ok := inputsRaw[0].([]interface{}); ok {
+			meta.InputSize = len(row)
+		}
+		if row, ok := outputsRaw[0].([]interface{}); ok {
+			meta.OutputSize = len(row)
+		}
+		if loss >= 0 {
+			meta.TrainingLoss = &loss
+		}
+		if sum, err := fileSHA256(modelPath); err == nil {
+			meta.SHA256 = sum
+		}
+		cmd := &ModelTrainedCommand{ModelID: modelID, ModelPath: modelPath, JobID: trainID, InputStats: computeInputStats(inputsRaw), Metadata: meta}
+		if !publish {
+			return holdPending(cmd)
 		}
-		raftNode.Replicate(entry)
+		return publishModel(cmd)
+	}
+	jobEvents.Record(trainID, JobFailed, map[string]interface{}{"error": "training failed"})
+	return map[string]interface{}{"status": "ERROR", "message": "Training failed"}
+}
 
-		sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": modelID})
-	} else {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Training failed"})
+// publishModel reserves a trained model's id and replicates its
+// MODEL_TRAINED, returning the client response
+func publishModel(cmd *ModelTrainedCommand) map[string]interface{} {
+	if err := reserveName(cmd.ModelID, modelOwner(cmd.ModelPath)); err != nil {
+		os.Remove(cmd.ModelPath)
+		jobEvents.Record(cmd.JobID, JobFailed, map[string]interface{}{"error": err.Error()})
+		resp := map[string]interface{}{"status": "ERROR", "message": "Cannot register model: " + err.Error()}
+		if errors.Is(err, errNameConflict) {
+			resp["code"] = "E_NAME_CONFLICT"
+		}
+		return resp
+	}
+
+	// Replicate via RAFT, the file first; a model that didn't commit isn't
+	// reported
+	if err := replicateModelFile(cmd.ModelPath); err != nil {
+		jobEvents.Record(cmd.JobID, JobFailed, map[string]interface{}{"error": err.Error()})
+		return map[string]interface{}{"status": "ERROR", "code": "E_NOT_COMMITTED", "message": "Cannot replicate model file: " + err.Error(), "job_id": cmd.JobID}
+	}
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		jobEvents.Record(cmd.JobID, JobFailed, map[string]interface{}{"error": err.Error()})
+		return map[string]interface{}{"status": "ERROR", "code": "E_NOT_COMMITTED", "message": "Model not committed: " + err.Error(), "job_id": cmd.JobID}
 	}
+	return map[string]interface{}{"status": "OK", "model_id": cmd.ModelID, "job_id": cmd.JobID, "session": sessionToken(index)}
 }
 
 // handleSubTrain handles distributed training sub-requests from leader
-func handleSubTrain(conn net.Conn, msg map[string]interface{}) {
-	inputsRaw, _ := msg["inputs"].([]interface{})
-	outputsRaw, _ := msg["outputs"].([]interface{})
+func handleSubTrain(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	inputsRaw, outputsRaw, ok := subTrainDataset(conn, msg)
+	if !ok {
+		return
+	}
 	chunkID, _ := msg["chunk_id"].(float64)
+	jobID, _ := msg["job_id"].(string)
 
 	if len(inputsRaw) == 0 || len(outputsRaw) == 0 {
 		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing inputs or outputs"})
 		return
 	}
 
-	logMsg("SUB_TRAIN request: chunk %d, %d samples", int(chunkID), len(inputsRaw))
+	tcpLog.Infof("SUB_TRAIN request: chunk %d, %d samples", int(chunkID), len(inputsRaw))
+
+	release, err := waitTrainSlot(ctx)
+	if err != nil {
+		requestTimedOut(conn, ctx, "SUB_TRAIN")
+		return
+	}
+	defer release()
+	resp := subTrain(ctx, jobID, int(chunkID), inputsRaw, outputsRaw)
+	if resp == nil && deadlineExpired(ctx) {
+		resp = timeoutResponse("SUB_TRAIN")
+	}
+	if resp != nil {
+		sendResponse(conn, resp)
+	}
+}
+
+// subTrain trains one chunk of a distributed job and returns the response
+// for the leader, or nil if ctx was cancelled
+func subTrain(ctx context.Context, jobID string, chunkID int, inputsRaw, outputsRaw []interface{}) map[string]interface{} {
+	if err := checkTrainingSpace(); err != nil {
+		return map[string]interface{}{"status": "ERROR", "code": "E_DISK_FULL", "message": err.Error()}
+	}
 
 	// Generate training ID for this chunk
-	trainID := fmt.Sprintf("%d_chunk%d", time.Now().UnixNano()%100000000, int(chunkID))
+	trainID := fmt.Sprintf("%d_chunk%d", time.Now().UnixNano()%100000000, chunkID)
 
 	// Write CSV files
-	inputsFile := filepath.Join(modelsDir, fmt.Sprintf("inputs_%s.csv", trainID))
-	outputsFile := filepath.Join(modelsDir, fmt.Sprintf("outputs_%s.csv", trainID))
+	inputsFile := filepath.Join(scratchDir, fmt.Sprintf("inputs_%s.csv", trainID))
+	outputsFile := filepath.Join(scratchDir, fmt.Sprintf("outputs_%s.csv", trainID))
 	modelPath := filepath.Join(modelsDir, fmt.Sprintf("model_%s.bin", trainID))
 
 	if err := writeCSV(inputsFile, inputsRaw); err != nil {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
-		return
+		return map[string]interface{}{"status": "ERROR", "message": err.Error()}
 	}
 	if err := writeCSV(outputsFile, outputsRaw); err != nil {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
-		return
+		return map[string]interface{}{"status": "ERROR", "message": err.Error()}
 	}
 
-	logMsg("SUB_TRAIN data saved: %s, %s", inputsFile, outputsFile)
+	javaLog.Debugf("SUB_TRAIN data saved: %s, %s", inputsFile, outputsFile)
 
 	// Run Java training
-	modelID := runJavaTraining(inputsFile, outputsFile, modelPath)
+	modelID, _ := runJavaTraining(ctx, inputsFile, outputsFile, modelPath)
 
 	// Cleanup temp files
 	os.Remove(inputsFile)
 	os.Remove(outputsFile)
 
+	if ctx.Err() != nil {
+		os.Remove(modelPath)
+		jobEvents.Record(jobID, JobAbandoned, map[string]interface{}{"chunk_id": chunkID})
+		tcpLog.Warnf("Training %s abandoned (%v), cleaned up", trainID, context.Cause(ctx))
+		return nil
+	}
+
 	if modelID != "" {
-		logMsg("SUB_TRAIN complete: model_id=%s", modelID)
-		sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": modelID, "model_path": modelPath})
-	} else {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Training failed"})
+		tcpLog.Infof("SUB_TRAIN complete: model_id=%s", modelID)
+		chunkRegistry.Register(jobID, chunkID, modelPath)
+		jobEvents.Record(jobID, JobChunkDone, map[string]interface{}{"chunk_id": chunkID, "model_id": modelID})
+		return map[string]interface{}{"status": "OK", "model_id": modelID, "model_path": modelPath}
 	}
+	jobEvents.Record(jobID, JobFailed, map[string]interface{}{"chunk_id": chunkID, "error": "training failed"})
+	return map[string]interface{}{"status": "ERROR", "message": "Training failed"}
 }
 
 
-func handlePredict(conn net.Conn, msg map[string]interface{}) {
+func handlePredict(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
 	modelID, _ := msg["model_id"].(string)
 	inputRaw, _ := msg["input"].([]interface{})
 
@@ -346,12 +998,44 @@ func handlePredict(conn net.Conn, msg map[string]interface{}) {
 		return
 	}
 
-	logMsg("PREDICT request: model=%s", modelID)
+	tcpLog.Infof("PREDICT request: model=%s", modelID)
+	start := time.Now()
+	requestID, _ := msg["request_id"].(string)
 
-	// Find model file
-	modelPath := findModel(modelID)
+	// Find model file; followers serve committed models only
+	modelPath, ok := findServableModel(ctx, conn, msg, modelID)
+	if !ok {
+		return
+	}
 	if modelPath == "" {
-		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found", "session": currentSession(msg)})
+		return
+	}
+	if !checkModelIntegrity(conn, msg, modelPath) || !checkQuarantine(conn, msg, modelPath) {
+		return
+	}
+	rows := [][]interface{}{inputRaw}
+	if err := preprocessRows(modelPath, rows); err != nil {
+		sendPreprocessError(conn, msg, err)
+		return
+	}
+	inputRaw = rows[0]
+
+	// Small models skip the JVM entirely, so they are not shed while training
+	if fastPredictor != nil {
+		if input, ok := parseNumericInput(inputRaw); ok {
+			if output, ok := fastPredictor.Predict(modelPath, input); ok {
+				requestID = predictionLog.Record(modelIDFromPath(modelPath), requestID, input, output, time.Since(start))
+				inputDrift.Observe(modelIDFromPath(modelPath), input)
+				predictionAudit.Sample(modelIDFromPath(modelPath), requestID, input, output, time.Since(start))
+				predictionFailures.Succeeded(modelPath)
+				sendResponse(conn, map[string]interface{}{"status": "OK", "output": output, "request_id": requestID, "session": currentSession(msg)})
+				return
+			}
+		}
+	}
+
+	if shedPredict(conn, modelPath) {
 		return
 	}
 
@@ -362,83 +1046,219 @@ func handlePredict(conn net.Conn, msg map[string]interface{}) {
 	}
 	inputStr := strings.Join(inputParts, ",")
 
-	// Run Java prediction
-	output := runJavaPrediction(modelPath, inputStr)
-	if output != nil {
-		sendResponse(conn, map[string]interface{}{"status": "OK", "output": output})
+	// Run Java prediction (micro-batched when enabled), at most
+	// -predict-max-concurrent at a time per model, within the deadline
+	var output []float64
+	var err error
+	if predictBatcher != nil {
+		output, err = predictBatcher.Predict(ctx, modelPath, inputStr)
+	} else {
+		output, err = limitedPrediction(modelPath, func() []float64 { return runJavaPrediction(ctx, modelPath, inputStr) })
+	}
+	if requestTimedOut(conn, ctx, "PREDICT") {
+		return
+	}
+	if errors.Is(err, errPredictQueueFull) || errors.Is(err, errPredictQueueTimeout) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": err.Error()})
+	} else if output != nil {
+		input, _ := parseNumericInput(inputRaw)
+		requestID = predictionLog.Record(modelIDFromPath(modelPath), requestID, input, output, time.Since(start))
+		inputDrift.Observe(modelIDFromPath(modelPath), input)
+		predictionAudit.Sample(modelIDFromPath(modelPath), requestID, input, output, time.Since(start))
+		predictionFailures.Succeeded(modelPath)
+		sendResponse(conn, map[string]interface{}{"status": "OK", "output": output, "request_id": requestID, "session": currentSession(msg)})
 	} else {
+		predictionFailures.Failed(modelPath)
 		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Prediction failed"})
 	}
 }
 
-func handleListModels(conn net.Conn) {
-	logMsg("LIST_MODELS request")
+// handleGeoReplicate accepts entries shipped from a primary cluster and
+// commits them through the local RAFT log as STORE_FILE, chunked when the
+// file is large (filechunks.go) or as a reference when the file service is
+// up (filetransfer.go)
+func handleGeoReplicate(conn net.Conn, msg map[string]interface{}) {
+	raw, _ := msg["command"].(map[string]interface{})
+	cmd, err := decodeCommand(raw)
+	if err != nil || cmd.Action() != "STORE_FILE" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Unsupported geo-replicated action"})
+		return
+	}
 
-	var models []string
-	files, _ := filepath.Glob(filepath.Join(modelsDir, "*.bin"))
-	for _, f := range files {
-		name := filepath.Base(f)
-		// Extract model ID from filename
-		if strings.HasPrefix(name, "model_") && strings.HasSuffix(name, ".bin") {
-			id := strings.TrimSuffix(strings.TrimPrefix(name, "model_"), ".bin")
-			models = append(models, id)
+	if !raftNode.IsLeader() {
+		leader := raftNode.GetLeader()
+		if leader != nil {
+			sendResponse(conn, redirectResponse(leader))
+			return
+		}
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "No leader available"})
+		return
+	}
+
+	store := cmd.(*StoreFileCommand)
+	tcpLog.Infof("GEO_REPLICATE request: %s", store.Filename)
+
+	if err := store.Validate(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(store.DataB64)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid data_b64"})
+		return
+	}
+	index, err := replicateFile(store.Filename, data)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	sendResponse(conn, map[string]interface{}{"status": "OK", "session": sessionToken(index)})
+}
+
+// handleDeleteModel removes a model cluster-wide. The leader commits a
+// DELETE_FILE carrying the model id; every node deletes the file and
+// tombstones the id when it applies the entry.
+func handleDeleteModel(conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+
+	if !raftNode.IsLeader() {
+		leader := raftNode.GetLeader()
+		if leader != nil {
+			sendResponse(conn, redirectResponse(leader))
+			return
 		}
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "No leader available"})
+		return
+	}
+
+	modelPath := findModel(modelID)
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+	id := modelStateMachine.ResolveAlias(modelID)
+	if _, ok := modelStateMachine.ModelPath(id); !ok {
+		id = modelIDFromPath(modelPath)
 	}
 
-	sendResponse(conn, map[string]interface{}{"status": "OK", "models": models})
+	tcpLog.Infof("DELETE_MODEL request: %s (%s)", id, filepath.Base(modelPath))
+
+	index, err := replicateCommand(&DeleteFileCommand{Filename: filepath.Base(modelPath), ModelID: id})
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	metrics.Inc("models.deleted", 1)
+	sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": id, "session": sessionToken(index)})
+}
+
+// handlePing reports liveness plus a snapshot of the node's RAFT state
+func handlePing(conn net.Conn) {
+	sendResponse(conn, map[string]interface{}{
+		"status": "OK",
+		"time":   time.Now().UTC().Format(time.RFC3339),
+		"raft":   raftNode.Status(),
+	})
+}
+
+func handleListModels(conn net.Conn, msg map[string]interface{}) {
+	tcpLog.Infof("LIST_MODELS request")
+
+	if !awaitSession(conn, msg) {
+		return
+	}
+
+	var resp map[string]interface{}
+	if paged(msg) {
+		var err error
+		if resp, err = listModelsPage(msg); err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+			return
+		}
+	} else {
+		models, details := listModelIDs(), modelStateMachine.Registry().List()
+		if !listQuarantined(msg) {
+			models, details = dropQuarantinedIDs(models), dropQuarantinedDetails(details)
+		}
+		resp = map[string]interface{}{
+			"status":  "OK",
+			"models":  models,
+			"details": details,
+		}
+	}
+	// Models held for PUBLISH on this node and those left out for their
+	// quarantine, with the first page
+	if _, next := msg["page_token"]; !next {
+		if pending := pendingModels.List(); len(pending) > 0 {
+			resp["pending"] = pending
+		}
+		if quarantined := quarantinedModels(); len(quarantined) > 0 && !listQuarantined(msg) {
+			resp["quarantined"] = quarantined
+		}
+	}
+	resp["session"] = currentSession(msg)
+	sendResponse(conn, resp)
 }
 
 // ============================================================================
 // Java Integration
 // ============================================================================
 
-func runJavaTraining(inputsFile, outputsFile, modelPath string) string {
-	cmd := exec.Command("java", "-cp", javaDir, "TrainingModule",
-		"train", inputsFile, outputsFile, "1000", modelPath)
+// trainEpochs is the number of epochs every training runs
+const trainEpochs = 1000
 
-	logMsg("Running: %s", strings.Join(cmd.Args, " "))
+// runJavaTraining trains a model and returns its id and the error of the last
+// epoch, or -1 if the backend didn't report it
+func runJavaTraining(ctx context.Context, inputsFile, outputsFile, modelPath string) (string, float64) {
+	args := []string{"train", inputsFile, outputsFile, strconv.Itoa(trainEpochs), modelPath}
+	javaLog.Debugf("Running: TrainingModule %s", strings.Join(args, " "))
 
-	output, err := cmd.CombinedOutput()
+	defer metrics.Since("java.train", time.Now())
+	output, err := runJava(ctx, func() { os.Remove(modelPath) }, args...)
 	if err != nil {
-		logMsg("Java training error: %v", err)
-		return ""
+		javaLog.Errorf("Java training error: %v", err)
+		metrics.Inc("java.train_errors", 1)
+		return "", -1
 	}
 
-	// Parse output for MODEL_ID
+	// Parse output for MODEL_ID and the final "Epoch n/m - Error: e" line
 	var modelID string
-	for _, line := range strings.Split(string(output), "\n") {
-		logMsg("JAVA: %s", line)
+	loss := -1.0
+	for _, line := range splitLines(string(output)) {
+		javaLog.Debugf("%s", line)
 		if strings.HasPrefix(line, "MODEL_ID:") {
 			modelID = strings.TrimPrefix(line, "MODEL_ID:")
 		}
+		var epoch, epochs int
+		var e float64
+		if n, _ := fmt.Sscanf(line, "Epoch %d/%d - Error: %g", &epoch, &epochs, &e); n == 3 {
+			loss = e
+		}
 	}
 
-	return modelID
+	return modelID, loss
 }
 
-func runJavaPrediction(modelPath, inputStr string) []float64 {
-	cmd := exec.Command("java", "-cp", javaDir, "TrainingModule",
-		"predict", modelPath, inputStr)
-
-	logMsg("Running: %s", strings.Join(cmd.Args, " "))
+func runJavaPrediction(ctx context.Context, modelPath, inputStr string) []float64 {
+	args := []string{"predict", modelPath, inputStr}
+	javaLog.Debugf("Running: TrainingModule %s", strings.Join(args, " "))
 
-	output, err := cmd.CombinedOutput()
+	defer metrics.Since("java.predict", time.Now())
+	output, err := runJava(ctx, nil, args...)
 	if err != nil {
-		logMsg("Java prediction error: %v", err)
+		javaLog.Errorf("Java prediction error: %v", err)
+		metrics.Inc("java.predict_errors", 1)
 		return nil
 	}
 
 	// Parse output for PREDICTION
-	for _, line := range strings.Split(string(output), "\n") {
+	for _, line := range splitLines(string(output)) {
 		if strings.HasPrefix(line, "PREDICTION:") {
-			predStr := strings.TrimPrefix(line, "PREDICTION:")
-			var result []float64
-			for _, v := range strings.Split(predStr, ",") {
-				var f float64
-				fmt.Sscanf(strings.TrimSpace(v), "%f", &f)
-				result = append(result, f)
-			}
-			return result
+			return parsePrediction(strings.TrimPrefix(line, "PREDICTION:"))
 		}
 	}
 
@@ -446,16 +1266,27 @@ func runJavaPrediction(modelPath, inputStr string) []float64 {
 }
 
 func findModel(modelID string) string {
+	if modelStateMachine != nil {
+		modelID = modelStateMachine.ResolveAlias(modelID)
+		if path, ok := modelStateMachine.ModelPath(modelID); ok {
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+
 	// Try exact match
 	exactPath := filepath.Join(modelsDir, fmt.Sprintf("model_%s.bin", modelID))
-	if _, err := os.Stat(exactPath); err == nil {
+	if _, err := os.Stat(exactPath); err == nil && !deletedModelFile(exactPath) {
 		return exactPath
 	}
 
 	// Try partial match
 	files, _ := filepath.Glob(filepath.Join(modelsDir, fmt.Sprintf("*%s*.bin", modelID)))
-	if len(files) > 0 {
-		return files[0]
+	for _, f := range files {
+		if !deletedModelFile(f) {
+			return f
+		}
 	}
 
 	return ""
@@ -468,6 +1299,12 @@ func writeCSV(path string, data []interface{}) error {
 	}
 	defer f.Close()
 
+	writeCSVRows(f, data)
+	return nil
+}
+
+// writeCSVRows writes one line per row, values separated by commas
+func writeCSVRows(w io.Writer, data []interface{}) {
 	for _, row := range data {
 		switch r := row.(type) {
 		case []interface{}:
@@ -475,12 +1312,11 @@ func writeCSV(path string, data []interface{}) error {
 			for _, v := range r {
 				parts = append(parts, fmt.Sprintf("%v", v))
 			}
-			f.WriteString(strings.Join(parts, ",") + "\n")
+			io.WriteString(w, strings.Join(parts, ",")+"\n")
 		default:
-			f.WriteString(fmt.Sprintf("%v\n", r))
+			io.WriteString(w, fmt.Sprintf("%v\n", r))
 		}
 	}
-	return nil
 }
 
 // ============================================================================
@@ -489,15 +1325,43 @@ func writeCSV(path string, data []interface{}) error {
 
 func startHTTPMonitor(host string, port int) {
 	addr := fmt.Sprintf("%s:%d", host, port)
-	logMsg("Starting HTTP monitor on %s", addr)
+	monitorLog.Infof("Starting HTTP monitor on %s", addr)
 
 	http.HandleFunc("/", handleDashboard)
 	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/metrics", handlePrometheus)
 	http.HandleFunc("/models", handleModelsAPI)
 	http.HandleFunc("/logs", handleLogs)
-
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		logMsg("HTTP server error: %v", err)
+	http.HandleFunc("/admin/maintenance", handleMaintenanceAPI)
+	http.HandleFunc("/admin/log-level", handleLogLevelAPI)
+	http.HandleFunc("/admin/support-bundle", handleSupportBundleAPI)
+	http.HandleFunc("/admin/verify-models", handleVerifyModelsAPI)
+	http.HandleFunc("/admin/settings", refuseInMaintenance(handleSettingsAPI))
+	http.HandleFunc("/admin/compact-log", refuseInMaintenance(handleCompactLogAPI))
+	http.HandleFunc("/admin/config", refuseInMaintenance(handleConfigAPI))
+	http.HandleFunc("/api/training/rounds", handleRoundsAPI)
+	http.HandleFunc("/api/jobs/", handleJobEventsAPI)
+	http.HandleFunc("/api/models/export", handleExportAPI)
+	http.HandleFunc("/api/ab/report", handleABReportAPI)
+	http.HandleFunc("/api/feedback/", handleFeedbackAPI)
+	http.HandleFunc("/api/drift/", handleDriftAPI)
+	http.HandleFunc("/api/audit/", handleAuditAPI)
+	http.HandleFunc("/ws", handleLiveUpdates)
+	http.HandleFunc("/cluster", handleClusterPage)
+	http.HandleFunc("/cluster/status", handleClusterStatusAPI)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	go liveUpdates.watchRaft(100*time.Millisecond, raftNode.stopCh)
+
+	if clientTLS != nil {
+		server := &http.Server{Addr: addr, Handler: requireMonitorToken(http.DefaultServeMux), TLSConfig: clientTLS}
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			monitorLog.Errorf("HTTPS server error: %v", err)
+		}
+		return
+	}
+	if err := http.ListenAndServe(addr, requireMonitorToken(http.DefaultServeMux)); err != nil {
+		monitorLog.Errorf("HTTP server error: %v", err)
 	}
 }
 
@@ -525,6 +1389,7 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 </head>
 <body>
     <h1>🖥️ Worker Monitor <span class="go-badge">Go</span></h1>
+    <div><a id="cluster" href="/cluster" style="color: #00ADD8">Cluster view</a></div>
     <div class="card">
         <div class="label">RAFT Status</div>
         <div id="status">Loading...</div>
@@ -534,34 +1399,88 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
         <div id="models">Loading...</div>
     </div>
     <div class="card">
-        <div class="label">Recent Logs</div>
+        <div class="label">Trainings</div>
+        <div id="jobs"><em>None since this page opened</em></div>
+    </div>
+    <div class="card">
+        <div class="label">Recent Logs <span id="live"></span></div>
         <pre id="logs">Loading...</pre>
     </div>
     <script>
         async function refresh() {
             try {
-                const status = await fetch('/status').then(r => r.json());
+                const status = await fetch('/status' + location.search).then(r => r.json());
                 document.getElementById('status').innerHTML = 
                     '<span class="' + status.state + '">' + status.state.toUpperCase() + '</span> | ' +
                     'Term: ' + status.term + ' | Leader: ' + JSON.stringify(status.leader) +
-                    ' | Log: ' + status.log_length + ' entries';
+                    ' | Log: ' + status.log_length + ' entries' +
+                    ' | Commit: ' + status.commit_index + ' | Applied: ' + status.last_applied +
+                    (status.peers || []).map(p =>
+                        '<div>' + (p.reachable ? '🟢 ' : '🔴 ') + p.address +
+                        (p.match_index !== undefined ? ' (match ' + p.match_index + ', lag ' + p.lag + ')' : '') +
+                        (p.paused ? ' ⏸ paused' : '') +
+                        (p.inflight_entries ? ' inflight ' + p.inflight_entries : '') + '</div>').join('');
             } catch(e) { document.getElementById('status').textContent = 'Error'; }
 
             try {
-                const models = await fetch('/models').then(r => r.json());
+                const models = await fetch('/models' + location.search).then(r => r.json());
                 document.getElementById('models').innerHTML = models.models && models.models.length 
                     ? models.models.map(m => '<div>📦 ' + m + '</div>').join('')
                     : '<em>No models yet</em>';
             } catch(e) { document.getElementById('models').textContent = 'Error'; }
 
             try {
-                const logs = await fetch('/logs').then(r => r.text());
-                const lines = logs.split('\n').slice(-50).join('\n');
-                document.getElementById('logs').textContent = lines || 'No logs';
+                const logs = await fetch('/logs' + location.search).then(r => r.text());
+                logLines = logs.split('\n').filter(l => l).slice(-50);
+                document.getElementById('logs').textContent = logLines.join('\n') || 'No logs';
             } catch(e) { document.getElementById('logs').textContent = 'Error'; }
         }
+
+        document.getElementById('cluster').href = '/cluster' + location.search;
+
+        // Live updates over /ws; polling every 3s while it is down
+        let logLines = [], jobs = {}, poll = null, statusTimer = null;
+        function refreshStatusSoon() {
+            // Coalesce bursts of events into one /status fetch
+            if (statusTimer) return;
+            statusTimer = setTimeout(() => { statusTimer = null; refresh(); }, 300);
+        }
+        function showJobs() {
+            document.getElementById('jobs').innerHTML = Object.entries(jobs).slice(-10).reverse().map(([id, j]) =>
+                '<div>⚙️ ' + id + ' ' + j.state + (j.epochs ? ' (epoch ' + j.epoch + '/' + j.epochs + ', loss ' + j.loss.toFixed(6) + ')' : '') + '</div>').join('');
+        }
+        function connect() {
+            const ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws' + location.search);
+            ws.onopen = () => {
+                clearInterval(poll); poll = null;
+                document.getElementById('live').textContent = '● live';
+                refresh();
+            };
+            ws.onmessage = e => {
+                const ev = JSON.parse(e.data);
+                if (ev.type === 'log') {
+                    logLines.push(ev.line);
+                    logLines = logLines.slice(-50);
+                    document.getElementById('logs').textContent = logLines.join('\n');
+                } else if (ev.type === 'progress') {
+                    jobs[ev.job_id] = Object.assign(jobs[ev.job_id] || {}, {state: 'running', epoch: ev.epoch, epochs: ev.epochs, loss: ev.loss});
+                    showJobs();
+                } else if (ev.type === 'job') {
+                    jobs[ev.job_id] = Object.assign(jobs[ev.job_id] || {}, {state: ev.event});
+                    showJobs();
+                } else {
+                    refreshStatusSoon();
+                }
+            };
+            ws.onclose = () => {
+                document.getElementById('live').textContent = '';
+                if (!poll) poll = setInterval(refresh, 3000);
+                setTimeout(connect, 5000);
+            };
+        }
         refresh();
-        setInterval(refresh, 3000);
+        poll = setInterval(refresh, 3000);
+        if (window.WebSocket) connect();
     </script>
 </body>
 </html>`
@@ -571,28 +1490,73 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statusReport())
+}
+
+// statusReport is the node state served at /status
+func statusReport() map[string]interface{} {
+	st := raftNode.Status()
 	status := map[string]interface{}{
-		"state":      raftNode.state,
-		"term":       raftNode.currentTerm,
-		"leader":     raftNode.leader,
-		"log_length": len(raftNode.log),
+		"id":             st.ID,
+		"node_uuid":      st.UUID,
+		"labels":         st.Labels,
+		"state":          st.Role,
+		"term":           st.Term,
+		"leader":         st.Leader,
+		"log_length":     st.LogLength,
+		"snapshot_index": st.SnapshotIdx,
+		"commit_index":   st.CommitIndex,
+		"last_applied":   st.LastApplied,
+		"peers":          st.Peers,
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	status["election_timeout_ms"] = st.ElectionMs
+	if st.Config != nil {
+		status["config"] = st.Config
+	}
+	if geoReplicator != nil {
+		status["geo_replication"] = geoReplicator.Status()
+	}
+	status["storage"] = storageStatus()
+	status["protocol"] = protocolStatus()
+	status["maintenance"] = maintenanceStatus()
+	if report := getReadinessReport(); report != nil {
+		status["readiness"] = report
+	}
+	if recoveryProgress != nil {
+		status["recovery"] = recoveryProgress.Status()
+	}
+	if report := integrityStatus(); report != nil {
+		status["model_integrity"] = report
+	}
+	status["backend"] = modelBackend
+	status["dataset_store"] = datasetStore.Name()
+	if javaBridge != nil {
+		status["java_bridge"] = javaBridge.Status()
+	}
+	if javaPool != nil {
+		status["java_pool"] = javaPool.Status()
+	}
+	if pendingModels != nil {
+		status["pending_models"] = len(pendingModels.List())
+	}
+	return status
 }
 
 func handleModelsAPI(w http.ResponseWriter, r *http.Request) {
 	var models []string
 	files, _ := filepath.Glob(filepath.Join(modelsDir, "*.bin"))
 	for _, f := range files {
-		models = append(models, filepath.Base(f))
+		if !deletedModelFile(f) {
+			models = append(models, filepath.Base(f))
+		}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
 }
 
 func handleLogs(w http.ResponseWriter, r *http.Request) {
-	logPath := filepath.Join(storageDir, "worker.log")
+	logPath := filepath.Join(logDir, "worker.log")
 	data, err := os.ReadFile(logPath)
 	if err != nil {
 		w.Write([]byte("No logs yet"))
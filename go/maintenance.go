@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Maintenance mode
+// ============================================================================
+
+// maintenance holds the node's read-only switch. While enabled the node keeps
+// participating in RAFT and serving PREDICT/LIST_MODELS, but rejects TRAIN and
+// any other request that would mutate replicated state: on the client port
+// the types flagged mutating in requestTypes (acl.go), unlisted ones
+// included, and on the monitor the admin endpoints that change state.
+var maintenance struct {
+	sync.RWMutex
+	enabled bool
+	reason  string
+	since   time.Time
+}
+
+func setMaintenance(enabled bool, reason string) {
+	maintenance.Lock()
+	changed := maintenance.enabled != enabled
+	maintenance.enabled = enabled
+	maintenance.reason = reason
+	if changed {
+		maintenance.since = time.Now()
+	}
+	maintenance.Unlock()
+
+	if changed {
+		if enabled {
+			maintenanceLog.Infof("enabled (%s)", reason)
+		} else {
+			maintenanceLog.Infof("disabled")
+		}
+	}
+}
+
+func inMaintenance() bool {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.enabled
+}
+
+// rejectIfMaintenance answers E_MAINTENANCE for mutating requests and reports
+// whether the request was rejected
+func rejectIfMaintenance(conn net.Conn, msgType string) bool {
+	if !requestInfo(msgType).mutating || !inMaintenance() {
+		return false
+	}
+	sendResponse(conn, map[string]interface{}{
+		"status":  "ERROR",
+		"code":    "E_MAINTENANCE",
+		"message": "Node is in maintenance mode (read-only)",
+	})
+	return true
+}
+
+// refuseInMaintenance wraps a monitor handler so that, in maintenance
+// mode, anything but a GET answers 503 with E_MAINTENANCE
+func refuseInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && inMaintenance() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "ERROR",
+				"code":    "E_MAINTENANCE",
+				"message": "Node is in maintenance mode (read-only)",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func maintenanceStatus() map[string]interface{} {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+
+	status := map[string]interface{}{"enabled": maintenance.enabled}
+	if maintenance.enabled {
+		status["reason"] = maintenance.reason
+		status["since"] = maintenance.since.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// handleMaintenanceAPI toggles maintenance mode:
+// GET shows the state, POST ?enabled=true|false&reason=... changes it
+func handleMaintenanceAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.URL.Query().Get("enabled") {
+		case "true", "1":
+			setMaintenance(true, r.URL.Query().Get("reason"))
+		case "false", "0":
+			setMaintenance(false, "")
+		default:
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceStatus())
+}
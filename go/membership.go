@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ============================================================================
+// Dynamic membership (joint consensus)
+// ============================================================================
+
+// clusterConfig is a cluster configuration carried by a MEMBERSHIP entry.
+// While Old is set the configuration is joint: commits and elections need a
+// majority of Old and a majority of New.
+type clusterConfig struct {
+	Old []Peer `json:"old,omitempty"`
+	New []Peer `json:"new"`
+}
+
+// Joint reports whether the configuration is a transition C_old,new
+func (c *clusterConfig) Joint() bool {
+	return c != nil && len(c.Old) > 0
+}
+
+// membershipTimeout bounds how long a configuration entry may take to commit,
+// including the time a new server needs to catch up
+const membershipTimeout = 2 * time.Minute
+
+var errNotLeader = errors.New("not the leader")
+
+// configFromCommand extracts the configuration from a MEMBERSHIP entry
+func configFromCommand(command map[string]interface{}) (*clusterConfig, bool) {
+	if action, _ := command["action"].(string); action != "MEMBERSHIP" {
+		return nil, false
+	}
+	cmd, err := decodeCommand(command)
+	if err != nil {
+		return nil, false
+	}
+	m := cmd.(*MembershipCommand)
+	if len(m.New) == 0 {
+		return nil, false
+	}
+	return &clusterConfig{Old: m.Old, New: m.New}, true
+}
+
+// configAtLocked returns the latest configuration in the log at or before
+// index and the index it was appended at. A server uses a configuration as
+// soon as it is in its log, committed or not. Callers hold rn.mu.
+func (rn *RaftNode) configAtLocked(index int) (*clusterConfig, int) {
+	for i := min(index, rn.lastLogIndex()); i > rn.snapshotIndex; i-- {
+		if cfg, ok := configFromCommand(rn.log[i-rn.snapshotIndex-1].Command); ok {
+			return cfg, i
+		}
+	}
+	if rn.snapshotConfig != nil {
+		return rn.snapshotConfig, rn.snapshotIndex
+	}
+	return nil, -1
+}
+
+// refreshConfigLocked recomputes the configuration after the log changed and
+// derives the peers to replicate to: every member of Old and New except this
+// node. Without any configuration entry the -peers list applies. Callers
+// hold rn.mu.
+func (rn *RaftNode) refreshConfigLocked() {
+	prev := rn.config
+	rn.config, rn.configIndex = rn.configAtLocked(rn.lastLogIndex())
+	if rn.config == nil {
+		if prev != nil {
+			rn.peers = rn.staticPeers
+		}
+		return
+	}
+
+	var peers []Peer
+	seen := make(map[string]bool)
+	for _, p := range append(append([]Peer{}, rn.config.Old...), rn.config.New...) {
+		key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+		if rn.isSelf(p) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		peers = append(peers, p)
+		addressBook.Add(p)
+		if rn.state == "leader" {
+			if _, ok := rn.nextIndex[key]; !ok {
+				rn.nextIndex[key] = rn.lastLogIndex() + 1
+				rn.matchIndex[key] = -1
+			}
+		}
+	}
+	rn.peers = peers
+}
+
+// isSelf reports whether a member entry names this node. A node bound to an
+// unspecified address can't match by host and matches on its ports instead.
+func (rn *RaftNode) isSelf(p Peer) bool {
+	if p.Port != rn.port {
+		return false
+	}
+	if p.Host == rn.host {
+		return true
+	}
+	ip := net.ParseIP(rn.host)
+	return ip != nil && ip.IsUnspecified() && p.WorkerPort == rn.workerPort
+}
+
+// isVoterLocked reports whether this node belongs to the configuration and
+// may stand for election. Callers hold rn.mu.
+func (rn *RaftNode) isVoterLocked() bool {
+	if rn.config == nil {
+		return !rn.joining
+	}
+	for _, p := range append(append([]Peer{}, rn.config.Old...), rn.config.New...) {
+		if rn.isSelf(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// quorumLocked reports whether the nodes for which acked returns true form a
+// majority of the configuration, or of both configurations while joint. This
+// node always counts as acked. Callers hold rn.mu.
+func (rn *RaftNode) quorumLocked(acked func(key string) bool) bool {
+	majority := func(members []Peer, self bool) bool {
+		count, total := 0, len(members)
+		if self {
+			count, total = 1, total+1
+		}
+		for _, p := range members {
+			if rn.isSelf(p) {
+				count++
+			} else if acked(fmt.Sprintf("%s:%d", p.Host, p.Port)) {
+				count++
+			}
+		}
+		return count >= total/2+1
+	}
+
+	if rn.config == nil {
+		return majority(rn.peers, true)
+	}
+	if !majority(rn.config.New, false) {
+		return false
+	}
+	return !rn.config.Joint() || majority(rn.config.Old, false)
+}
+
+// membersLocked returns the voting members of the current configuration.
+// This node is included only when it has a routable address. Callers hold
+// rn.mu.
+func (rn *RaftNode) membersLocked() []Peer {
+	if rn.config != nil {
+		return append([]Peer{}, rn.config.New...)
+	}
+	members := make([]Peer, 0, len(rn.peers)+1)
+	if ip := net.ParseIP(rn.host); ip == nil || !ip.IsUnspecified() {
+		members = append(members, Peer{Host: rn.host, Port: rn.port, WorkerPort: rn.workerPort})
+	}
+	return append(members, rn.peers...)
+}
+
+// SetJoining keeps a node that is being added to a running cluster from
+// standing for election until a configuration that includes it reaches its
+// log
+func (rn *RaftNode) SetJoining(joining bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.joining = joining
+}
+
+// ChangeMembership adds or removes one server using joint consensus: the
+// leader commits C_old,new and then C_new. Only one change runs at a time; a
+// joint configuration left behind by a previous leader is completed first.
+func (rn *RaftNode) ChangeMembership(p Peer, add bool) error {
+	rn.configMu.Lock()
+	defer rn.configMu.Unlock()
+
+	rn.mu.RLock()
+	leader := rn.state == "leader"
+	ip := net.ParseIP(rn.host)
+	cfg, cfgIndex := rn.config, rn.configIndex
+	pending := cfgIndex > rn.commitIndex
+	ownTerm := rn.termAt(cfgIndex) == rn.currentTerm
+	rn.mu.RUnlock()
+
+	if !leader {
+		return errNotLeader
+	}
+	if ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("membership changes need a routable -host, not %s", rn.host)
+	}
+	switch {
+	case cfg == nil || !pending:
+	case ownTerm:
+		if !rn.waitCommitted(cfgIndex, membershipTimeout) {
+			return fmt.Errorf("previous configuration change at index %d is not committed", cfgIndex)
+		}
+	default:
+		// Left uncommitted by an earlier leader; entries of older terms only
+		// commit behind one of ours, so propose the same configuration again
+		if err := rn.commitConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Joint() {
+		raftLog.Infof("completing pending joint configuration")
+		if err := rn.commitConfig(&clusterConfig{New: cfg.New}); err != nil {
+			return err
+		}
+	}
+
+	rn.mu.RLock()
+	members := rn.membersLocked()
+	rn.mu.RUnlock()
+
+	var next []Peer
+	found := false
+	for _, m := range members {
+		if m.Host == p.Host && m.Port == p.Port {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		next = append(next, m)
+	}
+	switch {
+	case add && found:
+		return fmt.Errorf("%s:%d is already a member", p.Host, p.Port)
+	case !add && !found:
+		return fmt.Errorf("%s:%d is not a member", p.Host, p.Port)
+	case add:
+		if err := rn.checkNewMember(p); err != nil {
+			return err
+		}
+		next = append(next, p)
+	case len(next) == 0:
+		return fmt.Errorf("cannot remove the last member")
+	}
+
+	op := "remove"
+	if add {
+		op = "add"
+	}
+	raftLog.Infof("membership change: %s %s:%d (%d -> %d members)", op, p.Host, p.Port, len(members), len(next))
+	if err := rn.commitConfig(&clusterConfig{Old: members, New: next}); err != nil {
+		return err
+	}
+	return rn.commitConfig(&clusterConfig{New: next})
+}
+
+// commitConfig appends a configuration entry and waits for it to commit
+func (rn *RaftNode) commitConfig(cfg *clusterConfig) error {
+	index, ok := rn.ReplicateIndex(encodeCommand(&MembershipCommand{Old: cfg.Old, New: cfg.New}))
+	if index < 0 {
+		return errNotLeader
+	}
+	if !ok && !rn.waitCommitted(index, membershipTimeout) {
+		return fmt.Errorf("configuration at index %d not committed within %v", index, membershipTimeout)
+	}
+	metrics.Inc("raft.config_changes", 1)
+	return nil
+}
+
+// waitCommitted waits until index is committed while this node stays leader
+// of the current term
+func (rn *RaftNode) waitCommitted(index int, timeout time.Duration) bool {
+	rn.mu.RLock()
+	term := rn.currentTerm
+	rn.mu.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		rn.mu.RLock()
+		committed := rn.commitIndex >= index
+		lost := rn.state != "leader" || rn.currentTerm != term
+		rn.mu.RUnlock()
+		if committed {
+			return true
+		}
+		if lost || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stepDownIfRemovedLocked makes a leader that is not part of a committed
+// C_new give up leadership. Callers hold rn.mu.
+func (rn *RaftNode) stepDownIfRemovedLocked() {
+	if rn.state != "leader" || rn.config == nil || rn.config.Joint() ||
+		rn.configIndex > rn.commitIndex || rn.isVoterLocked() {
+		return
+	}
+	raftLog.Infof("removed from the cluster configuration, stepping down")
+	rn.state = "follower"
+	rn.leader = nil
+	rn.resetElectionTimeout()
+}
+
+// handleMembershipChange serves ADD_SERVER and REMOVE_SERVER. port is the
+// server's client port; without raft_port the address book supplies it.
+func handleMembershipChange(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	msgType, _ := msg["type"].(string)
+	host, _ := msg["host"].(string)
+	port := int(numberOr(msg["port"], 0))
+	raftPort := int(numberOr(msg["raft_port"], 0))
+	if host == "" || port <= 0 || raftPort < 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing host or port"})
+		return
+	}
+	peer := Peer{Host: host, Port: raftPort, WorkerPort: port}
+	if raftPort == 0 {
+		var derived bool
+		if peer, derived = addressBook.Resolve(host, port); derived {
+			tcpLog.Warnf("%s %s:%d: not in the address book, assuming raft port %d", msgType, host, port, peer.Port)
+		}
+	}
+
+	tcpLog.Infof("%s request: %s:%d (raft %d)", msgType, host, port, peer.Port)
+	if err := raftNode.ChangeMembership(peer, msgType == "ADD_SERVER"); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_MEMBERSHIP", "message": err.Error()})
+		return
+	}
+	sendResponse(conn, map[string]interface{}{"status": "OK", "members": raftNode.Members()})
+}
+
+// Members returns the voting members of the current configuration
+func (rn *RaftNode) Members() []Peer {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return rn.membersLocked()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQuorumJointConsensus(t *testing.T) {
+	self := Peer{Host: "127.0.0.1", Port: 1}
+	a, b := Peer{Host: "10.0.0.1", Port: 5000}, Peer{Host: "10.0.0.2", Port: 5000}
+	c, d := Peer{Host: "10.0.0.3", Port: 5000}, Peer{Host: "10.0.0.4", Port: 5000}
+	tests := []struct {
+		name   string
+		peers  []Peer
+		config *clusterConfig
+		acked  []Peer
+		want   bool
+	}{
+		{name: "static peers, no acks", peers: []Peer{a, b}, want: false},
+		{name: "static peers, self and one", peers: []Peer{a, b}, acked: []Peer{a}, want: true},
+		{name: "config without self needs a majority of it", config: &clusterConfig{New: []Peer{a, b, c}}, acked: []Peer{a}, want: false},
+		{name: "config without self, two of three", config: &clusterConfig{New: []Peer{a, b, c}}, acked: []Peer{a, c}, want: true},
+		{name: "config counts self once", config: &clusterConfig{New: []Peer{self, a, b}}, acked: []Peer{b}, want: true},
+		{name: "joint needs old majority", config: &clusterConfig{Old: []Peer{self, a, b}, New: []Peer{self, c, d}}, acked: []Peer{c}, want: false},
+		{name: "joint needs new majority", config: &clusterConfig{Old: []Peer{self, a, b}, New: []Peer{self, c, d}}, acked: []Peer{a}, want: false},
+		{name: "joint with both majorities", config: &clusterConfig{Old: []Peer{self, a, b}, New: []Peer{self, c, d}}, acked: []Peer{a, d}, want: true},
+		{name: "joint, self leaving", config: &clusterConfig{Old: []Peer{self, a}, New: []Peer{a, b}}, acked: []Peer{a}, want: false},
+		{name: "joint, self leaving, both acked", config: &clusterConfig{Old: []Peer{self, a}, New: []Peer{a, b}}, acked: []Peer{a, b}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := NewRaftNode("127.0.0.1:1", "127.0.0.1", 1, tt.peers, 1)
+			rn.config = tt.config
+			acked := make(map[string]bool)
+			for _, p := range tt.acked {
+				acked[fmt.Sprintf("%s:%d", p.Host, p.Port)] = true
+			}
+			if got := rn.quorumLocked(func(key string) bool { return acked[key] }); got != tt.want {
+				t.Errorf("quorumLocked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovedLeaderStepsDown(t *testing.T) {
+	self := Peer{Host: "127.0.0.1", Port: 1}
+	a, b := Peer{Host: "10.0.0.1", Port: 5000}, Peer{Host: "10.0.0.2", Port: 5000}
+	tests := []struct {
+		name        string
+		config      *clusterConfig
+		configIndex int
+		commitIndex int
+		leads       bool
+	}{
+		{name: "committed config without self", config: &clusterConfig{New: []Peer{a, b}}, configIndex: 3, commitIndex: 3, leads: false},
+		{name: "config not yet committed", config: &clusterConfig{New: []Peer{a, b}}, configIndex: 4, commitIndex: 3, leads: true},
+		{name: "joint config", config: &clusterConfig{Old: []Peer{self, a}, New: []Peer{a, b}}, configIndex: 3, commitIndex: 3, leads: true},
+		{name: "still a member", config: &clusterConfig{New: []Peer{self, a}}, configIndex: 3, commitIndex: 3, leads: true},
+		{name: "static peers", configIndex: -1, commitIndex: 3, leads: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := NewRaftNode("127.0.0.1:1", "127.0.0.1", 1, []Peer{a}, 1)
+			rn.state = "leader"
+			rn.config = tt.config
+			rn.configIndex = tt.configIndex
+			rn.commitIndex = tt.commitIndex
+			rn.stepDownIfRemovedLocked()
+			if leads := rn.state == "leader"; leads != tt.leads {
+				t.Errorf("still leader = %v, want %v", leads, tt.leads)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Metrics registry
+// ============================================================================
+
+// Metrics collects counters, gauges and timers for exporters. Counters and
+// timer samples are accumulated between flushes (statsd.go); totals and
+// histograms are cumulative since start (prometheus.go); gauges are sampled
+// when read.
+type Metrics struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	timers     map[string][]time.Duration
+	gauges     map[string]func() float64
+	totals     map[string]int64
+	histograms map[string]*histogram
+	keepTimers bool // a flushing exporter drains the timer samples
+}
+
+var metrics = &Metrics{
+	counters:   make(map[string]int64),
+	timers:     make(map[string][]time.Duration),
+	gauges:     make(map[string]func() float64),
+	totals:     make(map[string]int64),
+	histograms: make(map[string]*histogram),
+}
+
+// histogramBuckets are the upper bounds, in seconds, of timer histograms
+var histogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram counts timer samples per bucket; counts[i] holds samples up to
+// histogramBuckets[i], the last slot those above every bound
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(histogramBuckets, seconds)
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+// Inc adds delta to a counter
+func (m *Metrics) Inc(name string, delta int64) {
+	m.mu.Lock()
+	m.counters[name] += delta
+	m.totals[name] += delta
+	m.mu.Unlock()
+}
+
+// Time records a duration sample
+func (m *Metrics) Time(name string, d time.Duration) {
+	m.mu.Lock()
+	if m.keepTimers {
+		m.timers[name] = append(m.timers[name], d)
+	}
+	h, ok := m.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(histogramBuckets)+1)}
+		m.histograms[name] = h
+	}
+	h.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// KeepTimers makes the registry buffer timer samples for Drain. Without a
+// flushing exporter only the histograms are kept.
+func (m *Metrics) KeepTimers() {
+	m.mu.Lock()
+	m.keepTimers = true
+	m.mu.Unlock()
+}
+
+// Since records the time elapsed since start; use as `defer metrics.Since(...)`
+func (m *Metrics) Since(name string, start time.Time) {
+	m.Time(name, time.Since(start))
+}
+
+// Gauge registers a function sampled at each flush
+func (m *Metrics) Gauge(name string, fn func() float64) {
+	m.mu.Lock()
+	m.gauges[name] = fn
+	m.mu.Unlock()
+}
+
+// MetricsSnapshot is the data drained from the registry by one flush
+type MetricsSnapshot struct {
+	Counters map[string]int64
+	Timers   map[string][]time.Duration
+	Gauges   map[string]float64
+}
+
+// Drain returns accumulated counters and timers, resetting them, plus the
+// current gauge values
+func (m *Metrics) Drain() MetricsSnapshot {
+	m.mu.Lock()
+	snap := MetricsSnapshot{
+		Counters: m.counters,
+		Timers:   m.timers,
+		Gauges:   make(map[string]float64, len(m.gauges)),
+	}
+	m.counters = make(map[string]int64)
+	m.timers = make(map[string][]time.Duration)
+	gauges := make(map[string]func() float64, len(m.gauges))
+	for k, fn := range m.gauges {
+		gauges[k] = fn
+	}
+	m.mu.Unlock()
+
+	for k, fn := range gauges {
+		snap.Gauges[k] = fn()
+	}
+	return snap
+}
+
+// cumulative is the registry state since start, for pull exporters
+type cumulative struct {
+	Totals     map[string]int64
+	Histograms map[string]histogram
+	Gauges     map[string]float64
+}
+
+// Cumulative returns copies of the totals and histograms plus the current
+// gauge values, leaving the flush buffers alone
+func (m *Metrics) Cumulative() cumulative {
+	m.mu.Lock()
+	snap := cumulative{
+		Totals:     make(map[string]int64, len(m.totals)),
+		Histograms: make(map[string]histogram, len(m.histograms)),
+		Gauges:     make(map[string]float64, len(m.gauges)),
+	}
+	for k, v := range m.totals {
+		snap.Totals[k] = v
+	}
+	for k, h := range m.histograms {
+		snap.Histograms[k] = histogram{counts: append([]int64(nil), h.counts...), count: h.count, sum: h.sum}
+	}
+	gauges := make(map[string]func() float64, len(m.gauges))
+	for k, fn := range m.gauges {
+		gauges[k] = fn
+	}
+	m.mu.Unlock()
+
+	for k, fn := range gauges {
+		snap.Gauges[k] = fn()
+	}
+	return snap
+}
+
+// sortedKeys returns map keys in a stable order for exporters
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// registerRaftGauges exposes consensus state to exporters
+func registerRaftGauges() {
+	metrics.Gauge("raft.term", func() float64 {
+		return float64(raftNode.Status().Term)
+	})
+	metrics.Gauge("raft.log_length", func() float64 {
+		return float64(raftNode.Status().LogLength)
+	})
+	metrics.Gauge("raft.commit_index", func() float64 {
+		return float64(raftNode.Status().CommitIndex)
+	})
+	metrics.Gauge("raft.election_timeout_ms", func() float64 {
+		return float64(raftNode.ElectionTimeout().Milliseconds())
+	})
+	metrics.Gauge("raft.is_leader", func() float64 {
+		if raftNode.IsLeader() {
+			return 1
+		}
+		return 0
+	})
+	metrics.Gauge("raft.max_peer_lag", func() float64 {
+		maxLag := 0
+		for _, p := range raftNode.Status().Peers {
+			if p.Lag != nil && *p.Lag > maxLag {
+				maxLag = *p.Lag
+			}
+		}
+		return float64(maxLag)
+	})
+	metrics.Gauge("predict.waiting", func() float64 {
+		if predictLimiter == nil {
+			return 0
+		}
+		return float64(predictLimiter.Waiting())
+	})
+	metrics.Gauge("java.queued", func() float64 {
+		if javaPool == nil {
+			return 0
+		}
+		return float64(javaPool.Queued())
+	})
+	metrics.Gauge("train.active", func() float64 {
+		return float64(atomic.LoadInt64(&activeTrainings))
+	})
+	metrics.Gauge("drift.models_drifting", func() float64 {
+		return float64(inputDrift.Drifting())
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// Cluster-wide model namespace
+// ============================================================================
+
+// Model ids and aliases share one namespace. A name is claimed by committing
+// RESERVE_NAME through RAFT; because every node applies reservations in log
+// order, the first one committed wins even when two leaders from different
+// terms picked the same name.
+
+// Namespace owners. A model owns its id through its path, so re-applying the
+// same MODEL_TRAINED is not a conflict; aliases may be repointed freely.
+const ownerAlias = "alias"
+
+func modelOwner(modelPath string) string { return "model:" + modelPath }
+
+// reserveWaitTimeout bounds how long the leader waits to apply its own
+// reservation before reporting the outcome
+const reserveWaitTimeout = 5 * time.Second
+
+// errNameConflict is returned when a name is already held by another owner
+var errNameConflict = errors.New("name already in use")
+
+// claimLocked takes name for owner, or reports who holds it. Callers hold
+// sm.mu.
+func (sm *ModelStateMachine) claimLocked(name, owner string) error {
+	if held, ok := sm.names[name]; ok && held != owner {
+		return fmt.Errorf("%w: %q is held by %s", errNameConflict, name, held)
+	}
+	sm.names[name] = owner
+	return nil
+}
+
+// NameOwner returns the owner a name is reserved for
+func (sm *ModelStateMachine) NameOwner(name string) (string, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	owner, ok := sm.names[name]
+	return owner, ok
+}
+
+// rebuildNames derives the namespace from models and aliases, for snapshots
+// taken before reservations existed. Callers hold sm.mu.
+func (sm *ModelStateMachine) rebuildNames() {
+	sm.names = make(map[string]string, len(sm.models)+len(sm.aliases))
+	for id, path := range sm.models {
+		sm.names[id] = modelOwner(path)
+	}
+	for alias := range sm.aliases {
+		if _, taken := sm.names[alias]; !taken {
+			sm.names[alias] = ownerAlias
+		}
+	}
+}
+
+// ReserveNameCommand claims a model id or alias cluster-wide
+type ReserveNameCommand struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+func (c *ReserveNameCommand) Action() string { return "RESERVE_NAME" }
+
+func (c *ReserveNameCommand) Validate() error {
+	if c.Name == "" || c.Owner == "" {
+		return fmt.Errorf("missing name or owner")
+	}
+	return nil
+}
+
+func (c *ReserveNameCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if err := sm.claimLocked(c.Name, c.Owner); err != nil {
+		return err
+	}
+	raftLog.Infof("applied RESERVE_NAME: %s -> %s", c.Name, c.Owner)
+	return nil
+}
+
+// reserveName commits a reservation and waits until it is applied locally,
+// so the caller learns whether it or an earlier reservation won
+func reserveName(name, owner string) error {
+	index, err := replicateCommand(&ReserveNameCommand{Name: name, Owner: owner})
+	if err != nil {
+		return err
+	}
+	if !modelStateMachine.WaitApplied(index, reserveWaitTimeout) {
+		return fmt.Errorf("reservation of %q committed but not yet applied", name)
+	}
+	if held, _ := modelStateMachine.NameOwner(name); held != owner {
+		metrics.Inc("names.conflicts", 1)
+		return fmt.Errorf("%w: %q is held by %s", errNameConflict, name, held)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Paged answers with continuation tokens
+// ============================================================================
+
+// A cluster with thousands of models, or an EVALUATE asked for its
+// per-sample results, would answer with one JSON line larger than many
+// clients read. Both can answer in pages instead:
+//
+//	{"type": "LIST_MODELS", "limit": 500}
+//	-> {"status": "OK", "models": [...], "details": [...], "next_page_token": "..."}
+//	{"type": "LIST_MODELS", "limit": 500, "page_token": "..."}
+//
+// and so on until an answer has no next_page_token. LIST_MODELS without a
+// limit or page_token answers everything in one line, as before. Both of
+// its lists are paged in id order and the token holds the last id sent of
+// each, so any node can serve the next page and models created meanwhile
+// show up if they sort later.
+//
+// EVALUATE with "per_sample": true also answers the prediction, label,
+// squared error and correctness of every sample, at most limit of them
+// (default pageDefaultLimit) per page. The rest waits on the node that ran
+// the evaluation for pageTTL, and the next page is asked for with the token
+// alone:
+//
+//	{"type": "EVALUATE", "page_token": "..."}
+//
+// A token that expired or was served by another node gets E_PAGE_EXPIRED.
+
+const (
+	pageDefaultLimit = 500
+	pageMaxLimit     = 5000
+
+	// pageTTL is how long a stored result waits for its next page
+	pageTTL = 5 * time.Minute
+	// maxStoredPages bounds the results waiting for their next page; the
+	// oldest goes first
+	maxStoredPages = 64
+)
+
+var (
+	errPageExpired  = errors.New("page token expired or unknown on this node")
+	errBadPageToken = errors.New("invalid page_token")
+)
+
+// pageLimit reads a request's limit, capped at pageMaxLimit
+func pageLimit(msg map[string]interface{}) int {
+	limit := int(numberOr(msg["limit"], pageDefaultLimit))
+	if limit <= 0 {
+		limit = pageDefaultLimit
+	}
+	return min(limit, pageMaxLimit)
+}
+
+// paged reports whether a request asks for pages
+func paged(msg map[string]interface{}) bool {
+	_, limit := msg["limit"]
+	_, token := msg["page_token"]
+	return limit || token
+}
+
+// listModelIDs returns the ids in the names of the model files on this
+// node, sorted
+func listModelIDs() []string {
+	ids := []string{}
+	files, _ := filepath.Glob(filepath.Join(modelsDir, "*.bin"))
+	for _, f := range files {
+		name := filepath.Base(f)
+		if strings.HasPrefix(name, "model_") && strings.HasSuffix(name, ".bin") && !deletedModelFile(f) {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(name, "model_"), ".bin"))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// listPageToken is where a paged LIST_MODELS stopped in each of its lists
+type listPageToken struct {
+	Model  string `json:"m,omitempty"` // last id in models
+	Detail string `json:"d,omitempty"` // last model id in details
+}
+
+// listModelsPage answers a paged LIST_MODELS. models (this node's files)
+// and details (the cluster's registry) are paged side by side, each in id
+// order.
+func listModelsPage(msg map[string]interface{}) (map[string]interface{}, error) {
+	var after listPageToken
+	if token, _ := msg["page_token"].(string); token != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || json.Unmarshal(raw, &after) != nil {
+			return nil, errBadPageToken
+		}
+	}
+	limit := pageLimit(msg)
+
+	ids := listModelIDs()
+	if !listQuarantined(msg) {
+		ids = dropQuarantinedIDs(ids)
+	}
+	start := sort.Search(len(ids), func(i int) bool { return ids[i] > after.Model })
+	models := ids[start:min(start+limit, len(ids))]
+
+	all := modelStateMachine.Registry().All()
+	detailIDs := make([]string, 0, len(all))
+	for id, m := range all {
+		if id > after.Detail && (m.Quarantine == nil || listQuarantined(msg)) {
+			detailIDs = append(detailIDs, id)
+		}
+	}
+	sort.Strings(detailIDs)
+	more := len(ids)-start > limit || len(detailIDs) > limit
+	detailIDs = detailIDs[:min(limit, len(detailIDs))]
+	details := make([]*ModelMetadata, len(detailIDs))
+	for i, id := range detailIDs {
+		details[i] = all[id]
+	}
+
+	resp := map[string]interface{}{"status": "OK", "models": models, "details": details}
+	if more {
+		next := after
+		if len(models) > 0 {
+			next.Model = models[len(models)-1]
+		}
+		if len(detailIDs) > 0 {
+			next.Detail = detailIDs[len(detailIDs)-1]
+		}
+		raw, _ := json.Marshal(next)
+		resp["next_page_token"] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return resp, nil
+}
+
+// storedPages is a result too large for one answer, waiting for its next
+// pages
+type storedPages struct {
+	items   []interface{}
+	header  map[string]interface{} // fields repeated on every page
+	expires time.Time
+}
+
+var pageStore = struct {
+	sync.Mutex
+	results map[string]*storedPages
+}{results: make(map[string]*storedPages)}
+
+// firstPage answers the first page of items and stores the rest. header
+// holds the answer's other fields, which every page repeats.
+func firstPage(header map[string]interface{}, items []interface{}, limit int) map[string]interface{} {
+	if len(items) <= limit {
+		return pageAnswer(header, items, "", 0, limit)
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	key := hex.EncodeToString(buf)
+	now := time.Now()
+
+	pageStore.Lock()
+	for k, r := range pageStore.results {
+		if now.After(r.expires) {
+			delete(pageStore.results, k)
+		}
+	}
+	if len(pageStore.results) >= maxStoredPages {
+		oldest := ""
+		for k, r := range pageStore.results {
+			if oldest == "" || r.expires.Before(pageStore.results[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(pageStore.results, oldest)
+		metrics.Inc("pages.evicted", 1)
+	}
+	pageStore.results[key] = &storedPages{items: items, header: header, expires: now.Add(pageTTL)}
+	pageStore.Unlock()
+
+	return pageAnswer(header, items, key, 0, limit)
+}
+
+// nextPage answers the page a token points at
+func nextPage(token string, limit int) (map[string]interface{}, error) {
+	key, offsetStr, ok := strings.Cut(token, ".")
+	offset, err := strconv.Atoi(offsetStr)
+	if !ok || err != nil || offset < 0 {
+		return nil, errBadPageToken
+	}
+
+	pageStore.Lock()
+	defer pageStore.Unlock()
+	r, ok := pageStore.results[key]
+	if !ok || time.Now().After(r.expires) || offset > len(r.items) {
+		delete(pageStore.results, key)
+		return nil, errPageExpired
+	}
+	if offset+limit >= len(r.items) {
+		// last page: nothing left to wait for
+		delete(pageStore.results, key)
+	} else {
+		r.expires = time.Now().Add(pageTTL)
+	}
+	return pageAnswer(r.header, r.items, key, offset, limit), nil
+}
+
+// pageAnswer builds the answer holding items[offset:offset+limit]
+func pageAnswer(header map[string]interface{}, items []interface{}, key string, offset, limit int) map[string]interface{} {
+	end := min(offset+limit, len(items))
+	resp := make(map[string]interface{}, len(header)+4)
+	for k, v := range header {
+		resp[k] = v
+	}
+	resp["offset"] = offset
+	resp["total"] = len(items)
+	resp["results"] = items[offset:end]
+	if end < len(items) {
+		resp["next_page_token"] = fmt.Sprintf("%s.%d", key, end)
+	}
+	return resp
+}
+
+// sendNextPage answers a request that only carries a page_token
+func sendNextPage(conn net.Conn, msg map[string]interface{}) {
+	token, _ := msg["page_token"].(string)
+	resp, err := nextPage(token, pageLimit(msg))
+	if err != nil {
+		resp = map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		if errors.Is(err, errPageExpired) {
+			resp["code"] = "E_PAGE_EXPIRED"
+		}
+	}
+	sendResponse(conn, resp)
+}
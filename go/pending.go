@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Two-phase model publish
+// ============================================================================
+
+// A TRAIN or JOB_SUBMIT with "publish": false trains as usual but doesn't
+// commit the model. Its file waits in <models-dir>/pending on the leader
+// that trained it, and the answer says so:
+//
+//	{"status": "OK", "model_id": "...", "job_id": "...", "pending": true}
+//
+// On that node the pending model can be scored with EVALUATE,
+// COMPARE_MODELS and INSPECT_MODEL, but PREDICT, LIST_MODELS' models and
+// the other nodes don't see it. Once it is good enough,
+//
+//	{"type": "PUBLISH", "model_id": "..."}
+//
+// commits it like a finished training (name reservation, MODEL_TRAINED)
+// and answers what the TRAIN would have; DISCARD_PENDING deletes it
+// instead. Both are served by the leader, so a model left pending on a node
+// that lost leadership can be published once it leads again. Pending models
+// not published within -pending-ttl are discarded.
+
+// pendingModel is a trained model waiting for PUBLISH
+type pendingModel struct {
+	File    string               `json:"file"` // in the pending directory
+	Expires time.Time            `json:"expires"`
+	Command *ModelTrainedCommand `json:"command"` // committed by PUBLISH
+}
+
+// PendingModels holds this node's pending models, indexed in pending.json
+type PendingModels struct {
+	dir string
+	ttl time.Duration
+
+	mu     sync.Mutex
+	models map[string]*pendingModel // model id -> entry
+}
+
+var errNotPending = errors.New("no pending model with that id on this node")
+
+var pendingModels *PendingModels
+
+// NewPendingModels opens the pending directory and its index
+func NewPendingModels(dir string, ttl time.Duration) (*PendingModels, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &PendingModels{dir: dir, ttl: ttl, models: make(map[string]*pendingModel)}
+	data, err := os.ReadFile(filepath.Join(dir, "pending.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &p.models); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *PendingModels) saveLocked() {
+	data, _ := json.MarshalIndent(p.models, "", "  ")
+	path := filepath.Join(p.dir, "pending.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		storageLog.Warnf("cannot save pending models: %v", err)
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+// Hold moves a trained model into the pending directory instead of
+// committing cmd
+func (p *PendingModels) Hold(cmd *ModelTrainedCommand) error {
+	name := filepath.Base(cmd.ModelPath)
+	if err := os.Rename(cmd.ModelPath, filepath.Join(p.dir, name)); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.models[cmd.ModelID] = &pendingModel{File: name, Expires: time.Now().Add(p.ttl), Command: cmd}
+	p.saveLocked()
+	p.mu.Unlock()
+	metrics.Inc("models.pending", 1)
+	return nil
+}
+
+// Path returns the file of a pending model
+func (p *PendingModels) Path(modelID string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.models[modelID]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(p.dir, m.File), true
+}
+
+// Take removes a pending model from the index and moves its file back to
+// where its training left it, returning the command that commits it
+func (p *PendingModels) Take(modelID string) (*ModelTrainedCommand, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.models[modelID]
+	if !ok {
+		return nil, errNotPending
+	}
+	if err := os.Rename(filepath.Join(p.dir, m.File), m.Command.ModelPath); err != nil {
+		return nil, err
+	}
+	delete(p.models, modelID)
+	p.saveLocked()
+	return m.Command, nil
+}
+
+// Discard deletes a pending model
+func (p *PendingModels) Discard(modelID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.models[modelID]
+	if !ok {
+		return errNotPending
+	}
+	os.Remove(filepath.Join(p.dir, m.File))
+	delete(p.models, modelID)
+	p.saveLocked()
+	return nil
+}
+
+// List returns the pending models' metadata, oldest first
+func (p *PendingModels) List() []*ModelMetadata {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]*ModelMetadata, 0, len(p.models))
+	for id, m := range p.models {
+		meta := ModelMetadata{}
+		if m.Command.Metadata != nil {
+			meta = *m.Command.Metadata
+		}
+		meta.ModelID = id
+		meta.File = m.File
+		list = append(list, &meta)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].ModelID < list[j].ModelID
+	})
+	return list
+}
+
+// Run discards the pending models past -pending-ttl every interval
+func (p *PendingModels) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		p.mu.Lock()
+		for id, m := range p.models {
+			if now.After(m.Expires) {
+				os.Remove(filepath.Join(p.dir, m.File))
+				delete(p.models, id)
+				metrics.Inc("models.pending_expired", 1)
+				storageLog.Infof("pending model %s expired unpublished", id)
+			}
+		}
+		p.saveLocked()
+		p.mu.Unlock()
+	}
+}
+
+// publishOnTrain reports whether a TRAIN or JOB_SUBMIT publishes its model
+// right away, as it does unless it sets "publish": false
+func publishOnTrain(msg map[string]interface{}) bool {
+	publish, ok := msg["publish"].(bool)
+	return publish || !ok
+}
+
+// holdPending keeps a model trained with "publish": false and returns the
+// client response
+func holdPending(cmd *ModelTrainedCommand) map[string]interface{} {
+	if err := pendingModels.Hold(cmd); err != nil {
+		os.Remove(cmd.ModelPath)
+		jobEvents.Record(cmd.JobID, JobFailed, map[string]interface{}{"error": err.Error()})
+		return map[string]interface{}{"status": "ERROR", "message": "Cannot keep pending model: " + err.Error()}
+	}
+	tcpLog.Infof("Model %s pending until PUBLISH", cmd.ModelID)
+	return map[string]interface{}{"status": "OK", "model_id": cmd.ModelID, "job_id": cmd.JobID, "pending": true}
+}
+
+// findEvaluableModel is findModel that also finds this node's pending
+// models
+func findEvaluableModel(modelID string) string {
+	if path := findModel(modelID); path != "" {
+		return path
+	}
+	path, _ := pendingModels.Path(modelID)
+	return path
+}
+
+// handlePublish serves PUBLISH and DISCARD_PENDING
+func handlePublish(ctx context.Context, conn net.Conn, msgType string, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+	tcpLog.Infof("%s request: %s", msgType, modelID)
+
+	if msgType == "DISCARD_PENDING" {
+		if err := pendingModels.Discard(modelID); err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_NOT_PENDING", "message": err.Error()})
+			return
+		}
+		metrics.Inc("models.pending_discarded", 1)
+		sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": modelID})
+		return
+	}
+
+	cmd, err := pendingModels.Take(modelID)
+	if err != nil {
+		resp := map[string]interface{}{"status": "ERROR", "message": err.Error()}
+		if errors.Is(err, errNotPending) {
+			resp["code"] = "E_NOT_PENDING"
+		}
+		sendResponse(conn, resp)
+		return
+	}
+	metrics.Inc("models.published", 1)
+	sendResponse(conn, publishModel(cmd))
+}
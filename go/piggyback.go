@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+// ============================================================================
+// Heartbeat piggybacking for small commands
+// ============================================================================
+
+// A burst of small commands (aliases, deletions, KV puts, locks) used to
+// start one replication round each. Commands of at most piggybackMaxBytes
+// are instead appended to the log and left for the next AppendEntries: the
+// leader loop sends an early heartbeat piggybackDelay after the first of
+// them, so every command of the burst shares one RPC per follower, and the
+// caller waits for the entry to commit. Backpressure comes for free: a
+// heartbeat skips a follower whose previous RPC is still in flight, and that
+// RPC picks the new entries up when it comes back (replicateTo keeps going
+// until the follower has caught up).
+
+var (
+	piggybackMaxBytes int64 = 4096 // 0 = replicate every command on its own
+	piggybackDelay          = 2 * time.Millisecond
+)
+
+// replicatePiggybacked waits for the entry at index, already in the log, to
+// be committed by a heartbeat. Like Replicate it gives up after 5 seconds.
+func (rn *RaftNode) replicatePiggybacked(index int) (int, bool) {
+	metrics.Inc("raft.piggybacked", 1)
+	select {
+	case rn.flushCh <- struct{}{}:
+	default: // an early heartbeat is already due
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		rn.mu.RLock()
+		committed := rn.commitIndex >= index
+		leader := rn.state == "leader"
+		notify := rn.commitNotify
+		rn.mu.RUnlock()
+		if committed || !leader {
+			return index, committed
+		}
+		select {
+		case <-notify:
+		case <-time.After(rn.heartbeatInterval()):
+			// recheck leadership
+		case <-deadline:
+			return index, false
+		}
+	}
+}
+
+// notifyCommitLocked wakes the callers waiting for commitIndex to advance.
+// Callers hold rn.mu.
+func (rn *RaftNode) notifyCommitLocked() {
+	close(rn.commitNotify)
+	rn.commitNotify = make(chan struct{})
+}
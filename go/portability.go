@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ============================================================================
+// Cross-platform helpers
+// ============================================================================
+
+// splitLines splits subprocess or protocol output into lines, accepting both
+// "\n" and Windows "\r\n" line endings
+func splitLines(s string) []string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
+// trimLine strips the line terminator from a line-protocol message so that
+// clients sending CRLF (e.g. from Windows tools) are handled like LF clients
+func trimLine(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
+
+// javaExecutable returns the JVM launcher: -java-bin, or the name for this
+// platform, which exec.Command resolves via PATH (and PATHEXT on Windows).
+func javaExecutable() string {
+	if javaBin != "" {
+		return javaBin
+	}
+	if runtime.GOOS == "windows" {
+		return "java.exe"
+	}
+	return "java"
+}
+
+// safeBaseName reports whether name is a plain file name with no directory
+// components on any platform. Both separators are rejected so that a name
+// accepted on Linux cannot escape the models directory on Windows.
+func safeBaseName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	if strings.ContainsAny(name, `/\:`) {
+		return false
+	}
+	return filepath.Base(name) == name
+}
+
+// replaceFile atomically moves src over dst. os.Rename already replaces an
+// existing destination on Windows, but a destination held open by a reader
+// can make it fail, so fall back to remove-then-rename.
+func replaceFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || runtime.GOOS != "windows" {
+		return err
+	}
+	os.Remove(dst)
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// PREDICT_BATCH
+// ============================================================================
+
+// PREDICT_BATCH runs a matrix of inputs through one model in a single
+// backend call (one JVM launch, or one request to the persistent bridge)
+// instead of one PREDICT per sample:
+//
+//	{"type": "PREDICT_BATCH", "model_id": "...", "inputs": [[...], [...]]}
+//	-> {"status": "OK", "outputs": [[...], [...]], "request_ids": [...]}
+//
+// Outputs are in input order. The batch takes one slot of the model's
+// prediction limit and is shed like a PREDICT while the leader is busy.
+
+// maxPredictBatch bounds the rows of one PREDICT_BATCH, which travel to the
+// backend as a single command-line argument
+const maxPredictBatch = 1000
+
+func handlePredictBatch(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	inputsRaw, _ := msg["inputs"].([]interface{})
+
+	if modelID == "" || len(inputsRaw) == 0 {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id or inputs"})
+		return
+	}
+	if len(inputsRaw) > maxPredictBatch {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("At most %d inputs per batch", maxPredictBatch)})
+		return
+	}
+	rows := make([][]interface{}, len(inputsRaw))
+	for i, r := range inputsRaw {
+		row, ok := r.([]interface{})
+		if !ok || len(row) == 0 {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("Input %d is not a list of values", i)})
+			return
+		}
+		rows[i] = row
+	}
+
+	tcpLog.Infof("PREDICT_BATCH request: model=%s, %d inputs", modelID, len(rows))
+	start := time.Now()
+
+	modelPath, ok := findServableModel(ctx, conn, msg, modelID)
+	if !ok {
+		return
+	}
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found", "session": currentSession(msg)})
+		return
+	}
+	if !checkModelIntegrity(conn, msg, modelPath) || !checkQuarantine(conn, msg, modelPath) {
+		return
+	}
+	if err := preprocessRows(modelPath, rows); err != nil {
+		sendPreprocessError(conn, msg, err)
+		return
+	}
+
+	outputs := fastPredictBatch(modelPath, rows)
+	if outputs == nil {
+		if shedPredict(conn, modelPath) {
+			return
+		}
+		var err error
+		outputs, err = backendPredictBatch(ctx, modelPath, rows)
+		if requestTimedOut(conn, ctx, "PREDICT_BATCH") {
+			return
+		}
+		if errors.Is(err, errPredictQueueFull) || errors.Is(err, errPredictQueueTimeout) {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUEUE_FULL", "message": err.Error()})
+			return
+		}
+		if err != nil {
+			predictionFailures.Failed(modelPath)
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Prediction failed"})
+			return
+		}
+	}
+	predictionFailures.Succeeded(modelPath)
+
+	modelID = modelIDFromPath(modelPath)
+	latency := time.Since(start) / time.Duration(len(rows))
+	requestIDs := make([]string, len(rows))
+	for i, row := range rows {
+		input, _ := parseNumericInput(row)
+		requestIDs[i] = predictionLog.Record(modelID, "", input, outputs[i], latency)
+		inputDrift.Observe(modelID, input)
+		predictionAudit.Sample(modelID, requestIDs[i], input, outputs[i], latency)
+	}
+	metrics.Inc("predict.batch_request_inputs", int64(len(rows)))
+	sendResponse(conn, map[string]interface{}{"status": "OK", "outputs": outputs, "request_ids": requestIDs, "session": currentSession(msg)})
+}
+
+// fastPredictBatch serves every row in-process, or returns nil if any of
+// them needs the backend
+func fastPredictBatch(modelPath string, rows [][]interface{}) [][]float64 {
+	if fastPredictor == nil {
+		return nil
+	}
+	outputs := make([][]float64, len(rows))
+	for i, row := range rows {
+		input, ok := parseNumericInput(row)
+		if !ok {
+			return nil
+		}
+		if outputs[i], ok = fastPredictor.Predict(modelPath, input); !ok {
+			return nil
+		}
+	}
+	return outputs
+}
+
+// errPredictionFailed means the backend returned no output for some row
+var errPredictionFailed = errors.New("prediction failed")
+
+// backendPredictBatch runs every row through the backend in one call, under
+// the model's prediction limit
+func backendPredictBatch(ctx context.Context, modelPath string, rows [][]interface{}) ([][]float64, error) {
+	inputs := make([]string, len(rows))
+	for i, row := range rows {
+		parts := make([]string, len(row))
+		for j, v := range row {
+			parts[j] = fmt.Sprintf("%v", v)
+		}
+		inputs[i] = strings.Join(parts, ",")
+	}
+
+	outputs, err := limitedPrediction(modelPath, func() [][]float64 { return runJavaPredictionBatch(ctx, modelPath, inputs) })
+	if err != nil {
+		return nil, err
+	}
+	for _, output := range outputs {
+		if output == nil {
+			return nil, errPredictionFailed
+		}
+	}
+	if outputs == nil {
+		return nil, errPredictionFailed
+	}
+	return outputs, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Per-model prediction concurrency
+// ============================================================================
+
+// PredictLimiter caps the backend predictions running at once for each
+// model, so a burst on one model doesn't launch a JVM per request and starve
+// the others. A prediction over the cap waits for a slot in FIFO order; a
+// finishing prediction hands its slot straight to the oldest waiter. With
+// micro-batching a whole batch takes one slot. In-process (fast path)
+// predictions don't launch anything and are not limited.
+type PredictLimiter struct {
+	limit    int           // running predictions per model
+	maxQueue int           // waiting predictions per model (0 = unbounded)
+	timeout  time.Duration // longest wait for a slot (0 = no limit)
+
+	mu     sync.Mutex
+	models map[string]*predictSlots // model path -> slots
+}
+
+type predictSlots struct {
+	running int
+	waiting []chan struct{} // oldest first; closed when granted a slot
+}
+
+var (
+	errPredictQueueFull    = errors.New("too many predictions waiting for this model")
+	errPredictQueueTimeout = errors.New("timed out waiting for a prediction slot")
+)
+
+var predictLimiter *PredictLimiter
+
+// NewPredictLimiter creates a limiter allowing limit predictions per model
+func NewPredictLimiter(limit, maxQueue int, timeout time.Duration) *PredictLimiter {
+	return &PredictLimiter{
+		limit:    limit,
+		maxQueue: maxQueue,
+		timeout:  timeout,
+		models:   make(map[string]*predictSlots),
+	}
+}
+
+// Acquire waits for a slot on modelPath and returns the function releasing
+// it. It fails when the model's queue is full or the wait times out.
+func (l *PredictLimiter) Acquire(modelPath string) (func(), error) {
+	start := time.Now()
+	release := func() { l.release(modelPath) }
+
+	l.mu.Lock()
+	slots, ok := l.models[modelPath]
+	if !ok {
+		slots = &predictSlots{}
+		l.models[modelPath] = slots
+	}
+	if slots.running < l.limit && len(slots.waiting) == 0 {
+		slots.running++
+		l.mu.Unlock()
+		metrics.Time("predict.queue_wait", 0)
+		return release, nil
+	}
+	if l.maxQueue > 0 && len(slots.waiting) >= l.maxQueue {
+		l.mu.Unlock()
+		metrics.Inc("predict.queue_rejected", 1)
+		return nil, errPredictQueueFull
+	}
+	granted := make(chan struct{})
+	slots.waiting = append(slots.waiting, granted)
+	l.mu.Unlock()
+	metrics.Inc("predict.queued", 1)
+
+	var expired <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-granted:
+		metrics.Since("predict.queue_wait", start)
+		return release, nil
+	case <-expired:
+	}
+
+	l.mu.Lock()
+	select {
+	case <-granted:
+		// Granted while timing out: take the slot after all
+		l.mu.Unlock()
+		metrics.Since("predict.queue_wait", start)
+		return release, nil
+	default:
+	}
+	for i, ch := range slots.waiting {
+		if ch == granted {
+			slots.waiting = append(slots.waiting[:i], slots.waiting[i+1:]...)
+			break
+		}
+	}
+	l.mu.Unlock()
+	metrics.Inc("predict.queue_timeouts", 1)
+	return nil, errPredictQueueTimeout
+}
+
+// release passes a slot to the oldest waiter, or frees it
+func (l *PredictLimiter) release(modelPath string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots := l.models[modelPath]
+	if len(slots.waiting) > 0 {
+		close(slots.waiting[0])
+		slots.waiting = slots.waiting[1:]
+		return
+	}
+	slots.running--
+	if slots.running == 0 {
+		delete(l.models, modelPath)
+	}
+}
+
+// Waiting returns the number of predictions waiting for a slot
+func (l *PredictLimiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, slots := range l.models {
+		n += len(slots.waiting)
+	}
+	return n
+}
+
+// limitedPrediction runs fn under modelPath's limit, if one is configured
+func limitedPrediction[T any](modelPath string, fn func() T) (T, error) {
+	if predictLimiter == nil {
+		return fn(), nil
+	}
+	release, err := predictLimiter.Acquire(modelPath)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer release()
+	return fn(), nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Prediction input preprocessing
+// ============================================================================
+
+// A model can carry a declarative preprocessing spec that turns the raw row
+// a client sends into the numeric features the model was trained on, so
+// clients don't have to repeat the feature engineering:
+//
+//	{"type": "SET_PREPROCESS", "model_id": "iris", "preprocess": {
+//	    "input_size": 4,
+//	    "columns": [
+//	        {"index": 0, "scale": {"method": "standard", "mean": 5.8, "std": 0.8}},
+//	        {"index": 3, "scale": {"method": "minmax", "min": 0, "max": 2.5}},
+//	        {"index": 2, "one_hot": ["red", "green", "blue"]}
+//	    ]}}
+//
+// Each listed column is taken from the raw row in list order, so the list
+// both selects and orders columns. A column with one_hot becomes one value
+// per category (1 for the matching one, all 0 for an unknown category); one
+// with scale is standardized or min-max scaled; any other is passed through
+// and must be numeric. The spec is a SET_PREPROCESS entry in the RAFT log and
+// lives in the model's metadata, so every node applies the same one to
+// PREDICT, PREDICT_BATCH and EVALUATE inputs before the backend sees them. A
+// null preprocess removes it.
+
+// maxPreprocessColumns bounds the features a spec can produce
+const maxPreprocessColumns = 4096
+
+// PreprocessSpec maps a raw input row to model features
+type PreprocessSpec struct {
+	InputSize int                `json:"input_size,omitempty"` // raw row length; 0 = unchecked
+	Columns   []PreprocessColumn `json:"columns"`
+}
+
+// PreprocessColumn produces one feature, or one per category, from a raw
+// column
+type PreprocessColumn struct {
+	Index  int          `json:"index"`
+	OneHot []string     `json:"one_hot,omitempty"`
+	Scale  *ScaleParams `json:"scale,omitempty"`
+}
+
+// ScaleParams scales a numeric column: (x-mean)/std for "standard",
+// (x-min)/(max-min) for "minmax"
+type ScaleParams struct {
+	Method string  `json:"method"`
+	Mean   float64 `json:"mean,omitempty"`
+	Std    float64 `json:"std,omitempty"`
+	Min    float64 `json:"min,omitempty"`
+	Max    float64 `json:"max,omitempty"`
+}
+
+// Features returns how many values the spec produces per row
+func (p *PreprocessSpec) Features() int {
+	n := 0
+	for _, c := range p.Columns {
+		if len(c.OneHot) > 0 {
+			n += len(c.OneHot)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Validate checks the spec on its own
+func (p *PreprocessSpec) Validate() error {
+	if len(p.Columns) == 0 {
+		return fmt.Errorf("no columns")
+	}
+	if p.InputSize < 0 {
+		return fmt.Errorf("negative input_size")
+	}
+	for i, c := range p.Columns {
+		if c.Index < 0 || p.InputSize > 0 && c.Index >= p.InputSize {
+			return fmt.Errorf("column %d: index %d out of range", i, c.Index)
+		}
+		if len(c.OneHot) > 0 && c.Scale != nil {
+			return fmt.Errorf("column %d: one_hot and scale are exclusive", i)
+		}
+		seen := make(map[string]bool, len(c.OneHot))
+		for _, category := range c.OneHot {
+			if seen[category] {
+				return fmt.Errorf("column %d: category %q listed twice", i, category)
+			}
+			seen[category] = true
+		}
+		if s := c.Scale; s != nil {
+			switch {
+			case s.Method == "standard" && s.Std <= 0:
+				return fmt.Errorf("column %d: standard scaling needs std > 0", i)
+			case s.Method == "minmax" && s.Max <= s.Min:
+				return fmt.Errorf("column %d: minmax scaling needs max > min", i)
+			case s.Method != "standard" && s.Method != "minmax":
+				return fmt.Errorf("column %d: unknown scale method %q (use standard or minmax)", i, s.Method)
+			}
+		}
+	}
+	if p.Features() > maxPreprocessColumns {
+		return fmt.Errorf("spec produces %d features, at most %d", p.Features(), maxPreprocessColumns)
+	}
+	return nil
+}
+
+// Apply turns a raw row into the model's features
+func (p *PreprocessSpec) Apply(raw []interface{}) ([]interface{}, error) {
+	if p.InputSize > 0 && len(raw) != p.InputSize {
+		return nil, fmt.Errorf("expected %d input columns, got %d", p.InputSize, len(raw))
+	}
+	out := make([]interface{}, 0, p.Features())
+	for _, c := range p.Columns {
+		if c.Index >= len(raw) {
+			return nil, fmt.Errorf("missing input column %d", c.Index)
+		}
+		v := raw[c.Index]
+		if len(c.OneHot) > 0 {
+			category := fmt.Sprintf("%v", v)
+			for _, want := range c.OneHot {
+				if category == want {
+					out = append(out, 1.0)
+				} else {
+					out = append(out, 0.0)
+				}
+			}
+			continue
+		}
+		x, ok := numericValue(v)
+		if !ok {
+			return nil, fmt.Errorf("input column %d is not numeric: %v", c.Index, v)
+		}
+		if s := c.Scale; s != nil {
+			if s.Method == "standard" {
+				x = (x - s.Mean) / s.Std
+			} else {
+				x = (x - s.Min) / (s.Max - s.Min)
+			}
+		}
+		out = append(out, x)
+	}
+	return out, nil
+}
+
+// numericValue reads a JSON number or a numeric string
+func numericValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// preprocessFor returns the spec attached to the model at modelPath, if any
+func preprocessFor(modelPath string) *PreprocessSpec {
+	meta, ok := modelStateMachine.Registry().Get(modelIDFromPath(modelPath), filepath.Base(modelPath))
+	if !ok {
+		return nil
+	}
+	return meta.Preprocess
+}
+
+// preprocessRows applies the model's spec, if any, to each row in place
+func preprocessRows(modelPath string, rows [][]interface{}) error {
+	spec := preprocessFor(modelPath)
+	if spec == nil {
+		return nil
+	}
+	for i, row := range rows {
+		features, err := spec.Apply(row)
+		if err != nil {
+			if len(rows) > 1 {
+				return fmt.Errorf("input %d: %v", i, err)
+			}
+			return err
+		}
+		rows[i] = features
+	}
+	metrics.Inc("predict.preprocessed_inputs", int64(len(rows)))
+	return nil
+}
+
+// sendPreprocessError answers a request whose input the spec rejected
+func sendPreprocessError(conn net.Conn, msg map[string]interface{}, err error) {
+	sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_BAD_INPUT", "message": "Preprocessing failed: " + err.Error(), "session": currentSession(msg)})
+}
+
+// SetPreprocessCommand attaches a preprocessing spec to a model, or removes
+// it when Spec is nil
+type SetPreprocessCommand struct {
+	ModelID string          `json:"model_id"`
+	Spec    *PreprocessSpec `json:"preprocess"`
+}
+
+func (c *SetPreprocessCommand) Action() string { return "SET_PREPROCESS" }
+
+func (c *SetPreprocessCommand) Validate() error {
+	if c.ModelID == "" {
+		return fmt.Errorf("missing model_id")
+	}
+	if c.Spec != nil {
+		return c.Spec.Validate()
+	}
+	return nil
+}
+
+func (c *SetPreprocessCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.RLock()
+	path, ok := sm.models[c.ModelID]
+	sm.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown model %s", c.ModelID)
+	}
+	sm.registry.SetPreprocess(c.ModelID, filepath.Base(path), c.Spec)
+	raftLog.Infof("applied SET_PREPROCESS: %s", c.ModelID)
+	return nil
+}
+
+// handleSetPreprocess attaches or removes a model's preprocessing spec
+func handleSetPreprocess(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	raw, present := msg["preprocess"]
+	if modelID == "" || !present {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id or preprocess"})
+		return
+	}
+	cmd := &SetPreprocessCommand{ModelID: modelStateMachine.ResolveAlias(modelID)}
+	if raw != nil {
+		data, _ := json.Marshal(raw)
+		cmd.Spec = &PreprocessSpec{}
+		if err := json.Unmarshal(data, cmd.Spec); err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid preprocess: " + err.Error()})
+			return
+		}
+	}
+	if err := cmd.Validate(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid preprocess: " + err.Error()})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	modelPath, ok := modelStateMachine.ModelPath(cmd.ModelID)
+	if !ok {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+	if meta, ok := modelStateMachine.Registry().Get(cmd.ModelID, filepath.Base(modelPath)); ok && cmd.Spec != nil && meta.InputSize > 0 && cmd.Spec.Features() != meta.InputSize {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": fmt.Sprintf("Invalid preprocess: produces %d features, the model takes %d", cmd.Spec.Features(), meta.InputSize)})
+		return
+	}
+
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	modelStateMachine.WaitApplied(index, reserveWaitTimeout)
+	sendResponse(conn, map[string]interface{}{"status": "OK", "model_id": cmd.ModelID, "preprocess": cmd.Spec, "session": sessionToken(index)})
+}
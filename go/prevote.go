@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Pre-vote
+// ============================================================================
+
+// A node cut off from the cluster used to bump its term at every election
+// timeout, and when it came back the higher term in its replies made the
+// leader step down (RAFT §9.6). Before campaigning, a node now asks the
+// voters with PRE_VOTE whether they would vote for it at the next term. A
+// voter grants a pre-vote under the same conditions as a vote (log at least
+// as up to date as its own, no leader heard from within an election timeout)
+// but changes neither its term nor its vote. Only with a majority of
+// pre-votes does the node increment its term and send REQUEST_VOTE.
+// Leadership transfers (transfer.go) skip the phase. Peers older than
+// preVoteVersion don't know PRE_VOTE and count as granted.
+
+// preVoteVersion is the first protocol version whose nodes answer PRE_VOTE
+const preVoteVersion = 5
+
+// preVote reports whether a majority of voters would elect this node at the
+// next term
+func (rn *RaftNode) preVote() bool {
+	rn.mu.RLock()
+	term := rn.currentTerm + 1
+	lastLogIndex := rn.lastLogIndex()
+	lastLogTerm := rn.termAt(lastLogIndex)
+	rn.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := make(map[string]bool)
+	replies := make(map[string]map[string]interface{})
+
+	for _, peer := range rn.peersSnapshot() {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			resp := rn.sendRPC(p.Host, p.Port, map[string]interface{}{
+				"type":           PRE_VOTE,
+				"term":           term,
+				"candidate_id":   rn.id,
+				"last_log_index": lastLogIndex,
+				"last_log_term":  lastLogTerm,
+			})
+			if resp == nil {
+				return
+			}
+			key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+			mu.Lock()
+			defer mu.Unlock()
+			replies[key] = resp
+			if resp["vote_granted"] == true || messageProtocol(resp) < preVoteVersion {
+				granted[key] = true
+			}
+		}(peer)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(raftRPCTimeout):
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	// A voter already past our term refuses us (or, predating PRE_VOTE,
+	// was counted as granting); catch up with it so our next pre-vote can
+	// succeed
+	for key, resp := range replies {
+		if rn.observeTerm(key, resp) {
+			return false
+		}
+	}
+	if rn.quorumLocked(func(key string) bool { return granted[key] }) {
+		return true
+	}
+	raftLog.Infof("Pre-vote for term %d failed with %d/%d votes", term, len(granted)+1, len(rn.peers)+1)
+	metrics.Inc("raft.prevotes_lost", 1)
+	return false
+}
+
+// handlePreVote tells a prospective candidate whether it would get our vote
+// at the term it proposes. Nothing is persisted and the election timer keeps
+// running.
+func (rn *RaftNode) handlePreVote(msg map[string]interface{}) map[string]interface{} {
+	term := int(numberOr(msg["term"], -1))
+
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	grant := term > rn.currentTerm &&
+		rn.state != "leader" &&
+		time.Since(rn.lastLeaderContact) >= rn.ElectionTimeout() &&
+		rn.candidateUpToDate(msg)
+
+	return map[string]interface{}{
+		"type":         VOTE_RESPONSE,
+		"term":         rn.currentTerm,
+		"vote_granted": grant,
+	}
+}
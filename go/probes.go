@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================================
+// Health and readiness probes
+// ============================================================================
+
+// The monitor answers two probes for Kubernetes and load balancers:
+//
+//	GET /healthz  200 {"status": "ok", "node_uuid": "...", "uptime": "1h2m3s"}
+//	GET /readyz   200 or 503 {"ready": false, "checked_at": "...", "checks": [
+//	                {"name": "raft_leader", "ok": false, "message": "no leader known (term 3)"},
+//	                {"name": "java_backend", "ok": true, "message": "bridge running (pid 4242)"},
+//	                {"name": "storage_models", "ok": true, "message": "/data/models writable"},
+//	                {"name": "disk_models", "ok": true, "message": "812 MB free"}, ...]}
+//
+// /healthz only says the process serves HTTP, so a liveness probe doesn't
+// restart a node that is merely waiting for an election. /readyz is 503
+// while no leader is known, the Java backend (with -backend=java) can't
+// run, a storage volume can't be written or has less than -min-free-mb
+// free, or the node is shutting down. Both answer without a monitor token.
+// Metric: readyz.not_ready.
+
+// probePaths are served without a monitor token
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "ok",
+		"node_uuid": raftNode.uuid,
+		"uptime":    time.Since(raftNode.started).Round(time.Second).String(),
+	})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := readinessNow()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Ready {
+		metrics.Inc("readyz.not_ready", 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// readinessNow runs the readiness checks; every failed one is fatal
+func readinessNow() *ReadinessReport {
+	report := &ReadinessReport{CheckedAt: time.Now().UTC().Format(time.RFC3339), Ready: true}
+	add := func(c ReadinessCheck) {
+		c.Fatal = true
+		report.Checks = append(report.Checks, c)
+		if !c.OK {
+			report.Ready = false
+		}
+	}
+
+	if isShuttingDown() {
+		add(ReadinessCheck{Name: "shutdown", Message: "shutting down"})
+	}
+	add(checkRaftLeader())
+	if modelBackend == BackendJava {
+		add(probeJavaBackend())
+	}
+	for _, v := range storageVolumes() {
+		add(probeStorageWritable(v))
+		add(probeDiskSpace(v))
+	}
+	return report
+}
+
+// checkRaftLeader passes while this node knows a leader
+func checkRaftLeader() ReadinessCheck {
+	c := ReadinessCheck{Name: "raft_leader"}
+	st := raftNode.Status()
+	if st.Leader == nil {
+		c.Message = fmt.Sprintf("no leader known (term %d)", st.Term)
+		return c
+	}
+	c.OK = true
+	c.Message = fmt.Sprintf("%s:%d (term %d)", st.Leader.Host, st.Leader.WorkerPort, st.Term)
+	return c
+}
+
+// probeJavaBackend checks the bridge JVM is up, or without a bridge that a
+// JVM could be started; unlike the self-test it doesn't run one
+func probeJavaBackend() ReadinessCheck {
+	c := ReadinessCheck{Name: "java_backend"}
+	if javaBridge != nil {
+		st := javaBridge.Status()
+		if running, _ := st["running"].(bool); !running {
+			c.Message = fmt.Sprintf("bridge JVM not running (%v restarts)", st["restarts"])
+			return c
+		}
+		c.OK = true
+		c.Message = fmt.Sprintf("bridge running (pid %v)", st["pid"])
+		return c
+	}
+	if _, err := exec.LookPath(javaExecutable()); err != nil {
+		c.Message = err.Error()
+		return c
+	}
+	if _, err := os.Stat(filepath.Join(currentJavaDir(), "TrainingModule.class")); err != nil {
+		c.Message = fmt.Sprintf("TrainingModule.class not found in %s", currentJavaDir())
+		return c
+	}
+	c.OK = true
+	c.Message = "java available, TrainingModule compiled"
+	return c
+}
+
+func probeStorageWritable(v StorageVolume) ReadinessCheck {
+	c := ReadinessCheck{Name: "storage_" + v.Name}
+	f, err := os.CreateTemp(v.Path, ".readyz-*")
+	if err != nil {
+		c.Message = fmt.Sprintf("%s is not writable: %v", v.Path, err)
+		return c
+	}
+	f.Close()
+	os.Remove(f.Name())
+	c.OK = true
+	c.Message = v.Path + " writable"
+	return c
+}
+
+func probeDiskSpace(v StorageVolume) ReadinessCheck {
+	c := ReadinessCheck{Name: "disk_" + v.Name}
+	if err := checkFreeSpace(v.Name, v.Path); err != nil {
+		c.Message = err.Error()
+		return c
+	}
+	c.OK = true
+	if free, err := diskFree(v.Path); err == nil {
+		c.Message = fmt.Sprintf("%d MB free", free>>20)
+	} else {
+		c.Message = "free space unknown"
+	}
+	return c
+}
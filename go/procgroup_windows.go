@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd alone: cancelling its context kills the
+// process, and Windows has no process groups to signal
+func killProcessGroup(cmd *exec.Cmd) {}
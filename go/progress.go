@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ============================================================================
+// Training progress streaming
+// ============================================================================
+
+// A TRAIN with "stream_progress": true gets PROGRESS messages before the
+// final answer on the same connection: one for every epoch line the
+// backend prints and, for a distributed training, one as each chunk
+// finishes:
+//
+//	{"status": "PROGRESS", "job_id": "...", "event": "epoch", "epoch": 101, "epochs": 1000, "loss": 0.0123}
+//	{"status": "PROGRESS", "job_id": "...", "event": "chunk_done", "chunk_id": 2,
+//	 "worker": "10.0.0.3:9000", "chunks_done": 3, "chunks": 4}
+//
+// Backends print every 100 epochs and the last one; a distributed job's
+// epochs are those of the chunk the leader trains. The lines reach the
+// handler through an observer carried by the context, which runJava feeds
+// from whichever path runs the command: the Java bridge, a one-off JVM or
+// the Go backend. Chunk completions come from the job event log
+// (jobevents.go). A follower proxying the TRAIN relays the leader's
+// PROGRESS messages as they arrive.
+
+type outputObserverKey struct{}
+
+// withOutputObserver returns a context whose backend commands report each
+// output line to observe as it is printed
+func withOutputObserver(ctx context.Context, observe func(line string)) context.Context {
+	return context.WithValue(ctx, outputObserverKey{}, observe)
+}
+
+// outputObserver returns the observer set by withOutputObserver, or nil
+func outputObserver(ctx context.Context) func(string) {
+	observe, _ := ctx.Value(outputObserverKey{}).(func(string))
+	return observe
+}
+
+// lineWriter collects a command's output and passes every complete line
+// to observe
+type lineWriter struct {
+	buf     bytes.Buffer
+	partial []byte
+	observe func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.observe(trimLine(string(w.partial[:i])))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// parseEpochLine parses the "Epoch n/m - Error: e" lines backends print
+func parseEpochLine(line string) (epoch, epochs int, loss float64, ok bool) {
+	n, _ := fmt.Sscanf(line, "Epoch %d/%d - Error: %g", &epoch, &epochs, &loss)
+	return epoch, epochs, loss, n == 3
+}
+
+// streamTrainingProgress returns a context that sends conn a PROGRESS
+// message for each epoch line and chunk completion of job's training, and
+// a stop that ends the stream before the final answer
+func streamTrainingProgress(ctx context.Context, conn net.Conn, jobID string) (context.Context, func()) {
+	var mu sync.Mutex
+	stopped := false
+	send := func(progress map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		progress["status"] = "PROGRESS"
+		progress["job_id"] = jobID
+		sendResponse(conn, progress)
+	}
+
+	chunks := 0
+	done := make(map[int]bool)
+	unwatch := jobEvents.Watch(jobID, func(e JobEvent) {
+		chunkID, ok := e.Detail["chunk_id"].(int)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		switch e.Type {
+		case JobChunkDispatched:
+			n, _ := e.Detail["chunks"].(int)
+			chunks = max(chunks, n)
+		case JobChunkDone:
+			done[chunkID] = true
+		}
+		chunksDone, total := len(done), chunks
+		mu.Unlock()
+		if e.Type == JobChunkDone {
+			worker, _ := e.Detail["worker"].(string)
+			if worker == "" {
+				worker = "local" // the leader's own chunk, recorded by subTrain
+			}
+			send(map[string]interface{}{
+				"event":       "chunk_done",
+				"chunk_id":    chunkID,
+				"worker":      worker,
+				"chunks_done": chunksDone,
+				"chunks":      total,
+			})
+		}
+	})
+
+	ctx = withOutputObserver(ctx, func(line string) {
+		if epoch, epochs, loss, ok := parseEpochLine(line); ok {
+			send(map[string]interface{}{"event": "epoch", "epoch": epoch, "epochs": epochs, "loss": loss})
+		}
+	})
+	return ctx, func() {
+		unwatch()
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Prometheus exporter
+// ============================================================================
+
+// /metrics on the HTTP monitor serves the metrics registry in the Prometheus
+// text format (0.0.4). Names get the "worker_" prefix with dots and dashes
+// turned into underscores; counters end in _total and timers become
+// histograms in seconds (worker_java_train_seconds, ...).
+
+const prometheusPrefix = "worker_"
+
+// prometheusName turns a registry name into a valid metric name
+func prometheusName(name string) string {
+	return prometheusPrefix + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(prometheusText()))
+}
+
+// prometheusText renders the registry in the Prometheus text format
+func prometheusText() string {
+	snap := metrics.Cumulative()
+	var b strings.Builder
+
+	for _, name := range sortedKeys(snap.Totals) {
+		metric := prometheusName(name) + "_total"
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s %d\n", metric, metric, snap.Totals[name])
+	}
+	for _, name := range sortedKeys(snap.Gauges) {
+		metric := prometheusName(name)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %s\n", metric, metric, formatFloat(snap.Gauges[name]))
+	}
+	for _, name := range sortedKeys(snap.Histograms) {
+		h := snap.Histograms[name]
+		metric := prometheusName(name) + "_seconds"
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", metric)
+		var cumulative int64
+		for i, bound := range histogramBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", metric, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", metric, h.count)
+		fmt.Fprintf(&b, "%s_sum %s\n%s_count %d\n", metric, formatFloat(h.sum), metric, h.count)
+	}
+
+	// Replication lag per follower, known only on the leader
+	metric := prometheusName("raft.peer_lag")
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metric)
+	for _, p := range raftNode.Status().Peers {
+		if p.Lag != nil {
+			fmt.Fprintf(&b, "%s{peer=%q} %d\n", metric, p.Address, *p.Lag)
+		}
+	}
+
+	return b.String()
+}
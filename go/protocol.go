@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ============================================================================
+// Protocol versioning for rolling upgrades
+// ============================================================================
+
+// Every RAFT RPC and client request may carry a "proto" field. Messages
+// without it come from releases that predate versioning, the Python and
+// Kotlin workers and plain clients, and are treated as version 0 and served
+// on the legacy paths. A node speaks the highest version both sides
+// understand, so a cluster can be upgraded one node at a time, but a
+// versioned message older than MinProtocolVersion is refused: version 1
+// nodes replicate without log matching and can't safely share a log with
+// this release. Clients get E_PROTOCOL, peers an "unsupported_protocol"
+// error, both with the supported range. A client that sends a version gets
+// the negotiated one back in "proto" on every response.
+//
+// Version history:
+//
+//	1: handshake ("proto" field, HELLO)
+//	2: RAFT log matching (prev_log_index/prev_log_term, last_log_index/term)
+//	3: gzip-compressed RAFT RPC bodies (compress.go)
+//	4: length-prefixed framing (framing.go)
+//	5: RAFT pre-vote (prevote.go)
+//	6: out-of-band file transfer, STORE_FILE_REF (filetransfer.go)
+const (
+	ProtocolVersion    = 6
+	MinProtocolVersion = logMatchingVersion
+)
+
+// protocolDowngrades rewrites a message from version v+1 into version v.
+// When a release changes a message format it registers the inverse here so
+// peers still on the older release keep working during the upgrade. The
+// changes since version 2 are negotiated per feature instead (compressed
+// bodies, framing, pre-vote and file references each check the peer's
+// version), so only the unversioned format needs a shim.
+var protocolDowngrades = map[int]func(map[string]interface{}) map[string]interface{}{
+	0: func(msg map[string]interface{}) map[string]interface{} {
+		// Version 0 has no handshake field; legacy nodes ignore unknown
+		// keys, but drop it so their logs stay clean.
+		delete(msg, "proto")
+		return msg
+	},
+}
+
+// peerProtocols remembers the version each remote address last spoke
+var peerProtocols = struct {
+	sync.RWMutex
+	versions map[string]int
+}{versions: make(map[string]int)}
+
+// messageProtocol returns the protocol version a message was encoded with
+func messageProtocol(msg map[string]interface{}) int {
+	if v, ok := msg["proto"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// notePeerProtocol records the version spoken by addr
+func notePeerProtocol(addr string, version int) {
+	peerProtocols.Lock()
+	peerProtocols.versions[addr] = version
+	peerProtocols.Unlock()
+}
+
+// negotiatedProtocol returns the version to use when talking to addr. Unknown
+// peers get the current version; a peer that turns out to be older answers
+// with its own version and is downgraded from then on.
+func negotiatedProtocol(addr string) int {
+	peerProtocols.RLock()
+	v, ok := peerProtocols.versions[addr]
+	peerProtocols.RUnlock()
+	if !ok || v > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return v
+}
+
+// knownPeerProtocol returns the version addr last answered with, or -1 if it
+// hasn't answered yet
+func knownPeerProtocol(addr string) int {
+	peerProtocols.RLock()
+	defer peerProtocols.RUnlock()
+	if v, ok := peerProtocols.versions[addr]; ok {
+		return v
+	}
+	return -1
+}
+
+// encodeForPeer stamps msg with the negotiated version and applies the
+// downgrade shims needed for older peers
+func encodeForPeer(addr string, msg map[string]interface{}) map[string]interface{} {
+	target := negotiatedProtocol(addr)
+
+	out := make(map[string]interface{}, len(msg)+1)
+	for k, v := range msg {
+		out[k] = v
+	}
+	out["proto"] = ProtocolVersion
+
+	for v := ProtocolVersion - 1; v >= target; v-- {
+		if shim, ok := protocolDowngrades[v]; ok {
+			out = shim(out)
+		}
+	}
+	if target > 0 {
+		out["proto"] = target
+	}
+	return out
+}
+
+// checkProtocol reports whether an incoming message uses a version this
+// node can still serve: none at all, or at least MinProtocolVersion
+func checkProtocol(msg map[string]interface{}) bool {
+	_, versioned := msg["proto"]
+	return !versioned || messageProtocol(msg) >= MinProtocolVersion
+}
+
+// protocolError answers a client whose version is no longer served
+func protocolError(msg map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"status":    "ERROR",
+		"code":      "E_PROTOCOL",
+		"message":   fmt.Sprintf("Protocol version %v is not supported; this node speaks %d to %d", msg["proto"], MinProtocolVersion, ProtocolVersion),
+		"proto":     ProtocolVersion,
+		"min_proto": MinProtocolVersion,
+	}
+}
+
+// clientProtocol returns the version to answer a client request with, or
+// 0 for an unversioned client
+func clientProtocol(msg map[string]interface{}) int {
+	if _, versioned := msg["proto"]; !versioned {
+		return 0
+	}
+	return min(messageProtocol(msg), ProtocolVersion)
+}
+
+// versionedConn stamps the negotiated version on the responses sent with
+// sendResponse
+type versionedConn struct {
+	net.Conn
+	proto int
+}
+
+// handleHello answers a client handshake with the supported version range
+func handleHello(conn net.Conn, msg map[string]interface{}) {
+	sendResponse(conn, map[string]interface{}{
+		"status":       "OK",
+		"proto":        ProtocolVersion,
+		"min_proto":    MinProtocolVersion,
+		"client_proto": messageProtocol(msg),
+	})
+}
+
+// protocolStatus reports versions for the monitor
+func protocolStatus() map[string]interface{} {
+	peerProtocols.RLock()
+	defer peerProtocols.RUnlock()
+
+	peers := make(map[string]int, len(peerProtocols.versions))
+	for k, v := range peerProtocols.versions {
+		peers[k] = v
+	}
+	return map[string]interface{}{
+		"version":     ProtocolVersion,
+		"min_version": MinProtocolVersion,
+		"peers":       peers,
+	}
+}
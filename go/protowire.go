@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ============================================================================
+// Protocol Buffers wire format
+// ============================================================================
+
+// Just enough of the protobuf encoding for the messages of
+// proto/worker.proto (grpc.go): varints, doubles, strings and nested
+// messages. Fields are written in proto3 style (zero values omitted) and
+// read in any order; unknown fields are skipped.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoWriter builds a message
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wire int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, protoVarint)
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *protoWriter) int(field int, v int64) {
+	w.uint(field, uint64(v))
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.uint(field, 1)
+	}
+}
+
+// double writes v unless it is 0; optionalDouble always writes it
+func (w *protoWriter) double(field int, v float64) {
+	if v != 0 {
+		w.optionalDouble(field, v)
+	}
+}
+
+func (w *protoWriter) optionalDouble(field int, v float64) {
+	w.tag(field, protoFixed64)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+// doubles writes a packed repeated double
+func (w *protoWriter) doubles(field int, vs []float64) {
+	if len(vs) == 0 {
+		return
+	}
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(8*len(vs)))
+	for _, v := range vs {
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+	}
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// message writes a nested message, even an empty one
+func (w *protoWriter) message(field int, m *protoWriter) {
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(m.buf)))
+	w.buf = append(w.buf, m.buf...)
+}
+
+// protoField is one field read from a message
+type protoField struct {
+	num   int
+	wire  int
+	value uint64 // varint and fixed wire types
+	data  []byte // length-delimited
+}
+
+// readProto calls fn with every field of data, in order
+func readProto(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case protoVarint:
+			if f.value, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			f.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			f.value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errProtoTruncated
+			}
+			f.data, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+		if f.num == 0 {
+			return errors.New("protobuf: field number 0")
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f protoField) string() string {
+	return string(f.data)
+}
+
+func (f protoField) int() int64 {
+	return int64(f.value)
+}
+
+func (f protoField) bool() bool {
+	return f.value != 0
+}
+
+// doubles appends the values of a repeated double, packed or not
+func (f protoField) doubles(vs []float64) ([]float64, error) {
+	switch f.wire {
+	case protoFixed64:
+		return append(vs, math.Float64frombits(f.value)), nil
+	case protoBytes:
+		if len(f.data)%8 != 0 {
+			return nil, errProtoTruncated
+		}
+		for i := 0; i < len(f.data); i += 8 {
+			vs = append(vs, math.Float64frombits(binary.LittleEndian.Uint64(f.data[i:])))
+		}
+		return vs, nil
+	default:
+		return nil, errors.New("protobuf: expected a double")
+	}
+}
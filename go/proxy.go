@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// Leader forwarding for non-leaders
+// ============================================================================
+
+// Non-leader behaviour for requests that must run on the leader
+const (
+	NonLeaderRedirect = "redirect" // answer REDIRECT with the leader's address
+	NonLeaderProxy    = "proxy"    // forward to the leader and relay its answer
+)
+
+var (
+	nonLeaderMode = NonLeaderRedirect
+	proxyTimeout  = 10 * time.Minute
+)
+
+// redirectResponse is the REDIRECT answer for leader. Besides the leader's
+// address it lists every node this one knows, itself included, with its
+// client address and role, so a client can refresh its view of the cluster
+// and fail over to another node when the leader goes away:
+//
+//	{"status": "REDIRECT", "leader": ["10.0.0.2", 9000], "peers": [
+//	  {"host": "10.0.0.2", "worker_port": 9000, "role": "leader", "reachable": true},
+//	  {"host": "10.0.0.1", "worker_port": 9000, "role": "follower", "self": true, "reachable": true}]}
+//
+// "reachable" is this node's view: whether its last RAFT exchange with the
+// peer succeeded or, for the leader, whether it heard from the leader within
+// an election timeout.
+func redirectResponse(leader *LeaderInfo) map[string]interface{} {
+	st := raftNode.Status()
+	role := func(host string, workerPort int) string {
+		if host == leader.Host && workerPort == leader.WorkerPort {
+			return "leader"
+		}
+		return "follower"
+	}
+
+	peers := make([]map[string]interface{}, 0, len(st.Peers)+1)
+	peers = append(peers, map[string]interface{}{
+		"host":        raftNode.host,
+		"worker_port": raftNode.workerPort,
+		"role":        role(raftNode.host, raftNode.workerPort),
+		"self":        true,
+		"reachable":   true,
+	})
+	for _, p := range st.Peers {
+		node, ok := addressBook.Lookup(p.Address)
+		if !ok {
+			continue
+		}
+		r := role(node.Host, node.WorkerPort)
+		peers = append(peers, map[string]interface{}{
+			"host":        node.Host,
+			"worker_port": node.WorkerPort,
+			"role":        r,
+			"reachable":   p.Reachable || r == "leader" && raftNode.heardFromLeader(),
+		})
+	}
+	return map[string]interface{}{
+		"status": "REDIRECT",
+		"leader": []interface{}{leader.Host, leader.WorkerPort},
+		"peers":  peers,
+	}
+}
+
+// heardFromLeader reports whether a follower got an AppendEntries from the
+// leader within an election timeout; followers don't send the leader RPCs,
+// so their peer health never marks it reachable
+func (rn *RaftNode) heardFromLeader() bool {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return time.Since(rn.lastLeaderContact) < rn.ElectionTimeout()
+}
+
+// forwardToLeader answers a leader-only request received by a follower,
+// either redirecting the client or proxying the request. A request that was
+// already proxied once is always redirected, so a stale leader hint can never
+// bounce a request around the cluster. When the leader can't be reached the
+// client is redirected after all, unless the request may have reached it:
+// then retrying could run it twice, and the client gets E_PROXY instead.
+func forwardToLeader(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	leader := raftNode.GetLeader()
+	if leader == nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "No leader available"})
+		return
+	}
+
+	proxied, _ := msg["proxied"].(bool)
+	if modelStateMachine.Settings().String("non_leader") != NonLeaderProxy || proxied {
+		sendResponse(conn, redirectResponse(leader))
+		return
+	}
+
+	addr := net.JoinHostPort(leader.Host, strconv.Itoa(leader.WorkerPort))
+	msgType, _ := msg["type"].(string)
+	tcpLog.Infof("Proxying %s to leader %s", msgType, addr)
+
+	forward := make(map[string]interface{}, len(msg)+1)
+	for k, v := range msg {
+		forward[k] = v
+	}
+	forward["proxied"] = true
+	if ms := remainingTimeoutMs(ctx); ms > 0 {
+		forward["timeout_ms"] = ms
+	}
+
+	defer metrics.Since("proxy."+msgType, time.Now())
+	var relay func(map[string]interface{})
+	if stream, _ := msg["stream_progress"].(bool); stream {
+		relay = func(progress map[string]interface{}) { sendResponse(conn, progress) }
+	}
+	resp, err := sendClientMessageStream(ctx, addr, forward, proxyTimeout, relay)
+	if err != nil {
+		if requestTimedOut(conn, ctx, msgType) {
+			return
+		}
+		if ctx.Err() != nil {
+			tcpLog.Warnf("Client disconnected, abandoned proxied %s", msgType)
+			return
+		}
+		metrics.Inc("proxy.errors", 1)
+		if errors.Is(err, errNotSent) {
+			tcpLog.Warnf("Cannot proxy %s to %s, redirecting: %v", msgType, addr, err)
+			sendResponse(conn, redirectResponse(leader))
+			return
+		}
+		sendResponse(conn, map[string]interface{}{
+			"status":  "ERROR",
+			"code":    "E_PROXY",
+			"message": "Leader unreachable: " + err.Error(),
+			"leader":  []interface{}{leader.Host, leader.WorkerPort},
+		})
+		return
+	}
+	delete(resp, "proto")
+	sendResponse(conn, resp)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Model quarantine
+// ============================================================================
+
+// A model whose predictions keep failing in the backend is quarantined
+// instead of letting every caller find out for itself. Each node counts the
+// consecutive PREDICT and PREDICT_BATCH failures of each model (a success
+// resets the count; full queues and timeouts don't count) and after
+// -quarantine-after of them asks the leader to quarantine it:
+//
+//	{"type": "QUARANTINE_MODEL", "model_id": "...", "reason": "5 consecutive predictions failed",
+//	 "failures": 5, "node": "10.0.0.2:8000", "auto": true}
+//	-> {"status": "OK", "model_id": "...", "quarantine": {"reason": "...", "since": "...", ...}}
+//
+// Operators send the same request, and UNQUARANTINE_MODEL {"model_id"}
+// releases a model; both need admin. The flag is a QUARANTINE entry in the
+// RAFT log and lives in the model's metadata, so every node then answers
+// PREDICT and PREDICT_BATCH for it, aliases included, with E_QUARANTINED,
+// and LIST_MODELS leaves it out of models and details unless the request
+// sets "include_quarantined": true; the ids it left out are listed in
+// "quarantined". EVALUATE still runs, to check a fix. SET_ALIAS can't point
+// an alias at a quarantined model.
+//
+// The leader logs an error, publishes a model_quarantined live update and,
+// with -quarantine-webhook, POSTs {"event": "model_quarantined", "model_id",
+// "reason", "failures", "node", "aliases", "at"}. -quarantine-after 0 turns
+// automatic quarantine off. Metrics: models.quarantined, models.released,
+// predict.quarantined.
+
+var (
+	quarantineAfter   = 5 // consecutive failed predictions; 0 = never
+	quarantineWebhook string
+)
+
+// quarantineReportTimeout bounds a follower's QUARANTINE_MODEL to the leader
+const quarantineReportTimeout = 10 * time.Second
+
+// QuarantineInfo records why and since when a model is withheld from serving
+type QuarantineInfo struct {
+	Reason   string `json:"reason"`
+	Since    string `json:"since"`
+	Failures int    `json:"failures,omitempty"`
+	Node     string `json:"node,omitempty"` // whose predictions failed
+	Auto     bool   `json:"auto,omitempty"` // set by a node rather than an operator
+}
+
+// quarantineFor returns the registry id of the model at modelPath, which
+// the backend may have named apart from its file, and its quarantine if any
+func quarantineFor(modelPath string) (string, *QuarantineInfo) {
+	meta, ok := modelStateMachine.Registry().Get(modelIDFromPath(modelPath), filepath.Base(modelPath))
+	if !ok {
+		return modelIDFromPath(modelPath), nil
+	}
+	return meta.ModelID, meta.Quarantine
+}
+
+// checkQuarantine answers a prediction for a quarantined model itself
+func checkQuarantine(conn net.Conn, msg map[string]interface{}, modelPath string) bool {
+	modelID, q := quarantineFor(modelPath)
+	if q == nil {
+		return true
+	}
+	metrics.Inc("predict.quarantined", 1)
+	sendResponse(conn, map[string]interface{}{
+		"status":     "ERROR",
+		"code":       "E_QUARANTINED",
+		"message":    fmt.Sprintf("Model %s is quarantined: %s", modelID, q.Reason),
+		"model_id":   modelID,
+		"quarantine": q,
+		"session":    currentSession(msg),
+	})
+	return false
+}
+
+// listQuarantined reports whether a LIST_MODELS wants quarantined models
+func listQuarantined(msg map[string]interface{}) bool {
+	include, _ := msg["include_quarantined"].(bool)
+	return include
+}
+
+// quarantinedModels returns the ids of the quarantined models, sorted
+func quarantinedModels() []string {
+	var ids []string
+	for id, m := range modelStateMachine.Registry().All() {
+		if m.Quarantine != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// dropQuarantinedIDs filters the quarantined models out of a list of model
+// file ids
+func dropQuarantinedIDs(ids []string) []string {
+	kept := ids[:0:0]
+	for _, id := range ids {
+		if meta, ok := modelStateMachine.Registry().Get(id, "model_"+id+".bin"); !ok || meta.Quarantine == nil {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// dropQuarantinedDetails filters the quarantined models out of registry
+// entries
+func dropQuarantinedDetails(details []*ModelMetadata) []*ModelMetadata {
+	kept := details[:0:0]
+	for _, m := range details {
+		if m.Quarantine == nil {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// predictFailures counts each model's consecutive failed predictions on
+// this node
+type predictFailures struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	reported map[string]bool // quarantine requested, awaiting the leader
+}
+
+var predictionFailures = &predictFailures{counts: make(map[string]int), reported: make(map[string]bool)}
+
+// Succeeded resets the model's count
+func (f *predictFailures) Succeeded(modelPath string) {
+	if quarantineAfter == 0 {
+		return
+	}
+	f.mu.Lock()
+	counting := len(f.counts) > 0
+	f.mu.Unlock()
+	if !counting {
+		return
+	}
+	modelID, _ := quarantineFor(modelPath)
+	f.mu.Lock()
+	delete(f.counts, modelID)
+	f.mu.Unlock()
+}
+
+// Failed counts a failed prediction and asks for the model's quarantine
+// once the count reaches -quarantine-after
+func (f *predictFailures) Failed(modelPath string) {
+	if quarantineAfter == 0 {
+		return
+	}
+	modelID, _ := quarantineFor(modelPath)
+	f.mu.Lock()
+	f.counts[modelID]++
+	n := f.counts[modelID]
+	trip := n >= quarantineAfter && !f.reported[modelID]
+	if trip {
+		f.reported[modelID] = true
+	}
+	f.mu.Unlock()
+	if trip {
+		go f.report(modelID, n)
+	}
+}
+
+// Reset forgets a model, once it is quarantined or released
+func (f *predictFailures) Reset(modelID string) {
+	f.mu.Lock()
+	delete(f.counts, modelID)
+	delete(f.reported, modelID)
+	f.mu.Unlock()
+}
+
+// report asks the leader to quarantine a model; on failure the next failed
+// prediction tries again
+func (f *predictFailures) report(modelID string, failures int) {
+	info := &QuarantineInfo{
+		Reason:   fmt.Sprintf("%d consecutive predictions failed", failures),
+		Failures: failures,
+		Node:     raftNode.id,
+		Auto:     true,
+	}
+	predictLog.Warnf("model %s: %s, requesting quarantine", modelID, info.Reason)
+
+	var resp map[string]interface{}
+	var err error
+	if raftNode.IsLeader() {
+		resp = setQuarantine(modelID, info)
+	} else if leader := raftNode.GetLeader(); leader == nil {
+		err = fmt.Errorf("no leader available")
+	} else {
+		msg := map[string]interface{}{
+			"type":     "QUARANTINE_MODEL",
+			"model_id": modelID,
+			"reason":   info.Reason,
+			"failures": failures,
+			"node":     info.Node,
+			"auto":     true,
+		}
+		addr := net.JoinHostPort(leader.Host, strconv.Itoa(leader.WorkerPort))
+		resp, err = sendClientMessageContext(context.Background(), addr, msg, quarantineReportTimeout)
+	}
+	if err == nil && resp["status"] != "OK" {
+		err = fmt.Errorf("%v", resp["message"])
+	}
+	if err != nil {
+		predictLog.Errorf("cannot quarantine model %s: %v", modelID, err)
+		f.mu.Lock()
+		delete(f.reported, modelID)
+		f.mu.Unlock()
+	}
+}
+
+// setQuarantine quarantines a model, or releases it when info is nil, and
+// returns the answer to the request. Only the leader calls it.
+func setQuarantine(name string, info *QuarantineInfo) map[string]interface{} {
+	modelID := modelStateMachine.ResolveAlias(name)
+	modelPath, ok := modelStateMachine.ModelPath(modelID)
+	if !ok {
+		return map[string]interface{}{"status": "ERROR", "message": "Model not found"}
+	}
+	// Several nodes may report the same model; the first report wins
+	_, current := quarantineFor(modelPath)
+	if info == nil && current == nil || info != nil && info.Auto && current != nil {
+		return map[string]interface{}{"status": "OK", "model_id": modelID, "quarantine": current}
+	}
+	if info != nil {
+		info.Since = time.Now().UTC().Format(time.RFC3339)
+		if info.Reason == "" {
+			info.Reason = "quarantined by an operator"
+		}
+	}
+
+	index, err := replicateCommand(&QuarantineCommand{ModelID: modelID, Quarantine: info})
+	if err != nil {
+		return map[string]interface{}{"status": "ERROR", "message": err.Error()}
+	}
+	modelStateMachine.WaitApplied(index, reserveWaitTimeout)
+	if info != nil {
+		alertQuarantine(modelID, info)
+	} else {
+		metrics.Inc("models.released", 1)
+		predictLog.Infof("model %s released from quarantine", modelID)
+	}
+	return map[string]interface{}{"status": "OK", "model_id": modelID, "quarantine": info, "session": sessionToken(index)}
+}
+
+// alertQuarantine tells operators a model was quarantined
+func alertQuarantine(modelID string, info *QuarantineInfo) {
+	metrics.Inc("models.quarantined", 1)
+	aliases := modelStateMachine.AliasesFor(modelID)
+	predictLog.Errorf("model %s quarantined: %s (aliases %v)", modelID, info.Reason, aliases)
+	postWebhook(quarantineWebhook, map[string]interface{}{
+		"event":    "model_quarantined",
+		"model_id": modelID,
+		"reason":   info.Reason,
+		"failures": info.Failures,
+		"node":     info.Node,
+		"aliases":  aliases,
+		"at":       info.Since,
+	})
+}
+
+// QuarantineCommand quarantines a model, or releases it when Quarantine is
+// nil
+type QuarantineCommand struct {
+	ModelID    string          `json:"model_id"`
+	Quarantine *QuarantineInfo `json:"quarantine"`
+}
+
+func (c *QuarantineCommand) Action() string { return "QUARANTINE" }
+
+func (c *QuarantineCommand) Validate() error {
+	if c.ModelID == "" {
+		return fmt.Errorf("missing model_id")
+	}
+	return nil
+}
+
+func (c *QuarantineCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.RLock()
+	path, ok := sm.models[c.ModelID]
+	sm.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown model %s", c.ModelID)
+	}
+	sm.registry.SetQuarantine(c.ModelID, filepath.Base(path), c.Quarantine)
+	predictionFailures.Reset(c.ModelID)
+	if c.Quarantine != nil {
+		liveUpdates.Publish("model_quarantined", map[string]interface{}{"model_id": c.ModelID, "reason": c.Quarantine.Reason})
+		raftLog.Infof("applied QUARANTINE: %s (%s)", c.ModelID, c.Quarantine.Reason)
+	} else {
+		liveUpdates.Publish("model_released", map[string]interface{}{"model_id": c.ModelID})
+		raftLog.Infof("applied QUARANTINE: %s released", c.ModelID)
+	}
+	return nil
+}
+
+// handleQuarantineModel serves QUARANTINE_MODEL and, with quarantine
+// false, UNQUARANTINE_MODEL
+func handleQuarantineModel(ctx context.Context, conn net.Conn, msg map[string]interface{}, quarantine bool) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	var info *QuarantineInfo
+	if quarantine {
+		info = &QuarantineInfo{}
+		info.Reason, _ = msg["reason"].(string)
+		failures, _ := msg["failures"].(float64)
+		info.Failures = int(failures)
+		info.Node, _ = msg["node"].(string)
+		info.Auto, _ = msg["auto"].(bool)
+	}
+	tcpLog.Infof("%s request: %s", msg["type"], modelID)
+	sendResponse(conn, setQuarantine(modelID, info))
+}
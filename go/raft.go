@@ -2,25 +2,39 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
-	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 
 // RAFT message types
 const (
-	REQUEST_VOTE    = "REQUEST_VOTE"
-	VOTE_RESPONSE   = "VOTE_RESPONSE"
-	APPEND_ENTRIES  = "APPEND_ENTRIES"
-	APPEND_RESPONSE = "APPEND_RESPONSE"
+	REQUEST_VOTE     = "REQUEST_VOTE"
+	VOTE_RESPONSE    = "VOTE_RESPONSE"
+	APPEND_ENTRIES   = "APPEND_ENTRIES"
+	APPEND_RESPONSE  = "APPEND_RESPONSE"
+	STATE_QUERY      = "STATE_QUERY"
+	INSTALL_SNAPSHOT = "INSTALL_SNAPSHOT"
+	TIMEOUT_NOW      = "TIMEOUT_NOW"
+	PRE_VOTE         = "PRE_VOTE"
 )
 
+// logMatchingVersion is the first protocol version whose nodes check
+// prev_log_index/prev_log_term and the election restriction. Older peers
+// blindly append whatever they are sent.
+const logMatchingVersion = 2
+
+
+// maxEntriesPerRPC bounds one AppendEntries batch while a follower catches up
+const maxEntriesPerRPC = 64
+
 // Peer represents a RAFT peer
 type Peer struct {
 	Host       string
@@ -47,12 +61,38 @@ type RaftNode struct {
 	host       string
 	port       int
 	workerPort int
-	peers      []Peer
-
-	// Persistent state
-	currentTerm int
-	votedFor    string
-	log         []LogEntry
+	peers      []Peer // replication targets: -peers, or the configuration's members
+
+	// Persistent identity (identity.go): UUID, start time, the UUIDs peers
+	// reported and the twins already reported
+	uuid      string
+	started   time.Time
+	peerUUIDs map[string]string
+	twins     map[string]bool
+
+	// Scheduling labels (labels.go): this node's, fixed at start, and the
+	// ones peers stamp on their RPCs
+	labels     Labels
+	peerLabels map[string]Labels
+
+	// Cluster configuration (membership.go): latest MEMBERSHIP entry in the
+	// log and its index, nil while the cluster still runs on -peers
+	staticPeers []Peer
+	config      *clusterConfig
+	configIndex int
+	joining     bool       // don't campaign until a configuration includes us
+	configMu    sync.Mutex // serializes membership changes on the leader
+
+	// Persistent state. log holds the entries after the snapshot: global
+	// index i lives at log[i-snapshotIndex-1].
+	currentTerm    int
+	votedFor       string
+	log            []LogEntry
+	snapshotIndex  int            // last index covered by the snapshot, -1 if none
+	snapshotTerm   int            // term of the entry at snapshotIndex
+	snapshotState  []byte         // state machine state at snapshotIndex
+	snapshotPeers  []Peer         // cluster members at snapshotIndex
+	snapshotConfig *clusterConfig // MEMBERSHIP configuration at snapshotIndex
 
 	// Volatile state
 	commitIndex int
@@ -66,52 +106,158 @@ type RaftNode struct {
 	state  string // "follower", "candidate", "leader"
 	leader *LeaderInfo
 
-	// Synchronization
-	mu            sync.RWMutex
-	electionTimer *time.Timer
-	stopCh        chan struct{}
+	// Last time a current leader contacted us; votes are refused shortly
+	// after so removed servers can't disrupt the cluster
+	lastLeaderContact time.Time
+
+	// Set by TIMEOUT_NOW: the next election is a leadership transfer
+	transferElection bool
+
+	// Synchronization. The role loop (roleloop.go) owns the timers; others
+	// signal it through timerReset and campaign.
+	mu         sync.RWMutex
+	timerReset chan struct{}
+	campaign   chan struct{}
+	stopCh     chan struct{}
+
+	// Election timeout (timeouts.go) and the leader's RTT to each follower
+	electionTimeout atomic.Int64
+	rtts            map[string]*rttEstimate
+
+	// State machine fed with committed entries, in log order
+	stateMachine StateMachine
+	applyMu      sync.Mutex
+	applyQueue   []applyMsg
+	applyNotify  chan struct{}
+	applyExec    sync.Mutex // held while the state machine runs; taken before rn.mu
+
+	// Snapshots: threshold of applied entries between snapshots (0 = never)
+	// and the INSTALL_SNAPSHOT transfer being received
+	snapshotThreshold int
+	snapshotRecv      snapshotTransfer
+
+	// Persistence: checkpoint plus write-ahead log (wal.go)
+	persistencePath string
+	wal             *raftWAL
+
+	// Peer health: last successful RPC and consecutive failures per peer
+	peerLastContact map[string]time.Time
+	peerFailures    map[string]int
 
-	// Configuration
-	heartbeatInterval time.Duration
+	// Replication flow control per peer
+	flowMu sync.Mutex
+	flows  map[string]*peerFlow
 
-	// Callback for applying committed entries
-	applyCallback func(map[string]interface{})
+	// One AppendEntries sender per peer (peer key -> *sync.Mutex)
+	sendLocks sync.Map
 
-	// Persistence
-	persistencePath string
+	// Small commands ride on heartbeats (piggyback.go): flushCh asks the
+	// leader loop for an early heartbeat, commitNotify is closed and
+	// replaced whenever the leader advances commitIndex
+	flushCh      chan struct{}
+	commitNotify chan struct{}
+}
+
+// PeerHealth describes how reachable a peer has been recently
+type PeerHealth struct {
+	Address     string   `json:"address"`
+	UUID        string   `json:"node_uuid,omitempty"`
+	Labels      Labels   `json:"labels,omitempty"`
+	WorkerPort  int      `json:"worker_port"`
+	Reachable   bool     `json:"reachable"`
+	LastContact string   `json:"last_contact,omitempty"`
+	Failures    int      `json:"consecutive_failures"`
+	MatchIndex  *int     `json:"match_index,omitempty"`
+	Lag         *int     `json:"lag,omitempty"`
+	RTT         *float64 `json:"rtt_ms,omitempty"` // smoothed AppendEntries round trip
+	Inflight    int      `json:"inflight_entries"`
+	InflightB   int64    `json:"inflight_bytes"`
+	Paused      bool     `json:"paused"`
+	Skipped     int64    `json:"skipped_sends"`
+}
+
+// RaftStatus is an immutable snapshot of the node's consensus state
+type RaftStatus struct {
+	ID          string         `json:"id"`
+	UUID        string         `json:"node_uuid,omitempty"`
+	Labels      Labels         `json:"labels,omitempty"`
+	Role        string         `json:"state"`
+	Term        int            `json:"term"`
+	Leader      *LeaderInfo    `json:"leader"`
+	LogLength   int            `json:"log_length"`
+	SnapshotIdx int            `json:"snapshot_index"`
+	CommitIndex int            `json:"commit_index"`
+	LastApplied int            `json:"last_applied"`
+	ElectionMs  int64          `json:"election_timeout_ms"`
+	Peers       []PeerHealth   `json:"peers"`
+	Config      *clusterConfig `json:"config,omitempty"` // nil while running on -peers
+}
+
+// applyMsg is a committed entry waiting to be applied
+type applyMsg struct {
+	index   int
+	command map[string]interface{}
 }
 
 // NewRaftNode creates a new RAFT node
 func NewRaftNode(id, host string, port int, peers []Peer, workerPort int) *RaftNode {
-	return &RaftNode{
+	rn := &RaftNode{
 		id:                id,
 		host:              host,
 		port:              port,
 		workerPort:        workerPort,
 		peers:             peers,
+		started:           time.Now(),
+		peerUUIDs:         make(map[string]string),
+		peerLabels:        make(map[string]Labels),
+		twins:             make(map[string]bool),
+		staticPeers:       peers,
+		configIndex:       -1,
 		currentTerm:       0,
 		votedFor:          "",
 		log:               []LogEntry{},
+		snapshotIndex:     -1,
 		commitIndex:       -1,
 		lastApplied:       -1,
 		nextIndex:         make(map[string]int),
 		matchIndex:        make(map[string]int),
 		state:             "follower",
+		timerReset:        make(chan struct{}, 1),
+		campaign:          make(chan struct{}, 1),
 		stopCh:            make(chan struct{}),
-		heartbeatInterval: 1 * time.Second,
+		applyNotify:       make(chan struct{}, 1),
+		rtts:              make(map[string]*rttEstimate),
+		peerLastContact:   make(map[string]time.Time),
+		peerFailures:      make(map[string]int),
+		flows:             make(map[string]*peerFlow),
+		flushCh:           make(chan struct{}, 1),
+		commitNotify:      make(chan struct{}),
 	}
+	rn.electionTimeout.Store(int64(clampElectionTimeout(defaultElectionTimeout)))
+	return rn
 }
 
-// Start begins the RAFT node operation
-func (rn *RaftNode) Start() {
+// Start begins the RAFT node operation. It fails when the persisted state
+// exists but can't be read (statefile.go).
+func (rn *RaftNode) Start() error {
 	// Load persisted state if available
-	rn.loadState()
+	if err := rn.loadState(); err != nil {
+		return err
+	}
+	rn.loadSnapshot()
+	rn.mu.Lock()
+	rn.refreshConfigLocked()
+	rn.mu.Unlock()
 	
 	// Start RPC server
 	go rn.startRPCServer()
 
-	// Start election timer
-	rn.resetElectionTimeout()
+	// Apply committed entries in order
+	go rn.runApplier()
+
+	// Run the election timer, elections and the leader's heartbeats
+	go rn.run()
+	return nil
 }
 
 // SetPersistencePath sets the directory for RAFT state persistence
@@ -121,68 +267,86 @@ func (rn *RaftNode) SetPersistencePath(path string) {
 	rn.persistencePath = path
 }
 
-// saveState persists current term, votedFor, and log to disk
-func (rn *RaftNode) saveState() {
+// saveState persists current term, votedFor, and log to disk: a record in
+// the write-ahead log, or a new checkpoint when one is due. Errors are
+// logged and returned for callers that must not answer before the state is
+// durable.
+func (rn *RaftNode) saveState() error {
 	if rn.persistencePath == "" {
-		return
+		return nil
 	}
 	
-	stateFile := filepath.Join(rn.persistencePath, "raft_state.json")
 	os.MkdirAll(rn.persistencePath, 0755)
 	
-	state := map[string]interface{}{
-		"current_term": rn.currentTerm,
-		"voted_for":    rn.votedFor,
-		"log":          rn.log,
-	}
-	
-	data, err := json.Marshal(state)
-	if err != nil {
-		logMsg("RAFT: Error marshaling state: %v", err)
-		return
-	}
-	
-	// Atomic write using temp file
-	tempFile := stateFile + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		logMsg("RAFT: Error writing state: %v", err)
-		return
-	}
-	if err := os.Rename(tempFile, stateFile); err != nil {
-		logMsg("RAFT: Error renaming state file: %v", err)
+	if err := rn.persistLocked(); err != nil {
+		raftLog.Errorf("Error saving state: %v", err)
+		metrics.Inc("raft.persist_errors", 1)
+		return err
 	}
+	return nil
 }
 
 // loadState loads persisted state from disk
-func (rn *RaftNode) loadState() {
+func (rn *RaftNode) loadState() error {
 	if rn.persistencePath == "" {
-		return
+		return nil
 	}
 	
-	stateFile := filepath.Join(rn.persistencePath, "raft_state.json")
-	data, err := os.ReadFile(stateFile)
+	state, found, err := readPersistedState(rn.persistencePath)
 	if err != nil {
-		return // File doesn't exist yet
-	}
-	
-	var state struct {
-		CurrentTerm int        `json:"current_term"`
-		VotedFor    string     `json:"voted_for"`
-		Log         []LogEntry `json:"log"`
+		return fmt.Errorf("cannot load RAFT state: %v", err)
 	}
-	
-	if err := json.Unmarshal(data, &state); err != nil {
-		logMsg("RAFT: Error loading state: %v", err)
-		return
+	if !found {
+		return nil // Nothing saved yet
 	}
 	
 	rn.mu.Lock()
 	rn.currentTerm = state.CurrentTerm
 	rn.votedFor = state.VotedFor
 	rn.log = state.Log
+	rn.snapshotIndex = state.SnapshotIndex
+	rn.snapshotTerm = state.SnapshotTerm
+	// Fold the replayed records into a checkpoint and start a clean log
+	rn.wal = &raftWAL{seq: state.WALSeq}
+	err = rn.checkpointLocked()
 	rn.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot checkpoint RAFT state: %v", err)
+	}
 	
-	logMsg("RAFT: Loaded state from disk (term=%d, log_len=%d)", state.CurrentTerm, len(state.Log))
+	raftLog.Infof("Loaded state from disk (term=%d, log_len=%d, snapshot_index=%d)",
+		state.CurrentTerm, state.SnapshotIndex+1+len(state.Log), state.SnapshotIndex)
+	return nil
+}
+
+// persistedState is the on-disk layout of raft_state.json
+type persistedState struct {
+	CurrentTerm   int        `json:"current_term"`
+	VotedFor      string     `json:"voted_for"`
+	Log           []LogEntry `json:"log"`
+	SnapshotIndex int        `json:"snapshot_index"`
+	SnapshotTerm  int        `json:"snapshot_term"`
+	WALSeq        int64      `json:"wal_seq,omitempty"` // last write-ahead log record included
+}
+
+// lastLogIndex returns the global index of the last entry; callers hold rn.mu
+func (rn *RaftNode) lastLogIndex() int {
+	return rn.snapshotIndex + len(rn.log)
+}
+
+// termAt returns the term of the entry at a global index, 0 before the start
+// of the log and -1 when the entry was compacted away or doesn't exist yet.
+// Callers hold rn.mu.
+func (rn *RaftNode) termAt(index int) int {
+	switch {
+	case index < 0:
+		return 0
+	case index == rn.snapshotIndex:
+		return rn.snapshotTerm
+	case index < rn.snapshotIndex || index > rn.lastLogIndex():
+		return -1
+	}
+	return rn.log[index-rn.snapshotIndex-1].Term
 }
 
 // Stop halts the RAFT node
@@ -197,6 +361,68 @@ func (rn *RaftNode) IsLeader() bool {
 	return rn.state == "leader"
 }
 
+// Status returns a consistent snapshot of the node's consensus state. Callers
+// outside the RAFT goroutines must use this instead of reading fields directly.
+func (rn *RaftNode) Status() RaftStatus {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	st := RaftStatus{
+		ID:          rn.id,
+		UUID:        rn.uuid,
+		Labels:      rn.labels,
+		Role:        rn.state,
+		Term:        rn.currentTerm,
+		LogLength:   rn.lastLogIndex() + 1,
+		SnapshotIdx: rn.snapshotIndex,
+		Config:      rn.config,
+		CommitIndex: rn.commitIndex,
+		ElectionMs:  rn.ElectionTimeout().Milliseconds(),
+		Peers:       make([]PeerHealth, 0, len(rn.peers)),
+	}
+	if rn.leader != nil {
+		leader := *rn.leader
+		st.Leader = &leader
+	}
+	rn.applyMu.Lock()
+	st.LastApplied = rn.lastApplied
+	rn.applyMu.Unlock()
+
+	for _, p := range rn.peers {
+		key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+		h := PeerHealth{
+			Address:    key,
+			UUID:       rn.peerUUIDs[key],
+			Labels:     rn.peerLabels[key],
+			WorkerPort: p.WorkerPort,
+			Failures:   rn.peerFailures[key],
+		}
+		if t, ok := rn.peerLastContact[key]; ok {
+			h.LastContact = t.UTC().Format(time.RFC3339)
+			h.Reachable = h.Failures == 0
+		}
+		if rn.state == "leader" {
+			if m, ok := rn.matchIndex[key]; ok {
+				match := m
+				lag := rn.lastLogIndex() - m
+				h.MatchIndex = &match
+				h.Lag = &lag
+			}
+			if e, ok := rn.rtts[key]; ok {
+				rtt := float64(e.srtt.Microseconds()) / 1000
+				h.RTT = &rtt
+			}
+		}
+		flow := rn.flowSnapshot(key)
+		h.Inflight = flow.inflightEntries
+		h.InflightB = flow.inflightBytes
+		h.Paused = time.Now().Before(flow.pausedUntil)
+		h.Skipped = flow.skipped
+		st.Peers = append(st.Peers, h)
+	}
+	return st
+}
+
 // GetLeader returns current leader info
 func (rn *RaftNode) GetLeader() *LeaderInfo {
 	rn.mu.RLock()
@@ -204,71 +430,193 @@ func (rn *RaftNode) GetLeader() *LeaderInfo {
 	return rn.leader
 }
 
-// SetApplyCallback sets the callback function for applying committed entries
-func (rn *RaftNode) SetApplyCallback(fn func(map[string]interface{})) {
+// SetStateMachine sets the state machine committed entries are applied to
+func (rn *RaftNode) SetStateMachine(sm StateMachine) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
-	rn.applyCallback = fn
+	rn.stateMachine = sm
 }
 
-// applyCommitted applies all committed but not yet applied entries
+// applyCommitted queues all committed but not yet applied entries. Called
+// with rn.mu held; the state machine runs on the applier goroutine so it
+// never executes under the RAFT lock.
 func (rn *RaftNode) applyCommitted() {
+	queued := false
+	rn.applyMu.Lock()
 	for rn.lastApplied < rn.commitIndex {
 		rn.lastApplied++
-		if rn.lastApplied >= 0 && rn.lastApplied < len(rn.log) {
-			entry := rn.log[rn.lastApplied]
-			if rn.applyCallback != nil && entry.Command != nil {
-				// Call outside lock to avoid deadlocks
-				go rn.applyCallback(entry.Command)
+		if rn.lastApplied > rn.snapshotIndex && rn.lastApplied <= rn.lastLogIndex() {
+			entry := rn.log[rn.lastApplied-rn.snapshotIndex-1]
+			if entry.Command != nil {
+				rn.applyQueue = append(rn.applyQueue, applyMsg{index: rn.lastApplied, command: entry.Command})
+				queued = true
+			}
+		}
+	}
+	rn.applyMu.Unlock()
+
+	if queued {
+		select {
+		case rn.applyNotify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runApplier feeds queued entries to the state machine one at a time
+func (rn *RaftNode) runApplier() {
+	for {
+		select {
+		case <-rn.stopCh:
+			return
+		case <-rn.applyNotify:
+		}
+
+		for {
+			// applyExec is taken before popping so an installed snapshot can
+			// discard queued entries without racing an in-flight Apply
+			rn.applyExec.Lock()
+			rn.applyMu.Lock()
+			if len(rn.applyQueue) == 0 {
+				rn.applyMu.Unlock()
+				rn.applyExec.Unlock()
+				break
+			}
+			msg := rn.applyQueue[0]
+			rn.applyQueue = rn.applyQueue[1:]
+			rn.applyMu.Unlock()
+
+			rn.mu.RLock()
+			sm := rn.stateMachine
+			rn.mu.RUnlock()
+			if sm != nil {
+				sm.Apply(msg.index, msg.command)
+				rn.maybeSnapshot(msg.index)
 			}
+			rn.applyExec.Unlock()
 		}
 	}
 }
 
-// resetElectionTimeout resets the election timer with random timeout
-func (rn *RaftNode) resetElectionTimeout() {
-	if rn.electionTimer != nil {
-		rn.electionTimer.Stop()
+// peersSnapshot returns a copy of the current peer list
+func (rn *RaftNode) peersSnapshot() []Peer {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	peers := make([]Peer, len(rn.peers))
+	copy(peers, rn.peers)
+	return peers
+}
+
+// PeersAtIndex returns the peers known to have replicated the log up to index
+func (rn *RaftNode) PeersAtIndex(index int) []Peer {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	var peers []Peer
+	for _, p := range rn.peers {
+		key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+		if match, ok := rn.matchIndex[key]; ok && match >= index {
+			peers = append(peers, p)
+		}
 	}
-	// Random timeout between 3-5 seconds
-	timeout := time.Duration(3000+rand.Intn(2000)) * time.Millisecond
-	rn.electionTimer = time.AfterFunc(timeout, rn.startElection)
+	return peers
 }
 
-// startElection begins a new election
+// addPeer adds a peer to the cluster configuration if not already present
+func (rn *RaftNode) addPeer(p Peer) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if p.Host == rn.host && p.Port == rn.port {
+		return
+	}
+	for _, existing := range rn.peers {
+		if existing.Host == p.Host && existing.Port == p.Port {
+			return
+		}
+	}
+	peers := make([]Peer, len(rn.peers), len(rn.peers)+1)
+	copy(peers, rn.peers)
+	rn.peers = append(peers, p)
+	if rn.state == "leader" {
+		key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+		rn.nextIndex[key] = rn.lastLogIndex() + 1
+		rn.matchIndex[key] = -1
+	}
+}
+
+// startElection runs one election on the role loop, which restarts the
+// election timer if it is lost
 func (rn *RaftNode) startElection() {
 	rn.mu.Lock()
+	if !rn.isVoterLocked() || rn.state == "leader" {
+		rn.mu.Unlock()
+		return
+	}
+	transfer := rn.transferElection
+	rn.transferElection = false
+	rn.mu.Unlock()
+
+	// Only campaign if a majority would vote for us (prevote.go)
+	if !transfer && !rn.preVote() {
+		return
+	}
+
+	rn.mu.Lock()
+	if !transfer && (rn.state == "leader" || time.Since(rn.lastLeaderContact) < rn.ElectionTimeout()) {
+		// A leader showed up during the pre-vote
+		rn.mu.Unlock()
+		return
+	}
 	rn.state = "candidate"
 	rn.currentTerm++
+	metrics.Inc("raft.term_changes", 1)
 	rn.votedFor = rn.id
-	rn.saveState() // Persist term and vote
+	if rn.saveState() != nil {
+		// Don't ask for votes in a term whose own vote isn't durable
+		rn.state = "follower"
+		rn.mu.Unlock()
+		return
+	}
 	term := rn.currentTerm
-	votes := 1
+	granted := make(map[string]bool)
+	lastLogIndex := rn.lastLogIndex()
+	lastLogTerm := rn.termAt(lastLogIndex)
 	rn.mu.Unlock()
 
-	logMsg("Starting election for term %d", term)
+	raftLog.Infof("Starting election for term %d", term)
+	metrics.Inc("raft.elections", 1)
 
 	// Request votes from all peers
 	var wg sync.WaitGroup
 	var votesMu sync.Mutex
+	replies := make(map[string]map[string]interface{})
 
-	for _, peer := range rn.peers {
+	for _, peer := range rn.peersSnapshot() {
 		wg.Add(1)
 		go func(p Peer) {
 			defer wg.Done()
 
 			msg := map[string]interface{}{
-				"type":         REQUEST_VOTE,
-				"term":         term,
-				"candidate_id": rn.id,
+				"type":           REQUEST_VOTE,
+				"term":           term,
+				"candidate_id":   rn.id,
+				"last_log_index": lastLogIndex,
+				"last_log_term":  lastLogTerm,
+			}
+			if transfer {
+				msg["leadership_transfer"] = true
 			}
 
 			resp := rn.sendRPC(p.Host, p.Port, msg)
-			if resp != nil && resp["vote_granted"] == true {
-				votesMu.Lock()
-				votes++
-				votesMu.Unlock()
+			if resp == nil {
+				return
+			}
+			key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+			votesMu.Lock()
+			replies[key] = resp
+			if resp["vote_granted"] == true {
+				granted[key] = true
 			}
+			votesMu.Unlock()
 		}(peer)
 	}
 
@@ -281,119 +629,326 @@ func (rn *RaftNode) startElection() {
 
 	select {
 	case <-done:
-	case <-time.After(2 * time.Second):
+	case <-time.After(raftRPCTimeout):
 	}
 
 	// Check if we won
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.state != "candidate" {
+	if rn.state != "candidate" || rn.currentTerm != term {
 		return
 	}
 
+	votesMu.Lock()
+	defer votesMu.Unlock()
+	// A voter at a newer term ends the campaign: adopt its term and follow
+	for key, resp := range replies {
+		if rn.observeTerm(key, resp) {
+			return
+		}
+	}
+	votes := len(granted) + 1
 	total := len(rn.peers) + 1
-	majority := total/2 + 1
 
-	if votes >= majority {
-		logMsg("Won election with %d/%d votes, becoming leader", votes, total)
+	if rn.quorumLocked(func(key string) bool { return granted[key] }) {
+		raftLog.Infof("Won election with %d/%d votes, becoming leader", votes, total)
+		metrics.Inc("raft.elections_won", 1)
 		rn.state = "leader"
 		rn.leader = &LeaderInfo{Host: rn.host, WorkerPort: rn.workerPort}
 
 		// Initialize leader state
 		for _, p := range rn.peers {
 			key := fmt.Sprintf("%s:%d", p.Host, p.Port)
-			rn.nextIndex[key] = len(rn.log)
+			rn.nextIndex[key] = rn.lastLogIndex() + 1
 			rn.matchIndex[key] = -1
 		}
 
-		// Start heartbeat loop
-		go rn.leaderLoop()
+		// Commit an entry of the new term right away, so entries left by
+		// earlier terms commit and get applied now rather than at the next
+		// client write (RAFT §8)
+		go rn.ReplicateIndex(map[string]interface{}{"action": "NOOP"})
 	} else {
-		logMsg("Lost election with %d/%d votes", votes, total)
-		rn.resetElectionTimeout()
+		raftLog.Infof("Lost election with %d/%d votes", votes, total)
 	}
 }
 
-// leaderLoop sends periodic heartbeats
-func (rn *RaftNode) leaderLoop() {
-	ticker := time.NewTicker(rn.heartbeatInterval)
+// leaderLoop sends periodic heartbeats on the role loop until the node
+// steps down, or stops, which it reports with true
+func (rn *RaftNode) leaderLoop() bool {
+	interval := rn.heartbeatInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-rn.stopCh:
-			return
-		case <-ticker.C:
+			return true
+		case <-rn.timerReset:
+			// sent when stepping down; a leader has no election timer
 			rn.mu.RLock()
 			isLeader := rn.state == "leader"
 			rn.mu.RUnlock()
-
 			if !isLeader {
-				return
+				return false
+			}
+			continue
+		case <-ticker.C:
+		case <-rn.flushCh:
+			// let the rest of a burst of small commands join the heartbeat
+			time.Sleep(piggybackDelay)
+			select {
+			case <-rn.flushCh:
+			default:
 			}
+			ticker.Reset(interval)
+		}
+
+		rn.mu.RLock()
+		isLeader := rn.state == "leader"
+		rn.mu.RUnlock()
 
-			rn.sendHeartbeats()
+		if !isLeader {
+			return false
+		}
+
+		rn.sendHeartbeats()
+
+		// Step down once a majority stops answering (lease.go)
+		rn.mu.Lock()
+		isLeader = rn.checkLeaseLocked()
+		rn.mu.Unlock()
+		if !isLeader {
+			return false
+		}
+
+		// Follow the election timeout as RTTs are measured
+		if next := rn.heartbeatInterval(); next != interval {
+			interval = next
+			ticker.Reset(interval)
 		}
 	}
 }
 
-// sendHeartbeats sends AppendEntries to all peers
+// sendHeartbeats sends AppendEntries to all peers. A heartbeat carries any
+// entries the follower is missing, so lagging followers converge without
+// waiting for the next client command.
 func (rn *RaftNode) sendHeartbeats() {
-	for _, peer := range rn.peers {
+	for _, peer := range rn.peersSnapshot() {
 		go func(p Peer) {
-			rn.sendAppendEntries(p, []LogEntry{})
+			key := fmt.Sprintf("%s:%d", p.Host, p.Port)
+			mu := rn.sendLock(key)
+			if !mu.TryLock() {
+				return // a replication RPC is in flight and doubles as heartbeat
+			}
+			ok := rn.replicateTo(p)
+			mu.Unlock()
+			rn.noteHeartbeat(key, ok)
 		}(peer)
 	}
 }
 
-// sendAppendEntries sends AppendEntries RPC to a peer
-func (rn *RaftNode) sendAppendEntries(peer Peer, entries []LogEntry) bool {
-	rn.mu.RLock()
-	msg := map[string]interface{}{
-		"type":           APPEND_ENTRIES,
-		"term":           rn.currentTerm,
-		"leader_id":      []interface{}{rn.host, rn.workerPort},
-		"entries":        entries,
-		"prev_log_index": -1,
-		"prev_log_term":  0,
-		"leader_commit":  rn.commitIndex,
+// sendLock returns the mutex serializing AppendEntries to one follower, so
+// nextIndex is only moved by one sender at a time
+func (rn *RaftNode) sendLock(key string) *sync.Mutex {
+	v, _ := rn.sendLocks.LoadOrStore(key, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+// replicateTo brings one follower up to date. It sends the entries from the
+// peer's nextIndex together with the index and term that precede them; when
+// the follower rejects them for a log mismatch, nextIndex backs off and the
+// send is retried until the logs match. Returns false if the peer is
+// unreachable or this node stopped being leader. Callers hold sendLock.
+func (rn *RaftNode) replicateTo(peer Peer) bool {
+	key := fmt.Sprintf("%s:%d", peer.Host, peer.Port)
+	legacy := negotiatedProtocol(net.JoinHostPort(peer.Host, strconv.Itoa(peer.Port))) < logMatchingVersion
+
+	for {
+		rn.mu.RLock()
+		if rn.state != "leader" {
+			rn.mu.RUnlock()
+			return false
+		}
+		term := rn.currentTerm
+		next, ok := rn.nextIndex[key]
+		if !ok || next > rn.lastLogIndex()+1 {
+			next = rn.lastLogIndex() + 1
+		}
+		if next < 0 {
+			next = 0
+		}
+
+		// Entries the follower needs were compacted: send the snapshot
+		if next <= rn.snapshotIndex {
+			rn.mu.RUnlock()
+			if legacy {
+				raftLog.Warnf("%s needs compacted entries but predates snapshots", key)
+				return false
+			}
+			if !rn.sendSnapshot(peer, key) {
+				return false
+			}
+			continue
+		}
+
+		prevIndex := next - 1
+		prevTerm := rn.termAt(prevIndex)
+		start := next - rn.snapshotIndex - 1
+		end := min(len(rn.log), start+maxEntriesPerRPC)
+		entries := make([]LogEntry, end-start)
+		copy(entries, rn.log[start:end])
+		msg := map[string]interface{}{
+			"type":                APPEND_ENTRIES,
+			"term":                term,
+			"leader_id":           []interface{}{rn.host, rn.workerPort},
+			"entries":             entries,
+			"prev_log_index":      prevIndex,
+			"prev_log_term":       prevTerm,
+			"leader_commit":       rn.commitIndex,
+			"election_timeout_ms": rn.ElectionTimeout().Milliseconds(),
+		}
+		rn.mu.RUnlock()
+
+		resp := rn.sendRPC(peer.Host, peer.Port, msg)
+		if resp == nil {
+			return false
+		}
+
+		rn.mu.Lock()
+		if rn.observeTerm(key, resp) || rn.state != "leader" || rn.currentTerm != term {
+			rn.mu.Unlock()
+			return false
+		}
+
+		if resp["success"] == true {
+			match := prevIndex + len(entries)
+			if match > rn.matchIndex[key] {
+				rn.matchIndex[key] = match
+			}
+			rn.nextIndex[key] = match + 1
+			rn.advanceCommitIndex()
+			caughtUp := match >= rn.lastLogIndex()
+			rn.mu.Unlock()
+			if caughtUp || len(entries) == 0 {
+				return true
+			}
+			continue
+		}
+
+		// Legacy followers only reject stale terms, which was handled above
+		if legacy || next == 0 {
+			rn.mu.Unlock()
+			return false
+		}
+
+		// Log mismatch: skip back to the follower's hint, or one entry
+		back := next - 1
+		if hint, ok := resp["conflict_index"].(float64); ok && int(hint) < next {
+			back = int(hint)
+		}
+		if back < 0 {
+			back = 0
+		}
+		rn.nextIndex[key] = back
+		rn.mu.Unlock()
+
+		metrics.Inc("raft.append_rejected", 1)
+		raftLog.Infof("%s rejected entries at index %d, retrying from %d", key, next, back)
+	}
+}
+
+// observeTerm steps down when a peer's reply carries a newer term and
+// reports whether it did. Callers hold rn.mu.
+func (rn *RaftNode) observeTerm(key string, resp map[string]interface{}) bool {
+	respTerm := int(numberOr(resp["term"], 0))
+	if respTerm <= rn.currentTerm {
+		return false
 	}
-	rn.mu.RUnlock()
+	raftLog.Infof("peer %s is at term %d, stepping down", key, respTerm)
+	rn.currentTerm = respTerm
+	metrics.Inc("raft.term_changes", 1)
+	rn.votedFor = ""
+	rn.state = "follower"
+	rn.leader = nil
+	rn.saveState()
+	rn.resetElectionTimeout()
+	return true
+}
 
-	resp := rn.sendRPC(peer.Host, peer.Port, msg)
-	return resp != nil && resp["success"] == true
+// advanceCommitIndex commits the highest entry of the current term stored on
+// a majority. Entries from earlier terms are committed indirectly, as RAFT
+// requires. Called with rn.mu held.
+func (rn *RaftNode) advanceCommitIndex() {
+	for n := rn.lastLogIndex(); n > rn.commitIndex; n-- {
+		if rn.termAt(n) != rn.currentTerm {
+			break
+		}
+		stored := func(key string) bool {
+			m, ok := rn.matchIndex[key]
+			return ok && m >= n
+		}
+		if rn.quorumLocked(stored) {
+			rn.commitIndex = n
+			rn.notifyCommitLocked()
+			rn.applyCommitted()
+			rn.stepDownIfRemovedLocked()
+			return
+		}
+	}
 }
 
 // Replicate appends a command to the log and replicates it
 func (rn *RaftNode) Replicate(command map[string]interface{}) bool {
+	_, ok := rn.ReplicateIndex(command)
+	return ok
+}
+
+// ReplicateIndex is Replicate that also returns the entry's log index
+func (rn *RaftNode) ReplicateIndex(command map[string]interface{}) (int, bool) {
 	rn.mu.Lock()
-	if rn.state != "leader" {
+	if !rn.checkLeaseLocked() {
 		rn.mu.Unlock()
-		return false
+		return -1, false
 	}
 
 	entry := LogEntry{Term: rn.currentTerm, Command: command}
 	rn.log = append(rn.log, entry)
-	rn.saveState() // Persist log change
-	myIndex := len(rn.log) - 1
+	if err := rn.saveState(); err != nil {
+		// Never acknowledge an entry that isn't durable; the next save
+		// rewrites the state without it
+		rn.log = rn.log[:len(rn.log)-1]
+		rn.mu.Unlock()
+		return -1, false
+	}
+	if _, ok := configFromCommand(command); ok {
+		rn.refreshConfigLocked()
+	}
+	myIndex := rn.lastLogIndex()
+	peers := len(rn.peers)
 	rn.mu.Unlock()
 
+	size := entriesSize([]LogEntry{entry})
+	if peers > 0 && size <= piggybackMaxBytes {
+		return rn.replicatePiggybacked(myIndex)
+	}
 
-	// Send to all peers
-	acks := 1
+	// Send to all peers, skipping followers whose pipeline is saturated
 	var wg sync.WaitGroup
-	var acksMu sync.Mutex
 
-	for _, peer := range rn.peers {
+	for _, peer := range rn.peersSnapshot() {
+		key := fmt.Sprintf("%s:%d", peer.Host, peer.Port)
+		if !rn.acquireFlow(key, 1, size) {
+			continue
+		}
 		wg.Add(1)
 		go func(p Peer) {
 			defer wg.Done()
-			if rn.sendAppendEntries(p, []LogEntry{entry}) {
-				acksMu.Lock()
-				acks++
-				acksMu.Unlock()
-			}
+			mu := rn.sendLock(key)
+			mu.Lock()
+			ok := rn.replicateTo(p)
+			mu.Unlock()
+			rn.releaseFlow(key, 1, size, ok)
 		}(peer)
 	}
 
@@ -406,23 +961,15 @@ func (rn *RaftNode) Replicate(command map[string]interface{}) bool {
 
 	select {
 	case <-done:
-	case <-time.After(5 * time.Second):
+	case <-time.After(replicateTimeout):
 	}
 
 	// Check majority
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	total := len(rn.peers) + 1
-	majority := total/2 + 1
-
-	if acks >= majority {
-		rn.commitIndex = myIndex
-		rn.applyCommitted()
-		return true
-	}
-
-	return false
+	rn.advanceCommitIndex()
+	return myIndex, rn.commitIndex >= myIndex
 }
 
 
@@ -432,14 +979,14 @@ func (rn *RaftNode) Replicate(command map[string]interface{}) bool {
 
 func (rn *RaftNode) startRPCServer() {
 	addr := fmt.Sprintf("%s:%d", rn.host, rn.port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := listen(addr, raftTLS)
 	if err != nil {
-		logMsg("RAFT RPC listen error: %v", err)
+		raftLog.Errorf("RPC listen error: %v", err)
 		return
 	}
 	defer listener.Close()
 
-	logMsg("RAFT RPC server listening on %s", addr)
+	raftLog.Infof("RPC server listening on %s", addr)
 
 	for {
 		select {
@@ -458,32 +1005,74 @@ func (rn *RaftNode) startRPCServer() {
 
 func (rn *RaftNode) handleRPC(conn net.Conn) {
 	defer conn.Close()
+	// A peer that stops sending mid-request doesn't hold the goroutine
+	conn.SetReadDeadline(time.Now().Add(raftRPCTimeout))
 
 	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
+	line, framed, err := readMessage(reader)
 	if err != nil {
 		return
 	}
 
+	body, nonce, err := openRequest(line)
+	if err != nil {
+		metrics.Inc("raft.auth_failures", 1)
+		raftLog.Warnf("rejected RPC from %s: %v", conn.RemoteAddr(), err)
+		data, _ := json.Marshal(map[string]interface{}{"error": "unauthorized", "proto": ProtocolVersion})
+		writeMessage(conn, data, framed)
+		return
+	}
+
 	var msg map[string]interface{}
-	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return
+	}
+	if msg, err = decodeEnvelope(msg); err != nil {
+		raftLog.Warnf("dropping undecodable RPC: %v", err)
 		return
 	}
 
 	var resp map[string]interface{}
 	msgType, _ := msg["type"].(string)
 
+	if !checkProtocol(msg) {
+		raftLog.Warnf("refusing %s at protocol version %v (minimum %d)", msgType, msg["proto"], MinProtocolVersion)
+		msgType = "unsupported_protocol"
+	}
+	if rn.isTwin(msg) {
+		msgType = "duplicate"
+	}
+
 	switch msgType {
 	case REQUEST_VOTE:
 		resp = rn.handleRequestVote(msg)
 	case APPEND_ENTRIES:
 		resp = rn.handleAppendEntries(msg)
+	case STATE_QUERY:
+		resp = rn.handleStateQuery(msg)
+	case INSTALL_SNAPSHOT:
+		resp = rn.handleInstallSnapshot(msg)
+	case TIMEOUT_NOW:
+		resp = rn.handleTimeoutNow(msg)
+	case PRE_VOTE:
+		resp = rn.handlePreVote(msg)
+	case "duplicate":
+		resp = map[string]interface{}{"error": "duplicate_node"}
+	case "unsupported_protocol":
+		resp = map[string]interface{}{"error": "unsupported_protocol", "min_proto": MinProtocolVersion}
 	default:
 		resp = map[string]interface{}{"error": "unknown"}
 	}
 
+	resp["proto"] = ProtocolVersion
+	if fileServicePort != 0 {
+		resp["file_service"] = true
+		resp["file_port"] = fileServicePort
+	}
+	rn.stampIdentity(resp)
+
 	data, _ := json.Marshal(resp)
-	conn.Write(append(data, '\n'))
+	writeMessage(conn, sealResponse(data, nonce), framed)
 }
 
 func (rn *RaftNode) handleRequestVote(msg map[string]interface{}) map[string]interface{} {
@@ -493,31 +1082,85 @@ func (rn *RaftNode) handleRequestVote(msg map[string]interface{}) map[string]int
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
+	deny := func() map[string]interface{} {
+		return map[string]interface{}{
+			"type":         VOTE_RESPONSE,
+			"term":         rn.currentTerm,
+			"vote_granted": false,
+		}
+	}
+
+	// A candidate from an earlier term gets our term back and nothing else,
+	// not even a reset of our election timer
+	if term < rn.currentTerm || candidateID == "" {
+		return deny()
+	}
+
+	// A server that still hears from a leader ignores candidates, so a
+	// server removed from the configuration can't force new elections,
+	// unless the leader itself handed over (transfer.go)
+	transfer, _ := msg["leadership_transfer"].(bool)
+	if term > rn.currentTerm && !transfer && (rn.state == "leader" || time.Since(rn.lastLeaderContact) < rn.ElectionTimeout()) {
+		return deny()
+	}
+
 	if term > rn.currentTerm {
 		rn.currentTerm = term
+		metrics.Inc("raft.term_changes", 1)
 		rn.votedFor = ""
 		rn.state = "follower"
-		rn.saveState() // Persist term change
+		rn.leader = nil
+		if rn.saveState() != nil {
+			// The new term is kept in memory and saved with the next change;
+			// without it on disk we can't promise a vote in it
+			return deny()
+		}
 	}
 
-	voteGranted := false
-	if (rn.votedFor == "" || rn.votedFor == candidateID) && term >= rn.currentTerm {
-		rn.votedFor = candidateID
-		voteGranted = true
-		rn.saveState() // Persist vote
-		logMsg("Voted for %s in term %d", candidateID, term)
+	// One vote per term, only for a log at least as up to date as ours
+	if rn.votedFor != "" && rn.votedFor != candidateID || !rn.candidateUpToDate(msg) {
+		return deny()
 	}
 
-	rn.resetElectionTimeout()
+	// The vote counts only once it is on disk: after a crash we must still
+	// know whom we voted for in this term
+	previous := rn.votedFor
+	rn.votedFor = candidateID
+	if rn.saveState() != nil {
+		rn.votedFor = previous
+		return deny()
+	}
+	raftLog.Debugf("Voted for %s in term %d", candidateID, term)
 
+	// Granting a vote defers our own candidacy (RAFT §5.2)
+	rn.resetElectionTimeout()
 
 	return map[string]interface{}{
 		"type":         VOTE_RESPONSE,
 		"term":         rn.currentTerm,
-		"vote_granted": voteGranted,
+		"vote_granted": true,
 	}
 }
 
+// candidateUpToDate applies the RAFT election restriction: only a candidate
+// whose log is at least as up-to-date as ours may win our vote, so a leader
+// always holds every committed entry. Legacy candidates don't report their
+// log and are not checked. Called with rn.mu held.
+func (rn *RaftNode) candidateUpToDate(msg map[string]interface{}) bool {
+	if messageProtocol(msg) < logMatchingVersion {
+		return true
+	}
+	lastIndex := int(numberOr(msg["last_log_index"], -1))
+	lastTerm := int(numberOr(msg["last_log_term"], 0))
+
+	myLastIndex := rn.lastLogIndex()
+	myLastTerm := rn.termAt(myLastIndex)
+	if lastTerm != myLastTerm {
+		return lastTerm > myLastTerm
+	}
+	return lastIndex >= myLastIndex
+}
+
 func (rn *RaftNode) handleAppendEntries(msg map[string]interface{}) map[string]interface{} {
 	term := int(msg["term"].(float64))
 	leaderID := msg["leader_id"]
@@ -529,92 +1172,248 @@ func (rn *RaftNode) handleAppendEntries(msg map[string]interface{}) map[string]i
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if term >= rn.currentTerm {
-		stateChanged := term > rn.currentTerm
-		rn.currentTerm = term
-		rn.state = "follower"
-
-		// Parse leader info
-		if leaderArr, ok := leaderID.([]interface{}); ok && len(leaderArr) == 2 {
-			host, _ := leaderArr[0].(string)
-			port, _ := leaderArr[1].(float64)
-			rn.leader = &LeaderInfo{Host: host, WorkerPort: int(port)}
-		}
-
-		// Append entries if present
-		if entries, ok := msg["entries"].([]interface{}); ok && len(entries) > 0 {
-			for _, e := range entries {
-				if entryMap, ok := e.(map[string]interface{}); ok {
-					entryTerm := 0
-					if t, ok := entryMap["term"].(float64); ok {
-						entryTerm = int(t)
-					}
-					var cmd map[string]interface{}
-					if c, ok := entryMap["command"].(map[string]interface{}); ok {
-						cmd = c
-					}
-					rn.log = append(rn.log, LogEntry{Term: entryTerm, Command: cmd})
-					stateChanged = true
-				}
-			}
+	if term < rn.currentTerm {
+		return map[string]interface{}{
+			"type":    APPEND_RESPONSE,
+			"term":    rn.currentTerm,
+			"success": false,
 		}
+	}
 
-		// Update commit index
-		if leaderCommit > rn.commitIndex {
-			if leaderCommit < len(rn.log)-1 {
-				rn.commitIndex = leaderCommit
-			} else {
-				rn.commitIndex = len(rn.log) - 1
-			}
-			rn.applyCommitted()
-		}
+	stateChanged := term > rn.currentTerm
+	if stateChanged {
+		rn.votedFor = ""
+		metrics.Inc("raft.term_changes", 1)
+	}
+	rn.currentTerm = term
+	rn.state = "follower"
+
+	rn.setLeader(leaderID)
+	rn.lastLeaderContact = time.Now()
 
-		// Persist state if changed
+	rn.adoptElectionTimeout(msg["election_timeout_ms"])
+	rn.resetElectionTimeout()
+
+	reject := func(conflictIndex int) map[string]interface{} {
 		if stateChanged {
 			rn.saveState()
 		}
+		return map[string]interface{}{
+			"type":           APPEND_RESPONSE,
+			"term":           rn.currentTerm,
+			"success":        false,
+			"conflict_index": conflictIndex,
+		}
+	}
 
-		rn.resetElectionTimeout()
+	entries := parseEntries(msg["entries"])
+	var lastNew int
+	held := rn.log // restored if the new entries can't be persisted
 
+	if messageProtocol(msg) < logMatchingVersion {
+		// Legacy leaders (including the Python and Kotlin workers) send only
+		// new entries and no consistency information
+		if len(entries) > 0 {
+			rn.log = append(rn.log, entries...)
+			stateChanged = true
+		}
+		lastNew = rn.lastLogIndex()
+	} else {
+		prevIndex := int(numberOr(msg["prev_log_index"], -1))
+		prevTerm := int(numberOr(msg["prev_log_term"], 0))
+		lastNew = prevIndex + len(entries)
+
+		// Entries covered by our snapshot are committed and match by
+		// definition; skip them
+		if prevIndex < rn.snapshotIndex {
+			skip := min(rn.snapshotIndex-prevIndex, len(entries))
+			entries = entries[skip:]
+			prevIndex = rn.snapshotIndex
+			prevTerm = rn.snapshotTerm
+		}
 
-		return map[string]interface{}{
-			"type":    APPEND_RESPONSE,
-			"term":    rn.currentTerm,
-			"success": true,
+		// Log matching: our log must contain prev_log_index with prev_log_term
+		if prevIndex > rn.lastLogIndex() {
+			return reject(rn.lastLogIndex() + 1)
+		}
+		if rn.termAt(prevIndex) != prevTerm {
+			// Hint the first index of the conflicting term so the leader
+			// skips the whole term in one round trip
+			conflictTerm := rn.termAt(prevIndex)
+			first := prevIndex
+			for first > rn.snapshotIndex+1 && rn.termAt(first-1) == conflictTerm {
+				first--
+			}
+			return reject(first)
+		}
+
+		// Skip entries we already have; truncate at the first conflict
+		for i, e := range entries {
+			idx := prevIndex + 1 + i
+			if idx <= rn.lastLogIndex() {
+				if rn.termAt(idx) == e.Term {
+					continue
+				}
+				if idx <= rn.commitIndex {
+					raftLog.Warnf("leader conflicts with committed entry %d, rejecting", idx)
+					return reject(rn.commitIndex + 1)
+				}
+				raftLog.Infof("truncating log from index %d (term %d vs %d)", idx, rn.termAt(idx), e.Term)
+				pos := idx - rn.snapshotIndex - 1
+				rn.log = rn.log[:pos:pos]
+			}
+			rn.log = append(rn.log, entries[i:]...)
+			stateChanged = true
+			break
+		}
+	}
+
+	// Persist state if changed; entries that aren't durable are neither
+	// acknowledged nor committed
+	if stateChanged {
+		if err := rn.saveState(); err != nil {
+			rn.log = held
+			return reject(rn.lastLogIndex() + 1)
+		}
+		rn.refreshConfigLocked()
+	}
+
+	// Update commit index, never past what the leader has confirmed we hold
+	if leaderCommit > rn.commitIndex {
+		newCommit := min(leaderCommit, lastNew)
+		if newCommit > rn.commitIndex {
+			rn.commitIndex = newCommit
+			rn.applyCommitted()
 		}
 	}
 
 	return map[string]interface{}{
 		"type":    APPEND_RESPONSE,
 		"term":    rn.currentTerm,
-		"success": false,
+		"success": true,
 	}
 }
 
+// setLeader records the leader named by an RPC's leader_id; callers hold rn.mu
+func (rn *RaftNode) setLeader(leaderID interface{}) {
+	if leaderArr, ok := leaderID.([]interface{}); ok && len(leaderArr) == 2 {
+		host, _ := leaderArr[0].(string)
+		port, _ := leaderArr[1].(float64)
+		rn.leader = &LeaderInfo{Host: host, WorkerPort: int(port)}
+	}
+}
+
+// parseEntries decodes the entries of an APPEND_ENTRIES message
+func parseEntries(raw interface{}) []LogEntry {
+	list, _ := raw.([]interface{})
+	entries := make([]LogEntry, 0, len(list))
+	for _, e := range list {
+		entryMap, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		entryTerm := 0
+		if t, ok := entryMap["term"].(float64); ok {
+			entryTerm = int(t)
+		}
+		var cmd map[string]interface{}
+		if c, ok := entryMap["command"].(map[string]interface{}); ok {
+			cmd = c
+		}
+		entries = append(entries, LogEntry{Term: entryTerm, Command: cmd})
+	}
+	return entries
+}
+
+
+// handleStateQuery reports term and log position so operator tools (e.g.
+// restore) can compare local state against the live cluster
+func (rn *RaftNode) handleStateQuery(msg map[string]interface{}) map[string]interface{} {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	entryTerm := -1
+	if idx, ok := msg["index"].(float64); ok && int(idx) >= 0 {
+		entryTerm = rn.termAt(int(idx))
+	}
+
+	return map[string]interface{}{
+		"current_term":   rn.currentTerm,
+		"log_length":     rn.lastLogIndex() + 1,
+		"snapshot_index": rn.snapshotIndex,
+		"commit_index":   rn.commitIndex,
+		"state":          rn.state,
+		"entry_term":     entryTerm,
+		"time_ms":        time.Now().UnixMilli(),
+	}
+}
 
 func (rn *RaftNode) sendRPC(host string, port int, msg map[string]interface{}) map[string]interface{} {
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	start := time.Now()
+	rn.stampIdentity(msg)
+	resp := sendRaftRPC(host, port, msg)
+	if resp != nil && rn.isTwin(resp) {
+		resp = nil
+	}
+
+	key := fmt.Sprintf("%s:%d", host, port)
+	rn.mu.Lock()
+	if resp != nil {
+		if uuid, ok := resp["node_uuid"].(string); ok {
+			rn.peerUUIDs[key] = uuid
+		}
+		rn.peerLabels[key] = labelsFromValue(resp["node_labels"])
+		rn.peerLastContact[key] = time.Now()
+		rn.peerFailures[key] = 0
+		if msg["type"] == APPEND_ENTRIES {
+			rn.observeRTTLocked(key, time.Since(start))
+		}
+	} else {
+		rn.peerFailures[key]++
+	}
+	rn.mu.Unlock()
+
+	return resp
+}
+
+// sendRaftRPC sends a single RPC to a peer's RAFT port and returns the reply,
+// or nil on any network or decoding error
+func sendRaftRPC(host string, port int, msg map[string]interface{}) map[string]interface{} {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	ctx, cancel := context.WithTimeout(context.Background(), raftRPCTimeout)
+	defer cancel()
+	conn, err := dialPeer(ctx, addr, raftRPCTimeout)
 	if err != nil {
 		return nil
 	}
 	defer conn.Close()
 
-	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
 
-	data, _ := json.Marshal(msg)
-	conn.Write(append(data, '\n'))
+	data, _ := json.Marshal(encodeForPeer(addr, msg))
+	data, nonce := sealRequest(compressForPeer(addr, data))
+	if err := writeMessage(conn, data, peerFramed(addr)); err != nil {
+		return nil
+	}
 
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
+	line, _, err := readMessage(bufio.NewReader(conn))
 	if err != nil {
 		return nil
 	}
 
+	body, err := openResponse(line, nonce)
+	if err != nil {
+		metrics.Inc("raft.auth_failures", 1)
+		raftLog.Warnf("rejected reply from %s: %v", addr, err)
+		return nil
+	}
 	var resp map[string]interface{}
-	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+	if err := json.Unmarshal(body, &resp); err != nil {
 		return nil
 	}
+	notePeerProtocol(addr, messageProtocol(resp))
+	notePeerFileService(addr, resp)
 
 	return resp
 }
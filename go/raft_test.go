@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a follower, not started, whose log holds one entry per
+// term given
+func newTestNode(t *testing.T, currentTerm int, terms ...int) *RaftNode {
+	t.Helper()
+	rn := NewRaftNode("127.0.0.1:1", "127.0.0.1", 1, nil, 1)
+	rn.currentTerm = currentTerm
+	for _, term := range terms {
+		rn.log = append(rn.log, LogEntry{Term: term, Command: map[string]interface{}{"action": "NOOP"}})
+	}
+	return rn
+}
+
+func logTerms(rn *RaftNode) []int {
+	terms := make([]int, len(rn.log))
+	for i, e := range rn.log {
+		terms[i] = e.Term
+	}
+	return terms
+}
+
+func appendMsg(term, prevIndex, prevTerm int, entryTerms ...int) map[string]interface{} {
+	entries := make([]interface{}, len(entryTerms))
+	for i, et := range entryTerms {
+		entries[i] = map[string]interface{}{"term": float64(et), "command": map[string]interface{}{"action": "NOOP"}}
+	}
+	return map[string]interface{}{
+		"type":           APPEND_ENTRIES,
+		"proto":          float64(ProtocolVersion),
+		"term":           float64(term),
+		"leader_id":      []interface{}{"127.0.0.1", float64(2)},
+		"prev_log_index": float64(prevIndex),
+		"prev_log_term":  float64(prevTerm),
+		"leader_commit":  float64(-1),
+		"entries":        entries,
+	}
+}
+
+func TestAppendEntriesLogMatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		log       []int // terms of the follower's entries
+		prevIndex int
+		prevTerm  int
+		entries   []int
+		success   bool
+		conflict  int // conflict_index on rejection
+		want      []int
+	}{
+		{name: "append to empty log", prevIndex: -1, entries: []int{1, 1}, success: true, want: []int{1, 1}},
+		{name: "append after matching entry", log: []int{1, 1}, prevIndex: 1, prevTerm: 1, entries: []int{2}, success: true, want: []int{1, 1, 2}},
+		{name: "heartbeat keeps log", log: []int{1, 2}, prevIndex: 1, prevTerm: 2, success: true, want: []int{1, 2}},
+		{name: "duplicate entries are skipped", log: []int{1, 1, 2}, prevIndex: 0, prevTerm: 1, entries: []int{1, 2}, success: true, want: []int{1, 1, 2}},
+		{name: "conflicting suffix is truncated", log: []int{1, 1, 2, 2}, prevIndex: 1, prevTerm: 1, entries: []int{3}, success: true, want: []int{1, 1, 3}},
+		{name: "prev beyond log hints its end", log: []int{1}, prevIndex: 4, prevTerm: 2, entries: []int{2}, conflict: 1, want: []int{1}},
+		{name: "prev term mismatch hints first index of term", log: []int{1, 2, 2, 2}, prevIndex: 3, prevTerm: 3, entries: []int{3}, conflict: 1, want: []int{1, 2, 2, 2}},
+		{name: "mismatch at first entry hints zero", log: []int{2, 2}, prevIndex: 1, prevTerm: 3, conflict: 0, want: []int{2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := newTestNode(t, 3, tt.log...)
+			resp := rn.handleAppendEntries(appendMsg(3, tt.prevIndex, tt.prevTerm, tt.entries...))
+			if got := resp["success"] == true; got != tt.success {
+				t.Fatalf("success = %v, want %v (%v)", got, tt.success, resp)
+			}
+			if !tt.success {
+				if got, _ := resp["conflict_index"].(int); got != tt.conflict {
+					t.Errorf("conflict_index = %v, want %d", resp["conflict_index"], tt.conflict)
+				}
+			}
+			if got := logTerms(rn); !reflect.DeepEqual(got, append([]int{}, tt.want...)) {
+				t.Errorf("log terms = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendEntriesStaleTerm(t *testing.T) {
+	rn := newTestNode(t, 5, 1, 5)
+	resp := rn.handleAppendEntries(appendMsg(4, 1, 5, 4))
+	if resp["success"] == true || resp["term"] != 5 {
+		t.Fatalf("stale leader accepted: %v", resp)
+	}
+	if got := logTerms(rn); !reflect.DeepEqual(got, []int{1, 5}) {
+		t.Errorf("log terms = %v, want [1 5]", got)
+	}
+}
+
+func TestAppendEntriesUnpersisted(t *testing.T) {
+	// A regular file where the RAFT directory should be: every write fails
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestNode(t, 3, 1, 2)
+	rn.commitIndex = 0
+	rn.SetPersistencePath(filepath.Join(blocker, "raft"))
+
+	msg := appendMsg(3, 1, 2, 3, 3)
+	msg["leader_commit"] = float64(3)
+	resp := rn.handleAppendEntries(msg)
+	if resp["success"] == true {
+		t.Fatalf("acknowledged entries that failed to persist: %v", resp)
+	}
+	if got, _ := resp["conflict_index"].(int); got != 2 {
+		t.Errorf("conflict_index = %v, want 2", resp["conflict_index"])
+	}
+	if got := logTerms(rn); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("log terms = %v, want [1 2]", got)
+	}
+	if rn.commitIndex != 0 {
+		t.Errorf("commitIndex = %d, want 0", rn.commitIndex)
+	}
+}
+
+func TestWALReplayAfterTornWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string // appended to raft_wal.log after three intact records
+	}{
+		{name: "clean end"},
+		{name: "torn record", tail: `1a2b3c4d {"seq": 4, "term": 2, "from": 3, "entr`},
+		{name: "bad checksum", tail: "00000000 {\"seq\": 4, \"term\": 2, \"from\": 3, \"entries\": []}\n"},
+		{name: "garbage line", tail: "not a record\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rn := newTestNode(t, 1)
+			rn.SetPersistencePath(dir)
+			rn.mu.Lock()
+			if err := rn.saveState(); err != nil { // checkpoint
+				t.Fatal(err)
+			}
+			for _, term := range []int{1, 1, 2} {
+				rn.currentTerm = term
+				rn.log = append(rn.log, LogEntry{Term: term, Command: map[string]interface{}{"action": "NOOP"}})
+				if err := rn.saveState(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rn.wal.file.Close()
+			rn.mu.Unlock()
+
+			if tt.tail != "" {
+				f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(tt.tail)
+				f.Close()
+			}
+
+			state, found, err := readPersistedState(dir)
+			if err != nil || !found {
+				t.Fatalf("readPersistedState: found=%v err=%v", found, err)
+			}
+			terms := make([]int, len(state.Log))
+			for i, e := range state.Log {
+				terms[i] = e.Term
+			}
+			if !reflect.DeepEqual(terms, []int{1, 1, 2}) || state.CurrentTerm != 2 || state.WALSeq != 3 {
+				t.Errorf("recovered log %v, term %d, seq %d; want [1 1 2], term 2, seq 3", terms, state.CurrentTerm, state.WALSeq)
+			}
+		})
+	}
+}
+
+func voteMsg(msgType string, term, lastIndex, lastTerm int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":           msgType,
+		"proto":          float64(ProtocolVersion),
+		"term":           float64(term),
+		"candidate_id":   "127.0.0.1:2",
+		"last_log_index": float64(lastIndex),
+		"last_log_term":  float64(lastTerm),
+	}
+}
+
+func TestPreVote(t *testing.T) {
+	tests := []struct {
+		name          string
+		voterTerm     int
+		voterLog      []int
+		leaderContact time.Duration // ago; 0 = never
+		leader        bool
+		term          int // proposed
+		lastIndex     int
+		lastTerm      int
+		grant         bool
+	}{
+		{name: "up-to-date candidate, no leader", voterTerm: 2, voterLog: []int{1, 2}, term: 3, lastIndex: 1, lastTerm: 2, grant: true},
+		{name: "longer log at same term", voterTerm: 2, voterLog: []int{1, 2}, term: 3, lastIndex: 2, lastTerm: 2, grant: true},
+		{name: "newer last term wins over length", voterTerm: 2, voterLog: []int{1, 1, 1}, term: 3, lastIndex: 0, lastTerm: 2, grant: true},
+		{name: "shorter log at same term", voterTerm: 2, voterLog: []int{1, 2, 2}, term: 3, lastIndex: 1, lastTerm: 2},
+		{name: "older last term", voterTerm: 2, voterLog: []int{1, 2}, term: 3, lastIndex: 5, lastTerm: 1},
+		{name: "term not ahead of voter", voterTerm: 3, voterLog: []int{1}, term: 3, lastIndex: 0, lastTerm: 1},
+		{name: "voter heard from leader recently", voterTerm: 2, voterLog: []int{1}, leaderContact: time.Millisecond, term: 3, lastIndex: 0, lastTerm: 1},
+		{name: "voter's leader went silent", voterTerm: 2, voterLog: []int{1}, leaderContact: time.Hour, term: 3, lastIndex: 0, lastTerm: 1, grant: true},
+		{name: "voter is leader", voterTerm: 2, voterLog: []int{1}, leader: true, term: 3, lastIndex: 0, lastTerm: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := newTestNode(t, tt.voterTerm, tt.voterLog...)
+			if tt.leaderContact > 0 {
+				rn.lastLeaderContact = time.Now().Add(-tt.leaderContact)
+			}
+			if tt.leader {
+				rn.state = "leader"
+			}
+			resp := rn.handlePreVote(voteMsg(PRE_VOTE, tt.term, tt.lastIndex, tt.lastTerm))
+			if got := resp["vote_granted"] == true; got != tt.grant {
+				t.Errorf("vote_granted = %v, want %v", got, tt.grant)
+			}
+			// A pre-vote changes neither term nor vote
+			if rn.currentTerm != tt.voterTerm || rn.votedFor != "" {
+				t.Errorf("pre-vote changed state: term %d, voted for %q", rn.currentTerm, rn.votedFor)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Connection, training and per-client request limits
+// ============================================================================
+
+// A burst of clients can otherwise open any number of connections and start
+// a JVM per TRAIN. Three limits, all off by default:
+//
+//	-max-connections 512   client connections served at once
+//	-max-trainings 4       trainings running at once on this node
+//	-rate-limit 20         requests per second from one client address,
+//	-rate-burst 40         with bursts up to this many
+//
+// A connection over the cap, a TRAIN over the cap and a request over its
+// client's rate get
+//
+//	{"status": "ERROR", "code": "E_QUEUE_FULL", "message": "...", "retry_after_ms": 250}
+//
+// before the request runs, so any of them can be retried after
+// retry_after_ms (the client package does). The training cap counts TRAIN
+// on the leader, JOB_SUBMIT trainings and SUB_TRAIN chunks; jobs and chunks
+// wait for a slot instead of failing. Requests from other nodes are not
+// rate limited: sealed ones (auth.go), the node-to-node messages and
+// requests a peer proxies, which its own limit already counted.
+
+const (
+	// connRetryAfter and trainRetryAfter are the hints sent with a refused
+	// connection and a refused TRAIN
+	connRetryAfter  = 200 * time.Millisecond
+	trainRetryAfter = 5 * time.Second
+
+	// rateIdleAfter is how long a client's bucket outlives its last request
+	rateIdleAfter = time.Minute
+)
+
+// maxConnections caps the client connections served at once (0 = no cap)
+var maxConnections int64
+
+// trainSlots holds a token for each training running on this node; nil when
+// -max-trainings is off
+var trainSlots chan struct{}
+
+// initTrainSlots sets the training cap
+func initTrainSlots(n int) {
+	if n > 0 {
+		trainSlots = make(chan struct{}, n)
+	}
+}
+
+// tryTrainSlot takes a training slot if one is free, returning the function
+// releasing it
+func tryTrainSlot() (func(), bool) {
+	if trainSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case trainSlots <- struct{}{}:
+		return releaseTrainSlot, true
+	default:
+		metrics.Inc("limits.trainings_rejected", 1)
+		return nil, false
+	}
+}
+
+// waitTrainSlot waits for a training slot until ctx ends
+func waitTrainSlot(ctx context.Context) (func(), error) {
+	if trainSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case trainSlots <- struct{}{}:
+		return releaseTrainSlot, nil
+	default:
+	}
+	metrics.Inc("limits.trainings_queued", 1)
+	select {
+	case trainSlots <- struct{}{}:
+		return releaseTrainSlot, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func releaseTrainSlot() { <-trainSlots }
+
+// admitConnection reports whether a newly accepted connection is under
+// -max-connections; one that isn't is answered E_QUEUE_FULL and closed
+func admitConnection(conn net.Conn) bool {
+	limit := atomic.LoadInt64(&maxConnections)
+	if limit <= 0 || atomic.LoadInt64(&openConns) < limit {
+		return true
+	}
+	metrics.Inc("limits.connections_rejected", 1)
+	go func() {
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		data, _ := json.Marshal(queueFullResponse("too many connections", connRetryAfter))
+		conn.Write(append(data, '\n'))
+	}()
+	return false
+}
+
+// queueFullResponse is the E_QUEUE_FULL answer to a request refused by a
+// limit
+func queueFullResponse(message string, retryAfter time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"status":         "ERROR",
+		"code":           "E_QUEUE_FULL",
+		"message":        message,
+		"retry_after_ms": int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond))),
+	}
+}
+
+// RateLimiter is a token bucket per client address
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is nil when -rate-limit is off
+var rateLimiter *RateLimiter
+
+// NewRateLimiter allows rate requests per second per client, in bursts of
+// up to burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*rateBucket)}
+}
+
+// Allow takes a token from client's bucket. When it is empty it returns
+// false and how long until the next token.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > rateIdleAfter {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > rateIdleAfter {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// checkRateLimit answers E_QUEUE_FULL to a request over its client's rate
+// and reports whether it did. sealed is true for a request sealed by a peer.
+func checkRateLimit(conn net.Conn, msgType string, msg map[string]interface{}, sealed bool) bool {
+	if rateLimiter == nil || sealed || requestInfo(msgType).role == roleNode {
+		return false
+	}
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	if proxied, _ := msg["proxied"].(bool); proxied && isPeerHost(client) {
+		return false
+	}
+	ok, wait := rateLimiter.Allow(client)
+	if ok {
+		return false
+	}
+	metrics.Inc("limits.rate_limited", 1)
+	sendResponse(conn, queueFullResponse("rate limit exceeded for "+client, wait))
+	return true
+}
+
+// isPeerHost reports whether host is the address of a cluster member
+func isPeerHost(host string) bool {
+	for _, p := range raftNode.peersSnapshot() {
+		if p.Host == host {
+			return true
+		}
+	}
+	return false
+}
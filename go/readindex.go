@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================================
+// Consistent PREDICT on followers
+// ============================================================================
+
+// Any node answers PREDICT from its local model files, but a follower may
+// lag the leader: a model the leader just trained may not be committed here
+// yet, and stray .bin files (the chunk models of a distributed training)
+// were never committed at all. A follower therefore only serves models it
+// has applied from the RAFT log. When it doesn't know a model it catches up
+// before answering "Model not found": while it holds a lease on the leader
+// (heard from it within an election timeout) its own commit index is recent
+// enough, otherwise it asks the leader for its commit index (read index),
+// and it waits until that index is applied. A model committed here whose
+// file hasn't arrived yet is sent to the leader, like a strict request. A
+// session token makes the read observe the client's own writes; strict=true
+// sends it to the leader.
+
+// ReadIndex returns a commit index at least as recent as the leader's when
+// the call started, as far as this node can tell
+func (rn *RaftNode) ReadIndex() (int, error) {
+	rn.mu.RLock()
+	if rn.state == "leader" || time.Since(rn.lastLeaderContact) < rn.ElectionTimeout() {
+		defer rn.mu.RUnlock()
+		return rn.commitIndex, nil
+	}
+	var leader *Peer
+	if rn.leader != nil {
+		for _, p := range rn.membersLocked() {
+			if p.Host == rn.leader.Host && p.WorkerPort == rn.leader.WorkerPort {
+				leader = &p
+				break
+			}
+		}
+	}
+	rn.mu.RUnlock()
+
+	if leader == nil {
+		return -1, errors.New("no leader available")
+	}
+	metrics.Inc("raft.read_index_queries", 1)
+	resp := rn.sendRPC(leader.Host, leader.Port, map[string]interface{}{"type": STATE_QUERY})
+	if resp == nil {
+		return -1, fmt.Errorf("leader %s:%d unreachable", leader.Host, leader.Port)
+	}
+	return int(numberOr(resp["commit_index"], -1)), nil
+}
+
+// committedModel reports whether a model file was applied from the log
+func committedModel(modelPath string) bool {
+	if _, ok := modelStateMachine.ModelPath(modelIDFromPath(modelPath)); ok {
+		return true
+	}
+	_, ok := modelStateMachine.FileIndex(filepath.Base(modelPath))
+	return ok
+}
+
+// findServableModel resolves the model a PREDICT may use on this node.
+// The leader serves any local model. A follower serves committed models
+// only, catching up to the leader's commit index before giving up on one.
+// It answers the request itself and returns false when a strict request or
+// one for a model whose file is missing was forwarded, or the node could not
+// catch up with the session or the leader.
+func findServableModel(ctx context.Context, conn net.Conn, msg map[string]interface{}, modelID string) (string, bool) {
+	if strict, _ := msg["strict"].(bool); strict && !raftNode.IsLeader() {
+		metrics.Inc("predict.strict_forwarded", 1)
+		forwardToLeader(ctx, conn, msg)
+		return "", false
+	}
+	if !awaitSession(conn, msg) {
+		return "", false
+	}
+	if raftNode.IsLeader() {
+		return findModel(modelID), true
+	}
+
+	if path := findModel(modelID); path != "" && committedModel(path) {
+		return path, true
+	}
+	index, err := raftNode.ReadIndex()
+	if err == nil && !modelStateMachine.WaitApplied(index, sessionWaitTimeout) {
+		err = fmt.Errorf("node has applied up to %d, leader committed %d", modelStateMachine.AppliedIndex(), index)
+	}
+	if err != nil {
+		metrics.Inc("predict.stale_reads", 1)
+		resp := map[string]interface{}{"status": "ERROR", "code": "E_STALE", "message": "Model not known on this node: " + err.Error()}
+		if leader := raftNode.GetLeader(); leader != nil {
+			resp["leader"] = []interface{}{leader.Host, leader.WorkerPort}
+		}
+		sendResponse(conn, resp)
+		return "", false
+	}
+	if path := findModel(modelID); path != "" && committedModel(path) {
+		return path, true
+	}
+	// Committed, but its file hasn't reached this node: the leader has it
+	if _, ok := modelStateMachine.ModelPath(modelStateMachine.ResolveAlias(modelID)); ok {
+		metrics.Inc("predict.missing_file_forwarded", 1)
+		forwardToLeader(ctx, conn, msg)
+		return "", false
+	}
+	return "", true
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Rebuild-from-peers disaster recovery
+// ============================================================================
+
+// recoveredVote is stored as votedFor after a rebuild. The node cannot know
+// whether it already voted in the recovered term before its disk was lost, so
+// it refuses to vote again until the term advances.
+const recoveredVote = "__recovered__"
+
+// RecoveryProgress tracks the guided recovery flow for logs and /status
+type RecoveryProgress struct {
+	mu        sync.Mutex
+	peer      string
+	step      string
+	steps     []string
+	modelsGot int
+	modelsAll int
+	err       string
+	startedAt time.Time
+	doneAt    time.Time
+}
+
+var recoveryProgress *RecoveryProgress
+
+func (rp *RecoveryProgress) setStep(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	rp.mu.Lock()
+	rp.step = msg
+	rp.steps = append(rp.steps, msg)
+	total := len(rp.steps)
+	rp.mu.Unlock()
+	recoveryLog.Infof("RECOVERY [step %d]: %s", total, msg)
+}
+
+// Status returns the recovery state for the monitor
+func (rp *RecoveryProgress) Status() map[string]interface{} {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	status := map[string]interface{}{
+		"peer":           rp.peer,
+		"step":           rp.step,
+		"steps":          rp.steps,
+		"models_fetched": rp.modelsGot,
+		"models_total":   rp.modelsAll,
+		"started_at":     rp.startedAt.UTC().Format(time.RFC3339),
+		"complete":       !rp.doneAt.IsZero() && rp.err == "",
+	}
+	if rp.err != "" {
+		status["error"] = rp.err
+	}
+	return status
+}
+
+// recoverFromPeer rebuilds local storage from a live peer: RAFT state and
+// every model file, which replace the local ones once all of them arrived.
+// It runs before the RAFT node starts so the node rejoins with the fetched
+// log instead of an empty one.
+func recoverFromPeer(peer string) error {
+	rp := &RecoveryProgress{peer: peer, startedAt: time.Now()}
+	recoveryProgress = rp
+
+	err := rp.run()
+
+	rp.mu.Lock()
+	rp.doneAt = time.Now()
+	if err != nil {
+		rp.err = err.Error()
+	}
+	rp.mu.Unlock()
+
+	if err != nil {
+		recoveryLog.Errorf("%v", err)
+		recoveryLog.Infof("fix the problem and restart with -recover-from=%s to retry", peer)
+		return err
+	}
+	rp.setStep("recovery complete, node rejoining cluster as follower")
+	return nil
+}
+
+// raftStateFiles are the files that make up a node's RAFT state. The node's
+// UUID is not among them: a rebuilt node is the same member and keeps it.
+// raft_state.json comes last, the order a recovery installs them in.
+var raftStateFiles = []string{"raft_snapshot.json", "raft_snapshot.json.tmp", "raft_wal.log", "raft_wal.log.prev", "raft_state.json.tmp", "raft_state.json.prev", "raft_state.json"}
+
+// recoveryStagingDir holds what a recovery fetched until all of it arrived
+const recoveryStagingDir = "recovery.tmp"
+
+// run fetches the peer's state and models into a staging directory and
+// only then swaps them in, so a recovery that fails halfway leaves the old
+// storage as it was. The staged files are renamed over the old ones, models
+// first and raft_state.json last, and only then are the leftovers removed.
+func (rp *RecoveryProgress) run() error {
+	staging := filepath.Join(raftDir, recoveryStagingDir)
+	stagedModels := filepath.Join(staging, "models")
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("clear %s: %v", staging, err)
+	}
+	if err := os.MkdirAll(stagedModels, 0755); err != nil {
+		return fmt.Errorf("create %s: %v", staging, err)
+	}
+	defer os.RemoveAll(staging)
+
+	rp.setStep("fetching RAFT snapshot from %s", rp.peer)
+	resp, err := sendClientMessage(rp.peer, map[string]interface{}{"type": "FETCH_STATE"}, 60*time.Second)
+	if err != nil {
+		return fmt.Errorf("fetch state: %v", err)
+	}
+	if status, _ := resp["status"].(string); status != "OK" {
+		return fmt.Errorf("peer refused FETCH_STATE: %v", resp["message"])
+	}
+
+	var snapshot struct {
+		CurrentTerm int           `json:"current_term"`
+		Log         []LogEntry    `json:"log"`
+		Snapshot    *snapshotFile `json:"snapshot"`
+		Models      []string      `json:"models"`
+	}
+	raw, _ := json.Marshal(resp)
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode snapshot: %v", err)
+	}
+
+	rp.mu.Lock()
+	rp.modelsAll = len(snapshot.Models)
+	rp.mu.Unlock()
+	rp.setStep("fetching %d model files into %s", len(snapshot.Models), staging)
+
+	for _, name := range snapshot.Models {
+		if err := fetchModelFromPeer(rp.peer, name, stagedModels); err != nil {
+			return fmt.Errorf("fetch model %s: %v", name, err)
+		}
+		rp.mu.Lock()
+		rp.modelsGot++
+		rp.mu.Unlock()
+	}
+
+	rp.setStep("staging snapshot (term=%d, log_len=%d)", snapshot.CurrentTerm, len(snapshot.Log))
+	raftNode.mu.Lock()
+	raftNode.persistencePath = staging
+	raftNode.currentTerm = snapshot.CurrentTerm
+	raftNode.votedFor = recoveredVote
+	raftNode.log = snapshot.Log
+	if s := snapshot.Snapshot; s != nil {
+		raftNode.snapshotIndex = s.LastIncludedIndex
+		raftNode.snapshotTerm = s.LastIncludedTerm
+		raftNode.snapshotState = s.State
+		raftNode.snapshotPeers = s.Members
+		raftNode.snapshotConfig = s.Config
+		err = raftNode.saveSnapshot()
+	}
+	if err == nil {
+		// Start the staged log past the records already in raftDir, so
+		// any left over by a crash during the swap are never replayed
+		raftNode.wal = &raftWAL{seq: lastWALSeq(raftDir)}
+		err = raftNode.checkpointLocked()
+	}
+	if raftNode.wal != nil {
+		raftNode.wal.file.Close()
+		raftNode.wal = nil
+	}
+	raftNode.persistencePath = raftDir
+	raftNode.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("stage RAFT state: %v", err)
+	}
+
+	// Everything arrived: replace the old state, keeping node_uuid
+	rp.setStep("replacing RAFT state in %s and models in %s (node identity kept)", raftDir, modelsDir)
+	if err := os.MkdirAll(modelsDir, 0755); err != nil {
+		return fmt.Errorf("create %s: %v", modelsDir, err)
+	}
+	fetched := make(map[string]bool, len(snapshot.Models))
+	for _, name := range snapshot.Models {
+		if err := replaceFile(filepath.Join(stagedModels, name), filepath.Join(modelsDir, name)); err != nil {
+			return fmt.Errorf("install model %s: %v", name, err)
+		}
+		fetched[name] = true
+	}
+	staged := make(map[string]bool)
+	for _, name := range raftStateFiles {
+		src := filepath.Join(staging, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := replaceFile(src, filepath.Join(raftDir, name)); err != nil {
+			return fmt.Errorf("install %s: %v", name, err)
+		}
+		staged[name] = true
+	}
+	for _, name := range raftStateFiles {
+		if staged[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(raftDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %v", name, err)
+		}
+	}
+	old, _ := filepath.Glob(filepath.Join(modelsDir, "*"))
+	for _, m := range old {
+		if info, err := os.Stat(m); err == nil && !info.IsDir() && !fetched[filepath.Base(m)] {
+			os.Remove(m)
+		}
+	}
+	return nil
+}
+
+// fetchModelFromPeer downloads one model file from peer into dir
+func fetchModelFromPeer(peer, name, dir string) error {
+	resp, err := sendClientMessage(peer, map[string]interface{}{
+		"type":     "FETCH_MODEL",
+		"filename": name,
+	}, 60*time.Second)
+	if err != nil {
+		return err
+	}
+	if status, _ := resp["status"].(string); status != "OK" {
+		return fmt.Errorf("%v", resp["message"])
+	}
+
+	if !safeBaseName(name) {
+		return fmt.Errorf("unsafe filename %q", name)
+	}
+
+	dataB64, _ := resp["data_b64"].(string)
+	data, err := base64.StdEncoding.DecodeString(dataB64)
+	if err != nil {
+		return err
+	}
+	sum := sha256Hex(data)
+	if want, _ := resp["sha256"].(string); want != "" && sum != want {
+		return fmt.Errorf("%s damaged in transfer", name)
+	}
+	if want, ok := modelStateMachine.Checksum(name); ok && sum != want {
+		metrics.Inc("models.corrupt", 1)
+		return fmt.Errorf("%s from %s fails its checksum", name, peer)
+	}
+	return os.WriteFile(filepath.Join(dir, name), data, 0644)
+}
+
+// handleFetchState serves the RAFT snapshot and model list to a recovering
+// node, most important models first (replpriority.go)
+func handleFetchState(conn net.Conn) {
+	raftNode.mu.RLock()
+	term := raftNode.currentTerm
+	entries := make([]LogEntry, len(raftNode.log))
+	copy(entries, raftNode.log)
+	var snap *snapshotFile
+	if raftNode.snapshotIndex >= 0 {
+		snap = &snapshotFile{
+			LastIncludedIndex: raftNode.snapshotIndex,
+			LastIncludedTerm:  raftNode.snapshotTerm,
+			Members:           raftNode.snapshotPeers,
+			Config:            raftNode.snapshotConfig,
+			State:             raftNode.snapshotState,
+		}
+	}
+	raftNode.mu.RUnlock()
+
+	var models []string
+	files, _ := filepath.Glob(filepath.Join(modelsDir, "*.bin"))
+	for _, f := range files {
+		if !deletedModelFile(f) {
+			models = append(models, filepath.Base(f))
+		}
+	}
+	models = prioritizeModels(models)
+
+	tcpLog.Infof("FETCH_STATE request: serving term=%d, log_len=%d, %d models", term, len(entries), len(models))
+
+	sendResponse(conn, map[string]interface{}{
+		"status":       "OK",
+		"current_term": term,
+		"log":          entries,
+		"snapshot":     snap,
+		"models":       models,
+	})
+}
+
+// handleFetchModel serves one model file to a recovering node
+func handleFetchModel(conn net.Conn, msg map[string]interface{}) {
+	filename, _ := msg["filename"].(string)
+	if !safeBaseName(filename) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid filename"})
+		return
+	}
+	if modelStateMachine.DeletedFile(filename) {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(modelsDir, filename))
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found"})
+		return
+	}
+	if want, ok := modelStateMachine.Checksum(filename); ok && sha256Hex(data) != want {
+		metrics.Inc("models.corrupt", 1)
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_MODEL_CORRUPT", "message": "Model fails its checksum"})
+		return
+	}
+
+	sendResponse(conn, map[string]interface{}{
+		"status":   "OK",
+		"filename": filename,
+		"data_b64": base64.StdEncoding.EncodeToString(data),
+		"sha256":   sha256Hex(data),
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ============================================================================
+// Model metadata registry
+// ============================================================================
+
+// The leader attaches how a model was trained to its MODEL_TRAINED entry.
+// Every node applies it into a ModelRegistry, which keeps the metadata of all
+// models in <models-dir>/models.json and travels in state machine snapshots,
+// so LIST_MODELS and GET_MODEL_INFO answer the same on every node. Models
+// committed by workers that don't send metadata are listed with their id and
+// file only.
+
+// registryFile is the index written next to the model files
+const registryFile = "models.json"
+
+// ModelMetadata describes a trained model
+type ModelMetadata struct {
+	ModelID      string          `json:"model_id"`
+	File         string          `json:"file,omitempty"`
+	CreatedAt    string          `json:"created_at,omitempty"`
+	Creator      string          `json:"creator,omitempty"` // node that ran the training
+	Backend      string          `json:"backend,omitempty"`
+	Samples      int             `json:"samples,omitempty"`
+	InputSize    int             `json:"input_size,omitempty"`
+	OutputSize   int             `json:"output_size,omitempty"`
+	Epochs       int             `json:"epochs,omitempty"`
+	TrainingLoss *float64        `json:"training_loss,omitempty"` // final epoch error reported by the backend
+	Preprocess   *PreprocessSpec `json:"preprocess,omitempty"`    // applied to prediction inputs (preprocess.go)
+	SHA256       string          `json:"sha256,omitempty"`        // of the model file when created (integrity.go)
+	Quarantine   *QuarantineInfo `json:"quarantine,omitempty"`    // withheld from serving (quarantine.go)
+}
+
+// ModelRegistry is the metadata index of committed models
+type ModelRegistry struct {
+	path string
+
+	mu     sync.RWMutex
+	models map[string]*ModelMetadata
+}
+
+// NewModelRegistry opens the index in dir, starting empty if it is missing
+// or unreadable; replaying the log fills it again
+func NewModelRegistry(dir string) *ModelRegistry {
+	r := &ModelRegistry{path: filepath.Join(dir, registryFile), models: make(map[string]*ModelMetadata)}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return r
+	}
+	var models []*ModelMetadata
+	if err := json.Unmarshal(data, &models); err != nil {
+		storageLog.Warnf("registry: ignoring unreadable %s: %v", r.path, err)
+		return r
+	}
+	for _, m := range models {
+		if m != nil && m.ModelID != "" {
+			r.models[m.ModelID] = m
+		}
+	}
+	return r
+}
+
+// Register stores a model's metadata, replacing any previous entry
+func (r *ModelRegistry) Register(meta *ModelMetadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.models[meta.ModelID] = meta
+	r.saveLocked()
+}
+
+// Remove drops a model's metadata
+func (r *ModelRegistry) Remove(modelID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.models[modelID]; !ok {
+		return
+	}
+	delete(r.models, modelID)
+	r.saveLocked()
+}
+
+// SetPreprocess attaches a preprocessing spec to a model's metadata, or
+// removes it when spec is nil. Models committed without metadata get an
+// entry holding just their id and file.
+func (r *ModelRegistry) SetPreprocess(modelID, file string, spec *PreprocessSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	meta := ModelMetadata{ModelID: modelID, File: file}
+	if old, ok := r.models[modelID]; ok {
+		meta = *old
+	}
+	meta.Preprocess = spec
+	r.models[modelID] = &meta
+	r.saveLocked()
+}
+
+// SetQuarantine quarantines a model, or releases it when info is nil
+func (r *ModelRegistry) SetQuarantine(modelID, file string, info *QuarantineInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	meta := ModelMetadata{ModelID: modelID, File: file}
+	if old, ok := r.models[modelID]; ok {
+		meta = *old
+	}
+	meta.Quarantine = info
+	r.models[modelID] = &meta
+	r.saveLocked()
+}
+
+// Replace swaps the whole index, for snapshot installs
+func (r *ModelRegistry) Replace(models map[string]*ModelMetadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.models = make(map[string]*ModelMetadata, len(models))
+	for id, m := range models {
+		if m != nil {
+			r.models[id] = m
+		}
+	}
+	r.saveLocked()
+}
+
+// saveLocked rewrites models.json. Callers hold r.mu.
+func (r *ModelRegistry) saveLocked() {
+	data, err := json.MarshalIndent(r.listLocked(), "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		storageLog.Errorf("registry: cannot write %s: %v", tmp, err)
+		return
+	}
+	if err := replaceFile(tmp, r.path); err != nil {
+		storageLog.Errorf("registry: cannot replace %s: %v", r.path, err)
+	}
+}
+
+// Get returns a model's metadata by id or, failing that, by file name
+func (r *ModelRegistry) Get(modelID, file string) (*ModelMetadata, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m, ok := r.models[modelID]; ok {
+		return m, true
+	}
+	for _, m := range r.models {
+		if file != "" && m.File == file {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// All returns the index keyed by model id
+func (r *ModelRegistry) All() map[string]*ModelMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	models := make(map[string]*ModelMetadata, len(r.models))
+	for id, m := range r.models {
+		models[id] = m
+	}
+	return models
+}
+
+// List returns the metadata of every model, oldest first
+func (r *ModelRegistry) List() []*ModelMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.listLocked()
+}
+
+func (r *ModelRegistry) listLocked() []*ModelMetadata {
+	models := make([]*ModelMetadata, 0, len(r.models))
+	for _, m := range r.models {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].CreatedAt != models[j].CreatedAt {
+			return models[i].CreatedAt < models[j].CreatedAt
+		}
+		return models[i].ModelID < models[j].ModelID
+	})
+	return models
+}
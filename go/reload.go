@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Live configuration reload
+// ============================================================================
+
+// A few settings can change while the worker runs:
+//
+//	log-level                                   all components (clears per-component levels)
+//	election-timeout-min, election-timeout-max  bounds of the adaptive timeout
+//	heartbeat-interval                          0 = derived from the timeout
+//	java-dir                                    the JVM bridge restarts once idle
+//
+// SIGHUP reads the -config file again and applies any of these that changed;
+// a changed setting that needs a restart is only logged, and a flag given on
+// the command line or in a WORKER_* variable keeps its value. POST
+// /admin/config on the monitor does the same without a body, or applies
+// {"log-level": "debug", "heartbeat-interval": "200ms"} given in one. The
+// new values are validated together and applied all or none; GET
+// /admin/config shows the values in force.
+
+// liveSettings lists the flags that can change at runtime
+var liveSettings = []string{"log-level", "election-timeout-min", "election-timeout-max", "heartbeat-interval", "java-dir"}
+
+// liveConfig is the runtime-changeable part of the configuration
+type liveConfig struct {
+	LogLevel    LogLevel
+	ElectionMin time.Duration
+	ElectionMax time.Duration
+	Heartbeat   time.Duration
+	JavaDir     string
+}
+
+// configChange is one setting a reload changed
+type configChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ReloadReport describes a reload
+type ReloadReport struct {
+	Source          string            `json:"source"`
+	Changed         []configChange    `json:"changed"`
+	Pinned          map[string]string `json:"pinned,omitempty"`           // key -> command line or variable that keeps it
+	RestartRequired []string          `json:"restart_required,omitempty"` // changed in the file, apply on restart
+}
+
+// reloadMu serializes reloads
+var reloadMu sync.Mutex
+
+var javaDirValue atomic.Value // string
+
+func currentJavaDir() string {
+	dir, _ := javaDirValue.Load().(string)
+	return dir
+}
+
+func setJavaDir(dir string) {
+	javaDirValue.Store(dir)
+}
+
+func currentLiveConfig() liveConfig {
+	logConfigMu.RLock()
+	level := logLevel
+	logConfigMu.RUnlock()
+	lo, hi := electionTimeoutBounds()
+	return liveConfig{
+		LogLevel:    level,
+		ElectionMin: lo,
+		ElectionMax: hi,
+		Heartbeat:   time.Duration(heartbeatOverride.Load()),
+		JavaDir:     currentJavaDir(),
+	}
+}
+
+// get returns a setting as its flag would print it
+func (c *liveConfig) get(key string) string {
+	switch key {
+	case "log-level":
+		return c.LogLevel.String()
+	case "election-timeout-min":
+		return c.ElectionMin.String()
+	case "election-timeout-max":
+		return c.ElectionMax.String()
+	case "heartbeat-interval":
+		return c.Heartbeat.String()
+	default:
+		return c.JavaDir
+	}
+}
+
+// set parses one setting
+func (c *liveConfig) set(key, value string) error {
+	var err error
+	switch key {
+	case "log-level":
+		c.LogLevel, err = parseLogLevel(value)
+	case "election-timeout-min":
+		c.ElectionMin, err = time.ParseDuration(value)
+	case "election-timeout-max":
+		c.ElectionMax, err = time.ParseDuration(value)
+	case "heartbeat-interval":
+		c.Heartbeat, err = time.ParseDuration(value)
+	case "java-dir":
+		c.JavaDir = value
+	default:
+		return fmt.Errorf("key %q can't change at runtime", key)
+	}
+	if err != nil {
+		return fmt.Errorf("key %q: invalid value %q: %v", key, value, err)
+	}
+	return nil
+}
+
+// validate checks c as a replacement for cur
+func (c *liveConfig) validate(cur liveConfig) error {
+	if c.ElectionMin <= 0 || c.ElectionMax < c.ElectionMin {
+		return fmt.Errorf("invalid election timeout bounds %v..%v", c.ElectionMin, c.ElectionMax)
+	}
+	if c.Heartbeat < 0 || c.Heartbeat >= c.ElectionMin {
+		return fmt.Errorf("heartbeat-interval %v must be below election-timeout-min %v", c.Heartbeat, c.ElectionMin)
+	}
+	if c.JavaDir != cur.JavaDir {
+		if info, err := os.Stat(c.JavaDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("java-dir %q is not a directory", c.JavaDir)
+		}
+	}
+	return nil
+}
+
+// applyLiveConfig validates next and applies what differs from the current
+// configuration
+func applyLiveConfig(next liveConfig) ([]configChange, error) {
+	cur := currentLiveConfig()
+	if err := next.validate(cur); err != nil {
+		return nil, err
+	}
+	changes := []configChange{}
+	for _, key := range liveSettings {
+		if old, val := cur.get(key), next.get(key); old != val {
+			changes = append(changes, configChange{Key: key, Old: old, New: val})
+			if f := flag.Lookup(key); f != nil {
+				f.Value.Set(val)
+			}
+		}
+	}
+
+	if next.LogLevel != cur.LogLevel {
+		setLogLevel("", next.LogLevel)
+	}
+	if next.ElectionMin != cur.ElectionMin || next.ElectionMax != cur.ElectionMax {
+		setElectionTimeoutBounds(next.ElectionMin, next.ElectionMax)
+		raftNode.setElectionTimeout(clampElectionTimeout(raftNode.ElectionTimeout()))
+	}
+	if next.Heartbeat != cur.Heartbeat {
+		heartbeatOverride.Store(int64(next.Heartbeat))
+	}
+	if next.JavaDir != cur.JavaDir {
+		setJavaDir(next.JavaDir)
+		if javaBridge != nil {
+			javaBridge.Restart()
+		}
+	}
+
+	for _, c := range changes {
+		workerLog.Infof("config: %s %s -> %s", c.Key, c.Old, c.New)
+	}
+	if len(changes) > 0 {
+		metrics.Inc("config.reloads", 1)
+	}
+	return changes, nil
+}
+
+// reloadConfigFile reads the configuration file again and applies the live
+// settings it changes
+func reloadConfigFile() (*ReloadReport, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if configPath == "" {
+		return nil, fmt.Errorf("no configuration file (start with -config)")
+	}
+	values, err := readConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReloadReport{Source: configPath, Pinned: make(map[string]string)}
+	next := currentLiveConfig()
+	live := make(map[string]bool, len(liveSettings))
+	for _, key := range liveSettings {
+		live[key] = true
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := values[key]
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", configPath, v.line, key)
+		}
+		if from, pinned := configPinned[key]; pinned {
+			if !sameFlagValue(f, v.value) {
+				report.Pinned[key] = from
+			}
+			continue
+		}
+		switch {
+		case live[key]:
+			if err := next.set(key, v.value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", configPath, v.line, err)
+			}
+		case !sameFlagValue(f, v.value):
+			report.RestartRequired = append(report.RestartRequired, key)
+		}
+	}
+
+	if report.Changed, err = applyLiveConfig(next); err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+	for _, key := range report.RestartRequired {
+		workerLog.Warnf("config: %s changed in %s, takes effect on restart", key, configPath)
+	}
+	return report, nil
+}
+
+// sameFlagValue reports whether value parses to the flag's current value
+func sameFlagValue(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() == value
+	}
+	switch cur := getter.Get().(type) {
+	case bool:
+		v, err := strconv.ParseBool(value)
+		return err == nil && v == cur
+	case int:
+		v, err := strconv.Atoi(value)
+		return err == nil && v == cur
+	case int64:
+		v, err := strconv.ParseInt(value, 0, 64)
+		return err == nil && v == cur
+	case uint64:
+		v, err := strconv.ParseUint(value, 0, 64)
+		return err == nil && v == cur
+	case float64:
+		v, err := strconv.ParseFloat(value, 64)
+		return err == nil && v == cur
+	case time.Duration:
+		v, err := time.ParseDuration(value)
+		return err == nil && v == cur
+	default:
+		return f.Value.String() == value
+	}
+}
+
+// watchReloadSignal reloads the configuration file on every SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadAPITokens()
+		report, err := reloadConfigFile()
+		if err != nil {
+			workerLog.Errorf("config reload: %v", err)
+			continue
+		}
+		workerLog.Infof("config reload from %s: %d changed", report.Source, len(report.Changed))
+	}
+}
+
+// liveConfigStatus lists the live settings in force
+func liveConfigStatus() map[string]interface{} {
+	cur := currentLiveConfig()
+	values := make(map[string]string, len(liveSettings))
+	for _, key := range liveSettings {
+		values[key] = cur.get(key)
+	}
+	return map[string]interface{}{"config_file": configPath, "live": values, "pinned": configPinned}
+}
+
+func handleConfigAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(liveConfigStatus())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var report *ReloadReport
+	if len(body) == 0 {
+		report, err = reloadConfigFile()
+	} else {
+		report, err = applyConfigUpdate(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// applyConfigUpdate applies the live settings of a JSON object. An operator
+// asking explicitly overrides the command line too.
+func applyConfigUpdate(body []byte) (*ReloadReport, error) {
+	var update map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&update); err != nil {
+		return nil, fmt.Errorf("body must be a JSON object: %v", err)
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next := currentLiveConfig()
+	for k, v := range update {
+		key := configKey(k)
+		value, err := jsonConfigValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+		if err := next.set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	changes, err := applyLiveConfig(next)
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadReport{Source: "api", Changed: changes}, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ============================================================================
+// Model replication priority
+// ============================================================================
+
+// A node rebuilt from a peer fetches every model file one at a time, in the
+// order the peer lists them. The peer lists the models that matter most
+// first, so they are back on the node early in a long recovery: models under
+// a production alias, then models under any other alias, then the rest; and
+// within each group the models it served most recently, then the newest
+// files.
+
+// productionAliases mark the models clients serve from in production
+var productionAliases = map[string]bool{"production": true, "prod": true}
+
+// Priority groups, most important first
+const (
+	priorityProduction = iota
+	priorityAliased
+	priorityOther
+)
+
+// modelPriority returns the priority group of a model id
+func modelPriority(modelID string) int {
+	aliases := modelStateMachine.AliasesFor(modelID)
+	for _, alias := range aliases {
+		if productionAliases[alias] {
+			return priorityProduction
+		}
+	}
+	if len(aliases) > 0 {
+		return priorityAliased
+	}
+	return priorityOther
+}
+
+// prioritizeModels orders model file names by replication priority
+func prioritizeModels(names []string) []string {
+	type ranked struct {
+		name     string
+		group    int
+		lastUsed time.Time
+		modified time.Time
+	}
+	models := make([]ranked, len(names))
+	for i, name := range names {
+		id := modelIDFromPath(name)
+		models[i] = ranked{name: name, group: modelPriority(id), lastUsed: predictionLog.LastUsed(id)}
+		if info, err := os.Stat(filepath.Join(modelsDir, name)); err == nil {
+			models[i].modified = info.ModTime()
+		}
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		a, b := models[i], models[j]
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		if !a.lastUsed.Equal(b.lastUsed) {
+			return a.lastUsed.After(b.lastUsed)
+		}
+		return a.modified.After(b.modified)
+	})
+
+	ordered := make([]string, len(models))
+	for i, m := range models {
+		ordered[i] = m.name
+	}
+	return ordered
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// ============================================================================
+// Role loop
+// ============================================================================
+
+// One goroutine, run, owns the node's role and the timers that drive it:
+// as follower or candidate it waits out the election timeout and campaigns,
+// as leader it runs the heartbeat loop. Elections never overlap and a leader
+// never has an election timer armed. RPC handlers and other goroutines
+// don't touch timers: they change rn.state under rn.mu and signal the loop
+// through buffered channels, resetElectionTimeout to restart the election
+// timeout (which also makes a leader loop notice a step-down at once) and
+// campaignNow to start an election right away (TIMEOUT_NOW). A signal sent
+// while the loop is busy campaigning waits in the channel.
+
+// resetElectionTimeout asks the role loop to restart the election timeout
+func (rn *RaftNode) resetElectionTimeout() {
+	select {
+	case rn.timerReset <- struct{}{}:
+	default: // a reset is already pending
+	}
+}
+
+// campaignNow asks the role loop to start an election without waiting for
+// the election timeout
+func (rn *RaftNode) campaignNow() {
+	select {
+	case rn.campaign <- struct{}{}:
+	default:
+	}
+}
+
+// run is the role loop; it returns when the node stops
+func (rn *RaftNode) run() {
+	for {
+		rn.mu.RLock()
+		leader := rn.state == "leader"
+		rn.mu.RUnlock()
+
+		var stopped bool
+		if leader {
+			stopped = rn.leaderLoop()
+		} else {
+			stopped = rn.followerLoop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// followerLoop runs the election timer of a follower or candidate and
+// campaigns when it expires. It returns once the node has become leader,
+// and true if the node stopped.
+func (rn *RaftNode) followerLoop() bool {
+	timer := time.NewTimer(rn.randomElectionTimeout())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-rn.stopCh:
+			return true
+		case <-rn.timerReset:
+			stopTimer(timer)
+			timer.Reset(rn.randomElectionTimeout())
+			continue
+		case <-timer.C:
+		case <-rn.campaign:
+			stopTimer(timer)
+		}
+
+		rn.startElection()
+
+		rn.mu.RLock()
+		leader := rn.state == "leader"
+		rn.mu.RUnlock()
+		if leader {
+			return false
+		}
+		timer.Reset(rn.randomElectionTimeout())
+	}
+}
+
+// stopTimer stops t and drains a tick it may already have delivered, so it
+// can be Reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
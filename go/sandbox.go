@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Backend sandbox
+// ============================================================================
+
+// The TrainingModule JVM parses whatever datasets clients send, so a
+// deployment can confine it in case one exploits the backend:
+//
+//	-java-user      run it as this user (name or uid); the worker must run
+//	                as root, and the user needs to read -java-dir and
+//	                -scratch-dir and write -models-dir
+//	-java-workdir   run it in this directory (created, and owned by
+//	                -java-user) instead of the worker's; models and
+//	                scratch paths are then passed as absolute paths
+//	-java-no-network
+//	                run it in a network namespace of its own with no
+//	                interfaces but loopback; without root it also gets a
+//	                user namespace, which the kernel must allow
+//
+// Users and namespaces are only available on Linux, where a sandbox that
+// can't be set up stops the worker at startup. The readiness check runs
+// "java -version" inside the sandbox. The bridge JVM and one-off JVMs are
+// both sandboxed; -backend=go runs in-process and is not.
+
+// javaSandbox is the confinement of TrainingModule processes
+type javaSandbox struct {
+	User      string // as given, for the log
+	UID       int    // -1 = the worker's
+	GID       int
+	Dir       string
+	NoNetwork bool
+}
+
+var sandbox = javaSandbox{UID: -1, GID: -1}
+
+// configureSandbox validates and sets the sandbox flags
+func configureSandbox(userName, dir string, noNetwork bool) error {
+	sb := javaSandbox{User: userName, UID: -1, GID: -1, NoNetwork: noNetwork}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return fmt.Errorf("-java-user %q: no such user", userName)
+			}
+		}
+		if sb.UID, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("-java-user %q: uid %q is not numeric", userName, u.Uid)
+		}
+		if sb.GID, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("-java-user %q: gid %q is not numeric", userName, u.Gid)
+		}
+	}
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("-java-workdir %q: %v", dir, err)
+		}
+		if err := os.MkdirAll(abs, 0750); err != nil {
+			return fmt.Errorf("-java-workdir %q: %v", dir, err)
+		}
+		if sb.UID >= 0 {
+			if err := os.Chown(abs, sb.UID, sb.GID); err != nil {
+				return fmt.Errorf("-java-workdir %q: %v", dir, err)
+			}
+		}
+		sb.Dir = abs
+	}
+	if err := checkSandboxSupport(sb); err != nil {
+		return err
+	}
+	sandbox = sb
+	return nil
+}
+
+// enabled reports whether any confinement is configured
+func (sb javaSandbox) enabled() bool {
+	return sb.UID >= 0 || sb.Dir != "" || sb.NoNetwork
+}
+
+// String describes the sandbox for the log
+func (sb javaSandbox) String() string {
+	var parts []string
+	if sb.UID >= 0 {
+		parts = append(parts, fmt.Sprintf("user %s (%d:%d)", sb.User, sb.UID, sb.GID))
+	}
+	if sb.Dir != "" {
+		parts = append(parts, "workdir "+sb.Dir)
+	}
+	if sb.NoNetwork {
+		parts = append(parts, "no network")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sandboxCommand confines a TrainingModule process before it starts
+func sandboxCommand(cmd *exec.Cmd) {
+	if sandbox.Dir != "" {
+		cmd.Dir = sandbox.Dir
+	}
+	applySandbox(cmd, sandbox)
+}
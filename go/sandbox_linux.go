@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// checkSandboxSupport reports what this process can't do of sb
+func checkSandboxSupport(sb javaSandbox) error {
+	if sb.UID >= 0 && os.Geteuid() != 0 {
+		return fmt.Errorf("-java-user needs the worker to run as root")
+	}
+	if !sb.NoNetwork {
+		return nil
+	}
+	// Try the namespaces once with a process that exits at once
+	probe := exec.Command("/proc/self/exe", "-h")
+	applySandbox(probe, sb)
+	if err := probe.Start(); err != nil {
+		return fmt.Errorf("-java-no-network: cannot create a network namespace: %v", err)
+	}
+	probe.Wait()
+	return nil
+}
+
+// applySandbox sets cmd's credentials and namespaces, keeping the process
+// group killProcessGroup may have asked for
+func applySandbox(cmd *exec.Cmd, sb javaSandbox) {
+	if sb.UID < 0 && !sb.NoNetwork {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	if sb.UID >= 0 {
+		attr.Credential = &syscall.Credential{Uid: uint32(sb.UID), Gid: uint32(sb.GID)}
+	}
+	if sb.NoNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+		if os.Geteuid() != 0 {
+			// An unprivileged process needs a user namespace, mapping
+			// the worker's ids to themselves, to own the network one
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+		}
+	}
+}
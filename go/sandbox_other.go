@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// checkSandboxSupport reports what this platform can't do of sb: only the
+// working directory is available outside Linux
+func checkSandboxSupport(sb javaSandbox) error {
+	if sb.UID >= 0 {
+		return fmt.Errorf("-java-user is not supported on %s", runtime.GOOS)
+	}
+	if sb.NoNetwork {
+		return fmt.Errorf("-java-no-network is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+func applySandbox(cmd *exec.Cmd, sb javaSandbox) {}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Startup self-test
+// ============================================================================
+
+// ReadinessCheck is one line of the boot-time readiness report
+type ReadinessCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Fatal   bool   `json:"fatal"`
+	Message string `json:"message"`
+}
+
+// ReadinessReport is the result of the startup self-test
+type ReadinessReport struct {
+	CheckedAt string           `json:"checked_at"`
+	Ready     bool             `json:"ready"`
+	Checks    []ReadinessCheck `json:"checks"`
+}
+
+var (
+	readinessMu     sync.RWMutex
+	readinessReport *ReadinessReport
+)
+
+// SelfTestConfig holds what the self-test needs to know about this node
+type SelfTestConfig struct {
+	Host         string
+	Ports        map[string]int // name -> port that must be free
+	Peers        []Peer
+	MaxClockSkew time.Duration
+}
+
+// runSelfTest validates the environment before any listener starts. Fatal
+// checks (storage, ports) make the report not ready; the rest are warnings
+// since peers may legitimately still be booting.
+func runSelfTest(cfg SelfTestConfig) *ReadinessReport {
+	report := &ReadinessReport{CheckedAt: time.Now().UTC().Format(time.RFC3339), Ready: true}
+	add := func(c ReadinessCheck) {
+		report.Checks = append(report.Checks, c)
+		if !c.OK && c.Fatal {
+			report.Ready = false
+		}
+	}
+
+	for _, v := range storageVolumes() {
+		add(checkStorageWritable(v))
+	}
+	names := make([]string, 0, len(cfg.Ports))
+	for name := range cfg.Ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(checkPortFree(cfg.Host, name, cfg.Ports[name]))
+	}
+	if modelBackend == BackendJava {
+		add(checkJavaBackend())
+	}
+	for _, p := range cfg.Peers {
+		add(checkPeerResolves(p))
+	}
+	for _, p := range cfg.Peers {
+		add(checkClockSkew(p, cfg.MaxClockSkew))
+	}
+
+	readinessMu.Lock()
+	readinessReport = report
+	readinessMu.Unlock()
+
+	for _, c := range report.Checks {
+		level := "OK  "
+		if !c.OK && c.Fatal {
+			level = "FAIL"
+		} else if !c.OK {
+			level = "WARN"
+		}
+		workerLog.Infof("SELF-TEST %s %-22s %s", level, c.Name, c.Message)
+	}
+	workerLog.Infof("SELF-TEST ready=%v", report.Ready)
+	return report
+}
+
+func getReadinessReport() *ReadinessReport {
+	readinessMu.RLock()
+	defer readinessMu.RUnlock()
+	return readinessReport
+}
+
+func checkStorageWritable(v StorageVolume) ReadinessCheck {
+	c := ReadinessCheck{Name: "storage_" + v.Name, Fatal: true}
+	probe := filepath.Join(v.Path, ".selftest")
+	if err := os.WriteFile(probe, []byte("ok"), 0644); err != nil {
+		c.Message = fmt.Sprintf("%s is not writable: %v", v.Path, err)
+		return c
+	}
+	os.Remove(probe)
+	if err := checkFreeSpace(v.Name, v.Path); err != nil {
+		c.Message = err.Error()
+		return c
+	}
+	c.OK = true
+	c.Message = v.Path
+	return c
+}
+
+func checkPortFree(host, name string, port int) ReadinessCheck {
+	c := ReadinessCheck{Name: "port_" + name, Fatal: true}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.Message = fmt.Sprintf("%s unavailable: %v", addr, err)
+		return c
+	}
+	l.Close()
+	c.OK = true
+	c.Message = addr
+	return c
+}
+
+// checkJavaBackend verifies the JVM runs and the training module is compiled
+func checkJavaBackend() ReadinessCheck {
+	c := ReadinessCheck{Name: "java_backend"}
+	if _, err := os.Stat(filepath.Join(currentJavaDir(), "TrainingModule.class")); err != nil {
+		c.Message = fmt.Sprintf("TrainingModule.class not found in %s (run javac)", currentJavaDir())
+		return c
+	}
+	cmd := exec.Command(javaExecutable(), append(append([]string(nil), javaOpts...), "-version")...)
+	sandboxCommand(cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		c.Message = fmt.Sprintf("%s -version failed: %v %s", javaExecutable(), err, out)
+		return c
+	}
+	c.OK = true
+	c.Message = "java available, TrainingModule compiled"
+	return c
+}
+
+func checkPeerResolves(p Peer) ReadinessCheck {
+	c := ReadinessCheck{Name: "resolve_" + p.Host}
+	if _, err := net.LookupHost(p.Host); err != nil {
+		c.Message = fmt.Sprintf("cannot resolve %s: %v", p.Host, err)
+		return c
+	}
+	c.OK = true
+	c.Message = p.Host
+	return c
+}
+
+// checkClockSkew compares local time against the peer's, correcting for half
+// the round trip
+func checkClockSkew(p Peer, maxSkew time.Duration) ReadinessCheck {
+	addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	c := ReadinessCheck{Name: "clock_skew_" + addr}
+
+	start := time.Now()
+	resp := sendRaftRPC(p.Host, p.Port, map[string]interface{}{"type": STATE_QUERY, "index": -1})
+	rtt := time.Since(start)
+	if resp == nil {
+		c.Message = "peer unreachable (may still be starting)"
+		return c
+	}
+	peerMs, ok := resp["time_ms"].(float64)
+	if !ok {
+		c.OK = true
+		c.Message = "peer does not report time, skipped"
+		return c
+	}
+
+	local := start.Add(rtt / 2)
+	skew := time.UnixMilli(int64(peerMs)).Sub(local)
+	if skew < 0 {
+		skew = -skew
+	}
+	c.Message = fmt.Sprintf("skew %v (max %v)", skew.Round(time.Millisecond), maxSkew)
+	c.OK = skew <= maxSkew
+	return c
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Read-your-writes sessions
+// ============================================================================
+
+// sessionWaitTimeout bounds how long a follower holds a read while catching
+// up to a client's last write
+var sessionWaitTimeout = 5 * time.Second
+
+// sessionToken encodes the log index of a client's last write. The token is
+// opaque to clients: they echo back whatever they last received.
+func sessionToken(index int) string {
+	return fmt.Sprintf("s1.%d", index)
+}
+
+// parseSessionToken returns the write index carried by a token
+func parseSessionToken(token string) (int, bool) {
+	rest, ok := strings.CutPrefix(token, "s1.")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, false
+	}
+	return index, true
+}
+
+// awaitSession makes a read observe the caller's previous writes: it waits
+// until the local state machine has applied the session's index. It answers
+// the request itself and returns false when the node cannot catch up in time.
+func awaitSession(conn net.Conn, msg map[string]interface{}) bool {
+	token, _ := msg["session"].(string)
+	if token == "" {
+		return true
+	}
+	index, ok := parseSessionToken(token)
+	if !ok {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_SESSION", "message": "Invalid session token"})
+		return false
+	}
+	if modelStateMachine.WaitApplied(index, sessionWaitTimeout) {
+		return true
+	}
+
+	metrics.Inc("session.stale_reads", 1)
+	resp := map[string]interface{}{
+		"status":  "ERROR",
+		"code":    "E_STALE",
+		"message": fmt.Sprintf("Node has applied up to %d, session requires %d", modelStateMachine.AppliedIndex(), index),
+	}
+	if leader := raftNode.GetLeader(); leader != nil {
+		resp["leader"] = []interface{}{leader.Host, leader.WorkerPort}
+	}
+	sendResponse(conn, resp)
+	return false
+}
+
+// currentSession returns the token a read response should carry: the later
+// of the client's session and what this node has applied
+func currentSession(msg map[string]interface{}) string {
+	index := modelStateMachine.AppliedIndex()
+	if token, _ := msg["session"].(string); token != "" {
+		if i, ok := parseSessionToken(token); ok && i > index {
+			index = i
+		}
+	}
+	return sessionToken(index)
+}
+
+// handleGetModelInfo describes a stored model: file, size and aliases
+func handleGetModelInfo(conn net.Conn, msg map[string]interface{}) {
+	modelID, _ := msg["model_id"].(string)
+	if modelID == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Missing model_id"})
+		return
+	}
+	if !awaitSession(conn, msg) {
+		return
+	}
+
+	modelPath := findModel(modelID)
+	if modelPath == "" {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Model not found", "session": currentSession(msg)})
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":   "OK",
+		"model_id": modelID,
+		"file":     filepath.Base(modelPath),
+		"session":  currentSession(msg),
+	}
+	if info, err := os.Stat(modelPath); err == nil {
+		resp["size_bytes"] = info.Size()
+		resp["modified"] = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	if aliases := modelStateMachine.AliasesFor(modelStateMachine.ResolveAlias(modelID)); len(aliases) > 0 {
+		resp["aliases"] = aliases
+	}
+	if meta, ok := modelStateMachine.Registry().Get(modelStateMachine.ResolveAlias(modelID), filepath.Base(modelPath)); ok {
+		resp["metadata"] = meta
+	}
+	sendResponse(conn, resp)
+}
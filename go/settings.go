@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Cluster-wide settings
+// ============================================================================
+
+// Some policies have to be the same on every node: a KV_PUT is accepted or
+// rejected by each node as it applies the entry, so a key quota that differs
+// between nodes makes their stores diverge, and a follower that proxies
+// where the others redirect surprises clients. These settings can be set for
+// the whole cluster with an admin command that goes through the RAFT log:
+//
+//	{"type": "SET_SETTINGS", "settings": {"job_retention": "24h", "kv_max_keys": 50000, "non_leader": null}}
+//
+// A committed value overrides the node's flag on every node, survives
+// restarts in the log and snapshots, and so outlives any leader; null drops
+// the override and each node goes back to its flag. GET_SETTINGS (or GET
+// /admin/settings on the monitor) lists the values in force and where each
+// one comes from.
+
+// Setting kinds
+const (
+	settingKindInt      = "int"
+	settingKindDuration = "duration"
+	settingKindChoice   = "choice"
+)
+
+// settingDef describes a cluster setting
+type settingDef struct {
+	kind    string
+	choices []string // settingKindChoice
+	help    string
+	local   func() string // this node's flag value, in force while unset
+}
+
+// maxTrainSamples is -max-train-samples, the local default of the
+// max_train_samples quota (0 = unlimited)
+var maxTrainSamples int64
+
+var settingDefs = map[string]settingDef{
+	"job_retention": {
+		kind:  settingKindDuration,
+		help:  "Keep finished jobs for JOB_STATUS/JOB_RESULT this long (-job-retention)",
+		local: func() string { return jobHistoryRetention.String() },
+	},
+	"kv_max_keys": {
+		kind:  settingKindInt,
+		help:  "Keys the replicated KV store holds at most",
+		local: func() string { return strconv.Itoa(maxKVKeys) },
+	},
+	"max_train_samples": {
+		kind:  settingKindInt,
+		help:  "Samples a TRAIN or JOB_SUBMIT may carry, 0 = unlimited (-max-train-samples)",
+		local: func() string { return strconv.FormatInt(atomic.LoadInt64(&maxTrainSamples), 10) },
+	},
+	"shed_threshold": {
+		kind:  settingKindInt,
+		help:  "Concurrent trainings at which the leader redirects PREDICT to followers, 0 = off (-shed-threshold)",
+		local: func() string { return strconv.FormatInt(atomic.LoadInt64(&shedThreshold), 10) },
+	},
+	"non_leader": {
+		kind:    settingKindChoice,
+		choices: []string{NonLeaderRedirect, NonLeaderProxy},
+		help:    "How followers answer requests for the leader (-non-leader)",
+		local:   func() string { return nonLeaderMode },
+	},
+}
+
+// normalizeSetting validates a value for a setting and returns it in its
+// canonical form
+func normalizeSetting(name string, value interface{}) (string, error) {
+	def, ok := settingDefs[name]
+	if !ok {
+		return "", fmt.Errorf("unknown setting %q", name)
+	}
+	switch def.kind {
+	case settingKindInt:
+		var n int64
+		switch v := value.(type) {
+		case float64:
+			if v != float64(int64(v)) {
+				return "", fmt.Errorf("%s: %v is not an integer", name, v)
+			}
+			n = int64(v)
+		case string:
+			var err error
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return "", fmt.Errorf("%s: %q is not an integer", name, v)
+			}
+		default:
+			return "", fmt.Errorf("%s: expected an integer", name)
+		}
+		if n < 0 {
+			return "", fmt.Errorf("%s: must not be negative", name)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case settingKindDuration:
+		s, _ := value.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return "", fmt.Errorf("%s: expected a duration like \"90m\"", name)
+		}
+		return d.String(), nil
+	default:
+		s, _ := value.(string)
+		for _, choice := range def.choices {
+			if s == choice {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("%s: expected one of %v", name, def.choices)
+	}
+}
+
+// ClusterSettings holds the committed overrides. It has its own lock so
+// commands can read settings while applying under the state machine's.
+type ClusterSettings struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func NewClusterSettings() *ClusterSettings {
+	return &ClusterSettings{values: make(map[string]string)}
+}
+
+// All returns a copy of the overrides
+func (s *ClusterSettings) All() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make(map[string]string, len(s.values))
+	for name, value := range s.values {
+		values[name] = value
+	}
+	return values
+}
+
+// Replace installs the overrides of a snapshot
+func (s *ClusterSettings) Replace(values map[string]string) {
+	if values == nil {
+		values = make(map[string]string)
+	}
+	s.mu.Lock()
+	s.values = values
+	s.mu.Unlock()
+}
+
+// Value returns a setting in force and whether it comes from the cluster
+func (s *ClusterSettings) Value(name string) (string, bool) {
+	s.mu.RLock()
+	value, ok := s.values[name]
+	s.mu.RUnlock()
+	if ok {
+		return value, true
+	}
+	return settingDefs[name].local(), false
+}
+
+// String returns a setting in force
+func (s *ClusterSettings) String(name string) string {
+	value, _ := s.Value(name)
+	return value
+}
+
+// Int returns an integer setting in force
+func (s *ClusterSettings) Int(name string) int64 {
+	value, _ := s.Value(name)
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+// Duration returns a duration setting in force
+func (s *ClusterSettings) Duration(name string) time.Duration {
+	value, _ := s.Value(name)
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+// Settings returns the cluster settings of the state machine
+func (sm *ModelStateMachine) Settings() *ClusterSettings {
+	return sm.settings
+}
+
+// SetSettingsCommand overrides cluster settings; a nil value drops the
+// override
+type SetSettingsCommand struct {
+	Settings map[string]*string `json:"settings"`
+}
+
+func (c *SetSettingsCommand) Action() string { return "SET_SETTINGS" }
+
+func (c *SetSettingsCommand) Validate() error {
+	if len(c.Settings) == 0 {
+		return fmt.Errorf("no settings")
+	}
+	for name, value := range c.Settings {
+		if value == nil {
+			if _, ok := settingDefs[name]; !ok {
+				return fmt.Errorf("unknown setting %q", name)
+			}
+			continue
+		}
+		if _, err := normalizeSetting(name, *value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SetSettingsCommand) Apply(sm *ModelStateMachine) error {
+	s := sm.settings
+	s.mu.Lock()
+	for name, value := range c.Settings {
+		if value == nil {
+			delete(s.values, name)
+		} else {
+			s.values[name] = *value
+		}
+	}
+	s.mu.Unlock()
+	raftLog.Infof("applied SET_SETTINGS: %d settings", len(c.Settings))
+	return nil
+}
+
+// settingsReport lists every setting with the value in force here
+func settingsReport() map[string]interface{} {
+	names := make([]string, 0, len(settingDefs))
+	for name := range settingDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		value, cluster := modelStateMachine.Settings().Value(name)
+		source := "local"
+		if cluster {
+			source = "cluster"
+		}
+		entry := map[string]interface{}{"value": value, "source": source, "kind": settingDefs[name].kind, "help": settingDefs[name].help}
+		if choices := settingDefs[name].choices; len(choices) > 0 {
+			entry["choices"] = choices
+		}
+		report[name] = entry
+	}
+	return report
+}
+
+// handleSettings serves SET_SETTINGS (leader) and GET_SETTINGS (any node)
+func handleSettings(ctx context.Context, conn net.Conn, msg map[string]interface{}) {
+	if msg["type"] == "GET_SETTINGS" {
+		if !awaitSession(conn, msg) {
+			return
+		}
+		sendResponse(conn, map[string]interface{}{"status": "OK", "settings": settingsReport(), "session": currentSession(msg)})
+		return
+	}
+
+	raw, _ := msg["settings"].(map[string]interface{})
+	cmd := &SetSettingsCommand{Settings: make(map[string]*string, len(raw))}
+	for name, value := range raw {
+		if value == nil {
+			cmd.Settings[name] = nil
+			continue
+		}
+		normalized, err := normalizeSetting(name, value)
+		if err != nil {
+			sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid settings: " + err.Error()})
+			return
+		}
+		cmd.Settings[name] = &normalized
+	}
+	if err := cmd.Validate(); err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": "Invalid settings: " + err.Error()})
+		return
+	}
+	if !raftNode.IsLeader() {
+		forwardToLeader(ctx, conn, msg)
+		return
+	}
+
+	index, err := replicateCommand(cmd)
+	if err != nil {
+		sendResponse(conn, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+		return
+	}
+	modelStateMachine.WaitApplied(index, reserveWaitTimeout)
+	sendResponse(conn, map[string]interface{}{"status": "OK", "settings": settingsReport(), "session": sessionToken(index)})
+}
+
+func handleSettingsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settingsReport())
+}
+
+// checkTrainQuota answers E_QUOTA for a training larger than
+// max_train_samples and reports whether it did
+func checkTrainQuota(conn net.Conn, samples int) bool {
+	limit := modelStateMachine.Settings().Int("max_train_samples")
+	if limit <= 0 || int64(samples) <= limit {
+		return false
+	}
+	metrics.Inc("train.quota_rejections", 1)
+	sendResponse(conn, map[string]interface{}{"status": "ERROR", "code": "E_QUOTA", "message": fmt.Sprintf("%d samples, the cluster allows at most %d", samples, limit)})
+	return true
+}
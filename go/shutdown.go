@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Graceful shutdown
+// ============================================================================
+
+// On SIGINT or SIGTERM the worker stops accepting clients, lets in-flight
+// requests and training jobs finish for up to -shutdown-timeout, then
+// cancels what is left so Java processes are killed and their CSVs removed.
+// A leader hands leadership to a follower before stopping RAFT, so the
+// cluster doesn't wait an election timeout for a new one. A second signal
+// exits at once.
+
+// shutdownGrace bounds the wait for cancelled trainings to clean up
+const shutdownGrace = 5 * time.Second
+
+var (
+	// shutdownCtx is cancelled when draining gives up; long-running
+	// requests derive their context from it
+	shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+
+	shuttingDown int32
+	openConns    int64 // client connections being served
+
+	clientListenerMu sync.Mutex
+	clientListener   net.Listener
+
+	shutdownDone = make(chan struct{})
+)
+
+// isShuttingDown reports whether the node is draining
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// setClientListener registers the client port listener closed at shutdown
+func setClientListener(l net.Listener) {
+	clientListenerMu.Lock()
+	clientListener = l
+	clientListenerMu.Unlock()
+}
+
+// handleSignals runs the shutdown sequence on the first SIGINT or SIGTERM
+func handleSignals(timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	go func() {
+		<-signals
+		shutdownLog.Warnf("second signal, exiting now")
+		os.Exit(1)
+	}()
+	shutdown(sig.String(), timeout)
+}
+
+// shutdown drains the node and stops it. It closes shutdownDone when done.
+func shutdown(reason string, timeout time.Duration) {
+	start := time.Now()
+	shutdownLog.Infof("%s, draining (timeout %v)", reason, timeout)
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	// Stop accepting clients
+	clientListenerMu.Lock()
+	if clientListener != nil {
+		clientListener.Close()
+	}
+	clientListenerMu.Unlock()
+
+	// Wait for in-flight requests and jobs, then cancel the rest
+	if !waitDrained(timeout) {
+		shutdownLog.Warnf("%d connections, %d trainings and %d jobs still running, cancelling",
+			atomic.LoadInt64(&openConns), atomic.LoadInt64(&activeTrainings), jobManager.Pending())
+		cancelShutdown()
+		if !waitDrained(shutdownGrace) {
+			shutdownLog.Warnf("gave up waiting for cancelled requests")
+		}
+	}
+	cancelShutdown()
+
+	if raftNode.IsLeader() {
+		if leader, err := raftNode.TransferLeadership(); err != nil {
+			shutdownLog.Warnf("leadership not transferred: %v", err)
+		} else {
+			shutdownLog.Infof("leadership transferred to %s", leader)
+		}
+	}
+	raftNode.Stop()
+	if javaBridge != nil {
+		javaBridge.Close(shutdownGrace)
+	}
+	raftNode.Flush()
+
+	shutdownLog.Infof("done in %v", time.Since(start).Round(time.Millisecond))
+	closeLog()
+	close(shutdownDone)
+}
+
+// waitDrained waits until no client connection, training or job is running
+func waitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if atomic.LoadInt64(&openConns) == 0 && atomic.LoadInt64(&activeTrainings) == 0 && jobManager.Pending() == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// closeLog flushes and closes the log file; later messages go to stdout only
+func closeLog() {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+		logFile = nil
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================================
+// RAFT snapshots and log compaction
+// ============================================================================
+
+// Snapshotter is implemented by state machines that support log compaction
+type Snapshotter interface {
+	// Snapshot captures the state after the last applied entry
+	Snapshot() ([]byte, error)
+	// SnapshotFiles returns the files a follower needs alongside the state
+	SnapshotFiles(state []byte) (map[string][]byte, error)
+	// InstallFiles writes files received from the leader
+	InstallFiles(state []byte, files map[string][]byte) error
+	// Restore replaces the state with one taken at index
+	Restore(index int, state []byte) error
+}
+
+// snapshotChunkSize bounds the data carried by one INSTALL_SNAPSHOT RPC
+const snapshotChunkSize = 512 * 1024
+
+// snapshotFile is the on-disk layout of raft_snapshot.json. Model files are
+// not included: they already live in the models directory.
+type snapshotFile struct {
+	LastIncludedIndex int             `json:"last_included_index"`
+	LastIncludedTerm  int             `json:"last_included_term"`
+	Members           []Peer          `json:"members"`
+	Config            *clusterConfig  `json:"config,omitempty"`
+	State             json.RawMessage `json:"state"`
+}
+
+// snapshotBlob is what INSTALL_SNAPSHOT transfers: the snapshot plus the
+// files it refers to
+type snapshotBlob struct {
+	snapshotFile
+	Files map[string][]byte `json:"files"`
+}
+
+// snapshotTransfer accumulates INSTALL_SNAPSHOT chunks on a follower
+type snapshotTransfer struct {
+	index int
+	buf   []byte
+}
+
+// SetSnapshotThreshold sets how many applied entries trigger a snapshot
+func (rn *RaftNode) SetSnapshotThreshold(n int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.snapshotThreshold = n
+}
+
+// saveSnapshot writes the current snapshot; callers hold rn.mu. It is
+// written before raft_state.json so a crash in between leaves a snapshot
+// newer than the log, which loadSnapshot reconciles.
+func (rn *RaftNode) saveSnapshot() error {
+	if rn.persistencePath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(snapshotFile{
+		LastIncludedIndex: rn.snapshotIndex,
+		LastIncludedTerm:  rn.snapshotTerm,
+		Members:           rn.snapshotPeers,
+		Config:            rn.snapshotConfig,
+		State:             rn.snapshotState,
+	})
+	if err != nil {
+		raftLog.Errorf("Error marshaling snapshot: %v", err)
+		return err
+	}
+
+	path := filepath.Join(rn.persistencePath, "raft_snapshot.json")
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		raftLog.Errorf("Error writing snapshot: %v", err)
+		return err
+	}
+	if err := replaceFile(tmp, path); err != nil {
+		raftLog.Errorf("Error renaming snapshot file: %v", err)
+		return err
+	}
+	return nil
+}
+
+// loadSnapshot restores the state machine from raft_snapshot.json at startup
+// and drops log entries the snapshot already covers
+func (rn *RaftNode) loadSnapshot() {
+	if rn.persistencePath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(rn.persistencePath, "raft_snapshot.json"))
+	if err != nil {
+		rn.mu.RLock()
+		missing := rn.snapshotIndex >= 0
+		rn.mu.RUnlock()
+		if missing {
+			raftLog.Errorf("log is compacted but raft_snapshot.json is missing; state before the log is lost")
+		}
+		return
+	}
+
+	var snap snapshotFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		raftLog.Errorf("Error loading snapshot: %v", err)
+		return
+	}
+
+	rn.mu.Lock()
+	if snap.LastIncludedIndex > rn.snapshotIndex {
+		// The snapshot is already on disk; a log that can't be rewritten
+		// now is reconciled with it again on the next start
+		rn.adoptSnapshotLocked(snap.LastIncludedIndex, snap.LastIncludedTerm, snap.State, snap.Members, snap.Config)
+		rn.saveState()
+	} else {
+		rn.snapshotState = snap.State
+		rn.snapshotPeers = snap.Members
+		rn.snapshotConfig = snap.Config
+		rn.refreshConfigLocked()
+	}
+	index := rn.snapshotIndex
+	rn.commitIndex = index
+	rn.applyMu.Lock()
+	rn.lastApplied = index
+	rn.applyMu.Unlock()
+	sm := rn.stateMachine
+	rn.mu.Unlock()
+
+	if s, ok := sm.(Snapshotter); ok {
+		if err := s.Restore(index, snap.State); err != nil {
+			raftLog.Errorf("Error restoring snapshot: %v", err)
+		}
+	}
+	rn.addMembers(snap.Members)
+
+	raftLog.Infof("Loaded snapshot (last_included_index=%d, term=%d)", index, snap.LastIncludedTerm)
+}
+
+// maybeSnapshot compacts the log once enough entries have been applied since
+// the last snapshot. It runs on the applier goroutine with rn.applyExec held,
+// right after index was applied.
+func (rn *RaftNode) maybeSnapshot(index int) {
+	rn.mu.RLock()
+	due := rn.snapshotThreshold > 0 && index-rn.snapshotIndex >= rn.snapshotThreshold
+	sm := rn.stateMachine
+	rn.mu.RUnlock()
+	if !due {
+		return
+	}
+	s, ok := sm.(Snapshotter)
+	if !ok {
+		return
+	}
+
+	state, err := s.Snapshot()
+	if err != nil {
+		raftLog.Errorf("snapshot failed: %v", err)
+		return
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if index <= rn.snapshotIndex || index > rn.lastLogIndex() {
+		return
+	}
+	before := len(rn.log)
+	config, _ := rn.configAtLocked(index)
+	if err := rn.compactLocked(index, rn.termAt(index), state, rn.membersLocked(), config); err != nil {
+		return
+	}
+	raftLog.Infof("snapshot at index %d, compacted %d log entries", index, before-len(rn.log))
+}
+
+// compactLocked installs a snapshot ending at index, discards the log up to
+// it and persists both. If either write fails nothing is discarded: the log
+// is kept as it was and the error returned. Callers hold rn.mu.
+func (rn *RaftNode) compactLocked(index, term int, state []byte, members []Peer, config *clusterConfig) error {
+	prevLog, prevIndex, prevTerm := rn.log, rn.snapshotIndex, rn.snapshotTerm
+	prevState, prevPeers, prevConfig := rn.snapshotState, rn.snapshotPeers, rn.snapshotConfig
+	rn.adoptSnapshotLocked(index, term, state, members, config)
+
+	err := rn.saveSnapshot()
+	if err == nil {
+		err = rn.saveState()
+	}
+	if err != nil {
+		rn.log, rn.snapshotIndex, rn.snapshotTerm = prevLog, prevIndex, prevTerm
+		rn.snapshotState, rn.snapshotPeers, rn.snapshotConfig = prevState, prevPeers, prevConfig
+		rn.refreshConfigLocked()
+		raftLog.Errorf("compaction to index %d failed, log kept: %v", index, err)
+		return err
+	}
+	metrics.Inc("raft.snapshots", 1)
+	return nil
+}
+
+// adoptSnapshotLocked makes the snapshot ending at index the current one in
+// memory and drops the log up to it. Entries after index are kept only if
+// the log agrees on its term. config is the cluster configuration in effect
+// at index. Callers hold rn.mu.
+func (rn *RaftNode) adoptSnapshotLocked(index, term int, state []byte, members []Peer, config *clusterConfig) {
+	var keep []LogEntry
+	if index <= rn.lastLogIndex() && rn.termAt(index) == term {
+		keep = append(keep, rn.log[index-rn.snapshotIndex:]...)
+	}
+	rn.log = keep
+	rn.snapshotIndex = index
+	rn.snapshotTerm = term
+	rn.snapshotState = state
+	rn.snapshotPeers = members
+	rn.snapshotConfig = config
+	rn.refreshConfigLocked()
+}
+
+// addMembers adds the peers recorded in a snapshot taken before the cluster
+// had a MEMBERSHIP configuration; once it has one, that alone decides the
+// peers. A node bound to an unspecified address can't recognise itself by
+// host, so it skips any member on its own ports; its -peers list still applies.
+func (rn *RaftNode) addMembers(members []Peer) {
+	rn.mu.RLock()
+	configured := rn.config != nil
+	rn.mu.RUnlock()
+	if configured {
+		return
+	}
+	ip := net.ParseIP(rn.host)
+	unspecified := ip != nil && ip.IsUnspecified()
+	for _, p := range members {
+		if unspecified && p.Port == rn.port && p.WorkerPort == rn.workerPort {
+			continue
+		}
+		rn.addPeer(p)
+	}
+}
+
+// sendSnapshot transfers the current snapshot to a follower whose next entry
+// was compacted away. Callers hold the peer's send lock.
+func (rn *RaftNode) sendSnapshot(peer Peer, key string) bool {
+	rn.mu.RLock()
+	term := rn.currentTerm
+	blob := snapshotBlob{snapshotFile: snapshotFile{
+		LastIncludedIndex: rn.snapshotIndex,
+		LastIncludedTerm:  rn.snapshotTerm,
+		Members:           rn.snapshotPeers,
+		Config:            rn.snapshotConfig,
+		State:             rn.snapshotState,
+	}}
+	sm := rn.stateMachine
+	leaderID := []interface{}{rn.host, rn.workerPort}
+	rn.mu.RUnlock()
+
+	if s, ok := sm.(Snapshotter); ok {
+		files, err := s.SnapshotFiles(blob.State)
+		if err != nil {
+			raftLog.Errorf("cannot read snapshot files: %v", err)
+			return false
+		}
+		blob.Files = files
+	}
+	data, err := json.Marshal(blob)
+	if err != nil {
+		raftLog.Errorf("cannot encode snapshot: %v", err)
+		return false
+	}
+
+	raftLog.Infof("sending snapshot (index %d, %d files, %d bytes) to %s",
+		blob.LastIncludedIndex, len(blob.Files), len(data), key)
+
+	for offset := 0; ; offset += snapshotChunkSize {
+		end := min(len(data), offset+snapshotChunkSize)
+		resp := rn.sendRPC(peer.Host, peer.Port, map[string]interface{}{
+			"type":                INSTALL_SNAPSHOT,
+			"term":                term,
+			"leader_id":           leaderID,
+			"last_included_index": blob.LastIncludedIndex,
+			"last_included_term":  blob.LastIncludedTerm,
+			"offset":              offset,
+			"data":                data[offset:end],
+			"done":                end == len(data),
+		})
+		if resp == nil {
+			return false
+		}
+		rn.mu.Lock()
+		stale := rn.observeTerm(key, resp) || rn.state != "leader" || rn.currentTerm != term
+		rn.mu.Unlock()
+		if stale || resp["success"] != true {
+			return false
+		}
+		if end == len(data) {
+			break
+		}
+	}
+
+	rn.mu.Lock()
+	if blob.LastIncludedIndex > rn.matchIndex[key] {
+		rn.matchIndex[key] = blob.LastIncludedIndex
+	}
+	rn.nextIndex[key] = blob.LastIncludedIndex + 1
+	rn.mu.Unlock()
+
+	metrics.Inc("raft.snapshots_sent", 1)
+	return true
+}
+
+// handleInstallSnapshot receives one chunk of a snapshot from the leader and
+// installs it once the last chunk arrives
+func (rn *RaftNode) handleInstallSnapshot(msg map[string]interface{}) map[string]interface{} {
+	term := int(numberOr(msg["term"], 0))
+	index := int(numberOr(msg["last_included_index"], -1))
+	offset := int(numberOr(msg["offset"], 0))
+	done, _ := msg["done"].(bool)
+
+	reply := func(success bool) map[string]interface{} {
+		return map[string]interface{}{
+			"type":    INSTALL_SNAPSHOT,
+			"term":    rn.currentTerm,
+			"success": success,
+		}
+	}
+
+	encoded, _ := msg["data"].(string)
+	chunk, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		rn.mu.RLock()
+		defer rn.mu.RUnlock()
+		return reply(false)
+	}
+
+	rn.mu.Lock()
+	if term < rn.currentTerm {
+		defer rn.mu.Unlock()
+		return reply(false)
+	}
+	if term > rn.currentTerm {
+		rn.currentTerm = term
+		metrics.Inc("raft.term_changes", 1)
+		rn.votedFor = ""
+		rn.saveState()
+	}
+	rn.state = "follower"
+	rn.setLeader(msg["leader_id"])
+	rn.lastLeaderContact = time.Now()
+	rn.resetElectionTimeout()
+
+	recv := &rn.snapshotRecv
+	if offset == 0 {
+		recv.index = index
+		recv.buf = recv.buf[:0]
+	}
+	if recv.index != index || offset != len(recv.buf) {
+		defer rn.mu.Unlock()
+		return reply(false)
+	}
+	recv.buf = append(recv.buf, chunk...)
+	if !done {
+		defer rn.mu.Unlock()
+		return reply(true)
+	}
+	data := recv.buf
+	recv.buf = nil
+	rn.mu.Unlock()
+
+	ok := rn.installSnapshot(data)
+
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return reply(ok)
+}
+
+// installSnapshot replaces local state with a snapshot received from the
+// leader. The applier is paused for the duration so no older queued entry can
+// be applied on top of the restored state.
+func (rn *RaftNode) installSnapshot(data []byte) bool {
+	var blob snapshotBlob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		raftLog.Errorf("invalid snapshot: %v", err)
+		return false
+	}
+
+	rn.applyExec.Lock()
+	defer rn.applyExec.Unlock()
+
+	rn.mu.RLock()
+	alreadyHave := blob.LastIncludedIndex <= rn.commitIndex
+	sm := rn.stateMachine
+	rn.mu.RUnlock()
+	if alreadyHave {
+		// Everything in the snapshot is already committed here; the leader
+		// continues with AppendEntries from the next index
+		return true
+	}
+
+	if s, ok := sm.(Snapshotter); ok {
+		if err := s.InstallFiles(blob.State, blob.Files); err != nil {
+			raftLog.Errorf("cannot install snapshot files: %v", err)
+			return false
+		}
+		if err := s.Restore(blob.LastIncludedIndex, blob.State); err != nil {
+			raftLog.Errorf("cannot restore snapshot: %v", err)
+			return false
+		}
+	}
+
+	rn.mu.Lock()
+	if err := rn.compactLocked(blob.LastIncludedIndex, blob.LastIncludedTerm, blob.State, blob.Members, blob.Config); err != nil {
+		// The state machine already holds the snapshot: drop what was queued
+		// before it, and let the leader send it again
+		rn.applyMu.Lock()
+		rn.applyQueue = nil
+		rn.lastApplied = blob.LastIncludedIndex
+		rn.applyMu.Unlock()
+		rn.mu.Unlock()
+		return false
+	}
+	if blob.LastIncludedIndex > rn.commitIndex {
+		rn.commitIndex = blob.LastIncludedIndex
+	}
+	rn.applyMu.Lock()
+	rn.applyQueue = nil
+	rn.lastApplied = blob.LastIncludedIndex
+	rn.applyMu.Unlock()
+	rn.mu.Unlock()
+
+	rn.addMembers(blob.Members)
+
+	raftLog.Infof("installed snapshot from leader (index %d, term %d, %d files)",
+		blob.LastIncludedIndex, blob.LastIncludedTerm, len(blob.Files))
+	return true
+}
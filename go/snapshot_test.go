@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompactionKeepsLogWhenWriteFails(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestNode(t, 2, 1, 1, 2, 2)
+	rn.SetPersistencePath(filepath.Join(blocker, "raft"))
+
+	rn.mu.Lock()
+	err := rn.compactLocked(1, 1, json.RawMessage(`{}`), nil, nil)
+	rn.mu.Unlock()
+	if err == nil {
+		t.Fatal("compaction succeeded without its snapshot on disk")
+	}
+	if got := logTerms(rn); !reflect.DeepEqual(got, []int{1, 1, 2, 2}) || rn.snapshotIndex != -1 {
+		t.Errorf("log terms %v, snapshot index %d; want [1 1 2 2], -1", got, rn.snapshotIndex)
+	}
+}
+
+func TestCompactionSurvivesRestart(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		term  int
+		want  []int // terms left in the log
+	}{
+		{name: "prefix", index: 1, term: 1, want: []int{2, 2}},
+		{name: "whole log", index: 3, term: 2, want: []int{}},
+		{name: "snapshot disagrees with log", index: 2, term: 3, want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rn := newTestNode(t, 3, 1, 1, 2, 2)
+			rn.SetPersistencePath(dir)
+			rn.mu.Lock()
+			if err := rn.saveState(); err != nil {
+				t.Fatal(err)
+			}
+			if err := rn.compactLocked(tt.index, tt.term, json.RawMessage(`{}`), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			rn.wal.file.Close()
+			rn.mu.Unlock()
+
+			restarted := newTestNode(t, 0)
+			restarted.SetPersistencePath(dir)
+			if err := restarted.loadState(); err != nil {
+				t.Fatal(err)
+			}
+			restarted.loadSnapshot()
+			if restarted.snapshotIndex != tt.index || restarted.snapshotTerm != tt.term {
+				t.Errorf("snapshot %d/%d, want %d/%d", restarted.snapshotIndex, restarted.snapshotTerm, tt.index, tt.term)
+			}
+			if got := logTerms(restarted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("log terms = %v, want %v", got, tt.want)
+			}
+			if restarted.commitIndex != tt.index {
+				t.Errorf("commitIndex = %d, want %d", restarted.commitIndex, tt.index)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ============================================================================
+// raft_state.json integrity
+// ============================================================================
+
+// The Go worker wraps its RAFT state in a checksummed envelope:
+//
+//	{"checksum": "<sha256 of state>", "state": {"current_term": 5, ...}}
+//
+// Each checkpoint (wal.go) first moves the current file to
+// raft_state.json.prev, so a file left half written or damaged on disk is
+// detected on start and the node falls back to the previous generation,
+// replaying the write-ahead log records written since. Losing a recorded vote or term could let the node vote twice in
+// one term, so when neither generation is readable the node refuses to
+// start instead of starting empty. Files written before the envelope are
+// still read, without a check.
+
+const (
+	stateFileName     = "raft_state.json"
+	prevStateFileName = "raft_state.json.prev"
+)
+
+// errStateCorrupt marks a state file whose contents can't be trusted
+var errStateCorrupt = errors.New("corrupt RAFT state file")
+
+type stateEnvelope struct {
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+// encodeStateFile returns the on-disk form of the encoded state
+func encodeStateFile(state []byte) ([]byte, error) {
+	return json.Marshal(stateEnvelope{Checksum: sha256Hex(state), State: state})
+}
+
+// decodeStateFile checks a state file and returns the state it holds
+func decodeStateFile(data []byte) ([]byte, error) {
+	var env stateEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", errStateCorrupt, err)
+	}
+	if env.State == nil {
+		if env.Checksum != "" {
+			return nil, fmt.Errorf("%w: no state", errStateCorrupt)
+		}
+		return data, nil // written before checksums
+	}
+	if sha256Hex(env.State) != env.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errStateCorrupt)
+	}
+	return env.State, nil
+}
+
+// readStateFile reads and checks the state file at path
+func readStateFile(path string) (persistedState, error) {
+	state := persistedState{SnapshotIndex: -1}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	body, err := decodeStateFile(data)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(body, &state); err != nil {
+		return state, fmt.Errorf("%w: %v", errStateCorrupt, err)
+	}
+	return state, nil
+}
+
+// loadStateGenerations returns the newest readable generation of the state
+// in dir, and false when the node has never saved any. A damaged current
+// file is moved aside to raft_state.json.corrupt once the previous
+// generation has been read, so the next save doesn't rotate it over the
+// good copy.
+func loadStateGenerations(dir string) (persistedState, bool, error) {
+	current := filepath.Join(dir, stateFileName)
+	state, err := readStateFile(current)
+	if err == nil {
+		return state, true, nil
+	}
+	currentErr := err
+
+	prev := filepath.Join(dir, prevStateFileName)
+	state, err = readStateFile(prev)
+	switch {
+	case err == nil:
+		if !os.IsNotExist(currentErr) {
+			raftLog.Errorf("%s: %v; recovered the previous generation from %s", current, currentErr, prevStateFileName)
+			if err := replaceFile(current, current+".corrupt"); err != nil {
+				return state, true, fmt.Errorf("move %s aside: %v", current, err)
+			}
+			metrics.Inc("raft.state_recovered", 1)
+		}
+		// else: a crash between the two renames of a save
+		return state, true, nil
+	case os.IsNotExist(currentErr) && os.IsNotExist(err):
+		return state, false, nil
+	case os.IsNotExist(currentErr):
+		return state, false, fmt.Errorf("%s is missing and %s is unreadable: %v", current, prev, err)
+	case os.IsNotExist(err):
+		return state, false, fmt.Errorf("%s: %v (no previous generation)", current, currentErr)
+	default:
+		return state, false, fmt.Errorf("%s: %v; %s: %v", current, currentErr, prev, err)
+	}
+}
+
+// writeStateGenerations replaces the state in dir with data, keeping the
+// current file as the previous generation
+func writeStateGenerations(dir string, state []byte) error {
+	data, err := encodeStateFile(state)
+	if err != nil {
+		return err
+	}
+	current := filepath.Join(dir, stateFileName)
+	tempFile := current + ".tmp"
+	if err := writeFileSync(tempFile, data); err != nil {
+		return fmt.Errorf("write state: %v", err)
+	}
+	if _, err := os.Stat(current); err == nil {
+		if err := replaceFile(current, filepath.Join(dir, prevStateFileName)); err != nil {
+			return fmt.Errorf("keep previous state: %v", err)
+		}
+	}
+	if err := replaceFile(tempFile, current); err != nil {
+		return fmt.Errorf("rename state file: %v", err)
+	}
+	return nil
+}
+
+// writeFileSync writes data to path and flushes it to disk before returning
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Replicated state machine and command registry
+// ============================================================================
+
+// StateMachine consumes committed RAFT entries in log order
+type StateMachine interface {
+	Apply(index int, raw map[string]interface{}) error
+}
+
+// Command is a typed, replicated state-machine command. Apply must be
+// idempotent: entries are re-applied after a restart because commitIndex
+// is volatile.
+type Command interface {
+	Action() string
+	Validate() error
+	Apply(sm *ModelStateMachine) error
+}
+
+// commandRegistry maps log entry "action" values to typed payloads
+var commandRegistry = map[string]func() Command{}
+
+// RegisterCommand adds a command type to the registry
+func RegisterCommand(action string, factory func() Command) {
+	commandRegistry[action] = factory
+}
+
+func init() {
+	RegisterCommand("STORE_FILE", func() Command { return &StoreFileCommand{} })
+	RegisterCommand("STORE_FILE_BEGIN", func() Command { return &StoreFileBeginCommand{} })
+	RegisterCommand("STORE_FILE_CHUNK", func() Command { return &StoreFileChunkCommand{} })
+	RegisterCommand("STORE_FILE_END", func() Command { return &StoreFileEndCommand{} })
+	RegisterCommand("STORE_FILE_REF", func() Command { return &StoreFileRefCommand{} })
+	RegisterCommand("DELETE_FILE", func() Command { return &DeleteFileCommand{} })
+	RegisterCommand("PURGE_TOMBSTONES", func() Command { return &PurgeTombstonesCommand{} })
+	RegisterCommand("MODEL_TRAINED", func() Command { return &ModelTrainedCommand{} })
+	RegisterCommand("SET_ALIAS", func() Command { return &SetAliasCommand{} })
+	RegisterCommand("SET_PREPROCESS", func() Command { return &SetPreprocessCommand{} })
+	RegisterCommand("QUARANTINE", func() Command { return &QuarantineCommand{} })
+	RegisterCommand("SET_SETTINGS", func() Command { return &SetSettingsCommand{} })
+	RegisterCommand("RESERVE_NAME", func() Command { return &ReserveNameCommand{} })
+	RegisterCommand("MEMBERSHIP", func() Command { return &MembershipCommand{} })
+	RegisterCommand("JOB", func() Command { return &JobCommand{} })
+	RegisterCommand("NOOP", func() Command { return &NoopCommand{} })
+	RegisterCommand("LOCK", func() Command { return &LockCommand{} })
+	RegisterCommand("KV", func() Command { return &KVCommand{} })
+}
+
+// decodeCommand turns a raw log entry into its typed command
+func decodeCommand(raw map[string]interface{}) (Command, error) {
+	action, _ := raw["action"].(string)
+	factory, ok := commandRegistry[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+
+	cmd := factory()
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", action, err)
+	}
+	return cmd, nil
+}
+
+// encodeCommand turns a typed command into the raw form stored in the log
+func encodeCommand(cmd Command) map[string]interface{} {
+	data, _ := json.Marshal(cmd)
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+	raw["action"] = cmd.Action()
+	return raw
+}
+
+// replicateCommand validates a typed command and replicates it through RAFT,
+// returning the committed log index
+func replicateCommand(cmd Command) (int, error) {
+	if err := cmd.Validate(); err != nil {
+		return -1, err
+	}
+	index, ok := raftNode.ReplicateIndex(encodeCommand(cmd))
+	if !ok {
+		return index, fmt.Errorf("replication failed")
+	}
+	return index, nil
+}
+
+// ModelStateMachine is the worker's state machine: model files on disk plus
+// in-memory indexes rebuilt from the log
+type ModelStateMachine struct {
+	modelsDir string
+
+	mu          sync.RWMutex
+	lastApplied int
+	applied     chan struct{}            // closed and replaced whenever lastApplied advances
+	models      map[string]string        // model id -> path
+	aliases     map[string]string        // alias -> model id
+	names       map[string]string        // model id or alias -> owner (names.go)
+	files       map[string]int           // STORE_FILE name -> index it was written at
+	checksums   map[string]string        // file name -> SHA-256 of its contents (integrity.go)
+	transfers   map[string]*fileTransfer // chunked STORE_FILE in progress (filechunks.go)
+	inputStats  map[string]*InputStats   // model id -> training input statistics (drift.go)
+	registry    *ModelRegistry           // model metadata, persisted in models.json (registry.go)
+	tombstones  map[string]string        // deleted model id -> its file name
+	deletedAt   map[string]int           // deleted model id -> index of its DELETE_FILE (tombstones.go)
+	jobs        map[string]*JobRecord    // JOB_SUBMIT jobs (jobstore.go)
+	locks       map[string]*Lease        // held leases (locks.go)
+	lockToken   int64                    // last fencing token granted
+	kv          map[string]*KVEntry      // client metadata (kv.go)
+	kvRevision  int64                    // last KV write
+	settings    *ClusterSettings         // cluster-wide settings (settings.go)
+	onApply     []func(index int, cmd Command)
+}
+
+// NewModelStateMachine creates the state machine over a models directory
+func NewModelStateMachine(dir string) *ModelStateMachine {
+	return &ModelStateMachine{
+		modelsDir:   dir,
+		lastApplied: -1,
+		applied:     make(chan struct{}),
+		models:      make(map[string]string),
+		aliases:     make(map[string]string),
+		names:       make(map[string]string),
+		files:       make(map[string]int),
+		checksums:   make(map[string]string),
+		transfers:   make(map[string]*fileTransfer),
+		inputStats:  make(map[string]*InputStats),
+		registry:    NewModelRegistry(dir),
+		tombstones:  make(map[string]string),
+		deletedAt:   make(map[string]int),
+		jobs:        make(map[string]*JobRecord),
+		locks:       make(map[string]*Lease),
+		kv:          make(map[string]*KVEntry),
+		settings:    NewClusterSettings(),
+	}
+}
+
+// OnApply registers a hook that runs after each successfully applied command
+func (sm *ModelStateMachine) OnApply(fn func(index int, cmd Command)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.onApply = append(sm.onApply, fn)
+}
+
+// Apply decodes, validates and applies one committed entry. The entry counts
+// as applied even if it is rejected, so readers waiting on an index never
+// stall behind a bad entry.
+func (sm *ModelStateMachine) Apply(index int, raw map[string]interface{}) error {
+	defer sm.advance(index)
+
+	cmd, err := decodeCommand(raw)
+	if err != nil {
+		raftLog.Errorf("apply [%d]: %v", index, err)
+		return err
+	}
+	if err := cmd.Validate(); err != nil {
+		raftLog.Errorf("apply [%d] %s: invalid: %v", index, cmd.Action(), err)
+		return err
+	}
+	if err := cmd.Apply(sm); err != nil {
+		raftLog.Errorf("apply [%d] %s: %v", index, cmd.Action(), err)
+		return err
+	}
+	sm.recordFile(index, cmd)
+
+	sm.mu.RLock()
+	hooks := sm.onApply
+	sm.mu.RUnlock()
+
+	for _, fn := range hooks {
+		fn(index, cmd)
+	}
+	return nil
+}
+
+// recordFile tracks which replicated files exist and since which index, so
+// followers holding a file can be found and snapshots know what to ship
+func (sm *ModelStateMachine) recordFile(index int, cmd Command) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch c := cmd.(type) {
+	case *StoreFileCommand:
+		sm.files[c.Filename] = index
+		sm.checksums[c.Filename] = c.SHA256
+		fileRepairs.Drop(c.Filename)
+	case *StoreFileEndCommand:
+		sm.files[c.Filename] = index
+		sm.checksums[c.Filename] = c.SHA256
+		fileRepairs.Drop(c.Filename)
+	case *StoreFileRefCommand:
+		sm.checksums[c.Filename] = c.SHA256
+		if c.pending {
+			// present once the pull verifies it (installPulledFile)
+			delete(sm.files, c.Filename)
+			fileRepairs.Add(index, c)
+		} else {
+			sm.files[c.Filename] = index
+			fileRepairs.Drop(c.Filename)
+		}
+	case *ModelTrainedCommand:
+		if c.Metadata != nil && c.Metadata.SHA256 != "" && c.ModelPath != "" {
+			sm.checksums[filepath.Base(c.ModelPath)] = c.Metadata.SHA256
+		}
+	case *DeleteFileCommand:
+		delete(sm.files, c.Filename)
+		delete(sm.checksums, c.Filename)
+		fileRepairs.Drop(c.Filename)
+		if c.ModelID != "" {
+			sm.deletedAt[c.ModelID] = index
+		}
+	}
+}
+
+// advance marks index as applied and wakes WaitApplied callers
+func (sm *ModelStateMachine) advance(index int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if index > sm.lastApplied {
+		sm.lastApplied = index
+		close(sm.applied)
+		sm.applied = make(chan struct{})
+	}
+}
+
+// AppliedIndex returns the highest log index applied to this state machine
+func (sm *ModelStateMachine) AppliedIndex() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.lastApplied
+}
+
+// WaitApplied blocks until index has been applied or the timeout expires
+func (sm *ModelStateMachine) WaitApplied(index int, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		sm.mu.RLock()
+		done := sm.lastApplied >= index
+		ch := sm.applied
+		sm.mu.RUnlock()
+		if done {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// ModelPath returns the path recorded for a trained model id
+func (sm *ModelStateMachine) ModelPath(modelID string) (string, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	path, ok := sm.models[modelID]
+	return path, ok
+}
+
+// AliasesFor returns the aliases pointing at a model id
+func (sm *ModelStateMachine) AliasesFor(modelID string) []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var aliases []string
+	for alias, id := range sm.aliases {
+		if id == modelID {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// FileIndex returns the log index at which a replicated file was written
+func (sm *ModelStateMachine) FileIndex(name string) (int, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	index, ok := sm.files[name]
+	return index, ok
+}
+
+// InputStats returns the training input statistics of a model
+func (sm *ModelStateMachine) InputStats(modelID string) (*InputStats, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	stats, ok := sm.inputStats[modelID]
+	return stats, ok
+}
+
+// Registry returns the metadata index of committed models
+func (sm *ModelStateMachine) Registry() *ModelRegistry {
+	return sm.registry
+}
+
+// Deleted reports whether a model id was removed by DELETE_MODEL
+func (sm *ModelStateMachine) Deleted(modelID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	_, ok := sm.tombstones[modelID]
+	return ok
+}
+
+// deletedFileLocked returns the deleted model a file belonged to. Callers
+// hold sm.mu.
+func (sm *ModelStateMachine) deletedFileLocked(name string) (string, bool) {
+	for id, file := range sm.tombstones {
+		if file == name {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// ResolveAlias returns the model id an alias points to, or the input unchanged
+func (sm *ModelStateMachine) ResolveAlias(name string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if id, ok := sm.aliases[name]; ok {
+		return id
+	}
+	return name
+}
+
+// modelSnapshot is the ModelStateMachine state stored in RAFT snapshots
+type modelSnapshot struct {
+	Models  map[string]string `json:"models"`
+	Aliases map[string]string `json:"aliases"`
+	Names   map[string]string `json:"names"`
+	Files   map[string]int    `json:"files"`
+
+	Checksums  map[string]string         `json:"checksums,omitempty"`
+	InputStats map[string]*InputStats    `json:"input_stats,omitempty"`
+	Metadata   map[string]*ModelMetadata `json:"metadata,omitempty"`
+	Tombstones map[string]string         `json:"tombstones,omitempty"`
+	DeletedAt  map[string]int            `json:"deleted_at,omitempty"`
+	Jobs       map[string]*JobRecord     `json:"jobs,omitempty"`
+	Locks      map[string]*Lease         `json:"locks,omitempty"`
+	LockToken  int64                     `json:"lock_token,omitempty"`
+	KV         map[string]*KVEntry       `json:"kv,omitempty"`
+	KVRevision int64                     `json:"kv_revision,omitempty"`
+	Settings   map[string]string         `json:"settings,omitempty"`
+
+	PendingFiles []pendingFile `json:"pending_files,omitempty"` // out-of-band files not pulled yet
+}
+
+// Snapshot serializes the indexes. It runs on the applier goroutine, so the
+// result reflects exactly the last applied entry.
+func (sm *ModelStateMachine) Snapshot() ([]byte, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return json.Marshal(modelSnapshot{Models: sm.models, Aliases: sm.aliases, Names: sm.names, Files: sm.files, Checksums: sm.checksums, InputStats: sm.inputStats, Metadata: sm.registry.All(), Tombstones: sm.tombstones, DeletedAt: sm.deletedAt, Jobs: sm.jobs, Locks: sm.locks, LockToken: sm.lockToken, KV: sm.kv, KVRevision: sm.kvRevision, Settings: sm.settings.All(), PendingFiles: fileRepairs.List()})
+}
+
+// SnapshotFiles reads the files a follower installing the snapshot needs:
+// replicated files plus model files present in the models directory
+func (sm *ModelStateMachine) SnapshotFiles(state []byte) (map[string][]byte, error) {
+	var snap modelSnapshot
+	if err := json.Unmarshal(state, &snap); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range snap.Files {
+		names[name] = true
+	}
+	for _, path := range snap.Models {
+		if path != "" {
+			names[filepath.Base(path)] = true
+		}
+	}
+
+	files := make(map[string][]byte, len(names))
+	for name := range names {
+		if !safeBaseName(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(sm.modelsDir, name))
+		if err != nil {
+			// Deleted by a later entry, which the follower also applies
+			continue
+		}
+		if want, ok := snap.Checksums[name]; ok && sha256Hex(data) != want {
+			metrics.Inc("models.corrupt", 1)
+			storageLog.Errorf("snapshot: not sending %s, it fails its checksum", name)
+			continue
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// InstallFiles writes files received with a snapshot into the models
+// directory, checking each against the snapshot's checksums
+func (sm *ModelStateMachine) InstallFiles(state []byte, files map[string][]byte) error {
+	var snap modelSnapshot
+	if err := json.Unmarshal(state, &snap); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if !safeBaseName(name) {
+			return fmt.Errorf("unsafe filename %q", name)
+		}
+		if want, ok := snap.Checksums[name]; ok && sha256Hex(data) != want {
+			metrics.Inc("models.corrupt", 1)
+			return fmt.Errorf("%s fails its checksum", name)
+		}
+		path := filepath.Join(sm.modelsDir, name)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return fmt.Errorf("write %s: %v", name, err)
+		}
+		if err := replaceFile(tmp, path); err != nil {
+			return fmt.Errorf("rename %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the indexes with a snapshot taken at index
+func (sm *ModelStateMachine) Restore(index int, state []byte) error {
+	snap := modelSnapshot{}
+	if err := json.Unmarshal(state, &snap); err != nil {
+		return err
+	}
+	if snap.Models == nil {
+		snap.Models = make(map[string]string)
+	}
+	if snap.Aliases == nil {
+		snap.Aliases = make(map[string]string)
+	}
+	if snap.Files == nil {
+		snap.Files = make(map[string]int)
+	}
+	if snap.Checksums == nil {
+		snap.Checksums = make(map[string]string)
+	}
+	if snap.InputStats == nil {
+		snap.InputStats = make(map[string]*InputStats)
+	}
+	if snap.Tombstones == nil {
+		snap.Tombstones = make(map[string]string)
+	}
+	if snap.DeletedAt == nil {
+		snap.DeletedAt = make(map[string]int)
+	}
+	if snap.Jobs == nil {
+		snap.Jobs = make(map[string]*JobRecord)
+	}
+	if snap.Locks == nil {
+		snap.Locks = make(map[string]*Lease)
+	}
+	if snap.KV == nil {
+		snap.KV = make(map[string]*KVEntry)
+	}
+
+	sm.mu.Lock()
+	sm.models = snap.Models
+	sm.aliases = snap.Aliases
+	sm.names = snap.Names
+	if sm.names == nil {
+		sm.rebuildNames()
+	}
+	sm.files = snap.Files
+	sm.checksums = snap.Checksums
+	sm.inputStats = snap.InputStats
+	sm.tombstones = snap.Tombstones
+	sm.deletedAt = snap.DeletedAt
+	sm.jobs = snap.Jobs
+	sm.locks = snap.Locks
+	sm.lockToken = snap.LockToken
+	sm.kv = snap.KV
+	sm.kvRevision = snap.KVRevision
+	sm.mu.Unlock()
+	sm.registry.Replace(snap.Metadata)
+	sm.settings.Replace(snap.Settings)
+	sm.removeTombstonedFiles()
+	fileRepairs.Reset(snap.PendingFiles)
+
+	sm.advance(index)
+	raftLog.Infof("restored state machine from snapshot at index %d (%d models, %d aliases)",
+		index, len(snap.Models), len(snap.Aliases))
+	return nil
+}
+
+// ============================================================================
+// Commands
+// ============================================================================
+
+// StoreFileCommand writes a (model) file into the models directory
+type StoreFileCommand struct {
+	Filename string `json:"filename"`
+	DataB64  string `json:"data_b64"`
+	SHA256   string `json:"sha256,omitempty"` // unset in entries written before checksums
+}
+
+func (c *StoreFileCommand) Action() string { return "STORE_FILE" }
+
+func (c *StoreFileCommand) Validate() error {
+	if c.Filename == "" || c.DataB64 == "" {
+		return fmt.Errorf("missing filename or data")
+	}
+	if !safeBaseName(c.Filename) {
+		return fmt.Errorf("unsafe filename %q", c.Filename)
+	}
+	return nil
+}
+
+func (c *StoreFileCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.RLock()
+	deletedID, deleted := sm.deletedFileLocked(c.Filename)
+	sm.mu.RUnlock()
+	if deleted {
+		return fmt.Errorf("%s belongs to deleted model %s", c.Filename, deletedID)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(c.DataB64)
+	if err != nil {
+		return fmt.Errorf("base64 decode error: %v", err)
+	}
+	sum := sha256Hex(data)
+	if c.SHA256 != "" && sum != c.SHA256 {
+		return fmt.Errorf("%s: data fails its checksum", c.Filename)
+	}
+	c.SHA256 = sum // recorded by recordFile
+
+	path := filepath.Join(sm.modelsDir, c.Filename)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write error: %v", err)
+	}
+	if err := replaceFile(tmp, path); err != nil {
+		return fmt.Errorf("rename error: %v", err)
+	}
+	raftLog.Infof("applied STORE_FILE: wrote %s (%d bytes)", path, len(data))
+	return nil
+}
+
+// DeleteFileCommand removes a file from the models directory. With a model
+// id (DELETE_MODEL) it also drops the model from every index and leaves a
+// tombstone, so a MODEL_TRAINED or STORE_FILE for it committed later, e.g.
+// by the trainer's still pending replication, can't bring it back.
+type DeleteFileCommand struct {
+	Filename string `json:"filename"`
+	ModelID  string `json:"model_id,omitempty"`
+}
+
+func (c *DeleteFileCommand) Action() string { return "DELETE_FILE" }
+
+func (c *DeleteFileCommand) Validate() error {
+	if !safeBaseName(c.Filename) {
+		return fmt.Errorf("unsafe filename %q", c.Filename)
+	}
+	return nil
+}
+
+func (c *DeleteFileCommand) Apply(sm *ModelStateMachine) error {
+	path := filepath.Join(sm.modelsDir, c.Filename)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if c.ModelID != "" {
+		sm.mu.Lock()
+		delete(sm.models, c.ModelID)
+		delete(sm.inputStats, c.ModelID)
+		for alias, id := range sm.aliases {
+			if id == c.ModelID {
+				delete(sm.aliases, alias)
+				if sm.names[alias] == ownerAlias {
+					delete(sm.names, alias)
+				}
+			}
+		}
+		sm.tombstones[c.ModelID] = c.Filename
+		sm.mu.Unlock()
+		sm.registry.Remove(c.ModelID)
+		liveUpdates.Publish("model_deleted", map[string]interface{}{"model_id": c.ModelID})
+	}
+	raftLog.Infof("applied DELETE_FILE: %s", path)
+	return nil
+}
+
+// ModelTrainedCommand records a model produced by the leader. It claims the
+// model id if no RESERVE_NAME did, and is rejected if another model or an
+// alias holds it.
+type ModelTrainedCommand struct {
+	ModelID    string         `json:"model_id"`
+	ModelPath  string         `json:"model_path"`
+	JobID      string         `json:"job_id,omitempty"`      // lineage for chunk GC
+	InputStats *InputStats    `json:"input_stats,omitempty"` // baseline for input drift
+	Metadata   *ModelMetadata `json:"metadata,omitempty"`    // for the model registry
+}
+
+func (c *ModelTrainedCommand) Action() string { return "MODEL_TRAINED" }
+
+func (c *ModelTrainedCommand) Validate() error {
+	if c.ModelID == "" {
+		return fmt.Errorf("missing model_id")
+	}
+	return nil
+}
+
+func (c *ModelTrainedCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	if _, deleted := sm.tombstones[c.ModelID]; deleted {
+		sm.mu.Unlock()
+		return fmt.Errorf("model %s was deleted", c.ModelID)
+	}
+	if err := sm.claimLocked(c.ModelID, modelOwner(c.ModelPath)); err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	sm.models[c.ModelID] = c.ModelPath
+	if c.InputStats != nil {
+		sm.inputStats[c.ModelID] = c.InputStats
+	}
+	sm.mu.Unlock()
+
+	meta := ModelMetadata{}
+	if c.Metadata != nil {
+		meta = *c.Metadata
+	}
+	meta.ModelID = c.ModelID
+	if c.ModelPath != "" {
+		meta.File = filepath.Base(c.ModelPath)
+	}
+	sm.registry.Register(&meta)
+	liveUpdates.Publish("model", map[string]interface{}{"model_id": c.ModelID, "file": meta.File})
+	raftLog.Infof("applied MODEL_TRAINED: %s", c.ModelID)
+	return nil
+}
+
+// SetAliasCommand points a human-friendly name at a model id. An empty
+// model id removes the alias. An alias can't take a name held by a model
+// nor point at a quarantined one.
+type SetAliasCommand struct {
+	Alias   string `json:"alias"`
+	ModelID string `json:"model_id"`
+}
+
+func (c *SetAliasCommand) Action() string { return "SET_ALIAS" }
+
+func (c *SetAliasCommand) Validate() error {
+	if c.Alias == "" {
+		return fmt.Errorf("missing alias")
+	}
+	return nil
+}
+
+func (c *SetAliasCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if c.ModelID == "" {
+		if sm.names[c.Alias] == ownerAlias {
+			delete(sm.names, c.Alias)
+		}
+		delete(sm.aliases, c.Alias)
+	} else {
+		if meta, ok := sm.registry.Get(c.ModelID, ""); ok && meta.Quarantine != nil {
+			return fmt.Errorf("model %s is quarantined", c.ModelID)
+		}
+		if err := sm.claimLocked(c.Alias, ownerAlias); err != nil {
+			return err
+		}
+		sm.aliases[c.Alias] = c.ModelID
+	}
+	raftLog.Infof("applied SET_ALIAS: %s -> %s", c.Alias, c.ModelID)
+	return nil
+}
+
+// MembershipCommand is a cluster configuration (membership.go): joint while
+// Old is set, final otherwise. RAFT switches configuration when the entry is
+// appended, so applying it only records the change.
+type MembershipCommand struct {
+	Old []Peer `json:"old,omitempty"`
+	New []Peer `json:"new"`
+}
+
+func (c *MembershipCommand) Action() string { return "MEMBERSHIP" }
+
+func (c *MembershipCommand) Validate() error {
+	if len(c.New) == 0 {
+		return fmt.Errorf("empty configuration")
+	}
+	for _, p := range append(append([]Peer{}, c.Old...), c.New...) {
+		if p.Host == "" || p.Port <= 0 {
+			return fmt.Errorf("member missing host or port")
+		}
+	}
+	return nil
+}
+
+func (c *MembershipCommand) Apply(sm *ModelStateMachine) error {
+	if len(c.Old) > 0 {
+		raftLog.Infof("applied MEMBERSHIP: joint configuration, %d -> %d members", len(c.Old), len(c.New))
+	} else {
+		raftLog.Infof("applied MEMBERSHIP: %d members", len(c.New))
+	}
+	return nil
+}
+
+// NoopCommand is committed by a new leader to commit earlier terms' entries
+type NoopCommand struct{}
+
+func (c *NoopCommand) Action() string { return "NOOP" }
+
+func (c *NoopCommand) Validate() error { return nil }
+
+func (c *NoopCommand) Apply(sm *ModelStateMachine) error { return nil }
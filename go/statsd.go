@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// statsd push exporter
+// ============================================================================
+
+// maxStatsdPacket keeps datagrams under a typical MTU
+const maxStatsdPacket = 1400
+
+// StatsdExporter periodically ships metrics to a statsd/Graphite-compatible
+// agent over UDP
+type StatsdExporter struct {
+	addr     string
+	prefix   string
+	interval time.Duration
+}
+
+// NewStatsdExporter creates an exporter for the given host:port
+func NewStatsdExporter(addr, prefix string, interval time.Duration) *StatsdExporter {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	metrics.KeepTimers()
+	return &StatsdExporter{addr: addr, prefix: prefix, interval: interval}
+}
+
+// Run flushes metrics every interval until stopCh is closed
+func (e *StatsdExporter) Run(stopCh <-chan struct{}) {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		metricsLog.Warnf("cannot resolve %s: %v", e.addr, err)
+		return
+	}
+	defer conn.Close()
+
+	metricsLog.Infof("pushing metrics to %s every %v", e.addr, e.interval)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			e.flush(conn, metrics.Drain())
+		}
+	}
+}
+
+func (e *StatsdExporter) flush(conn net.Conn, snap MetricsSnapshot) {
+	var lines []string
+	for _, name := range sortedKeys(snap.Counters) {
+		lines = append(lines, fmt.Sprintf("%s:%d|c", e.name(name), snap.Counters[name]))
+	}
+	for _, name := range sortedKeys(snap.Timers) {
+		for _, d := range snap.Timers[name] {
+			lines = append(lines, fmt.Sprintf("%s:%d|ms", e.name(name), d.Milliseconds()))
+		}
+	}
+	for _, name := range sortedKeys(snap.Gauges) {
+		lines = append(lines, fmt.Sprintf("%s:%g|g", e.name(name), snap.Gauges[name]))
+	}
+
+	// Pack as many lines as fit into each datagram
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacket {
+			conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			metricsLog.Errorf("send error: %v", err)
+		}
+	}
+}
+
+func (e *StatsdExporter) name(metric string) string {
+	if e.prefix == "" {
+		return metric
+	}
+	return e.prefix + "." + metric
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ============================================================================
+// Storage layout
+// ============================================================================
+
+// StorageVolume is one configurable storage location
+type StorageVolume struct {
+	Name string
+	Path string
+}
+
+// storageVolumes returns every configured location. Paths that share a
+// filesystem simply report the same free space.
+func storageVolumes() []StorageVolume {
+	return []StorageVolume{
+		{Name: "models", Path: modelsDir},
+		{Name: "raft", Path: raftDir},
+		{Name: "scratch", Path: scratchDir},
+		{Name: "logs", Path: logDir},
+	}
+}
+
+// minFreeBytes is the free space below which a volume is considered full
+var minFreeBytes uint64 = 100 << 20
+
+// resolveDir returns override if set, otherwise base joined with def
+func resolveDir(override, base, def string) string {
+	if override != "" {
+		return override
+	}
+	if def == "" {
+		return base
+	}
+	return filepath.Join(base, def)
+}
+
+// ensureStorageDirs creates every configured directory
+func ensureStorageDirs() error {
+	for _, v := range storageVolumes() {
+		if err := os.MkdirAll(v.Path, 0755); err != nil {
+			return fmt.Errorf("create %s dir %s: %v", v.Name, v.Path, err)
+		}
+	}
+	return nil
+}
+
+// checkFreeSpace returns an error if dir's volume is below minFreeBytes.
+// Platforms where free space cannot be determined are never reported full.
+func checkFreeSpace(name, dir string) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return nil
+	}
+	if free < minFreeBytes {
+		return fmt.Errorf("%s volume %s has %d MB free (minimum %d MB)",
+			name, dir, free>>20, minFreeBytes>>20)
+	}
+	return nil
+}
+
+// storageStatus reports path and free space for each volume
+func storageStatus() []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, v := range storageVolumes() {
+		entry := map[string]interface{}{"name": v.Name, "path": v.Path}
+		if free, err := diskFree(v.Path); err == nil {
+			entry["free_bytes"] = free
+			entry["low"] = free < minFreeBytes
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// checkTrainingSpace verifies the volumes written by a training run
+func checkTrainingSpace() error {
+	if err := checkFreeSpace("scratch", scratchDir); err != nil {
+		return err
+	}
+	return checkFreeSpace("models", modelsDir)
+}
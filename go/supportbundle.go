@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Support bundle
+// ============================================================================
+
+// A support bundle is one .tar.gz a user can attach to an issue report:
+//
+//	bundle_manifest.json  what was collected, when, and what couldn't be
+//	status.json           the /status report
+//	config.json           command-line flags, secrets redacted
+//	raft.json             term, vote, log bounds and entries per action
+//	jobs.json             the replicated job table
+//	metrics.prom          the /metrics exposition
+//	worker.log            the tail of the log
+//
+// GET /admin/support-bundle builds it from the running node. `worker
+// support-bundle -monitor <addr>` downloads that; without a reachable
+// monitor it falls back to what can be read from the storage directory of a
+// stopped node (raft.json from the persisted state, and worker.log). Model
+// files, training data and log entry payloads are never included.
+
+const bundleManifestName = "bundle_manifest.json"
+
+// supportBundleLogBytes is how much of the end of worker.log is included
+const supportBundleLogBytes = 4 << 20
+
+// redactedFlagWords mark flags whose values are never put in a bundle
+var redactedFlagWords = []string{"secret", "key", "token", "password", "webhook"}
+
+// BundleManifest describes the contents of a support bundle
+type BundleManifest struct {
+	CreatedAt string   `json:"created_at"`
+	Source    string   `json:"source"` // "live" or "offline"
+	Node      string   `json:"node,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Files     []string `json:"files"`
+	Missing   []string `json:"missing,omitempty"` // what couldn't be collected, and why
+}
+
+// supportBundle accumulates the files of a bundle in memory
+type supportBundle struct {
+	manifest BundleManifest
+	files    map[string][]byte
+}
+
+func newSupportBundle(source string) *supportBundle {
+	return &supportBundle{
+		manifest: BundleManifest{
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Source:    source,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		},
+		files: make(map[string][]byte),
+	}
+}
+
+func (b *supportBundle) add(name string, data []byte) {
+	b.files[name] = data
+	b.manifest.Files = append(b.manifest.Files, name)
+}
+
+func (b *supportBundle) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.missing(name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *supportBundle) missing(name string, err error) {
+	b.manifest.Missing = append(b.manifest.Missing, fmt.Sprintf("%s: %v", name, err))
+}
+
+// writeTo writes the bundle as a .tar.gz, manifest last
+func (b *supportBundle) writeTo(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range b.manifest.Files {
+		if err := addTarFile(tw, name, b.files[name]); err != nil {
+			return err
+		}
+	}
+	manifestData, _ := json.MarshalIndent(b.manifest, "", "  ")
+	if err := addTarFile(tw, bundleManifestName, manifestData); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addLogTail adds the end of worker.log in dir, starting at a line boundary
+func (b *supportBundle) addLogTail(dir string) {
+	f, err := os.Open(filepath.Join(dir, "worker.log"))
+	if err != nil {
+		b.missing("worker.log", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.missing("worker.log", err)
+		return
+	}
+	start := max(info.Size()-supportBundleLogBytes, 0)
+	data := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		b.missing("worker.log", err)
+		return
+	}
+	if start > 0 {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	b.add("worker.log", data)
+}
+
+// raftSummary describes the RAFT state without the entry payloads
+type raftSummary struct {
+	CurrentTerm   int            `json:"current_term"`
+	VotedFor      string         `json:"voted_for"`
+	SnapshotIndex int            `json:"snapshot_index"`
+	SnapshotTerm  int            `json:"snapshot_term"`
+	FirstIndex    int            `json:"first_index"`
+	LastIndex     int            `json:"last_index"`
+	LastTerm      int            `json:"last_term"`
+	CommitIndex   *int           `json:"commit_index,omitempty"` // not persisted
+	LastApplied   *int           `json:"last_applied,omitempty"`
+	WALSeq        int64          `json:"wal_seq"`
+	WALBytes      int64          `json:"wal_bytes"`
+	Actions       map[string]int `json:"entries_by_action"`
+}
+
+// summarizeRaftState summarizes a persisted state
+func summarizeRaftState(state persistedState) raftSummary {
+	s := raftSummary{
+		CurrentTerm:   state.CurrentTerm,
+		VotedFor:      state.VotedFor,
+		SnapshotIndex: state.SnapshotIndex,
+		SnapshotTerm:  state.SnapshotTerm,
+		FirstIndex:    state.SnapshotIndex + 1,
+		LastIndex:     state.SnapshotIndex + len(state.Log),
+		LastTerm:      state.SnapshotTerm,
+		WALSeq:        state.WALSeq,
+		Actions:       make(map[string]int),
+	}
+	if n := len(state.Log); n > 0 {
+		s.LastTerm = state.Log[n-1].Term
+	}
+	for _, entry := range state.Log {
+		action, _ := entry.Command["action"].(string)
+		s.Actions[action]++
+	}
+	return s
+}
+
+// supportSummary summarizes the node's live RAFT state
+func (rn *RaftNode) supportSummary() raftSummary {
+	rn.mu.Lock()
+	s := summarizeRaftState(persistedState{
+		CurrentTerm:   rn.currentTerm,
+		VotedFor:      rn.votedFor,
+		Log:           rn.log,
+		SnapshotIndex: rn.snapshotIndex,
+		SnapshotTerm:  rn.snapshotTerm,
+	})
+	commit, applied := rn.commitIndex, rn.lastApplied
+	if rn.wal != nil {
+		s.WALSeq, s.WALBytes = rn.wal.seq, rn.wal.size
+	}
+	rn.mu.Unlock()
+	s.CommitIndex, s.LastApplied = &commit, &applied
+	return s
+}
+
+// configFlag is one command-line flag as shown in a bundle
+type configFlag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Set   bool   `json:"set"` // given on the command line rather than defaulted
+}
+
+// redactedConfig lists the server's flags, hiding the values of any that
+// may hold a secret or a credential-bearing URL
+func redactedConfig() []configFlag {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var flags []configFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		for _, word := range redactedFlagWords {
+			if value != "" && strings.Contains(f.Name, word) {
+				value = "[redacted]"
+				break
+			}
+		}
+		flags = append(flags, configFlag{Name: f.Name, Value: value, Set: set[f.Name]})
+	})
+	return flags
+}
+
+// liveSupportBundle collects a bundle from the running node
+func liveSupportBundle() *supportBundle {
+	b := newSupportBundle("live")
+	b.manifest.Node = raftNode.id
+	b.addJSON("status.json", statusReport())
+	b.addJSON("config.json", redactedConfig())
+	b.addJSON("raft.json", raftNode.supportSummary())
+	b.addJSON("jobs.json", modelStateMachine.Jobs())
+	b.add("metrics.prom", []byte(prometheusText()))
+	b.addLogTail(logDir)
+	return b
+}
+
+func handleSupportBundleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	if err := liveSupportBundle().writeTo(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := "support-bundle-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Write(buf.Bytes())
+}
+
+// runSupportBundle implements `worker support-bundle`
+func runSupportBundle(args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	storage := fs.String("storage-dir", "node0_storage", "Storage directory of the node")
+	raftFlag := fs.String("raft-dir", "", "RAFT state directory (default <storage-dir>)")
+	logFlag := fs.String("log-dir", "", "Directory of worker.log (default <storage-dir>)")
+	monitor := fs.String("monitor", "", "Monitor address (host:port or URL) of the running node; unset or unreachable = read the storage directory")
+	out := fs.String("out", "", "Output archive (.tar.gz)")
+	fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("missing -out")
+	}
+
+	var notes []string
+	if *monitor != "" {
+		err := downloadSupportBundle(*monitor, *out)
+		if err == nil {
+			fmt.Printf("Support bundle from %s written to %s\n", *monitor, *out)
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "support-bundle: %v; reading %s instead\n", err, *storage)
+		notes = append(notes, fmt.Sprintf("monitor %s: %v", *monitor, err))
+	}
+
+	b := newSupportBundle("offline")
+	b.manifest.Missing = append(b.manifest.Missing, notes...)
+	for _, name := range []string{"status.json", "config.json", "jobs.json", "metrics.prom"} {
+		b.missing(name, fmt.Errorf("only available from a running node"))
+	}
+	raftPath := resolveDir(*raftFlag, *storage, "")
+	state, found, err := readPersistedState(raftPath)
+	switch {
+	case err != nil:
+		b.missing("raft.json", err)
+	case !found:
+		b.missing("raft.json", fmt.Errorf("no RAFT state in %s", *storage))
+	default:
+		summary := summarizeRaftState(state)
+		if info, err := os.Stat(filepath.Join(raftPath, walFileName)); err == nil {
+			summary.WALBytes = info.Size()
+		}
+		b.addJSON("raft.json", summary)
+	}
+	b.addLogTail(resolveDir(*logFlag, *storage, ""))
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := b.writeTo(f); err != nil {
+		return err
+	}
+	fmt.Printf("Support bundle written to %s (%d files, %d missing)\n", *out, len(b.manifest.Files), len(b.manifest.Missing))
+	return nil
+}
+
+// downloadSupportBundle saves the bundle served by a running node's monitor
+func downloadSupportBundle(monitor, out string) error {
+	url := strings.TrimSuffix(monitor, "/")
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url + "/admin/support-bundle")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0644)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Adaptive election timeouts
+// ============================================================================
+
+// The leader times every AppendEntries round trip and keeps a smoothed RTT
+// and its deviation per follower, like TCP's retransmission timer (RFC
+// 6298). From the slowest follower it derives the cluster's election
+// timeout, electionTimeoutRTTs round trips clamped to -election-timeout-min
+// and -election-timeout-max, and sends it in every AppendEntries. Followers
+// adopt it within their own bounds and the leader heartbeats
+// heartbeatsPerTimeout times per timeout, so a fast network fails over in
+// about a second while a slow one stops seeing spurious elections. Until a
+// leader advises a timeout, and under leaders that predate this, nodes keep
+// the historical 3s.
+
+const (
+	defaultElectionTimeout = 3 * time.Second
+	electionTimeoutRTTs    = 10
+	heartbeatsPerTimeout   = 4
+	// Heartbeats are never sparser than before, so followers that predate
+	// adaptive timeouts keep hearing from a new leader in time
+	maxHeartbeatInterval = time.Second
+)
+
+// Bounds of the adaptive election timeout (-election-timeout-min/max),
+// changeable at runtime (reload.go)
+var (
+	electionBoundsMu   sync.RWMutex
+	electionTimeoutMin = time.Second
+	electionTimeoutMax = 10 * time.Second
+)
+
+// heartbeatOverride is -heartbeat-interval; 0 derives the interval from the
+// election timeout
+var heartbeatOverride atomic.Int64
+
+func electionTimeoutBounds() (time.Duration, time.Duration) {
+	electionBoundsMu.RLock()
+	defer electionBoundsMu.RUnlock()
+	return electionTimeoutMin, electionTimeoutMax
+}
+
+func setElectionTimeoutBounds(lo, hi time.Duration) {
+	electionBoundsMu.Lock()
+	electionTimeoutMin, electionTimeoutMax = lo, hi
+	electionBoundsMu.Unlock()
+}
+
+// rttEstimate is the smoothed round trip to one follower
+type rttEstimate struct {
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+// observe folds in one sample (RFC 6298 §2)
+func (e *rttEstimate) observe(sample time.Duration) {
+	if e.srtt == 0 {
+		e.srtt = sample
+		e.rttvar = sample / 2
+		return
+	}
+	diff := e.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	e.rttvar = (3*e.rttvar + diff) / 4
+	e.srtt = (7*e.srtt + sample) / 8
+}
+
+// bound is the round trip a follower stays within almost always
+func (e *rttEstimate) bound() time.Duration {
+	return e.srtt + 4*e.rttvar
+}
+
+func clampElectionTimeout(d time.Duration) time.Duration {
+	lo, hi := electionTimeoutBounds()
+	return max(lo, min(d, hi))
+}
+
+// ElectionTimeout returns the current lower end of the election timeout
+func (rn *RaftNode) ElectionTimeout() time.Duration {
+	return time.Duration(rn.electionTimeout.Load())
+}
+
+// heartbeatInterval returns how often the leader sends AppendEntries
+func (rn *RaftNode) heartbeatInterval() time.Duration {
+	if d := time.Duration(heartbeatOverride.Load()); d > 0 {
+		return d
+	}
+	return min(rn.ElectionTimeout()/heartbeatsPerTimeout, maxHeartbeatInterval)
+}
+
+// randomElectionTimeout picks a timeout in [T, 5T/3), the 3-5s spread of
+// the historical timeout scaled to T
+func (rn *RaftNode) randomElectionTimeout() time.Duration {
+	base := rn.ElectionTimeout()
+	return base + time.Duration(rand.Int63n(int64(base)*2/3))
+}
+
+// observeRTTLocked records an AppendEntries round trip to a follower and,
+// as leader, recomputes the election timeout. Callers hold rn.mu.
+func (rn *RaftNode) observeRTTLocked(key string, sample time.Duration) {
+	e, ok := rn.rtts[key]
+	if !ok {
+		e = &rttEstimate{}
+		rn.rtts[key] = e
+	}
+	e.observe(sample)
+	if rn.state != "leader" {
+		return
+	}
+	var slowest time.Duration
+	for _, p := range rn.peers {
+		if e, ok := rn.rtts[fmt.Sprintf("%s:%d", p.Host, p.Port)]; ok {
+			slowest = max(slowest, e.bound())
+		}
+	}
+	rn.setElectionTimeout(clampElectionTimeout(slowest * electionTimeoutRTTs))
+}
+
+// adoptElectionTimeout applies the timeout a leader advised, in ms
+func (rn *RaftNode) adoptElectionTimeout(advised interface{}) {
+	if ms := numberOr(advised, 0); ms > 0 {
+		rn.setElectionTimeout(clampElectionTimeout(time.Duration(ms) * time.Millisecond))
+	}
+}
+
+func (rn *RaftNode) setElectionTimeout(d time.Duration) {
+	if old := time.Duration(rn.electionTimeout.Swap(int64(d))); old != d && (d > old*5/4 || d < old*4/5) {
+		raftLog.Infof("election timeout %v -> %v", old, d)
+	}
+}
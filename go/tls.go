@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ============================================================================
+// TLS
+// ============================================================================
+
+// With -tls-cert/-tls-key the client port and the HTTP monitor serve TLS and
+// RAFT RPCs use mutual TLS: every node presents its certificate and accepts
+// only peers whose certificate chains to -tls-ca (the system roots if
+// unset). Messages to other workers' client ports (proxying, recovery, geo
+// replication) use the same certificate and CA. Python and Kotlin workers
+// don't speak TLS, so a TLS cluster is Go-only.
+
+// TLS client authentication modes for the client port and the monitor
+const (
+	TLSClientAuthNone    = "none"
+	TLSClientAuthRequest = "request" // verify a certificate if the client sends one
+	TLSClientAuthRequire = "require"
+)
+
+var (
+	clientTLS *tls.Config // client port and HTTP monitor; nil serves plaintext
+	raftTLS   *tls.Config // RAFT RPC listener, always mutual
+	peerTLS   *tls.Config // dialing other workers
+)
+
+// setupTLS loads the node's certificate and CA and builds the TLS configs.
+// It does nothing without a certificate.
+func setupTLS(certFile, keyFile, caFile, clientAuth string) error {
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return fmt.Errorf("-tls-ca needs -tls-cert and -tls-key")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+
+	var auth tls.ClientAuthType
+	switch clientAuth {
+	case TLSClientAuthNone:
+		auth = tls.NoClientCert
+	case TLSClientAuthRequest:
+		auth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid -tls-client-auth %q (use %s, %s or %s)", clientAuth, TLSClientAuthNone, TLSClientAuthRequest, TLSClientAuthRequire)
+	}
+
+	clientTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   auth,
+		MinVersion:   tls.VersionTLS12,
+	}
+	raftTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	peerTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	workerLog.Infof("TLS enabled (client certificates: %s, RAFT: mutual)", clientAuth)
+	return nil
+}
+
+// listen opens a TCP listener, wrapped in TLS when config is set
+func listen(addr string, config *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || config == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// dialPeer connects to another worker, over TLS when enabled
+func dialPeer(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if peerTLS == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	tlsDialer := tls.Dialer{NetDialer: &dialer, Config: peerTLS}
+	return tlsDialer.DialContext(ctx, "tcp", addr)
+}
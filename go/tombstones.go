@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ============================================================================
+// Model tombstones
+// ============================================================================
+
+// DELETE_MODEL commits a DELETE_FILE that removes the model's file on every
+// node and leaves a tombstone: the model id, its file and the index of the
+// delete. A node that was down during the delete and catches up through a
+// snapshot never applies that DELETE_FILE, and its copy of the file would
+// bring the model back the next time the models directory is listed. So
+// snapshots carry the tombstones, and restoring one removes the files they
+// name. Until then findModel, LIST_MODELS, FETCH_STATE and FETCH_MODEL skip
+// tombstoned files, so neither clients nor a recovering peer pick the model
+// up again, and a MODEL_TRAINED or STORE_FILE for it is refused.
+//
+// Tombstones are kept until COMPACT_LOG on the leader finds every peer past
+// their delete. It then commits
+//
+//	{"action": "PURGE_TOMBSTONES", "through": 1234}
+//
+// which drops the tombstones of the deletes up to that index: no node can
+// still miss them.
+
+// PurgeTombstonesCommand drops the tombstones of deletes at or before
+// Through
+type PurgeTombstonesCommand struct {
+	Through int `json:"through"`
+}
+
+func (c *PurgeTombstonesCommand) Action() string { return "PURGE_TOMBSTONES" }
+
+func (c *PurgeTombstonesCommand) Validate() error {
+	if c.Through < 0 {
+		return fmt.Errorf("invalid through %d", c.Through)
+	}
+	return nil
+}
+
+func (c *PurgeTombstonesCommand) Apply(sm *ModelStateMachine) error {
+	sm.mu.Lock()
+	purged := 0
+	for id := range sm.tombstones {
+		// tombstones from before indexes were kept count as index 0
+		if sm.deletedAt[id] <= c.Through {
+			delete(sm.tombstones, id)
+			delete(sm.deletedAt, id)
+			purged++
+		}
+	}
+	sm.mu.Unlock()
+	raftLog.Infof("applied PURGE_TOMBSTONES: %d tombstones through index %d", purged, c.Through)
+	return nil
+}
+
+// DeletedFile reports whether a models directory file belonged to a
+// deleted model
+func (sm *ModelStateMachine) DeletedFile(name string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	_, ok := sm.deletedFileLocked(name)
+	return ok
+}
+
+// TombstonesThrough counts the tombstones of deletes at or before index
+func (sm *ModelStateMachine) TombstonesThrough(index int) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	n := 0
+	for id := range sm.tombstones {
+		if sm.deletedAt[id] <= index {
+			n++
+		}
+	}
+	return n
+}
+
+// deletedModelFile reports whether a path in the models directory belongs
+// to a deleted model
+func deletedModelFile(path string) bool {
+	return modelStateMachine != nil && modelStateMachine.DeletedFile(filepath.Base(path))
+}
+
+// removeTombstonedFiles deletes the files of deleted models left in the
+// models directory by a node that missed their DELETE_FILE
+func (sm *ModelStateMachine) removeTombstonedFiles() {
+	sm.mu.RLock()
+	var stale []string
+	for id, name := range sm.tombstones {
+		if !safeBaseName(name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sm.modelsDir, name)); err == nil {
+			stale = append(stale, name)
+			storageLog.Infof("removing %s: model %s was deleted", name, id)
+		}
+	}
+	sm.mu.RUnlock()
+
+	for _, name := range stale {
+		if err := os.Remove(filepath.Join(sm.modelsDir, name)); err != nil && !os.IsNotExist(err) {
+			storageLog.Warnf("cannot remove deleted model file %s: %v", name, err)
+			continue
+		}
+		metrics.Inc("models.tombstoned_removed", 1)
+	}
+}
+
+// purgeTombstones commits a PURGE_TOMBSTONES for the deletes every peer has
+// applied, after a COMPACT_LOG on the leader, and returns how many went
+func purgeTombstones(res *CompactResult) (int, error) {
+	if !raftNode.IsLeader() || len(res.Unreachable) > 0 {
+		return 0, nil
+	}
+	through := res.Index
+	for _, applied := range res.PeerApplied {
+		through = min(through, applied)
+	}
+	n := modelStateMachine.TombstonesThrough(through)
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := replicateCommand(&PurgeTombstonesCommand{Through: through}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// Leadership transfer
+// ============================================================================
+
+// A leader that is going away hands leadership over instead of leaving the
+// cluster leaderless until an election timeout fires (RAFT §3.10). It brings
+// the follower with the most log up to date, steps down and sends it
+// TIMEOUT_NOW, which makes the follower campaign at once. Its REQUEST_VOTE
+// carries leadership_transfer, so voters that heard from the old leader a
+// moment ago don't refuse it. Peers that don't know TIMEOUT_NOW just wait
+// for the election timeout as before.
+
+// TransferLeadership steps down in favour of the most up-to-date voter and
+// returns its id once it has been elected. The node steps down even when
+// the transfer fails.
+func (rn *RaftNode) TransferLeadership() (string, error) {
+	rn.mu.Lock()
+	if rn.state != "leader" {
+		rn.mu.Unlock()
+		return "", errNotLeader
+	}
+	var target Peer
+	found, best := false, -2
+	for _, p := range rn.membersLocked() {
+		if rn.isSelf(p) {
+			continue
+		}
+		if match, ok := rn.matchIndex[fmt.Sprintf("%s:%d", p.Host, p.Port)]; ok && match > best {
+			target, found, best = p, true, match
+		}
+	}
+	rn.mu.Unlock()
+
+	stepDown := func() int {
+		rn.mu.Lock()
+		defer rn.mu.Unlock()
+		if rn.state == "leader" {
+			rn.state = "follower"
+			rn.leader = nil
+			rn.resetElectionTimeout()
+		}
+		return rn.currentTerm
+	}
+	if !found {
+		stepDown()
+		return "", fmt.Errorf("no follower to transfer to")
+	}
+
+	// Level the target's log with ours
+	key := fmt.Sprintf("%s:%d", target.Host, target.Port)
+	mu := rn.sendLock(key)
+	mu.Lock()
+	caughtUp := rn.replicateTo(target)
+	mu.Unlock()
+	rn.mu.RLock()
+	caughtUp = caughtUp && rn.matchIndex[key] == rn.lastLogIndex()
+	rn.mu.RUnlock()
+
+	term := stepDown()
+	if !caughtUp {
+		return "", fmt.Errorf("%s could not catch up", key)
+	}
+	resp := rn.sendRPC(target.Host, target.Port, map[string]interface{}{
+		"type": TIMEOUT_NOW,
+		"term": term,
+	})
+	if resp == nil || resp["success"] != true {
+		return "", fmt.Errorf("%s refused TIMEOUT_NOW", key)
+	}
+
+	deadline := time.Now().Add(rn.ElectionTimeout())
+	for time.Now().Before(deadline) {
+		if leader := rn.GetLeader(); leader != nil {
+			return fmt.Sprintf("%s:%d", leader.Host, leader.WorkerPort), nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return "", fmt.Errorf("no leader elected after TIMEOUT_NOW to %s", key)
+}
+
+// handleTimeoutNow starts an election right away at the request of the
+// leader of the current term
+func (rn *RaftNode) handleTimeoutNow(msg map[string]interface{}) map[string]interface{} {
+	term := int(numberOr(msg["term"], -1))
+
+	rn.mu.Lock()
+	accept := term == rn.currentTerm && rn.state != "leader" && rn.isVoterLocked()
+	if accept {
+		rn.transferElection = true
+	}
+	current := rn.currentTerm
+	rn.mu.Unlock()
+
+	if accept {
+		raftLog.Infof("leadership handed over in term %d, starting election", term)
+		rn.campaignNow()
+	}
+	return map[string]interface{}{
+		"type":    TIMEOUT_NOW,
+		"term":    current,
+		"success": accept,
+	}
+}
+
+// Flush persists the RAFT state once more before exit
+func (rn *RaftNode) Flush() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.saveState()
+}
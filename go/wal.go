@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ============================================================================
+// RAFT write-ahead log
+// ============================================================================
+
+// saveState used to rewrite the whole raft_state.json, every model payload
+// included, on each append. The Go worker now keeps raft_state.json as a
+// checkpoint and appends each change to raft_wal.log as one record:
+//
+//	<crc32c hex> {"seq": 12, "term": 3, "voted_for": "...", "from": 40, "entries": [...]}
+//
+// A record carries the current term and vote, truncates the log at global
+// index from and appends its entries there, so a plain append, a follower
+// dropping conflicting entries and a term or vote change all take one
+// fsynced write proportional to the change. Records are numbered and the
+// checkpoint stores the last number it includes (wal_seq).
+//
+// Once the log file passes -raft-wal-checkpoint bytes, and whenever the log
+// is compacted, the node writes a fresh checkpoint and starts a new log,
+// keeping the previous one as raft_wal.log.prev next to
+// raft_state.json.prev. On start the node loads the newest readable
+// checkpoint, replays the records after its wal_seq from both log files in
+// order, and stops at the first torn or damaged record, which can only be
+// the tail of the last write. It then writes a checkpoint of what it
+// recovered.
+
+const (
+	walFileName     = "raft_wal.log"
+	prevWALFileName = "raft_wal.log.prev"
+)
+
+// walCheckpointBytes is the log size that triggers a checkpoint
+var walCheckpointBytes int64 = 16 << 20
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walRecord struct {
+	Seq      int64      `json:"seq"`
+	Term     int        `json:"term"`
+	VotedFor string     `json:"voted_for"`
+	From     int        `json:"from"`
+	Entries  []LogEntry `json:"entries,omitempty"`
+}
+
+// raftWAL is the open log file and what the checkpoint plus its records hold
+type raftWAL struct {
+	file          *os.File
+	size          int64
+	seq           int64
+	term          int
+	votedFor      string
+	snapshotIndex int
+	logged        []LogEntry // rn.log as of the last record
+	broken        bool       // a write failed, the file may end in a torn record
+}
+
+// persistLocked writes whatever changed since the last call. Callers hold
+// rn.mu.
+func (rn *RaftNode) persistLocked() error {
+	w := rn.wal
+	if w == nil || w.broken || w.snapshotIndex != rn.snapshotIndex || w.size >= walCheckpointBytes {
+		return rn.checkpointLocked()
+	}
+
+	from := w.divergence(rn.log)
+	if from == len(rn.log) && from == len(w.logged) && w.term == rn.currentTerm && w.votedFor == rn.votedFor {
+		return nil
+	}
+	rec := walRecord{
+		Seq:      w.seq + 1,
+		Term:     rn.currentTerm,
+		VotedFor: rn.votedFor,
+		From:     rn.snapshotIndex + 1 + from,
+		Entries:  rn.log[from:],
+	}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line := make([]byte, 0, len(body)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.Checksum(body, walTable))...)
+	line = append(line, body...)
+	line = append(line, '\n')
+	if _, err := w.file.Write(line); err != nil {
+		w.broken = true
+		return fmt.Errorf("append to %s: %v", walFileName, err)
+	}
+	if err := w.file.Sync(); err != nil {
+		w.broken = true
+		return fmt.Errorf("sync %s: %v", walFileName, err)
+	}
+	w.size += int64(len(line))
+	w.seq = rec.Seq
+	w.term, w.votedFor, w.logged = rn.currentTerm, rn.votedFor, rn.log
+	return nil
+}
+
+// divergence returns the position of the first entry of log that differs
+// from the logged one. By the RAFT log matching property two entries with
+// the same index and term are preceded by the same entries, so a backwards
+// scan stops at the first match and a plain append costs one comparison.
+func (w *raftWAL) divergence(log []LogEntry) int {
+	i := min(len(log), len(w.logged)) - 1
+	for i >= 0 && log[i].Term != w.logged[i].Term {
+		i--
+	}
+	return i + 1
+}
+
+// checkpointLocked writes the full state to raft_state.json and starts a
+// new log. Callers hold rn.mu.
+func (rn *RaftNode) checkpointLocked() error {
+	var seq int64
+	if rn.wal != nil {
+		seq = rn.wal.seq
+		if rn.wal.file != nil {
+			rn.wal.file.Close()
+		}
+		rn.wal = nil
+	}
+	data, err := json.Marshal(persistedState{
+		CurrentTerm:   rn.currentTerm,
+		VotedFor:      rn.votedFor,
+		Log:           rn.log,
+		SnapshotIndex: rn.snapshotIndex,
+		SnapshotTerm:  rn.snapshotTerm,
+		WALSeq:        seq,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeStateGenerations(rn.persistencePath, data); err != nil {
+		return err
+	}
+
+	current := filepath.Join(rn.persistencePath, walFileName)
+	if _, err := os.Stat(current); err == nil {
+		if err := replaceFile(current, filepath.Join(rn.persistencePath, prevWALFileName)); err != nil {
+			return fmt.Errorf("keep previous %s: %v", walFileName, err)
+		}
+	}
+	f, err := os.OpenFile(current, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", walFileName, err)
+	}
+	rn.wal = &raftWAL{
+		file:          f,
+		seq:           seq,
+		term:          rn.currentTerm,
+		votedFor:      rn.votedFor,
+		snapshotIndex: rn.snapshotIndex,
+		logged:        rn.log,
+	}
+	metrics.Inc("raft.checkpoints", 1)
+	return nil
+}
+
+// readPersistedState returns the state saved in dir: the newest readable
+// checkpoint with the log records after it replayed. found is false when
+// nothing was ever saved.
+func readPersistedState(dir string) (persistedState, bool, error) {
+	state, found, err := loadStateGenerations(dir)
+	if err != nil || !found {
+		return state, found, err
+	}
+
+	replayed := 0
+	for _, name := range []string{prevWALFileName, walFileName} {
+		records, err := readWALFile(filepath.Join(dir, name))
+		if err != nil {
+			raftLog.Warnf("%s: %v; replayed up to the last intact record", name, err)
+		}
+		for _, rec := range records {
+			if rec.Seq <= state.WALSeq {
+				continue
+			}
+			pos := rec.From - state.SnapshotIndex - 1
+			if rec.Seq != state.WALSeq+1 || pos < 0 || pos > len(state.Log) {
+				raftLog.Warnf("%s: record %d does not follow record %d, ignoring the rest", name, rec.Seq, state.WALSeq)
+				return state, true, nil
+			}
+			state.CurrentTerm = rec.Term
+			state.VotedFor = rec.VotedFor
+			state.Log = append(state.Log[:pos], rec.Entries...)
+			state.WALSeq = rec.Seq
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		raftLog.Infof("replayed %d records from %s", replayed, walFileName)
+	}
+	return state, true, nil
+}
+
+// lastWALSeq returns the highest record sequence saved in dir, in either
+// generation of the state or of the log
+func lastWALSeq(dir string) int64 {
+	var seq int64
+	for _, name := range []string{prevStateFileName, stateFileName} {
+		if state, err := readStateFile(filepath.Join(dir, name)); err == nil {
+			seq = max(seq, state.WALSeq)
+		}
+	}
+	for _, name := range []string{prevWALFileName, walFileName} {
+		records, _ := readWALFile(filepath.Join(dir, name))
+		for _, rec := range records {
+			seq = max(seq, rec.Seq)
+		}
+	}
+	return seq
+}
+
+// readWALFile returns the intact records of a log file, in order. A missing
+// file holds none; a torn or damaged record ends the file with an error.
+func readWALFile(path string) ([]walRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []walRecord
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return records, nil // clean end of file
+		}
+		if err != nil {
+			return records, fmt.Errorf("record %d is torn", n)
+		}
+		sum, body, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+		want, perr := strconv.ParseUint(string(sum), 16, 32)
+		if !ok || perr != nil || uint32(want) != crc32.Checksum(body, walTable) {
+			return records, fmt.Errorf("record %d fails its checksum", n)
+		}
+		var rec walRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return records, fmt.Errorf("record %d: %v", n, err)
+		}
+		records = append(records, rec)
+	}
+}
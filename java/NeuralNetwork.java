@@ -1,4 +1,7 @@
 import java.io.*;
+import java.util.ArrayList;
+import java.util.List;
+import java.util.Locale;
 import java.util.Random;
 import java.util.UUID;
 import java.util.concurrent.*;
@@ -184,6 +187,10 @@ public class NeuralNetwork implements Serializable {
         System.out.println("Samples: " + inputs.length + ", Epochs: " + epochs);
         
         for (int epoch = 0; epoch < epochs; epoch++) {
+            if (Thread.currentThread().isInterrupted()) {
+                executor.shutdownNow();
+                throw new CancellationException("Training cancelled at epoch " + epoch);
+            }
             final int currentEpoch = epoch;
             double totalError = 0;
             
@@ -257,6 +264,99 @@ public class NeuralNetwork implements Serializable {
         return outputSize;
     }
     
+    public int getHiddenSize() {
+        return hiddenSize;
+    }
+    
+    /**
+     * Describe every weight/bias tensor as
+     * name,rows,cols,params,min,max,mean,std
+     */
+    public List<String> describeWeights() {
+        List<String> lines = new ArrayList<>();
+        lines.add(describeTensor("weights_input_hidden", weightsInputHidden));
+        lines.add(describeTensor("bias_hidden", new double[][] { biasHidden }));
+        lines.add(describeTensor("weights_hidden_output", weightsHiddenOutput));
+        lines.add(describeTensor("bias_output", new double[][] { biasOutput }));
+        return lines;
+    }
+    
+    /**
+     * Export architecture and parameters as a single-line JSON document
+     * (format described in docs/MODEL_EXPORT_FORMAT.md)
+     */
+    public String toJson() {
+        StringBuilder sb = new StringBuilder();
+        sb.append("{\"format\":\"mlp-sigmoid\",\"format_version\":1");
+        sb.append(",\"model_id\":\"").append(modelId).append('"');
+        sb.append(",\"architecture\":{\"input_size\":").append(inputSize);
+        sb.append(",\"hidden_size\":").append(hiddenSize);
+        sb.append(",\"output_size\":").append(outputSize);
+        sb.append(",\"activation\":\"sigmoid\"}");
+        sb.append(",\"layers\":[");
+        appendLayer(sb, "hidden", weightsInputHidden, biasHidden);
+        sb.append(',');
+        appendLayer(sb, "output", weightsHiddenOutput, biasOutput);
+        sb.append("]}");
+        return sb.toString();
+    }
+    
+    private static void appendLayer(StringBuilder sb, String name, double[][] weights, double[] bias) {
+        sb.append("{\"name\":\"").append(name).append("\",\"weights\":[");
+        for (int i = 0; i < weights.length; i++) {
+            if (i > 0) sb.append(',');
+            appendVector(sb, weights[i]);
+        }
+        sb.append("],\"bias\":");
+        appendVector(sb, bias);
+        sb.append('}');
+    }
+    
+    private static void appendVector(StringBuilder sb, double[] v) {
+        sb.append('[');
+        for (int i = 0; i < v.length; i++) {
+            if (i > 0) sb.append(',');
+            // JSON has no NaN/Infinity; a diverged weight exports as null
+            sb.append(Double.isFinite(v[i]) ? Double.toString(v[i]) : "null");
+        }
+        sb.append(']');
+    }
+    
+    public int parameterCount() {
+        return inputSize * hiddenSize + hiddenSize + hiddenSize * outputSize + outputSize;
+    }
+    
+    private static String describeTensor(String name, double[][] t) {
+        int rows = t.length;
+        int cols = rows > 0 ? t[0].length : 0;
+        double min = Double.POSITIVE_INFINITY;
+        double max = Double.NEGATIVE_INFINITY;
+        double sum = 0;
+        int n = 0;
+        for (double[] row : t) {
+            for (double v : row) {
+                min = Math.min(min, v);
+                max = Math.max(max, v);
+                sum += v;
+                n++;
+            }
+        }
+        double mean = n > 0 ? sum / n : 0;
+        double var = 0;
+        for (double[] row : t) {
+            for (double v : row) {
+                var += (v - mean) * (v - mean);
+            }
+        }
+        double std = n > 0 ? Math.sqrt(var / n) : 0;
+        if (n == 0) {
+            min = 0;
+            max = 0;
+        }
+        return String.format(Locale.ROOT, "%s,%d,%d,%d,%.6f,%.6f,%.6f,%.6f",
+            name, rows, cols, n, min, max, mean, std);
+    }
+    
     @Override
     public String toString() {
         return String.format("NeuralNetwork[id=%s, architecture=%d-%d-%d]", 
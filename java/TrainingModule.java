@@ -1,5 +1,8 @@
 import java.io.*;
 import java.util.*;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.ExecutorService;
+import java.util.concurrent.Executors;
 
 /**
  * Training Module - Entry point for neural network training
@@ -7,7 +10,12 @@ import java.util.*;
  * Usage:
  *   java TrainingModule train <inputs_file> <outputs_file> [epochs]
  *   java TrainingModule predict <model_file> <input_values...>
+ *   java TrainingModule predict_batch <model_file> <v1,v2;v3,v4;...>
+ *   java TrainingModule describe <model_file>
+ *   java TrainingModule export <model_file>
+ *   java TrainingModule evaluate <model_file> <inputs_file> <outputs_file>
  *   java TrainingModule demo
+ *   java TrainingModule serve
  * 
  * File format for inputs/outputs: CSV with one sample per line
  */
@@ -19,28 +27,171 @@ public class TrainingModule {
             return;
         }
         
-        String command = args[0].toLowerCase();
+        if (args[0].equalsIgnoreCase("serve")) {
+            try {
+                serve();
+            } catch (IOException e) {
+                System.err.println("Error: " + e.getMessage());
+            }
+            return;
+        }
         
         try {
-            switch (command) {
-                case "train":
-                    handleTrain(args);
-                    break;
-                case "predict":
-                    handlePredict(args);
-                    break;
-                case "demo":
-                    runXorDemo();
-                    break;
-                default:
-                    printUsage();
-            }
+            dispatch(args);
         } catch (Exception e) {
             System.err.println("Error: " + e.getMessage());
             e.printStackTrace();
         }
     }
     
+    /**
+     * Run one command; returns false if the command is unknown
+     */
+    private static boolean dispatch(String[] args) throws Exception {
+        String command = args[0].toLowerCase();
+        
+        switch (command) {
+            case "train":
+                handleTrain(args);
+                break;
+            case "predict":
+                handlePredict(args);
+                break;
+            case "predict_batch":
+                handlePredictBatch(args);
+                break;
+            case "describe":
+                handleDescribe(args);
+                break;
+            case "export":
+                handleExport(args);
+                break;
+            case "evaluate":
+                handleEvaluate(args);
+                break;
+            case "demo":
+                runXorDemo();
+                break;
+            default:
+                printUsage();
+                return false;
+        }
+        return true;
+    }
+    
+    /**
+     * Serve commands over stdin/stdout so the worker keeps one JVM alive.
+     * Prints READY, then reads one request per line:
+     *   <id>\t<command>\t<arg>\t...
+     * Requests run concurrently. Everything a request prints (stdout and
+     * stderr) is answered as OUT\t<id>\t<line> lines followed by
+     * END\t<id>\t<status>, where status is 0 on success and 1 on error.
+     * A CANCEL\t<id> line interrupts that request; training stops at the
+     * next epoch and the request ends with status 1.
+     */
+    private static void serve() throws IOException {
+        final PrintStream stdout = System.out;
+        final PrintStream stderr = System.err;
+        final ThreadLocal<ByteArrayOutputStream> capture = new ThreadLocal<>();
+        
+        System.setOut(new PrintStream(new CaptureStream(capture, stdout), true));
+        System.setErr(new PrintStream(new CaptureStream(capture, stderr), true));
+        
+        ExecutorService pool = Executors.newCachedThreadPool();
+        final Map<String, Thread> running = new ConcurrentHashMap<>();
+        BufferedReader in = new BufferedReader(new InputStreamReader(System.in));
+        
+        synchronized (stdout) {
+            stdout.println("READY");
+            stdout.flush();
+        }
+        
+        String line;
+        while ((line = in.readLine()) != null) {
+            final String[] fields = line.split("\t", -1);
+            if (fields.length < 2) continue;
+            if (fields[0].equals("CANCEL")) {
+                Thread worker = running.get(fields[1]);
+                if (worker != null) worker.interrupt();
+                continue;
+            }
+            
+            pool.submit(() -> {
+                String id = fields[0];
+                running.put(id, Thread.currentThread());
+                String[] args = Arrays.copyOfRange(fields, 1, fields.length);
+                ByteArrayOutputStream buf = new ByteArrayOutputStream();
+                int status = 0;
+                
+                capture.set(buf);
+                try {
+                    if (!dispatch(args)) status = 1;
+                } catch (Exception e) {
+                    System.err.println("Error: " + e.getMessage());
+                    status = 1;
+                } finally {
+                    running.remove(id);
+                    System.out.flush();
+                    System.err.flush();
+                    capture.remove();
+                }
+                
+                synchronized (stdout) {
+                    if (buf.size() > 0) {
+                        for (String out : buf.toString().split("\r?\n")) {
+                            stdout.println("OUT\t" + id + "\t" + out);
+                        }
+                    }
+                    stdout.println("END\t" + id + "\t" + status);
+                    stdout.flush();
+                }
+            });
+        }
+        
+        pool.shutdown();
+    }
+    
+    /**
+     * Sends output to the calling request's buffer while it runs inside
+     * serve(), and to the real stream otherwise
+     */
+    private static class CaptureStream extends OutputStream {
+        private final ThreadLocal<ByteArrayOutputStream> capture;
+        private final OutputStream fallback;
+        
+        CaptureStream(ThreadLocal<ByteArrayOutputStream> capture, OutputStream fallback) {
+            this.capture = capture;
+            this.fallback = fallback;
+        }
+        
+        @Override
+        public void write(int b) throws IOException {
+            ByteArrayOutputStream buf = capture.get();
+            if (buf != null) {
+                buf.write(b);
+            } else {
+                fallback.write(b);
+            }
+        }
+        
+        @Override
+        public void write(byte[] b, int off, int len) throws IOException {
+            ByteArrayOutputStream buf = capture.get();
+            if (buf != null) {
+                buf.write(b, off, len);
+            } else {
+                fallback.write(b, off, len);
+            }
+        }
+        
+        @Override
+        public void flush() throws IOException {
+            if (capture.get() == null) {
+                fallback.flush();
+            }
+        }
+    }
+    
     private static void printUsage() {
         System.out.println("TrainingModule - Neural Network Training System");
         System.out.println();
@@ -51,8 +202,23 @@ public class TrainingModule {
         System.out.println("  predict <model.bin> <value1,value2,...>");
         System.out.println("      Load a model and make a prediction");
         System.out.println();
+        System.out.println("  predict_batch <model.bin> <v1,v2;v3,v4;...>");
+        System.out.println("      Load a model once and predict several inputs");
+        System.out.println();
+        System.out.println("  describe <model.bin>");
+        System.out.println("      Print layer sizes, parameter count and weight statistics");
+        System.out.println();
+        System.out.println("  export <model.bin>");
+        System.out.println("      Print architecture, weights and biases as JSON");
+        System.out.println();
+        System.out.println("  evaluate <model.bin> <inputs.csv> <outputs.csv>");
+        System.out.println("      Compute loss (MSE) and accuracy on a labelled dataset");
+        System.out.println();
         System.out.println("  demo");
         System.out.println("      Run XOR demonstration (no files needed)");
+        System.out.println();
+        System.out.println("  serve");
+        System.out.println("      Read tab-separated commands from stdin, one per line (used by the worker)");
     }
     
     /**
@@ -135,6 +301,119 @@ public class TrainingModule {
         System.out.println();
     }
     
+    /**
+     * Handle batched prediction: one JVM start and model load for many inputs.
+     * Prints one PREDICTION[i]: line per input, in order.
+     */
+    private static void handlePredictBatch(String[] args) throws Exception {
+        if (args.length < 3) {
+            System.err.println("Usage: predict_batch <model.bin> <v1,v2;v3,v4;...>");
+            return;
+        }
+        
+        NeuralNetwork nn = NeuralNetwork.load(args[1]);
+        String[] samples = args[2].split(";");
+        
+        for (int s = 0; s < samples.length; s++) {
+            String[] parts = samples[s].split(",");
+            double[] input = new double[parts.length];
+            for (int i = 0; i < parts.length; i++) {
+                input[i] = Double.parseDouble(parts[i].trim());
+            }
+            
+            double[] output = nn.predict(input);
+            
+            StringBuilder sb = new StringBuilder("PREDICTION[" + s + "]:");
+            for (int i = 0; i < output.length; i++) {
+                sb.append(i > 0 ? "," : "").append(String.format("%.6f", output[i]));
+            }
+            System.out.println(sb);
+        }
+    }
+    
+    /**
+     * Handle describe command: machine-readable summary of a stored model
+     */
+    private static void handleDescribe(String[] args) throws Exception {
+        if (args.length < 2) {
+            System.err.println("Usage: describe <model.bin>");
+            return;
+        }
+        
+        NeuralNetwork nn = NeuralNetwork.load(args[1]);
+        
+        System.out.println("MODEL_ID:" + nn.getModelId());
+        System.out.println("LAYERS:" + nn.getInputSize() + "," + nn.getHiddenSize() + "," + nn.getOutputSize());
+        System.out.println("PARAMS:" + nn.parameterCount());
+        for (String line : nn.describeWeights()) {
+            System.out.println("WEIGHTS:" + line);
+        }
+    }
+    
+    /**
+     * Handle export command: prints EXPORT:<json> with the full parameters
+     */
+    private static void handleExport(String[] args) throws Exception {
+        if (args.length < 2) {
+            System.err.println("Usage: export <model.bin>");
+            return;
+        }
+        
+        NeuralNetwork nn = NeuralNetwork.load(args[1]);
+        System.out.println("EXPORT:" + nn.toJson());
+    }
+    
+    /**
+     * Handle evaluate command. Accuracy rounds single outputs at 0.5 and uses
+     * argmax for multi-output models. Prints:
+     *   EVAL:loss=<mse>,accuracy=<acc>,samples=<n>
+     */
+    private static void handleEvaluate(String[] args) throws Exception {
+        if (args.length < 4) {
+            System.err.println("Usage: evaluate <model.bin> <inputs.csv> <outputs.csv>");
+            return;
+        }
+        
+        NeuralNetwork nn = NeuralNetwork.load(args[1]);
+        double[][] inputs = loadCsv(args[2]);
+        double[][] outputs = loadCsv(args[3]);
+        
+        if (inputs.length != outputs.length) {
+            throw new IllegalArgumentException("Inputs and outputs must have same number of samples");
+        }
+        
+        double sqError = 0;
+        int values = 0;
+        int correct = 0;
+        for (int s = 0; s < inputs.length; s++) {
+            double[] predicted = nn.predict(inputs[s]);
+            double[] expected = outputs[s];
+            for (int i = 0; i < expected.length && i < predicted.length; i++) {
+                double d = predicted[i] - expected[i];
+                sqError += d * d;
+                values++;
+            }
+            if (expected.length == 1) {
+                if ((predicted[0] >= 0.5) == (expected[0] >= 0.5)) correct++;
+            } else if (argmax(predicted) == argmax(expected)) {
+                correct++;
+            }
+        }
+        
+        double loss = values > 0 ? sqError / values : 0;
+        double accuracy = inputs.length > 0 ? (double) correct / inputs.length : 0;
+        System.out.println(String.format(Locale.ROOT, "EVAL:loss=%.6f,accuracy=%.6f,samples=%d",
+            loss, accuracy, inputs.length));
+    }
+    
+    private static int argmax(double[] v) {
+        int best = 0;
+        for (int i = 1; i < v.length; i++) {
+            if (v[i] > v[best]) best = i;
+        }
+        return best;
+    }
+    
     /**
      * XOR demonstration - proves the network can learn non-linear patterns
      */
@@ -0,0 +1,184 @@
+"""
+Chunk placement policies for distributed training.
+
+The leader asks its policy how many samples each node trains. Nodes are
+peer (host, port) tuples plus LOCAL for the leader itself. A policy gives
+each node a weight; plan() splits the samples in proportion (largest
+remainder, in node order) and drops nodes that get nothing. Policies are
+shared by all handler threads, so their state is guarded by a lock.
+
+Policies:
+  round-robin  equal shares, rotating which node gets the extra samples and
+               which nodes are used when there are fewer samples than nodes
+  least-loaded favours nodes with fewer chunks in flight and faster recent
+               chunks
+  capability   static weights per node from the config ("capabilities")
+  locality     full weight for nodes in the leader's zone, "remote_weight"
+               for the rest ("zone", "zones")
+
+Config file (JSON, --scheduler-config):
+  {"policy": "capability",
+   "capabilities": {"local": 2, "10.0.0.2:9001": 4},
+   "zone": "a", "zones": {"10.0.0.2:9001": "a", "10.0.0.3:9002": "b"},
+   "remote_weight": 0.25}
+"""
+import json
+import threading
+
+LOCAL = 'local'
+
+
+def node_key(node):
+    """Config key of a node: 'local' or 'host:port'."""
+    if node == LOCAL:
+        return LOCAL
+    host, port = node
+    return f"{host}:{port}"
+
+
+def split_by_weight(total, weights):
+    """Split total into integer shares proportional to weights (largest remainder)."""
+    weight_sum = sum(w for w in weights if w > 0)
+    if total <= 0 or weight_sum <= 0:
+        return [0] * len(weights)
+    exact = [total * max(w, 0) / weight_sum for w in weights]
+    counts = [int(x) for x in exact]
+    left = total - sum(counts)
+    by_remainder = sorted(range(len(weights)), key=lambda i: (-(exact[i] - counts[i]), i))
+    for i in by_remainder[:left]:
+        counts[i] += 1
+    return counts
+
+
+class SchedulerPolicy:
+    name = ''
+
+    def __init__(self, config=None):
+        self.config = config or {}
+        self.lock = threading.Lock()
+
+    def weights(self, nodes):
+        return [1.0] * len(nodes)
+
+    def order(self, nodes):
+        return list(nodes)
+
+    def plan(self, peers, total):
+        """Return [(node, samples), ...] for a training of total samples."""
+        with self.lock:
+            nodes = self.order([LOCAL] + list(peers))
+            counts = split_by_weight(total, self.weights(nodes))
+        return [(n, c) for n, c in zip(nodes, counts) if c > 0]
+
+    def started(self, node, samples):
+        """A chunk was sent to node."""
+
+    def finished(self, node, samples, seconds, ok):
+        """A chunk sent to node completed (or failed) after seconds."""
+
+    def describe(self):
+        return {'policy': self.name}
+
+
+class RoundRobinPolicy(SchedulerPolicy):
+    name = 'round-robin'
+
+    def __init__(self, config=None):
+        super().__init__(config)
+        self.cursor = 0
+
+    def order(self, nodes):
+        if not nodes:
+            return nodes
+        start = self.cursor % len(nodes)
+        self.cursor += 1
+        return nodes[start:] + nodes[:start]
+
+
+class LeastLoadedPolicy(SchedulerPolicy):
+    """Weight = speed / (1 + chunks in flight), with speed from an EWMA of
+    seconds per sample (1.0 until a node has finished a chunk)."""
+    name = 'least-loaded'
+    alpha = 0.3
+
+    def __init__(self, config=None):
+        super().__init__(config)
+        self.inflight = {}
+        self.sec_per_sample = {}
+
+    def weights(self, nodes):
+        known = [v for v in self.sec_per_sample.values() if v > 0]
+        baseline = sum(known) / len(known) if known else 1.0
+        weights = []
+        for n in nodes:
+            key = node_key(n)
+            speed = baseline / self.sec_per_sample.get(key, baseline)
+            weights.append(speed / (1 + self.inflight.get(key, 0)))
+        return weights
+
+    def started(self, node, samples):
+        with self.lock:
+            key = node_key(node)
+            self.inflight[key] = self.inflight.get(key, 0) + 1
+
+    def finished(self, node, samples, seconds, ok):
+        with self.lock:
+            key = node_key(node)
+            self.inflight[key] = max(0, self.inflight.get(key, 0) - 1)
+            if not ok:
+                # A failing node looks slow until it proves otherwise
+                seconds = max(seconds, 1.0) * 10
+            if samples > 0:
+                rate = max(seconds, 1e-6) / samples
+                old = self.sec_per_sample.get(key)
+                self.sec_per_sample[key] = rate if old is None else self.alpha * rate + (1 - self.alpha) * old
+
+    def describe(self):
+        with self.lock:
+            return {'policy': self.name, 'inflight': dict(self.inflight),
+                    'sec_per_sample': dict(self.sec_per_sample)}
+
+
+class CapabilityWeightedPolicy(SchedulerPolicy):
+    name = 'capability'
+
+    def weights(self, nodes):
+        caps = self.config.get('capabilities', {})
+        return [float(caps.get(node_key(n), 1.0)) for n in nodes]
+
+
+class LocalityAwarePolicy(SchedulerPolicy):
+    name = 'locality'
+
+    def weights(self, nodes):
+        zone = self.config.get('zone')
+        zones = self.config.get('zones', {})
+        remote = float(self.config.get('remote_weight', 0.25))
+        weights = []
+        for n in nodes:
+            same = n == LOCAL or (zone is not None and zones.get(node_key(n)) == zone)
+            weights.append(1.0 if same else remote)
+        return weights
+
+
+POLICIES = {
+    RoundRobinPolicy.name: RoundRobinPolicy,
+    LeastLoadedPolicy.name: LeastLoadedPolicy,
+    CapabilityWeightedPolicy.name: CapabilityWeightedPolicy,
+    LocalityAwarePolicy.name: LocalityAwarePolicy,
+}
+
+DEFAULT_POLICY = RoundRobinPolicy.name
+
+
+def load_scheduler(policy=None, config_path=None):
+    """Build the policy named by policy, else by the config file, else the default."""
+    config = {}
+    if config_path:
+        with open(config_path, 'r', encoding='utf-8') as f:
+            config = json.load(f)
+    name = policy or config.get('policy') or DEFAULT_POLICY
+    if name not in POLICIES:
+        raise ValueError(f"unknown scheduler policy {name!r} (use {', '.join(sorted(POLICIES))})")
+    return POLICIES[name](config)
+
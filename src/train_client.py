@@ -11,7 +11,7 @@ import argparse
 import time
 
 
-def send_train_request(host: str, port: int, inputs: list, outputs: list):
+def send_train_request(host: str, port: int, inputs: list, outputs: list, progress: bool = False):
     """
     Send training data to a worker and receive model ID.
     
@@ -20,18 +20,23 @@ def send_train_request(host: str, port: int, inputs: list, outputs: list):
         port: Worker port
         inputs: List of input vectors (each is a list of floats)
         outputs: List of output vectors (each is a list of floats)
+        progress: Ask the worker (Go) to stream PROGRESS messages while training
     
     Returns:
         model_id if successful, None otherwise
     """
-    message = json.dumps({
+    request = {
         'type': 'TRAIN',
         'inputs': inputs,
         'outputs': outputs
-    })
+    }
+    if progress:
+        request['stream_progress'] = True
+    message = json.dumps(request)
     
     attempt = 0
     cur_host, cur_port = host, port
+    known = []  # other nodes learned from REDIRECT, tried if the current one fails
     
     while attempt < 5:
         try:
@@ -39,21 +44,23 @@ def send_train_request(host: str, port: int, inputs: list, outputs: list):
                 # Send message with newline terminator
                 s.sendall((message + '\n').encode('utf-8'))
                 
-                # Receive response (may take time for training)
-                response_data = b''
+                # Receive response (may take time for training); PROGRESS
+                # lines may come first
+                reader = s.makefile('rb')
                 while True:
-                    chunk = s.recv(4096)
-                    if not chunk:
+                    response_data = reader.readline()
+                    try:
+                        resp = json.loads(response_data.decode('utf-8').strip())
+                    except Exception:
+                        print('Response (raw):', response_data)
+                        return None
+                    if resp.get('status') != 'PROGRESS':
                         break
-                    response_data += chunk
-                    if b'\n' in chunk:
-                        break
-                
-                try:
-                    resp = json.loads(response_data.decode('utf-8').strip())
-                except Exception:
-                    print('Response (raw):', response_data)
-                    return None
+                    if resp.get('event') == 'chunk_done':
+                        print(f"Chunk {resp.get('chunk_id')} done on {resp.get('worker')} "
+                              f"({resp.get('chunks_done')}/{resp.get('chunks')})")
+                        continue
+                    print(f"Epoch {resp.get('epoch')}/{resp.get('epochs')} - loss {resp.get('loss'):.6f}")
                 
                 if resp.get('status') == 'OK':
                     model_id = resp.get('model_id')
@@ -62,6 +69,9 @@ def send_train_request(host: str, port: int, inputs: list, outputs: list):
                     return model_id
                 
                 if resp.get('status') == 'REDIRECT':
+                    # Go workers list every known node; keep them for failover
+                    known = [(p['host'], int(p['worker_port'])) for p in resp.get('peers', [])
+                             if p.get('role') != 'leader']
                     leader = resp.get('leader')
                     if leader:
                         cur_host, cur_port = leader[0], int(leader[1])
@@ -75,6 +85,12 @@ def send_train_request(host: str, port: int, inputs: list, outputs: list):
         except Exception as e:
             print(f'Connection error: {e}')
             attempt += 1
+            # the node we were sent to may be gone: ask another one for the leader
+            others = [n for n in known if n != (cur_host, cur_port)]
+            if others:
+                cur_host, cur_port = others[0]
+                known.remove(others[0])
+                print(f'Trying {cur_host}:{cur_port}')
             time.sleep(0.5)
     
     print('Failed after retries')
@@ -110,6 +126,8 @@ def main():
     
     subparsers = parser.add_subparsers(dest='command')
     
+    parser.add_argument('--progress', action='store_true', help='Print training progress (Go workers)')
+    
     # train command with CSV files
     train_parser = subparsers.add_parser('train', help='Train with CSV files')
     train_parser.add_argument('inputs_file', help='CSV file with inputs')
@@ -126,13 +144,13 @@ def main():
         inputs = load_csv(args.inputs_file)
         outputs = load_csv(args.outputs_file)
         print(f'Loaded {len(inputs)} samples from files')
-        send_train_request(args.host, args.port, inputs, outputs)
+        send_train_request(args.host, args.port, inputs, outputs, args.progress)
         
     elif args.command == 'train-inline':
         inputs = parse_inline(args.inputs)
         outputs = parse_inline(args.outputs)
         print(f'Training with {len(inputs)} samples (inline)')
-        send_train_request(args.host, args.port, inputs, outputs)
+        send_train_request(args.host, args.port, inputs, outputs, args.progress)
         
     else:
         parser.print_help()
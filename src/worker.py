@@ -23,14 +23,22 @@ import re
 import math
 from datetime import datetime
 from src.raft import RaftNode, NotLeader
+from src.scheduler import LOCAL, node_key, load_scheduler, POLICIES
 import subprocess
 import tempfile
 import uuid
+import time
 
 STORAGE_DIR = 'worker_storage'
 MODELS_DIR = 'models'
 LOG_FILE = 'worker.log'
 JAVA_DIR = 'java'
+SCHEDULER = load_scheduler()
+
+# Model files removed by DELETE_FILE entries. A STORE_FILE for one of them
+# committed later (the trainer replicates asynchronously) must not recreate
+# it. Rebuilt on restart, since the log is re-applied in order.
+DELETED_FILES = set()
 
 
 def log(msg: str):
@@ -89,6 +97,8 @@ class WorkerTCPHandler(threading.Thread):
                 self._handle_predict(msg)
             elif msg_type == 'LIST_MODELS':
                 self._handle_list_models()
+            elif msg_type == 'DELETE_MODEL':
+                self._handle_delete_model(msg)
             else:
                 self._send_response({'status': 'ERROR', 'message': f'Unknown type: {msg_type}'})
 
@@ -211,43 +221,52 @@ class WorkerTCPHandler(threading.Thread):
         🆕 DISTRIBUTED TRAINING: Divide data among nodes
         
         Strategy:
-        1. Split data into num_nodes chunks
+        1. Ask the scheduler policy how many samples each node gets
         2. Send chunks to peers for parallel training
         3. Each node trains its subset
         4. Aggregate results (here: train final model with all data)
         """
-        # Split data into chunks
-        chunks = self._split_data(inputs, outputs, num_nodes)
-        
-        # My chunk (leader trains first chunk)
-        my_inputs, my_outputs = chunks[0]
-        log(f"Leader training chunk 0: {len(my_inputs)} samples")
-        
-        my_model_path = self._train_chunk(my_inputs, my_outputs, chunk_id=0)
-        
-        if not my_model_path:
-            log("Leader chunk training failed")
-            return None
-        
-        partial_models = [my_model_path]
-        
-        # Send chunks to peers for parallel training
+        plan = SCHEDULER.plan(self.peers_info, len(inputs))
+        log(f"Scheduler {SCHEDULER.name}: " + ', '.join(f"{node_key(n)}={c}" for n, c in plan))
+
+        # Cut the chunks in plan order
+        chunks = []
+        start = 0
+        for chunk_id, (node, count) in enumerate(plan):
+            end = start + count
+            chunks.append((chunk_id, node, inputs[start:end], outputs[start:end]))
+            log(f"Chunk {chunk_id}: samples {start}-{end-1} ({count} total) -> {node_key(node)}")
+            start = end
+
+        partial_models = []
         threads = []
         results_lock = threading.Lock()
-        
-        for i, peer_addr in enumerate(self.peers_info):
-            if i + 1 >= len(chunks):
-                break
-            
-            peer_inputs, peer_outputs = chunks[i + 1]
-            
+
+        # Send chunks to peers for parallel training
+        for chunk_id, node, chunk_inputs, chunk_outputs in chunks:
+            if node == LOCAL:
+                continue
             t = threading.Thread(
-                target=self._send_train_to_peer,
-                args=(peer_addr, peer_inputs, peer_outputs, i+1, partial_models, results_lock)
+                target=self._scheduled_send_train,
+                args=(node, chunk_inputs, chunk_outputs, chunk_id, partial_models, results_lock)
             )
             threads.append(t)
             t.start()
-        
+
+        # Leader trains its own chunk meanwhile
+        for chunk_id, node, chunk_inputs, chunk_outputs in chunks:
+            if node != LOCAL:
+                continue
+            log(f"Leader training chunk {chunk_id}: {len(chunk_inputs)} samples")
+            began = time.monotonic()
+            my_model_path = self._train_chunk(chunk_inputs, chunk_outputs, chunk_id=chunk_id)
+            SCHEDULER.finished(LOCAL, len(chunk_inputs), time.monotonic() - began, bool(my_model_path))
+            if not my_model_path:
+                log("Leader chunk training failed")
+                return None, None
+            with results_lock:
+                partial_models.append(my_model_path)
+
         # Wait for all peers to finish training
         for t in threads:
             t.join(timeout=180)  # 3 minutes max per peer
@@ -258,41 +277,16 @@ class WorkerTCPHandler(threading.Thread):
         # (This is simpler than averaging weights)
         return self._aggregate_train(inputs, outputs)
 
-    def _split_data(self, inputs, outputs, num_chunks):
-        """
-        Split data into chunks for distributed training.
-        Uses modulo to distribute remainder samples evenly.
-        
-        Examples:
-          4 samples, 3 chunks -> [2, 1, 1]
-          10 samples, 3 chunks -> [4, 3, 3]
-          3 samples, 3 chunks -> [1, 1, 1]
-        """
-        total = len(inputs)
-        chunk_size = total // num_chunks
-        remainder = total % num_chunks  # Samples sobrantes
-        
-        chunks = []
-        start = 0
-        
-        for i in range(num_chunks):
-            # Los primeros 'remainder' chunks reciben 1 sample extra
-            current_size = chunk_size + (1 if i < remainder else 0)
-            end = start + current_size
-            
-            # Asegurar que no excedemos el total
-            end = min(end, total)
-            
-            chunk_inputs = inputs[start:end]
-            chunk_outputs = outputs[start:end]
-            
-            chunks.append((chunk_inputs, chunk_outputs))
-            
-            log(f"Chunk {i}: samples {start}-{end-1} ({len(chunk_inputs)} total)")
-            
-            start = end  # Mover el inicio al final del chunk actual
-        
-        return chunks
+    def _scheduled_send_train(self, peer_addr, inputs, outputs, chunk_id, results_list, lock):
+        """Send a chunk to a peer, reporting its load and duration to the scheduler."""
+        SCHEDULER.started(peer_addr, len(inputs))
+        with lock:
+            before = len(results_list)
+        began = time.monotonic()
+        self._send_train_to_peer(peer_addr, inputs, outputs, chunk_id, results_list, lock)
+        with lock:
+            ok = len(results_list) > before
+        SCHEDULER.finished(peer_addr, len(inputs), time.monotonic() - began, ok)
 
     def _train_chunk(self, inputs, outputs, chunk_id):
         """Train a model with a subset of data."""
@@ -578,6 +572,43 @@ class WorkerTCPHandler(threading.Thread):
 
         self._send_response({'status': 'OK', 'models': models})
 
+    def _handle_delete_model(self, msg):
+        """Handle DELETE_MODEL: replicate a DELETE_FILE entry so every replica drops the model."""
+        model_id = msg.get('model_id')
+        if not model_id:
+            self._send_response({'status': 'ERROR', 'message': 'Missing model_id'})
+            return
+
+        if not self.raft_node.is_leader():
+            leader = self.raft_node.leader
+            if leader:
+                self._send_response({'status': 'REDIRECT', 'leader': leader})
+                return
+            self._send_response({'status': 'ERROR', 'message': 'No leader available'})
+            return
+
+        model_path = self._find_model(model_id)
+        if not model_path:
+            self._send_response({'status': 'ERROR', 'message': f'Model not found: {model_id}'})
+            return
+
+        fname = os.path.basename(model_path)
+        match = re.search(r'model_(.+)\.bin', fname)
+        entry = {
+            'action': 'DELETE_FILE',
+            'filename': fname,
+            'model_id': match.group(1) if match else model_id
+        }
+        log(f"DELETE_MODEL request from {self.addr}: {entry['model_id']} ({fname})")
+
+        try:
+            if self.raft_node.replicate(entry):
+                self._send_response({'status': 'OK', 'model_id': entry['model_id']})
+            else:
+                self._send_response({'status': 'ERROR', 'message': 'Replication failed'})
+        except NotLeader as nl:
+            self._send_response({'status': 'REDIRECT', 'leader': nl.leader})
+
     def _handle_legacy_put(self, data):
         """Handle legacy PUT format for backward compatibility."""
         try:
@@ -659,7 +690,8 @@ class MonitorHandler(http.server.SimpleHTTPRequestHandler):
             'term': raft_node.current_term,
             'leader': raft_node.leader,
             'log_length': len(raft_node.log),
-            'commit_index': raft_node.commit_index
+            'commit_index': raft_node.commit_index,
+            'scheduler': SCHEDULER.describe()
         }
         self.wfile.write(json.dumps(status, indent=2).encode('utf-8'))
 
@@ -756,6 +788,9 @@ def main():
     parser.add_argument('--raft-port', type=int, default=10000, help='port for raft RPCs')
     parser.add_argument('--storage-dir', default=None, help='Directory to store files')
     parser.add_argument('--java-dir', default='java', help='Directory with Java classes')
+    parser.add_argument('--scheduler', choices=sorted(POLICIES), default=None,
+                        help='chunk placement policy for distributed training (default: round-robin)')
+    parser.add_argument('--scheduler-config', default=None, help='JSON file with scheduler settings')
     args = parser.parse_args()
 
     peers = []
@@ -764,7 +799,7 @@ def main():
         peers.append((h, int(po)))
 
     # Configure directories
-    global STORAGE_DIR, MODELS_DIR, LOG_FILE, JAVA_DIR
+    global STORAGE_DIR, MODELS_DIR, LOG_FILE, JAVA_DIR, SCHEDULER
     if args.storage_dir:
         STORAGE_DIR = args.storage_dir
     else:
@@ -772,6 +807,10 @@ def main():
     MODELS_DIR = os.path.join(STORAGE_DIR, 'models')
     LOG_FILE = os.path.join(STORAGE_DIR, f'worker.log')
     JAVA_DIR = args.java_dir
+    try:
+        SCHEDULER = load_scheduler(args.scheduler, args.scheduler_config)
+    except (OSError, ValueError) as e:
+        parser.error(f"scheduler: {e}")
 
     os.makedirs(STORAGE_DIR, exist_ok=True)
     os.makedirs(MODELS_DIR, exist_ok=True)
@@ -795,6 +834,9 @@ def main():
             if not fname or not data_b64:
                 log('STORE_FILE missing filename or data')
                 return
+            if fname in DELETED_FILES:
+                log(f"RAFT skipped STORE_FILE: {fname} belongs to a deleted model")
+                return
             try:
                 data = base64.b64decode(data_b64)
                 os.makedirs(MODELS_DIR, exist_ok=True)
@@ -806,10 +848,31 @@ def main():
                 log(f"Error applying STORE_FILE: {e}")
             return
 
+        # DELETE_FILE removes a model everywhere and leaves a tombstone
+        if action == 'DELETE_FILE':
+            fname = command.get('filename')
+            if not fname or os.path.basename(fname) != fname or fname in ('.', '..'):
+                log(f"DELETE_FILE with unsafe filename: {fname!r}")
+                return
+            DELETED_FILES.add(fname)
+            path = os.path.join(MODELS_DIR, fname)
+            try:
+                os.remove(path)
+            except FileNotFoundError:
+                pass
+            except Exception as e:
+                log(f"Error applying DELETE_FILE: {e}")
+                return
+            log(f"RAFT applied DELETE_FILE: {path} (model {command.get('model_id')})")
+            return
+
         # Handle legacy entries that only include filename + data_b64
         if isinstance(command, dict) and 'filename' in command and 'data_b64' in command:
             try:
                 fname = command.get('filename')
+                if fname in DELETED_FILES:
+                    log(f"RAFT skipped legacy file: {fname} belongs to a deleted model")
+                    return
                 data = base64.b64decode(command.get('data_b64'))
                 # decide destination: models if filename looks like model_*.bin, otherwise storage
                 if fname.startswith('model_') or (isinstance(command.get('meta'), dict) and 'model_id' in command.get('meta')):
@@ -0,0 +1,38 @@
+from src import scheduler
+
+
+PEERS = [('10.0.0.2', 9001), ('10.0.0.3', 9002)]
+
+
+def test_split_by_weight_keeps_total():
+    assert scheduler.split_by_weight(10, [1, 1, 1]) == [4, 3, 3]
+    assert scheduler.split_by_weight(7, [2, 0, 1]) == [5, 0, 2]
+    assert scheduler.split_by_weight(0, [1, 1]) == [0, 0]
+
+
+def test_round_robin_rotates():
+    policy = scheduler.load_scheduler('round-robin')
+    first = policy.plan(PEERS, 10)
+    second = policy.plan(PEERS, 10)
+    assert first[0] == (scheduler.LOCAL, 4)
+    assert second[0] == (PEERS[0], 4)
+    assert sum(c for _, c in second) == 10
+
+
+def test_capability_weights():
+    policy = scheduler.CapabilityWeightedPolicy({'capabilities': {'local': 2, '10.0.0.2:9001': 4}})
+    assert policy.plan(PEERS, 14) == [(scheduler.LOCAL, 4), (PEERS[0], 8), (PEERS[1], 2)]
+
+
+def test_locality_prefers_same_zone():
+    policy = scheduler.LocalityAwarePolicy({'zone': 'a', 'zones': {'10.0.0.2:9001': 'a'}})
+    assert policy.plan(PEERS, 9) == [(scheduler.LOCAL, 4), (PEERS[0], 4), (PEERS[1], 1)]
+
+
+def test_least_loaded_avoids_slow_and_busy_nodes():
+    policy = scheduler.LeastLoadedPolicy()
+    policy.finished(scheduler.LOCAL, 10, 1.0, True)
+    policy.finished(PEERS[0], 10, 10.0, True)
+    policy.started(PEERS[1], 5)
+    plan = dict(policy.plan(PEERS, 12))
+    assert plan[scheduler.LOCAL] > plan[PEERS[1]] >= plan[PEERS[0]]